@@ -0,0 +1,357 @@
+package libprobe
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+const KindACME = "ACME"
+
+// acmeMaxBody bounds the bodies read, ACME objects being small.
+const acmeMaxBody = 1 << 20
+
+// ACMEProberOptions configures an ACMEProber.
+type ACMEProberOptions struct {
+	// Identifier is the DNS name ordered, e.g. "probe.internal.example".
+	// The order is never finalized, so no certificate is issued.
+	Identifier string
+	// AccountKey is the key of the account ordering, an ECDSA P-256 or RSA
+	// key. Default: a new key at every probe, and so a new account; set it
+	// to reuse an account with CAs limiting account creation.
+	AccountKey crypto.Signer
+	// Contact are the contact URLs of the account, e.g.
+	// "mailto:pki@example.com".
+	Contact []string
+	// TLSConfig configures TLS, e.g. RootCAs to verify the certificate of
+	// an internal CA.
+	TLSConfig *tls.Config
+}
+
+// ACMEProblem is an error document of an ACME server (RFC 8555 6.7).
+type ACMEProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *ACMEProblem) Error() string {
+	if p.Detail == "" {
+		return "acme: " + p.Type
+	}
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+// ACMEResult describes the steps of an issuance dry run. A step failing
+// with an error document of the server sets Problem along with Error.
+type ACMEResult struct {
+	Target
+	Error   error
+	Problem *ACMEProblem
+
+	// Step is the step failing, empty on success.
+	Step              string
+	DirectoryTime     time.Duration
+	NonceTime         time.Duration
+	AccountTime       time.Duration
+	OrderTime         time.Duration
+	AuthorizationTime time.Duration
+	TotalTime         time.Duration
+	// AccountURL and OrderURL are the URLs of the account and order.
+	AccountURL string
+	OrderURL   string
+	// OrderStatus is the status of the new order, "pending" unless the CA
+	// has valid authorizations for the identifier.
+	OrderStatus string
+	// Challenges are the challenge types offered for the identifier, e.g.
+	// "http-01" and "dns-01".
+	Challenges []string
+}
+
+func (r ACMEResult) RTT() time.Duration {
+	return r.DirectoryTime
+}
+
+func (r ACMEResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %s: %v", r.Target.Address, r.Step, r.Error)
+	}
+	return fmt.Sprintf("-> %s order %s Directory: %s, Nonce: %s, Account: %s, Order: %s, Authorization: %s. Total: %s",
+		r.Target.Address, r.OrderStatus, r.DirectoryTime, r.NonceTime, r.AccountTime, r.OrderTime, r.AuthorizationTime, r.TotalTime)
+}
+
+// ACMEProber exercises the issuance path of the ACME server (RFC 8555) whose
+// directory URL is Target.Address, e.g. an internal step-ca or Vault: it
+// reads the directory, gets a nonce, registers an account, places an order
+// for ACMEProberOptions.Identifier and reads its authorization, without
+// answering challenges or finalizing.
+type ACMEProber struct {
+	opts ACMEProberOptions
+}
+
+func NewACMEProber(opts ACMEProberOptions) *ACMEProber {
+	return &ACMEProber{opts: opts}
+}
+
+func (p *ACMEProber) Kind() string {
+	return KindACME
+}
+
+func (p *ACMEProber) Probe(target Target) (Result, error) {
+	if p.opts.Identifier == "" {
+		return nil, errors.New("acme: no identifier")
+	}
+	key := p.opts.AccountKey
+	if key == nil {
+		var err error
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+	}
+	jwk, err := acmeJWK(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	r := &ACMEResult{Target: target}
+	client := &http.Client{Timeout: target.Timeout, Transport: &http.Transport{DialContext: meteredDial(target.meter), TLSClientConfig: p.opts.TLSConfig}}
+	defer client.CloseIdleConnections()
+	c := &acmeClient{client: client, key: key, jwk: jwk}
+	startAt := time.Now()
+	r.Step, r.Error = p.run(r, c, target.Address)
+	r.TotalTime = time.Since(startAt)
+	errors.As(r.Error, &r.Problem)
+	return r, nil
+}
+
+// run performs the steps, returning the last one started.
+func (p *ACMEProber) run(r *ACMEResult, c *acmeClient, directoryURL string) (string, error) {
+	stepAt := time.Now()
+	var directory struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+	req, err := http.NewRequest(http.MethodGet, directoryURL, nil)
+	if err != nil {
+		return "directory", err
+	}
+	if _, err := c.do(req, &directory); err != nil {
+		return "directory", err
+	}
+	r.DirectoryTime = time.Since(stepAt)
+	if directory.NewNonce == "" || directory.NewAccount == "" || directory.NewOrder == "" {
+		return "directory", errors.New("acme: incomplete directory")
+	}
+
+	stepAt = time.Now()
+	if req, err = http.NewRequest(http.MethodHead, directory.NewNonce, nil); err != nil {
+		return "nonce", err
+	}
+	if _, err := c.do(req, nil); err != nil {
+		return "nonce", err
+	}
+	if c.nonce == "" {
+		return "nonce", errors.New("acme: no nonce")
+	}
+	r.NonceTime = time.Since(stepAt)
+
+	stepAt = time.Now()
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if len(p.opts.Contact) > 0 {
+		account["contact"] = p.opts.Contact
+	}
+	resp, err := c.post(directory.NewAccount, account, nil)
+	if err != nil {
+		return "account", err
+	}
+	r.AccountTime = time.Since(stepAt)
+	if r.AccountURL = resp.Header.Get("Location"); r.AccountURL == "" {
+		return "account", errors.New("acme: no account URL")
+	}
+	c.kid = r.AccountURL
+
+	stepAt = time.Now()
+	var order struct {
+		Status         string   `json:"status"`
+		Authorizations []string `json:"authorizations"`
+	}
+	identifiers := []map[string]string{{"type": "dns", "value": p.opts.Identifier}}
+	if resp, err = c.post(directory.NewOrder, map[string]interface{}{"identifiers": identifiers}, &order); err != nil {
+		return "order", err
+	}
+	r.OrderTime = time.Since(stepAt)
+	r.OrderURL = resp.Header.Get("Location")
+	r.OrderStatus = order.Status
+	if len(order.Authorizations) == 0 {
+		return "order", errors.New("acme: no authorization in the order")
+	}
+
+	stepAt = time.Now()
+	var authz struct {
+		Challenges []struct {
+			Type string `json:"type"`
+		} `json:"challenges"`
+	}
+	if _, err := c.post(order.Authorizations[0], nil, &authz); err != nil {
+		return "authorization", err
+	}
+	r.AuthorizationTime = time.Since(stepAt)
+	for _, ch := range authz.Challenges {
+		r.Challenges = append(r.Challenges, ch.Type)
+	}
+	return "", nil
+}
+
+// acmeClient sends the requests of an account, keeping the latest nonce.
+type acmeClient struct {
+	client *http.Client
+	key    crypto.Signer
+	jwk    map[string]string
+	// kid is the account URL, identifying the key once the account exists.
+	kid   string
+	nonce string
+}
+
+// do sends req and decodes the JSON response into v, unless nil. Error
+// documents are returned as *ACMEProblem.
+func (c *acmeClient) do(req *http.Request, v interface{}) (*http.Response, error) {
+	req.Header.Set("User-Agent", UserAgent())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.nonce = nonce
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, acmeMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		problem := &ACMEProblem{}
+		if json.Unmarshal(body, problem) != nil || problem.Type == "" {
+			return nil, fmt.Errorf("acme: %s", resp.Status)
+		}
+		if problem.Status == 0 {
+			problem.Status = resp.StatusCode
+		}
+		return nil, problem
+	}
+	if v != nil {
+		if err := json.Unmarshal(body, v); err != nil {
+			return nil, fmt.Errorf("acme: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+// post sends payload to url signed with JWS, or a POST-as-GET when payload
+// is nil. A request refused for a bad nonce is retried once, with the
+// fresh nonce of the refusal, as RFC 8555 6.5 has clients do.
+func (c *acmeClient) post(url string, payload interface{}, v interface{}) (*http.Response, error) {
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	for retried := false; ; retried = true {
+		body, err := c.sign(url, data)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := c.do(req, v)
+		var problem *ACMEProblem
+		if !retried && errors.As(err, &problem) && problem.Type == "urn:ietf:params:acme:error:badNonce" {
+			continue
+		}
+		return resp, err
+	}
+}
+
+// sign returns the flattened JWS of payload for url.
+func (c *acmeClient) sign(url string, payload []byte) ([]byte, error) {
+	protected := map[string]interface{}{"nonce": c.nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = c.jwk
+	}
+	hash := crypto.SHA256
+	switch pub := c.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		protected["alg"] = "ES256"
+	case *rsa.PublicKey:
+		protected["alg"] = "RS256"
+	default:
+		return nil, fmt.Errorf("acme: unsupported key type %T", pub)
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	b64 := base64.RawURLEncoding
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := c.key.Sign(rand.Reader, digest[:], hash)
+	if err != nil {
+		return nil, err
+	}
+	// JWS has ECDSA signatures as the fixed-size r and s, not ASN.1.
+	if _, ok := c.key.Public().(*ecdsa.PublicKey); ok {
+		var parsed struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &parsed); err != nil {
+			return nil, err
+		}
+		sig = make([]byte, 64)
+		parsed.R.FillBytes(sig[:32])
+		parsed.S.FillBytes(sig[32:])
+	}
+	// The nonce is used up, a new one coming with the response.
+	c.nonce = ""
+	return json.Marshal(map[string]string{
+		"protected": b64.EncodeToString(header),
+		"payload":   b64.EncodeToString(payload),
+		"signature": b64.EncodeToString(sig),
+	})
+}
+
+// acmeJWK returns the JSON Web Key of pub, an ECDSA P-256 or RSA key.
+func acmeJWK(pub crypto.PublicKey) (map[string]string, error) {
+	b64 := base64.RawURLEncoding
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errors.New("acme: only P-256 ECDSA keys are supported")
+		}
+		x, y := make([]byte, 32), make([]byte, 32)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		return map[string]string{"kty": "EC", "crv": "P-256", "x": b64.EncodeToString(x), "y": b64.EncodeToString(y)}, nil
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "n": b64.EncodeToString(pub.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())}, nil
+	}
+	return nil, fmt.Errorf("acme: unsupported key type %T", pub)
+}
@@ -0,0 +1,158 @@
+package libprobe_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveACME runs an ACME server checking ES256 signatures and nonces,
+// refusing the first nonce of every new order and the identifier
+// "bad.example".
+func serveACME(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	nonces := 0
+	fresh := map[string]bool{}
+	keys := map[string]*ecdsa.PublicKey{}
+	refused := map[string]bool{}
+	b64 := base64.RawURLEncoding
+
+	var srv *httptest.Server
+	problem := func(w http.ResponseWriter, status int, typ, detail string) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"type": "urn:ietf:params:acme:error:%s", "detail": %q}`, typ, detail)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"newNonce": "%[1]s/nonce", "newAccount": "%[1]s/account", "newOrder": "%[1]s/order"}`, srv.URL)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		nonces++
+		nonce := fmt.Sprint(nonces)
+		fresh[nonce] = true
+		w.Header().Set("Replay-Nonce", nonce)
+		if req.URL.Path == "/nonce" {
+			return
+		}
+
+		var jws struct{ Protected, Payload, Signature string }
+		if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+			problem(w, 400, "malformed", err.Error())
+			return
+		}
+		header, _ := b64.DecodeString(jws.Protected)
+		var protected struct {
+			Alg, Nonce, URL, Kid string
+			JWK                  struct{ X, Y string }
+		}
+		json.Unmarshal(header, &protected)
+		key := keys[protected.Kid]
+		if protected.Kid == "" {
+			x, _ := b64.DecodeString(protected.JWK.X)
+			y, _ := b64.DecodeString(protected.JWK.Y)
+			key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+		sig, _ := b64.DecodeString(jws.Signature)
+		digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+		if key == nil || protected.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			problem(w, 401, "unauthorized", "bad signature")
+			return
+		}
+		if protected.URL != srv.URL+req.URL.Path {
+			problem(w, 401, "unauthorized", "bad url")
+			return
+		}
+		if !fresh[protected.Nonce] || (req.URL.Path == "/order" && !refused[protected.Kid]) {
+			refused[protected.Kid] = true
+			problem(w, 400, "badNonce", "")
+			return
+		}
+		delete(fresh, protected.Nonce)
+		payload, _ := b64.DecodeString(jws.Payload)
+
+		switch req.URL.Path {
+		case "/account":
+			kid := srv.URL + "/account/" + fmt.Sprint(len(keys)+1)
+			keys[kid] = key
+			w.Header().Set("Location", kid)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"status": "valid"}`)
+		case "/order":
+			if strings.Contains(string(payload), "bad.example") {
+				problem(w, 400, "rejectedIdentifier", "bad.example is forbidden by policy")
+				return
+			}
+			w.Header().Set("Location", srv.URL+"/order/1")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"status": "pending", "authorizations": ["%s/authz/1"], "finalize": "%[1]s/order/1/finalize"}`, srv.URL)
+		case "/authz/1":
+			if len(payload) != 0 {
+				problem(w, 400, "malformed", "POST-as-GET expected")
+				return
+			}
+			fmt.Fprint(w, `{"status": "pending", "challenges": [{"type": "http-01"}, {"type": "dns-01"}, {"type": "tls-alpn-01"}]}`)
+		default:
+			problem(w, 404, "malformed", "not found")
+		}
+	})
+	srv = httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestACMEProber(t *testing.T) {
+	srv := serveACME(t)
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	target := libprobe.Target{Address: srv.URL + "/directory", Timeout: 5 * time.Second}
+
+	p := libprobe.NewACMEProber(libprobe.ACMEProberOptions{
+		Identifier: "probe.internal.example",
+		Contact:    []string{"mailto:pki@example.com"},
+		TLSConfig:  &tls.Config{RootCAs: roots},
+	})
+	require.Equal(t, libprobe.KindACME, p.Kind())
+	r, err := p.Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.ACMEResult)
+	require.NoError(t, res.Error)
+	require.Empty(t, res.Step)
+	require.Equal(t, srv.URL+"/account/1", res.AccountURL)
+	require.Equal(t, srv.URL+"/order/1", res.OrderURL)
+	require.Equal(t, "pending", res.OrderStatus)
+	require.Equal(t, []string{"http-01", "dns-01", "tls-alpn-01"}, res.Challenges)
+	require.Positive(t, res.DirectoryTime)
+	require.Positive(t, res.NonceTime)
+	require.Positive(t, res.AccountTime)
+	require.Positive(t, res.OrderTime)
+	require.Positive(t, res.AuthorizationTime)
+
+	p = libprobe.NewACMEProber(libprobe.ACMEProberOptions{Identifier: "bad.example", TLSConfig: &tls.Config{RootCAs: roots}})
+	r, err = p.Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.ACMEResult)
+	require.Equal(t, "order", res.Step)
+	require.EqualError(t, res.Error, "acme: urn:ietf:params:acme:error:rejectedIdentifier: bad.example is forbidden by policy")
+	require.Equal(t, 400, res.Problem.Status)
+
+	_, err = libprobe.NewACMEProber(libprobe.ACMEProberOptions{}).Probe(target)
+	require.Error(t, err)
+}
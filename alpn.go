@@ -0,0 +1,165 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindALPN = "ALPN"
+
+// ALPNCase is a handshake of an ALPNProber.
+type ALPNCase struct {
+	// Offer are the protocols offered, none when empty.
+	Offer []string
+	// Expect, when set, is the protocol the server must select.
+	Expect string
+}
+
+// DefaultALPNCases offer the protocols of the web one by one and together,
+// along with those a TCP server shouldn't select: h3, which runs over QUIC,
+// and acme-tls/1, reserved for ACME TLS-ALPN-01 challenges.
+var DefaultALPNCases = []ALPNCase{
+	{Offer: []string{"h2", "http/1.1"}},
+	{Offer: []string{"h2"}},
+	{Offer: []string{"http/1.1"}},
+	{Offer: []string{"h3"}},
+	{Offer: []string{"acme-tls/1"}},
+	{},
+}
+
+// ALPSUnsupported is the ALPS status of every ALPNResult: application
+// settings (ALPS), exchanged along the selected protocol, are neither
+// offered nor reported, crypto/tls lacking support for the extension.
+const ALPSUnsupported = "unsupported"
+
+// ALPNProberOptions configures an ALPNProber.
+type ALPNProberOptions struct {
+	// ServerName is sent in the SNI extension. Default: the host of
+	// Target.Address.
+	ServerName string
+	// Cases are the handshakes performed, in order. Default:
+	// DefaultALPNCases.
+	Cases []ALPNCase
+}
+
+// ALPNNegotiation is the outcome of an ALPNCase.
+type ALPNNegotiation struct {
+	ALPNCase
+	// Error is the error of the handshake, or the unmet expectation.
+	Error error
+	// Selected is the protocol selected by the server, empty when none.
+	Selected      string
+	Version       string
+	HandshakeTime time.Duration
+}
+
+// ALPNResult holds the protocol selected by a server for each set of
+// protocols offered.
+type ALPNResult struct {
+	Target
+	// Error is set when a case with an expectation failed.
+	Error        error
+	Negotiations []ALPNNegotiation
+	TotalTime    time.Duration
+	// ALPS is always ALPSUnsupported.
+	ALPS string
+}
+
+func (r ALPNResult) RTT() time.Duration {
+	return r.TotalTime
+}
+
+func (r ALPNResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "-> %s alps=%s", r.Target.Address, r.ALPS)
+	if r.Error != nil {
+		fmt.Fprintf(&b, ": %v", r.Error)
+	}
+	for _, n := range r.Negotiations {
+		selected := n.Selected
+		if n.Error != nil {
+			selected = n.Error.Error()
+		} else if selected == "" {
+			selected = "(none)"
+		}
+		fmt.Fprintf(&b, "\n[%s] -> %s", strings.Join(n.Offer, ","), selected)
+	}
+	return b.String()
+}
+
+// ALPNProber performs one TLS handshake with Target.Address, "host" or
+// "host:port" with port 443 by default, per set of ALPN protocols, and
+// reports the protocol the server selects for each. A single handshake
+// offering the usual protocols hides servers refusing h2 alone, or
+// selecting h3 or acme-tls/1 outside of QUIC and ACME challenges. Each
+// handshake has Target.Timeout. Certificates aren't verified, as
+// TLSProber does. ALPS isn't probed, see ALPSUnsupported.
+type ALPNProber struct {
+	opts ALPNProberOptions
+}
+
+func NewALPNProber(opts ALPNProberOptions) *ALPNProber {
+	if opts.Cases == nil {
+		opts.Cases = DefaultALPNCases
+	}
+	return &ALPNProber{opts: opts}
+}
+
+func (p *ALPNProber) Kind() string {
+	return KindALPN
+}
+
+func (p *ALPNProber) Probe(target Target) (Result, error) {
+	r := &ALPNResult{Target: target, ALPS: ALPSUnsupported}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "443")
+	}
+	host, _, _ := net.SplitHostPort(address)
+	startAt := time.Now()
+	expected, failed := 0, 0
+	for _, c := range p.opts.Cases {
+		n := ALPNNegotiation{ALPNCase: c}
+		config := unverifiedTLSConfig(&tls.Config{ServerName: p.opts.ServerName, NextProtos: c.Offer}, host)
+		n.Selected, n.Version, n.HandshakeTime, n.Error = alpnHandshake(target.meter, address, config, target.Timeout)
+		if n.Error == nil && c.Expect != "" && n.Selected != c.Expect {
+			n.Error = fmt.Errorf("alpn: the server selected %q instead of %q", n.Selected, c.Expect)
+		}
+		if c.Expect != "" {
+			expected++
+			if n.Error != nil {
+				failed++
+			}
+		}
+		r.Negotiations = append(r.Negotiations, n)
+	}
+	r.TotalTime = time.Since(startAt)
+	if failed > 0 {
+		r.Error = fmt.Errorf("alpn: %d of %d expectations failed", failed, expected)
+	}
+	return r, nil
+}
+
+// alpnHandshake performs a handshake with config, returning the protocol
+// and version negotiated.
+func alpnHandshake(meter *trafficMeter, address string, config *tls.Config, timeout time.Duration) (string, string, time.Duration, error) {
+	startAt := time.Now()
+	conn, err := dialTimeout(meter, "tcp", address, timeout)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(timeout))
+	}
+	handshakeAt := time.Now()
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return "", "", 0, err
+	}
+	state := tlsConn.ConnectionState()
+	return state.NegotiatedProtocol, tlsVersionName(state.Version), time.Since(handshakeAt), nil
+}
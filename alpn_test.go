@@ -0,0 +1,63 @@
+package libprobe_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestALPNProber(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	srv.StartTLS()
+	defer srv.Close()
+	target := libprobe.Target{Address: srv.Listener.Addr().String(), Timeout: 5 * time.Second}
+
+	r, err := libprobe.NewALPNProber(libprobe.ALPNProberOptions{}).Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.ALPNResult)
+	require.NoError(t, res.Error)
+	require.Len(t, res.Negotiations, len(libprobe.DefaultALPNCases))
+	require.Equal(t, libprobe.ALPSUnsupported, res.ALPS)
+	require.Equal(t, libprobe.ALPSUnsupported, libprobe.Flatten(r)[0]["alps"])
+	selected := make(map[string]string)
+	for _, n := range res.Negotiations {
+		if len(n.Offer) > 0 {
+			selected[n.Offer[0]+"/"+n.Offer[len(n.Offer)-1]] = n.Selected
+		}
+		if n.Error == nil {
+			require.Equal(t, "TLS 1.3", n.Version)
+		}
+	}
+	require.Equal(t, map[string]string{
+		"h2/http/1.1":           "h2",
+		"h2/h2":                 "h2",
+		"http/1.1/http/1.1":     "http/1.1",
+		"h3/h3":                 "",
+		"acme-tls/1/acme-tls/1": "",
+	}, selected)
+	// Servers refuse handshakes without a protocol in common.
+	require.Error(t, res.Negotiations[3].Error)
+	require.NoError(t, res.Negotiations[5].Error)
+	require.Empty(t, res.Negotiations[5].Selected)
+
+	r, err = libprobe.NewALPNProber(libprobe.ALPNProberOptions{Cases: []libprobe.ALPNCase{
+		{Offer: []string{"http/1.1", "h2"}, Expect: "h2"},
+		{Offer: []string{"http/1.1"}, Expect: "h2"},
+		{Offer: []string{"h3"}},
+	}}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.ALPNResult)
+	require.EqualError(t, res.Error, "alpn: 1 of 2 expectations failed")
+	require.NoError(t, res.Negotiations[0].Error)
+	require.Error(t, res.Negotiations[1].Error)
+	require.Equal(t, "http/1.1", res.Negotiations[1].Selected)
+	require.Error(t, res.Negotiations[2].Error)
+}
@@ -0,0 +1,453 @@
+package libprobe
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const KindAMQP = "AMQP"
+
+// amqpProtocolHeader opens an AMQP 0-9-1 connection.
+var amqpProtocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xce
+	// amqpMaxFrame bounds the frames read before tuning, 128KB by default
+	// on RabbitMQ.
+	amqpMaxFrame = 1 << 20
+)
+
+// Methods of the connection class, as class and method IDs.
+const (
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+)
+
+// AMQPProberOptions configures an AMQPProber.
+type AMQPProberOptions struct {
+	// TLS connects with TLS, configured by TLSConfig, whose ServerName
+	// defaults to the host dialed, on port 5671 by default instead of
+	// 5672.
+	TLS       bool
+	TLSConfig *tls.Config
+	// Username and Password, when set, authenticate with PLAIN and open
+	// VirtualHost, "/" by default. Otherwise the connection is dropped
+	// after connection.start.
+	Username    string
+	Password    string
+	VirtualHost string
+}
+
+// AMQPResult describes the negotiation of an AMQP 0-9-1 connection.
+type AMQPResult struct {
+	Target
+	Error error
+
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	// StartTime is the time from the protocol header to connection.start,
+	// AuthTime that from connection.start-ok to connection.tune and
+	// OpenTime that of connection.open.
+	StartTime time.Duration
+	AuthTime  time.Duration
+	OpenTime  time.Duration
+	TotalTime time.Duration
+	// Version is the protocol version of connection.start, e.g. "0-9".
+	Version string
+	// Product, ServerVersion, Platform and ClusterName are server
+	// properties, and Capabilities those of its capabilities set.
+	Product       string
+	ServerVersion string
+	Platform      string
+	ClusterName   string
+	Capabilities  []string
+	Mechanisms    []string
+	// ChannelMax, FrameMax and Heartbeat are proposed by connection.tune.
+	ChannelMax uint16
+	FrameMax   uint32
+	Heartbeat  time.Duration
+}
+
+func (r AMQPResult) RTT() time.Duration {
+	return r.StartTime
+}
+
+func (r AMQPResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	return fmt.Sprintf("-> %s %s %s Connect: %s, TLS Handshake: %s, Start: %s, Auth: %s, Open: %s. Total: %s",
+		r.Target.Address, r.Product, r.ServerVersion, r.ConnectTime, r.TLSHandshakeTime, r.StartTime, r.AuthTime, r.OpenTime, r.TotalTime)
+}
+
+// AMQPProber negotiates an AMQP 0-9-1 connection with the broker in
+// Target.Address, "host" or "host:port", such as RabbitMQ, and reports its
+// properties. With credentials, the connection is opened and closed
+// cleanly.
+type AMQPProber struct {
+	opts AMQPProberOptions
+}
+
+func NewAMQPProber(opts AMQPProberOptions) *AMQPProber {
+	if opts.VirtualHost == "" {
+		opts.VirtualHost = "/"
+	}
+	return &AMQPProber{opts: opts}
+}
+
+func (p *AMQPProber) Kind() string {
+	return KindAMQP
+}
+
+func (p *AMQPProber) Probe(target Target) (Result, error) {
+	r := &AMQPResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "5672"
+		if p.opts.TLS {
+			port = "5671"
+		}
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+	if p.opts.TLS {
+		handshakeAt := time.Now()
+		tlsConn := tls.Client(conn, mailTLSConfig(p.opts.TLSConfig, address))
+		if err := tlsConn.Handshake(); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.TLSHandshakeTime = time.Since(handshakeAt)
+		conn = tlsConn
+	}
+	r.Error = p.negotiate(r, &amqpConn{conn: conn, br: bufio.NewReader(conn)})
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+func (p *AMQPProber) negotiate(r *AMQPResult, c *amqpConn) error {
+	startAt := time.Now()
+	if _, err := c.conn.Write(amqpProtocolHeader); err != nil {
+		return err
+	}
+	// Brokers not speaking 0-9-1 answer with the header of their version.
+	if b, err := c.br.Peek(4); err == nil && string(b) == "AMQP" {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(c.br, header); err != nil {
+			return err
+		}
+		return fmt.Errorf("amqp: the broker speaks AMQP %d-%d-%d", header[5], header[6], header[7])
+	}
+	d, err := c.readMethod(amqpConnectionStart)
+	if err != nil {
+		return err
+	}
+	r.StartTime = time.Since(startAt)
+	major, minor := d.octet(), d.octet()
+	r.Version = fmt.Sprintf("%d-%d", major, minor)
+	properties := d.table()
+	r.Mechanisms = strings.Fields(d.longString())
+	d.longString() // locales
+	if d.err != nil {
+		return d.err
+	}
+	r.Product, _ = properties["product"].(string)
+	r.ServerVersion, _ = properties["version"].(string)
+	r.Platform, _ = properties["platform"].(string)
+	r.ClusterName, _ = properties["cluster_name"].(string)
+	capabilities, _ := properties["capabilities"].(map[string]interface{})
+	for name, v := range capabilities {
+		if v == true {
+			r.Capabilities = append(r.Capabilities, name)
+		}
+	}
+	sort.Strings(r.Capabilities)
+	if p.opts.Username == "" {
+		return nil
+	}
+
+	if !stringsContain(r.Mechanisms, "PLAIN") {
+		return errors.New("amqp: the broker doesn't offer PLAIN")
+	}
+	// authentication_failure_close has RabbitMQ explain authentication
+	// failures with connection.close rather than dropping the connection.
+	var e amqpEncoder
+	e.table(map[string]interface{}{
+		"product":      "libprobe",
+		"capabilities": map[string]interface{}{"authentication_failure_close": true},
+	})
+	e.shortString("PLAIN")
+	e.longString("\x00" + p.opts.Username + "\x00" + p.opts.Password)
+	e.shortString("en_US")
+	authAt := time.Now()
+	if err := c.writeMethod(amqpConnectionStartOk, e.b); err != nil {
+		return err
+	}
+	if d, err = c.readMethod(amqpConnectionTune); err != nil {
+		return err
+	}
+	r.AuthTime = time.Since(authAt)
+	r.ChannelMax, r.FrameMax = d.short(), d.long()
+	r.Heartbeat = time.Duration(d.short()) * time.Second
+	if d.err != nil {
+		return d.err
+	}
+	e = amqpEncoder{}
+	e.short(r.ChannelMax)
+	e.long(r.FrameMax)
+	// Heartbeats are disabled, the connection being short lived.
+	e.short(0)
+	if err := c.writeMethod(amqpConnectionTuneOk, e.b); err != nil {
+		return err
+	}
+
+	e = amqpEncoder{}
+	e.shortString(p.opts.VirtualHost)
+	e.shortString("")
+	e.b = append(e.b, 0)
+	openAt := time.Now()
+	if err := c.writeMethod(amqpConnectionOpen, e.b); err != nil {
+		return err
+	}
+	if _, err := c.readMethod(amqpConnectionOpenOk); err != nil {
+		return err
+	}
+	r.OpenTime = time.Since(openAt)
+
+	e = amqpEncoder{}
+	e.short(200)
+	e.shortString("Goodbye")
+	e.short(0)
+	e.short(0)
+	if err := c.writeMethod(amqpConnectionClose, e.b); err != nil {
+		return err
+	}
+	_, err = c.readMethod(amqpConnectionCloseOk)
+	return err
+}
+
+// amqpConn reads and writes the frames of channel 0.
+type amqpConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func (c *amqpConn) writeMethod(method uint32, args []byte) error {
+	frame := []byte{amqpFrameMethod, 0, 0}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(4+len(args)))
+	frame = binary.BigEndian.AppendUint32(frame, method)
+	frame = append(append(frame, args...), amqpFrameEnd)
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// readMethod reads the next method, which must be method, and returns a
+// decoder of its arguments. A connection.close from the broker is
+// acknowledged and returned as an error.
+func (c *amqpConn) readMethod(method uint32) (*amqpDecoder, error) {
+	for {
+		var header [7]byte
+		if _, err := io.ReadFull(c.br, header[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(header[3:])
+		if n > amqpMaxFrame {
+			return nil, errors.New("amqp: frame too large")
+		}
+		payload := make([]byte, n+1)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return nil, err
+		}
+		if payload[n] != amqpFrameEnd {
+			return nil, errors.New("amqp: malformed frame")
+		}
+		if header[0] == amqpFrameHeartbeat {
+			continue
+		}
+		if header[0] != amqpFrameMethod || n < 4 {
+			return nil, fmt.Errorf("amqp: unexpected frame type %d", header[0])
+		}
+		d := &amqpDecoder{b: payload[4:n]}
+		switch got := binary.BigEndian.Uint32(payload); got {
+		case method:
+			return d, nil
+		case amqpConnectionClose:
+			code, text := d.short(), d.shortString()
+			_ = c.writeMethod(amqpConnectionCloseOk, nil)
+			return nil, fmt.Errorf("amqp: connection closed by the broker: %d %s", code, text)
+		default:
+			return nil, fmt.Errorf("amqp: unexpected method %d.%d", got>>16, got&0xffff)
+		}
+	}
+}
+
+// amqpEncoder encodes method arguments.
+type amqpEncoder struct {
+	b []byte
+}
+
+func (e *amqpEncoder) short(v uint16) { e.b = binary.BigEndian.AppendUint16(e.b, v) }
+func (e *amqpEncoder) long(v uint32)  { e.b = binary.BigEndian.AppendUint32(e.b, v) }
+
+func (e *amqpEncoder) shortString(s string) {
+	e.b = append(append(e.b, byte(len(s))), s...)
+}
+
+func (e *amqpEncoder) longString(s string) {
+	e.long(uint32(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// table encodes a field table of strings, booleans and tables.
+func (e *amqpEncoder) table(t map[string]interface{}) {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields amqpEncoder
+	for _, name := range names {
+		fields.shortString(name)
+		switch v := t[name].(type) {
+		case string:
+			fields.b = append(fields.b, 'S')
+			fields.longString(v)
+		case bool:
+			fields.b = append(fields.b, 't', 0)
+			if v {
+				fields.b[len(fields.b)-1] = 1
+			}
+		case map[string]interface{}:
+			fields.b = append(fields.b, 'F')
+			fields.table(v)
+		}
+	}
+	e.long(uint32(len(fields.b)))
+	e.b = append(e.b, fields.b...)
+}
+
+var errAMQPMalformed = errors.New("amqp: malformed method")
+
+// amqpDecoder reads method arguments, remembering the first error.
+type amqpDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *amqpDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = errAMQPMalformed
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *amqpDecoder) octet() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *amqpDecoder) short() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *amqpDecoder) long() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *amqpDecoder) shortString() string {
+	return string(d.take(int(d.octet())))
+}
+
+func (d *amqpDecoder) longString() string {
+	return string(d.take(int(d.long())))
+}
+
+// table decodes a field table. Strings, booleans and tables are decoded,
+// values of other types skipped.
+func (d *amqpDecoder) table() map[string]interface{} {
+	fields := &amqpDecoder{b: d.take(int(d.long()))}
+	t := make(map[string]interface{})
+	for d.err == nil && fields.err == nil && len(fields.b) > 0 {
+		name := fields.shortString()
+		if v, ok := fields.value(); ok {
+			t[name] = v
+		}
+	}
+	if d.err == nil {
+		d.err = fields.err
+	}
+	return t
+}
+
+// value decodes a field value of the types of RabbitMQ, returning whether
+// its type is decoded.
+func (d *amqpDecoder) value() (interface{}, bool) {
+	var size int
+	switch typ := d.octet(); typ {
+	case 't':
+		return d.octet() != 0, true
+	case 'S':
+		return d.longString(), true
+	case 'F':
+		return d.table(), true
+	case 'b', 'B':
+		size = 1
+	case 's', 'u':
+		size = 2
+	case 'I', 'i', 'f':
+		size = 4
+	case 'D':
+		size = 5
+	case 'l', 'd', 'T':
+		size = 8
+	case 'A', 'x':
+		size = int(d.long())
+	case 'V':
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("amqp: unsupported field type %q", typ)
+		}
+	}
+	d.take(size)
+	return nil, false
+}
@@ -0,0 +1,133 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func amqpMethod(class, method uint16, args ...[]byte) []byte {
+	payload := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, class), method)
+	payload = append(payload, bytes.Join(args, nil)...)
+	frame := binary.BigEndian.AppendUint32([]byte{1, 0, 0}, uint32(len(payload)))
+	return append(append(frame, payload...), 0xce)
+}
+
+func amqpShortString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func amqpLongString(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+func amqpTable(fields ...[]byte) []byte {
+	b := bytes.Join(fields, nil)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+// serveAMQP serves a RabbitMQ-like broker accepting guest/guest on the
+// virtual host "/".
+func serveAMQP(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				header := make([]byte, 8)
+				if _, err := io.ReadFull(r, header); err != nil || string(header) != "AMQP\x00\x00\x09\x01" {
+					return
+				}
+				properties := amqpTable(
+					amqpShortString("capabilities"), []byte{'F'}, amqpTable(
+						amqpShortString("publisher_confirms"), []byte{'t', 1},
+						amqpShortString("basic.nack"), []byte{'t', 1},
+						amqpShortString("exchange_exchange_bindings"), []byte{'t', 0},
+					),
+					amqpShortString("cluster_name"), []byte{'S'}, amqpLongString("rabbit@node1"),
+					amqpShortString("copyright"), []byte{'x'}, amqpLongString("skipped"),
+					amqpShortString("platform"), []byte{'S'}, amqpLongString("Erlang/OTP 26"),
+					amqpShortString("product"), []byte{'S'}, amqpLongString("RabbitMQ"),
+					amqpShortString("version"), []byte{'S'}, amqpLongString("3.13.0"),
+				)
+				conn.Write(amqpMethod(10, 10, []byte{0, 9}, properties, amqpLongString("AMQPLAIN PLAIN"), amqpLongString("en_US")))
+				for {
+					var h [7]byte
+					if _, err := io.ReadFull(r, h[:]); err != nil {
+						return
+					}
+					payload := make([]byte, binary.BigEndian.Uint32(h[3:])+1)
+					if _, err := io.ReadFull(r, payload); err != nil {
+						return
+					}
+					switch method := binary.BigEndian.Uint32(payload); method {
+					case 10<<16 | 11:
+						if !bytes.Contains(payload, []byte("\x00guest\x00guest")) {
+							conn.Write(amqpMethod(10, 50, []byte{0x01, 0x93}, amqpShortString("ACCESS_REFUSED - Login was refused"), []byte{0, 0, 0, 0}))
+							continue
+						}
+						conn.Write(amqpMethod(10, 30, []byte{0x07, 0xff}, []byte{0, 2, 0, 0}, []byte{0, 60}))
+					case 10<<16 | 40:
+						conn.Write(amqpMethod(10, 41, amqpShortString("")))
+					case 10<<16 | 50:
+						conn.Write(amqpMethod(10, 51))
+						return
+					case 10<<16 | 51:
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestAMQPProber(t *testing.T) {
+	target := libprobe.Target{Address: serveAMQP(t), Timeout: 5 * time.Second}
+	p := libprobe.NewAMQPProber(libprobe.AMQPProberOptions{Username: "guest", Password: "guest"})
+	require.Equal(t, libprobe.KindAMQP, p.Kind())
+	r, err := p.Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.AMQPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "0-9", res.Version)
+	require.Equal(t, "RabbitMQ", res.Product)
+	require.Equal(t, "3.13.0", res.ServerVersion)
+	require.Equal(t, "Erlang/OTP 26", res.Platform)
+	require.Equal(t, "rabbit@node1", res.ClusterName)
+	require.Equal(t, []string{"basic.nack", "publisher_confirms"}, res.Capabilities)
+	require.Equal(t, []string{"AMQPLAIN", "PLAIN"}, res.Mechanisms)
+	require.Equal(t, uint16(2047), res.ChannelMax)
+	require.Equal(t, uint32(131072), res.FrameMax)
+	require.Equal(t, time.Minute, res.Heartbeat)
+	require.Positive(t, res.StartTime)
+	require.Positive(t, res.AuthTime)
+	require.Positive(t, res.OpenTime)
+
+	r, err = libprobe.NewAMQPProber(libprobe.AMQPProberOptions{}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.AMQPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "RabbitMQ", res.Product)
+	require.Zero(t, res.AuthTime)
+
+	r, err = libprobe.NewAMQPProber(libprobe.AMQPProberOptions{Username: "guest", Password: "wrong"}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.AMQPResult)
+	require.EqualError(t, res.Error, "amqp: connection closed by the broker: 403 ACCESS_REFUSED - Login was refused")
+}
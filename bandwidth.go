@@ -0,0 +1,331 @@
+package libprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic counts the bytes and packets exchanged by probes. Byte counts
+// include IP headers where they're known; counted sockets report TCP and UDP
+// payloads, and no packets for TCP.
+type Traffic struct {
+	BytesSent       int64
+	BytesReceived   int64
+	PacketsSent     int64
+	PacketsReceived int64
+}
+
+// Add returns the sum of t and o.
+func (t Traffic) Add(o Traffic) Traffic {
+	return Traffic{
+		BytesSent:       t.BytesSent + o.BytesSent,
+		BytesReceived:   t.BytesReceived + o.BytesReceived,
+		PacketsSent:     t.PacketsSent + o.PacketsSent,
+		PacketsReceived: t.PacketsReceived + o.PacketsReceived,
+	}
+}
+
+func (t Traffic) sub(o Traffic) Traffic {
+	return t.Add(Traffic{-o.BytesSent, -o.BytesReceived, -o.PacketsSent, -o.PacketsReceived})
+}
+
+// Bytes returns the bytes exchanged in both directions.
+func (t Traffic) Bytes() int64 {
+	return t.BytesSent + t.BytesReceived
+}
+
+// Packets returns the packets exchanged in both directions.
+func (t Traffic) Packets() int64 {
+	return t.PacketsSent + t.PacketsReceived
+}
+
+// TrafficReporter is implemented by results knowing the traffic of their
+// probe.
+type TrafficReporter interface {
+	Traffic() Traffic
+}
+
+// resultTraffic returns the traffic reported by r or a result it wraps.
+func resultTraffic(r Result) (Traffic, bool) {
+	switch r := r.(type) {
+	case TrafficReporter:
+		return r.Traffic(), true
+	case ResultWrapper:
+		return resultTraffic(r.Unwrap())
+	}
+	return Traffic{}, false
+}
+
+// trafficMeter counts the traffic of the sockets a probe dials, for results
+// that don't report their traffic. Stream sockets count payload bytes
+// alone, packet sockets count packets and UDP payload bytes.
+type trafficMeter struct {
+	sockets         int64
+	bytesSent       int64
+	bytesReceived   int64
+	packetsSent     int64
+	packetsReceived int64
+}
+
+func (m *trafficMeter) sent(n int, packet bool) {
+	atomic.AddInt64(&m.bytesSent, int64(n))
+	if packet {
+		atomic.AddInt64(&m.packetsSent, 1)
+	}
+}
+
+func (m *trafficMeter) received(n int, packet bool) {
+	atomic.AddInt64(&m.bytesReceived, int64(n))
+	if packet {
+		atomic.AddInt64(&m.packetsReceived, 1)
+	}
+}
+
+// traffic returns the traffic counted so far, and false when the probe
+// opened no socket.
+func (m *trafficMeter) traffic() (Traffic, bool) {
+	t := Traffic{
+		BytesSent:       atomic.LoadInt64(&m.bytesSent),
+		BytesReceived:   atomic.LoadInt64(&m.bytesReceived),
+		PacketsSent:     atomic.LoadInt64(&m.packetsSent),
+		PacketsReceived: atomic.LoadInt64(&m.packetsReceived),
+	}
+	return t, atomic.LoadInt64(&m.sockets) > 0
+}
+
+type trafficMeterKey struct{}
+
+// withTrafficMeter returns ctx carrying meter, for the sockets dialed with
+// it. A nil meter returns ctx itself.
+func withTrafficMeter(ctx context.Context, meter *trafficMeter) context.Context {
+	if meter == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, trafficMeterKey{}, meter)
+}
+
+func trafficMeterFrom(ctx context.Context) *trafficMeter {
+	meter, _ := ctx.Value(trafficMeterKey{}).(*trafficMeter)
+	return meter
+}
+
+// meteredConn counts the traffic of a connection with the meter of the
+// probe currently using it, which changes when a later probe reuses it.
+// Every read and write of a connected UDP socket is a packet.
+type meteredConn struct {
+	net.Conn
+	packet bool
+	meter  atomic.Pointer[trafficMeter]
+}
+
+func newMeteredConn(conn net.Conn, meter *trafficMeter) *meteredConn {
+	_, packet := conn.LocalAddr().(*net.UDPAddr)
+	c := &meteredConn{Conn: conn, packet: packet}
+	c.attribute(meter)
+	return c
+}
+
+func (c *meteredConn) attribute(meter *trafficMeter) {
+	if old := c.meter.Swap(meter); old != meter {
+		atomic.AddInt64(&meter.sockets, 1)
+	}
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 || err == nil {
+		c.meter.Load().received(n, c.packet)
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 || err == nil {
+		c.meter.Load().sent(n, c.packet)
+	}
+	return n, err
+}
+
+// attributeConn counts the traffic of conn, a connection reused from an
+// earlier probe, with meter from now on.
+func attributeConn(conn net.Conn, meter *trafficMeter) {
+	if meter == nil {
+		return
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if mc, ok := conn.(*meteredConn); ok {
+		mc.attribute(meter)
+	}
+}
+
+// connMeter returns the meter counting the traffic of conn, if any.
+func connMeter(conn net.Conn) *trafficMeter {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if mc, ok := conn.(*meteredConn); ok {
+		return mc.meter.Load()
+	}
+	return nil
+}
+
+// meteredPacketConn counts the traffic of a packet connection. It hides
+// the methods of *net.UDPConn on purpose, so that QUIC exchanges its
+// packets through ReadFrom and WriteTo rather than batched system calls.
+type meteredPacketConn struct {
+	net.PacketConn
+	meter *trafficMeter
+}
+
+func newMeteredPacketConn(conn net.PacketConn, meter *trafficMeter) *meteredPacketConn {
+	atomic.AddInt64(&meter.sockets, 1)
+	return &meteredPacketConn{PacketConn: conn, meter: meter}
+}
+
+func (c *meteredPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.meter.received(n, true)
+	}
+	return n, addr, err
+}
+
+func (c *meteredPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		c.meter.sent(n, true)
+	}
+	return n, err
+}
+
+// icmpTraffic returns the traffic of echoes with a payload of size bytes.
+func icmpTraffic(address string, size, sent, recv int) Traffic {
+	ipHeader := 20
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		ipHeader = 40
+	}
+	packet := int64(ipHeader + 8 + size)
+	return Traffic{
+		BytesSent:       int64(sent) * packet,
+		BytesReceived:   int64(recv) * packet,
+		PacketsSent:     int64(sent),
+		PacketsReceived: int64(recv),
+	}
+}
+
+func (r ICMPResult) Traffic() Traffic {
+	if r.Stats == nil {
+		return Traffic{}
+	}
+	return icmpTraffic(r.Destination, r.size, r.Stats.PacketsSent, r.Stats.PacketsRecv)
+}
+
+func (r ICMPSweepResult) Traffic() Traffic {
+	var t Traffic
+	for _, s := range r.Steps {
+		t = t.Add(icmpTraffic(r.Address, s.Size, s.PacketsSent, s.PacketsRecv))
+	}
+	return t
+}
+
+// BandwidthBudget bounds the traffic of an engine per period, for probing
+// over metered links. Probes that would exceed the budget are deferred until
+// the next period.
+type BandwidthBudget struct {
+	// Bytes and Packets bound the traffic in both directions; 0 means
+	// unlimited.
+	Bytes   int64
+	Packets int64
+	// Period is the accounting period, starting when the engine first
+	// probes. Default: 24h.
+	Period time.Duration
+}
+
+// budgetState tracks the use of a BandwidthBudget. It's guarded by
+// Engine.statsMu.
+type budgetState struct {
+	start time.Time
+	used  Traffic
+}
+
+// roll starts a new period if the current one is over.
+func (s *budgetState) roll(b *BandwidthBudget, now time.Time) {
+	if s.start.IsZero() || !now.Before(s.start.Add(b.Period)) {
+		s.start, s.used = now, Traffic{}
+	}
+}
+
+// fits reports whether a probe with the estimated traffic fits in the
+// budget. The first probe of a period always fits.
+func (s *budgetState) fits(b *BandwidthBudget, estimate Traffic) bool {
+	if s.used == (Traffic{}) {
+		return true
+	}
+	used := s.used.Add(estimate)
+	return (b.Bytes <= 0 || used.Bytes() <= b.Bytes) && (b.Packets <= 0 || used.Packets() <= b.Packets)
+}
+
+// reserveBudget waits until the estimated traffic of a probe of the job fits
+// in the budget and reserves it, returning the reservation. It returns false
+// when stop or ctx is done first.
+func (e *Engine) reserveBudget(job Job, stats *JobStats, stop <-chan struct{}, done <-chan struct{}) (budgetReservation, bool) {
+	b := e.opts.Budget
+	deferred := false
+	for {
+		now := time.Now()
+		e.statsMu.Lock()
+		estimate := job.ExpectedTraffic
+		if estimate == (Traffic{}) {
+			estimate = stats.LastTraffic
+		}
+		e.budget.roll(b, now)
+		if e.budget.fits(b, estimate) {
+			e.budget.used = e.budget.used.Add(estimate)
+			res := budgetReservation{period: e.budget.start, traffic: estimate}
+			e.statsMu.Unlock()
+			return res, true
+		}
+		if !deferred {
+			deferred = true
+			stats.Deferred++
+		}
+		wait := time.Until(e.budget.start.Add(b.Period))
+		e.statsMu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return budgetReservation{}, false
+		case <-done:
+			timer.Stop()
+			return budgetReservation{}, false
+		}
+	}
+}
+
+type budgetReservation struct {
+	period  time.Time
+	traffic Traffic
+}
+
+// accountTraffic records the traffic of a probe, replacing the budget
+// reservation made for it. It must be called with e.statsMu held.
+func (e *Engine) accountTraffic(stats *JobStats, res budgetReservation, t Traffic) {
+	e.traffic = e.traffic.Add(t)
+	stats.Traffic = stats.Traffic.Add(t)
+	stats.LastTraffic = t
+	if e.opts.Budget == nil {
+		return
+	}
+	if e.budget.start.Equal(res.period) {
+		e.budget.used = e.budget.used.sub(res.traffic)
+	}
+	e.budget.used = e.budget.used.Add(t)
+}
@@ -0,0 +1,97 @@
+package libprobe_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngineBandwidthBudget(t *testing.T) {
+	prober := funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		return &libprobe.TCPResult{Target: target}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 100)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{
+		Sinks:  []libprobe.Sink{sink},
+		Budget: &libprobe.BandwidthBudget{Bytes: 1000, Period: 200 * time.Millisecond},
+	})
+	for _, address := range []string{"a:1", "b:1"} {
+		require.NoError(t, engine.Add(libprobe.Job{
+			Prober:          prober,
+			Target:          libprobe.Target{Address: address},
+			Interval:        5 * time.Millisecond,
+			ExpectedTraffic: libprobe.Traffic{BytesSent: 120, BytesReceived: 80, PacketsSent: 2, PacketsReceived: 2},
+		}))
+	}
+	engine.Start()
+	time.Sleep(100 * time.Millisecond)
+	engine.Stop()
+
+	// 5 probes of 200 bytes fit into the first period.
+	stats := engine.Stats()
+	require.Equal(t, libprobe.Traffic{BytesSent: 600, BytesReceived: 400, PacketsSent: 10, PacketsReceived: 10}, stats.Traffic)
+	require.Equal(t, stats.Traffic, stats.BudgetUsed)
+	a, _ := engine.JobStats("FAKE/a:1")
+	b, _ := engine.JobStats("FAKE/b:1")
+	require.Equal(t, int64(1000), a.Traffic.Bytes()+b.Traffic.Bytes())
+	require.Equal(t, int64(200), a.LastTraffic.Bytes())
+	require.True(t, a.Deferred+b.Deferred >= 2)
+	require.Len(t, sink.results, 5)
+
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/probes", nil))
+	require.Contains(t, rec.Body.String(), `"bytes_sent": 600`)
+}
+
+func TestICMPResultTraffic(t *testing.T) {
+	r := libprobe.ICMPSweepResult{
+		Target: libprobe.Target{Address: "192.0.2.1"},
+		Steps:  []libprobe.ICMPSweepStep{{Size: 100, PacketsSent: 3, PacketsRecv: 2}, {Size: 1000, PacketsSent: 1}},
+	}
+	require.Equal(t, libprobe.Traffic{BytesSent: 3*128 + 1028, BytesReceived: 2 * 128, PacketsSent: 4, PacketsReceived: 2}, r.Traffic())
+}
+
+func TestEngineMeteredTraffic(t *testing.T) {
+	var query int64
+	dns := serveUDP(t, func(b []byte) [][]byte {
+		atomic.StoreInt64(&query, int64(len(b)))
+		resp := append([]byte(nil), b...)
+		resp[2] |= 0x80 // QR
+		return [][]byte{resp}
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+
+	engine := libprobe.NewEngine(libprobe.EngineOptions{})
+	jobs := []libprobe.Job{
+		{ID: "http", Prober: libprobe.NewHTTPProber(), Target: libprobe.Target{Address: srv.URL, Timeout: 5 * time.Second}},
+		{ID: "dns", Prober: libprobe.NewDNSProber(libprobe.DNSExtention{Server: dns}), Target: libprobe.Target{Address: "example", Timeout: 5 * time.Second}},
+	}
+	for _, job := range jobs {
+		job.Interval = time.Hour
+		require.NoError(t, engine.Add(job))
+	}
+	engine.Start()
+	require.Eventually(t, func() bool {
+		a, _ := engine.JobStats("http")
+		b, _ := engine.JobStats("dns")
+		return a.Probes == 1 && b.Probes == 1
+	}, 5*time.Second, time.Millisecond)
+	engine.Stop()
+
+	// Without ExpectedTraffic, the traffic is counted on the sockets.
+	stats, _ := engine.JobStats("http")
+	require.True(t, stats.LastTraffic.BytesSent > 0)
+	require.True(t, stats.LastTraffic.BytesReceived > 1000)
+	require.Zero(t, stats.LastTraffic.Packets())
+	stats, _ = engine.JobStats("dns")
+	require.Equal(t, libprobe.Traffic{BytesSent: atomic.LoadInt64(&query), BytesReceived: atomic.LoadInt64(&query), PacketsSent: 1, PacketsReceived: 1}, stats.LastTraffic)
+}
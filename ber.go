@@ -0,0 +1,218 @@
+package libprobe
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// BER tags shared by the ASN.1 based protocols.
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+)
+
+// berMaxLength bounds the elements read from the network.
+const berMaxLength = 16 << 20
+
+var errBERTruncated = errors.New("ber: truncated element")
+
+// berElement is a decoded BER element with a definite length and a
+// single-byte tag, which covers every element the probers use.
+type berElement struct {
+	Tag     byte
+	Content []byte
+}
+
+// berTLV encodes an element made of the concatenated contents.
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var n int
+	for _, c := range contents {
+		n += len(c)
+	}
+	b := append([]byte{tag}, berLength(n)...)
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// berInt encodes n as a minimal two's complement integer.
+func berInt(tag byte, n int64) []byte {
+	b := []byte{byte(n)}
+	for n > 127 || n < -128 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berTLV(berBoolean, []byte{0xff})
+	}
+	return berTLV(berBoolean, []byte{0})
+}
+
+// berObjectIdentifier encodes a dotted object identifier, e.g.
+// "1.3.6.1.2.1.1.3.0".
+func berObjectIdentifier(oid string) ([]byte, error) {
+	arcs := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(arcs) < 2 {
+		return nil, errors.New("ber: invalid object identifier")
+	}
+	values := make([]uint64, len(arcs))
+	for i, arc := range arcs {
+		v, err := strconv.ParseUint(arc, 10, 32)
+		if err != nil {
+			return nil, errors.New("ber: invalid object identifier")
+		}
+		values[i] = v
+	}
+	if values[0] > 2 || values[0] < 2 && values[1] >= 40 {
+		return nil, errors.New("ber: invalid object identifier")
+	}
+	values = append([]uint64{values[0]*40 + values[1]}, values[2:]...)
+	var b []byte
+	for _, v := range values {
+		enc := []byte{byte(v & 0x7f)}
+		for v >>= 7; v > 0; v >>= 7 {
+			enc = append([]byte{byte(v&0x7f) | 0x80}, enc...)
+		}
+		b = append(b, enc...)
+	}
+	return berTLV(berOID, b), nil
+}
+
+// berParseObjectIdentifier decodes the content of an object identifier
+// element into its dotted form.
+func berParseObjectIdentifier(b []byte) string {
+	var arcs []string
+	var v uint64
+	for _, c := range b {
+		v = v<<7 | uint64(c&0x7f)
+		if c&0x80 != 0 {
+			continue
+		}
+		if arcs == nil {
+			first := min(v/40, 2)
+			arcs = append(arcs, strconv.FormatUint(first, 10), strconv.FormatUint(v-40*first, 10))
+		} else {
+			arcs = append(arcs, strconv.FormatUint(v, 10))
+		}
+		v = 0
+	}
+	return strings.Join(arcs, ".")
+}
+
+// berParseInt decodes the content of an integer element.
+func berParseInt(b []byte) int64 {
+	var n int64
+	for i, c := range b {
+		if i == 0 && c&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(c)
+	}
+	return n
+}
+
+// berParseUint decodes the content of an unsigned integer element, such
+// as the counters of SNMP.
+func berParseUint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// berDecode decodes the first element of b and returns the bytes after it.
+func berDecode(b []byte) (berElement, []byte, error) {
+	if len(b) < 2 {
+		return berElement{}, nil, errBERTruncated
+	}
+	tag, n := b[0], int(b[1])
+	b = b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < size {
+			return berElement{}, nil, errors.New("ber: unsupported length")
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if n < 0 || len(b) < n {
+		return berElement{}, nil, errBERTruncated
+	}
+	return berElement{Tag: tag, Content: b[:n]}, b[n:], nil
+}
+
+// berChildren decodes the elements of a constructed element's content.
+func berChildren(b []byte) ([]berElement, error) {
+	var children []berElement
+	for len(b) > 0 {
+		e, rest, err := berDecode(b)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, e)
+		b = rest
+	}
+	return children, nil
+}
+
+// berReadFrom reads one element from a stream.
+func berReadFrom(r *bufio.Reader) (berElement, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return berElement{}, err
+	}
+	n := int(head[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 {
+			return berElement{}, errors.New("ber: unsupported length")
+		}
+		n = 0
+		for i := 0; i < size; i++ {
+			c, err := r.ReadByte()
+			if err != nil {
+				return berElement{}, err
+			}
+			n = n<<8 | int(c)
+		}
+	}
+	if n > berMaxLength {
+		return berElement{}, errors.New("ber: element too large")
+	}
+	e := berElement{Tag: head[0], Content: make([]byte, n)}
+	_, err := io.ReadFull(r, e.Content)
+	return e, err
+}
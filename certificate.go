@@ -0,0 +1,65 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"time"
+)
+
+// CertificateInfo describes the leaf certificate presented by a server.
+type CertificateInfo struct {
+	Subject   string
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+	DNSNames  []string
+}
+
+func newCertificateInfo(cert *x509.Certificate) *CertificateInfo {
+	return &CertificateInfo{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		DNSNames:  cert.DNSNames,
+	}
+}
+
+// unverifiedTLSConfig returns a copy of config that lets the handshake
+// succeed whatever the certificate, for verifyCertificate to check it
+// afterwards and report the certificate of failing servers too.
+func unverifiedTLSConfig(config *tls.Config, serverName string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = serverName
+	}
+	config.InsecureSkipVerify = true
+	return config
+}
+
+// verifyCertificate verifies the chain of a connection against roots (the
+// system pool when nil) and checks that the leaf is valid for every name.
+func verifyCertificate(state tls.ConnectionState, roots *x509.CertPool, names []string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("tls: no peer certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := leaf.VerifyHostname(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package libprobe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Address classes, after the IANA special-purpose address registries (RFC
+// 6890). Every class but AddressPublic is a bogon: it shouldn't appear as a
+// destination or a hop on the public Internet.
+const (
+	AddressPublic        = "public"
+	AddressPrivate       = "private"
+	AddressShared        = "shared"
+	AddressLoopback      = "loopback"
+	AddressLinkLocal     = "link-local"
+	AddressMulticast     = "multicast"
+	AddressDocumentation = "documentation"
+	AddressBenchmarking  = "benchmarking"
+	AddressUnspecified   = "unspecified"
+	AddressReserved      = "reserved"
+)
+
+// AddressInfo is the classification of an address.
+type AddressInfo struct {
+	Class string
+	Bogon bool
+	// Country is the ISO 3166-1 alpha-2 code of the country the address
+	// is located in, if known.
+	Country string
+}
+
+// AddressClassifier classifies target and hop addresses.
+type AddressClassifier interface {
+	Classify(ip net.IP) AddressInfo
+}
+
+// CountryLookup returns the ISO 3166-1 alpha-2 country code of ip, or "".
+// It can be backed by any geolocation database.
+type CountryLookup func(ip net.IP) string
+
+// RegistryClassifier classifies addresses with the IANA special-purpose
+// address registries, and tags public addresses with the country returned
+// by Country, when set.
+type RegistryClassifier struct {
+	Country CountryLookup
+}
+
+func (c RegistryClassifier) Classify(ip net.IP) AddressInfo {
+	info := AddressInfo{Class: AddressClass(ip)}
+	info.Bogon = info.Class != AddressPublic
+	if !info.Bogon && c.Country != nil {
+		info.Country = c.Country(ip)
+	}
+	return info
+}
+
+type specialPrefix struct {
+	ipnet *net.IPNet
+	class string
+}
+
+var specialPrefixes = func() []specialPrefix {
+	var prefixes []specialPrefix
+	for _, p := range []struct{ cidr, class string }{
+		{"0.0.0.0/32", AddressUnspecified},
+		{"0.0.0.0/8", AddressReserved},
+		{"10.0.0.0/8", AddressPrivate},
+		{"100.64.0.0/10", AddressShared},
+		{"127.0.0.0/8", AddressLoopback},
+		{"169.254.0.0/16", AddressLinkLocal},
+		{"172.16.0.0/12", AddressPrivate},
+		{"192.0.0.0/24", AddressReserved},
+		{"192.0.2.0/24", AddressDocumentation},
+		{"192.88.99.0/24", AddressReserved},
+		{"192.168.0.0/16", AddressPrivate},
+		{"198.18.0.0/15", AddressBenchmarking},
+		{"198.51.100.0/24", AddressDocumentation},
+		{"203.0.113.0/24", AddressDocumentation},
+		{"224.0.0.0/4", AddressMulticast},
+		{"240.0.0.0/4", AddressReserved},
+		{"::/128", AddressUnspecified},
+		{"::1/128", AddressLoopback},
+		{"64:ff9b:1::/48", AddressPrivate},
+		{"100::/64", AddressReserved},
+		{"2001:2::/48", AddressBenchmarking},
+		{"2001:db8::/32", AddressDocumentation},
+		{"3fff::/20", AddressDocumentation},
+		{"fc00::/7", AddressPrivate},
+		{"fe80::/10", AddressLinkLocal},
+		{"ff00::/8", AddressMulticast},
+	} {
+		_, ipnet, err := net.ParseCIDR(p.cidr)
+		if err != nil {
+			panic(err)
+		}
+		prefixes = append(prefixes, specialPrefix{ipnet, p.class})
+	}
+	return prefixes
+}()
+
+var (
+	_, ipv6Global, _ = net.ParseCIDR("2000::/3")
+	_, ipv6NAT64, _  = net.ParseCIDR("64:ff9b::/96")
+)
+
+// AddressClass returns the class of ip in the IANA special-purpose address
+// registries, or AddressPublic. IPv6 addresses outside of the global unicast
+// space 2000::/3 are reserved.
+func AddressClass(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, p := range specialPrefixes {
+		if p.ipnet.Contains(ip) {
+			return p.class
+		}
+	}
+	if len(ip) == net.IPv6len && !ipv6Global.Contains(ip) && !ipv6NAT64.Contains(ip) {
+		return AddressReserved
+	}
+	return AddressPublic
+}
+
+// PrefixCountries returns a CountryLookup mapping networks in CIDR notation
+// to country codes, such as an export of a geolocation database. The most
+// specific network containing an address wins.
+func PrefixCountries(countries map[string]string) (CountryLookup, error) {
+	type entry struct {
+		ipnet   *net.IPNet
+		country string
+	}
+	entries := make([]entry, 0, len(countries))
+	for cidr, country := range countries {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("classify: invalid prefix %q", cidr)
+		}
+		entries = append(entries, entry{ipnet, strings.ToUpper(country)})
+	}
+	return func(ip net.IP) string {
+		country, best := "", -1
+		for _, e := range entries {
+			if ones, _ := e.ipnet.Mask.Size(); ones > best && e.ipnet.Contains(ip) {
+				country, best = e.country, ones
+			}
+		}
+		return country
+	}, nil
+}
+
+// classifyAddress classifies address, an IP address or empty, with c.
+func classifyAddress(c AddressClassifier, address string) *AddressInfo {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+	info := c.Classify(ip)
+	return &info
+}
+
+// targetIP returns the IP address of the host of address, a host, host:port
+// or URL, resolving host names.
+func targetIP(address string, timeout time.Duration) (net.IP, error) {
+	host := address
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		host = u.Hostname()
+	} else if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("classify: no address for %s", host)
+	}
+	return addrs[0].IP, nil
+}
+
+// ClassifiedResult decorates a result with the classification of its
+// target's address.
+type ClassifiedResult struct {
+	Result
+	TargetInfo AddressInfo
+}
+
+func (r *ClassifiedResult) Unwrap() Result {
+	return r.Result
+}
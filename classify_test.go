@@ -0,0 +1,112 @@
+package libprobe_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressClass(t *testing.T) {
+	for address, class := range map[string]string{
+		"8.8.8.8":          libprobe.AddressPublic,
+		"10.1.2.3":         libprobe.AddressPrivate,
+		"172.31.255.255":   libprobe.AddressPrivate,
+		"172.32.0.1":       libprobe.AddressPublic,
+		"192.168.1.1":      libprobe.AddressPrivate,
+		"100.64.0.1":       libprobe.AddressShared,
+		"127.0.0.1":        libprobe.AddressLoopback,
+		"169.254.1.1":      libprobe.AddressLinkLocal,
+		"192.0.2.1":        libprobe.AddressDocumentation,
+		"198.19.0.1":       libprobe.AddressBenchmarking,
+		"224.0.0.251":      libprobe.AddressMulticast,
+		"255.255.255.255":  libprobe.AddressReserved,
+		"0.0.0.0":          libprobe.AddressUnspecified,
+		"::ffff:10.0.0.1":  libprobe.AddressPrivate,
+		"2606:4700::1111":  libprobe.AddressPublic,
+		"64:ff9b::808:808": libprobe.AddressPublic,
+		"::1":              libprobe.AddressLoopback,
+		"::":               libprobe.AddressUnspecified,
+		"fd00::1":          libprobe.AddressPrivate,
+		"fe80::1":          libprobe.AddressLinkLocal,
+		"ff02::1":          libprobe.AddressMulticast,
+		"2001:db8::1":      libprobe.AddressDocumentation,
+		"4000::1":          libprobe.AddressReserved,
+	} {
+		require.Equal(t, class, libprobe.AddressClass(net.ParseIP(address)), address)
+	}
+}
+
+func TestRegistryClassifier(t *testing.T) {
+	countries, err := libprobe.PrefixCountries(map[string]string{"8.0.0.0/8": "us", "8.8.8.0/24": "de", "10.0.0.0/8": "fr"})
+	require.NoError(t, err)
+	c := libprobe.RegistryClassifier{Country: countries}
+	require.Equal(t, libprobe.AddressInfo{Class: libprobe.AddressPublic, Country: "DE"}, c.Classify(net.ParseIP("8.8.8.8")))
+	require.Equal(t, libprobe.AddressInfo{Class: libprobe.AddressPublic, Country: "US"}, c.Classify(net.ParseIP("8.8.4.4")))
+	require.Equal(t, libprobe.AddressInfo{Class: libprobe.AddressPublic}, c.Classify(net.ParseIP("1.1.1.1")))
+	require.Equal(t, libprobe.AddressInfo{Class: libprobe.AddressPrivate, Bogon: true}, c.Classify(net.ParseIP("10.0.0.1")))
+
+	_, err = libprobe.PrefixCountries(map[string]string{"8.0.0.0": "us"})
+	require.Error(t, err)
+}
+
+func TestEngineClassifier(t *testing.T) {
+	prober := funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		return &libprobe.TCPResult{Target: target}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 100)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}, Classifier: libprobe.RegistryClassifier{}})
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "http://8.8.8.8/"}, Interval: 5 * time.Millisecond}))
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "10.0.0.1:80"}, Interval: 5 * time.Millisecond, SkipBogons: true}))
+	engine.Start()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case r := <-sink.results:
+			classified := r.(*libprobe.ClassifiedResult)
+			require.Equal(t, "http://8.8.8.8/", classified.Result.(*libprobe.TCPResult).Address)
+			require.Equal(t, libprobe.AddressPublic, classified.TargetInfo.Class)
+			require.Equal(t, "public", libprobe.Flatten(r)[0]["target_info_class"])
+		case <-time.After(3 * time.Second):
+			t.Fatal("no result delivered")
+		}
+	}
+	engine.Stop()
+	stats, ok := engine.JobStats("FAKE/10.0.0.1:80")
+	require.True(t, ok)
+	require.Zero(t, stats.Probes)
+	require.True(t, stats.Bogons > 0)
+}
+
+func TestSweepProberClassifier(t *testing.T) {
+	prober := libprobe.NewSweepProber(libprobe.SweepProberOptions{
+		Prober: funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+			return &libprobe.TCPResult{Target: target}, nil
+		}},
+		Classifier:   libprobe.RegistryClassifier{},
+		ReverseDNS:   true,
+		SkipBogonPTR: true,
+	})
+	r, err := prober.Probe(libprobe.Target{Address: "10.0.0.0/30", Timeout: time.Second})
+	require.NoError(t, err)
+	alive := r.(*libprobe.SweepResult).Alive
+	require.Len(t, alive, 2)
+	for _, host := range alive {
+		require.Empty(t, host.Name)
+		require.Equal(t, &libprobe.AddressInfo{Class: libprobe.AddressPrivate, Bogon: true}, host.Info)
+	}
+}
+
+func TestICMPProberClassifier(t *testing.T) {
+	prober := libprobe.NewICMPProberWithOptions(libprobe.ICMPProberOptions{Privileged: true, Classifier: libprobe.RegistryClassifier{}})
+	r, err := prober.Probe(libprobe.Target{Address: "127.0.0.1", Timeout: time.Second})
+	if err != nil {
+		t.Skipf("ICMP unavailable: %v", err)
+	}
+	res := r.(*libprobe.ICMPResult)
+	require.Equal(t, &libprobe.AddressInfo{Class: libprobe.AddressLoopback, Bogon: true}, res.DestinationInfo)
+	require.Equal(t, res.DestinationInfo, res.ReplySourceInfo)
+}
@@ -0,0 +1,220 @@
+package libprobe
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Clock confidences, from the point of view of a ClockChecker.
+const (
+	// ClockUnchecked means the clock wasn't checked successfully yet.
+	ClockUnchecked = "unchecked"
+	// ClockSynced means the clock is within MaxOffset of NTP time.
+	ClockSynced = "synced"
+	// ClockSkewed means the clock is off by more than MaxOffset, or the
+	// offset can't be bounded that tightly.
+	ClockSkewed = "skewed"
+	// ClockStale means the last successful check is older than three
+	// check intervals.
+	ClockStale = "stale"
+)
+
+// processEpoch is the reference of monotonic timestamps.
+var processEpoch = time.Now()
+
+// ClockCheckerOptions configures a ClockChecker.
+type ClockCheckerOptions struct {
+	// Servers are NTP servers tried in order. Default: "pool.ntp.org".
+	Servers []string
+	// Interval is the period of checks. Default: 15m.
+	Interval time.Duration
+	// MaxOffset is the offset up to which the clock is considered synced.
+	// Default: 100ms.
+	MaxOffset time.Duration
+	Timeout   time.Duration
+}
+
+// ClockState is the outcome of the latest clock check.
+type ClockState struct {
+	// CheckedAt is when the latest successful check happened.
+	CheckedAt time.Time
+	Server    string
+	// Offset is the estimated offset of the local clock, positive when it's
+	// ahead of NTP time, and Uncertainty bounds the estimate's error.
+	Offset      time.Duration
+	Uncertainty time.Duration
+	Stratum     int
+	// Error is the error of the latest check, if it failed.
+	Error error
+}
+
+// ClockChecker periodically compares the local clock with NTP servers, so
+// results can be qualified with how far their timestamps can be trusted.
+type ClockChecker struct {
+	opts ClockCheckerOptions
+
+	mu    sync.Mutex
+	state ClockState
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewClockChecker(opts ClockCheckerOptions) *ClockChecker {
+	if len(opts.Servers) == 0 {
+		opts.Servers = []string{"pool.ntp.org"}
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 15 * time.Minute
+	}
+	if opts.MaxOffset <= 0 {
+		opts.MaxOffset = 100 * time.Millisecond
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	return &ClockChecker{opts: opts}
+}
+
+// Check queries the servers in order until one answers and records the
+// outcome.
+func (c *ClockChecker) Check() (ClockState, error) {
+	err := errors.New("ntp: no servers")
+	for _, server := range c.opts.Servers {
+		var resp ntpResponse
+		if resp, err = ntpQuery(nil, server, c.opts.Timeout); err != nil {
+			continue
+		}
+		c.mu.Lock()
+		c.state = ClockState{
+			CheckedAt:   time.Now(),
+			Server:      server,
+			Offset:      -resp.Offset,
+			Uncertainty: resp.Uncertainty(),
+			Stratum:     resp.Stratum,
+		}
+		state := c.state
+		c.mu.Unlock()
+		return state, nil
+	}
+	c.mu.Lock()
+	c.state.Error = err
+	state := c.state
+	c.mu.Unlock()
+	return state, err
+}
+
+// Start checks immediately and then every Interval until Stop is called.
+func (c *ClockChecker) Start() {
+	c.mu.Lock()
+	if c.stop != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	stop, done := c.stop, c.done
+	c.mu.Unlock()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(c.opts.Interval)
+		defer ticker.Stop()
+		for {
+			_, _ = c.Check()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops periodic checks and waits for an in-flight check to finish.
+func (c *ClockChecker) Stop() {
+	c.mu.Lock()
+	stop, done := c.stop, c.done
+	c.stop, c.done = nil, nil
+	c.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (c *ClockChecker) State() ClockState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Confidence assesses the local clock based on the latest successful check.
+func (c *ClockChecker) Confidence() string {
+	return c.confidence(c.State())
+}
+
+func (c *ClockChecker) confidence(s ClockState) string {
+	offset := s.Offset
+	if offset < 0 {
+		offset = -offset
+	}
+	switch {
+	case s.CheckedAt.IsZero():
+		return ClockUnchecked
+	case time.Since(s.CheckedAt) > 3*c.opts.Interval:
+		return ClockStale
+	case offset+s.Uncertainty > c.opts.MaxOffset:
+		return ClockSkewed
+	}
+	return ClockSynced
+}
+
+// ResultTimestamps place a probe in time in a way that survives clock steps
+// and drift of the agent.
+type ResultTimestamps struct {
+	// StartTime is the wall clock time the probe started at.
+	StartTime time.Time
+	// MonotonicTime is the time the probe started at on the agent's
+	// monotonic clock, counted from ProcessStart. It orders the results of
+	// a process correctly even if the wall clock was stepped.
+	MonotonicTime time.Duration
+	ProcessStart  time.Time
+	// ClockConfidence is the assessment of the wall clock by a
+	// ClockChecker, or empty without one. When it was checked,
+	// CorrectedStartTime is StartTime corrected by the measured ClockOffset.
+	ClockConfidence    string
+	ClockOffset        time.Duration
+	ClockUncertainty   time.Duration
+	CorrectedStartTime time.Time
+}
+
+// NewResultTimestamps returns the timestamps of a probe started at start,
+// which must carry a monotonic clock reading as returned by time.Now. clock
+// may be nil.
+func NewResultTimestamps(start time.Time, clock *ClockChecker) ResultTimestamps {
+	ts := ResultTimestamps{
+		StartTime:     start.Round(0),
+		MonotonicTime: start.Sub(processEpoch),
+		ProcessStart:  processEpoch.Round(0),
+	}
+	if clock != nil {
+		state := clock.State()
+		ts.ClockConfidence = clock.confidence(state)
+		if !state.CheckedAt.IsZero() {
+			ts.ClockOffset = state.Offset
+			ts.ClockUncertainty = state.Uncertainty
+			ts.CorrectedStartTime = ts.StartTime.Add(-state.Offset)
+		}
+	}
+	return ts
+}
+
+// TimestampedResult decorates a result with the timestamps of its probe.
+type TimestampedResult struct {
+	Result
+	ResultTimestamps
+}
+
+func (r *TimestampedResult) Unwrap() Result {
+	return r.Result
+}
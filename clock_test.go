@@ -0,0 +1,79 @@
+package libprobe_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveNTP runs an NTP server whose clock is ahead of the local one by skew.
+func serveNTP(t *testing.T, skew time.Duration) string {
+	return serveUDP(t, func(q []byte) [][]byte {
+		if len(q) < 48 {
+			return nil
+		}
+		now := time.Now().Add(skew)
+		ts := uint64(now.Unix()+2208988800)<<32 | uint64(now.Nanosecond())<<32/uint64(time.Second)
+		resp := make([]byte, 48)
+		resp[0] = 4<<3 | 4
+		resp[1] = 2
+		binary.BigEndian.PutUint32(resp[8:], 1<<16/1000) // root dispersion 1ms
+		copy(resp[24:32], q[40:48])
+		binary.BigEndian.PutUint64(resp[32:], ts)
+		binary.BigEndian.PutUint64(resp[40:], ts)
+		return [][]byte{resp}
+	})
+}
+
+func TestClockChecker(t *testing.T) {
+	clock := libprobe.NewClockChecker(libprobe.ClockCheckerOptions{Servers: []string{serveNTP(t, 0)}, Timeout: time.Second})
+	require.Equal(t, libprobe.ClockUnchecked, clock.Confidence())
+	state, err := clock.Check()
+	require.NoError(t, err)
+	require.Equal(t, 2, state.Stratum)
+	require.True(t, state.Offset < 50*time.Millisecond && state.Offset > -50*time.Millisecond, state.Offset)
+	require.Equal(t, libprobe.ClockSynced, clock.Confidence())
+
+	clock = libprobe.NewClockChecker(libprobe.ClockCheckerOptions{Servers: []string{serveNTP(t, -3*time.Second)}, Timeout: time.Second})
+	state, err = clock.Check()
+	require.NoError(t, err)
+	require.InDelta(t, float64(3*time.Second), float64(state.Offset), float64(50*time.Millisecond))
+	require.Equal(t, libprobe.ClockSkewed, clock.Confidence())
+
+	start := time.Now()
+	ts := libprobe.NewResultTimestamps(start, clock)
+	require.Equal(t, libprobe.ClockSkewed, ts.ClockConfidence)
+	require.InDelta(t, float64(-3*time.Second), float64(ts.CorrectedStartTime.Sub(start)), float64(50*time.Millisecond))
+	require.True(t, libprobe.NewResultTimestamps(time.Now(), nil).MonotonicTime >= ts.MonotonicTime)
+}
+
+func TestEngineTimestamps(t *testing.T) {
+	prober := funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		return &libprobe.TCPResult{Target: target, ConnectTime: time.Millisecond}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 100)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}, Timestamps: true})
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "a:1"}, Interval: time.Hour}))
+	engine.Start()
+	defer engine.Stop()
+	var r libprobe.Result
+	select {
+	case r = <-sink.results:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no result delivered")
+	}
+	ts, ok := r.(*libprobe.TimestampedResult)
+	require.True(t, ok)
+	require.Equal(t, time.Millisecond, ts.RTT())
+	require.False(t, ts.StartTime.IsZero())
+
+	row := libprobe.Flatten(r)[0]
+	require.Equal(t, "TCP", row[libprobe.ColumnKind])
+	require.Equal(t, "a:1", row[libprobe.ColumnAddress])
+	require.Contains(t, row, "monotonic_time_ns")
+	require.Equal(t, "", row["clock_confidence"])
+}
@@ -0,0 +1,139 @@
+package libprobe
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// CloudEvents types emitted by CloudEventEncoder, after the type prefix.
+const (
+	CloudEventResult      = "probe.result"
+	CloudEventStateChange = "probe.state_changed"
+)
+
+// CloudEventEncoderOptions configures a CloudEventEncoder.
+type CloudEventEncoderOptions struct {
+	// Source identifies the emitting agent, e.g. "//probes/edge-1".
+	// Default: "libprobe".
+	Source string
+	// TypePrefix is prepended to event types, as in
+	// "io.libprobe.probe.result". Default: "io.libprobe".
+	TypePrefix string
+}
+
+// CloudEvent is a CloudEvents 1.0 event in the JSON format, for structured
+// content mode. The target address is the subject of the event.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// CloudEventStateData is the data of state change events.
+type CloudEventStateData struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	Up     bool   `json:"up"`
+	// Since is when the target entered the previous state.
+	Since time.Time `json:"since"`
+	// Result is the result causing the change, as by MarshalResultJSON.
+	Result json.RawMessage `json:"result"`
+}
+
+type cloudEventState struct {
+	up    bool
+	since time.Time
+}
+
+// CloudEventEncoder maps results onto CloudEvents, so they can be routed
+// through event buses without a custom schema. Every result produces a
+// result event carrying MarshalResultJSON as data; a result flipping its
+// target between up and down additionally produces a state change event.
+type CloudEventEncoder struct {
+	w    io.Writer
+	opts CloudEventEncoderOptions
+
+	mu     sync.Mutex
+	states map[string]*cloudEventState
+}
+
+// NewCloudEventEncoder creates an encoder writing newline-delimited events
+// to w. w may be nil when only Events is used.
+func NewCloudEventEncoder(w io.Writer, opts CloudEventEncoderOptions) *CloudEventEncoder {
+	if opts.Source == "" {
+		opts.Source = "libprobe"
+	}
+	if opts.TypePrefix == "" {
+		opts.TypePrefix = "io.libprobe"
+	}
+	return &CloudEventEncoder{w: w, opts: opts, states: make(map[string]*cloudEventState)}
+}
+
+func (e *CloudEventEncoder) event(at time.Time, typ, subject string, data []byte) CloudEvent {
+	return CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              randomID(),
+		Source:          e.opts.Source,
+		Type:            e.opts.TypePrefix + "." + typ,
+		Subject:         subject,
+		Time:            at.UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+}
+
+// Events returns the events of a result observed at a given time.
+func (e *CloudEventEncoder) Events(at time.Time, r Result) ([]CloudEvent, error) {
+	data, err := MarshalResultJSON(r)
+	if err != nil {
+		return nil, err
+	}
+	address, _ := Flatten(r)[0][ColumnAddress].(string)
+	kind := resultKind(r)
+	events := []CloudEvent{e.event(at, CloudEventResult, address, data)}
+
+	up := resultOK(r)
+	key := kind + "/" + address
+	e.mu.Lock()
+	st, seen := e.states[key]
+	if !seen {
+		e.states[key] = &cloudEventState{up: up, since: at}
+	}
+	changed := seen && st.up != up
+	var since time.Time
+	if changed {
+		since = st.since
+		st.up, st.since = up, at
+	}
+	e.mu.Unlock()
+	if changed {
+		state, err := json.Marshal(CloudEventStateData{Kind: kind, Target: address, Up: up, Since: since, Result: data})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e.event(at, CloudEventStateChange, address, state))
+	}
+	return events, nil
+}
+
+// Encode writes the events of a result, one JSON object per line.
+func (e *CloudEventEncoder) Encode(r Result) error {
+	events, err := e.Events(time.Now(), r)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(e.w)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package libprobe_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloudEventEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := libprobe.NewCloudEventEncoder(&buf, libprobe.CloudEventEncoderOptions{Source: "//probes/edge-1"})
+	target := libprobe.Target{Address: "1.1.1.1:80"}
+	require.NoError(t, enc.Encode(&libprobe.TCPResult{Target: target, ConnectTime: time.Millisecond}))
+	require.NoError(t, enc.Encode(&libprobe.TCPResult{Target: target, ConnectTime: time.Millisecond}))
+	require.NoError(t, enc.Encode(&libprobe.TCPResult{Target: target, Error: errors.New("refused")}))
+
+	var events []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var event map[string]interface{}
+		require.NoError(t, dec.Decode(&event))
+		events = append(events, event)
+	}
+	require.Len(t, events, 4)
+	for i, typ := range []string{"probe.result", "probe.result", "probe.result", "probe.state_changed"} {
+		require.Equal(t, "io.libprobe."+typ, events[i]["type"])
+		require.Equal(t, "1.0", events[i]["specversion"])
+		require.Equal(t, "//probes/edge-1", events[i]["source"])
+		require.Equal(t, "1.1.1.1:80", events[i]["subject"])
+		require.Equal(t, "application/json", events[i]["datacontenttype"])
+	}
+	require.NotEqual(t, events[0]["id"], events[1]["id"])
+	require.Equal(t, "TCP", events[0]["data"].(map[string]interface{})["kind"])
+
+	state := events[3]["data"].(map[string]interface{})
+	require.Equal(t, false, state["up"])
+	require.Equal(t, "TCP", state["kind"])
+	require.Equal(t, "refused", state["result"].(map[string]interface{})["error"])
+}
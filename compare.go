@@ -0,0 +1,157 @@
+package libprobe
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const KindCompare = "COMPARE"
+
+// CompareProberOptions configures a CompareProber.
+type CompareProberOptions struct {
+	// Prober probes every address. Default: an unprivileged ICMPProber.
+	Prober Prober
+	// Addresses are the addresses of the service, e.g. those of several
+	// PoPs. When empty, the host of Target.Address ("host" or "host:port")
+	// is resolved and all its addresses are probed.
+	Addresses []string
+}
+
+// CompareEntry is the outcome of probing one address of a service.
+type CompareEntry struct {
+	Address string
+	// Rank starts at 1 for the best address.
+	Rank      int
+	Available bool
+	RTT       time.Duration
+	// Loss is the percentage of lost packets for ICMP, and 0 or 100 for
+	// other probes.
+	Loss  float64
+	Error string
+}
+
+// CompareResult ranks the addresses of a service: available addresses come
+// first, then those with less loss, then those with lower RTT.
+type CompareResult struct {
+	Target
+
+	Entries []CompareEntry
+}
+
+// RTT returns the RTT of the best available address.
+func (r CompareResult) RTT() time.Duration {
+	if len(r.Entries) == 0 || !r.Entries[0].Available {
+		return 0
+	}
+	return r.Entries[0].RTT
+}
+
+func (r CompareResult) String() string {
+	var b strings.Builder
+	for _, e := range r.Entries {
+		state := "up"
+		if !e.Available {
+			state = "down"
+		}
+		fmt.Fprintf(&b, "%d. %s %s rtt=%s loss=%v%%", e.Rank, e.Address, state, e.RTT, e.Loss)
+		if e.Error != "" {
+			fmt.Fprintf(&b, " error=%s", e.Error)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// CompareProber probes the same logical service via several addresses in
+// parallel and ranks them, e.g. to pick among the A records of a name or
+// the PoPs of a GSLB service.
+type CompareProber struct {
+	opts CompareProberOptions
+}
+
+func NewCompareProber(opts CompareProberOptions) *CompareProber {
+	if opts.Prober == nil {
+		opts.Prober = NewICMPProber(false)
+	}
+	return &CompareProber{opts: opts}
+}
+
+func (p *CompareProber) Kind() string {
+	return KindCompare
+}
+
+func (p *CompareProber) addresses(target Target) ([]string, error) {
+	if len(p.opts.Addresses) > 0 {
+		return p.opts.Addresses, nil
+	}
+	host, port, err := net.SplitHostPort(target.Address)
+	if err != nil {
+		host, port = target.Address, ""
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, len(ips))
+	for i, ip := range ips {
+		if port != "" {
+			addresses[i] = net.JoinHostPort(ip, port)
+		} else {
+			addresses[i] = ip
+		}
+	}
+	return addresses, nil
+}
+
+func (p *CompareProber) Probe(target Target) (Result, error) {
+	addresses, err := p.addresses(target)
+	if err != nil {
+		return nil, err
+	}
+	r := &CompareResult{Target: target, Entries: make([]CompareEntry, len(addresses))}
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(e *CompareEntry, address string) {
+			defer wg.Done()
+			t := target
+			t.Address = address
+			e.Address = address
+			e.Loss = 100
+			res, err := safeProbe(p.opts.Prober, t)
+			if err != nil {
+				e.Error = err.Error()
+				return
+			}
+			e.Available = resultOK(res)
+			e.RTT = res.RTT()
+			if icmp, ok := innermostResult(res).(*ICMPResult); ok && icmp.Stats != nil {
+				e.Loss = icmp.Stats.PacketLoss
+			} else if e.Available {
+				e.Loss = 0
+			}
+			if msg, _ := Flatten(res)[0][ColumnError].(string); msg != "" {
+				e.Error = msg
+			}
+		}(&r.Entries[i], address)
+	}
+	wg.Wait()
+	sort.SliceStable(r.Entries, func(i, j int) bool {
+		a, b := r.Entries[i], r.Entries[j]
+		if a.Available != b.Available {
+			return a.Available
+		}
+		if a.Loss != b.Loss {
+			return a.Loss < b.Loss
+		}
+		return a.RTT < b.RTT
+	})
+	for i := range r.Entries {
+		r.Entries[i].Rank = i + 1
+	}
+	return r, nil
+}
@@ -0,0 +1,72 @@
+package libprobe_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+	"github.com/go-ping/ping"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareProber(t *testing.T) {
+	rtts := map[string]time.Duration{"a:1": 30 * time.Millisecond, "b:1": 10 * time.Millisecond}
+	prober := libprobe.NewCompareProber(libprobe.CompareProberOptions{
+		Prober: funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+			rtt, ok := rtts[target.Address]
+			if !ok {
+				return &libprobe.TCPResult{Target: target, Error: errors.New("refused")}, nil
+			}
+			return &libprobe.TCPResult{Target: target, ConnectTime: rtt}, nil
+		}},
+		Addresses: []string{"c:1", "a:1", "b:1"},
+	})
+	r, err := prober.Probe(libprobe.Target{Address: "service"})
+	require.NoError(t, err)
+	cmp := r.(*libprobe.CompareResult)
+	require.Len(t, cmp.Entries, 3)
+	require.Equal(t, "b:1", cmp.Entries[0].Address)
+	require.Equal(t, 1, cmp.Entries[0].Rank)
+	require.Equal(t, "a:1", cmp.Entries[1].Address)
+	require.Equal(t, "c:1", cmp.Entries[2].Address)
+	require.False(t, cmp.Entries[2].Available)
+	require.EqualValues(t, 100, cmp.Entries[2].Loss)
+	require.Equal(t, "refused", cmp.Entries[2].Error)
+	require.Equal(t, 10*time.Millisecond, r.RTT())
+}
+
+func TestCompareProberResolve(t *testing.T) {
+	var probed []string
+	prober := libprobe.NewCompareProber(libprobe.CompareProberOptions{
+		Prober: funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+			probed = append(probed, target.Address)
+			return &libprobe.TCPResult{Target: target}, nil
+		}},
+	})
+	_, err := prober.Probe(libprobe.Target{Address: "127.0.0.1:80"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.1:80"}, probed)
+}
+
+func TestCompareProberWrappedICMP(t *testing.T) {
+	prober := libprobe.NewCompareProber(libprobe.CompareProberOptions{
+		Prober: funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+			return &libprobe.ScheduledResult{Result: &libprobe.ICMPResult{
+				Target: target,
+				Stats:  &ping.Statistics{PacketsSent: 4, PacketsRecv: 3, PacketLoss: 25, AvgRtt: time.Millisecond},
+			}}, nil
+		}},
+		Addresses: []string{"192.0.2.1"},
+	})
+	r, err := prober.Probe(libprobe.Target{Address: "service"})
+	require.NoError(t, err)
+	require.EqualValues(t, 25, r.(*libprobe.CompareResult).Entries[0].Loss)
+
+	// Without a prober, addresses are pinged.
+	require.NotPanics(t, func() {
+		libprobe.NewCompareProber(libprobe.CompareProberOptions{Addresses: []string{"127.0.0.1"}}).
+			Probe(libprobe.Target{Address: "localhost", Timeout: 100 * time.Millisecond})
+	})
+}
@@ -0,0 +1,45 @@
+package libprobe
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// HeaderProbeID is the request header carrying Target.ProbeID.
+const HeaderProbeID = "X-Probe-ID"
+
+// randomID returns a random 128-bit identifier in hex.
+func randomID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// isTraceID reports whether s is a valid W3C trace ID: 32 lowercase hex
+// digits, not all zero.
+func isTraceID(s string) bool {
+	if len(s) != 32 || strings.Trim(s, "0") == "" {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// setCorrelationHeaders adds the probe and trace IDs of target to h. The
+// trace ID is sent as a sampled W3C traceparent with a fresh span ID.
+func setCorrelationHeaders(h http.Header, target Target) {
+	if target.ProbeID != "" {
+		h.Set(HeaderProbeID, target.ProbeID)
+	}
+	if isTraceID(target.TraceID) {
+		var span [8]byte
+		_, _ = rand.Read(span[:])
+		h.Set("Traceparent", "00-"+target.TraceID+"-"+hex.EncodeToString(span[:])+"-01")
+	}
+}
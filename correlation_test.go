@@ -0,0 +1,74 @@
+package libprobe_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorrelationHTTP(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer server.Close()
+	target := libprobe.Target{
+		Address:  server.URL,
+		Timeout:  5 * time.Second,
+		Headers:  http.Header{"X-Agent": {"edge-1"}},
+		ProbeID:  "probe-1",
+		TraceID:  "4bf92f3577b34da6a3ce929d0e0e4736",
+		Metadata: map[string]string{"env": "prod"},
+	}
+	r, err := libprobe.NewHTTPProber().Probe(target)
+	require.NoError(t, err)
+	h := <-headers
+	require.Equal(t, "probe-1", h.Get(libprobe.HeaderProbeID))
+	require.Equal(t, "edge-1", h.Get("X-Agent"))
+	require.Regexp(t, regexp.MustCompile(`^00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-01$`), h.Get("Traceparent"))
+	require.Len(t, target.Headers, 1, "the target's headers must not be modified")
+
+	row := libprobe.Flatten(r)[0]
+	require.Equal(t, "probe-1", row["probe_id"])
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", row["trace_id"])
+	require.Equal(t, "prod", row["metadata_env"])
+
+	target.TraceID = "not-a-w3c-trace-id"
+	_, err = libprobe.NewHTTPProber().Probe(target)
+	require.NoError(t, err)
+	require.Empty(t, (<-headers).Get("Traceparent"))
+}
+
+func TestEngineAssignProbeIDs(t *testing.T) {
+	prober := funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		return &libprobe.TCPResult{Target: target}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 100)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}, AssignProbeIDs: true})
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "a:1"}, Interval: 5 * time.Millisecond}))
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "b:1", ProbeID: "fixed"}, Interval: 5 * time.Millisecond}))
+	engine.Start()
+	defer engine.Stop()
+	ids := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		select {
+		case r := <-sink.results:
+			ids[r.(*libprobe.TCPResult).ProbeID]++
+		case <-time.After(3 * time.Second):
+			t.Fatal("no result delivered")
+		}
+	}
+	require.True(t, ids["fixed"] > 0)
+	for id, n := range ids {
+		require.NotEmpty(t, id)
+		if id != "fixed" {
+			require.Equal(t, 1, n)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package libprobe
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+)
+
+type debugKind struct {
+	Probes      int64   `json:"probes"`
+	Successes   int64   `json:"successes"`
+	Failures    int64   `json:"failures"`
+	Errors      int64   `json:"errors"`
+	SuccessRate float64 `json:"success_rate"`
+}
+
+type debugTraffic struct {
+	BytesSent       int64 `json:"bytes_sent"`
+	BytesReceived   int64 `json:"bytes_received"`
+	PacketsSent     int64 `json:"packets_sent"`
+	PacketsReceived int64 `json:"packets_received"`
+}
+
+type debugJob struct {
+	ID       string       `json:"id"`
+	Kind     string       `json:"kind"`
+	Address  string       `json:"address"`
+	Interval string       `json:"interval"`
+	Traffic  debugTraffic `json:"traffic"`
+	Deferred int64        `json:"deferred,omitempty"`
+	Skipped  int64        `json:"skipped,omitempty"`
+	Canceled int64        `json:"canceled,omitempty"`
+}
+
+type debugSocketPool struct {
+	Max      int    `json:"max"`
+	InUse    int    `json:"in_use"`
+	Peak     int    `json:"peak"`
+	Waiting  int    `json:"waiting"`
+	Waits    uint64 `json:"waits"`
+	WaitTime string `json:"wait_time"`
+	Timeouts uint64 `json:"timeouts"`
+}
+
+type debugState struct {
+	Running       bool                 `json:"running"`
+	Jobs          int                  `json:"jobs"`
+	QueueDepth    int                  `json:"queue_depth"`
+	InFlight      int                  `json:"in_flight"`
+	HungProbes    int                  `json:"hung_probes"`
+	Skipped       int64                `json:"skipped"`
+	Canceled      int64                `json:"canceled"`
+	SinkErrors    int64                `json:"sink_errors"`
+	LastSinkError string               `json:"last_sink_error,omitempty"`
+	Kinds         map[string]debugKind `json:"kinds"`
+	Traffic       debugTraffic         `json:"traffic"`
+	BudgetUsed    *debugTraffic        `json:"budget_used,omitempty"`
+	SocketPool    *debugSocketPool     `json:"socket_pool,omitempty"`
+	Targets       []debugJob           `json:"targets,omitempty"`
+}
+
+func (e *Engine) debugState(withTargets bool) debugState {
+	stats := e.Stats()
+	state := debugState{
+		Running:       stats.Running,
+		Jobs:          stats.Jobs,
+		QueueDepth:    stats.QueueDepth,
+		InFlight:      stats.InFlight,
+		HungProbes:    stats.HungProbes,
+		Skipped:       stats.Skipped,
+		Canceled:      stats.Canceled,
+		SinkErrors:    stats.SinkErrors,
+		LastSinkError: stats.LastSinkError,
+		Kinds:         make(map[string]debugKind, len(stats.Kinds)),
+		Traffic:       debugTraffic(stats.Traffic),
+	}
+	if e.opts.Budget != nil {
+		used := debugTraffic(stats.BudgetUsed)
+		state.BudgetUsed = &used
+	}
+	if pool := activeFDPool(); pool != nil {
+		ps := pool.Stats()
+		state.SocketPool = &debugSocketPool{
+			Max:      ps.Max,
+			InUse:    ps.InUse,
+			Peak:     ps.Peak,
+			Waiting:  ps.Waiting,
+			Waits:    ps.Waits,
+			WaitTime: ps.WaitTime.String(),
+			Timeouts: ps.Timeouts,
+		}
+	}
+	for kind, ks := range stats.Kinds {
+		state.Kinds[kind] = debugKind{
+			Probes:      ks.Probes,
+			Successes:   ks.Successes,
+			Failures:    ks.Failures,
+			Errors:      ks.Errors,
+			SuccessRate: ks.SuccessRate(),
+		}
+	}
+	if withTargets {
+		for _, job := range e.Jobs() {
+			js, _ := e.JobStats(job.Key())
+			state.Targets = append(state.Targets, debugJob{
+				ID:       job.Key(),
+				Kind:     job.Prober.Kind(),
+				Address:  job.Target.Address,
+				Interval: job.Interval.String(),
+				Traffic:  debugTraffic(js.Traffic),
+				Deferred: js.Deferred,
+				Skipped:  js.Skipped,
+				Canceled: js.Canceled,
+			})
+		}
+		sort.Slice(state.Targets, func(i, j int) bool { return state.Targets[i].ID < state.Targets[j].ID })
+	}
+	return state
+}
+
+// ServeHTTP serves the engine state as JSON, meant to be mounted at e.g.
+// /debug/probes. The list of targets is included unless the request has a
+// "summary" query parameter.
+func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, summary := r.URL.Query()["summary"]
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(e.debugState(!summary))
+}
+
+// PublishExpvar publishes the engine state (without the target list) as the
+// expvar variable name, served by expvar's /debug/vars handler. Like
+// expvar.Publish, it panics if the name is already registered.
+func (e *Engine) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return e.debugState(false)
+	}))
+}
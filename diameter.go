@@ -0,0 +1,386 @@
+package libprobe
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const KindDiameter = "DIAMETER"
+
+// Diameter command codes and AVP codes (RFC 6733).
+const (
+	diameterCapabilitiesExchange = 257
+	diameterDisconnectPeer       = 282
+
+	diameterFlagRequest  = 0x80
+	diameterAVPMandatory = 0x40
+	diameterAVPVendor    = 0x80
+
+	avpHostIPAddress       = 257
+	avpAuthApplicationID   = 258
+	avpAcctApplicationID   = 259
+	avpVendorSpecificAppID = 260
+	avpOriginHost          = 264
+	avpSupportedVendorID   = 265
+	avpVendorID            = 266
+	avpFirmwareRevision    = 267
+	avpResultCode          = 268
+	avpProductName         = 269
+	avpDisconnectCause     = 273
+	avpErrorMessage        = 281
+	avpOriginRealm         = 296
+
+	diameterSuccess = 2001
+)
+
+// DiameterProberOptions configures a DiameterProber.
+type DiameterProberOptions struct {
+	// Network is "tcp" or "sctp" (Linux only). Default: "tcp".
+	Network string
+	// OriginHost identifies the prober. Default: the host name.
+	OriginHost string
+	// OriginRealm is the realm of the prober. Default: the domain of
+	// OriginHost, or "libprobe".
+	OriginRealm string
+	// AuthApplications are the Auth-Application-Ids advertised, e.g.
+	// 16777251 for S6a. Peers usually reject a CER without an application
+	// in common with DIAMETER_NO_COMMON_APPLICATION (5010).
+	AuthApplications []uint32
+	// AcctApplications are the Acct-Application-Ids advertised.
+	AcctApplications []uint32
+}
+
+type DiameterResult struct {
+	Target
+	Error error
+
+	ConnectTime      time.Duration
+	ExchangeTime     time.Duration
+	TotalTime        time.Duration
+	ResultCode       int
+	OriginHost       string
+	OriginRealm      string
+	ProductName      string
+	FirmwareRevision int
+	// AuthApplications and AcctApplications are the application ids the
+	// peer advertised, vendor specific ones included.
+	AuthApplications []uint32
+	AcctApplications []uint32
+	SupportedVendors []uint32
+}
+
+func (r DiameterResult) RTT() time.Duration {
+	return r.TotalTime
+}
+
+func (r DiameterResult) String() string {
+	if r.Error != nil && r.ResultCode == 0 {
+		return fmt.Sprintf("Error: %s", r.Error)
+	}
+	return fmt.Sprintf("-> %s %s/%s (%s) result=%d auth-apps=%v acct-apps=%v Connect: %s, CER/CEA: %s",
+		r.Target.Address, r.OriginHost, r.OriginRealm, r.ProductName, r.ResultCode,
+		r.AuthApplications, r.AcctApplications, r.ConnectTime, r.ExchangeTime)
+}
+
+// DiameterProber connects to the Diameter peer in Target.Address (port 3868
+// by default), exchanges capabilities with a CER and reports the CEA, then
+// disconnects with a DPR. A result code other than DIAMETER_SUCCESS fails
+// the probe.
+type DiameterProber struct {
+	opts DiameterProberOptions
+}
+
+func NewDiameterProber(opts DiameterProberOptions) *DiameterProber {
+	if opts.Network == "" {
+		opts.Network = "tcp"
+	}
+	if opts.OriginHost == "" {
+		opts.OriginHost, _ = os.Hostname()
+		if opts.OriginHost == "" {
+			opts.OriginHost = "libprobe"
+		}
+	}
+	if opts.OriginRealm == "" {
+		opts.OriginRealm = "libprobe"
+		if i := strings.IndexByte(opts.OriginHost, '.'); i > 0 {
+			opts.OriginRealm = opts.OriginHost[i+1:]
+		}
+	}
+	return &DiameterProber{opts: opts}
+}
+
+func (p *DiameterProber) Kind() string {
+	return KindDiameter
+}
+
+// diameterAVP encodes an AVP without vendor id.
+func diameterAVP(code uint32, data []byte) []byte {
+	n := 8 + len(data)
+	b := make([]byte, 8, (n+3)&^3)
+	binary.BigEndian.PutUint32(b, code)
+	binary.BigEndian.PutUint32(b[4:], uint32(n))
+	b[4] = diameterAVPMandatory
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func diameterU32(code, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return diameterAVP(code, b[:])
+}
+
+// diameterAddress encodes an Address AVP.
+func diameterAddress(code uint32, ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return diameterAVP(code, append([]byte{0, 1}, ip4...))
+	}
+	return diameterAVP(code, append([]byte{0, 2}, ip.To16()...))
+}
+
+type diameterMessage struct {
+	Flags       byte
+	Command     uint32
+	Application uint32
+	HopByHop    uint32
+	EndToEnd    uint32
+	AVPs        []byte
+}
+
+func (m *diameterMessage) bytes() []byte {
+	b := make([]byte, 20, 20+len(m.AVPs))
+	binary.BigEndian.PutUint32(b, uint32(20+len(m.AVPs)))
+	b[0] = 1
+	binary.BigEndian.PutUint32(b[4:], m.Command)
+	b[4] = m.Flags
+	binary.BigEndian.PutUint32(b[8:], m.Application)
+	binary.BigEndian.PutUint32(b[12:], m.HopByHop)
+	binary.BigEndian.PutUint32(b[16:], m.EndToEnd)
+	return append(b, m.AVPs...)
+}
+
+func readDiameterMessage(r io.Reader) (*diameterMessage, error) {
+	var head [20]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != 1 {
+		return nil, fmt.Errorf("diameter: unsupported version %d", head[0])
+	}
+	n := binary.BigEndian.Uint32(head[:]) & 0xffffff
+	if n < 20 {
+		return nil, errors.New("diameter: bad message length")
+	}
+	m := &diameterMessage{
+		Flags:       head[4],
+		Command:     binary.BigEndian.Uint32(head[4:]) & 0xffffff,
+		Application: binary.BigEndian.Uint32(head[8:]),
+		HopByHop:    binary.BigEndian.Uint32(head[12:]),
+		EndToEnd:    binary.BigEndian.Uint32(head[16:]),
+		AVPs:        make([]byte, n-20),
+	}
+	if _, err := io.ReadFull(r, m.AVPs); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// eachDiameterAVP calls fn with the code and data of every AVP in b.
+func eachDiameterAVP(b []byte, fn func(code uint32, data []byte)) error {
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return errors.New("diameter: truncated AVP")
+		}
+		code := binary.BigEndian.Uint32(b)
+		flags := b[4]
+		n := int(binary.BigEndian.Uint32(b[4:]) & 0xffffff)
+		hdr := 8
+		if flags&diameterAVPVendor != 0 {
+			hdr = 12
+		}
+		if n < hdr || len(b) < n {
+			return errors.New("diameter: bad AVP length")
+		}
+		fn(code, b[hdr:n])
+		padded := (n + 3) &^ 3
+		if padded > len(b) {
+			padded = len(b)
+		}
+		b = b[padded:]
+	}
+	return nil
+}
+
+func diameterUint(data []byte) uint32 {
+	if len(data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data)
+}
+
+func (p *DiameterProber) cer(local net.IP, hopByHop, endToEnd uint32) []byte {
+	productName := diameterAVP(avpProductName, []byte("libprobe"))
+	productName[4] = 0 // Product-Name must not have the M bit
+	avps := [][]byte{
+		diameterAVP(avpOriginHost, []byte(p.opts.OriginHost)),
+		diameterAVP(avpOriginRealm, []byte(p.opts.OriginRealm)),
+		diameterAddress(avpHostIPAddress, local),
+		diameterU32(avpVendorID, 0),
+		productName,
+	}
+	for _, id := range p.opts.AuthApplications {
+		avps = append(avps, diameterU32(avpAuthApplicationID, id))
+	}
+	for _, id := range p.opts.AcctApplications {
+		avps = append(avps, diameterU32(avpAcctApplicationID, id))
+	}
+	m := &diameterMessage{
+		Flags:    diameterFlagRequest,
+		Command:  diameterCapabilitiesExchange,
+		HopByHop: hopByHop,
+		EndToEnd: endToEnd,
+	}
+	for _, avp := range avps {
+		m.AVPs = append(m.AVPs, avp...)
+	}
+	return m.bytes()
+}
+
+func (r *DiameterResult) parseCEA(m *diameterMessage) error {
+	return eachDiameterAVP(m.AVPs, func(code uint32, data []byte) {
+		switch code {
+		case avpResultCode:
+			r.ResultCode = int(diameterUint(data))
+		case avpOriginHost:
+			r.OriginHost = string(data)
+		case avpOriginRealm:
+			r.OriginRealm = string(data)
+		case avpProductName:
+			r.ProductName = string(data)
+		case avpFirmwareRevision:
+			r.FirmwareRevision = int(diameterUint(data))
+		case avpAuthApplicationID:
+			r.AuthApplications = append(r.AuthApplications, diameterUint(data))
+		case avpAcctApplicationID:
+			r.AcctApplications = append(r.AcctApplications, diameterUint(data))
+		case avpSupportedVendorID:
+			r.SupportedVendors = append(r.SupportedVendors, diameterUint(data))
+		case avpVendorSpecificAppID:
+			_ = eachDiameterAVP(data, func(code uint32, data []byte) {
+				switch code {
+				case avpAuthApplicationID:
+					r.AuthApplications = append(r.AuthApplications, diameterUint(data))
+				case avpAcctApplicationID:
+					r.AcctApplications = append(r.AcctApplications, diameterUint(data))
+				}
+			})
+		case avpErrorMessage:
+			if r.Error == nil {
+				r.Error = fmt.Errorf("diameter: %s", data)
+			}
+		}
+	})
+}
+
+func (p *DiameterProber) Probe(target Target) (Result, error) {
+	r := &DiameterResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "3868")
+	}
+	startAt := time.Now()
+	var conn net.Conn
+	var err error
+	switch p.opts.Network {
+	case "tcp":
+		conn, err = dialTimeout(target.meter, "tcp", address, target.Timeout)
+	case "sctp":
+		conn, err = dialSCTP(address, target.Timeout)
+	default:
+		return nil, fmt.Errorf("diameter: unknown network %q", p.opts.Network)
+	}
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	r.ConnectTime = time.Since(startAt)
+	if target.Timeout > 0 {
+		if err := conn.SetDeadline(startAt.Add(target.Timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	var ids [8]byte
+	if _, err := rand.Read(ids[:]); err != nil {
+		return nil, err
+	}
+	hopByHop, endToEnd := binary.BigEndian.Uint32(ids[:]), binary.BigEndian.Uint32(ids[4:])
+	var local net.IP
+	switch addr := conn.LocalAddr().(type) {
+	case *net.TCPAddr:
+		local = addr.IP
+	default:
+		local = net.IPv4zero
+	}
+
+	exchangeAt := time.Now()
+	if _, err := conn.Write(p.cer(local, hopByHop, endToEnd)); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	for {
+		m, err := readDiameterMessage(conn)
+		if err != nil {
+			r.Error = err
+			return r, nil
+		}
+		if m.Command != diameterCapabilitiesExchange || m.Flags&diameterFlagRequest != 0 || m.HopByHop != hopByHop {
+			continue
+		}
+		r.ExchangeTime = time.Since(exchangeAt)
+		if err := r.parseCEA(m); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		break
+	}
+	r.TotalTime = time.Since(startAt)
+	if r.ResultCode != diameterSuccess {
+		if r.Error == nil {
+			r.Error = fmt.Errorf("diameter: result code %d", r.ResultCode)
+		}
+		return r, nil
+	}
+	r.Error = nil
+
+	// Disconnect politely; the answer doesn't matter.
+	dpr := &diameterMessage{
+		Flags:    diameterFlagRequest,
+		Command:  diameterDisconnectPeer,
+		HopByHop: hopByHop + 1,
+		EndToEnd: endToEnd + 1,
+	}
+	for _, avp := range [][]byte{
+		diameterAVP(avpOriginHost, []byte(p.opts.OriginHost)),
+		diameterAVP(avpOriginRealm, []byte(p.opts.OriginRealm)),
+		diameterU32(avpDisconnectCause, 2), // DO_NOT_WANT_TO_TALK_TO_YOU
+	} {
+		dpr.AVPs = append(dpr.AVPs, avp...)
+	}
+	if _, err := conn.Write(dpr.bytes()); err == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _ = readDiameterMessage(conn)
+	}
+	return r, nil
+}
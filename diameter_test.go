@@ -0,0 +1,122 @@
+package libprobe_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func diameterAVP(code uint32, data []byte) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, code)
+	binary.BigEndian.PutUint32(b[4:], uint32(8+len(data)))
+	b[4] = 0x40
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func diameterU32(code, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return diameterAVP(code, b[:])
+}
+
+// serveDiameter answers CERs with resultCode and DPRs with a DPA, recording
+// the Origin-Host AVPs it receives.
+func serveDiameter(t *testing.T, resultCode uint32) (string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	origins := make(chan string, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			head := make([]byte, 20)
+			if _, err := io.ReadFull(conn, head); err != nil {
+				return
+			}
+			body := make([]byte, binary.BigEndian.Uint32(head)&0xffffff-20)
+			if _, err := io.ReadFull(conn, body); err != nil {
+				return
+			}
+			for b := body; len(b) >= 8; {
+				n := int(binary.BigEndian.Uint32(b[4:]) & 0xffffff)
+				if binary.BigEndian.Uint32(b) == 264 {
+					origins <- string(b[8:n])
+				}
+				b = b[(n+3)&^3:]
+			}
+			var avps []byte
+			command := binary.BigEndian.Uint32(head[4:]) & 0xffffff
+			switch command {
+			case 257:
+				vsa := append(diameterU32(266, 10415), diameterU32(258, 16777251)...)
+				for _, avp := range [][]byte{
+					diameterU32(268, resultCode),
+					diameterAVP(264, []byte("hss.example.net")),
+					diameterAVP(296, []byte("example.net")),
+					diameterAVP(269, []byte("FakeHSS")),
+					diameterU32(265, 10415),
+					diameterU32(258, 0xffffffff),
+					diameterAVP(260, vsa),
+				} {
+					avps = append(avps, avp...)
+				}
+			case 282:
+				avps = diameterU32(268, 2001)
+			default:
+				return
+			}
+			answer := make([]byte, 20)
+			copy(answer, head)
+			binary.BigEndian.PutUint32(answer, uint32(20+len(avps)))
+			answer[0] = 1
+			answer[4] = 0
+			conn.Write(append(answer, avps...))
+		}
+	}()
+	return ln.Addr().String(), origins
+}
+
+func TestDiameterProber(t *testing.T) {
+	address, origins := serveDiameter(t, 2001)
+	prober := libprobe.NewDiameterProber(libprobe.DiameterProberOptions{
+		OriginHost:       "probe.example.org",
+		AuthApplications: []uint32{16777251},
+	})
+	r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.DiameterResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, 2001, res.ResultCode)
+	require.Equal(t, "hss.example.net", res.OriginHost)
+	require.Equal(t, "example.net", res.OriginRealm)
+	require.Equal(t, "FakeHSS", res.ProductName)
+	require.Equal(t, []uint32{0xffffffff, 16777251}, res.AuthApplications)
+	require.Equal(t, []uint32{10415}, res.SupportedVendors)
+	require.Equal(t, "probe.example.org", <-origins)
+	require.Equal(t, "probe.example.org", <-origins)
+}
+
+func TestDiameterProberRejected(t *testing.T) {
+	address, _ := serveDiameter(t, 5010)
+	prober := libprobe.NewDiameterProber(libprobe.DiameterProberOptions{})
+	r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.DiameterResult)
+	require.Error(t, res.Error)
+	require.Equal(t, 5010, res.ResultCode)
+}
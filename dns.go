@@ -0,0 +1,552 @@
+package libprobe
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTypes are the record types DNS probers can query by name.
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"NS":    dnsmessage.TypeNS,
+	"CNAME": dnsmessage.TypeCNAME,
+	"SOA":   dnsmessage.TypeSOA,
+	"PTR":   dnsmessage.TypePTR,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"SRV":   dnsmessage.TypeSRV,
+	"SVCB":  dnsTypeSVCB,
+	"HTTPS": dnsTypeHTTPS,
+	"ANY":   dnsmessage.TypeALL,
+}
+
+var dnsRcodes = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+// parseDNSType returns the record type named s, such as "AAAA" or "TYPE65".
+func parseDNSType(s string) (dnsmessage.Type, error) {
+	s = strings.ToUpper(s)
+	if t, ok := dnsTypes[s]; ok {
+		return t, nil
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		if n, err := strconv.ParseUint(s[4:], 10, 16); err == nil {
+			return dnsmessage.Type(n), nil
+		}
+	}
+	return 0, fmt.Errorf("dns: unknown record type %q", s)
+}
+
+func dnsTypeName(t dnsmessage.Type) string {
+	for name, typ := range dnsTypes {
+		if typ == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+func dnsRcodeName(rcode dnsmessage.RCode) string {
+	if name, ok := dnsRcodes[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// dnsAnswer is a record of the answer section of a DNS response, its data in
+// presentation format.
+type dnsAnswer struct {
+	Name string
+	Type dnsmessage.Type
+	TTL  uint32
+	Data string
+	// SVCB is the decoded data of SVCB and HTTPS records.
+	SVCB *svcbRecord
+}
+
+func (a dnsAnswer) String() string {
+	return fmt.Sprintf("%s %d %s %s", a.Name, a.TTL, dnsTypeName(a.Type), a.Data)
+}
+
+type dnsResponse struct {
+	Header    dnsmessage.Header
+	Answers   []dnsAnswer
+	Authority []dnsAnswer
+	// EDNSSize is the UDP payload size advertised in the OPT record of the
+	// response, 0 without one.
+	EDNSSize int
+	// Truncated is set when the UDP response was truncated and the query
+	// retried over TCP.
+	Truncated bool
+	// Size is the size of the response message in bytes.
+	Size int
+}
+
+// dnsQuery builds a recursive query for name, returning its ID with it.
+func dnsQuery(name string, typ dnsmessage.Type) (uint16, []byte, error) {
+	return dnsQueryWith(name, typ, true, 0)
+}
+
+// dnsQueryWith builds a query for name, recursive if recursion is set, with
+// an EDNS(0) OPT record advertising ednsSize unless it's 0.
+func dnsQueryWith(name string, typ dnsmessage.Type, recursion bool, ednsSize int) (uint16, []byte, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return 0, nil, err
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               binary.BigEndian.Uint16(id[:]),
+			RecursionDesired: recursion,
+		},
+		Questions: []dnsmessage.Question{{Name: n, Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	if ednsSize > 0 {
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(ednsSize, dnsmessage.RCodeSuccess, false); err != nil {
+			return 0, nil, err
+		}
+		msg.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return 0, nil, err
+	}
+	return msg.Header.ID, b, nil
+}
+
+// dnsServerAddress adds the DNS port to server when it has none.
+func dnsServerAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "53")
+}
+
+// systemDNSServer returns the first name server of /etc/resolv.conf.
+func systemDNSServer() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return dnsServerAddress(fields[1]), nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("dns: no nameserver in /etc/resolv.conf")
+}
+
+// dnsExchange sends query to server over network ("udp" or "tcp") and reads
+// the response until deadline, counting the traffic with meter. Truncated
+// UDP responses are retried over TCP.
+func dnsExchange(meter *trafficMeter, network, server string, id uint16, query []byte, deadline time.Time) (*dnsResponse, error) {
+	conn, err := dialTimeout(meter, network, server, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	return dnsRoundTrip(conn, network, server, id, query, deadline)
+}
+
+// dnsRoundTrip sends query over conn, a connection to server over network,
+// and reads the response. Messages are framed with their length on stream
+// connections, such as TCP and TLS ones.
+func dnsRoundTrip(conn net.Conn, network, server string, id uint16, query []byte, deadline time.Time) (*dnsResponse, error) {
+	var b []byte
+	if network != "udp" {
+		msg := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(msg, uint16(len(query)))
+		copy(msg[2:], query)
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		b = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// Skip stray datagrams, such as late answers to earlier queries.
+			if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+				b = buf[:n]
+				break
+			}
+		}
+	}
+	resp, err := parseDNSResponse(b, id)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Truncated && network == "udp" {
+		if resp, err = dnsExchange(connMeter(conn), "tcp", server, id, query, deadline); err != nil {
+			return nil, err
+		}
+		resp.Truncated = true
+	}
+	return resp, nil
+}
+
+func parseDNSResponse(b []byte, id uint16) (*dnsResponse, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return nil, err
+	}
+	if h.ID != id || !h.Response {
+		return nil, errors.New("dns: response does not match the query")
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	resp := &dnsResponse{Header: h, Size: len(b)}
+	if resp.Answers, err = parseDNSSection(&p, p.AnswerHeader); err != nil {
+		return nil, err
+	}
+	if resp.Authority, err = parseDNSSection(&p, p.AuthorityHeader); err != nil {
+		return nil, err
+	}
+	for {
+		hdr, err := p.AdditionalHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Type == dnsmessage.TypeOPT {
+			resp.EDNSSize = int(hdr.Class)
+			resp.Header.RCode = hdr.ExtendedRCode(resp.Header.RCode)
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// parseDNSSection parses the records of the section whose headers are read
+// with next.
+func parseDNSSection(p *dnsmessage.Parser, next func() (dnsmessage.ResourceHeader, error)) ([]dnsAnswer, error) {
+	var records []dnsAnswer
+	for {
+		hdr, err := next()
+		if err == dnsmessage.ErrSectionDone {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		a := dnsAnswer{Name: hdr.Name.String(), Type: hdr.Type, TTL: hdr.TTL}
+		if hdr.Type == dnsTypeSVCB || hdr.Type == dnsTypeHTTPS {
+			r, err := p.UnknownResource()
+			if err != nil {
+				return nil, err
+			}
+			svcb, err := parseSVCB(r.Data)
+			if err != nil {
+				return nil, err
+			}
+			a.SVCB, a.Data = &svcb, svcb.String()
+		} else if a.Data, err = parseDNSData(p, hdr); err != nil {
+			return nil, err
+		}
+		records = append(records, a)
+	}
+}
+
+// parseDNSData formats the data of the current answer. Record types the
+// parser doesn't know are shown in the generic RFC 3597 format, without
+// their data.
+func parseDNSData(p *dnsmessage.Parser, hdr dnsmessage.ResourceHeader) (string, error) {
+	switch hdr.Type {
+	case dnsmessage.TypeA:
+		r, err := p.AResource()
+		return net.IP(r.A[:]).String(), err
+	case dnsmessage.TypeAAAA:
+		r, err := p.AAAAResource()
+		return net.IP(r.AAAA[:]).String(), err
+	case dnsmessage.TypeCNAME:
+		r, err := p.CNAMEResource()
+		return r.CNAME.String(), err
+	case dnsmessage.TypeNS:
+		r, err := p.NSResource()
+		return r.NS.String(), err
+	case dnsmessage.TypePTR:
+		r, err := p.PTRResource()
+		return r.PTR.String(), err
+	case dnsmessage.TypeMX:
+		r, err := p.MXResource()
+		return fmt.Sprintf("%d %s", r.Pref, r.MX), err
+	case dnsmessage.TypeSRV:
+		r, err := p.SRVResource()
+		return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, r.Target), err
+	case dnsmessage.TypeSOA:
+		r, err := p.SOAResource()
+		return fmt.Sprintf("%s %s %d %d %d %d %d", r.NS, r.MBox, r.Serial, r.Refresh, r.Retry, r.Expire, r.MinTTL), err
+	case dnsmessage.TypeTXT:
+		r, err := p.TXTResource()
+		quoted := make([]string, len(r.TXT))
+		for i, s := range r.TXT {
+			quoted[i] = strconv.Quote(s)
+		}
+		return strings.Join(quoted, " "), err
+	}
+	return fmt.Sprintf(`\# %d`, hdr.Length), p.SkipAnswer()
+}
+
+const KindDNS = "DNS"
+
+// DNSExtention configures the queries of a DNSProber.
+type DNSExtention struct {
+	// Server is the name server queried, as "host" or "host:port", or
+	// SystemResolver. Default: SystemResolver.
+	Server string
+	// QueryType is the record type queried, e.g. "AAAA" or "TXT".
+	// Default: "A".
+	QueryType string
+	// Recursion sets the recursion desired flag, as needed to monitor
+	// resolvers. Authoritative servers are queried without it.
+	Recursion bool
+	// EDNS adds an EDNS(0) OPT record advertising a UDP payload size of
+	// EDNSSize bytes, 1232 by default.
+	EDNS     bool
+	EDNSSize int
+	// Network is "udp", "tcp", "tls" for DNS over TLS (RFC 7858) or
+	// "https" for DNS over HTTPS (RFC 8484). Truncated UDP responses are
+	// always retried over TCP. Default: "udp".
+	//
+	// Over TLS, Server defaults to port 853. Over HTTPS, Server is the URL
+	// of the DoH endpoint, its path defaulting to "/dns-query".
+	Network string
+	// TLSConfig configures the TLS connections of DoT and DoH, e.g. RootCAs
+	// to verify certificates of a private resolver.
+	TLSConfig *tls.Config
+	// HTTPMethod is the method of DoH requests, "POST" or "GET".
+	// Default: "POST".
+	HTTPMethod string
+}
+
+// DNSRecord is a resource record of a DNS response, its data in
+// presentation format.
+type DNSRecord struct {
+	Name string
+	Type string
+	TTL  uint32
+	Data string
+}
+
+func (r DNSRecord) String() string {
+	return fmt.Sprintf("%s %d %s %s", r.Name, r.TTL, r.Type, r.Data)
+}
+
+// DNSResult is the response of a name server to a DNSProber query. Error is
+// set when the response code isn't NOERROR.
+type DNSResult struct {
+	Target
+	Error error
+
+	Server    string
+	Network   string
+	QueryType string
+	// Duration is the time taken by the whole exchange. Over TCP, TLS and
+	// HTTPS, it's split into the setup of the transport, ConnectTime and
+	// TLSHandshakeTime, and QueryTime, the time from sending the query on
+	// the established connection to receiving the response.
+	Duration         time.Duration
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	QueryTime        time.Duration
+	TLSVersion       string
+	Rcode            string
+	// Authoritative, Truncated and RecursionAvailable are flags of the
+	// response header. Truncated is set when the UDP response was
+	// truncated, even though the query was retried over TCP.
+	Authoritative      bool
+	Truncated          bool
+	RecursionAvailable bool
+	Answers            []DNSRecord
+	Authority          []DNSRecord
+	// MinTTL is the lowest TTL of the answers.
+	MinTTL uint32
+	// EDNSSize is the UDP payload size advertised by the server, 0 when it
+	// didn't answer with EDNS.
+	EDNSSize     int
+	ResponseSize int
+}
+
+func (r DNSResult) RTT() time.Duration {
+	return r.Duration
+}
+
+func (r DNSResult) String() string {
+	if r.Rcode == "" {
+		return fmt.Sprintf("%s %s @%s: %v", r.Target.Address, r.QueryType, r.Server, r.Error)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s @%s: %s in %v, %d bytes\n", r.Target.Address, r.QueryType, r.Server, r.Rcode, r.Duration, r.ResponseSize)
+	if r.TLSHandshakeTime > 0 {
+		fmt.Fprintf(&b, "connect %v, TLS handshake %v, query %v\n", r.ConnectTime, r.TLSHandshakeTime, r.QueryTime)
+	}
+	for _, a := range r.Answers {
+		fmt.Fprintf(&b, "%s\n", a)
+	}
+	for _, a := range r.Authority {
+		fmt.Fprintf(&b, "authority: %s\n", a)
+	}
+	return b.String()
+}
+
+// DNSProber queries a name server for the name in Target.Address and
+// measures the resolution latency. Target.Timeout defaults to five seconds.
+type DNSProber struct {
+	ext DNSExtention
+}
+
+func NewDNSProber(ext DNSExtention) *DNSProber {
+	if ext.Server == "" {
+		ext.Server = SystemResolver
+	}
+	if ext.QueryType == "" {
+		ext.QueryType = "A"
+	}
+	if ext.EDNS && ext.EDNSSize <= 0 {
+		ext.EDNSSize = 1232
+	}
+	if ext.Network == "" {
+		ext.Network = "udp"
+	}
+	if ext.HTTPMethod == "" {
+		ext.HTTPMethod = http.MethodPost
+	}
+	return &DNSProber{ext: ext}
+}
+
+func (p *DNSProber) Kind() string {
+	return KindDNS
+}
+
+func (p *DNSProber) Probe(target Target) (Result, error) {
+	typ, err := parseDNSType(p.ext.QueryType)
+	if err != nil {
+		return nil, err
+	}
+	if target.Timeout <= 0 {
+		target.Timeout = 5 * time.Second
+	}
+	r := &DNSResult{Target: target, Server: p.ext.Server, Network: p.ext.Network, QueryType: dnsTypeName(typ)}
+	var server string
+	switch {
+	case p.ext.Network == "https":
+		server, err = dohURL(p.ext.Server)
+	case p.ext.Server == SystemResolver:
+		server, err = systemDNSServer()
+		if err == nil && p.ext.Network == "tls" {
+			host, _, _ := net.SplitHostPort(server)
+			server = dotServerAddress(host)
+		}
+	case p.ext.Network == "tls":
+		server = dotServerAddress(p.ext.Server)
+	default:
+		server = dnsServerAddress(p.ext.Server)
+	}
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.Server = server
+	ednsSize := 0
+	if p.ext.EDNS {
+		ednsSize = p.ext.EDNSSize
+	}
+	id, query, err := dnsQueryWith(target.Address, typ, p.ext.Recursion, ednsSize)
+	if err != nil {
+		return nil, err
+	}
+	startAt := time.Now()
+	deadline := startAt.Add(target.Timeout)
+	var resp *dnsResponse
+	if p.ext.Network == "https" {
+		resp, err = p.exchangeHTTPS(r, server, query, deadline)
+	} else {
+		resp, err = p.exchange(r, server, id, query, deadline)
+	}
+	r.Duration = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.Rcode = dnsRcodeName(resp.Header.RCode)
+	r.Authoritative = resp.Header.Authoritative
+	r.Truncated = resp.Truncated
+	r.RecursionAvailable = resp.Header.RecursionAvailable
+	r.EDNSSize = resp.EDNSSize
+	r.ResponseSize = resp.Size
+	r.Answers = dnsRecords(resp.Answers)
+	r.Authority = dnsRecords(resp.Authority)
+	for i, a := range r.Answers {
+		if i == 0 || a.TTL < r.MinTTL {
+			r.MinTTL = a.TTL
+		}
+	}
+	if resp.Header.RCode != dnsmessage.RCodeSuccess {
+		r.Error = fmt.Errorf("dns: %s", r.Rcode)
+	}
+	return r, nil
+}
+
+func dnsRecords(answers []dnsAnswer) []DNSRecord {
+	var records []DNSRecord
+	for _, a := range answers {
+		records = append(records, DNSRecord{Name: a.Name, Type: dnsTypeName(a.Type), TTL: a.TTL, Data: a.Data})
+	}
+	return records
+}
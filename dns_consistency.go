@@ -0,0 +1,197 @@
+package libprobe
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const KindDNSConsistency = "DNS_CONSISTENCY"
+
+// SystemResolver names the first name server of /etc/resolv.conf in
+// DNSConsistencyProberOptions.Resolvers.
+const SystemResolver = "system"
+
+// DNSConsistencyProberOptions configures a DNSConsistencyProber.
+type DNSConsistencyProberOptions struct {
+	// Resolvers are the servers queried, as "host" or "host:port", or
+	// SystemResolver. Default: the system resolver, 8.8.8.8 and 1.1.1.1.
+	Resolvers []string
+	// Type is the record type queried, e.g. "AAAA" or "TXT". Default: "A".
+	Type string
+	// Network is "udp" or "tcp". Truncated UDP responses are always
+	// retried over TCP. Default: "udp".
+	Network string
+}
+
+// DNSResolverAnswer is the response of one resolver to a consistency probe.
+type DNSResolverAnswer struct {
+	Resolver string
+	RTT      time.Duration
+	Rcode    string
+	// Answers are the records of the answer section without their TTL,
+	// sorted to be compared across resolvers.
+	Answers []string
+	Error   string
+	// Differs is set when the resolver answered differently from the
+	// majority of resolvers.
+	Differs bool
+}
+
+// DNSConsistencyResult holds the answers of every resolver to the same
+// query. Error is set when a resolver failed or answers differ.
+type DNSConsistencyResult struct {
+	Target
+	Error error
+
+	Type       string
+	Consistent bool
+	Resolvers  []DNSResolverAnswer
+}
+
+// RTT returns the average RTT of the resolvers that answered.
+func (r DNSConsistencyResult) RTT() time.Duration {
+	var total time.Duration
+	var n int
+	for _, a := range r.Resolvers {
+		if a.Error == "" {
+			total += a.RTT
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / time.Duration(n)
+}
+
+func (r DNSConsistencyResult) String() string {
+	var b strings.Builder
+	state := "consistent"
+	if !r.Consistent {
+		state = "inconsistent"
+	}
+	fmt.Fprintf(&b, "%s %s: %s\n", r.Target.Address, r.Type, state)
+	for _, a := range r.Resolvers {
+		if a.Error != "" {
+			fmt.Fprintf(&b, "%s error=%s\n", a.Resolver, a.Error)
+			continue
+		}
+		mark := ""
+		if a.Differs {
+			mark = " (differs)"
+		}
+		fmt.Fprintf(&b, "%s %s %s%s: %s\n", a.Resolver, a.RTT, a.Rcode, mark, strings.Join(a.Answers, ", "))
+	}
+	return b.String()
+}
+
+// DNSConsistencyProber sends the same query for the name in Target.Address
+// to several resolvers concurrently and reports the latency of each one and
+// whether their answers agree. Target.Timeout, which defaults to five
+// seconds, applies to each resolver.
+type DNSConsistencyProber struct {
+	opts DNSConsistencyProberOptions
+}
+
+func NewDNSConsistencyProber(opts DNSConsistencyProberOptions) *DNSConsistencyProber {
+	if len(opts.Resolvers) == 0 {
+		opts.Resolvers = []string{SystemResolver, "8.8.8.8", "1.1.1.1"}
+	}
+	if opts.Type == "" {
+		opts.Type = "A"
+	}
+	if opts.Network == "" {
+		opts.Network = "udp"
+	}
+	return &DNSConsistencyProber{opts: opts}
+}
+
+func (p *DNSConsistencyProber) Kind() string {
+	return KindDNSConsistency
+}
+
+func (p *DNSConsistencyProber) Probe(target Target) (Result, error) {
+	typ, err := parseDNSType(p.opts.Type)
+	if err != nil {
+		return nil, err
+	}
+	if target.Timeout <= 0 {
+		target.Timeout = 5 * time.Second
+	}
+	r := &DNSConsistencyResult{
+		Target:    target,
+		Type:      dnsTypeName(typ),
+		Resolvers: make([]DNSResolverAnswer, len(p.opts.Resolvers)),
+	}
+	var wg sync.WaitGroup
+	for i, resolver := range p.opts.Resolvers {
+		wg.Add(1)
+		go func(a *DNSResolverAnswer, resolver string) {
+			defer wg.Done()
+			a.Resolver = resolver
+			server := dnsServerAddress(resolver)
+			var err error
+			if resolver == SystemResolver {
+				if server, err = systemDNSServer(); err != nil {
+					a.Error = err.Error()
+					return
+				}
+			}
+			id, query, err := dnsQuery(target.Address, typ)
+			if err != nil {
+				a.Error = err.Error()
+				return
+			}
+			startAt := time.Now()
+			resp, err := dnsExchange(target.meter, p.opts.Network, server, id, query, startAt.Add(target.Timeout))
+			if err != nil {
+				a.Error = err.Error()
+				return
+			}
+			a.RTT = time.Since(startAt)
+			a.Rcode = dnsRcodeName(resp.Header.RCode)
+			for _, ans := range resp.Answers {
+				a.Answers = append(a.Answers, fmt.Sprintf("%s %s %s", ans.Name, dnsTypeName(ans.Type), ans.Data))
+			}
+			sort.Strings(a.Answers)
+		}(&r.Resolvers[i], resolver)
+	}
+	wg.Wait()
+
+	// The majority is the most common rcode and answer set, the first
+	// resolver's winning ties.
+	votes := make(map[string]int)
+	var majority string
+	var failed int
+	for _, a := range r.Resolvers {
+		if a.Error != "" {
+			failed++
+			continue
+		}
+		key := a.key()
+		votes[key]++
+		if votes[key] > votes[majority] {
+			majority = key
+		}
+	}
+	for i := range r.Resolvers {
+		a := &r.Resolvers[i]
+		a.Differs = a.Error == "" && a.key() != majority
+	}
+	r.Consistent = failed == 0 && len(votes) <= 1
+	switch {
+	case failed > 0:
+		r.Error = fmt.Errorf("dns: %d of %d resolvers failed", failed, len(r.Resolvers))
+	case !r.Consistent:
+		r.Error = errors.New("dns: resolvers returned different answers")
+	}
+	return r, nil
+}
+
+func (a DNSResolverAnswer) key() string {
+	return a.Rcode + "\n" + strings.Join(a.Answers, "\n")
+}
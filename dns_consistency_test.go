@@ -0,0 +1,80 @@
+package libprobe_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDNS answers every A query on a local UDP port with the given
+// addresses and returns the server address.
+func serveDNS(t *testing.T, addresses ...string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.Header.ID, Response: true, RecursionAvailable: true},
+				Questions: query.Questions,
+			}
+			for _, address := range addresses {
+				var a dnsmessage.AResource
+				copy(a.A[:], net.ParseIP(address).To4())
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &a,
+				})
+			}
+			if len(addresses) == 0 {
+				resp.Header.RCode = dnsmessage.RCodeNameError
+			}
+			b, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(b, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDNSConsistencyProber(t *testing.T) {
+	a := serveDNS(t, "192.0.2.1", "192.0.2.2")
+	b := serveDNS(t, "192.0.2.2", "192.0.2.1")
+	c := serveDNS(t, "192.0.2.3")
+
+	prober := libprobe.NewDNSConsistencyProber(libprobe.DNSConsistencyProberOptions{Resolvers: []string{a, b}})
+	r, err := prober.Probe(libprobe.Target{Address: "example.com"})
+	require.NoError(t, err)
+	res := r.(*libprobe.DNSConsistencyResult)
+	require.NoError(t, res.Error)
+	require.True(t, res.Consistent)
+	require.Equal(t, "A", res.Type)
+	require.Equal(t, "NOERROR", res.Resolvers[0].Rcode)
+	require.Equal(t, []string{"example.com. A 192.0.2.1", "example.com. A 192.0.2.2"}, res.Resolvers[0].Answers)
+
+	prober = libprobe.NewDNSConsistencyProber(libprobe.DNSConsistencyProberOptions{Resolvers: []string{c, a, b}})
+	r, err = prober.Probe(libprobe.Target{Address: "example.com"})
+	require.NoError(t, err)
+	res = r.(*libprobe.DNSConsistencyResult)
+	require.Error(t, res.Error)
+	require.False(t, res.Consistent)
+	require.True(t, res.Resolvers[0].Differs)
+	require.False(t, res.Resolvers[1].Differs)
+	require.False(t, res.Resolvers[2].Differs)
+	require.NotZero(t, res.RTT())
+}
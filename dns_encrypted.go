@@ -0,0 +1,153 @@
+package libprobe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dnsMessageType is the media type of DoH requests and responses.
+const dnsMessageType = "application/dns-message"
+
+// dotServerAddress adds the DNS over TLS port to server when it has none.
+func dotServerAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "853")
+}
+
+// dohURL returns the URL of a DoH endpoint, given as a URL or a host, with
+// the path defaulting to "/dns-query".
+func dohURL(server string) (string, error) {
+	if server == SystemResolver {
+		return "", errors.New("dns: DNS over HTTPS needs the URL of a server")
+	}
+	if !strings.Contains(server, "://") {
+		server = "https://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" {
+		u.Path = "/dns-query"
+	}
+	return u.String(), nil
+}
+
+// exchange sends query to server over UDP, TCP or TLS, timing the setup of
+// the transport separately from the query.
+func (p *DNSProber) exchange(r *DNSResult, server string, id uint16, query []byte, deadline time.Time) (*dnsResponse, error) {
+	network := p.ext.Network
+	if network == "tls" {
+		network = "tcp"
+	}
+	start := time.Now()
+	conn, err := dialTimeout(r.meter, network, server, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { conn.Close() }()
+	if network == "tcp" {
+		r.ConnectTime = time.Since(start)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if p.ext.Network == "tls" {
+		start = time.Now()
+		tlsConn := tls.Client(conn, mailTLSConfig(p.ext.TLSConfig, server))
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		r.TLSHandshakeTime = time.Since(start)
+		r.TLSVersion = tlsVersionName(tlsConn.ConnectionState().Version)
+		conn = tlsConn
+	}
+	start = time.Now()
+	resp, err := dnsRoundTrip(conn, network, server, id, query, deadline)
+	r.QueryTime = time.Since(start)
+	return resp, err
+}
+
+// exchangeHTTPS sends query to the DoH endpoint at u over a new connection,
+// timing the setup of the connection separately from the query.
+func (p *DNSProber) exchangeHTTPS(r *DNSResult, u string, query []byte, deadline time.Time) (*dnsResponse, error) {
+	// RFC 8484 recommends the ID 0 so responses can be cached by HTTP.
+	query[0], query[1] = 0, 0
+	var req *http.Request
+	var err error
+	if p.ext.HTTPMethod == http.MethodGet {
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		req, err = http.NewRequest(http.MethodGet, u+sep+"dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	} else {
+		req, err = http.NewRequest(p.ext.HTTPMethod, u, bytes.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", dnsMessageType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dnsMessageType)
+	setDefaultUserAgent(req.Header)
+
+	var connectStart, connectDone, tlsStart, tlsDone, gotConn time.Time
+	var state tls.ConnectionState
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart:      func(_, _ string) { connectStart = time.Now() },
+		ConnectDone:       func(_, _ string, _ error) { connectDone = time.Now() },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(s tls.ConnectionState, _ error) {
+			tlsDone = time.Now()
+			state = s
+		},
+		GotConn: func(httptrace.GotConnInfo) { gotConn = time.Now() },
+	})
+	transport := &http.Transport{
+		DialContext:       meteredDial(r.meter),
+		TLSClientConfig:   p.ext.TLSConfig,
+		ForceAttemptHTTP2: true,
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	r.ConnectTime = connectDone.Sub(connectStart)
+	r.TLSHandshakeTime = tlsDone.Sub(tlsStart)
+	r.QueryTime = time.Since(gotConn)
+	if state.Version != 0 {
+		r.TLSVersion = tlsVersionName(state.Version)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns: HTTP status %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dnsMessageType {
+		return nil, fmt.Errorf("dns: unexpected content type %q", ct)
+	}
+	return parseDNSResponse(body, 0)
+}
@@ -0,0 +1,195 @@
+package libprobe_test
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSProber(t *testing.T) {
+	type query struct {
+		recursion bool
+		ednsSize  int
+	}
+	queries := make(chan query, 10)
+	address := serveUDP(t, func(b []byte) [][]byte {
+		var q dnsmessage.Message
+		if err := q.Unpack(b); err != nil {
+			return nil
+		}
+		seen := query{recursion: q.Header.RecursionDesired}
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, Authoritative: true},
+			Questions: q.Questions,
+		}
+		for _, a := range q.Additionals {
+			if a.Header.Type == dnsmessage.TypeOPT {
+				seen.ednsSize = int(a.Header.Class)
+				var opt dnsmessage.ResourceHeader
+				opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false)
+				resp.Additionals = append(resp.Additionals, dnsmessage.Resource{Header: opt, Body: &dnsmessage.OPTResource{}})
+			}
+		}
+		queries <- seen
+		name := q.Questions[0].Name
+		if name.String() == "missing.example." {
+			resp.Header.RCode = dnsmessage.RCodeNameError
+			soa := dnsmessage.MustNewName("example.")
+			resp.Authorities = append(resp.Authorities, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: soa, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.example."), MBox: dnsmessage.MustNewName("admin.example."), Serial: 7, MinTTL: 60},
+			})
+		} else {
+			for i, ttl := range []uint32{60, 30} {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl},
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i + 1)}},
+				})
+			}
+		}
+		b, _ = resp.Pack()
+		return [][]byte{b}
+	})
+
+	prober := libprobe.NewDNSProber(libprobe.DNSExtention{Server: address, Recursion: true, EDNS: true})
+	r, err := prober.Probe(libprobe.Target{Address: "www.example", Timeout: time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.DNSResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, query{recursion: true, ednsSize: 1232}, <-queries)
+	require.Equal(t, address, res.Server)
+	require.Equal(t, "A", res.QueryType)
+	require.Equal(t, "NOERROR", res.Rcode)
+	require.True(t, res.Authoritative)
+	require.Equal(t, 4096, res.EDNSSize)
+	require.Equal(t, uint32(30), res.MinTTL)
+	require.Equal(t, []libprobe.DNSRecord{
+		{Name: "www.example.", Type: "A", TTL: 60, Data: "192.0.2.1"},
+		{Name: "www.example.", Type: "A", TTL: 30, Data: "192.0.2.2"},
+	}, res.Answers)
+	require.True(t, res.RTT() > 0)
+
+	prober = libprobe.NewDNSProber(libprobe.DNSExtention{Server: address, QueryType: "aaaa"})
+	r, err = prober.Probe(libprobe.Target{Address: "missing.example", Timeout: time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.DNSResult)
+	require.Equal(t, query{}, <-queries)
+	require.EqualError(t, res.Error, "dns: NXDOMAIN")
+	require.Equal(t, "AAAA", res.QueryType)
+	require.Zero(t, res.EDNSSize)
+	require.Empty(t, res.Answers)
+	require.Equal(t, []libprobe.DNSRecord{
+		{Name: "example.", Type: "SOA", TTL: 300, Data: "ns.example. admin.example. 7 0 0 0 60"},
+	}, res.Authority)
+
+	_, err = libprobe.NewDNSProber(libprobe.DNSExtention{QueryType: "BOGUS"}).Probe(libprobe.Target{Address: "example"})
+	require.Error(t, err)
+
+	r, err = libprobe.NewDNSProber(libprobe.DNSExtention{Server: "127.0.0.1:1"}).Probe(libprobe.Target{Address: "example", Timeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+	require.Error(t, r.(*libprobe.DNSResult).Error)
+}
+
+// answerDNS answers a query with the address 192.0.2.1.
+func answerDNS(b []byte) []byte {
+	var q dnsmessage.Message
+	if err := q.Unpack(b); err != nil || len(q.Questions) != 1 {
+		return nil
+	}
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, RecursionAvailable: true},
+		Questions: q.Questions,
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}},
+	}
+	b, _ = resp.Pack()
+	return b
+}
+
+func TestDNSProberEncrypted(t *testing.T) {
+	// The test server's certificate is valid for example.com and 127.0.0.1.
+	var methods []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		var query []byte
+		if r.Method == http.MethodGet {
+			query, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			query, _ = ioutil.ReadAll(r.Body)
+		}
+		if r.URL.Path != "/dns-query" || binary.BigEndian.Uint16(query) != 0 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerDNS(query))
+	}))
+	defer srv.Close()
+	config := &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var l [2]byte
+				if _, err := io.ReadFull(conn, l[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(conn, q); err != nil {
+					return
+				}
+				b := answerDNS(q)
+				binary.BigEndian.PutUint16(l[:], uint16(len(b)))
+				conn.Write(append(l[:], b...))
+			}(conn)
+		}
+	}()
+
+	for _, ext := range []libprobe.DNSExtention{
+		{Server: ln.Addr().String(), Network: "tls", TLSConfig: config},
+		{Server: srv.URL, Network: "https", TLSConfig: config},
+		{Server: srv.URL + "/dns-query", Network: "https", TLSConfig: config, HTTPMethod: http.MethodGet},
+	} {
+		r, err := libprobe.NewDNSProber(ext).Probe(libprobe.Target{Address: "www.example", Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		res := r.(*libprobe.DNSResult)
+		require.NoError(t, res.Error, ext.Network)
+		require.Equal(t, ext.Network, res.Network)
+		require.Equal(t, []libprobe.DNSRecord{{Name: "www.example.", Type: "A", TTL: 60, Data: "192.0.2.1"}}, res.Answers)
+		require.True(t, res.ConnectTime > 0 && res.TLSHandshakeTime > 0 && res.QueryTime > 0)
+		require.True(t, res.Duration >= res.ConnectTime+res.TLSHandshakeTime+res.QueryTime)
+		require.Equal(t, "TLS 1.3", res.TLSVersion)
+	}
+	require.Equal(t, []string{http.MethodPost, http.MethodGet}, methods)
+
+	// The certificate isn't trusted without the test root.
+	r, err := libprobe.NewDNSProber(libprobe.DNSExtention{Server: ln.Addr().String(), Network: "tls"}).Probe(libprobe.Target{Address: "www.example", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.Error(t, r.(*libprobe.DNSResult).Error)
+
+	r, err = libprobe.NewDNSProber(libprobe.DNSExtention{Server: srv.URL + "/other", Network: "https", TLSConfig: config}).Probe(libprobe.Target{Address: "www.example", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.EqualError(t, r.(*libprobe.DNSResult).Error, "dns: HTTP status 404 Not Found")
+}
@@ -0,0 +1,345 @@
+package libprobe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS cache statuses of a probe, reported in the DNSCacheStatus field of
+// results.
+const (
+	DNSCacheHit    = "hit"
+	DNSCacheMiss   = "miss"
+	DNSCacheBypass = "bypass"
+)
+
+// DNSCacheOptions configures a DNSCache.
+type DNSCacheOptions struct {
+	// Server is the resolver queried on misses, as address[:port] or
+	// SystemResolver. Default: SystemResolver, which resolves names as the
+	// Go resolver does, honoring /etc/hosts and search domains.
+	Server string
+	// MinTTL and MaxTTL clamp the TTLs of the cached records. Default: 0
+	// and 1h. The TTLs of names resolved by SystemResolver are unknown;
+	// they are cached for MinTTL, or 1m when it's 0.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is how long a missing name is cached when the response
+	// has no SOA record to take it from (RFC 2308). Default: 30s.
+	NegativeTTL time.Duration
+	// MaxEntries bounds the cached names. Default: 10000.
+	MaxEntries int
+}
+
+// DNSCacheStats counts the lookups of a DNSCache.
+type DNSCacheStats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+	// NegativeHits are the hits on cached missing names, also counted in
+	// Hits.
+	NegativeHits uint64
+}
+
+// DNSCache caches the addresses of host names for their records' TTL, so
+// that probers probing names at a high frequency don't query the resolver
+// every time. Missing names are cached too, for the TTL of their zone's SOA
+// record; failures to resolve, such as timeouts or SERVFAIL, are not. A
+// cache can be shared by the probers of a process, which use it when set in
+// their options.
+type DNSCache struct {
+	opts DNSCacheOptions
+
+	hits         uint64
+	misses       uint64
+	negativeHits uint64
+
+	mu      sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []net.IP
+	err     error
+	expires time.Time
+}
+
+func NewDNSCache(opts DNSCacheOptions) *DNSCache {
+	if opts.Server == "" {
+		opts.Server = SystemResolver
+	}
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = time.Hour
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = 30 * time.Second
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 10000
+	}
+	return &DNSCache{opts: opts, entries: make(map[string]*dnsCacheEntry)}
+}
+
+// Stats returns the counters of the cache.
+func (c *DNSCache) Stats() DNSCacheStats {
+	c.mu.Lock()
+	n := len(c.entries)
+	c.mu.Unlock()
+	return DNSCacheStats{
+		Entries:      n,
+		Hits:         atomic.LoadUint64(&c.hits),
+		Misses:       atomic.LoadUint64(&c.misses),
+		NegativeHits: atomic.LoadUint64(&c.negativeHits),
+	}
+}
+
+// Flush empties the cache.
+func (c *DNSCache) Flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]*dnsCacheEntry)
+	c.mu.Unlock()
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of host, from the cache
+// while its records are fresh.
+func (c *DNSCache) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, _, err := c.lookup(ctx, host, false)
+	return addrs, err
+}
+
+// lookup returns the addresses of host and whether they came from the
+// cache. With bypass set the name is resolved afresh, refreshing the cache.
+func (c *DNSCache) lookup(ctx context.Context, host string, bypass bool) ([]net.IP, bool, error) {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return []net.IP{ip}, false, nil
+	}
+	key := normalizeDomain(host)
+	now := time.Now()
+	if !bypass {
+		c.mu.Lock()
+		e, ok := c.entries[key]
+		c.mu.Unlock()
+		if ok && now.Before(e.expires) {
+			atomic.AddUint64(&c.hits, 1)
+			if e.err != nil {
+				atomic.AddUint64(&c.negativeHits, 1)
+			}
+			return e.addrs, true, e.err
+		}
+		atomic.AddUint64(&c.misses, 1)
+	}
+
+	e, err := c.resolve(ctx, host)
+	if err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.opts.MaxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = e
+	return e.addrs, false, e.err
+}
+
+// evict removes the expired entries, or an arbitrary one if none are.
+func (c *DNSCache) evict(now time.Time) {
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) < c.opts.MaxEntries {
+		return
+	}
+	for key := range c.entries {
+		delete(c.entries, key)
+		return
+	}
+}
+
+// dnsCacheSystemTTL is how long names resolved by SystemResolver are cached
+// without a MinTTL.
+const dnsCacheSystemTTL = time.Minute
+
+// resolve queries the A and AAAA records of host, returning the entry to
+// cache. The error of a missing name is part of the entry. The addresses of
+// one family are kept when querying the other fails.
+func (c *DNSCache) resolve(ctx context.Context, host string) (*dnsCacheEntry, error) {
+	if c.opts.Server == SystemResolver {
+		return c.resolveSystem(ctx, host)
+	}
+	server := dnsServerAddress(c.opts.Server)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+
+	var addrs []net.IP
+	var failure error
+	ttl := c.opts.MaxTTL
+	negativeTTL := time.Duration(-1)
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		id, query, err := dnsQuery(host, typ)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := dnsExchange(trafficMeterFrom(ctx), "udp", server, id, query, deadline)
+		if err == nil {
+			if rcode := resp.Header.RCode; rcode != dnsmessage.RCodeSuccess && rcode != dnsmessage.RCodeNameError {
+				err = &net.DNSError{Err: "server misbehaving: " + dnsRcodeName(rcode), Name: host, Server: server}
+			}
+		}
+		if err != nil {
+			if failure == nil {
+				failure = err
+			}
+			continue
+		}
+		for _, a := range resp.Answers {
+			if d := time.Duration(a.TTL) * time.Second; d < ttl {
+				ttl = d
+			}
+			if a.Type == typ {
+				if ip := net.ParseIP(a.Data); ip != nil {
+					addrs = append(addrs, ip)
+				}
+			}
+		}
+		for _, a := range resp.Authority {
+			if a.Type == dnsmessage.TypeSOA {
+				if d := soaNegativeTTL(a); negativeTTL < 0 || d < negativeTTL {
+					negativeTTL = d
+				}
+			}
+		}
+	}
+
+	e := &dnsCacheEntry{addrs: addrs}
+	if len(addrs) == 0 {
+		// A name is only missing if neither family failed to resolve.
+		if failure != nil {
+			return nil, failure
+		}
+		e.err = &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+		ttl = negativeTTL
+		if ttl < 0 {
+			ttl = c.opts.NegativeTTL
+		}
+	}
+	c.expire(e, ttl)
+	return e, nil
+}
+
+// resolveSystem resolves host with the Go resolver, caching its addresses
+// for MinTTL or dnsCacheSystemTTL.
+func (c *DNSCache) resolveSystem(ctx context.Context, host string) (*dnsCacheEntry, error) {
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	e := &dnsCacheEntry{}
+	ttl := c.opts.MinTTL
+	if ttl <= 0 {
+		ttl = dnsCacheSystemTTL
+	}
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		e.err = err
+		ttl = c.opts.NegativeTTL
+	}
+	for _, a := range ipAddrs {
+		e.addrs = append(e.addrs, a.IP)
+	}
+	c.expire(e, ttl)
+	return e, nil
+}
+
+// expire sets the expiry of e after ttl, clamped by MinTTL and MaxTTL.
+func (c *DNSCache) expire(e *dnsCacheEntry, ttl time.Duration) {
+	if ttl < c.opts.MinTTL {
+		ttl = c.opts.MinTTL
+	}
+	if ttl > c.opts.MaxTTL {
+		ttl = c.opts.MaxTTL
+	}
+	e.expires = time.Now().Add(ttl)
+}
+
+// soaNegativeTTL returns the negative caching TTL of an SOA record, the
+// lower of its TTL and its MINIMUM field.
+func soaNegativeTTL(soa dnsAnswer) time.Duration {
+	ttl := time.Duration(soa.TTL) * time.Second
+	fields := strings.Fields(soa.Data)
+	if len(fields) == 7 {
+		if min, err := strconv.ParseUint(fields[6], 10, 32); err == nil && time.Duration(min)*time.Second < ttl {
+			ttl = time.Duration(min) * time.Second
+		}
+	}
+	return ttl
+}
+
+// dialCached resolves the host of address with cache, and dials the
+// addresses in turn until one accepts. The status reports whether the
+// cache was hit, or is "" without a cache, in which case dial resolves the
+// address itself.
+func dialCached(ctx context.Context, cache *DNSCache, bypass bool, network, address string, dial func(context.Context, string, string) (net.Conn, error)) (net.Conn, string, time.Duration, error) {
+	if cache == nil {
+		conn, err := dial(ctx, network, address)
+		return conn, "", 0, err
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if err := checkGuard(network, address); err != nil {
+		return nil, "", 0, err
+	}
+	addrs, status, resolveTime, err := cache.lookupStatus(ctx, host, bypass)
+	if err != nil {
+		return nil, status, resolveTime, err
+	}
+	conn, err := dialAddrs(ctx, network, addrs, port, dial)
+	return conn, status, resolveTime, err
+}
+
+// lookupStatus is lookup, returning the cache status and the time taken.
+// The status of an IP address, which isn't looked up, is "".
+func (c *DNSCache) lookupStatus(ctx context.Context, host string, bypass bool) ([]net.IP, string, time.Duration, error) {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return []net.IP{ip}, "", 0, nil
+	}
+	startAt := time.Now()
+	addrs, hit, err := c.lookup(ctx, host, bypass)
+	status := DNSCacheMiss
+	switch {
+	case hit:
+		status = DNSCacheHit
+	case bypass:
+		status = DNSCacheBypass
+	}
+	return addrs, status, time.Since(startAt), err
+}
+
+// dialAddrs dials port on addrs in turn until one accepts.
+func dialAddrs(ctx context.Context, network string, addrs []net.IP, port string, dial func(context.Context, string, string) (net.Conn, error)) (net.Conn, error) {
+	err := errors.New("no addresses to dial")
+	for _, ip := range addrs {
+		var conn net.Conn
+		if conn, err = dial(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,155 @@
+package libprobe_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSCache(t *testing.T) {
+	var queries int64
+	server := serveUDP(t, func(b []byte) [][]byte {
+		var q dnsmessage.Message
+		if err := q.Unpack(b); err != nil || len(q.Questions) != 1 {
+			return nil
+		}
+		atomic.AddInt64(&queries, 1)
+		question := q.Questions[0]
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, RecursionAvailable: true},
+			Questions: q.Questions,
+		}
+		soa := dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example."), Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.example."), MBox: dnsmessage.MustNewName("admin.example."), MinTTL: 60},
+		}
+		switch name := question.Name.String(); {
+		case name == "gone.example.":
+			resp.Header.RCode = dnsmessage.RCodeNameError
+			resp.Authorities = append(resp.Authorities, soa)
+		case question.Type == dnsmessage.TypeA:
+			ttl := uint32(60)
+			if strings.HasPrefix(name, "short.") {
+				ttl = 0
+			}
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			})
+		default:
+			resp.Authorities = append(resp.Authorities, soa)
+		}
+		b, _ = resp.Pack()
+		return [][]byte{b}
+	})
+	cache := libprobe.NewDNSCache(libprobe.DNSCacheOptions{Server: server})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	tcp := libprobe.NewTCPProberWithOptions(libprobe.TCPProberOptions{DNSCache: cache})
+	target := libprobe.Target{Address: net.JoinHostPort("www.example", port), Timeout: 5 * time.Second}
+	for _, want := range []string{libprobe.DNSCacheMiss, libprobe.DNSCacheHit} {
+		r, err := tcp.Probe(target)
+		require.NoError(t, err)
+		res := r.(*libprobe.TCPResult)
+		require.NoError(t, res.Error)
+		require.Equal(t, want, res.DNSCacheStatus)
+	}
+	require.Equal(t, int64(2), atomic.LoadInt64(&queries))
+	target.BypassDNSCache = true
+	r, err := tcp.Probe(target)
+	require.NoError(t, err)
+	require.Equal(t, libprobe.DNSCacheBypass, r.(*libprobe.TCPResult).DNSCacheStatus)
+	require.Equal(t, int64(4), atomic.LoadInt64(&queries))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, port, _ = net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	r, err = libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{DNSCache: cache}).Probe(libprobe.Target{
+		Address: "http://" + net.JoinHostPort("www.example", port) + "/",
+		Timeout: 5 * time.Second,
+	})
+	require.NoError(t, err)
+	res := r.(*libprobe.HTTPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, http.StatusOK, res.ResponseStatusCode)
+	require.Equal(t, libprobe.DNSCacheHit, res.DNSCacheStatus)
+	require.Equal(t, int64(4), atomic.LoadInt64(&queries))
+
+	// Missing names are cached for the SOA's minimum TTL, records with a
+	// zero TTL not at all.
+	for i := 0; i < 2; i++ {
+		_, err := cache.LookupIP(context.Background(), "gone.example")
+		require.True(t, err.(*net.DNSError).IsNotFound)
+		addrs, err := cache.LookupIP(context.Background(), "short.example")
+		require.NoError(t, err)
+		require.Equal(t, "127.0.0.1", addrs[0].String())
+	}
+	require.Equal(t, int64(10), atomic.LoadInt64(&queries))
+	stats := cache.Stats()
+	require.Equal(t, libprobe.DNSCacheStats{Entries: 3, Hits: 3, Misses: 4, NegativeHits: 1}, stats)
+
+	cache.Flush()
+	require.Zero(t, cache.Stats().Entries)
+}
+
+func TestDNSCacheSystemResolver(t *testing.T) {
+	cache := libprobe.NewDNSCache(libprobe.DNSCacheOptions{})
+	// localhost comes from the hosts file, which the servers of
+	// /etc/resolv.conf don't know.
+	addrs, err := cache.LookupIP(context.Background(), "localhost")
+	require.NoError(t, err)
+	require.NotEmpty(t, addrs)
+	require.True(t, addrs[0].IsLoopback())
+	_, err = cache.LookupIP(context.Background(), "localhost")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), cache.Stats().Hits)
+}
+
+func TestDNSCachePartialAnswer(t *testing.T) {
+	server := serveUDP(t, func(b []byte) [][]byte {
+		var q dnsmessage.Message
+		if err := q.Unpack(b); err != nil || len(q.Questions) != 1 || q.Questions[0].Type != dnsmessage.TypeA {
+			return nil // AAAA queries time out
+		}
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.Header.ID, Response: true},
+			Questions: q.Questions,
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			}},
+		}
+		b, _ = resp.Pack()
+		return [][]byte{b}
+	})
+	cache := libprobe.NewDNSCache(libprobe.DNSCacheOptions{Server: server})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	addrs, err := cache.LookupIP(ctx, "www.example")
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	require.Equal(t, "127.0.0.1", addrs[0].String())
+}
@@ -0,0 +1,199 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindECH = "ECH"
+
+// ECHProberOptions configures an ECHProber.
+type ECHProberOptions struct {
+	// Resolver is the name server queried for the HTTPS record of the
+	// target, as "host" or "host:port", or SystemResolver. Default:
+	// SystemResolver.
+	Resolver string
+	// ServerName is the name sent in the encrypted ClientHello. Default:
+	// the host of Target.Address.
+	ServerName string
+	// ConfigList is an ECHConfigList used instead of that of the HTTPS
+	// record, which isn't queried then.
+	ConfigList []byte
+}
+
+// ECHResult describes the deployment of Encrypted Client Hello on a server.
+type ECHResult struct {
+	Target
+	// Error is set when the server has no ECH configuration, or rejected
+	// ECH without retry configurations that it accepts.
+	Error error
+
+	LookupTime time.Duration
+	// ConfigFound is set when the HTTPS record, or ECHProberOptions,
+	// carries an ECHConfigList, PublicName being the name of its first
+	// configuration, sent in the outer ClientHello.
+	ConfigFound   bool
+	PublicName    string
+	ConnectTime   time.Duration
+	HandshakeTime time.Duration
+	Version       string
+	// Accepted is set when the server decrypted the inner ClientHello.
+	// Otherwise the handshake fell back to the outer one, and the server
+	// may send RetryConfigs, which are tried once: RetryAccepted is set
+	// when the second handshake is accepted.
+	Accepted      bool
+	RetryConfigs  bool
+	RetryAccepted bool
+}
+
+func (r ECHResult) RTT() time.Duration {
+	return r.HandshakeTime
+}
+
+func (r ECHResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	outcome := "accepted"
+	if r.RetryAccepted {
+		outcome = "accepted after retry"
+	}
+	return fmt.Sprintf("-> %s ECH %s, public name %s, lookup %v, handshake %v", r.Target.Address, outcome, r.PublicName, r.LookupTime, r.HandshakeTime)
+}
+
+// ECHProber checks Encrypted Client Hello on Target.Address, "host" or
+// "host:port" with port 443 by default: it resolves the ECH configuration
+// of the host from its HTTPS record and attempts a handshake with it.
+// Target.Timeout, five seconds by default, covers the lookup and the
+// handshakes. Certificates aren't verified, as TLSProber does.
+type ECHProber struct {
+	opts ECHProberOptions
+}
+
+func NewECHProber(opts ECHProberOptions) *ECHProber {
+	if opts.Resolver == "" {
+		opts.Resolver = SystemResolver
+	}
+	return &ECHProber{opts: opts}
+}
+
+func (p *ECHProber) Kind() string {
+	return KindECH
+}
+
+func (p *ECHProber) Probe(target Target) (Result, error) {
+	r := &ECHResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "443")
+	}
+	host, port, _ := net.SplitHostPort(address)
+	if target.Timeout <= 0 {
+		target.Timeout = 5 * time.Second
+	}
+	deadline := time.Now().Add(target.Timeout)
+
+	configList := p.opts.ConfigList
+	if configList == nil {
+		lookupAt := time.Now()
+		records, err := lookupHTTPSRecords(target.meter, p.opts.Resolver, httpsRecordName(host, port), deadline)
+		r.LookupTime = time.Since(lookupAt)
+		if err != nil {
+			r.Error = err
+			return r, nil
+		}
+		for _, record := range records {
+			if record.ECH != nil {
+				configList = record.ECH
+				break
+			}
+		}
+	}
+	if configList == nil {
+		r.Error = fmt.Errorf("ech: no ECH configuration for %s", host)
+		return r, nil
+	}
+	r.ConfigFound = true
+	r.PublicName = echPublicName(configList)
+
+	var retryConfigs []byte
+	r.ConnectTime, r.HandshakeTime, r.Version, retryConfigs, r.Error = p.handshake(target.meter, address, host, configList, deadline)
+	var rejection *tls.ECHRejectionError
+	if !errors.As(r.Error, &rejection) {
+		r.Accepted = r.Error == nil
+		return r, nil
+	}
+	if retryConfigs == nil {
+		r.Error = errors.New("ech: the server rejected ECH without retry configurations")
+		return r, nil
+	}
+	r.RetryConfigs = true
+	r.ConnectTime, r.HandshakeTime, r.Version, _, r.Error = p.handshake(target.meter, address, host, retryConfigs, deadline)
+	if errors.As(r.Error, &rejection) {
+		r.Error = errors.New("ech: the server rejected its retry configurations")
+	}
+	r.RetryAccepted = r.Error == nil
+	return r, nil
+}
+
+// handshake performs a handshake with configList, returning the retry
+// configurations of the server when it rejects ECH. The certificate of the
+// public name isn't verified either.
+func (p *ECHProber) handshake(meter *trafficMeter, address, host string, configList []byte, deadline time.Time) (time.Duration, time.Duration, string, []byte, error) {
+	config := unverifiedTLSConfig(&tls.Config{
+		ServerName:                          p.opts.ServerName,
+		MinVersion:                          tls.VersionTLS13,
+		EncryptedClientHelloConfigList:      configList,
+		EncryptedClientHelloRejectionVerify: func(tls.ConnectionState) error { return nil },
+	}, host)
+	startAt := time.Now()
+	conn, err := dialTimeout(meter, "tcp", address, time.Until(deadline))
+	if err != nil {
+		return 0, 0, "", nil, err
+	}
+	defer conn.Close()
+	connectTime := time.Since(startAt)
+	_ = conn.SetDeadline(deadline)
+	handshakeAt := time.Now()
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		var rejection *tls.ECHRejectionError
+		if errors.As(err, &rejection) && len(rejection.RetryConfigList) > 0 {
+			return connectTime, 0, "", rejection.RetryConfigList, err
+		}
+		return connectTime, 0, "", nil, err
+	}
+	state := tlsConn.ConnectionState()
+	return connectTime, time.Since(handshakeAt), tlsVersionName(state.Version), nil, nil
+}
+
+// echPublicName returns the public name of the first configuration of an
+// ECHConfigList of version 0xfe0d, empty when it can't be decoded.
+func echPublicName(list []byte) string {
+	// ECHConfigList: length(2), then ECHConfig: version(2), length(2),
+	// config_id(1), kem_id(2), public_key<2>, cipher_suites<2>,
+	// maximum_name_length(1), public_name<1>.
+	if len(list) < 6 || binary.BigEndian.Uint16(list[2:]) != 0xfe0d {
+		return ""
+	}
+	b := list[6:]
+	if len(b) < 3 {
+		return ""
+	}
+	b = b[3:]
+	for i := 0; i < 2; i++ {
+		if len(b) < 2 || int(binary.BigEndian.Uint16(b)) > len(b)-2 {
+			return ""
+		}
+		b = b[2+int(binary.BigEndian.Uint16(b)):]
+	}
+	if len(b) < 2 || int(b[1]) > len(b)-2 {
+		return ""
+	}
+	return string(b[2 : 2+int(b[1])])
+}
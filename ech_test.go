@@ -0,0 +1,111 @@
+package libprobe_test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// echConfigList encodes an ECHConfigList of one X25519 configuration with
+// the public name public.example.
+func echConfigList(t *testing.T) ([]byte, *ecdh.PrivateKey) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	u16 := func(b []byte) []byte { return append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...) }
+	contents := []byte{1, 0x00, 0x20}
+	contents = append(contents, u16(key.PublicKey().Bytes())...)
+	contents = append(contents, u16([]byte{0, 1, 0, 1})...)
+	contents = append(contents, 0, byte(len("public.example")))
+	contents = append(contents, "public.example"...)
+	contents = append(contents, 0, 0)
+	config := append([]byte{0xfe, 0x0d}, u16(contents)...)
+	return config, key
+}
+
+// serveHTTPSRecord serves the HTTPS record "1 . alpn=h2" for any name, with
+// ech if set.
+func serveHTTPSRecord(t *testing.T, ech []byte) string {
+	return serveUDP(t, func(b []byte) [][]byte {
+		var q dnsmessage.Message
+		if q.Unpack(b) != nil {
+			return nil
+		}
+		data := []byte{0, 1, 0, 0, 1, 0, 3, 2, 'h', '2'}
+		if ech != nil {
+			data = binary.BigEndian.AppendUint16(append(data, 0, 5), uint16(len(ech)))
+			data = append(data, ech...)
+		}
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, RecursionAvailable: true},
+			Questions: q.Questions,
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: 65, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.UnknownResource{Type: 65, Data: data},
+			}},
+		}
+		out, _ := resp.Pack()
+		return [][]byte{out}
+	})
+}
+
+func TestECHProber(t *testing.T) {
+	config, key := echConfigList(t)
+	list := binary.BigEndian.AppendUint16(nil, uint16(len(config)))
+	list = append(list, config...)
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &tls.Config{EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{{Config: config, PrivateKey: key.Bytes(), SendAsRetry: true}}}
+	srv.StartTLS()
+	defer srv.Close()
+	target := libprobe.Target{Address: srv.Listener.Addr().String(), Timeout: 5 * time.Second}
+
+	r, err := libprobe.NewECHProber(libprobe.ECHProberOptions{Resolver: serveHTTPSRecord(t, list), ServerName: "example.com"}).Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.ECHResult)
+	require.NoError(t, res.Error)
+	require.True(t, res.ConfigFound)
+	require.Equal(t, "public.example", res.PublicName)
+	require.True(t, res.Accepted)
+	require.False(t, res.RetryAccepted)
+	require.Equal(t, "TLS 1.3", res.Version)
+	require.Positive(t, res.LookupTime)
+	require.Positive(t, res.HandshakeTime)
+
+	// A stale configuration is rejected, and the retry configurations
+	// accepted.
+	stale, _ := echConfigList(t)
+	staleList := append(binary.BigEndian.AppendUint16(nil, uint16(len(stale))), stale...)
+	r, err = libprobe.NewECHProber(libprobe.ECHProberOptions{ConfigList: staleList, ServerName: "example.com"}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.ECHResult)
+	require.NoError(t, res.Error)
+	require.False(t, res.Accepted)
+	require.True(t, res.RetryConfigs)
+	require.True(t, res.RetryAccepted)
+	require.Zero(t, res.LookupTime)
+
+	// Without ECH in the HTTPS record.
+	r, err = libprobe.NewECHProber(libprobe.ECHProberOptions{Resolver: serveHTTPSRecord(t, nil)}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.ECHResult)
+	require.Error(t, res.Error)
+	require.False(t, res.ConfigFound)
+
+	// A server without ECH falls back to the outer ClientHello.
+	plain := httptest.NewTLSServer(http.NotFoundHandler())
+	defer plain.Close()
+	r, err = libprobe.NewECHProber(libprobe.ECHProberOptions{ConfigList: list, ServerName: "example.com"}).Probe(libprobe.Target{Address: plain.Listener.Addr().String(), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.ECHResult)
+	require.EqualError(t, res.Error, "ech: the server rejected ECH without retry configurations")
+	require.False(t, res.Accepted)
+}
@@ -0,0 +1,982 @@
+package libprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job is a target scheduled on an Engine together with the prober used for it.
+type Job struct {
+	// ID identifies the job within an engine. Default: "<kind>/<address>".
+	ID       string
+	Prober   Prober
+	Target   Target
+	Interval time.Duration
+	// Spacing selects how the delay between probe starts is derived from
+	// Interval. Default: SpacingFixed.
+	Spacing Spacing
+	// Jitter is the maximum relative deviation from Interval used by
+	// SpacingUniform, e.g. 0.1 for ±10%.
+	Jitter float64
+	// Offset delays the first probe after the job is started, to stagger
+	// jobs sharing an interval.
+	Offset time.Duration
+	// Overlap decides what happens when a probe is due while a probe of the
+	// same kind against the same address, from this or another job, is
+	// still running. Default: OverlapSkip.
+	Overlap OverlapPolicy
+	// Adaptive, when set, adapts the interval to the health of the target,
+	// and Backoff backs off from a persistently failing target. With either
+	// set, results are wrapped in ScheduledResult.
+	Adaptive *AdaptiveInterval
+	Backoff  *FailureBackoff
+	// ExpectedTraffic is the traffic of a probe, accounted for results that
+	// don't implement TrafficReporter when the probe opened no socket the
+	// engine counts: TCP, UDP and QUIC sockets are counted, raw ones aren't.
+	// It also reserves bandwidth budget before probing; the traffic of the
+	// job's previous probe is used when it's zero.
+	ExpectedTraffic Traffic
+	// SkipBogons skips probes of targets whose address is a bogon, as
+	// classified by EngineOptions.Classifier or the IANA registries. Host
+	// names are resolved before every probe.
+	SkipBogons bool
+}
+
+// OverlapPolicy is a strategy for probes overrunning their interval.
+type OverlapPolicy int
+
+const (
+	// OverlapSkip skips due probes while the target is being probed.
+	OverlapSkip OverlapPolicy = iota
+	// OverlapQueue delays a due probe until the running one finished.
+	OverlapQueue
+	// OverlapCancel cancels the running probe and starts the due one. The
+	// cancelled probe's result is discarded. Probers not implementing
+	// ContextProber can't be interrupted; their probe is abandoned and
+	// keeps running in the background.
+	OverlapCancel
+	// OverlapAllow runs probes against the same target concurrently.
+	OverlapAllow
+)
+
+// Spacing is a strategy to space probes of a job.
+type Spacing int
+
+const (
+	// SpacingFixed starts probes exactly every Interval.
+	SpacingFixed Spacing = iota
+	// SpacingUniform adds a uniformly distributed deviation of up to
+	// ±Jitter*Interval to every delay.
+	SpacingUniform
+	// SpacingPoisson draws delays from an exponential distribution with
+	// mean Interval, making probe starts a Poisson process. This avoids
+	// synchronizing with periodic network events and gives unbiased loss
+	// sampling (RFC 2330 section 11.1). Delays are truncated at
+	// 10*Interval.
+	SpacingPoisson
+)
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// NextDelay returns the delay between the start of a probe and the start of
+// the next one.
+func (j Job) NextDelay() time.Duration {
+	switch j.Spacing {
+	case SpacingUniform:
+		jitterMu.Lock()
+		f := jitterRand.Float64()*2 - 1
+		jitterMu.Unlock()
+		d := time.Duration(float64(j.Interval) * (1 + f*j.Jitter))
+		if d < 0 {
+			return 0
+		}
+		return d
+	case SpacingPoisson:
+		jitterMu.Lock()
+		f := jitterRand.ExpFloat64()
+		jitterMu.Unlock()
+		if f > 10 {
+			f = 10
+		}
+		return time.Duration(float64(j.Interval) * f)
+	default:
+		return j.Interval
+	}
+}
+
+// Key returns the job's ID, or its default derived from kind and address.
+func (j Job) Key() string {
+	if j.ID != "" {
+		return j.ID
+	}
+	return j.Prober.Kind() + "/" + j.Target.Address
+}
+
+// EngineOptions configures an Engine.
+type EngineOptions struct {
+	// Sinks receive every result.
+	Sinks []Sink
+	// OnResult, when set, is called after every probe.
+	OnResult func(job Job, r Result, err error)
+	// Concurrency limits the probes running at the same time. Due probes
+	// wait in a queue for a free slot. Default: 64.
+	Concurrency int
+	// DefaultInterval is used for jobs without an Interval. Default: 1m.
+	DefaultInterval time.Duration
+	// AssignProbeIDs gives every probe of a job whose target has no ProbeID
+	// a fresh random one, so its result can be correlated with what the
+	// probe left on the wire.
+	AssignProbeIDs bool
+	// Timestamps wraps results in TimestampedResult, qualified by Clock
+	// when set. The engine doesn't start Clock.
+	Timestamps bool
+	Clock      *ClockChecker
+	// Budget, when set, bounds the traffic of all jobs.
+	Budget *BandwidthBudget
+	// Classifier, when set, classifies the address of every target before
+	// it's probed, resolving host names, and wraps results in
+	// ClassifiedResult.
+	Classifier AddressClassifier
+	// Watchdog kills probes running past a hard cap and accounts the
+	// resources probes leave behind.
+	Watchdog WatchdogOptions
+}
+
+var (
+	ErrJobExists     = errors.New("job already exists")
+	ErrJobNotFound   = errors.New("job not found")
+	ErrEngineStopped = errors.New("engine stopped")
+)
+
+// Engine runs jobs periodically and delivers their results to sinks.
+type Engine struct {
+	opts EngineOptions
+	slot chan struct{}
+
+	mu      sync.Mutex
+	jobs    map[string]*scheduledJob
+	gates   map[string]*targetGate
+	running bool
+	closed  bool
+	wg      sync.WaitGroup
+
+	// sinkMu guards sinksClosed, set once Shutdown began closing the
+	// sinks; sinkWrites counts the deliveries writing to them meanwhile.
+	sinkMu      sync.RWMutex
+	sinksClosed bool
+	sinkWrites  sync.WaitGroup
+
+	statsMu    sync.Mutex
+	queued     int
+	inFlight   int
+	kinds      map[string]*KindStats
+	sinkErrors int64
+	lastSink   error
+	traffic    Traffic
+	budget     budgetState
+	hung       int
+}
+
+type scheduledJob struct {
+	job   Job
+	stop  chan struct{}
+	stats *JobStats
+}
+
+// targetGate serializes the probes against one target across jobs.
+type targetGate struct {
+	refs int
+	busy chan struct{}
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+func NewEngine(opts EngineOptions) *Engine {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 64
+	}
+	if opts.DefaultInterval <= 0 {
+		opts.DefaultInterval = time.Minute
+	}
+	if opts.Budget != nil && opts.Budget.Period <= 0 {
+		budget := *opts.Budget
+		budget.Period = 24 * time.Hour
+		opts.Budget = &budget
+	}
+	return &Engine{
+		opts:  opts,
+		slot:  make(chan struct{}, opts.Concurrency),
+		jobs:  make(map[string]*scheduledJob),
+		gates: make(map[string]*targetGate),
+		kinds: make(map[string]*KindStats),
+	}
+}
+
+func (e *Engine) normalize(job Job) (Job, error) {
+	if job.Prober == nil {
+		return job, errors.New("job has no prober")
+	}
+	if job.Interval <= 0 {
+		job.Interval = e.opts.DefaultInterval
+	}
+	return job, nil
+}
+
+// Add schedules a job. Jobs added to a running engine start immediately.
+func (e *Engine) Add(job Job) error {
+	job, err := e.normalize(job)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return ErrEngineStopped
+	}
+	key := job.Key()
+	if _, ok := e.jobs[key]; ok {
+		return fmt.Errorf("%w: %s", ErrJobExists, key)
+	}
+	sj := &scheduledJob{job: job, stats: &JobStats{}}
+	e.jobs[key] = sj
+	if e.running {
+		e.startJob(sj)
+	}
+	return nil
+}
+
+// Remove unschedules a job. A probe of the job that is in flight completes
+// and its result is still delivered.
+func (e *Engine) Remove(key string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sj, ok := e.jobs[key]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrJobNotFound, key)
+	}
+	delete(e.jobs, key)
+	if sj.stop != nil {
+		close(sj.stop)
+	}
+	return nil
+}
+
+// ApplyChanges lists the job keys affected by Apply.
+type ApplyChanges struct {
+	Added   []string
+	Updated []string
+	Removed []string
+}
+
+// Apply replaces the scheduled jobs with jobs, touching only what changed:
+// new jobs are added, jobs no longer present are removed, and jobs whose
+// prober, target or schedule changed are rescheduled. Unchanged jobs keep
+// running undisturbed, and all jobs that stay keep their JobStats. Jobs are
+// compared with reflect.DeepEqual, so reuse prober instances across calls to
+// keep jobs unchanged.
+func (e *Engine) Apply(jobs []Job) (ApplyChanges, error) {
+	var changes ApplyChanges
+	desired := make(map[string]Job, len(jobs))
+	for _, job := range jobs {
+		job, err := e.normalize(job)
+		if err != nil {
+			return changes, err
+		}
+		key := job.Key()
+		if _, ok := desired[key]; ok {
+			return changes, fmt.Errorf("%w: %s", ErrJobExists, key)
+		}
+		desired[key] = job
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return changes, ErrEngineStopped
+	}
+	for key, sj := range e.jobs {
+		if _, ok := desired[key]; !ok {
+			delete(e.jobs, key)
+			if sj.stop != nil {
+				close(sj.stop)
+			}
+			changes.Removed = append(changes.Removed, key)
+		}
+	}
+	for key, job := range desired {
+		sj, ok := e.jobs[key]
+		if !ok {
+			sj = &scheduledJob{job: job, stats: &JobStats{}}
+			e.jobs[key] = sj
+			if e.running {
+				e.startJob(sj)
+			}
+			changes.Added = append(changes.Added, key)
+			continue
+		}
+		if reflect.DeepEqual(sj.job, job) {
+			continue
+		}
+		if sj.stop != nil {
+			close(sj.stop)
+			sj.stop = nil
+		}
+		sj.job = job
+		if e.running {
+			e.startJob(sj)
+		}
+		changes.Updated = append(changes.Updated, key)
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Updated)
+	sort.Strings(changes.Removed)
+	return changes, nil
+}
+
+// Jobs returns the scheduled jobs.
+func (e *Engine) Jobs() []Job {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	jobs := make([]Job, 0, len(e.jobs))
+	for _, sj := range e.jobs {
+		jobs = append(jobs, sj.job)
+	}
+	return jobs
+}
+
+// Start begins probing all scheduled jobs. It has no effect after Shutdown.
+func (e *Engine) Start() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running || e.closed {
+		return
+	}
+	e.running = true
+	for _, sj := range e.jobs {
+		e.startJob(sj)
+	}
+}
+
+// Stop stops scheduling and waits for in-flight probes to finish. The engine
+// can be started again.
+func (e *Engine) Stop() {
+	e.stopJobs()
+	e.wg.Wait()
+}
+
+func (e *Engine) stopJobs() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.running {
+		return
+	}
+	e.running = false
+	for _, sj := range e.jobs {
+		close(sj.stop)
+		sj.stop = nil
+	}
+}
+
+// Flusher is implemented by sinks buffering results.
+type Flusher interface {
+	Flush() error
+}
+
+// Shutdown stops scheduling new probes, waits for in-flight probes until ctx
+// is done, then flushes and closes all sinks and releases the resources
+// probers keep between probes: probers implementing io.Closer are closed and
+// the connections an HTTPProber keeps with ReuseConnections are closed.
+// Probes still running or sinks still writing when ctx expires are abandoned
+// and ctx's error is returned; otherwise the first sink or prober error is
+// returned. Results of abandoned probes are discarded. The engine can't be
+// restarted afterwards.
+func (e *Engine) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return ErrEngineStopped
+	}
+	e.closed = true
+	e.mu.Unlock()
+	e.stopJobs()
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	e.sinkMu.Lock()
+	e.sinksClosed = true
+	e.sinkMu.Unlock()
+	// A hung sink write must not hold Shutdown past ctx, so the sinks are
+	// closed once the writes in flight are done, in the background.
+	closed := make(chan error, 1)
+	go func() {
+		e.sinkWrites.Wait()
+		closed <- e.closeSinks()
+	}()
+	select {
+	case cerr := <-closed:
+		if err == nil {
+			err = cerr
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if perr := e.closeProbers(); perr != nil && err == nil {
+		err = perr
+	}
+	return err
+}
+
+func (e *Engine) closeSinks() error {
+	var err error
+	for _, s := range e.opts.Sinks {
+		if f, ok := s.(Flusher); ok {
+			if ferr := f.Flush(); ferr != nil && err == nil {
+				err = ferr
+			}
+		}
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeProbers releases the resources the probers of the jobs keep between
+// probes, once for probers shared by several jobs.
+func (e *Engine) closeProbers() error {
+	e.mu.Lock()
+	probers := make([]Prober, 0, len(e.jobs))
+	seen := make(map[Prober]bool)
+	for _, sj := range e.jobs {
+		p := sj.job.Prober
+		if reflect.TypeOf(p).Comparable() {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+		}
+		probers = append(probers, p)
+	}
+	e.mu.Unlock()
+	var err error
+	for _, p := range probers {
+		switch p := p.(type) {
+		case io.Closer:
+			if cerr := p.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		case *HTTPProber:
+			p.closeIdleConnections()
+		}
+	}
+	return err
+}
+
+// startJob must be called with e.mu held.
+func (e *Engine) startJob(sj *scheduledJob) {
+	sj.stop = make(chan struct{})
+	e.wg.Add(1)
+	go e.loop(sj.job, sj.stop, sj.stats)
+}
+
+func (e *Engine) acquireGate(job Job) *targetGate {
+	key := job.Prober.Kind() + "/" + job.Target.Address
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	gate, ok := e.gates[key]
+	if !ok {
+		gate = &targetGate{busy: make(chan struct{}, 1)}
+		e.gates[key] = gate
+	}
+	gate.refs++
+	return gate
+}
+
+func (e *Engine) releaseGate(job Job) {
+	key := job.Prober.Kind() + "/" + job.Target.Address
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if gate := e.gates[key]; gate != nil {
+		gate.refs--
+		if gate.refs == 0 {
+			delete(e.gates, key)
+		}
+	}
+}
+
+func (e *Engine) loop(job Job, stop <-chan struct{}, stats *JobStats) {
+	defer e.wg.Done()
+	gate := e.acquireGate(job)
+	defer e.releaseGate(job)
+	var probes sync.WaitGroup
+	defer probes.Wait()
+	sched := newJobSchedule(job)
+	timer := time.NewTimer(job.Offset)
+	defer timer.Stop()
+	var startedAt time.Time
+	for {
+		select {
+		case <-timer.C:
+		case <-sched.changed:
+			// The interval changed since the timer was set.
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(startedAt.Add(sched.nextDelay())))
+			continue
+		case <-stop:
+			return
+		}
+		startedAt = time.Now()
+		switch job.Overlap {
+		case OverlapAllow:
+			probes.Add(1)
+			go func() {
+				defer probes.Done()
+				e.run(job, sched, stop, stats, nil)
+			}()
+		case OverlapQueue:
+			select {
+			case gate.busy <- struct{}{}:
+			case <-stop:
+				return
+			}
+			if !e.run(job, sched, stop, stats, gate) {
+				return
+			}
+		case OverlapCancel:
+			gate.mu.Lock()
+			if gate.cancel != nil {
+				gate.cancel()
+			}
+			gate.mu.Unlock()
+			select {
+			case gate.busy <- struct{}{}:
+			case <-stop:
+				return
+			}
+			probes.Add(1)
+			go func() {
+				defer probes.Done()
+				e.run(job, sched, stop, stats, gate)
+			}()
+		default:
+			select {
+			case gate.busy <- struct{}{}:
+				probes.Add(1)
+				go func() {
+					defer probes.Done()
+					e.run(job, sched, stop, stats, gate)
+				}()
+			default:
+				e.statsMu.Lock()
+				stats.Skipped++
+				e.statsMu.Unlock()
+			}
+		}
+		timer.Reset(time.Until(startedAt.Add(sched.nextDelay())))
+	}
+}
+
+// run waits for a free slot, probes and delivers the result. If gate is not
+// nil, it must be held by the caller and is released when the probe is done.
+// run returns false if the job was stopped while waiting.
+func (e *Engine) run(job Job, sched *jobSchedule, stop <-chan struct{}, stats *JobStats, gate *targetGate) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if gate != nil {
+		gate.mu.Lock()
+		gate.cancel = cancel
+		gate.mu.Unlock()
+		defer func() {
+			gate.mu.Lock()
+			gate.cancel = nil
+			gate.mu.Unlock()
+			<-gate.busy
+		}()
+	}
+
+	var info *AddressInfo
+	if e.opts.Classifier != nil || job.SkipBogons {
+		if info = e.classify(job.Target); info != nil && info.Bogon && job.SkipBogons {
+			e.statsMu.Lock()
+			stats.Bogons++
+			e.statsMu.Unlock()
+			return true
+		}
+	}
+
+	var reservation budgetReservation
+	if e.opts.Budget != nil {
+		var ok bool
+		if reservation, ok = e.reserveBudget(job, stats, stop, ctx.Done()); !ok {
+			if ctx.Err() == nil {
+				return false
+			}
+			e.statsMu.Lock()
+			stats.Canceled++
+			e.statsMu.Unlock()
+			return true
+		}
+	}
+
+	e.statsMu.Lock()
+	e.queued++
+	e.statsMu.Unlock()
+	select {
+	case e.slot <- struct{}{}:
+	case <-stop:
+		e.statsMu.Lock()
+		e.queued--
+		e.statsMu.Unlock()
+		return false
+	case <-ctx.Done():
+		e.statsMu.Lock()
+		e.queued--
+		stats.Canceled++
+		e.statsMu.Unlock()
+		return true
+	}
+	e.statsMu.Lock()
+	e.queued--
+	e.inFlight++
+	e.statsMu.Unlock()
+
+	target := job.Target
+	if e.opts.AssignProbeIDs && target.ProbeID == "" {
+		target.ProbeID = randomID()
+	}
+	meter := &trafficMeter{}
+	target.meter = meter
+	mode, interval := sched.state()
+	startedAt := time.Now()
+	r, err := e.watchProbe(withTrafficMeter(ctx, meter), job, target, stats)
+	pe, panicked := err.(*PanicError)
+	if panicked {
+		r, err = &PanicResult{Target: target, Kind: job.Prober.Kind(), Error: pe, Stack: string(pe.Stack)}, nil
+	}
+
+	<-e.slot
+	e.statsMu.Lock()
+	e.inFlight--
+	if panicked {
+		stats.Panics++
+	}
+	if ctx.Err() != nil {
+		// The budget reservation stands in for the traffic of the
+		// cancelled probe.
+		stats.Canceled++
+		e.statsMu.Unlock()
+		return true
+	}
+	traffic, ok := resultTraffic(r)
+	if !ok {
+		traffic, ok = meter.traffic()
+	}
+	if !ok {
+		traffic = job.ExpectedTraffic
+	}
+	e.accountTraffic(stats, reservation, traffic)
+	e.statsMu.Unlock()
+	sched.observe(r, err)
+	if r != nil && sched.scheduled() {
+		r = &ScheduledResult{Result: r, ScheduleMode: mode, ScheduleInterval: interval}
+	}
+	if r != nil && e.opts.Classifier != nil && info != nil {
+		r = &ClassifiedResult{Result: r, TargetInfo: *info}
+	}
+	if r != nil && e.opts.Timestamps {
+		r = &TimestampedResult{Result: r, ResultTimestamps: NewResultTimestamps(startedAt, e.opts.Clock)}
+	}
+	e.deliver(job, stats, startedAt, r, err)
+	return true
+}
+
+// classify classifies the address of target, or returns nil when it can't
+// be resolved.
+func (e *Engine) classify(target Target) *AddressInfo {
+	ip, err := targetIP(target.Address, target.Timeout)
+	if err != nil {
+		return nil
+	}
+	var c AddressClassifier = RegistryClassifier{}
+	if e.opts.Classifier != nil {
+		c = e.opts.Classifier
+	}
+	info := c.Classify(ip)
+	return &info
+}
+
+// PanicError is the error of a probe which panicked, with the stack of the
+// panicking goroutine.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("probe panicked: %v", e.Value)
+}
+
+// PanicResult is delivered in place of the result of a probe which panicked.
+// The engine recovers panics of probes, so a prober choking on a malformed
+// reply fails its probe instead of taking the agent down. Panics of
+// goroutines started by probers themselves can't be recovered.
+type PanicResult struct {
+	Target
+	Kind  string
+	Error error
+	Stack string
+}
+
+func (r PanicResult) RTT() time.Duration {
+	return 0
+}
+
+func (r PanicResult) String() string {
+	return fmt.Sprintf("%s %s: %v", r.Kind, r.Target.Address, r.Error)
+}
+
+// recoverProbe turns a panic of the probe deferring it into a PanicError.
+func recoverProbe(err *error) {
+	if v := recover(); v != nil {
+		*err = &PanicError{Value: v, Stack: debug.Stack()}
+	}
+}
+
+// safeProbe probes target with p, returning a panic of the probe as a
+// PanicError. Probers wrapping others probe through it from the goroutines
+// they start, which the engine's recover doesn't cover.
+func safeProbe(p Prober, target Target) (r Result, err error) {
+	defer recoverProbe(&err)
+	return p.Probe(target)
+}
+
+// probeContext probes target with p, returning early when ctx is done.
+// Panics of the probe are returned as a PanicError.
+func probeContext(ctx context.Context, p Prober, target Target) (r Result, err error) {
+	if cp, ok := p.(ContextProber); ok {
+		defer recoverProbe(&err)
+		return cp.ProbeContext(ctx, target)
+	}
+	type outcome struct {
+		r   Result
+		err error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		var o outcome
+		defer func() { done <- o }()
+		defer recoverProbe(&o.err)
+		o.r, o.err = p.Probe(target)
+	}()
+	select {
+	case o := <-done:
+		return o.r, o.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (e *Engine) deliver(job Job, stats *JobStats, startedAt time.Time, r Result, err error) {
+	e.sinkMu.RLock()
+	abandoned := e.sinksClosed
+	e.sinkMu.RUnlock()
+	if abandoned {
+		return
+	}
+	e.statsMu.Lock()
+	ks, ok := e.kinds[job.Prober.Kind()]
+	if !ok {
+		ks = &KindStats{}
+		e.kinds[job.Prober.Kind()] = ks
+	}
+	ks.Probes++
+	stats.Probes++
+	switch {
+	case err != nil:
+		ks.Errors++
+		stats.Errors++
+	case resultOK(r):
+		ks.Successes++
+		stats.Successes++
+	default:
+		ks.Failures++
+		stats.Failures++
+	}
+	stats.LastRunAt = startedAt
+	stats.LastResult = r
+	stats.LastError = err
+	e.statsMu.Unlock()
+
+	if e.opts.OnResult != nil {
+		e.opts.OnResult(job, r, err)
+	}
+	if r == nil {
+		return
+	}
+	e.sinkMu.RLock()
+	if e.sinksClosed {
+		e.sinkMu.RUnlock()
+		return
+	}
+	e.sinkWrites.Add(1)
+	e.sinkMu.RUnlock()
+	defer e.sinkWrites.Done()
+	for _, s := range e.opts.Sinks {
+		if err := s.Write(r); err != nil {
+			e.statsMu.Lock()
+			e.sinkErrors++
+			e.lastSink = err
+			e.statsMu.Unlock()
+		}
+	}
+}
+
+// KindStats counts probe outcomes of one prober kind. Failures are results
+// reporting a failed probe, Errors are probes that could not be run at all.
+type KindStats struct {
+	Probes    int64
+	Successes int64
+	Failures  int64
+	Errors    int64
+}
+
+// SuccessRate returns the fraction of successful probes, or 0 without probes.
+func (s KindStats) SuccessRate() float64 {
+	if s.Probes == 0 {
+		return 0
+	}
+	return float64(s.Successes) / float64(s.Probes)
+}
+
+// JobStats counts the probe outcomes of a single job and keeps its latest
+// result.
+type JobStats struct {
+	KindStats
+	// Skipped counts due probes skipped by OverlapSkip.
+	Skipped int64
+	// Canceled counts probes cancelled by OverlapCancel.
+	Canceled int64
+	// Deferred counts probes delayed by the bandwidth budget.
+	Deferred int64
+	// Bogons counts probes skipped by Job.SkipBogons.
+	Bogons int64
+	// Panics counts probes which panicked, delivered as a PanicResult.
+	Panics int64
+	// Killed counts probes killed by the watchdog. LeakedGoroutines and
+	// LeakedFDs add up the change of goroutines and open file descriptors
+	// over the probes, with WatchdogOptions.TrackResources; they may be
+	// negative.
+	Killed           int64
+	LeakedGoroutines int64
+	LeakedFDs        int64
+	// Traffic is the traffic of all probes of the job, LastTraffic that of
+	// the latest one.
+	Traffic     Traffic
+	LastTraffic Traffic
+
+	LastRunAt  time.Time
+	LastResult Result
+	LastError  error
+}
+
+// JobStats returns the statistics of the job with the given key.
+func (e *Engine) JobStats(key string) (JobStats, bool) {
+	e.mu.Lock()
+	sj, ok := e.jobs[key]
+	e.mu.Unlock()
+	if !ok {
+		return JobStats{}, false
+	}
+	e.statsMu.Lock()
+	defer e.statsMu.Unlock()
+	return *sj.stats, true
+}
+
+// EngineStats is a snapshot of an engine's internal state.
+type EngineStats struct {
+	Running bool
+	// Jobs is the number of scheduled jobs.
+	Jobs int
+	// QueueDepth is the number of due probes waiting for a free slot.
+	QueueDepth int
+	InFlight   int
+	// HungProbes is the number of probes killed by the watchdog which are
+	// still running.
+	HungProbes int
+	// Skipped and Canceled add up the JobStats counters of the scheduled
+	// jobs.
+	Skipped    int64
+	Canceled   int64
+	Kinds      map[string]KindStats
+	SinkErrors int64
+	// LastSinkError is the message of the most recent sink error.
+	LastSinkError string
+	// Traffic is the traffic of all probes. BudgetUsed is the traffic
+	// accounted against the bandwidth budget in the period starting at
+	// BudgetPeriodStart.
+	Traffic           Traffic
+	BudgetUsed        Traffic
+	BudgetPeriodStart time.Time
+}
+
+func (e *Engine) Stats() EngineStats {
+	e.mu.Lock()
+	stats := EngineStats{
+		Running: e.running,
+		Jobs:    len(e.jobs),
+	}
+	jobs := make([]*JobStats, 0, len(e.jobs))
+	for _, sj := range e.jobs {
+		jobs = append(jobs, sj.stats)
+	}
+	e.mu.Unlock()
+
+	e.statsMu.Lock()
+	defer e.statsMu.Unlock()
+	for _, js := range jobs {
+		stats.Skipped += js.Skipped
+		stats.Canceled += js.Canceled
+	}
+	stats.QueueDepth = e.queued
+	stats.InFlight = e.inFlight
+	stats.HungProbes = e.hung
+	stats.SinkErrors = e.sinkErrors
+	stats.Traffic = e.traffic
+	stats.BudgetUsed = e.budget.used
+	stats.BudgetPeriodStart = e.budget.start
+	if e.lastSink != nil {
+		stats.LastSinkError = e.lastSink.Error()
+	}
+	stats.Kinds = make(map[string]KindStats, len(e.kinds))
+	for kind, ks := range e.kinds {
+		stats.Kinds[kind] = *ks
+	}
+	return stats
+}
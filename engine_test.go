@@ -0,0 +1,428 @@
+package libprobe_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// funcProber adapts a function to the Prober interface.
+type funcProber struct {
+	kind  string
+	probe func(target libprobe.Target) (libprobe.Result, error)
+}
+
+func (p funcProber) Kind() string { return p.kind }
+
+func (p funcProber) Probe(target libprobe.Target) (libprobe.Result, error) {
+	return p.probe(target)
+}
+
+type memorySink struct {
+	results chan libprobe.Result
+}
+
+func (s *memorySink) Write(r libprobe.Result) error {
+	s.results <- r
+	return nil
+}
+
+func (s *memorySink) Close() error { return nil }
+
+// closingSink counts the writes made after it was closed.
+type closingSink struct {
+	closed int32
+	late   int32
+}
+
+func (s *closingSink) Write(r libprobe.Result) error {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		atomic.AddInt32(&s.late, 1)
+	}
+	return nil
+}
+
+func (s *closingSink) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	return nil
+}
+
+func TestEngine(t *testing.T) {
+	var calls int32
+	prober := funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		if atomic.AddInt32(&calls, 1)%2 == 0 {
+			return &libprobe.TCPResult{Target: target, Error: errors.New("refused")}, nil
+		}
+		return &libprobe.TCPResult{Target: target, ConnectTime: time.Millisecond}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 100)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}})
+	require.NoError(t, engine.Add(libprobe.Job{
+		Prober:   prober,
+		Target:   libprobe.Target{Address: "a:1"},
+		Interval: 5 * time.Millisecond,
+	}))
+	require.Error(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "a:1"}}))
+	engine.Start()
+	for i := 0; i < 4; i++ {
+		select {
+		case <-sink.results:
+		case <-time.After(3 * time.Second):
+			t.Fatal("no result delivered")
+		}
+	}
+	engine.Stop()
+
+	stats := engine.Stats()
+	require.False(t, stats.Running)
+	require.Equal(t, 1, stats.Jobs)
+	kind := stats.Kinds["FAKE"]
+	require.True(t, kind.Probes >= 4)
+	require.Equal(t, kind.Probes, kind.Successes+kind.Failures)
+
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/probes", nil))
+	var state map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	require.Len(t, state["targets"], 1)
+	require.Contains(t, state["kinds"], "FAKE")
+}
+
+func TestEngineDebugState(t *testing.T) {
+	release := make(chan struct{})
+	prober := funcProber{kind: "SLOW", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		<-release
+		return &libprobe.TCPResult{Target: target}, nil
+	}}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{})
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "a:1"}, Interval: time.Millisecond}))
+	engine.Start()
+	defer engine.Stop()
+	defer close(release)
+	require.Eventually(t, func() bool { return engine.Stats().Skipped > 0 }, 3*time.Second, time.Millisecond)
+
+	libprobe.SetFDPool(libprobe.NewFDPool(libprobe.FDPoolOptions{Max: 7}))
+	defer libprobe.SetFDPool(nil)
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/probes", nil))
+	var state struct {
+		HungProbes *int  `json:"hung_probes"`
+		Skipped    int64 `json:"skipped"`
+		Canceled   *int  `json:"canceled"`
+		SocketPool struct {
+			Max   int `json:"max"`
+			InUse int `json:"in_use"`
+		} `json:"socket_pool"`
+		Targets []struct {
+			Skipped int64 `json:"skipped"`
+		} `json:"targets"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	require.NotNil(t, state.HungProbes)
+	require.NotNil(t, state.Canceled)
+	require.Positive(t, state.Skipped)
+	require.Equal(t, 7, state.SocketPool.Max)
+	require.Len(t, state.Targets, 1)
+	require.Positive(t, state.Targets[0].Skipped)
+}
+
+func TestEngineShutdown(t *testing.T) {
+	release := make(chan struct{})
+	prober := funcProber{kind: "SLOW", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		<-release
+		return &libprobe.TCPResult{Target: target}, nil
+	}}
+	sink := &closingSink{}
+	var delivered int32
+	engine := libprobe.NewEngine(libprobe.EngineOptions{
+		Sinks:    []libprobe.Sink{sink},
+		OnResult: func(libprobe.Job, libprobe.Result, error) { atomic.AddInt32(&delivered, 1) },
+	})
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "a:1"}}))
+	engine.Start()
+	require.Eventually(t, func() bool { return engine.Stats().InFlight == 1 }, 3*time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, engine.Shutdown(ctx))
+	require.Equal(t, libprobe.ErrEngineStopped, engine.Add(libprobe.Job{Prober: prober}))
+	// The abandoned probe's result isn't written to the closed sink.
+	close(release)
+	engine.Stop()
+	require.Zero(t, atomic.LoadInt32(&sink.late))
+	require.Zero(t, atomic.LoadInt32(&delivered))
+}
+
+// hungSink blocks every write until release is closed.
+type hungSink struct {
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (s *hungSink) Write(r libprobe.Result) error {
+	s.writing <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func (s *hungSink) Close() error { return nil }
+
+// closerProber counts how often it was closed.
+type closerProber struct {
+	funcProber
+	closed int32
+}
+
+func (p *closerProber) Close() error {
+	atomic.AddInt32(&p.closed, 1)
+	return nil
+}
+
+func TestEngineShutdownHungSink(t *testing.T) {
+	prober := &closerProber{funcProber: funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		return &libprobe.TCPResult{Target: target}, nil
+	}}}
+	sink := &hungSink{writing: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(sink.release)
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}})
+	for _, address := range []string{"a:1", "b:1"} {
+		require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: address}, Interval: time.Hour}))
+	}
+	engine.Start()
+	<-sink.writing
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- engine.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		require.Equal(t, context.DeadlineExceeded, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown waited for the hung sink past its context")
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(&prober.closed))
+}
+
+func TestEngineShutdownClosesConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	prober := libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{ReuseConnections: true})
+	sink := &memorySink{results: make(chan libprobe.Result, 1)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}})
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: srv.URL, Timeout: 5 * time.Second}, Interval: time.Hour}))
+	engine.Start()
+	<-sink.results
+
+	require.NoError(t, engine.Shutdown(context.Background()))
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("kept-alive connection left open by Shutdown")
+	}
+}
+
+func TestEnginePanic(t *testing.T) {
+	prober := funcProber{kind: "BUGGY", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		var hops []int
+		return &libprobe.TCPResult{Target: target, ConnectTime: time.Duration(hops[1])}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 10)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}})
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "a:1"}, Interval: time.Hour}))
+	engine.Start()
+	defer engine.Stop()
+
+	res := (<-sink.results).(*libprobe.PanicResult)
+	require.Equal(t, "BUGGY", res.Kind)
+	require.Equal(t, "a:1", res.Address)
+	require.Contains(t, res.Error.Error(), "index out of range")
+	require.Contains(t, res.Stack, "TestEnginePanic")
+	var pe *libprobe.PanicError
+	require.True(t, errors.As(res.Error, &pe))
+
+	stats, ok := engine.JobStats("BUGGY/a:1")
+	require.True(t, ok)
+	require.Equal(t, int64(1), stats.Panics)
+	require.Equal(t, int64(1), stats.Failures)
+}
+
+func TestEnginePanicWrapped(t *testing.T) {
+	prober := libprobe.NewCompareProber(libprobe.CompareProberOptions{
+		Prober: funcProber{kind: "BUGGY", probe: func(target libprobe.Target) (libprobe.Result, error) {
+			if target.Address == "b:1" {
+				var hops []int
+				_ = hops[1]
+			}
+			return &libprobe.TCPResult{Target: target}, nil
+		}},
+		Addresses: []string{"a:1", "b:1"},
+	})
+	sink := &memorySink{results: make(chan libprobe.Result, 10)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}})
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "service"}, Interval: time.Hour}))
+	engine.Start()
+	defer engine.Stop()
+
+	// The inner panic fails its entry alone instead of the process.
+	res := (<-sink.results).(*libprobe.CompareResult)
+	require.Len(t, res.Entries, 2)
+	require.Equal(t, "a:1", res.Entries[0].Address)
+	require.True(t, res.Entries[0].Available)
+	require.Equal(t, "b:1", res.Entries[1].Address)
+	require.False(t, res.Entries[1].Available)
+	require.Contains(t, res.Entries[1].Error, "index out of range")
+}
+
+func TestEngineApply(t *testing.T) {
+	prober := &funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		return &libprobe.TCPResult{Target: target}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 100)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}})
+	job := func(address string, interval time.Duration) libprobe.Job {
+		return libprobe.Job{Prober: prober, Target: libprobe.Target{Address: address}, Interval: interval}
+	}
+	changes, err := engine.Apply([]libprobe.Job{job("a:1", time.Hour), job("b:1", time.Hour)})
+	require.NoError(t, err)
+	require.Equal(t, []string{"FAKE/a:1", "FAKE/b:1"}, changes.Added)
+	engine.Start()
+	defer engine.Stop()
+	<-sink.results
+	<-sink.results
+
+	changes, err = engine.Apply([]libprobe.Job{job("a:1", time.Hour), job("b:1", 2*time.Hour), job("c:1", time.Hour)})
+	require.NoError(t, err)
+	require.Equal(t, []string{"FAKE/c:1"}, changes.Added)
+	require.Equal(t, []string{"FAKE/b:1"}, changes.Updated)
+	require.Empty(t, changes.Removed)
+	<-sink.results
+	<-sink.results
+
+	stats, ok := engine.JobStats("FAKE/a:1")
+	require.True(t, ok)
+	require.Equal(t, int64(1), stats.Probes, "unchanged job must not be rerun")
+	stats, _ = engine.JobStats("FAKE/b:1")
+	require.Equal(t, int64(2), stats.Probes, "updated job keeps its statistics")
+
+	changes, err = engine.Apply([]libprobe.Job{job("c:1", time.Hour)})
+	require.NoError(t, err)
+	require.Equal(t, []string{"FAKE/a:1", "FAKE/b:1"}, changes.Removed)
+	require.Equal(t, 1, engine.Stats().Jobs)
+}
+
+func TestJobNextDelay(t *testing.T) {
+	job := libprobe.Job{Interval: time.Second}
+	require.Equal(t, time.Second, job.NextDelay())
+
+	job.Spacing = libprobe.SpacingUniform
+	job.Jitter = 0.1
+	for i := 0; i < 100; i++ {
+		d := job.NextDelay()
+		require.True(t, d >= 900*time.Millisecond && d <= 1100*time.Millisecond, d)
+	}
+
+	job.Spacing = libprobe.SpacingPoisson
+	var total time.Duration
+	for i := 0; i < 2000; i++ {
+		d := job.NextDelay()
+		require.True(t, d >= 0 && d <= 10*time.Second, d)
+		total += d
+	}
+	mean := total / 2000
+	require.True(t, mean > 800*time.Millisecond && mean < 1200*time.Millisecond, mean)
+}
+
+// blockingProber holds every probe until release is closed or the probe is
+// cancelled, and records the highest number of concurrent probes.
+type blockingProber struct {
+	release          chan struct{}
+	running, maxSeen int32
+}
+
+func (p *blockingProber) Kind() string { return "BLOCK" }
+
+func (p *blockingProber) Probe(target libprobe.Target) (libprobe.Result, error) {
+	return p.ProbeContext(context.Background(), target)
+}
+
+func (p *blockingProber) ProbeContext(ctx context.Context, target libprobe.Target) (libprobe.Result, error) {
+	n := atomic.AddInt32(&p.running, 1)
+	defer atomic.AddInt32(&p.running, -1)
+	for {
+		max := atomic.LoadInt32(&p.maxSeen)
+		if n <= max || atomic.CompareAndSwapInt32(&p.maxSeen, max, n) {
+			break
+		}
+	}
+	select {
+	case <-p.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &libprobe.TCPResult{Target: target}, nil
+}
+
+func TestEngineOverlap(t *testing.T) {
+	target := libprobe.Target{Address: "a:1"}
+	// run probes with two jobs sharing a target until done holds, and
+	// returns the prober and the engine's counters.
+	run := func(policy libprobe.OverlapPolicy, done func(*libprobe.Engine, *blockingProber) bool) (*blockingProber, libprobe.EngineStats) {
+		prober := &blockingProber{release: make(chan struct{})}
+		engine := libprobe.NewEngine(libprobe.EngineOptions{})
+		for _, id := range []string{"one", "two"} {
+			require.NoError(t, engine.Add(libprobe.Job{
+				ID:       id,
+				Prober:   prober,
+				Target:   target,
+				Interval: 2 * time.Millisecond,
+				Overlap:  policy,
+			}))
+		}
+		engine.Start()
+		require.Eventually(t, func() bool { return done(engine, prober) }, 3*time.Second, time.Millisecond)
+		close(prober.release)
+		engine.Stop()
+		return prober, engine.Stats()
+	}
+
+	prober, stats := run(libprobe.OverlapSkip, func(e *libprobe.Engine, _ *blockingProber) bool {
+		return e.Stats().Skipped > 0
+	})
+	require.EqualValues(t, 1, prober.maxSeen)
+
+	// Queued probes leave no trace to wait for, so let a few intervals pass.
+	queueEnd := time.Now().Add(30 * time.Millisecond)
+	prober, stats = run(libprobe.OverlapQueue, func(*libprobe.Engine, *blockingProber) bool {
+		return time.Now().After(queueEnd)
+	})
+	require.EqualValues(t, 1, prober.maxSeen)
+	require.Zero(t, stats.Skipped)
+
+	prober, _ = run(libprobe.OverlapCancel, func(e *libprobe.Engine, _ *blockingProber) bool {
+		return e.Stats().Canceled > 0
+	})
+	require.EqualValues(t, 1, prober.maxSeen)
+
+	prober, _ = run(libprobe.OverlapAllow, func(_ *libprobe.Engine, p *blockingProber) bool {
+		return atomic.LoadInt32(&p.maxSeen) > 1
+	})
+	require.True(t, prober.maxSeen > 1)
+}
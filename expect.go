@@ -0,0 +1,232 @@
+package libprobe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const KindExpect = "EXPECT"
+
+// ExpectStep sends data to a server and waits for its response.
+type ExpectStep struct {
+	// Send is written to the server, nothing when empty.
+	Send []byte
+	// Expect must match the data received since Send, read until it
+	// matches. Without it, any data is accepted, read until the server
+	// closes the connection, after a datagram over UDP, or up to the read
+	// limit.
+	Expect *regexp.Regexp
+}
+
+// ExpectScript is an exchange with a server of a simple text protocol.
+// Custom scripts are written by filling one in.
+type ExpectScript struct {
+	Name string
+	// Network is "tcp" or "udp". Default: "tcp".
+	Network string
+	// Port is the default port of the protocol.
+	Port  int
+	Steps []ExpectStep
+}
+
+// ExpectDaytime reads the time of a daytime server (RFC 867).
+var ExpectDaytime = ExpectScript{
+	Name:  "daytime",
+	Port:  13,
+	Steps: []ExpectStep{{}},
+}
+
+// ExpectEcho checks that an echo server (RFC 862) sends a line back. Over
+// UDP, set Network to "udp".
+var ExpectEcho = ExpectScript{
+	Name: "echo",
+	Port: 7,
+	Steps: []ExpectStep{{
+		Send:   []byte("libprobe echo\r\n"),
+		Expect: regexp.MustCompile(`libprobe echo\r\n`),
+	}},
+}
+
+// ExpectChargen reads a full line of a character generator (RFC 864). Over
+// UDP, the step must also send a datagram, of any content.
+var ExpectChargen = ExpectScript{
+	Name: "chargen",
+	Port: 19,
+	Steps: []ExpectStep{{
+		Expect: regexp.MustCompile(`[ -~]{72}\r\n`),
+	}},
+}
+
+// ExpectFinger queries a finger server (RFC 1288) about user, or lists the
+// users logged in when user is empty.
+func ExpectFinger(user string) ExpectScript {
+	return ExpectScript{
+		Name:  "finger",
+		Port:  79,
+		Steps: []ExpectStep{{Send: []byte(user + "\r\n")}},
+	}
+}
+
+// ExpectGopher requests selector from a gopher server (RFC 1436), the root
+// menu when it's empty.
+func ExpectGopher(selector string) ExpectScript {
+	return ExpectScript{
+		Name:  "gopher",
+		Port:  70,
+		Steps: []ExpectStep{{Send: []byte(selector + "\r\n")}},
+	}
+}
+
+// ExpectProberOptions configures an ExpectProber.
+type ExpectProberOptions struct {
+	Script ExpectScript
+	// ReadLimit bounds the data read at every step. Default: 4096 bytes.
+	ReadLimit int
+}
+
+// ExpectStepResult is the outcome of a step.
+type ExpectStepResult struct {
+	// Time is the time from sending to the end of the response.
+	Time     time.Duration
+	Response string
+}
+
+// ExpectResult describes the exchange of an ExpectProber.
+type ExpectResult struct {
+	Target
+	Error error
+
+	Script      string
+	ConnectTime time.Duration
+	Steps       []ExpectStepResult
+	TotalTime   time.Duration
+}
+
+// RTT returns the time of the steps.
+func (r ExpectResult) RTT() time.Duration {
+	var rtt time.Duration
+	for _, s := range r.Steps {
+		rtt += s.Time
+	}
+	return rtt
+}
+
+func (r ExpectResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	s := fmt.Sprintf("-> %s %s Connect: %s", r.Target.Address, r.Script, r.ConnectTime)
+	for i, step := range r.Steps {
+		response := step.Response
+		if len(response) > 64 {
+			response = response[:64] + "..."
+		}
+		s += fmt.Sprintf(", Step %d: %s %q", i+1, step.Time, response)
+	}
+	return s + fmt.Sprintf(". Total: %s", r.TotalTime)
+}
+
+// ExpectProber runs a send/expect script against the server in
+// Target.Address, on the default port of the script unless given.
+// Target.Timeout bounds the whole exchange and defaults to five seconds.
+type ExpectProber struct {
+	opts ExpectProberOptions
+}
+
+func NewExpectProber(opts ExpectProberOptions) *ExpectProber {
+	if opts.ReadLimit <= 0 {
+		opts.ReadLimit = 4096
+	}
+	return &ExpectProber{opts: opts}
+}
+
+func (p *ExpectProber) Kind() string {
+	return KindExpect
+}
+
+func (p *ExpectProber) Probe(target Target) (Result, error) {
+	script := p.opts.Script
+	if len(script.Steps) == 0 {
+		return nil, errors.New("expect: empty script")
+	}
+	network := script.Network
+	if network == "" {
+		network = "tcp"
+	}
+	r := &ExpectResult{Target: target, Script: script.Name}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), strconv.Itoa(script.Port))
+	}
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, network, address, timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(startAt.Add(timeout))
+
+	datagrams := !strings.HasPrefix(network, "tcp")
+	for i, step := range script.Steps {
+		stepAt := time.Now()
+		response, matched, err := p.step(conn, step, datagrams)
+		r.Steps = append(r.Steps, ExpectStepResult{Time: time.Since(stepAt), Response: string(response)})
+		switch {
+		case err != nil:
+			r.Error = err
+		case step.Expect != nil && !matched:
+			r.Error = fmt.Errorf("expect: step %d: the response doesn't match %s", i+1, step.Expect)
+		case len(response) == 0:
+			r.Error = fmt.Errorf("expect: step %d: no response", i+1)
+		}
+		if r.Error != nil {
+			break
+		}
+	}
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+// step sends the data of step and reads the response, returning whether it
+// matches.
+func (p *ExpectProber) step(conn net.Conn, step ExpectStep, datagrams bool) ([]byte, bool, error) {
+	if len(step.Send) > 0 {
+		if _, err := conn.Write(step.Send); err != nil {
+			return nil, false, err
+		}
+	}
+	var response []byte
+	buf := make([]byte, 64<<10)
+	for len(response) < p.opts.ReadLimit {
+		n, err := conn.Read(buf)
+		response = append(response, buf[:n]...)
+		if len(response) > p.opts.ReadLimit {
+			response = response[:p.opts.ReadLimit]
+		}
+		if step.Expect != nil && step.Expect.Match(response) {
+			return response, true, nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return response, false, err
+		}
+		if datagrams && step.Expect == nil {
+			break
+		}
+	}
+	return response, false, nil
+}
@@ -0,0 +1,123 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveLegacy serves a TCP server handling every connection with handle.
+func serveLegacy(t *testing.T, handle func(net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestExpectProber(t *testing.T) {
+	const line = "!\"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefgh\r\n"
+	lookup := func(conn net.Conn) string {
+		query, _ := bufio.NewReader(conn).ReadString('\n')
+		return strings.TrimSpace(query)
+	}
+	for _, tt := range []struct {
+		script   libprobe.ExpectScript
+		handle   func(net.Conn)
+		response string
+	}{
+		{libprobe.ExpectDaytime, func(conn net.Conn) {
+			conn.Write([]byte("Fri Oct 16 14:17:34 2026\r\n"))
+		}, "Fri Oct 16 14:17:34 2026\r\n"},
+		{libprobe.ExpectEcho, func(conn net.Conn) {
+			buf := make([]byte, 64)
+			n, _ := conn.Read(buf)
+			conn.Write(buf[:n])
+			// The server keeps the connection open.
+			conn.Read(buf)
+		}, "libprobe echo\r\n"},
+		{libprobe.ExpectChargen, func(conn net.Conn) {
+			for {
+				if _, err := conn.Write([]byte(line[:40])); err != nil {
+					return
+				}
+				if _, err := conn.Write([]byte(line[40:])); err != nil {
+					return
+				}
+			}
+		}, line},
+		{libprobe.ExpectFinger("alice"), func(conn net.Conn) {
+			conn.Write([]byte("Login: " + lookup(conn) + "\r\nNo mail.\r\n"))
+		}, "Login: alice\r\nNo mail.\r\n"},
+		{libprobe.ExpectGopher(""), func(conn net.Conn) {
+			if lookup(conn) == "" {
+				conn.Write([]byte("iWelcome\t\terror.host\t1\r\n1Docs\t/docs\tgopher.example.com\t70\r\n.\r\n"))
+			}
+		}, "iWelcome\t\terror.host\t1\r\n1Docs\t/docs\tgopher.example.com\t70\r\n.\r\n"},
+	} {
+		target := libprobe.Target{Address: serveLegacy(t, tt.handle), Timeout: 2 * time.Second}
+		p := libprobe.NewExpectProber(libprobe.ExpectProberOptions{Script: tt.script})
+		require.Equal(t, libprobe.KindExpect, p.Kind())
+		r, err := p.Probe(target)
+		require.NoError(t, err)
+		res := r.(*libprobe.ExpectResult)
+		require.NoError(t, res.Error, tt.script.Name)
+		require.Equal(t, tt.script.Name, res.Script)
+		require.Len(t, res.Steps, 1)
+		require.Contains(t, res.Steps[0].Response, tt.response, tt.script.Name)
+		require.Positive(t, res.RTT())
+	}
+}
+
+func TestExpectProberMismatch(t *testing.T) {
+	target := libprobe.Target{Address: serveLegacy(t, func(conn net.Conn) {
+		conn.Write([]byte("garbage\r\n"))
+	}), Timeout: 2 * time.Second}
+	r, err := libprobe.NewExpectProber(libprobe.ExpectProberOptions{Script: libprobe.ExpectEcho}).Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.ExpectResult)
+	require.ErrorContains(t, res.Error, "doesn't match")
+	require.Equal(t, "garbage\r\n", res.Steps[0].Response)
+
+	_, err = libprobe.NewExpectProber(libprobe.ExpectProberOptions{}).Probe(target)
+	require.Error(t, err)
+}
+
+func TestExpectProberUDP(t *testing.T) {
+	address := serveUDP(t, func(query []byte) [][]byte {
+		return [][]byte{query}
+	})
+	script := libprobe.ExpectScript{
+		Name:    "echo",
+		Network: "udp",
+		Steps: []libprobe.ExpectStep{
+			{Send: []byte("one")},
+			{Send: []byte("two"), Expect: regexp.MustCompile(`^two$`)},
+		},
+	}
+	r, err := libprobe.NewExpectProber(libprobe.ExpectProberOptions{Script: script}).Probe(libprobe.Target{Address: address, Timeout: 2 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.ExpectResult)
+	require.NoError(t, res.Error)
+	require.Len(t, res.Steps, 2)
+	require.Equal(t, "one", res.Steps[0].Response)
+	require.Equal(t, "two", res.Steps[1].Response)
+}
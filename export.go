@@ -0,0 +1,452 @@
+package libprobe
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Row is a flattened result keyed by stable snake_case column names.
+// Durations are stored as int64 nanoseconds (column suffix "_ns"), times as
+// RFC3339Nano strings and errors as their message. Slices other than those
+// Flatten expands into rows are stored as the JSON array of their elements,
+// flattened likewise, or "" when empty; byte slices are stored in base64.
+type Row map[string]interface{}
+
+// Common columns present in every row produced by Flatten.
+const (
+	ColumnKind    = "kind"
+	ColumnRow     = "row"
+	ColumnIndex   = "index"
+	ColumnAddress = "address"
+	ColumnRTT     = "rtt_ns"
+	ColumnError   = "error"
+)
+
+// RowResult is the ColumnRow value of the summary row of a result. Rows
+// expanded from slices (e.g. per-hop rows) carry the slice's column name.
+const RowResult = "result"
+
+var leadingColumns = []string{ColumnKind, ColumnRow, ColumnIndex, ColumnAddress, ColumnRTT, ColumnError}
+
+// Flatten converts a result into one or more rows. The first row always
+// summarizes the result itself; every slice of structs in the result (such
+// as a list of hops) adds one row per element, prefixed with the slice's
+// column name and sharing the summary row's columns.
+func Flatten(r Result) []Row {
+	base := Row{
+		ColumnKind: resultKind(r),
+		ColumnRow:  RowResult,
+		ColumnRTT:  int64(r.RTT()),
+	}
+	var children []Row
+	v := reflect.Indirect(reflect.ValueOf(r))
+	if v.Kind() == reflect.Struct {
+		flattenStruct(base, "", v, &children)
+	}
+	if _, ok := base[ColumnError]; !ok {
+		base[ColumnError] = ""
+	}
+	rows := []Row{base}
+	for _, child := range children {
+		row := Row{}
+		for k, val := range base {
+			row[k] = val
+		}
+		for k, val := range child {
+			row[k] = val
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// ResultWrapper is implemented by results decorating another result, such
+// as summaries of suppressed results. The kind of a wrapper is the kind of the
+// wrapped result.
+type ResultWrapper interface {
+	Unwrap() Result
+}
+
+// innermostResult returns the result decorated by r through any number of
+// ResultWrappers, or r itself.
+func innermostResult(r Result) Result {
+	for {
+		w, ok := r.(ResultWrapper)
+		if !ok {
+			return r
+		}
+		r = w.Unwrap()
+	}
+}
+
+// resultTarget returns the Target embedded in the result r wraps, or r
+// itself.
+func resultTarget(r Result) Target {
+	v := reflect.Indirect(reflect.ValueOf(innermostResult(r)))
+	if v.Kind() != reflect.Struct {
+		return Target{}
+	}
+	f := v.FieldByName("Target")
+	if !f.IsValid() {
+		return Target{}
+	}
+	t, _ := f.Interface().(Target)
+	return t
+}
+
+func resultKind(r Result) string {
+	if w, ok := r.(ResultWrapper); ok {
+		return resultKind(w.Unwrap())
+	}
+	t := reflect.TypeOf(r)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return ""
+	}
+	return strings.TrimSuffix(t.Name(), "Result")
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+func flattenStruct(row Row, prefix string, v reflect.Value, children *[]Row) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fv := v.Field(i)
+		if field.Anonymous {
+			for fv.Kind() == reflect.Interface || fv.Kind() == reflect.Ptr {
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				flattenStruct(row, prefix, fv, children)
+			}
+			continue
+		}
+		name := prefix + snakeCase(field.Name)
+		flattenValue(row, name, fv, children)
+	}
+}
+
+func flattenValue(row Row, name string, v reflect.Value, children *[]Row) {
+	if !v.IsValid() {
+		return
+	}
+	t := v.Type()
+	switch {
+	case t == durationType:
+		row[name+"_ns"] = v.Int()
+		return
+	case t == timeType:
+		ts := v.Interface().(time.Time)
+		if ts.IsZero() {
+			row[name] = ""
+		} else {
+			row[name] = ts.Format(time.RFC3339Nano)
+		}
+		return
+	case t.Implements(errorType):
+		if nilable(t) && v.IsNil() {
+			row[name] = ""
+		} else {
+			row[name] = v.Interface().(error).Error()
+		}
+		return
+	case t.Kind() != reflect.Struct && t.Implements(stringerType):
+		if nilable(t) && v.IsNil() {
+			row[name] = ""
+		} else {
+			row[name] = v.Interface().(fmt.Stringer).String()
+		}
+		return
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		row[name] = v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		row[name] = v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		row[name] = v.Uint()
+	case reflect.Float32, reflect.Float64:
+		row[name] = v.Float()
+	case reflect.String:
+		row[name] = v.String()
+	case reflect.Ptr:
+		if !v.IsNil() {
+			flattenValue(row, name, v.Elem(), children)
+		}
+	case reflect.Struct:
+		flattenStruct(row, name+"_", v, children)
+	case reflect.Map:
+		// Only string maps, such as Target.Metadata, have a column per key.
+		if t.Key().Kind() != reflect.String || t.Elem().Kind() != reflect.String {
+			return
+		}
+		for _, k := range v.MapKeys() {
+			row[name+"_"+k.String()] = v.MapIndex(k).String()
+		}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			row[name] = base64.StdEncoding.EncodeToString(b)
+			return
+		}
+		elem := t.Elem()
+		if elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		if children != nil && t.Kind() == reflect.Slice && elem.Kind() == reflect.Struct && elem != timeType {
+			for i := 0; i < v.Len(); i++ {
+				child := Row{ColumnRow: name, ColumnIndex: int64(i)}
+				flattenValue(child, name, v.Index(i), nil)
+				*children = append(*children, child)
+			}
+			return
+		}
+		if elem == durationType {
+			name += "_ns"
+		}
+		row[name] = ""
+		if v.Len() == 0 {
+			return
+		}
+		if b, err := json.Marshal(sliceValues(v)); err == nil {
+			row[name] = string(b)
+		}
+	}
+}
+
+// sliceValues flattens the elements of a slice or array like fields:
+// slices into their values, structs into a Row of their columns and other
+// values into the value of their single column.
+func sliceValues(v reflect.Value) []interface{} {
+	values := make([]interface{}, v.Len())
+	for i := range values {
+		e := v.Index(i)
+		if s := reflect.Indirect(e); (s.Kind() == reflect.Slice || s.Kind() == reflect.Array) &&
+			s.Type().Elem().Kind() != reflect.Uint8 && !s.Type().Implements(stringerType) {
+			values[i] = sliceValues(s)
+			continue
+		}
+		row := Row{}
+		flattenValue(row, "v", e, nil)
+		if value, ok := row["v"]; ok && len(row) == 1 {
+			values[i] = value
+			continue
+		}
+		if value, ok := row["v_ns"]; ok && len(row) == 1 {
+			values[i] = value
+			continue
+		}
+		if len(row) > 0 {
+			columns := Row{}
+			for k, value := range row {
+				columns[strings.TrimPrefix(k, "v_")] = value
+			}
+			values[i] = columns
+		}
+	}
+	return values
+}
+
+// nilable reports whether values of t can be nil, as reflect.Value.IsNil
+// expects.
+func nilable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func, reflect.Chan:
+		return true
+	}
+	return false
+}
+
+// snakeCase converts Go identifiers such as "DNSResolveTime" to
+// "dns_resolve_time".
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				prev := runes[i-1]
+				nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+					b.WriteByte('_')
+				}
+			}
+			b.WriteRune(unicode.ToLower(r))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Columns returns the column names of rows in a stable order: the common
+// columns first, followed by the remaining columns sorted by name.
+func Columns(rows ...Row) []string {
+	seen := make(map[string]bool)
+	var rest []string
+	for _, row := range rows {
+		for k := range row {
+			if !seen[k] {
+				seen[k] = true
+				rest = append(rest, k)
+			}
+		}
+	}
+	sort.Strings(rest)
+	columns := make([]string, 0, len(rest))
+	columns = append(columns, leadingColumns...)
+	for _, c := range rest {
+		if !isLeadingColumn(c) {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+func isLeadingColumn(name string) bool {
+	for _, c := range leadingColumns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func formatCell(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case bool:
+		return strconv.FormatBool(val)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case uint64:
+		return strconv.FormatUint(val, 10)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// CSVEncoder writes flattened results as CSV. The header is written before
+// the first record; columns not present in the header are dropped and missing
+// ones are left empty.
+type CSVEncoder struct {
+	w           *csv.Writer
+	columns     []string
+	wroteHeader bool
+}
+
+// NewCSVEncoder creates a CSV encoder writing to w. When columns is empty,
+// the header is derived from the first encoded result.
+func NewCSVEncoder(w io.Writer, columns ...string) *CSVEncoder {
+	return &CSVEncoder{
+		w:       csv.NewWriter(w),
+		columns: columns,
+	}
+}
+
+func (e *CSVEncoder) Encode(r Result) error {
+	rows := Flatten(r)
+	if !e.wroteHeader {
+		if len(e.columns) == 0 {
+			e.columns = Columns(rows...)
+		}
+		if err := e.w.Write(e.columns); err != nil {
+			return err
+		}
+		e.wroteHeader = true
+	}
+	record := make([]string, len(e.columns))
+	for _, row := range rows {
+		for i, c := range e.columns {
+			record[i] = formatCell(row[c])
+		}
+		if err := e.w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (e *CSVEncoder) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// ColumnarTable accumulates flattened results column by column, suitable for
+// handing over to dataframe or Parquet writers. Columns first seen after
+// some rows were appended are backfilled with nil.
+type ColumnarTable struct {
+	names   []string
+	index   map[string]int
+	columns [][]interface{}
+	rows    int
+}
+
+func NewColumnarTable() *ColumnarTable {
+	return &ColumnarTable{
+		index: make(map[string]int),
+	}
+}
+
+func (t *ColumnarTable) Append(r Result) {
+	rows := Flatten(r)
+	for _, name := range Columns(rows...) {
+		if _, ok := t.index[name]; !ok {
+			t.index[name] = len(t.names)
+			t.names = append(t.names, name)
+			t.columns = append(t.columns, make([]interface{}, t.rows))
+		}
+	}
+	for _, row := range rows {
+		for i, name := range t.names {
+			t.columns[i] = append(t.columns[i], row[name])
+		}
+		t.rows++
+	}
+}
+
+// Len returns the number of rows in the table.
+func (t *ColumnarTable) Len() int {
+	return t.rows
+}
+
+// Names returns the column names in insertion order.
+func (t *ColumnarTable) Names() []string {
+	return t.names
+}
+
+// Column returns the values of the named column, or nil if it's unknown.
+func (t *ColumnarTable) Column(name string) []interface{} {
+	i, ok := t.index[name]
+	if !ok {
+		return nil
+	}
+	return t.columns[i]
+}
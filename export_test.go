@@ -0,0 +1,159 @@
+package libprobe_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlattenHTTPResult(t *testing.T) {
+	rows := libprobe.Flatten(&libprobe.HTTPResult{
+		Target:             libprobe.Target{Address: "https://example.com"},
+		DNSResolveTime:     2 * time.Millisecond,
+		TTFB:               10 * time.Millisecond,
+		TotalTime:          20 * time.Millisecond,
+		ResponseStatusCode: 200,
+	})
+	require.Len(t, rows, 1)
+	row := rows[0]
+	require.Equal(t, "HTTP", row[libprobe.ColumnKind])
+	require.Equal(t, "https://example.com", row[libprobe.ColumnAddress])
+	require.Equal(t, int64(20*time.Millisecond), row[libprobe.ColumnRTT])
+	require.Equal(t, int64(2*time.Millisecond), row["dns_resolve_time_ns"])
+	require.Equal(t, int64(10*time.Millisecond), row["ttfb_ns"])
+	require.Equal(t, int64(200), row["response_status_code"])
+	require.Equal(t, "", row[libprobe.ColumnError])
+}
+
+type hopsResult struct {
+	libprobe.Target
+	Hops []struct {
+		TTL  int
+		Host string
+	}
+}
+
+func (r hopsResult) RTT() time.Duration { return 0 }
+func (r hopsResult) String() string     { return "" }
+
+func TestFlattenExpandsSlices(t *testing.T) {
+	r := hopsResult{Target: libprobe.Target{Address: "1.1.1.1"}}
+	r.Hops = append(r.Hops, struct {
+		TTL  int
+		Host string
+	}{1, "10.0.0.1"}, struct {
+		TTL  int
+		Host string
+	}{2, "1.1.1.1"})
+	rows := libprobe.Flatten(r)
+	require.Len(t, rows, 3)
+	require.Equal(t, "hops", rows[2][libprobe.ColumnRow])
+	require.Equal(t, int64(1), rows[2][libprobe.ColumnIndex])
+	require.Equal(t, int64(2), rows[2]["hops_ttl"])
+	require.Equal(t, "1.1.1.1", rows[2][libprobe.ColumnAddress])
+}
+
+type errnoResult struct {
+	libprobe.Target
+	Errno syscall.Errno
+}
+
+func (r errnoResult) RTT() time.Duration { return 0 }
+func (r errnoResult) String() string     { return "" }
+
+func TestFlattenErrorValues(t *testing.T) {
+	// Errors which aren't pointers or interfaces can't be nil.
+	row := libprobe.Flatten(errnoResult{Errno: syscall.ECONNREFUSED})[0]
+	require.Equal(t, syscall.ECONNREFUSED.Error(), row["errno"])
+	row = libprobe.Flatten(errnoResult{})[0]
+	require.Equal(t, syscall.Errno(0).Error(), row["errno"])
+}
+
+type listsResult struct {
+	libprobe.Target
+	Names   []string
+	Codes   []int
+	Rtts    []time.Duration
+	Groups  [][]string
+	Errs    []error
+	Payload []byte
+	Empty   []string
+}
+
+func (r listsResult) RTT() time.Duration { return 0 }
+func (r listsResult) String() string     { return "" }
+
+func TestFlattenValueSlices(t *testing.T) {
+	r := listsResult{
+		Names:   []string{"a", `b,"c"`},
+		Codes:   []int{1, 2},
+		Rtts:    []time.Duration{time.Millisecond},
+		Groups:  [][]string{{"x"}, nil},
+		Errs:    []error{errors.New("refused"), nil},
+		Payload: []byte{0xde, 0xad},
+	}
+	rows := libprobe.Flatten(r)
+	require.Len(t, rows, 1)
+	row := rows[0]
+	require.Equal(t, `["a","b,\"c\""]`, row["names"])
+	require.Equal(t, `[1,2]`, row["codes"])
+	require.Equal(t, `[1000000]`, row["rtts_ns"])
+	require.Equal(t, `[["x"],[]]`, row["groups"])
+	require.Equal(t, `["refused",""]`, row["errs"])
+	require.Equal(t, "3q0=", row["payload"])
+	require.Equal(t, "", row["empty"])
+
+	// The columns are the same whatever the lengths of the slices.
+	require.Equal(t, libprobe.Columns(rows...), libprobe.Columns(libprobe.Flatten(listsResult{})...))
+	table := libprobe.NewColumnarTable()
+	table.Append(r)
+	require.Equal(t, []interface{}{`["a","b,\"c\""]`}, table.Column("names"))
+}
+
+func TestCSVEncoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := libprobe.NewCSVEncoder(buf)
+	require.NoError(t, enc.Encode(&libprobe.TCPResult{
+		Target:      libprobe.Target{Address: "1.1.1.1:80"},
+		ConnectTime: time.Millisecond,
+	}))
+	require.NoError(t, enc.Encode(&libprobe.TCPResult{
+		Target: libprobe.Target{Address: "1.1.1.1:81"},
+		Error:  errors.New("connection refused"),
+	}))
+	require.NoError(t, enc.Flush())
+
+	records, err := csv.NewReader(buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	header := records[0]
+	require.Equal(t, libprobe.ColumnKind, header[0])
+	col := func(name string) int {
+		for i, h := range header {
+			if h == name {
+				return i
+			}
+		}
+		t.Fatalf("column %s not found", name)
+		return -1
+	}
+	require.Equal(t, "1000000", records[1][col("connect_time_ns")])
+	require.Equal(t, "connection refused", records[2][col(libprobe.ColumnError)])
+}
+
+func TestColumnarTable(t *testing.T) {
+	table := libprobe.NewColumnarTable()
+	table.Append(&libprobe.TCPResult{Target: libprobe.Target{Address: "a:1"}})
+	table.Append(&libprobe.HTTPResult{Target: libprobe.Target{Address: "http://b"}, ResponseStatusCode: 204})
+	require.Equal(t, 2, table.Len())
+	require.Equal(t, []interface{}{"a:1", "http://b"}, table.Column(libprobe.ColumnAddress))
+	require.Equal(t, []interface{}{nil, int64(204)}, table.Column("response_status_code"))
+	require.Nil(t, table.Column("unknown"))
+}
@@ -0,0 +1,263 @@
+package libprobe
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const KindFailover = "FAILOVER"
+
+// FailoverProberOptions configures a FailoverProber.
+type FailoverProberOptions struct {
+	// Prober probes the service address (a VIP) and the nodes.
+	Prober Prober
+	// Interval is the period probes are started at; probes run
+	// concurrently, so a hanging probe doesn't lower the resolution.
+	// Default: 100ms.
+	Interval time.Duration
+	// Duration is how long the service is observed, the failover must be
+	// induced meanwhile. Default: 1m.
+	Duration time.Duration
+	// SettleTime ends the observation early once the service was up for
+	// this long after an outage. Default: 0, observing for Duration.
+	SettleTime time.Duration
+	// ProbeTimeout bounds every probe. Default: 1s.
+	ProbeTimeout time.Duration
+	// Nodes are addresses of the nodes behind the service, such as the
+	// active and standby of a pair, probed alongside it to tell when each
+	// went down and up.
+	Nodes []string
+}
+
+// FailoverOutage is a period a service or node was down. It started between
+// LastSuccess and FirstFailure and ended at FirstSuccessAfter.
+type FailoverOutage struct {
+	LastSuccess       time.Time
+	FirstFailure      time.Time
+	FirstSuccessAfter time.Time
+	// Duration is the time between the first failed probe and the first
+	// successful one after it; MaxDuration is measured from the last
+	// successful probe before the outage and bounds it from above.
+	Duration     time.Duration
+	MaxDuration  time.Duration
+	FailedProbes int
+	// Recovered is false when the outage lasted until the end of the
+	// observation, Duration then ends at the last failed probe.
+	Recovered bool
+}
+
+// FailoverNode is the observation of a node behind the service.
+type FailoverNode struct {
+	Address  string
+	Probes   int
+	Failures int
+	Outages  []FailoverOutage
+}
+
+// FailoverResult is the outcome of observing a service during a failover.
+type FailoverResult struct {
+	Target
+
+	Error    error
+	Probes   int
+	Failures int
+	Outages  []FailoverOutage
+	// OutageTime is the sum of the outage durations.
+	OutageTime time.Duration
+	Nodes      []FailoverNode
+}
+
+// RTT returns the duration of the longest outage.
+func (r FailoverResult) RTT() time.Duration {
+	var longest time.Duration
+	for _, o := range r.Outages {
+		if o.Duration > longest {
+			longest = o.Duration
+		}
+	}
+	return longest
+}
+
+func (r FailoverResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d probes, %d failed, %d outages, outage time %s\n", r.Address, r.Probes, r.Failures, len(r.Outages), r.OutageTime)
+	writeOutages := func(outages []FailoverOutage) {
+		for _, o := range outages {
+			fmt.Fprintf(&b, "  down at %s for %s (at most %s), %d failed probes",
+				o.FirstFailure.Format("15:04:05.000"), o.Duration, o.MaxDuration, o.FailedProbes)
+			if !o.Recovered {
+				b.WriteString(", not recovered")
+			}
+			b.WriteString("\n")
+		}
+	}
+	writeOutages(r.Outages)
+	for _, n := range r.Nodes {
+		fmt.Fprintf(&b, "node %s: %d probes, %d failed\n", n.Address, n.Probes, n.Failures)
+		writeOutages(n.Outages)
+	}
+	if r.Error != nil {
+		fmt.Fprintf(&b, "error: %v\n", r.Error)
+	}
+	return b.String()
+}
+
+// FailoverProber measures failovers, as load balancer teams do by hand: it
+// probes a service continuously at a sub-second interval while a failover
+// is induced, and reports the outages it observed with the timestamps of
+// the last success before and the first success after each of them.
+type FailoverProber struct {
+	opts FailoverProberOptions
+}
+
+func NewFailoverProber(opts FailoverProberOptions) *FailoverProber {
+	if opts.Interval <= 0 {
+		opts.Interval = 100 * time.Millisecond
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = time.Minute
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = time.Second
+	}
+	return &FailoverProber{opts: opts}
+}
+
+func (p *FailoverProber) Kind() string {
+	return KindFailover
+}
+
+type failoverSample struct {
+	at time.Time
+	ok bool
+}
+
+// failoverSeries collects the samples of one address.
+type failoverSeries struct {
+	mu      sync.Mutex
+	samples []failoverSample
+}
+
+func (s *failoverSeries) add(at time.Time, ok bool) {
+	s.mu.Lock()
+	s.samples = append(s.samples, failoverSample{at, ok})
+	s.mu.Unlock()
+}
+
+// outages returns the outages in the samples and the number of failures.
+func (s *failoverSeries) outages() ([]FailoverOutage, int) {
+	s.mu.Lock()
+	samples := append([]failoverSample(nil), s.samples...)
+	s.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool { return samples[i].at.Before(samples[j].at) })
+	var outages []FailoverOutage
+	var current *FailoverOutage
+	var lastSuccess time.Time
+	failures := 0
+	for _, sample := range samples {
+		switch {
+		case !sample.ok:
+			failures++
+			if current == nil {
+				current = &FailoverOutage{LastSuccess: lastSuccess, FirstFailure: sample.at}
+			}
+			current.FailedProbes++
+			current.Duration = sample.at.Sub(current.FirstFailure)
+		case current != nil:
+			current.FirstSuccessAfter = sample.at
+			current.Duration = sample.at.Sub(current.FirstFailure)
+			if !current.LastSuccess.IsZero() {
+				current.MaxDuration = sample.at.Sub(current.LastSuccess)
+			}
+			current.Recovered = true
+			outages = append(outages, *current)
+			current = nil
+			lastSuccess = sample.at
+		default:
+			lastSuccess = sample.at
+		}
+	}
+	if current != nil {
+		outages = append(outages, *current)
+	}
+	return outages, failures
+}
+
+// recoveredSince returns when the series last recovered from an outage and
+// is up since, or the zero time.
+func (s *failoverSeries) recoveredSince() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var since time.Time
+	sawFailure := false
+	for _, sample := range s.samples {
+		switch {
+		case !sample.ok:
+			sawFailure = true
+			since = time.Time{}
+		case sawFailure && since.IsZero():
+			since = sample.at
+		}
+	}
+	return since
+}
+
+func (p *FailoverProber) Probe(target Target) (Result, error) {
+	if p.opts.Prober == nil {
+		return nil, fmt.Errorf("failover: no prober")
+	}
+	addresses := append([]string{target.Address}, p.opts.Nodes...)
+	series := make([]failoverSeries, len(addresses))
+	var wg sync.WaitGroup
+	probe := func(s *failoverSeries, address string, at time.Time) {
+		defer wg.Done()
+		t := target
+		t.Address = address
+		t.Timeout = p.opts.ProbeTimeout
+		r, err := safeProbe(p.opts.Prober, t)
+		s.add(at, err == nil && resultOK(r))
+	}
+
+	ticker := time.NewTicker(p.opts.Interval)
+	end := time.NewTimer(p.opts.Duration)
+	defer end.Stop()
+loop:
+	for {
+		at := time.Now()
+		for i, address := range addresses {
+			wg.Add(1)
+			go probe(&series[i], address, at)
+		}
+		if p.opts.SettleTime > 0 {
+			if since := series[0].recoveredSince(); !since.IsZero() && at.Sub(since) >= p.opts.SettleTime {
+				break loop
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-end.C:
+			break loop
+		}
+	}
+	ticker.Stop()
+	wg.Wait()
+
+	r := &FailoverResult{Target: target}
+	r.Outages, r.Failures = series[0].outages()
+	r.Probes = len(series[0].samples)
+	for _, o := range r.Outages {
+		r.OutageTime += o.Duration
+		if !o.Recovered {
+			r.Error = fmt.Errorf("failover: service down since %s", o.FirstFailure.Format(time.RFC3339Nano))
+		}
+	}
+	for i, address := range p.opts.Nodes {
+		n := FailoverNode{Address: address, Probes: len(series[i+1].samples)}
+		n.Outages, n.Failures = series[i+1].outages()
+		r.Nodes = append(r.Nodes, n)
+	}
+	return r, nil
+}
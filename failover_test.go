@@ -0,0 +1,61 @@
+package libprobe_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverProber(t *testing.T) {
+	start := time.Now()
+	// The active node fails 200ms in, the VIP moves to the standby 300ms
+	// later.
+	prober := funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		elapsed := time.Since(start)
+		var up bool
+		switch target.Address {
+		case "vip":
+			up = elapsed < 200*time.Millisecond || elapsed >= 500*time.Millisecond
+		case "active":
+			up = elapsed < 200*time.Millisecond
+		case "standby":
+			up = true
+		}
+		if !up {
+			return &libprobe.TCPResult{Target: target, Error: errors.New("refused")}, nil
+		}
+		return &libprobe.TCPResult{Target: target, ConnectTime: time.Millisecond}, nil
+	}}
+	p := libprobe.NewFailoverProber(libprobe.FailoverProberOptions{
+		Prober:     prober,
+		Interval:   10 * time.Millisecond,
+		Duration:   5 * time.Second,
+		SettleTime: 200 * time.Millisecond,
+		Nodes:      []string{"active", "standby"},
+	})
+	r, err := p.Probe(libprobe.Target{Address: "vip"})
+	require.NoError(t, err)
+	res := r.(*libprobe.FailoverResult)
+	require.NoError(t, res.Error)
+	require.True(t, time.Since(start) < 2*time.Second, "observation didn't end after settling")
+
+	require.Len(t, res.Outages, 1)
+	outage := res.Outages[0]
+	require.True(t, outage.Recovered)
+	require.InDelta(t, float64(300*time.Millisecond), float64(outage.Duration), float64(50*time.Millisecond))
+	require.True(t, outage.MaxDuration >= outage.Duration)
+	require.True(t, outage.FirstSuccessAfter.After(outage.FirstFailure))
+	require.Equal(t, outage.Duration, res.RTT())
+	require.Equal(t, res.Failures, outage.FailedProbes)
+
+	require.Len(t, res.Nodes, 2)
+	require.Equal(t, "active", res.Nodes[0].Address)
+	require.Len(t, res.Nodes[0].Outages, 1)
+	require.False(t, res.Nodes[0].Outages[0].Recovered)
+	require.Empty(t, res.Nodes[1].Outages)
+	require.Equal(t, res.Probes, res.Nodes[1].Probes)
+}
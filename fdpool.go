@@ -0,0 +1,233 @@
+package libprobe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrFDPoolExhausted is the error of a socket that waited for a slot of the
+// FD pool until its probe timed out.
+var ErrFDPoolExhausted = errors.New("fd pool: no free descriptor")
+
+// FDPoolOptions configures an FDPool.
+type FDPoolOptions struct {
+	// Max is the number of sockets open at the same time. It should stay
+	// well below the process's descriptor limit, leaving room for files and
+	// sinks. Default: 1024.
+	Max int
+	// MaxWait bounds the wait for a slot of sockets opened without a
+	// timeout. Default: 10s.
+	MaxWait time.Duration
+}
+
+// FDPoolStats is a snapshot of an FDPool.
+type FDPoolStats struct {
+	Max   int
+	InUse int
+	// Peak is the highest InUse seen.
+	Peak int
+	// Waiting is the number of sockets currently queued for a slot; Waits
+	// counts those queued so far and WaitTime their total time in the
+	// queue. Timeouts counts those that gave up.
+	Waiting  int
+	Waits    uint64
+	WaitTime time.Duration
+	Timeouts uint64
+}
+
+// FDPool caps the sockets the probers of the process have open at the same
+// time. Once installed with SetFDPool, probers take a slot before dialing
+// and give it back when the connection is closed; when the cap is hit, they
+// queue for a free slot instead of failing with EMFILE. The time spent in
+// the queue counts towards the probe's timeout and its measured timings, so
+// the cap should be sized for queuing to be the exception. Raw ICMP and IP
+// sockets, which are shared or short-lived, aren't accounted.
+type FDPool struct {
+	maxWait time.Duration
+	slots   chan struct{}
+
+	waiting  int64
+	waits    uint64
+	waitTime int64
+	timeouts uint64
+
+	mu   sync.Mutex
+	peak int
+}
+
+// NewFDPool returns a pool with the cap of opts.
+func NewFDPool(opts FDPoolOptions) *FDPool {
+	if opts.Max <= 0 {
+		opts.Max = 1024
+	}
+	if opts.MaxWait <= 0 {
+		opts.MaxWait = 10 * time.Second
+	}
+	return &FDPool{maxWait: opts.MaxWait, slots: make(chan struct{}, opts.Max)}
+}
+
+// Stats returns a snapshot of the pool.
+func (p *FDPool) Stats() FDPoolStats {
+	p.mu.Lock()
+	peak := p.peak
+	p.mu.Unlock()
+	return FDPoolStats{
+		Max:      cap(p.slots),
+		InUse:    len(p.slots),
+		Peak:     peak,
+		Waiting:  int(atomic.LoadInt64(&p.waiting)),
+		Waits:    atomic.LoadUint64(&p.waits),
+		WaitTime: time.Duration(atomic.LoadInt64(&p.waitTime)),
+		Timeouts: atomic.LoadUint64(&p.timeouts),
+	}
+}
+
+// acquire takes a slot, waiting until one is free, ctx is done or the
+// deadline, if not zero, has passed. A nil pool always succeeds.
+func (p *FDPool) acquire(ctx context.Context, deadline time.Time) error {
+	if p == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		p.taken()
+		return nil
+	default:
+	}
+
+	if deadline.IsZero() {
+		deadline = time.Now().Add(p.maxWait)
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	atomic.AddInt64(&p.waiting, 1)
+	atomic.AddUint64(&p.waits, 1)
+	startAt := time.Now()
+	defer func() {
+		atomic.AddInt64(&p.waiting, -1)
+		atomic.AddInt64(&p.waitTime, int64(time.Since(startAt)))
+	}()
+	select {
+	case p.slots <- struct{}{}:
+		p.taken()
+		return nil
+	case <-ctx.Done():
+		atomic.AddUint64(&p.timeouts, 1)
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrFDPoolExhausted
+		}
+		return ctx.Err()
+	case <-timer.C:
+		atomic.AddUint64(&p.timeouts, 1)
+		return ErrFDPoolExhausted
+	}
+}
+
+func (p *FDPool) taken() {
+	n := len(p.slots)
+	p.mu.Lock()
+	if n > p.peak {
+		p.peak = n
+	}
+	p.mu.Unlock()
+}
+
+func (p *FDPool) release() {
+	if p != nil {
+		<-p.slots
+	}
+}
+
+// pooledConn gives its slot back to the pool when closed.
+type pooledConn struct {
+	net.Conn
+	pool *FDPool
+	once sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.pool.release)
+	return err
+}
+
+// pooledPacketConn is a pooledConn for packet connections.
+type pooledPacketConn struct {
+	*net.UDPConn
+	pool *FDPool
+	once sync.Once
+}
+
+func (c *pooledPacketConn) Close() error {
+	err := c.UDPConn.Close()
+	c.once.Do(c.pool.release)
+	return err
+}
+
+var fdPool struct {
+	mu sync.RWMutex
+	p  *FDPool
+}
+
+// SetFDPool installs p as the FD pool of all probers of the process. A nil
+// pool, the default, leaves sockets uncapped.
+func SetFDPool(p *FDPool) {
+	fdPool.mu.Lock()
+	fdPool.p = p
+	fdPool.mu.Unlock()
+}
+
+func activeFDPool() *FDPool {
+	fdPool.mu.RLock()
+	defer fdPool.mu.RUnlock()
+	return fdPool.p
+}
+
+// pooledDial dials with dial once it took a slot of the active FD pool,
+// returning a connection which gives it back when closed and counts its
+// traffic with meter, if not nil.
+func pooledDial(ctx context.Context, deadline time.Time, meter *trafficMeter, dial func() (net.Conn, error)) (net.Conn, error) {
+	pool := activeFDPool()
+	if err := pool.acquire(ctx, deadline); err != nil {
+		return nil, err
+	}
+	conn, err := dial()
+	if err != nil {
+		pool.release()
+		return nil, err
+	}
+	if pool != nil {
+		conn = &pooledConn{Conn: conn, pool: pool}
+	}
+	if meter != nil {
+		conn = newMeteredConn(conn, meter)
+	}
+	return conn, nil
+}
+
+// listenUDP is net.ListenUDP, taking a slot of the active FD pool until
+// the connection is closed and counting its traffic with the meter of ctx.
+func listenUDP(ctx context.Context, laddr *net.UDPAddr) (net.PacketConn, error) {
+	pool := activeFDPool()
+	deadline, _ := ctx.Deadline()
+	if err := pool.acquire(ctx, deadline); err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		pool.release()
+		return nil, err
+	}
+	var conn net.PacketConn = udp
+	if pool != nil {
+		conn = &pooledPacketConn{UDPConn: udp, pool: pool}
+	}
+	if meter := trafficMeterFrom(ctx); meter != nil {
+		conn = newMeteredPacketConn(conn, meter)
+	}
+	return conn, nil
+}
@@ -0,0 +1,83 @@
+package libprobe_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFDPool(t *testing.T) {
+	// The listener accepts connections but never answers, so a TLS probe
+	// holds its socket until it times out.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	pool := libprobe.NewFDPool(libprobe.FDPoolOptions{Max: 1})
+	libprobe.SetFDPool(pool)
+	defer libprobe.SetFDPool(nil)
+
+	held := make(chan libprobe.Result)
+	go func() {
+		r, _ := libprobe.NewTLSProber(libprobe.TLSExtention{}).Probe(libprobe.Target{Address: ln.Addr().String(), Timeout: 300 * time.Millisecond})
+		held <- r
+	}()
+	require.Eventually(t, func() bool { return pool.Stats().InUse == 1 }, time.Second, time.Millisecond)
+
+	tcp := libprobe.NewTCPProber()
+	r, err := tcp.Probe(libprobe.Target{Address: ln.Addr().String(), Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	require.True(t, errors.Is(r.(*libprobe.TCPResult).Error, libprobe.ErrFDPoolExhausted))
+
+	r, err = tcp.Probe(libprobe.Target{Address: ln.Addr().String(), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.NoError(t, r.(*libprobe.TCPResult).Error)
+	require.Error(t, (<-held).(*libprobe.TLSResult).Error)
+
+	stats := pool.Stats()
+	require.Equal(t, 1, stats.Max)
+	require.Zero(t, stats.InUse)
+	require.Equal(t, 1, stats.Peak)
+	require.Zero(t, stats.Waiting)
+	require.Equal(t, uint64(2), stats.Waits)
+	require.Equal(t, uint64(1), stats.Timeouts)
+	require.True(t, stats.WaitTime >= 250*time.Millisecond)
+}
+
+func TestFDPoolHTTPProber(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	pool := libprobe.NewFDPool(libprobe.FDPoolOptions{Max: 2, MaxWait: 500 * time.Millisecond})
+	libprobe.SetFDPool(pool)
+	defer libprobe.SetFDPool(nil)
+
+	// Every probe opens a new connection, which must give back its slot.
+	prober := libprobe.NewHTTPProber()
+	for i := 0; i < 5; i++ {
+		r, err := prober.Probe(libprobe.Target{Address: srv.URL, Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		require.NoError(t, r.(*libprobe.HTTPResult).Error)
+	}
+	require.Eventually(t, func() bool { return pool.Stats().InUse == 0 }, time.Second, time.Millisecond)
+	require.Zero(t, pool.Stats().Timeouts)
+}
@@ -0,0 +1,52 @@
+package libprobe
+
+import "encoding/binary"
+
+// The reply parsers below are exported to the fuzz targets of fuzz_test.go.
+
+var (
+	ParseIPv4Options     = parseIPv4Options
+	ParseGTPEchoResponse = parseGTPEchoResponse
+	ParseTACACSReply     = parseTACACSReply
+	ParseFlowLabel       = parseFlowLabel
+	EachDiameterAVP      = eachDiameterAVP
+)
+
+// ICMPTracker is the tracker of the socket ParseICMPPacket parses for.
+var ICMPTracker = []byte("libprobe")
+
+func ParseICMPPacket(b []byte, isIPv6, raw bool) error {
+	return parseICMPPacket(&icmpPacket{}, b, isIPv6, raw, 0x1234, ICMPTracker)
+}
+
+func ParseDNSResponse(b []byte) error {
+	var id uint16
+	if len(b) >= 2 {
+		id = binary.BigEndian.Uint16(b)
+	}
+	_, err := parseDNSResponse(b, id)
+	return err
+}
+
+func ParseBER(b []byte) error {
+	children, err := berChildren(b)
+	for _, c := range children {
+		if c.Tag&0x20 != 0 { // constructed
+			berChildren(c.Content)
+		}
+	}
+	return err
+}
+
+func ParseReflectorPacket(b []byte) error {
+	_, err := parseReflectorPacket(b)
+	return err
+}
+
+func ParseKerberosReply(b []byte) error {
+	return (&KerberosTransport{}).parseReply(b)
+}
+
+func ParseLDAPRootDSE(b []byte) error {
+	return (&LDAPRootDSE{Attributes: make(map[string][]string)}).parse(b)
+}
@@ -0,0 +1,116 @@
+package libprobe_test
+
+import (
+	"testing"
+
+	"github.com/blho/libprobe"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The fuzz targets feed arbitrary replies to the parsers, which must reject
+// them without panicking: replies come from networks we don't control.
+
+func FuzzParseICMPPacket(f *testing.F) {
+	reply := append([]byte{0, 0, 0, 0, 0x12, 0x34, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}, libprobe.ICMPTracker...)
+	f.Add(reply, false, true)
+	f.Add(append([]byte{129, 0, 0, 0, 0x12, 0x34, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}, libprobe.ICMPTracker...), true, false)
+	// Time exceeded, quoting the IPv4 header and the echo request.
+	quoted := []byte{0x45, 0, 0, 52, 0, 0, 0, 0, 1, 1, 0, 0, 192, 0, 2, 1, 192, 0, 2, 2}
+	quoted = append(quoted, 8, 0, 0, 0, 0x12, 0x34, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0)
+	f.Add(append(append([]byte{11, 0, 0, 0, 0, 0, 0, 0}, quoted...), libprobe.ICMPTracker...), false, true)
+	// Packet too big, quoting the IPv6 header.
+	quoted6 := make([]byte, 40)
+	quoted6[0], quoted6[6] = 0x60, 58
+	f.Add(append(append([]byte{2, 0, 0, 0, 0, 0, 5, 0}, quoted6...), 128, 0, 0, 0, 0x12, 0x34, 0, 1), true, false)
+	f.Fuzz(func(t *testing.T, b []byte, isIPv6, raw bool) {
+		libprobe.ParseICMPPacket(b, isIPv6, raw)
+	})
+}
+
+func FuzzParseIPv4Options(f *testing.F) {
+	f.Add([]byte{7, 11, 8, 192, 0, 2, 1, 0, 0, 0, 0, 1})
+	f.Add([]byte{68, 20, 13, 0x01, 192, 0, 2, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		libprobe.ParseIPv4Options(b)
+	})
+}
+
+func FuzzParseFlowLabel(f *testing.F) {
+	f.Add([]byte{20, 0, 0, 0, 0, 0, 0, 0, 41, 0, 0, 0, 11, 0, 0, 0, 0, 1, 2, 3})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		libprobe.ParseFlowLabel(b)
+	})
+}
+
+func FuzzParseDNSResponse(f *testing.F) {
+	name := dnsmessage.MustNewName("www.example.")
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 7, Response: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(b)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		libprobe.ParseDNSResponse(b)
+	})
+}
+
+func FuzzParseBER(f *testing.F) {
+	f.Add([]byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x04, 0x01, 'x'})
+	f.Add([]byte{0x04, 0x82, 0x00, 0x01, 'x'})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		libprobe.ParseBER(b)
+	})
+}
+
+func FuzzParseKerberosReply(f *testing.F) {
+	f.Add([]byte{0x7e, 0x0a, 0x30, 0x08, 0xa6, 0x03, 0x02, 0x01, 0x19, 0xa4, 0x01, 0x00})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		libprobe.ParseKerberosReply(b)
+	})
+}
+
+func FuzzParseLDAPRootDSE(f *testing.F) {
+	f.Add([]byte{0x04, 0x00, 0x30, 0x0d, 0x30, 0x0b, 0x04, 0x04, 'n', 'a', 'm', 'e', 0x31, 0x03, 0x04, 0x01, 'x'})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		libprobe.ParseLDAPRootDSE(b)
+	})
+}
+
+func FuzzEachDiameterAVP(f *testing.F) {
+	f.Add([]byte{0, 0, 1, 12, 0x40, 0, 0, 12, 0, 0, 7, 0xd1})
+	f.Add([]byte{0, 0, 1, 10, 0xc0, 0, 0, 16, 0, 0, 0, 10, 0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		libprobe.EachDiameterAVP(b, func(uint32, []byte) {})
+	})
+}
+
+func FuzzParseGTPEchoResponse(f *testing.F) {
+	f.Add([]byte{0x32, 2, 0, 6, 0, 0, 0, 0, 0, 1, 0, 0, 14, 5}, 1)
+	f.Add([]byte{0x40, 2, 0, 9, 0, 0, 1, 0, 3, 0, 1, 0, 5}, 0)
+	f.Fuzz(func(t *testing.T, b []byte, version int) {
+		libprobe.ParseGTPEchoResponse(b, libprobe.GTPVersion(version))
+	})
+}
+
+func FuzzParseTACACSReply(f *testing.F) {
+	f.Add([]byte{1, 0, 0, 2, 0, 0, 'o', 'k'})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		libprobe.ParseTACACSReply(b)
+	})
+}
+
+func FuzzParseReflectorPacket(f *testing.F) {
+	f.Add(append([]byte("LPRF\x01\x02"), make([]byte, 42)...))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		libprobe.ParseReflectorPacket(b)
+	})
+}
@@ -0,0 +1,306 @@
+package libprobe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const KindGameQuery = "GAME_QUERY"
+
+// GameServerInfo is what a game or voice server reports about itself.
+// Players, MaxPlayers and Bots are -1 when the protocol doesn't report them.
+type GameServerInfo struct {
+	Name       string
+	Game       string
+	Map        string
+	Version    string
+	Players    int
+	MaxPlayers int
+	Bots       int
+}
+
+// GameQueryProtocol is a UDP query protocol of game or voice servers. Custom
+// protocols are plugged in by filling one in.
+type GameQueryProtocol struct {
+	Name string
+	// Port is the default port of the protocol.
+	Port int
+	// Query returns the datagram to send, given the challenge returned by
+	// Parse for the previous response, nil at first.
+	Query func(challenge []byte) []byte
+	// Parse fills info from a response. It returns a challenge when the
+	// server asks for the query to be sent again with one.
+	Parse func(response []byte, info *GameServerInfo) (challenge []byte, err error)
+}
+
+var errGameQueryMismatch = errors.New("gamequery: unexpected response")
+
+// GameQuerySource sends an A2S_INFO query to Source engine servers, such as
+// Counter-Strike or Team Fortress 2 ones, and the many games using the same
+// protocol.
+var GameQuerySource = GameQueryProtocol{
+	Name: "source",
+	Port: 27015,
+	Query: func(challenge []byte) []byte {
+		b := append([]byte("\xff\xff\xff\xffTSource Engine Query"), 0)
+		return append(b, challenge...)
+	},
+	Parse: func(b []byte, info *GameServerInfo) ([]byte, error) {
+		if len(b) < 5 || !bytes.HasPrefix(b, []byte{0xff, 0xff, 0xff, 0xff}) {
+			return nil, errGameQueryMismatch
+		}
+		switch b[4] {
+		case 'A':
+			if len(b) < 9 {
+				return nil, errGameQueryMismatch
+			}
+			return append([]byte(nil), b[5:9]...), nil
+		case 'I':
+		default:
+			return nil, errGameQueryMismatch
+		}
+		b = b[6:] // header and protocol version
+		var fields [4]string
+		for i := range fields {
+			end := bytes.IndexByte(b, 0)
+			if end < 0 {
+				return nil, errors.New("gamequery: truncated A2S_INFO response")
+			}
+			fields[i], b = string(b[:end]), b[end+1:]
+		}
+		// Steam app id, players, max players, bots, server type,
+		// environment, visibility, VAC, version.
+		if len(b) < 9 {
+			return nil, errors.New("gamequery: truncated A2S_INFO response")
+		}
+		info.Name, info.Map, info.Game = fields[0], fields[1], fields[3]
+		info.Players, info.MaxPlayers, info.Bots = int(b[2]), int(b[3]), int(b[4])
+		if end := bytes.IndexByte(b[9:], 0); end >= 0 {
+			info.Version = string(b[9 : 9+end])
+		}
+		return nil, nil
+	},
+}
+
+// GameQueryQuake3 sends a getstatus query to servers of the Quake 3 family,
+// such as Call of Duty, Wolfenstein or OpenArena ones.
+var GameQueryQuake3 = GameQueryProtocol{
+	Name: "quake3",
+	Port: 27960,
+	Query: func([]byte) []byte {
+		return []byte("\xff\xff\xff\xffgetstatus")
+	},
+	Parse: func(b []byte, info *GameServerInfo) ([]byte, error) {
+		const prefix = "\xff\xff\xff\xffstatusResponse\n"
+		if !bytes.HasPrefix(b, []byte(prefix)) {
+			return nil, errGameQueryMismatch
+		}
+		lines := strings.Split(strings.TrimRight(string(b[len(prefix):]), "\n"), "\n")
+		vars := strings.Split(strings.TrimPrefix(lines[0], "\\"), "\\")
+		for i := 0; i+1 < len(vars); i += 2 {
+			switch strings.ToLower(vars[i]) {
+			case "sv_hostname":
+				info.Name = vars[i+1]
+			case "mapname":
+				info.Map = vars[i+1]
+			case "gamename":
+				info.Game = vars[i+1]
+			case "version", "shortversion":
+				info.Version = vars[i+1]
+			case "sv_maxclients":
+				info.MaxPlayers, _ = strconv.Atoi(vars[i+1])
+			}
+		}
+		// One line per player follows.
+		info.Players = len(lines) - 1
+		return nil, nil
+	},
+}
+
+var raknetMagic = []byte{0x00, 0xff, 0xff, 0x00, 0xfe, 0xfe, 0xfe, 0xfe, 0xfd, 0xfd, 0xfd, 0xfd, 0x12, 0x34, 0x56, 0x78}
+
+// GameQueryMinecraftBedrock sends a RakNet unconnected ping to Minecraft
+// Bedrock Edition servers.
+var GameQueryMinecraftBedrock = GameQueryProtocol{
+	Name: "minecraft-bedrock",
+	Port: 19132,
+	Query: func([]byte) []byte {
+		b := make([]byte, 9, 33)
+		b[0] = 0x01
+		binary.BigEndian.PutUint64(b[1:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+		b = append(b, raknetMagic...)
+		guid := make([]byte, 8)
+		_, _ = rand.Read(guid)
+		return append(b, guid...)
+	},
+	Parse: func(b []byte, info *GameServerInfo) ([]byte, error) {
+		if len(b) < 35 || b[0] != 0x1c || !bytes.Equal(b[17:33], raknetMagic) {
+			return nil, errGameQueryMismatch
+		}
+		n := int(binary.BigEndian.Uint16(b[33:]))
+		if len(b) < 35+n {
+			return nil, errors.New("gamequery: truncated unconnected pong")
+		}
+		// MCPE;motd;protocol;version;players;max players;server id;level;...
+		fields := strings.Split(string(b[35:35+n]), ";")
+		if len(fields) < 6 {
+			return nil, errors.New("gamequery: malformed server id string")
+		}
+		info.Game, info.Name, info.Version = fields[0], fields[1], fields[3]
+		info.Players, _ = strconv.Atoi(fields[4])
+		info.MaxPlayers, _ = strconv.Atoi(fields[5])
+		if len(fields) > 7 {
+			info.Map = fields[7]
+		}
+		return nil, nil
+	},
+}
+
+// GameQueryTeamSpeak3 starts the handshake of a TeamSpeak 3 voice server,
+// whose first answer shows it is up. TeamSpeak doesn't report players over
+// this port.
+var GameQueryTeamSpeak3 = GameQueryProtocol{
+	Name: "teamspeak3",
+	Port: 9987,
+	Query: func([]byte) []byte {
+		// MAC, packet id 101, client id 0, INIT1 with the unencrypted
+		// flag, then the client version, step 0, a timestamp and a random
+		// number.
+		b := []byte("TS3INIT1\x00\x65\x00\x00\x88\x0e\x0e\x0e\x0e\x00")
+		ts := make([]byte, 4)
+		binary.BigEndian.PutUint32(ts, uint32(time.Now().Unix()))
+		b = append(b, ts...)
+		random := make([]byte, 4)
+		_, _ = rand.Read(random)
+		b = append(b, random...)
+		return append(b, make([]byte, 8)...)
+	},
+	Parse: func(b []byte, info *GameServerInfo) ([]byte, error) {
+		// MAC, packet id, INIT1 and step 1.
+		if len(b) < 12 || !bytes.HasPrefix(b, []byte("TS3INIT1")) || b[10]&0x0f != 0x08 || b[11] != 1 {
+			return nil, errGameQueryMismatch
+		}
+		info.Game = "TeamSpeak 3"
+		return nil, nil
+	},
+}
+
+// GameQueryProberOptions configures a GameQueryProber.
+type GameQueryProberOptions struct {
+	// Protocol is the query protocol. Default: GameQuerySource.
+	Protocol GameQueryProtocol
+}
+
+type GameQueryResult struct {
+	Target
+	Error error
+
+	Protocol string
+	// QueryTime is the time to the final response, challenges included.
+	QueryTime  time.Duration
+	Challenges int
+	GameServerInfo
+}
+
+func (r GameQueryResult) RTT() time.Duration {
+	return r.QueryTime
+}
+
+func (r GameQueryResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("Error: %s", r.Error)
+	}
+	s := fmt.Sprintf("%s %s: %q %s %s", r.Protocol, r.Target.Address, r.Name, r.Game, r.Map)
+	if r.Players >= 0 {
+		s += fmt.Sprintf(" players=%d/%d", r.Players, r.MaxPlayers)
+	}
+	return s + fmt.Sprintf(" time=%s", r.QueryTime)
+}
+
+// GameQueryProber queries the game or voice server in Target.Address, on the
+// default port of the protocol unless given, and reports what it says about
+// itself. Target.Timeout bounds the whole query and defaults to one second.
+type GameQueryProber struct {
+	opts GameQueryProberOptions
+}
+
+func NewGameQueryProber(opts GameQueryProberOptions) *GameQueryProber {
+	if opts.Protocol.Query == nil {
+		opts.Protocol = GameQuerySource
+	}
+	return &GameQueryProber{opts: opts}
+}
+
+func (p *GameQueryProber) Kind() string {
+	return KindGameQuery
+}
+
+// maxGameQueryChallenges bounds the challenge round trips, servers asking
+// for more are broken.
+const maxGameQueryChallenges = 3
+
+func (p *GameQueryProber) Probe(target Target) (Result, error) {
+	proto := p.opts.Protocol
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(proto.Port))
+	}
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	conn, err := dialTimeout(target.meter, "udp", address, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	startAt := time.Now()
+	if err := conn.SetDeadline(startAt.Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	r := &GameQueryResult{
+		Target:         target,
+		Protocol:       proto.Name,
+		GameServerInfo: GameServerInfo{Players: -1, MaxPlayers: -1, Bots: -1},
+	}
+	var challenge []byte
+	buf := make([]byte, 65535)
+	for {
+		if _, err := conn.Write(proto.Query(challenge)); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		var n int
+		for {
+			if n, err = conn.Read(buf); err != nil {
+				r.Error = err
+				return r, nil
+			}
+			challenge, err = proto.Parse(buf[:n], &r.GameServerInfo)
+			if err != errGameQueryMismatch {
+				break
+			}
+		}
+		if err != nil {
+			r.Error = err
+			return r, nil
+		}
+		if challenge == nil {
+			break
+		}
+		if r.Challenges++; r.Challenges > maxGameQueryChallenges {
+			r.Error = errors.New("gamequery: too many challenges")
+			return r, nil
+		}
+	}
+	r.QueryTime = time.Since(startAt)
+	return r, nil
+}
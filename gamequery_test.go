@@ -0,0 +1,98 @@
+package libprobe_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveUDP answers every datagram with the ones returned by handle.
+func serveUDP(t *testing.T, handle func(query []byte) [][]byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, b := range handle(append([]byte(nil), buf[:n]...)) {
+				conn.WriteTo(b, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestGameQuerySource(t *testing.T) {
+	address := serveUDP(t, func(q []byte) [][]byte {
+		if !bytes.HasSuffix(q, []byte("\x01\x02\x03\x04")) {
+			return [][]byte{[]byte("\xff\xff\xff\xffA\x01\x02\x03\x04")}
+		}
+		b := []byte("\xff\xff\xff\xffI\x11Fake server\x00de_dust2\x00csgo\x00Counter-Strike\x00\xda\x02")
+		b = append(b, 12, 24, 2, 'd', 'l', 0, 1)
+		b = append(b, "1.38.0.1\x00"...)
+		// A stray packet, ignored.
+		return [][]byte{[]byte("garbage"), b}
+	})
+	r, err := libprobe.NewGameQueryProber(libprobe.GameQueryProberOptions{}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.GameQueryResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, 1, res.Challenges)
+	require.Equal(t, libprobe.GameServerInfo{
+		Name:       "Fake server",
+		Game:       "Counter-Strike",
+		Map:        "de_dust2",
+		Version:    "1.38.0.1",
+		Players:    12,
+		MaxPlayers: 24,
+		Bots:       2,
+	}, res.GameServerInfo)
+}
+
+func TestGameQueryQuake3(t *testing.T) {
+	address := serveUDP(t, func(q []byte) [][]byte {
+		return [][]byte{[]byte("\xff\xff\xff\xffstatusResponse\n\\sv_hostname\\Arena\\mapname\\q3dm17\\sv_maxclients\\16\\gamename\\baseoa\n0 48 \"bob\"\n5 30 \"alice\"\n")}
+	})
+	prober := libprobe.NewGameQueryProber(libprobe.GameQueryProberOptions{Protocol: libprobe.GameQueryQuake3})
+	r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.GameQueryResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, libprobe.GameServerInfo{Name: "Arena", Game: "baseoa", Map: "q3dm17", Players: 2, MaxPlayers: 16, Bots: -1}, res.GameServerInfo)
+}
+
+func TestGameQueryMinecraftBedrock(t *testing.T) {
+	address := serveUDP(t, func(q []byte) [][]byte {
+		id := "MCPE;Bedrock world;589;1.20.0;3;10;123;Survival;Survival;1;19132;19133;"
+		b := append([]byte{0x1c}, q[1:9]...)
+		b = append(b, make([]byte, 8)...)
+		b = append(b, q[9:25]...)
+		n := make([]byte, 2)
+		binary.BigEndian.PutUint16(n, uint16(len(id)))
+		return [][]byte{append(append(b, n...), id...)}
+	})
+	prober := libprobe.NewGameQueryProber(libprobe.GameQueryProberOptions{Protocol: libprobe.GameQueryMinecraftBedrock})
+	r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.GameQueryResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, libprobe.GameServerInfo{Name: "Bedrock world", Game: "MCPE", Map: "Survival", Version: "1.20.0", Players: 3, MaxPlayers: 10, Bots: -1}, res.GameServerInfo)
+}
+
+func TestGameQueryTimeout(t *testing.T) {
+	address := serveUDP(t, func([]byte) [][]byte { return nil })
+	prober := libprobe.NewGameQueryProber(libprobe.GameQueryProberOptions{Protocol: libprobe.GameQueryTeamSpeak3})
+	r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	require.Error(t, r.(*libprobe.GameQueryResult).Error)
+}
@@ -0,0 +1,418 @@
+package libprobe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const KindGRPC = "GRPC"
+
+// gRPC status codes.
+var grpcStatusNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED",
+	"NOT_FOUND", "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+const grpcUnimplemented = 12
+
+func grpcStatusName(code int) string {
+	if code >= 0 && code < len(grpcStatusNames) {
+		return grpcStatusNames[code]
+	}
+	return fmt.Sprintf("CODE_%d", code)
+}
+
+var grpcServingStatuses = []string{"UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"}
+
+// grpcMaxMessage bounds the messages received.
+const grpcMaxMessage = 4 << 20
+
+// GRPCProberOptions configures a GRPCProber.
+type GRPCProberOptions struct {
+	// TLS enables TLS, configured by TLSConfig when set. Requests go over
+	// plaintext HTTP/2 otherwise.
+	TLS       bool
+	TLSConfig *tls.Config
+	// Service is the service of the health check, "" for the whole server.
+	Service string
+	// Method, e.g. "helloworld.Greeter/SayHello", is looked up with server
+	// reflection and invoked with Request instead of the health check.
+	// Only unary methods are supported.
+	Method string
+	// Request is the JSON mapping of the request message of Method.
+	// Default: "{}".
+	Request string
+	// Metadata are sent along requests.
+	Metadata map[string]string
+	// Assertions are evaluated against the JSON mapping of the response of
+	// Method, failing the probe unless all hold.
+	Assertions []*JSONAssertion
+}
+
+type GRPCResult struct {
+	Target
+	Error error
+
+	// Method is the method invoked, grpc.health.v1.Health/Check for health
+	// checks.
+	Method string
+	// StatusCode, Status and StatusMessage are the gRPC status of the call.
+	StatusCode    int
+	Status        string
+	StatusMessage string
+	// ServingStatus is the status answered by health checks.
+	ServingStatus  string
+	ReflectionTime time.Duration
+	CallTime       time.Duration
+	TotalTime      time.Duration
+	// Response is the JSON mapping of the response of Method.
+	Response string
+	// FailedAssertions are the GRPCProberOptions.Assertions that didn't
+	// hold.
+	FailedAssertions []string
+}
+
+func (r GRPCResult) RTT() time.Duration {
+	return r.CallTime
+}
+
+func (r GRPCResult) String() string {
+	if r.Error != nil && r.Status == "" {
+		return fmt.Sprintf("Error: %s", r.Error)
+	}
+	s := fmt.Sprintf("-> %s /%s %s", r.Target.Address, r.Method, r.Status)
+	if r.ServingStatus != "" {
+		s += " " + r.ServingStatus
+	}
+	if r.StatusMessage != "" {
+		s += fmt.Sprintf(" %q", r.StatusMessage)
+	}
+	return s + fmt.Sprintf(" time=%s", r.CallTime)
+}
+
+// GRPCProber calls the gRPC server in Target.Address ("host:port"). It runs
+// the standard health check, or invokes a method found with server
+// reflection, and fails unless the call succeeds.
+type GRPCProber struct {
+	opts GRPCProberOptions
+}
+
+func NewGRPCProber(opts GRPCProberOptions) *GRPCProber {
+	if opts.Request == "" {
+		opts.Request = "{}"
+	}
+	return &GRPCProber{opts: opts}
+}
+
+func (p *GRPCProber) Kind() string {
+	return KindGRPC
+}
+
+func (p *GRPCProber) transport() (*http.Transport, error) {
+	t := &http.Transport{TLSClientConfig: p.opts.TLSConfig, ForceAttemptHTTP2: true, DialContext: dialContext}
+	if !p.opts.TLS {
+		if err := enableH2C(t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// grpcError is a call ending with a status other than OK.
+type grpcError struct {
+	Code    int
+	Message string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("grpc: %s: %s", grpcStatusName(e.Code), e.Message)
+}
+
+// call invokes method with the requests and returns the responses.
+func (p *GRPCProber) call(ctx context.Context, t *http.Transport, target Target, method string, requests ...[]byte) ([][]byte, error) {
+	var body bytes.Buffer
+	for _, req := range requests {
+		var head [5]byte
+		binary.BigEndian.PutUint32(head[1:], uint32(len(req)))
+		body.Write(head[:])
+		body.Write(req)
+	}
+	scheme := "http"
+	if p.opts.TLS {
+		scheme = "https"
+	}
+	u := &url.URL{Scheme: scheme, Host: target.Address, Path: "/" + method}
+	req, err := http.NewRequest(http.MethodPost, u.String(), &body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("User-Agent", UserAgent())
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("Grpc-Timeout", strconv.FormatInt(int64(time.Until(deadline)/time.Millisecond), 10)+"m")
+	}
+	for k, v := range p.opts.Metadata {
+		req.Header.Set(k, v)
+	}
+	setCorrelationHeaders(req.Header, target)
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		return nil, fmt.Errorf("grpc: %s instead of HTTP/2", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("grpc: HTTP status %s", resp.Status)
+	}
+	var responses [][]byte
+	for {
+		var head [5]byte
+		if _, err := io.ReadFull(resp.Body, head[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if head[0] != 0 {
+			return nil, errors.New("grpc: compressed responses aren't supported")
+		}
+		n := binary.BigEndian.Uint32(head[1:])
+		if n > grpcMaxMessage {
+			return nil, errors.New("grpc: response too large")
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(resp.Body, msg); err != nil {
+			return nil, err
+		}
+		responses = append(responses, msg)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	// Trailers-only responses carry the status in the headers.
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, errors.New("grpc: missing status")
+	}
+	if msg, err := url.PathUnescape(message); err == nil {
+		message = msg
+	}
+	if code != 0 {
+		return responses, &grpcError{Code: code, Message: message}
+	}
+	return responses, nil
+}
+
+func (p *GRPCProber) Probe(target Target) (Result, error) {
+	return p.ProbeContext(context.Background(), target)
+}
+
+func (p *GRPCProber) ProbeContext(ctx context.Context, target Target) (Result, error) {
+	if target.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, target.Timeout)
+		defer cancel()
+	}
+	t, err := p.transport()
+	if err != nil {
+		return nil, err
+	}
+	defer t.CloseIdleConnections()
+	r := &GRPCResult{Target: target}
+	startAt := time.Now()
+
+	var reg *protoRegistry
+	var method *protoMethodDesc
+	var req []byte
+	if p.opts.Method == "" {
+		r.Method = "grpc.health.v1.Health/Check"
+		req = protoAppendString(nil, 1, p.opts.Service)
+	} else {
+		r.Method = strings.TrimPrefix(p.opts.Method, "/")
+		i := strings.LastIndexByte(r.Method, '/')
+		if i <= 0 {
+			return nil, fmt.Errorf("grpc: invalid method %q", p.opts.Method)
+		}
+		service, name := r.Method[:i], r.Method[i+1:]
+		if reg, err = p.reflect(ctx, t, target, service); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.ReflectionTime = time.Since(startAt)
+		methods, ok := reg.services[service]
+		if !ok {
+			r.Error = fmt.Errorf("grpc: service %s not found", service)
+			return r, nil
+		}
+		for i := range methods {
+			if methods[i].Name == name {
+				method = &methods[i]
+			}
+		}
+		if method == nil {
+			r.Error = fmt.Errorf("grpc: method %s not found", r.Method)
+			return r, nil
+		}
+		if method.ClientStreaming || method.ServerStreaming {
+			return nil, fmt.Errorf("grpc: %s isn't unary", r.Method)
+		}
+		if req, err = reg.encodeJSON(method.Input, []byte(p.opts.Request)); err != nil {
+			return nil, fmt.Errorf("grpc: request: %w", err)
+		}
+	}
+
+	callAt := time.Now()
+	responses, err := p.call(ctx, t, target, r.Method, req)
+	r.CallTime = time.Since(callAt)
+	r.TotalTime = time.Since(startAt)
+	var gerr *grpcError
+	switch {
+	case errors.As(err, &gerr):
+		r.StatusCode, r.Status, r.StatusMessage = gerr.Code, grpcStatusName(gerr.Code), gerr.Message
+		r.Error = err
+		return r, nil
+	case err != nil:
+		r.Error = err
+		return r, nil
+	}
+	r.Status = grpcStatusName(0)
+	if len(responses) != 1 {
+		r.Error = fmt.Errorf("grpc: %d responses to a unary call", len(responses))
+		return r, nil
+	}
+	if method != nil {
+		response, err := reg.decodeJSON(method.Output, responses[0])
+		if err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.Response = string(response)
+		if len(p.opts.Assertions) > 0 {
+			r.FailedAssertions, r.Error = evaluateJSONAssertions(p.opts.Assertions, response)
+		}
+		return r, nil
+	}
+	fields, err := protoParse(responses[0])
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	serving := 0
+	for _, f := range fields {
+		if f.Num == 1 && f.Wire == protoVarint {
+			serving = int(f.Value)
+		}
+	}
+	r.ServingStatus = fmt.Sprintf("STATUS_%d", serving)
+	if serving < len(grpcServingStatuses) {
+		r.ServingStatus = grpcServingStatuses[serving]
+	}
+	if serving != 1 {
+		r.Error = fmt.Errorf("grpc: %s", r.ServingStatus)
+	}
+	return r, nil
+}
+
+const (
+	grpcReflectionV1      = "grpc.reflection.v1.ServerReflection/ServerReflectionInfo"
+	grpcReflectionV1Alpha = "grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"
+)
+
+// reflect loads the descriptors of service and its dependencies with server
+// reflection, trying the v1 service then v1alpha. Dependencies the server
+// doesn't know are skipped.
+func (p *GRPCProber) reflect(ctx context.Context, t *http.Transport, target Target, service string) (*protoRegistry, error) {
+	reflection := grpcReflectionV1
+	call := func(requests [][]byte) ([][]byte, error) {
+		responses, err := p.call(ctx, t, target, reflection, requests...)
+		var gerr *grpcError
+		if errors.As(err, &gerr) && gerr.Code == grpcUnimplemented && reflection == grpcReflectionV1 {
+			reflection = grpcReflectionV1Alpha
+			responses, err = p.call(ctx, t, target, reflection, requests...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("grpc: reflection: %w", err)
+		}
+		return responses, nil
+	}
+
+	reg := newProtoRegistry()
+	requested := make(map[string]bool)
+	// ServerReflectionRequest.file_containing_symbol, then file_by_filename.
+	requests := [][]byte{protoAppendString(nil, 4, service)}
+	for first := true; len(requests) > 0; first = false {
+		responses, err := call(requests)
+		if err != nil {
+			return nil, err
+		}
+		for _, resp := range responses {
+			fields, err := protoParse(resp)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range fields {
+				switch f.Num {
+				case 4: // file_descriptor_response
+					files, err := protoParse(f.Bytes)
+					if err != nil {
+						return nil, err
+					}
+					for _, file := range files {
+						if file.Num != 1 {
+							continue
+						}
+						if err := reg.addFile(file.Bytes); err != nil {
+							return nil, err
+						}
+					}
+				case 7: // error_response
+					if !first {
+						continue
+					}
+					var code int
+					var message string
+					errFields, _ := protoParse(f.Bytes)
+					for _, ef := range errFields {
+						switch ef.Num {
+						case 1:
+							code = int(ef.Value)
+						case 2:
+							message = string(ef.Bytes)
+						}
+					}
+					if code == 5 { // NOT_FOUND
+						return nil, fmt.Errorf("grpc: service %s not found", service)
+					}
+					return nil, fmt.Errorf("grpc: reflection: %s: %s", grpcStatusName(code), message)
+				}
+			}
+		}
+		requests = nil
+		for _, dep := range reg.missingDeps() {
+			if !requested[dep] {
+				requested[dep] = true
+				requests = append(requests, protoAppendString(nil, 3, dep))
+			}
+		}
+	}
+	return reg, nil
+}
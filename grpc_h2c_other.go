@@ -0,0 +1,13 @@
+//go:build !go1.24
+// +build !go1.24
+
+package libprobe
+
+import (
+	"errors"
+	"net/http"
+)
+
+func enableH2C(*http.Transport) error {
+	return errors.New("grpc: plaintext HTTP/2 requires Go 1.24, use TLS")
+}
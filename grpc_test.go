@@ -0,0 +1,195 @@
+package libprobe_test
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func pbUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func pbVarint(b []byte, num int, v uint64) []byte {
+	return pbUvarint(pbUvarint(b, uint64(num)<<3), v)
+}
+
+func pbBytes(b []byte, num int, v []byte) []byte {
+	b = pbUvarint(pbUvarint(b, uint64(num)<<3|2), uint64(len(v)))
+	return append(b, v...)
+}
+
+func pbField(name string, num, typ int, typeName string, repeated bool) []byte {
+	b := pbBytes(nil, 1, []byte(name))
+	b = pbVarint(b, 3, uint64(num))
+	label := uint64(1)
+	if repeated {
+		label = 3
+	}
+	b = pbVarint(b, 4, label)
+	b = pbVarint(b, 5, uint64(typ))
+	if typeName != "" {
+		b = pbBytes(b, 6, []byte(typeName))
+	}
+	return b
+}
+
+// echoDescriptor is the FileDescriptorProto of:
+//
+//	package test;
+//	enum Kind { NONE = 0; LOUD = 1; }
+//	message EchoMessage {
+//	  string text = 1;
+//	  int64 count = 2;
+//	  repeated int32 nums = 3;
+//	  Kind kind = 4;
+//	  map<string, int32> scores = 5;
+//	  EchoMessage child = 6;
+//	}
+//	service Echo { rpc Echo(EchoMessage) returns (EchoMessage); }
+func echoDescriptor() []byte {
+	entry := pbBytes(nil, 1, []byte("ScoresEntry"))
+	entry = pbBytes(entry, 2, pbField("key", 1, 9, "", false))
+	entry = pbBytes(entry, 2, pbField("value", 2, 5, "", false))
+	entry = pbBytes(entry, 7, pbVarint(nil, 7, 1))
+
+	msg := pbBytes(nil, 1, []byte("EchoMessage"))
+	msg = pbBytes(msg, 2, pbField("text", 1, 9, "", false))
+	msg = pbBytes(msg, 2, pbField("count", 2, 3, "", false))
+	msg = pbBytes(msg, 2, pbField("nums", 3, 5, "", true))
+	msg = pbBytes(msg, 2, pbField("kind", 4, 14, ".test.Kind", false))
+	msg = pbBytes(msg, 2, pbField("scores", 5, 11, ".test.EchoMessage.ScoresEntry", true))
+	msg = pbBytes(msg, 2, pbField("child", 6, 11, ".test.EchoMessage", false))
+	msg = pbBytes(msg, 3, entry)
+
+	enum := pbBytes(nil, 1, []byte("Kind"))
+	enum = pbBytes(enum, 2, pbVarint(pbBytes(nil, 1, []byte("NONE")), 2, 0))
+	enum = pbBytes(enum, 2, pbVarint(pbBytes(nil, 1, []byte("LOUD")), 2, 1))
+
+	method := pbBytes(nil, 1, []byte("Echo"))
+	method = pbBytes(method, 2, []byte(".test.EchoMessage"))
+	method = pbBytes(method, 3, []byte(".test.EchoMessage"))
+	service := pbBytes(pbBytes(nil, 1, []byte("Echo")), 2, method)
+
+	file := pbBytes(nil, 1, []byte("echo.proto"))
+	file = pbBytes(file, 2, []byte("test"))
+	file = pbBytes(file, 4, msg)
+	file = pbBytes(file, 5, enum)
+	return pbBytes(file, 6, service)
+}
+
+func grpcFrames(msgs ...[]byte) []byte {
+	var b []byte
+	for _, msg := range msgs {
+		head := make([]byte, 5)
+		binary.BigEndian.PutUint32(head[1:], uint32(len(msg)))
+		b = append(append(b, head...), msg...)
+	}
+	return b
+}
+
+// serveGRPC runs a gRPC server with the health, v1alpha reflection and Echo
+// services.
+func serveGRPC(t *testing.T) (string, *tls.Config) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		status, message := "0", ""
+		var reply []byte
+		switch r.URL.Path {
+		case "/grpc.health.v1.Health/Check":
+			service := string(body[7:])
+			switch service {
+			case "":
+				reply = pbVarint(nil, 1, 1)
+			case "down":
+				reply = pbVarint(nil, 1, 2)
+			default:
+				status, message = "5", "unknown service "+service
+			}
+		case "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo":
+			if string(body[7:]) == "test.Echo" {
+				reply = pbBytes(nil, 4, pbBytes(nil, 1, echoDescriptor()))
+			} else {
+				reply = pbBytes(nil, 7, pbBytes(pbVarint(nil, 1, 5), 2, []byte("symbol not found")))
+			}
+		case "/test.Echo/Echo":
+			reply = body[5:]
+		default:
+			status, message = "12", "unknown method"
+		}
+		if reply != nil {
+			w.Write(grpcFrames(reply))
+		}
+		w.Header().Set("Grpc-Status", status)
+		w.Header().Set("Grpc-Message", message)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	config := server.Client().Transport.(*http.Transport).TLSClientConfig
+	return server.Listener.Addr().String(), config
+}
+
+func TestGRPCProberHealth(t *testing.T) {
+	address, config := serveGRPC(t)
+	probe := func(service string) *libprobe.GRPCResult {
+		prober := libprobe.NewGRPCProber(libprobe.GRPCProberOptions{TLS: true, TLSConfig: config, Service: service})
+		r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		return r.(*libprobe.GRPCResult)
+	}
+
+	res := probe("")
+	require.NoError(t, res.Error)
+	require.Equal(t, "OK", res.Status)
+	require.Equal(t, "SERVING", res.ServingStatus)
+
+	res = probe("down")
+	require.Error(t, res.Error)
+	require.Equal(t, "NOT_SERVING", res.ServingStatus)
+
+	res = probe("other")
+	require.Error(t, res.Error)
+	require.Equal(t, 5, res.StatusCode)
+	require.Equal(t, "NOT_FOUND", res.Status)
+	require.Equal(t, "unknown service other", res.StatusMessage)
+}
+
+func TestGRPCProberMethod(t *testing.T) {
+	address, config := serveGRPC(t)
+	prober := libprobe.NewGRPCProber(libprobe.GRPCProberOptions{
+		TLS:       true,
+		TLSConfig: config,
+		Method:    "test.Echo/Echo",
+		Request:   `{"text": "hi", "count": 12345678901, "nums": [1, -2], "kind": "LOUD", "scores": {"a": 3}, "child": {"text": "child", "kind": 0}}`,
+		Assertions: []*libprobe.JSONAssertion{
+			libprobe.MustCompileJSONAssertion(`$.kind == "LOUD" && $.nums[1] < 0`),
+		},
+	})
+	r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.GRPCResult)
+	require.NoError(t, res.Error)
+	require.JSONEq(t, `{"text": "hi", "count": "12345678901", "nums": [1, -2], "kind": "LOUD", "scores": {"a": 3}, "child": {"text": "child", "kind": "NONE"}}`, res.Response)
+
+	prober = libprobe.NewGRPCProber(libprobe.GRPCProberOptions{TLS: true, TLSConfig: config, Method: "test.Echo/Missing"})
+	r, err = prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.EqualError(t, r.(*libprobe.GRPCResult).Error, "grpc: method test.Echo/Missing not found")
+
+	prober = libprobe.NewGRPCProber(libprobe.GRPCProberOptions{TLS: true, TLSConfig: config, Method: "test.Other/Echo"})
+	r, err = prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.EqualError(t, r.(*libprobe.GRPCResult).Error, "grpc: service test.Other not found")
+}
@@ -0,0 +1,247 @@
+package libprobe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const KindGTP = "GTP"
+
+// GTPVersion selects the GTP flavour of echo requests.
+type GTPVersion int
+
+const (
+	// GTPv2C sends GTPv2-C echoes to port 2123, as between MME, SGW and
+	// PGW.
+	GTPv2C GTPVersion = iota
+	// GTPv1C sends GTPv1-C echoes to port 2123, as between SGSN and GGSN.
+	GTPv1C
+	// GTPv1U sends GTP-U echoes to port 2152, as on the user plane.
+	GTPv1U
+)
+
+func (v GTPVersion) String() string {
+	switch v {
+	case GTPv2C:
+		return "GTPv2-C"
+	case GTPv1C:
+		return "GTPv1-C"
+	case GTPv1U:
+		return "GTPv1-U"
+	}
+	return fmt.Sprintf("GTPVersion(%d)", int(v))
+}
+
+const (
+	gtpEchoRequest  = 1
+	gtpEchoResponse = 2
+)
+
+// GTPProberOptions configures a GTPProber.
+type GTPProberOptions struct {
+	Version GTPVersion
+}
+
+type GTPResult struct {
+	Target
+	Error error
+
+	Version     string
+	PacketsSent int
+	PacketsRecv int
+	MinRtt      time.Duration
+	AvgRtt      time.Duration
+	MaxRtt      time.Duration
+	// RestartCounter is the value of the Recovery IE of the last echo
+	// response, -1 when absent.
+	RestartCounter int
+	// Restarted is set when RestartCounter changed since the previous probe
+	// of the same peer by the prober, meaning the peer restarted.
+	Restarted bool
+}
+
+func (r GTPResult) RTT() time.Duration {
+	return r.AvgRtt
+}
+
+func (r GTPResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("Error: %s", r.Error)
+	}
+	s := fmt.Sprintf("%s echo %s: %d sent, %d received, min/avg/max = %v/%v/%v, restart counter %d",
+		r.Version, r.Target.Address, r.PacketsSent, r.PacketsRecv, r.MinRtt, r.AvgRtt, r.MaxRtt, r.RestartCounter)
+	if r.Restarted {
+		s += " (restarted)"
+	}
+	return s
+}
+
+// GTPProber sends Target.Count GTP echo requests to the peer in
+// Target.Address, Target.Interval apart, and waits up to Target.Timeout for
+// each response; both default to one second. It remembers the restart
+// counter of every peer to detect restarts.
+type GTPProber struct {
+	opts GTPProberOptions
+
+	mu       sync.Mutex
+	restarts map[string]int
+}
+
+func NewGTPProber(opts GTPProberOptions) *GTPProber {
+	return &GTPProber{opts: opts, restarts: make(map[string]int)}
+}
+
+func (p *GTPProber) Kind() string {
+	return KindGTP
+}
+
+func (p *GTPProber) echoRequest(seq uint32) []byte {
+	if p.opts.Version == GTPv2C {
+		// Header without TEID, then the mandatory Recovery IE.
+		b := []byte{0x40, gtpEchoRequest, 0, 9, byte(seq >> 16), byte(seq >> 8), byte(seq), 0}
+		return append(b, 3, 0, 1, 0, 0)
+	}
+	// Version 1, GTP, sequence number present.
+	return []byte{0x32, gtpEchoRequest, 0, 4, 0, 0, 0, 0, byte(seq >> 8), byte(seq), 0, 0}
+}
+
+// parseGTPEchoResponse returns the sequence number and restart counter of an
+// echo response of the given version, -1 for a missing counter.
+func parseGTPEchoResponse(b []byte, version GTPVersion) (uint32, int, error) {
+	if len(b) < 8 || b[1] != gtpEchoResponse {
+		return 0, 0, errors.New("gtp: not an echo response")
+	}
+	var seq uint32
+	var ies []byte
+	if version == GTPv2C {
+		if b[0]>>5 != 2 {
+			return 0, 0, errors.New("gtp: not a GTPv2 message")
+		}
+		off := 4
+		if b[0]&0x08 != 0 { // TEID present
+			off = 8
+		}
+		if len(b) < off+4 {
+			return 0, 0, errors.New("gtp: truncated message")
+		}
+		seq = uint32(b[off])<<16 | uint32(b[off+1])<<8 | uint32(b[off+2])
+		ies = b[off+4:]
+		for len(ies) >= 4 {
+			n := int(binary.BigEndian.Uint16(ies[1:3]))
+			if len(ies) < 4+n {
+				break
+			}
+			if ies[0] == 3 && n >= 1 {
+				return seq, int(ies[4]), nil
+			}
+			ies = ies[4+n:]
+		}
+		return seq, -1, nil
+	}
+	if b[0]>>5 != 1 || b[0]&0x07 == 0 || len(b) < 12 {
+		return 0, 0, errors.New("gtp: not a GTPv1 message with a sequence number")
+	}
+	seq = uint32(binary.BigEndian.Uint16(b[8:10]))
+	ies = b[12:]
+	// Skip extension headers, each a multiple of 4 bytes long.
+	for next := b[11]; next != 0 && len(ies) > 0; {
+		n := int(ies[0]) * 4
+		if n == 0 || len(ies) < n {
+			return 0, 0, errors.New("gtp: truncated extension header")
+		}
+		next = ies[n-1]
+		ies = ies[n:]
+	}
+	if len(ies) >= 2 && ies[0] == 14 {
+		return seq, int(ies[1]), nil
+	}
+	return seq, -1, nil
+}
+
+func (p *GTPProber) Probe(target Target) (Result, error) {
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "2123"
+		if p.opts.Version == GTPv1U {
+			port = "2152"
+		}
+		address = net.JoinHostPort(address, port)
+	}
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	interval := target.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	conn, err := dialTimeout(target.meter, "udp", address, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	r := &GTPResult{Target: target, Version: p.opts.Version.String(), RestartCounter: -1}
+	seqMask := uint32(0xffff)
+	if p.opts.Version == GTPv2C {
+		seqMask = 0xffffff
+	}
+	seqBase := uint32(time.Now().UnixNano())
+	var total time.Duration
+	buf := make([]byte, 1500)
+	for i := 0; i < target.GetCount(); i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		seq := (seqBase + uint32(i)) & seqMask
+		sentAt := time.Now()
+		if _, err := conn.Write(p.echoRequest(seq)); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.PacketsSent++
+		if err := conn.SetReadDeadline(sentAt.Add(timeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			got, counter, err := parseGTPEchoResponse(buf[:n], p.opts.Version)
+			if err != nil || got != seq {
+				continue
+			}
+			rtt := time.Since(sentAt)
+			r.PacketsRecv++
+			total += rtt
+			if r.MinRtt == 0 || rtt < r.MinRtt {
+				r.MinRtt = rtt
+			}
+			if rtt > r.MaxRtt {
+				r.MaxRtt = rtt
+			}
+			if counter >= 0 {
+				r.RestartCounter = counter
+			}
+			break
+		}
+	}
+	if r.PacketsRecv == 0 {
+		r.Error = fmt.Errorf("gtp: no echo response from %s", address)
+		return r, nil
+	}
+	r.AvgRtt = total / time.Duration(r.PacketsRecv)
+	if r.RestartCounter >= 0 {
+		p.mu.Lock()
+		last, ok := p.restarts[address]
+		p.restarts[address] = r.RestartCounter
+		p.mu.Unlock()
+		r.Restarted = ok && last != r.RestartCounter
+	}
+	return r, nil
+}
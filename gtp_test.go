@@ -0,0 +1,62 @@
+package libprobe_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveGTPEcho answers GTPv1 and GTPv2 echo requests with the restart
+// counter returned by restart.
+func serveGTPEcho(t *testing.T, restart func() byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 8 || buf[1] != 1 {
+				continue
+			}
+			var resp []byte
+			switch buf[0] >> 5 {
+			case 1:
+				resp = []byte{0x32, 2, 0, 6, 0, 0, 0, 0, buf[8], buf[9], 0, 0, 14, restart()}
+			case 2:
+				resp = []byte{0x40, 2, 0, 9, buf[4], buf[5], buf[6], 0, 3, 0, 1, 0, restart()}
+			}
+			conn.WriteTo(resp, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestGTPProber(t *testing.T) {
+	counter := int32(7)
+	address := serveGTPEcho(t, func() byte { return byte(atomic.LoadInt32(&counter)) })
+	for _, version := range []libprobe.GTPVersion{libprobe.GTPv2C, libprobe.GTPv1C, libprobe.GTPv1U} {
+		prober := libprobe.NewGTPProber(libprobe.GTPProberOptions{Version: version})
+		r, err := prober.Probe(libprobe.Target{Address: address, Count: 3, Interval: time.Millisecond})
+		require.NoError(t, err)
+		res := r.(*libprobe.GTPResult)
+		require.NoError(t, res.Error, version.String())
+		require.Equal(t, 3, res.PacketsRecv)
+		require.Equal(t, 7, res.RestartCounter)
+		require.False(t, res.Restarted)
+
+		atomic.StoreInt32(&counter, 8)
+		r, err = prober.Probe(libprobe.Target{Address: address})
+		require.NoError(t, err)
+		require.True(t, r.(*libprobe.GTPResult).Restarted, version.String())
+		atomic.StoreInt32(&counter, 7)
+	}
+}
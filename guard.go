@@ -0,0 +1,268 @@
+package libprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrExcluded is wrapped by the errors of probes refused by the guard.
+var ErrExcluded = errors.New("excluded from probing")
+
+// GuardOptions are the exclusions of a Guard.
+type GuardOptions struct {
+	// Prefixes are the never-probed networks, in CIDR notation, or single
+	// addresses.
+	Prefixes []string
+	// Domains are the never-probed domains. A domain excludes its
+	// subdomains too.
+	Domains []string
+	// Audit, if set, is called for every blocked attempt, before the probe
+	// fails. It must not block.
+	Audit func(GuardEvent)
+}
+
+// GuardEvent is a probe attempt blocked by the guard.
+type GuardEvent struct {
+	Time time.Time
+	// Network and Address are the ones dialed, or "ip" and the resolved
+	// address of ICMP and raw IP probes.
+	Network string
+	Address string
+	// Rule is the prefix or domain matched.
+	Rule string
+}
+
+func (e GuardEvent) String() string {
+	return fmt.Sprintf("%s blocked %s %s: excluded by %s", e.Time.Format(time.RFC3339), e.Network, e.Address, e.Rule)
+}
+
+// GuardError is the error of a probe refused by the guard.
+type GuardError struct {
+	Address string
+	Rule    string
+}
+
+func (e *GuardError) Error() string {
+	return fmt.Sprintf("guard: %s %v by %s", e.Address, ErrExcluded, e.Rule)
+}
+
+func (e *GuardError) Unwrap() error {
+	return ErrExcluded
+}
+
+// Guard enforces exclusion lists, such as military ranges or customer
+// opt-outs, inside the library: once installed with SetGuard, every prober
+// checks the host names it dials and the addresses they resolve to right
+// before connecting or sending a packet, and fails with a GuardError when
+// they are excluded. Probes through HTTP proxies are checked by host name
+// only, as the proxy resolves them.
+type Guard struct {
+	audit   func(GuardEvent)
+	blocked uint64
+
+	mu       sync.RWMutex
+	prefixes []*net.IPNet
+	domains  []string
+}
+
+// NewGuard returns a guard with the exclusions of opts.
+func NewGuard(opts GuardOptions) (*Guard, error) {
+	g := &Guard{audit: opts.Audit}
+	if err := g.ExcludePrefixes(opts.Prefixes...); err != nil {
+		return nil, err
+	}
+	g.ExcludeDomains(opts.Domains...)
+	return g, nil
+}
+
+// ExcludePrefixes adds networks, in CIDR notation, or single addresses to
+// the exclusions.
+func (g *Guard) ExcludePrefixes(prefixes ...string) error {
+	nets := make([]*net.IPNet, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if ip := net.ParseIP(prefix); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return fmt.Errorf("guard: invalid prefix %q", prefix)
+		}
+		nets = append(nets, ipnet)
+	}
+	g.mu.Lock()
+	g.prefixes = append(g.prefixes, nets...)
+	g.mu.Unlock()
+	return nil
+}
+
+// ExcludeDomains adds domains, and their subdomains, to the exclusions.
+func (g *Guard) ExcludeDomains(domains ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, domain := range domains {
+		if domain = normalizeDomain(domain); domain != "" {
+			g.domains = append(g.domains, domain)
+		}
+	}
+}
+
+// Blocked returns the number of attempts blocked so far.
+func (g *Guard) Blocked() uint64 {
+	return atomic.LoadUint64(&g.blocked)
+}
+
+func normalizeDomain(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(name, "*."), "."))
+}
+
+// match returns the rule excluding host, a host name or an IP address, or
+// "".
+func (g *Guard) match(host string) string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		for _, ipnet := range g.prefixes {
+			if ipnet.Contains(ip) {
+				return ipnet.String()
+			}
+		}
+		return ""
+	}
+	host = normalizeDomain(host)
+	for _, domain := range g.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return domain
+		}
+	}
+	return ""
+}
+
+// Check returns a GuardError if address, a host name or an IP address,
+// optionally with a port, is excluded. Blocked attempts are audited.
+func (g *Guard) Check(network, address string) error {
+	if g == nil {
+		return nil
+	}
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	rule := g.match(host)
+	if rule == "" {
+		return nil
+	}
+	atomic.AddUint64(&g.blocked, 1)
+	if g.audit != nil {
+		g.audit(GuardEvent{Time: time.Now(), Network: network, Address: address, Rule: rule})
+	}
+	return &GuardError{Address: address, Rule: rule}
+}
+
+var guard struct {
+	mu sync.RWMutex
+	g  *Guard
+}
+
+// SetGuard installs g as the guard of all probers of the process. A nil
+// guard, the default, allows every address.
+func SetGuard(g *Guard) {
+	guard.mu.Lock()
+	guard.g = g
+	guard.mu.Unlock()
+}
+
+func activeGuard() *Guard {
+	guard.mu.RLock()
+	defer guard.mu.RUnlock()
+	return guard.g
+}
+
+// checkGuard checks address against the active guard.
+func checkGuard(network, address string) error {
+	return activeGuard().Check(network, address)
+}
+
+// guardDialer returns a dialer for address, checking its host name now and
+// the addresses it resolves to before connecting.
+func guardDialer(network, address string, timeout time.Duration) (*net.Dialer, error) {
+	g := activeGuard()
+	if err := g.Check(network, address); err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if g != nil {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			return g.Check(network, address)
+		}
+	}
+	return dialer, nil
+}
+
+// dialTimeout is net.DialTimeout, refusing addresses excluded by the guard,
+// queuing for a slot of the FD pool and counting the traffic of the
+// connection with meter, if not nil.
+func dialTimeout(meter *trafficMeter, network, address string, timeout time.Duration) (net.Conn, error) {
+	dialer, err := guardDialer(network, address, 0)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		dialer.Deadline = time.Now().Add(timeout)
+	}
+	return pooledDial(context.Background(), dialer.Deadline, meter, func() (net.Conn, error) {
+		return dialer.Dial(network, address)
+	})
+}
+
+// dialContext is net.Dialer.DialContext, refusing addresses excluded by the
+// guard, queuing for a slot of the FD pool and counting the traffic of the
+// connection with the meter of ctx.
+func dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer, err := guardDialer(network, address, 0)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	return pooledDial(ctx, deadline, trafficMeterFrom(ctx), func() (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	})
+}
+
+// meteredDial returns dialContext counting the traffic of the connections
+// it dials with meter, for transports dialing on behalf of one probe.
+func meteredDial(meter *trafficMeter) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialContext(withTrafficMeter(ctx, meter), network, address)
+	}
+}
+
+// resolveIPAddr is net.ResolveIPAddr, refusing addresses excluded by the
+// guard.
+func resolveIPAddr(network, address string) (*net.IPAddr, error) {
+	if err := checkGuard(network, address); err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveIPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkGuard(network, addr.String()); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
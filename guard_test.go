@@ -0,0 +1,90 @@
+package libprobe_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuardCheck(t *testing.T) {
+	var events []libprobe.GuardEvent
+	guard, err := libprobe.NewGuard(libprobe.GuardOptions{
+		Prefixes: []string{"10.0.0.0/8", "2001:db8::1"},
+		Domains:  []string{"Example.mil."},
+		Audit:    func(e libprobe.GuardEvent) { events = append(events, e) },
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, guard.Check("tcp", "11.0.0.1:80"))
+	require.NoError(t, guard.Check("tcp", "notexample.mil:80"))
+	require.NoError(t, guard.Check("ip", "2001:db8::2"))
+
+	err = guard.Check("tcp", "10.1.2.3:80")
+	require.True(t, errors.Is(err, libprobe.ErrExcluded))
+	require.EqualError(t, err, "guard: 10.1.2.3:80 excluded from probing by 10.0.0.0/8")
+	require.Error(t, guard.Check("ip", "2001:db8::1"))
+	require.Error(t, guard.Check("udp", "[2001:db8::1%eth0]:53"))
+	require.Error(t, guard.Check("tcp", "example.mil"))
+	require.Error(t, guard.Check("tcp", "www.EXAMPLE.mil.:443"))
+
+	guard.ExcludeDomains("opted-out.example")
+	require.NoError(t, guard.ExcludePrefixes("192.0.2.0/24"))
+	require.Error(t, guard.Check("tcp", "api.opted-out.example:443"))
+	require.Error(t, guard.Check("ip", "192.0.2.7"))
+	require.Error(t, guard.ExcludePrefixes("192.0.2.0/33"))
+
+	require.Equal(t, uint64(7), guard.Blocked())
+	require.Len(t, events, 7)
+	require.Equal(t, "tcp", events[0].Network)
+	require.Equal(t, "10.1.2.3:80", events[0].Address)
+	require.Equal(t, "10.0.0.0/8", events[0].Rule)
+	require.True(t, strings.HasSuffix(events[0].String(), "blocked tcp 10.1.2.3:80: excluded by 10.0.0.0/8"))
+}
+
+func TestGuardProbers(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+	var events []libprobe.GuardEvent
+	guard, err := libprobe.NewGuard(libprobe.GuardOptions{
+		Prefixes: []string{"127.0.0.0/8", "::1"},
+		Domains:  []string{"blocked.test"},
+		Audit:    func(e libprobe.GuardEvent) { events = append(events, e) },
+	})
+	require.NoError(t, err)
+	libprobe.SetGuard(guard)
+	defer libprobe.SetGuard(nil)
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	r, err := libprobe.NewTCPProber().Probe(libprobe.Target{Address: "localhost:" + port, Timeout: time.Second})
+	require.NoError(t, err)
+	require.True(t, errors.Is(r.(*libprobe.TCPResult).Error, libprobe.ErrExcluded), "resolved addresses are checked")
+
+	_, err = libprobe.NewHTTPProber().Probe(libprobe.Target{Address: "http://www.blocked.test/", Timeout: time.Second})
+	require.True(t, errors.Is(err, libprobe.ErrExcluded))
+	r, err = libprobe.NewHTTPProber().Probe(libprobe.Target{Address: "http://localhost:" + port + "/", Timeout: time.Second})
+	require.NoError(t, err)
+	require.True(t, errors.Is(r.(*libprobe.HTTPResult).Error, libprobe.ErrExcluded))
+
+	_, err = libprobe.NewICMPProber(false).Probe(libprobe.Target{Address: "127.0.0.1", Timeout: time.Second})
+	require.True(t, errors.Is(err, libprobe.ErrExcluded))
+
+	require.Zero(t, requests)
+	require.True(t, len(events) >= 4)
+
+	libprobe.SetGuard(nil)
+	r, err = libprobe.NewHTTPProber().Probe(libprobe.Target{Address: server.URL, Timeout: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, r.(*libprobe.HTTPResult).Error)
+	require.Equal(t, 1, requests)
+}
@@ -0,0 +1,308 @@
+package libprobe
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheckOptions configures a HealthCheck. Thresholds follow Kubernetes
+// probe semantics.
+type HealthCheckOptions struct {
+	Name   string
+	Prober Prober
+	Target Target
+	// Period between probes. Default: 10s.
+	Period time.Duration
+	// SuccessThreshold is the number of consecutive successes for an
+	// unhealthy check to become healthy. Default: 1.
+	SuccessThreshold int
+	// FailureThreshold is the number of consecutive failures for a healthy
+	// check to become unhealthy. Default: 3.
+	FailureThreshold int
+	// InitiallyHealthy reports the check healthy until the first failures
+	// (liveness semantics). By default a check is unhealthy until it passed
+	// SuccessThreshold times (readiness semantics).
+	InitiallyHealthy bool
+}
+
+// HealthState is a snapshot of a health check.
+type HealthState struct {
+	Name                 string
+	Healthy              bool
+	LastResult           Result
+	LastError            error
+	ConsecutiveSuccesses int
+	ConsecutiveFailures  int
+	LastProbeAt          time.Time
+	LastTransitionAt     time.Time
+}
+
+// HealthEventHandler is notified about health check changes, in the spirit of
+// a Kubernetes informer's ResourceEventHandler. OnUpdate is called after
+// every probe, OnTransition only when Healthy flips.
+type HealthEventHandler interface {
+	OnUpdate(old, new HealthState)
+	OnTransition(old, new HealthState)
+}
+
+// HealthEventHandlerFuncs adapts functions to HealthEventHandler; nil
+// functions are skipped.
+type HealthEventHandlerFuncs struct {
+	UpdateFunc     func(old, new HealthState)
+	TransitionFunc func(old, new HealthState)
+}
+
+func (f HealthEventHandlerFuncs) OnUpdate(old, new HealthState) {
+	if f.UpdateFunc != nil {
+		f.UpdateFunc(old, new)
+	}
+}
+
+func (f HealthEventHandlerFuncs) OnTransition(old, new HealthState) {
+	if f.TransitionFunc != nil {
+		f.TransitionFunc(old, new)
+	}
+}
+
+// HealthCheck runs a probe periodically and tracks whether its target is
+// healthy. It implements http.Handler, answering 200 when healthy and 503
+// otherwise, so it can back readiness and liveness endpoints directly.
+type HealthCheck struct {
+	opts HealthCheckOptions
+
+	mu       sync.RWMutex
+	state    HealthState
+	handlers []HealthEventHandler
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewHealthCheck(opts HealthCheckOptions) *HealthCheck {
+	if opts.Period <= 0 {
+		opts.Period = 10 * time.Second
+	}
+	if opts.SuccessThreshold <= 0 {
+		opts.SuccessThreshold = 1
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 3
+	}
+	if opts.Name == "" {
+		opts.Name = opts.Target.Address
+	}
+	return &HealthCheck{
+		opts: opts,
+		state: HealthState{
+			Name:    opts.Name,
+			Healthy: opts.InitiallyHealthy,
+		},
+	}
+}
+
+func (c *HealthCheck) Name() string {
+	return c.opts.Name
+}
+
+// AddEventHandler registers a handler for subsequent state changes.
+func (c *HealthCheck) AddEventHandler(h HealthEventHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers = append(c.handlers, h)
+}
+
+// Start probes immediately and then every Period until Stop is called.
+func (c *HealthCheck) Start() {
+	c.mu.Lock()
+	if c.stop != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	stop, done := c.stop, c.done
+	c.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(c.opts.Period)
+		defer ticker.Stop()
+		for {
+			c.Observe(safeProbe(c.opts.Prober, c.opts.Target))
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops probing and waits for an in-flight probe to finish.
+func (c *HealthCheck) Stop() {
+	c.mu.Lock()
+	stop, done := c.stop, c.done
+	c.stop, c.done = nil, nil
+	c.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Observe feeds a probe outcome into the check. It's called by Start, and can
+// be used directly when probes are scheduled elsewhere.
+func (c *HealthCheck) Observe(r Result, err error) {
+	c.mu.Lock()
+	old := c.state
+	s := c.state
+	s.LastResult = r
+	s.LastError = err
+	s.LastProbeAt = time.Now()
+	if err == nil && resultOK(r) {
+		s.ConsecutiveSuccesses++
+		s.ConsecutiveFailures = 0
+		if !s.Healthy && s.ConsecutiveSuccesses >= c.opts.SuccessThreshold {
+			s.Healthy = true
+			s.LastTransitionAt = s.LastProbeAt
+		}
+	} else {
+		s.ConsecutiveFailures++
+		s.ConsecutiveSuccesses = 0
+		if s.Healthy && s.ConsecutiveFailures >= c.opts.FailureThreshold {
+			s.Healthy = false
+			s.LastTransitionAt = s.LastProbeAt
+		}
+	}
+	c.state = s
+	handlers := c.handlers
+	c.mu.Unlock()
+
+	for _, h := range handlers {
+		h.OnUpdate(old, s)
+		if old.Healthy != s.Healthy {
+			h.OnTransition(old, s)
+		}
+	}
+}
+
+func (c *HealthCheck) State() HealthState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state
+}
+
+type healthStatus struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Result  string `json:"result,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (s HealthState) status() healthStatus {
+	st := healthStatus{Name: s.Name, Healthy: s.Healthy}
+	if s.LastResult != nil {
+		st.Result = strings.TrimSpace(s.LastResult.String())
+	}
+	if s.LastError != nil {
+		st.Error = s.LastError.Error()
+	}
+	return st
+}
+
+func writeHealth(w http.ResponseWriter, healthy bool, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (c *HealthCheck) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	s := c.State()
+	writeHealth(w, s.Healthy, s.status())
+}
+
+// HealthChecks groups health checks behind a single handler. The group is
+// healthy when all its checks are; a request for "<prefix>/<name>" reports
+// only the named check.
+type HealthChecks struct {
+	mu     sync.RWMutex
+	checks map[string]*HealthCheck
+}
+
+func NewHealthChecks(checks ...*HealthCheck) *HealthChecks {
+	g := &HealthChecks{checks: make(map[string]*HealthCheck)}
+	for _, c := range checks {
+		g.Add(c)
+	}
+	return g
+}
+
+func (g *HealthChecks) Add(c *HealthCheck) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.checks[c.Name()] = c
+}
+
+func (g *HealthChecks) Remove(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.checks, name)
+}
+
+func (g *HealthChecks) Get(name string) (*HealthCheck, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	c, ok := g.checks[name]
+	return c, ok
+}
+
+// List returns the states of all checks ordered by name.
+func (g *HealthChecks) List() []HealthState {
+	g.mu.RLock()
+	states := make([]HealthState, 0, len(g.checks))
+	for _, c := range g.checks {
+		states = append(states, c.State())
+	}
+	g.mu.RUnlock()
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+func (g *HealthChecks) Start() {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, c := range g.checks {
+		c.Start()
+	}
+}
+
+func (g *HealthChecks) Stop() {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, c := range g.checks {
+		c.Stop()
+	}
+}
+
+func (g *HealthChecks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if i := strings.LastIndex(r.URL.Path, "/"); i >= 0 && i < len(r.URL.Path)-1 {
+		if c, ok := g.Get(r.URL.Path[i+1:]); ok {
+			c.ServeHTTP(w, r)
+			return
+		}
+	}
+	healthy := true
+	var statuses []healthStatus
+	for _, s := range g.List() {
+		healthy = healthy && s.Healthy
+		statuses = append(statuses, s.status())
+	}
+	writeHealth(w, healthy, statuses)
+}
@@ -0,0 +1,58 @@
+package libprobe_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckThresholds(t *testing.T) {
+	check := libprobe.NewHealthCheck(libprobe.HealthCheckOptions{
+		Name:             "db",
+		SuccessThreshold: 2,
+		FailureThreshold: 2,
+	})
+	var transitions []bool
+	check.AddEventHandler(libprobe.HealthEventHandlerFuncs{
+		TransitionFunc: func(_, new libprobe.HealthState) {
+			transitions = append(transitions, new.Healthy)
+		},
+	})
+	ok := &libprobe.TCPResult{}
+	failed := &libprobe.TCPResult{Error: errors.New("refused")}
+
+	check.Observe(ok, nil)
+	require.False(t, check.State().Healthy)
+	check.Observe(ok, nil)
+	require.True(t, check.State().Healthy)
+	check.Observe(failed, nil)
+	require.True(t, check.State().Healthy)
+	check.Observe(nil, errors.New("probe failed"))
+	require.False(t, check.State().Healthy)
+	require.Equal(t, []bool{true, false}, transitions)
+}
+
+func TestHealthChecksHandler(t *testing.T) {
+	up := libprobe.NewHealthCheck(libprobe.HealthCheckOptions{Name: "up"})
+	up.Observe(&libprobe.TCPResult{}, nil)
+	down := libprobe.NewHealthCheck(libprobe.HealthCheckOptions{Name: "down"})
+	group := libprobe.NewHealthChecks(up, down)
+
+	rec := httptest.NewRecorder()
+	group.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	rec = httptest.NewRecorder()
+	group.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz/up", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	group.Remove("down")
+	rec = httptest.NewRecorder()
+	group.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
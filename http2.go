@@ -0,0 +1,411 @@
+package libprobe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const KindHTTP2 = "HTTP2"
+
+// http2WindowSize is the flow control window advertised for streams.
+const http2WindowSize = 4 << 20
+
+// errHTTP2NoStreams fails the streams of servers allowing none.
+var errHTTP2NoStreams = errors.New("http2: the server allows no concurrent streams")
+
+// HTTP2ProberOptions configures an HTTP2Prober.
+type HTTP2ProberOptions struct {
+	// Streams is the number of concurrent GET requests sent. Default: 10.
+	Streams int
+	// TLSConfig configures the handshake with https:// targets.
+	TLSConfig *tls.Config
+	// Header is sent with every request.
+	Header http.Header
+}
+
+// HTTP2Stream is a request of an HTTP2Prober.
+type HTTP2Stream struct {
+	ID         uint32
+	Error      error
+	StatusCode int
+	Size       int
+	// Start is the time from opening the first stream to opening this one,
+	// later than the others when held back by the server's
+	// SETTINGS_MAX_CONCURRENT_STREAMS. TTFB is the time from opening the
+	// stream to its response headers, Duration to its end.
+	Start    time.Duration
+	TTFB     time.Duration
+	Duration time.Duration
+}
+
+// HTTP2Result describes concurrent requests multiplexed over one HTTP/2
+// connection.
+type HTTP2Result struct {
+	Target
+	// Error is set when the connection failed. Failed streams are counted
+	// in Failed instead, those refused by the server in RefusedStreams
+	// too.
+	Error error
+
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	// Settings are the SETTINGS of the server, keyed by name, e.g.
+	// "MAX_CONCURRENT_STREAMS". Settings left to their default are absent.
+	Settings       map[string]uint32
+	Streams        []HTTP2Stream
+	Failed         int
+	RefusedStreams int
+	// MultiplexTime is the time from opening the first stream to the end of
+	// the last one. HeadOfLineDelay is the Duration of the slowest stream
+	// minus that of the fastest: with identical requests, a large delay
+	// shows streams waiting for each other, as when a proxy serializes
+	// them onto one upstream connection.
+	MultiplexTime   time.Duration
+	HeadOfLineDelay time.Duration
+	TotalTime       time.Duration
+}
+
+func (r HTTP2Result) RTT() time.Duration {
+	return r.MultiplexTime
+}
+
+func (r HTTP2Result) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	s := fmt.Sprintf("-> %s %d streams, %d failed, %d refused, multiplex=%v head-of-line=%v",
+		r.Target.Address, len(r.Streams), r.Failed, r.RefusedStreams, r.MultiplexTime, r.HeadOfLineDelay)
+	for _, st := range r.Streams {
+		status := strconv.Itoa(st.StatusCode)
+		if st.Error != nil {
+			status = "ERR"
+		}
+		s += fmt.Sprintf("\n%5d %10v %10v %10v %3s", st.ID, st.Start.Round(time.Microsecond), st.TTFB.Round(time.Microsecond), st.Duration.Round(time.Microsecond), status)
+	}
+	return s
+}
+
+// HTTP2Prober opens one HTTP/2 connection to Target.Address, an http:// or
+// https:// URL, and sends concurrent GET requests for it on as many
+// streams, within the server's limit of concurrent streams. Plain http://
+// targets are spoken to with prior knowledge, without an upgrade.
+type HTTP2Prober struct {
+	opts HTTP2ProberOptions
+}
+
+func NewHTTP2Prober(opts HTTP2ProberOptions) *HTTP2Prober {
+	if opts.Streams <= 0 {
+		opts.Streams = 10
+	}
+	return &HTTP2Prober{opts: opts}
+}
+
+func (p *HTTP2Prober) Kind() string {
+	return KindHTTP2
+}
+
+func (p *HTTP2Prober) Probe(target Target) (Result, error) {
+	r := &HTTP2Result{Target: target}
+	u, err := url.Parse(target.Address)
+	if err != nil {
+		return nil, err
+	}
+	address := u.Host
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return nil, fmt.Errorf("http2: unsupported scheme %q", u.Scheme)
+	case u.Port() == "" && u.Scheme == "http":
+		address = net.JoinHostPort(u.Hostname(), "80")
+	case u.Port() == "":
+		address = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+	if u.Scheme == "https" {
+		config := mailTLSConfig(p.opts.TLSConfig, address)
+		config.NextProtos = []string{http2.NextProtoTLS}
+		tlsConn := tls.Client(conn, config)
+		handshakeAt := time.Now()
+		err := tlsConn.Handshake()
+		r.TLSHandshakeTime = time.Since(handshakeAt)
+		if err != nil {
+			r.Error = err
+			return r, nil
+		}
+		if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+			r.Error = fmt.Errorf("http2: the server negotiated %q instead of h2", proto)
+			return r, nil
+		}
+		conn = tlsConn
+	}
+	r.Error = p.multiplex(r, conn, u, target)
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+// http2Client speaks HTTP/2 on a connection, one frame at a time.
+type http2Client struct {
+	w  *bufio.Writer
+	fr *http2.Framer
+
+	headers bytes.Buffer
+	enc     *hpack.Encoder
+}
+
+// writeRequest opens stream id with a GET request.
+func (c *http2Client) writeRequest(id uint32, u *url.URL, header http.Header) error {
+	c.headers.Reset()
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: http.MethodGet},
+		{Name: ":scheme", Value: u.Scheme},
+		{Name: ":authority", Value: u.Host},
+		{Name: ":path", Value: u.RequestURI()},
+	}
+	for name, values := range header {
+		for _, v := range values {
+			fields = append(fields, hpack.HeaderField{Name: strings.ToLower(name), Value: v})
+		}
+	}
+	for _, f := range fields {
+		if err := c.enc.WriteField(f); err != nil {
+			return err
+		}
+	}
+	return c.fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      id,
+		BlockFragment: c.headers.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+}
+
+// multiplex runs the streams of a probe on conn.
+func (p *HTTP2Prober) multiplex(r *HTTP2Result, conn net.Conn, u *url.URL, target Target) error {
+	c := &http2Client{w: bufio.NewWriter(conn)}
+	c.fr = http2.NewFramer(c.w, bufio.NewReader(conn))
+	c.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	c.enc = hpack.NewEncoder(&c.headers)
+
+	header := p.opts.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	setDefaultUserAgent(header)
+	setCorrelationHeaders(header, target)
+
+	if _, err := io.WriteString(c.w, http2.ClientPreface); err != nil {
+		return err
+	}
+	if err := c.fr.WriteSettings(
+		http2.Setting{ID: http2.SettingEnablePush, Val: 0},
+		http2.Setting{ID: http2.SettingInitialWindowSize, Val: http2WindowSize},
+	); err != nil {
+		return err
+	}
+	if err := c.fr.WriteWindowUpdate(0, http2WindowSize); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	// The server's SETTINGS come first, before the streams are opened.
+	f, err := c.fr.ReadFrame()
+	if err != nil {
+		return err
+	}
+	settings, ok := f.(*http2.SettingsFrame)
+	if !ok || settings.IsAck() {
+		return fmt.Errorf("http2: expected SETTINGS, got %v", f.Header().Type)
+	}
+	maxStreams := p.opts.Streams
+	r.Settings = make(map[string]uint32)
+	applySettings := func(settings *http2.SettingsFrame) error {
+		_ = settings.ForeachSetting(func(s http2.Setting) error {
+			r.Settings[s.ID.String()] = s.Val
+			if s.ID == http2.SettingMaxConcurrentStreams {
+				maxStreams = min(int(s.Val), p.opts.Streams)
+			}
+			return nil
+		})
+		return c.fr.WriteSettingsAck()
+	}
+	if err := applySettings(settings); err != nil {
+		return err
+	}
+
+	r.Streams = make([]HTTP2Stream, p.opts.Streams)
+	opened := make([]time.Time, p.opts.Streams)
+	var firstAt time.Time
+	next, open, done := 0, 0, 0
+	var goAway error
+	// stream returns the index of the stream with id, -1 for unknown ids.
+	stream := func(id uint32) int {
+		i := int(id-1) / 2
+		if id%2 == 0 || i >= next {
+			return -1
+		}
+		return i
+	}
+	finish := func(i int, err error) {
+		st := &r.Streams[i]
+		if !opened[i].IsZero() {
+			st.Duration = time.Since(opened[i])
+			opened[i] = time.Time{}
+			open--
+		}
+		if err == nil && st.StatusCode >= 400 {
+			err = fmt.Errorf("HTTP status %d", st.StatusCode)
+		}
+		st.Error = err
+		done++
+	}
+	for done < p.opts.Streams {
+		for goAway == nil && next < p.opts.Streams && open < maxStreams {
+			id := uint32(2*next + 1)
+			if err := c.writeRequest(id, u, header); err != nil {
+				return err
+			}
+			opened[next] = time.Now()
+			if firstAt.IsZero() {
+				firstAt = opened[next]
+			}
+			r.Streams[next] = HTTP2Stream{ID: id, Start: opened[next].Sub(firstAt)}
+			next++
+			open++
+		}
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		if open == 0 {
+			// The remaining streams can't be opened.
+			err := goAway
+			if err == nil {
+				err = errHTTP2NoStreams
+			}
+			for ; next < p.opts.Streams; next++ {
+				r.Streams[next] = HTTP2Stream{ID: uint32(2*next + 1)}
+				finish(next, err)
+			}
+			break
+		}
+
+		f, err := c.fr.ReadFrame()
+		if err != nil {
+			return err
+		}
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			i := stream(f.StreamID)
+			if i < 0 || opened[i].IsZero() {
+				continue
+			}
+			// Informational responses precede the final one, trailers follow
+			// it.
+			if status, err := strconv.Atoi(f.PseudoValue("status")); err == nil && r.Streams[i].StatusCode < 200 {
+				r.Streams[i].StatusCode = status
+				r.Streams[i].TTFB = time.Since(opened[i])
+			}
+			if f.StreamEnded() {
+				finish(i, nil)
+			}
+		case *http2.DataFrame:
+			// Padding counts towards flow control too.
+			if n := f.Length; n > 0 {
+				if err := c.fr.WriteWindowUpdate(0, n); err != nil {
+					return err
+				}
+				if !f.StreamEnded() {
+					if err := c.fr.WriteWindowUpdate(f.StreamID, n); err != nil {
+						return err
+					}
+				}
+			}
+			i := stream(f.StreamID)
+			if i < 0 || opened[i].IsZero() {
+				continue
+			}
+			r.Streams[i].Size += len(f.Data())
+			if f.StreamEnded() {
+				finish(i, nil)
+			}
+		case *http2.RSTStreamFrame:
+			i := stream(f.StreamID)
+			if i < 0 || opened[i].IsZero() {
+				continue
+			}
+			if f.ErrCode == http2.ErrCodeRefusedStream {
+				r.RefusedStreams++
+			}
+			finish(i, fmt.Errorf("http2: stream reset: %v", f.ErrCode))
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				if err := applySettings(f); err != nil {
+					return err
+				}
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				if err := c.fr.WritePing(true, f.Data); err != nil {
+					return err
+				}
+			}
+		case *http2.GoAwayFrame:
+			goAway = fmt.Errorf("http2: connection closed by the server: %v", f.ErrCode)
+			// Streams after the last one processed by the server were
+			// not, and won't be.
+			for i := range opened {
+				if !opened[i].IsZero() && r.Streams[i].ID > f.LastStreamID {
+					finish(i, goAway)
+				}
+			}
+		}
+	}
+	// The server opened no streams for the client to process.
+	_ = c.fr.WriteGoAway(0, http2.ErrCodeNo, nil)
+	_ = c.w.Flush()
+
+	fastest, slowest := time.Duration(-1), time.Duration(0)
+	for _, st := range r.Streams {
+		if st.Error != nil {
+			r.Failed++
+			continue
+		}
+		if end := st.Start + st.Duration; end > r.MultiplexTime {
+			r.MultiplexTime = end
+		}
+		if fastest < 0 || st.Duration < fastest {
+			fastest = st.Duration
+		}
+		if st.Duration > slowest {
+			slowest = st.Duration
+		}
+	}
+	if fastest >= 0 {
+		r.HeadOfLineDelay = slowest - fastest
+	}
+	return nil
+}
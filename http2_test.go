@@ -0,0 +1,56 @@
+package libprobe_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestHTTP2Prober(t *testing.T) {
+	var inFlight, maxInFlight int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(strings.Repeat("x", 100<<10)))
+	}))
+	require.NoError(t, http2.ConfigureServer(srv.Config, &http2.Server{MaxConcurrentStreams: 3}))
+	srv.TLS = srv.Config.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	r, err := libprobe.NewHTTP2Prober(libprobe.HTTP2ProberOptions{
+		Streams:   7,
+		TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+	}).Probe(libprobe.Target{Address: srv.URL + "/", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.HTTP2Result)
+	require.NoError(t, res.Error)
+	require.Equal(t, uint32(3), res.Settings["MAX_CONCURRENT_STREAMS"])
+	require.Len(t, res.Streams, 7)
+	require.Zero(t, res.Failed)
+	for i, st := range res.Streams {
+		require.Equal(t, uint32(2*i+1), st.ID)
+		require.Equal(t, http.StatusOK, st.StatusCode)
+		require.Equal(t, 100<<10, st.Size)
+	}
+	require.LessOrEqual(t, atomic.LoadInt64(&maxInFlight), int64(3))
+	// Streams beyond the limit wait for the first ones to end.
+	require.GreaterOrEqual(t, res.Streams[3].Start, 20*time.Millisecond)
+	require.GreaterOrEqual(t, res.MultiplexTime, 60*time.Millisecond)
+	require.Equal(t, res.MultiplexTime, res.RTT())
+}
@@ -0,0 +1,97 @@
+package libprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Transport is the transport of a probe over HTTP/3. It dials QUIC
+// connections itself, so that they are checked by the guard, accounted by
+// the FD pool and resolved with lookup, and reports their phases to the
+// request's httptrace.ClientTrace: the QUIC handshake, which includes the
+// TLS one, is both the connection and the TLS handshake.
+type http3Transport struct {
+	*http3.Transport
+	lookup func(ctx context.Context, host string) ([]net.IP, error)
+
+	mu    sync.Mutex
+	conns []net.PacketConn
+}
+
+func newHTTP3Transport(tlsConfig *tls.Config, lookup func(context.Context, string) ([]net.IP, error)) *http3Transport {
+	t := &http3Transport{lookup: lookup}
+	t.Transport = &http3.Transport{TLSClientConfig: tlsConfig, Dial: t.dial}
+	return t
+}
+
+func (t *http3Transport) dial(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkGuard("udp", addr); err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addrs, err := t.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ip = addrs[0]
+	}
+	udpAddr := &net.UDPAddr{IP: ip, Port: portNum}
+	if err := checkGuard("udp", udpAddr.String()); err != nil {
+		return nil, err
+	}
+	conn, err := listenUDP(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.conns = append(t.conns, conn)
+	t.mu.Unlock()
+
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart("udp", udpAddr.String())
+	}
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	c, err := quic.Dial(ctx, conn, udpAddr, tlsConfig, config)
+	var state tls.ConnectionState
+	if c != nil {
+		state = c.ConnectionState().TLS
+	}
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(state, err)
+	}
+	if trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone("udp", udpAddr.String(), err)
+	}
+	return c, err
+}
+
+// Close closes the connections of the transport and their sockets.
+func (t *http3Transport) Close() error {
+	err := t.Transport.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+	t.conns = nil
+	return err
+}
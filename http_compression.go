@@ -0,0 +1,81 @@
+package libprobe
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// ContentDecoder returns a reader decoding r, for a content coding.
+type ContentDecoder func(r io.Reader) (io.Reader, error)
+
+// defaultContentDecoders are the content codings decoded out of the box.
+// Decoders of other codings, such as br or zstd, can be given in
+// HTTPProberOptions.ContentDecoders.
+var defaultContentDecoders = map[string]ContentDecoder{
+	"gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	"x-gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.Reader, error) {
+		// deflate is meant to be zlib wrapped, but raw deflate is common.
+		br := bufio.NewReader(r)
+		if head, _ := br.Peek(2); len(head) == 2 && head[0]&0x0f == 8 && binary.BigEndian.Uint16(head)%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	},
+}
+
+// decodeContent undoes the content codings of body, applied in the order
+// listed in the Content-Encoding header value encoding.
+func (p *HTTPProber) decodeContent(encoding string, body []byte) ([]byte, error) {
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		if coding == "" || coding == "identity" {
+			continue
+		}
+		decoder, ok := p.opts.ContentDecoders[coding]
+		if !ok {
+			decoder, ok = defaultContentDecoders[coding]
+		}
+		if !ok {
+			return nil, fmt.Errorf("http: no decoder for content coding %q", coding)
+		}
+		r, err := decoder(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("http: decoding %s: %w", coding, err)
+		}
+		if body, err = ioutil.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("http: decoding %s: %w", coding, err)
+		}
+	}
+	return body, nil
+}
+
+// compression fills the compression report of r from the raw body and
+// returns the decoded one.
+func (p *HTTPProber) compression(r *HTTPResult, encoding string, body []byte) []byte {
+	r.ContentEncoding = encoding
+	r.WireSize = len(body)
+	startAt := time.Now()
+	decoded, err := p.decodeContent(encoding, body)
+	r.DecompressTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return body
+	}
+	r.Compressed = encoding != "" && !strings.EqualFold(encoding, "identity")
+	return decoded
+}
@@ -0,0 +1,202 @@
+package libprobe
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// httpDialTrace carries the options of a probe to the dial functions of
+// its transport, which may be shared with other probes, and records what
+// they did, which may be after the probe gave up.
+type httpDialTrace struct {
+	// tunnel opens a tunnel through the proxy with CONNECT.
+	tunnel         bool
+	bypassDNSCache bool
+	// svcb is the HTTPS record whose endpoint is dialed.
+	svcb *svcbRecord
+
+	mu             sync.Mutex
+	connectTime    time.Duration
+	tunnelTime     time.Duration
+	dnsCacheStatus string
+	svcbHint       string
+}
+
+type httpDialTraceKey struct{}
+
+func withHTTPDialTrace(ctx context.Context, t *httpDialTrace) context.Context {
+	return context.WithValue(ctx, httpDialTraceKey{}, t)
+}
+
+func httpDialTraceFrom(ctx context.Context) *httpDialTrace {
+	if t, ok := ctx.Value(httpDialTraceKey{}).(*httpDialTrace); ok {
+		return t
+	}
+	return &httpDialTrace{}
+}
+
+// proxyTimes returns the timings of the connection to the proxy.
+func (t *httpDialTrace) proxyTimes() (time.Duration, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.connectTime, t.tunnelTime
+}
+
+func (t *httpDialTrace) cacheStatus() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dnsCacheStatus
+}
+
+func (p *HTTPProber) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if route := httpDialTraceFrom(ctx).svcb; route != nil {
+		conn, err = p.dialSVCB(ctx, network, route)
+	} else {
+		conn, err = p.dialHost(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pp := p.opts.ProxyProtocol; pp != nil {
+		if err := pp.send(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// dialHost dials address, resolving its host name through the DNS cache
+// when there is one.
+func (p *HTTPProber) dialHost(ctx context.Context, network, address string) (net.Conn, error) {
+	if p.opts.DNSCache == nil {
+		return dialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkGuard(network, address); err != nil {
+		return nil, err
+	}
+	addrs, err := p.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return dialAddrs(ctx, network, addrs, port, dialContext)
+}
+
+// lookupHost resolves host through the DNS cache, or the default resolver
+// without one. Lookups through the cache are reported to the request's
+// trace as its DNS phase, like those of the default resolver.
+func (p *HTTPProber) lookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	if p.opts.DNSCache == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+		return ips, nil
+	}
+	trace := httptrace.ContextClientTrace(ctx)
+	dialTrace := httpDialTraceFrom(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	ips, status, _, err := p.opts.DNSCache.lookupStatus(ctx, host, dialTrace.bypassDNSCache)
+	dialTrace.mu.Lock()
+	dialTrace.dnsCacheStatus = status
+	dialTrace.mu.Unlock()
+	if trace != nil && trace.DNSDone != nil {
+		addrs := make([]net.IPAddr, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.IPAddr{IP: ip}
+		}
+		trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: err, Coalesced: status == DNSCacheHit})
+	}
+	return ips, err
+}
+
+// dialProxy returns a dial function connecting to proxy whatever the address,
+// and opening a tunnel to the address with CONNECT when the probe asks for
+// one.
+func (p *HTTPProber) dialProxy(proxy *url.URL) func(context.Context, string, string) (net.Conn, error) {
+	proxyAddress := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddress = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		trace := httpDialTraceFrom(ctx)
+		startAt := time.Now()
+		conn, err := p.dial(ctx, network, proxyAddress)
+		if err != nil {
+			return nil, err
+		}
+		connectedAt := time.Now()
+		trace.mu.Lock()
+		trace.connectTime = connectedAt.Sub(startAt)
+		trace.mu.Unlock()
+		if !trace.tunnel {
+			return conn, nil
+		}
+		if err := httpConnect(ctx, conn, proxy, address); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		trace.mu.Lock()
+		trace.tunnelTime = time.Since(connectedAt)
+		trace.mu.Unlock()
+		return conn, nil
+	}
+}
+
+// httpConnect asks the proxy at the other end of conn for a tunnel to
+// address.
+func httpConnect(ctx context.Context, conn net.Conn, proxy *url.URL, address string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+		defer conn.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy: CONNECT %s: %s", address, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return errors.New("proxy: unexpected data after the CONNECT response")
+	}
+	return nil
+}
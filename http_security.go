@@ -0,0 +1,122 @@
+package libprobe
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecurityHeaderPolicy is the policy of the security header audit of HTTP
+// probes.
+type SecurityHeaderPolicy struct {
+	// HSTSMinMaxAge is the minimum max-age of the Strict-Transport-Security
+	// header of HTTPS responses. Zero disables the check.
+	HSTSMinMaxAge time.Duration
+	// RequireCSP requires a Content-Security-Policy header.
+	RequireCSP bool
+	// RequireFrameOptions requires an X-Frame-Options header of DENY or
+	// SAMEORIGIN, or a CSP frame-ancestors directive.
+	RequireFrameOptions bool
+	// SecureCookies requires the Secure and HttpOnly flags on every cookie
+	// set.
+	SecureCookies bool
+}
+
+// DefaultSecurityHeaderPolicy enables every check, with the 180 days of HSTS
+// max-age commonly recommended.
+var DefaultSecurityHeaderPolicy = SecurityHeaderPolicy{
+	HSTSMinMaxAge:       180 * 24 * time.Hour,
+	RequireCSP:          true,
+	RequireFrameOptions: true,
+	SecureCookies:       true,
+}
+
+// Checks of security findings.
+const (
+	SecurityCheckHSTS         = "hsts"
+	SecurityCheckCSP          = "csp"
+	SecurityCheckFrameOptions = "frame-options"
+	SecurityCheckCookie       = "cookie"
+)
+
+// SecurityFinding is a violation of a SecurityHeaderPolicy.
+type SecurityFinding struct {
+	Check   string
+	Message string
+}
+
+// audit returns the violations of the policy by resp.
+func (p *SecurityHeaderPolicy) audit(resp *http.Response) []SecurityFinding {
+	var findings []SecurityFinding
+	add := func(check, format string, args ...interface{}) {
+		findings = append(findings, SecurityFinding{Check: check, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if p.HSTSMinMaxAge > 0 && resp.TLS != nil {
+		hsts := resp.Header.Get("Strict-Transport-Security")
+		if hsts == "" {
+			add(SecurityCheckHSTS, "Strict-Transport-Security missing")
+		} else if maxAge, ok := hstsMaxAge(hsts); !ok {
+			add(SecurityCheckHSTS, "Strict-Transport-Security without a valid max-age: %q", hsts)
+		} else if maxAge < p.HSTSMinMaxAge {
+			add(SecurityCheckHSTS, "Strict-Transport-Security max-age %d below %d", int64(maxAge/time.Second), int64(p.HSTSMinMaxAge/time.Second))
+		}
+	}
+
+	csp := strings.Join(resp.Header.Values("Content-Security-Policy"), ",")
+	if p.RequireCSP && csp == "" {
+		add(SecurityCheckCSP, "Content-Security-Policy missing")
+	}
+	if p.RequireFrameOptions && !strings.Contains(strings.ToLower(csp), "frame-ancestors") {
+		xfo := strings.TrimSpace(resp.Header.Get("X-Frame-Options"))
+		switch strings.ToUpper(xfo) {
+		case "DENY", "SAMEORIGIN":
+		case "":
+			add(SecurityCheckFrameOptions, "X-Frame-Options and CSP frame-ancestors missing")
+		default:
+			add(SecurityCheckFrameOptions, "invalid X-Frame-Options %q", xfo)
+		}
+	}
+
+	if p.SecureCookies {
+		for _, cookie := range resp.Cookies() {
+			var missing []string
+			if !cookie.Secure {
+				missing = append(missing, "Secure")
+			}
+			if !cookie.HttpOnly {
+				missing = append(missing, "HttpOnly")
+			}
+			if len(missing) > 0 {
+				add(SecurityCheckCookie, "cookie %s without %s", cookie.Name, strings.Join(missing, " and "))
+			}
+		}
+	}
+	return findings
+}
+
+// hstsMaxAge returns the max-age directive of a Strict-Transport-Security
+// header.
+func hstsMaxAge(hsts string) (time.Duration, bool) {
+	for _, directive := range strings.Split(hsts, ";") {
+		name, value := directive, ""
+		if i := strings.IndexByte(directive, '='); i >= 0 {
+			name, value = directive[:i], directive[i+1:]
+		}
+		if !strings.EqualFold(strings.TrimSpace(name), "max-age") {
+			continue
+		}
+		seconds, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(value), `"`), 10, 64)
+		if err != nil || seconds < 0 {
+			return 0, false
+		}
+		if seconds > math.MaxInt64/int64(time.Second) {
+			seconds = math.MaxInt64 / int64(time.Second)
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
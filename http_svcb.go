@@ -0,0 +1,114 @@
+package libprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SVCBRoute is the endpoint of the HTTPS record followed by an HTTPProber.
+type SVCBRoute struct {
+	// Record is the record followed, in presentation format.
+	Record     string
+	LookupTime time.Duration
+	// Target and Port are the endpoint dialed.
+	Target string
+	Port   uint16
+	// ALPN are the protocols of the endpoint, those of the record along
+	// with http/1.1 unless it has no-default-alpn.
+	ALPN []string
+	// HintUsed is the address hint connected to, empty when Target was
+	// resolved instead.
+	HintUsed string
+}
+
+// lookupSVCB returns the first HTTPS record of the origin of u by
+// priority, its port and ALPN protocols completed with their defaults.
+// Targets without records, or whose lookup fails, are probed as usual.
+func (p *HTTPProber) lookupSVCB(u *url.URL, target Target) (*SVCBRoute, *svcbRecord) {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	startAt := time.Now()
+	records, err := lookupHTTPSRecords(target.meter, p.opts.SVCBResolver, httpsRecordName(u.Hostname(), port), startAt.Add(timeout))
+	if err != nil || len(records) == 0 {
+		return nil, nil
+	}
+	route := &SVCBRoute{Record: records[0].String(), LookupTime: time.Since(startAt)}
+	record := records[0]
+	if record.Port == 0 {
+		n, _ := strconv.ParseUint(port, 10, 16)
+		record.Port = uint16(n)
+	}
+	if !record.NoDefaultALPN && !stringsContain(record.ALPN, "http/1.1") {
+		record.ALPN = append(append([]string(nil), record.ALPN...), "http/1.1")
+	}
+	route.Target, route.Port, route.ALPN = record.Target, record.Port, record.ALPN
+	return route, &record
+}
+
+// svcbTransport returns a transport of its own for a probe following
+// record, offering the protocols of its ALPN that it speaks.
+func (p *HTTPProber) svcbTransport(record *svcbRecord) (*http.Transport, error) {
+	transport, err := p.newTransport()
+	if err != nil {
+		return nil, err
+	}
+	config := p.opts.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.NextProtos = nil
+	for _, proto := range record.ALPN {
+		if proto == "h2" || proto == "http/1.1" {
+			config.NextProtos = append(config.NextProtos, proto)
+		}
+	}
+	transport.TLSClientConfig = config
+	transport.ForceAttemptHTTP2 = stringsContain(config.NextProtos, "h2")
+	return transport, nil
+}
+
+// dialSVCB dials the endpoint of record, trying its address hints before
+// resolving its target.
+func (p *HTTPProber) dialSVCB(ctx context.Context, network string, record *svcbRecord) (net.Conn, error) {
+	port := strconv.Itoa(int(record.Port))
+	for _, hint := range append(append([]net.IP(nil), record.IPv4Hint...), record.IPv6Hint...) {
+		conn, err := dialContext(ctx, network, net.JoinHostPort(hint.String(), port))
+		if err == nil {
+			trace := httpDialTraceFrom(ctx)
+			trace.mu.Lock()
+			trace.svcbHint = hint.String()
+			trace.mu.Unlock()
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return p.dialHost(ctx, network, net.JoinHostPort(record.Target, port))
+}
+
+func (t *httpDialTrace) hintUsed() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.svcbHint
+}
+
+func stringsContain(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -1,12 +1,23 @@
 package libprobe_test
 
 import (
+	"bufio"
+	"compress/gzip"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/blho/libprobe"
 
+	"github.com/quic-go/quic-go/http3"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestHTTPProber(t *testing.T) {
@@ -25,3 +36,359 @@ func TestHTTPProber(t *testing.T) {
 	require.NotNil(t, result)
 	require.Error(t, result.(*libprobe.HTTPResult).Error)
 }
+
+func TestHTTPProberProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		header, _ := r.ReadString('\n')
+		headers <- header
+		if _, err := http.ReadRequest(r); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+	}()
+	prober := libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{
+		ProxyProtocol: &libprobe.ProxyProtocol{SourceAddress: "198.51.100.7:5000"},
+	})
+	result, err := prober.Probe(libprobe.Target{
+		Address: "http://" + ln.Addr().String() + "/",
+		Timeout: 5 * time.Second,
+	})
+	require.NoError(t, err)
+	res := result.(*libprobe.HTTPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, 200, res.ResponseStatusCode)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	require.Equal(t, "PROXY TCP4 198.51.100.7 127.0.0.1 5000 "+port+"\r\n", <-headers)
+}
+
+// serveHTTPProxy runs a forward proxy answering plain requests itself and
+// tunnelling CONNECT ones.
+func serveHTTPProxy(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect {
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 14\r\nConnection: close\r\n\r\n"+req.URL.Host)
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestHTTPProberProxy(t *testing.T) {
+	proxy := serveHTTPProxy(t)
+	prober := libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{Proxy: "http://" + proxy})
+
+	result, err := prober.Probe(libprobe.Target{Address: "http://origin.test:8080/", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := result.(*libprobe.HTTPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, 200, res.ResponseStatusCode)
+	require.NotZero(t, res.ProxyConnectTime)
+	require.Zero(t, res.ProxyTunnelTime)
+
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer origin.Close()
+	result, err = prober.Probe(libprobe.Target{Address: origin.URL, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = result.(*libprobe.HTTPResult)
+	// The tunnel reached the origin, whose certificate isn't trusted.
+	require.Error(t, res.Error)
+	require.Contains(t, res.Error.Error(), "certificate")
+	require.NotZero(t, res.ProxyConnectTime)
+	require.NotZero(t, res.ProxyTunnelTime)
+}
+
+func TestHTTPProberCompression(t *testing.T) {
+	body := strings.Repeat("compressible ", 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Accept-Encoding") {
+		case "gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			io.WriteString(gz, body)
+			gz.Close()
+		case "br":
+			w.Header().Set("Content-Encoding", "br")
+			io.WriteString(w, "not really brotli")
+		default:
+			io.WriteString(w, body)
+		}
+	}))
+	defer server.Close()
+	probe := func(opts libprobe.HTTPProberOptions) *libprobe.HTTPResult {
+		result, err := libprobe.NewHTTPProberWithOptions(opts).Probe(libprobe.Target{Address: server.URL, Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		return result.(*libprobe.HTTPResult)
+	}
+
+	res := probe(libprobe.HTTPProberOptions{AcceptEncoding: "gzip"})
+	require.NoError(t, res.Error)
+	require.True(t, res.Compressed)
+	require.Equal(t, "gzip", res.ContentEncoding)
+	require.Equal(t, len(body), res.ResponseSize)
+	require.Less(t, res.WireSize, res.ResponseSize)
+
+	res = probe(libprobe.HTTPProberOptions{AcceptEncoding: "identity"})
+	require.NoError(t, res.Error)
+	require.False(t, res.Compressed)
+	require.Equal(t, len(body), res.WireSize)
+	require.Equal(t, len(body), res.ResponseSize)
+
+	res = probe(libprobe.HTTPProberOptions{AcceptEncoding: "br"})
+	require.Error(t, res.Error)
+
+	res = probe(libprobe.HTTPProberOptions{
+		AcceptEncoding: "br",
+		ContentDecoders: map[string]libprobe.ContentDecoder{
+			"br": func(r io.Reader) (io.Reader, error) { return strings.NewReader("decoded"), nil },
+		},
+	})
+	require.NoError(t, res.Error)
+	require.True(t, res.Compressed)
+	require.Equal(t, len("decoded"), res.ResponseSize)
+}
+
+func TestHTTPProberSecurityAudit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/good" {
+			w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Secure: true, HttpOnly: true})
+			return
+		}
+		w.Header().Set("X-Frame-Options", "ALLOW-FROM https://example.com")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", HttpOnly: true})
+		http.SetCookie(w, &http.Cookie{Name: "prefs", Value: "1"})
+	}))
+	defer server.Close()
+	prober := libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{SecurityAudit: &libprobe.DefaultSecurityHeaderPolicy})
+
+	result, err := prober.Probe(libprobe.Target{Address: server.URL + "/good", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.NoError(t, result.(*libprobe.HTTPResult).Error)
+	require.Empty(t, result.(*libprobe.HTTPResult).SecurityFindings)
+
+	result, err = prober.Probe(libprobe.Target{Address: server.URL + "/bad", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := result.(*libprobe.HTTPResult)
+	require.NoError(t, res.Error)
+	// HSTS doesn't apply to plain HTTP.
+	require.Equal(t, []libprobe.SecurityFinding{
+		{Check: libprobe.SecurityCheckCSP, Message: "Content-Security-Policy missing"},
+		{Check: libprobe.SecurityCheckFrameOptions, Message: `invalid X-Frame-Options "ALLOW-FROM https://example.com"`},
+		{Check: libprobe.SecurityCheckCookie, Message: "cookie session without Secure"},
+		{Check: libprobe.SecurityCheckCookie, Message: "cookie prefs without Secure and HttpOnly"},
+	}, res.SecurityFindings)
+}
+
+func TestHTTPProberAssertions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"status": "ok", "replicas": 2}`)
+	}))
+	defer server.Close()
+	prober := libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{
+		Assertions: []*libprobe.JSONAssertion{
+			libprobe.MustCompileJSONAssertion(`$.status == "ok"`),
+			libprobe.MustCompileJSONAssertion(`$.replicas >= 3`),
+		},
+	})
+	result, err := prober.Probe(libprobe.Target{Address: server.URL, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := result.(*libprobe.HTTPResult)
+	require.EqualError(t, res.Error, "assertion failed: $.replicas >= 3")
+	require.Equal(t, []string{"$.replicas >= 3"}, res.FailedAssertions)
+}
+
+func TestHTTPProberHTTP3(t *testing.T) {
+	// The test server's certificate is valid for example.com and 127.0.0.1.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	h3 := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(srv.TLS.Clone()),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto)
+		}),
+	}
+	go h3.Serve(conn)
+	defer h3.Close()
+
+	prober := libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{
+		TLSConfig:  &tls.Config{RootCAs: roots},
+		ForceHTTP3: true,
+	})
+	result, err := prober.Probe(libprobe.Target{Address: "https://" + conn.LocalAddr().String() + "/", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := result.(*libprobe.HTTPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, http.StatusOK, res.ResponseStatusCode)
+	require.Equal(t, "HTTP/3.0", res.Protocol)
+	require.Equal(t, len("HTTP/3.0"), res.ResponseSize)
+	require.True(t, res.ConnectTime > 0 && res.TLSHandshakeTime > 0 && res.TTFB > 0)
+	require.True(t, res.TotalTime >= res.TLSHandshakeTime+res.TTFB)
+
+	_, err = libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{Proxy: "http://127.0.0.1:1", ForceHTTP3: true}).Probe(libprobe.Target{Address: "https://127.0.0.1/"})
+	require.Error(t, err)
+}
+
+func TestHTTPProberReuseConnections(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	prober := libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{ReuseConnections: true})
+	target := libprobe.Target{Address: srv.URL, Timeout: 5 * time.Second}
+
+	result, err := prober.Probe(target)
+	require.NoError(t, err)
+	res := result.(*libprobe.HTTPResult)
+	require.NoError(t, res.Error)
+	require.False(t, res.ConnectionReused)
+	require.Equal(t, []string{libprobe.HTTPStepDNSLookup, libprobe.HTTPStepTLSHandshake}, res.NotApplicable)
+	require.True(t, res.ConnectTime > 0)
+
+	result, err = prober.Probe(target)
+	require.NoError(t, err)
+	res = result.(*libprobe.HTTPResult)
+	require.NoError(t, res.Error)
+	require.True(t, res.ConnectionReused)
+	require.Equal(t, []string{libprobe.HTTPStepDNSLookup, libprobe.HTTPStepConnect, libprobe.HTTPStepTLSHandshake}, res.NotApplicable)
+	require.Zero(t, res.DNSResolveTime)
+	require.Zero(t, res.ConnectTime)
+	require.Zero(t, res.TLSHandshakeTime)
+	require.True(t, res.TTFB > 0)
+	require.True(t, res.TotalTime >= res.TTFB && res.TotalTime < 5*time.Second)
+
+	// Without ReuseConnections, every probe opens a new connection.
+	result, err = libprobe.NewHTTPProber().Probe(target)
+	require.NoError(t, err)
+	require.False(t, result.(*libprobe.HTTPResult).ConnectionReused)
+}
+
+func TestHTTPProberBodyMilestones(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 2<<10))
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write(make([]byte, 70<<10))
+	}))
+	defer srv.Close()
+	prober := libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{BodyMilestones: libprobe.DefaultBodyMilestones})
+	result, err := prober.Probe(libprobe.Target{Address: srv.URL, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := result.(*libprobe.HTTPResult)
+	require.NoError(t, res.Error)
+	require.Len(t, res.BodyMilestones, 3)
+	first, mid, last := res.BodyMilestones[0], res.BodyMilestones[1], res.BodyMilestones[2]
+	require.Equal(t, 1<<10, first.Bytes)
+	require.Equal(t, 64<<10, mid.Bytes)
+	require.Equal(t, 72<<10, last.Bytes)
+	require.True(t, first.Elapsed >= res.TTFB)
+	require.True(t, mid.Elapsed >= first.Elapsed+40*time.Millisecond)
+	require.True(t, last.Elapsed >= mid.Elapsed)
+	require.Equal(t, res.TotalTime, last.Elapsed)
+
+	rows := libprobe.Flatten(res)
+	require.Len(t, rows, 4)
+	require.Equal(t, int64(64<<10), rows[2]["body_milestones_bytes"])
+}
+
+func TestHTTPProberSVCB(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	// example.com points to the server's port on 127.0.0.1 with h2, and
+	// www.example.com to localhost with HTTP/1.1 only.
+	records := map[string][]byte{
+		"example.com.":     {0, 1, 0, 0, 1, 0, 3, 2, 'h', '2', 0, 3, 0, 2, byte(portNumber >> 8), byte(portNumber), 0, 4, 0, 4, 127, 0, 0, 1},
+		"www.example.com.": append(append([]byte{0, 1, 9}, "localhost"...), 0, 0, 3, 0, 2, byte(portNumber>>8), byte(portNumber)),
+	}
+	resolver := serveUDP(t, func(b []byte) [][]byte {
+		var q dnsmessage.Message
+		if q.Unpack(b) != nil {
+			return nil
+		}
+		resp := dnsmessage.Message{Header: dnsmessage.Header{ID: q.Header.ID, Response: true}, Questions: q.Questions}
+		if data, ok := records[q.Questions[0].Name.String()]; ok {
+			resp.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: 65, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.UnknownResource{Type: 65, Data: data},
+			}}
+		}
+		out, _ := resp.Pack()
+		return [][]byte{out}
+	})
+	prober := libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{
+		TLSConfig:    srv.Client().Transport.(*http.Transport).TLSClientConfig,
+		SVCB:         true,
+		SVCBResolver: resolver,
+		KeepBody:     true,
+	})
+
+	result, err := prober.Probe(libprobe.Target{Address: "https://example.com/", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := result.(*libprobe.HTTPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "HTTP/2.0", string(res.ResponseBody))
+	require.NotNil(t, res.SVCB)
+	require.Equal(t, "example.com", res.SVCB.Target)
+	require.EqualValues(t, portNumber, res.SVCB.Port)
+	require.Equal(t, []string{"h2", "http/1.1"}, res.SVCB.ALPN)
+	require.Equal(t, "127.0.0.1", res.SVCB.HintUsed)
+	require.Positive(t, res.SVCB.LookupTime)
+
+	result, err = prober.Probe(libprobe.Target{Address: "https://www.example.com/", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = result.(*libprobe.HTTPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "HTTP/1.1", string(res.ResponseBody))
+	require.Equal(t, "localhost", res.SVCB.Target)
+	require.Empty(t, res.SVCB.HintUsed)
+
+	// Without SVCB, the record is ignored.
+	result, err = libprobe.NewHTTPProberWithOptions(libprobe.HTTPProberOptions{SVCBResolver: resolver}).Probe(libprobe.Target{Address: "https://example.com:" + port + "/", Timeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+	require.Nil(t, result.(*libprobe.HTTPResult).SVCB)
+}
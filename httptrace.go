@@ -21,6 +21,9 @@ type HTTPClientTrace struct {
 	gotFirstResponseByte time.Time
 	endTime              time.Time
 	gotConnInfo          httptrace.GotConnInfo
+	// dnsSkipped is set when the connection was dialed without a lookup,
+	// such as to an IP address.
+	dnsSkipped bool
 
 	lastRequestWrote time.Time
 	requestWroteLock sync.RWMutex
@@ -55,6 +58,7 @@ func (t *HTTPClientTrace) CreateContext(ctx context.Context) context.Context {
 			ConnectStart: func(_, _ string) {
 				if t.dnsDone.IsZero() {
 					t.dnsDone = time.Now()
+					t.dnsSkipped = true
 				}
 				if t.dnsStart.IsZero() {
 					t.dnsStart = t.dnsDone
@@ -154,6 +158,12 @@ type HTTPTraceInfo struct {
 	// RemoteAddr returns the remote network address.
 	RemoteAddr net.Addr
 
+	// NotApplicable lists the steps that didn't take place for the request,
+	// such as all of HTTPStepDNSLookup, HTTPStepConnect and
+	// HTTPStepTLSHandshake on a reused connection. Their durations are
+	// zero.
+	NotApplicable []string
+
 	// Timestamps
 	RequestStartAt      time.Time
 	FirstResponseByteAt time.Time
@@ -170,6 +180,10 @@ func (t *HTTPClientTrace) TraceInfo() HTTPTraceInfo {
 		RequestStartAt:      t.dnsStart,
 		FirstResponseByteAt: t.gotFirstResponseByte,
 	}
+	// Without a new connection, the request starts when asking for one.
+	if t.gotConnInfo.Reused || t.dnsStart.IsZero() {
+		ti.RequestStartAt = t.getConn
+	}
 
 	// Only calculate on successful connections
 	if !t.connectDone.IsZero() {
@@ -200,7 +214,21 @@ func (t *HTTPClientTrace) TraceInfo() HTTPTraceInfo {
 	if t.gotConnInfo.Reused {
 		ti.TotalTime = t.endTime.Sub(t.getConn)
 	} else {
-		ti.TotalTime = t.endTime.Sub(t.dnsStart)
+		ti.TotalTime = t.endTime.Sub(ti.RequestStartAt)
+	}
+
+	switch {
+	case t.gotConnInfo.Reused:
+		ti.NotApplicable = []string{HTTPStepDNSLookup, HTTPStepConnect, HTTPStepTLSHandshake}
+		ti.DNSLookup, ti.TCPConnTime, ti.ConnTime, ti.TLSHandshake = 0, 0, 0, 0
+	case !t.gotConn.IsZero():
+		if t.dnsSkipped {
+			ti.NotApplicable = append(ti.NotApplicable, HTTPStepDNSLookup)
+		}
+		if t.tlsHandshakeStart.IsZero() {
+			ti.NotApplicable = append(ti.NotApplicable, HTTPStepTLSHandshake)
+			ti.TLSHandshake = 0
+		}
 	}
 
 	// Capture remote address info when connection is non-nil
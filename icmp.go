@@ -1,7 +1,13 @@
 package libprobe
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-ping/ping"
@@ -11,6 +17,34 @@ type ICMPResult struct {
 	Target
 
 	Stats *ping.Statistics
+	// ReplySeqs are the sequence numbers of the replies whose round-trip
+	// times are in Stats.Rtts, in the same order.
+	ReplySeqs []int
+	// Route is the IPv4 option data of the first reply when an IP option
+	// was requested.
+	Route []ICMPRouteHop
+	// Destination is the resolved address echo requests were sent to.
+	Destination string
+	// ReplySource is the source address of the replies. SourceMismatch is
+	// set when a reply came from another address than Destination, as
+	// happens with NAT, anycast or intercepting middleboxes; ReplySource is
+	// then the first such address.
+	ReplySource    string
+	SourceMismatch bool
+	// DestinationInfo and ReplySourceInfo classify Destination and
+	// ReplySource when the prober has a Classifier.
+	DestinationInfo *AddressInfo
+	ReplySourceInfo *AddressInfo
+	// ReplyTrafficClass and ReplyFlowLabel are those of the first IPv6
+	// reply.
+	ReplyTrafficClass int
+	ReplyFlowLabel    int
+	// Errors are the ICMP error messages received instead of echo replies,
+	// such as destination unreachable. They are only seen by privileged
+	// probers; unprivileged sockets don't receive them.
+	Errors []ICMPError
+
+	size int // echo payload size
 }
 
 const (
@@ -19,6 +53,9 @@ round-trip min/avg/max/stddev = %v/%v/%v/%v`
 )
 
 func (r ICMPResult) RTT() time.Duration {
+	if r.Stats == nil {
+		return 0
+	}
 	return r.Stats.AvgRtt
 }
 
@@ -26,44 +63,474 @@ func (r ICMPResult) String() string {
 	if r.Stats == nil {
 		return "ICMP probe no result"
 	}
-	return fmt.Sprintf(icmpTemplate, r.Stats.PacketsSent, r.Stats.PacketsRecv, r.Stats.PacketLoss,
+	s := fmt.Sprintf(icmpTemplate, r.Stats.PacketsSent, r.Stats.PacketsRecv, r.Stats.PacketLoss,
 		r.Stats.MinRtt, r.Stats.AvgRtt, r.Stats.MaxRtt, r.Stats.StdDevRtt)
+	for _, e := range r.Errors {
+		s += "\n" + e.String()
+	}
+	if r.SourceMismatch {
+		s += fmt.Sprintf("\nreplies from %s instead of %s", r.ReplySource, r.Destination)
+	}
+	if len(r.Route) > 0 {
+		s += "\nroute: " + formatRoute(r.Route)
+	}
+	return s
+}
+
+// ICMPProberOptions configures an ICMPProber.
+type ICMPProberOptions struct {
+	// Privileged uses raw sockets instead of unprivileged datagram sockets.
+	Privileged bool
+	// Size is the echo payload size in bytes. Payloads start with a 16 byte
+	// timestamp and tracker, smaller sizes are rounded up. Default: 24, the
+	// size ping sends.
+	Size int
+	// Payload selects how the rest of the payload is filled.
+	Payload ICMPPayload
+	// IPOption is an IPv4 option set on echo requests. Its data, returned
+	// in replies, is parsed into ICMPResult.Route. It requires a
+	// privileged prober.
+	IPOption IPv4Option
+	// TrafficClass and FlowLabel are set on IPv6 echo requests when not
+	// zero. Flow labels steer ECMP path selection and can only be set on
+	// Linux.
+	TrafficClass int
+	FlowLabel    int
+	// Sweep, when set, makes Probe send echoes of increasing size and
+	// return an *ICMPSweepResult.
+	Sweep *ICMPSweep
+	// Broadcast makes Probe treat targets as broadcast or multicast
+	// addresses: every host answering until Target.Timeout is collected in
+	// an *ICMPBroadcastResult. Note that many hosts ignore broadcast echo
+	// requests.
+	Broadcast bool
+	// MulticastTTL is the TTL (hop limit for IPv6) of multicast echo
+	// requests in broadcast mode. Default: 1.
+	MulticastTTL int
+	// Classifier, when set, classifies the destination, the reply source,
+	// the route hops and the sources of ICMP errors, flagging paths through
+	// private or reserved space.
+	Classifier AddressClassifier
+}
+
+// ICMPSweep configures sweep mode: Target.Count echoes are sent for every
+// payload size from MinSize to MaxSize, which reveals loss caused by MTU or
+// fragmentation problems.
+type ICMPSweep struct {
+	// MinSize and MaxSize bound the payload size in bytes. Payloads carry a
+	// 16 byte timestamp and tracker, smaller sizes are rounded up.
+	MinSize int
+	MaxSize int
+	// Step is the size increment. Default: 100.
+	Step int
+}
+
+// ICMPPayload is the fill of echo payloads following the timestamp and
+// tracker. Some middleboxes compress or deduplicate zero-filled payloads,
+// skewing measurements; the zero value fills with zeros.
+type ICMPPayload struct {
+	// Tag is ASCII text identifying the probing agent to remote operators.
+	// It comes first, followed by the operator contact when one is set with
+	// SetOperatorContact, by "probe-id=<id>" when the target has a ProbeID,
+	// and then by the pattern or random fill.
+	Tag string
+	// Pattern is repeated to fill the payload, like ping -p.
+	Pattern []byte
+	// Random fills the payload with pseudo-random bytes drawn from a source
+	// seeded with Seed, so payload sequences are reproducible.
+	Random bool
+	Seed   int64
 }
 
 type ICMPProber struct {
-	privileged bool
+	opts ICMPProberOptions
+
+	randMu sync.Mutex
+	rand   *rand.Rand
 }
 
 func NewICMPProber(privileged bool) *ICMPProber {
+	return NewICMPProberWithOptions(ICMPProberOptions{Privileged: privileged})
+}
+
+func NewICMPProberWithOptions(opts ICMPProberOptions) *ICMPProber {
+	if opts.Sweep != nil {
+		sweep := *opts.Sweep
+		if sweep.Step <= 0 {
+			sweep.Step = 100
+		}
+		if sweep.MinSize < icmpHeaderLen {
+			sweep.MinSize = icmpHeaderLen
+		}
+		if sweep.MaxSize < sweep.MinSize {
+			sweep.MaxSize = sweep.MinSize
+		}
+		opts.Sweep = &sweep
+	}
+	if opts.Size == 0 {
+		opts.Size = icmpDefaultSize
+	}
+	if opts.Size < icmpHeaderLen {
+		opts.Size = icmpHeaderLen
+	}
 	return &ICMPProber{
-		privileged: privileged,
+		opts: opts,
+		rand: rand.New(rand.NewSource(opts.Payload.Seed)),
 	}
 }
 
+// fill returns n bytes of payload fill for probing target.
+func (p *ICMPProber) fill(n int, target Target) []byte {
+	if n <= 0 {
+		return nil
+	}
+	b := make([]byte, 0, n)
+	texts := []string{p.opts.Payload.Tag, OperatorContact(), ""}
+	if target.ProbeID != "" {
+		texts[2] = "probe-id=" + target.ProbeID
+	}
+	for _, text := range texts {
+		if text == "" {
+			continue
+		}
+		if len(b) > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, text...)
+	}
+	// Text longer than the payload is cut, leaving no room for the fill.
+	if len(b) >= n {
+		return b[:n]
+	}
+	switch {
+	case p.opts.Payload.Random:
+		rest := make([]byte, n-len(b))
+		p.randMu.Lock()
+		p.rand.Read(rest)
+		p.randMu.Unlock()
+		b = append(b, rest...)
+	case len(p.opts.Payload.Pattern) > 0:
+		for len(b) < n {
+			b = append(b, p.opts.Payload.Pattern...)
+		}
+	}
+	if len(b) > n {
+		return b[:n]
+	}
+	return b
+}
+
 func (p *ICMPProber) Kind() string {
 	return "ICMP"
 }
 
 func (p *ICMPProber) Probe(target Target) (Result, error) {
-	r := &ICMPResult{
-		Target: target,
+	if p.opts.Broadcast {
+		return p.broadcast(target)
 	}
-	pinger, err := ping.NewPinger(target.Address)
-	if err != nil {
-		return nil, err
+	if p.opts.Sweep != nil {
+		return p.sweep(target)
 	}
-	pinger.SetPrivileged(p.privileged)
-	pinger.Count = target.GetCount()
-	if target.Timeout.Seconds() > 0 {
-		pinger.Timeout = target.Timeout
+	return p.echo(target, p.opts.Size, nil)
+}
+
+// ICMPReply is a single echo reply received during a probe.
+type ICMPReply struct {
+	Seq int
+	RTT time.Duration
+	// From is the address of the responder.
+	From  string
+	TTL   int
+	Bytes int
+	// Duplicate is set for replies to a sequence number already answered.
+	Duplicate bool
+	// Route is the IPv4 option data of the reply.
+	Route []ICMPRouteHop
+	// TrafficClass and FlowLabel are those of an IPv6 reply. Flow labels
+	// are only read on Linux.
+	TrafficClass int
+	FlowLabel    int
+	// Error is set when an ICMP error message arrived instead of an echo
+	// reply.
+	Error *ICMPError
+}
+
+func (r ICMPReply) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("icmp_seq=%d %s", r.Seq, r.Error)
 	}
-	if target.Interval.Seconds() > 0 {
-		pinger.Interval = target.Interval
+	dup := ""
+	if r.Duplicate {
+		dup = " (DUP!)"
 	}
-	err = pinger.Run()
+	return fmt.Sprintf("%d bytes from %s: icmp_seq=%d ttl=%d time=%v%s", r.Bytes, r.From, r.Seq, r.TTL, r.RTT, dup)
+}
+
+// ProbeStream probes like Probe, additionally calling onReply for every echo
+// reply as it arrives, which allows printing replies live like ping does.
+// onReply is called from the probing goroutine and should return quickly.
+func (p *ICMPProber) ProbeStream(target Target, onReply func(ICMPReply)) (Result, error) {
+	return p.echo(target, p.opts.Size, onReply)
+}
+
+// echo sends Target.Count echo requests of the given payload size every
+// Target.Interval (default 1s) and collects the replies. Like ping, it waits
+// for late replies twice the largest RTT seen (at least a second) after the
+// last request, or ten seconds without replies, unless Target.Timeout ends the
+// probe earlier.
+func (p *ICMPProber) echo(target Target, size int, onReply func(ICMPReply)) (*ICMPResult, error) {
+	addr, err := resolveIPAddr("ip", target.Address)
 	if err != nil {
 		return nil, err
 	}
-	r.Stats = pinger.Statistics()
+	sock, err := listenICMP(addr.IP.To4() == nil, p.opts.Privileged)
+	if err != nil {
+		return nil, err
+	}
+	defer sock.Close()
+	if p.opts.IPOption != IPv4OptionNone {
+		if !sock.raw || sock.ipv6 {
+			return nil, errors.New("icmp: IP options require a privileged IPv4 prober")
+		}
+		if err := setIPOptions(sock.conn, p.opts.IPOption.bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if sock.ipv6 && p.opts.TrafficClass != 0 {
+		if err := sock.p6.SetTrafficClass(p.opts.TrafficClass); err != nil {
+			return nil, err
+		}
+	}
+	if sock.ipv6 && p.opts.FlowLabel != 0 {
+		if err := sock.setFlowLabel(addr.IP, p.opts.FlowLabel); err != nil {
+			return nil, err
+		}
+	}
+
+	count := target.GetCount()
+	interval := target.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	start := time.Now()
+	var deadline time.Time
+	if target.Timeout > 0 {
+		deadline = start.Add(target.Timeout)
+	}
+	stats := &ping.Statistics{IPAddr: addr, Addr: target.Address}
+	r := &ICMPResult{Target: target, Stats: stats, Destination: addr.IP.String(), size: size}
+	received := make(map[int]bool, count)
+	// failed holds the sequence numbers answered by an ICMP error.
+	failed := make(map[int]bool)
+	sentAt := make([]time.Time, 0, count)
+	var m2 float64
+	var lastSent time.Time
+	nextSend := start
+	buf := make([]byte, 65536)
+	for {
+		now := time.Now()
+		if !deadline.IsZero() && !now.Before(deadline) {
+			break
+		}
+		if stats.PacketsSent < count && !now.Before(nextSend) {
+			payload := sock.payload(size, p.fill(size-icmpHeaderLen, target))
+			if err := sock.sendEcho(addr.IP, stats.PacketsSent, payload); err != nil {
+				return nil, err
+			}
+			stats.PacketsSent++
+			sentAt = append(sentAt, now)
+			lastSent = now
+			nextSend = nextSend.Add(interval)
+			continue
+		}
+		wake := nextSend
+		if stats.PacketsSent == count {
+			if stats.PacketsRecv+len(failed) >= count {
+				break
+			}
+			linger := 10 * time.Second
+			if stats.PacketsRecv+len(failed) > 0 {
+				linger = 2 * stats.MaxRtt
+				if linger < time.Second {
+					linger = time.Second
+				}
+			}
+			wake = lastSent.Add(linger)
+			if !now.Before(wake) {
+				break
+			}
+		}
+		if !deadline.IsZero() && deadline.Before(wake) {
+			wake = deadline
+		}
+		if err := sock.conn.SetReadDeadline(wake); err != nil {
+			return nil, err
+		}
+		pkt, err := sock.recv(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.Is(err, errNotOurs) || (errors.As(err, &nerr) && nerr.Timeout()) {
+				continue
+			}
+			return nil, err
+		}
+		if pkt.Seq >= stats.PacketsSent {
+			continue
+		}
+		if pkt.IsError {
+			if !pkt.Dst.Equal(addr.IP) || failed[pkt.Seq] || received[pkt.Seq] {
+				continue
+			}
+			failed[pkt.Seq] = true
+			icmpErr := ICMPError{
+				Seq:  pkt.Seq,
+				From: pkt.From.String(),
+				IPv6: sock.ipv6,
+				Type: pkt.Type,
+				Code: pkt.Code,
+				MTU:  pkt.MTU,
+			}
+			r.Errors = append(r.Errors, icmpErr)
+			if onReply != nil {
+				onReply(ICMPReply{
+					Seq:   pkt.Seq,
+					RTT:   pkt.Received.Sub(sentAt[pkt.Seq]),
+					From:  icmpErr.From,
+					TTL:   pkt.TTL,
+					Error: &icmpErr,
+				})
+			}
+			continue
+		}
+		reply := ICMPReply{
+			Seq:          pkt.Seq,
+			RTT:          pkt.Received.Sub(pkt.Sent),
+			From:         pkt.From.String(),
+			TTL:          pkt.TTL,
+			Bytes:        len(pkt.Data) + 8,
+			Duplicate:    received[pkt.Seq],
+			TrafficClass: pkt.TrafficClass,
+			FlowLabel:    pkt.FlowLabel,
+		}
+		if len(pkt.Options) > 0 {
+			reply.Route = parseIPv4Options(pkt.Options)
+			if r.Route == nil {
+				r.Route = reply.Route
+			}
+		}
+		if stats.PacketsRecv == 0 && !reply.Duplicate {
+			r.ReplyTrafficClass = reply.TrafficClass
+			r.ReplyFlowLabel = reply.FlowLabel
+			r.ReplySource = reply.From
+		}
+		if !r.SourceMismatch && !pkt.From.Equal(addr.IP) {
+			r.SourceMismatch = true
+			r.ReplySource = reply.From
+		}
+		if reply.Duplicate {
+			stats.PacketsRecvDuplicates++
+		} else {
+			received[pkt.Seq] = true
+			stats.PacketsRecv++
+			stats.Rtts = append(stats.Rtts, reply.RTT)
+			r.ReplySeqs = append(r.ReplySeqs, pkt.Seq)
+			if stats.PacketsRecv == 1 || reply.RTT < stats.MinRtt {
+				stats.MinRtt = reply.RTT
+			}
+			if reply.RTT > stats.MaxRtt {
+				stats.MaxRtt = reply.RTT
+			}
+			// Welford's online algorithm for the standard deviation.
+			delta := float64(reply.RTT - stats.AvgRtt)
+			stats.AvgRtt += time.Duration(delta / float64(stats.PacketsRecv))
+			m2 += delta * float64(reply.RTT-stats.AvgRtt)
+			stats.StdDevRtt = time.Duration(math.Sqrt(m2 / float64(stats.PacketsRecv)))
+		}
+		if onReply != nil {
+			onReply(reply)
+		}
+	}
+	if stats.PacketsSent > 0 {
+		stats.PacketLoss = float64(stats.PacketsSent-stats.PacketsRecv) / float64(stats.PacketsSent) * 100
+	}
+	if p.opts.Classifier != nil {
+		p.classify(r)
+	}
+	return r, nil
+}
+
+// classify sets the address classifications of r.
+func (p *ICMPProber) classify(r *ICMPResult) {
+	c := p.opts.Classifier
+	r.DestinationInfo = classifyAddress(c, r.Destination)
+	r.ReplySourceInfo = classifyAddress(c, r.ReplySource)
+	for i := range r.Route {
+		r.Route[i].Info = classifyAddress(c, r.Route[i].Address)
+	}
+	for i := range r.Errors {
+		r.Errors[i].FromInfo = classifyAddress(c, r.Errors[i].From)
+	}
+}
+
+// ICMPSweepStep holds the statistics of the echoes of one payload size.
+type ICMPSweepStep struct {
+	Size        int
+	PacketsSent int
+	PacketsRecv int
+	// PacketLoss is the percentage of packets lost.
+	PacketLoss float64
+	MinRtt     time.Duration
+	AvgRtt     time.Duration
+	MaxRtt     time.Duration
+}
+
+// ICMPSweepResult is the result of an ICMPProber in sweep mode.
+type ICMPSweepResult struct {
+	Target
+
+	Steps []ICMPSweepStep
+}
+
+// RTT returns the average RTT over all replies.
+func (r ICMPSweepResult) RTT() time.Duration {
+	var total time.Duration
+	var n int
+	for _, s := range r.Steps {
+		total += s.AvgRtt * time.Duration(s.PacketsRecv)
+		n += s.PacketsRecv
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / time.Duration(n)
+}
+
+func (r ICMPSweepResult) String() string {
+	var b strings.Builder
+	for _, s := range r.Steps {
+		fmt.Fprintf(&b, "%d bytes: %d packets transmitted, %d packets received, %v%% packet loss, avg %v\n",
+			s.Size, s.PacketsSent, s.PacketsRecv, s.PacketLoss, s.AvgRtt)
+	}
+	return b.String()
+}
+
+func (p *ICMPProber) sweep(target Target) (Result, error) {
+	r := &ICMPSweepResult{Target: target}
+	for size := p.opts.Sweep.MinSize; size <= p.opts.Sweep.MaxSize; size += p.opts.Sweep.Step {
+		res, err := p.echo(target, size, nil)
+		if err != nil {
+			return nil, err
+		}
+		stats := res.Stats
+		r.Steps = append(r.Steps, ICMPSweepStep{
+			Size:        size,
+			PacketsSent: stats.PacketsSent,
+			PacketsRecv: stats.PacketsRecv,
+			PacketLoss:  stats.PacketLoss,
+			MinRtt:      stats.MinRtt,
+			AvgRtt:      stats.AvgRtt,
+			MaxRtt:      stats.MaxRtt,
+		})
+	}
 	return r, nil
 }
@@ -0,0 +1,174 @@
+package libprobe
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ICMPResponder aggregates the echo replies of one host answering a
+// broadcast or multicast probe.
+type ICMPResponder struct {
+	Address string
+	Replies int
+	MinRtt  time.Duration
+	AvgRtt  time.Duration
+	MaxRtt  time.Duration
+	TTL     int
+}
+
+// ICMPBroadcastResult is the result of an ICMPProber in broadcast mode.
+type ICMPBroadcastResult struct {
+	Target
+
+	PacketsSent int
+	// Responders are ordered by average RTT.
+	Responders []ICMPResponder
+}
+
+// RTT returns the average RTT of the fastest responder.
+func (r ICMPBroadcastResult) RTT() time.Duration {
+	if len(r.Responders) == 0 {
+		return 0
+	}
+	return r.Responders[0].AvgRtt
+}
+
+func (r ICMPBroadcastResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d packets transmitted, %d responders\n", r.PacketsSent, len(r.Responders))
+	for _, resp := range r.Responders {
+		fmt.Fprintf(&b, "%s: %d replies, ttl=%d, min/avg/max = %v/%v/%v\n",
+			resp.Address, resp.Replies, resp.TTL, resp.MinRtt, resp.AvgRtt, resp.MaxRtt)
+	}
+	return b.String()
+}
+
+// broadcast sends Target.Count echoes to a broadcast or multicast address
+// and collects every responder until Target.Timeout, which defaults to one
+// second after the last echo.
+func (p *ICMPProber) broadcast(target Target) (Result, error) {
+	addr, err := resolveIPAddr("ip", target.Address)
+	if err != nil {
+		return nil, err
+	}
+	isIPv6 := addr.IP.To4() == nil
+	sock, err := listenICMP(isIPv6, p.opts.Privileged)
+	if err != nil {
+		return nil, err
+	}
+	defer sock.Close()
+
+	ttl := p.opts.MulticastTTL
+	if ttl <= 0 {
+		ttl = 1
+	}
+	if isIPv6 {
+		err = ipv6.NewPacketConn(sock.conn).SetMulticastHopLimit(ttl)
+	} else {
+		if err = setBroadcast(sock.conn); err == nil {
+			err = ipv4.NewPacketConn(sock.conn).SetMulticastTTL(ttl)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	count := target.GetCount()
+	interval := target.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = time.Duration(count-1)*interval + time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	if err := sock.conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	r := &ICMPBroadcastResult{Target: target}
+	var mu sync.Mutex
+	var sendErr error
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for seq := 0; seq < count && time.Now().Before(deadline); seq++ {
+			err := sock.sendEcho(addr.IP, seq, sock.payload(p.opts.Size, p.fill(p.opts.Size-icmpHeaderLen, target)))
+			mu.Lock()
+			if err != nil {
+				sendErr = err
+				mu.Unlock()
+				return
+			}
+			r.PacketsSent++
+			mu.Unlock()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	responders := make(map[string]*ICMPResponder)
+	total := make(map[string]time.Duration)
+	buf := make([]byte, 1500)
+	for {
+		pkt, err := sock.recv(buf)
+		if err != nil {
+			if errors.Is(err, errNotOurs) {
+				continue
+			}
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				break
+			}
+			close(stop)
+			<-done
+			return nil, err
+		}
+		if pkt.Sent.IsZero() {
+			continue
+		}
+		rtt := pkt.Received.Sub(pkt.Sent)
+		key := pkt.From.String()
+		resp, ok := responders[key]
+		if !ok {
+			resp = &ICMPResponder{Address: key, MinRtt: rtt, TTL: pkt.TTL}
+			responders[key] = resp
+		}
+		resp.Replies++
+		total[key] += rtt
+		if rtt < resp.MinRtt {
+			resp.MinRtt = rtt
+		}
+		if rtt > resp.MaxRtt {
+			resp.MaxRtt = rtt
+		}
+	}
+	close(stop)
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	if sendErr != nil {
+		return nil, sendErr
+	}
+	for key, resp := range responders {
+		resp.AvgRtt = total[key] / time.Duration(resp.Replies)
+		r.Responders = append(r.Responders, *resp)
+	}
+	sort.Slice(r.Responders, func(i, j int) bool { return r.Responders[i].AvgRtt < r.Responders[j].AvgRtt })
+	return r, nil
+}
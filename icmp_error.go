@@ -0,0 +1,99 @@
+package libprobe
+
+import "fmt"
+
+// ICMPError is an ICMP error message received instead of an echo reply.
+type ICMPError struct {
+	Seq int
+	// From is the address of the router or host reporting the error, and
+	// FromInfo its classification when the prober has a Classifier.
+	From     string
+	FromInfo *AddressInfo
+	IPv6     bool
+	Type     int
+	Code     int
+	// MTU is the next-hop MTU of "fragmentation needed" and "packet too
+	// big" messages.
+	MTU int
+}
+
+var icmpErrorNames = map[int]string{
+	3:  "destination unreachable",
+	4:  "source quench",
+	5:  "redirect",
+	11: "time exceeded",
+	12: "parameter problem",
+}
+
+var icmpv6ErrorNames = map[int]string{
+	1: "destination unreachable",
+	2: "packet too big",
+	3: "time exceeded",
+	4: "parameter problem",
+}
+
+var icmpUnreachableCodes = map[int]string{
+	0:  "net unreachable",
+	1:  "host unreachable",
+	2:  "protocol unreachable",
+	3:  "port unreachable",
+	4:  "fragmentation needed",
+	5:  "source route failed",
+	6:  "destination network unknown",
+	7:  "destination host unknown",
+	8:  "source host isolated",
+	9:  "network administratively prohibited",
+	10: "host administratively prohibited",
+	11: "network unreachable for TOS",
+	12: "host unreachable for TOS",
+	13: "communication administratively prohibited",
+	14: "host precedence violation",
+	15: "precedence cutoff in effect",
+}
+
+var icmpv6UnreachableCodes = map[int]string{
+	0: "no route to destination",
+	1: "communication administratively prohibited",
+	2: "beyond scope of source address",
+	3: "address unreachable",
+	4: "port unreachable",
+	5: "source address failed ingress/egress policy",
+	6: "reject route to destination",
+}
+
+// Unreachable reports whether the error is a destination unreachable message.
+func (e ICMPError) Unreachable() bool {
+	return (!e.IPv6 && e.Type == 3) || (e.IPv6 && e.Type == 1)
+}
+
+// AdminProhibited reports whether a filter rejected the echo request, as
+// opposed to it being lost or the destination being unreachable.
+func (e ICMPError) AdminProhibited() bool {
+	if !e.Unreachable() {
+		return false
+	}
+	if e.IPv6 {
+		return e.Code == 1 || e.Code == 5
+	}
+	return e.Code == 9 || e.Code == 10 || e.Code == 13
+}
+
+func (e ICMPError) String() string {
+	names, codes := icmpErrorNames, icmpUnreachableCodes
+	if e.IPv6 {
+		names, codes = icmpv6ErrorNames, icmpv6UnreachableCodes
+	}
+	name, ok := names[e.Type]
+	if !ok {
+		name = fmt.Sprintf("type %d", e.Type)
+	}
+	detail := fmt.Sprintf("code %d", e.Code)
+	if c, ok := codes[e.Code]; ok && e.Unreachable() {
+		detail = c
+	}
+	s := fmt.Sprintf("%s from %s: %s", name, e.From, detail)
+	if e.MTU > 0 {
+		s += fmt.Sprintf(" (mtu %d)", e.MTU)
+	}
+	return s
+}
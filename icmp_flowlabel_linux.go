@@ -0,0 +1,94 @@
+package libprobe
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Linux IPv6 socket options not defined by package syscall.
+const (
+	ipv6FlowInfo     = 11
+	ipv6FlowLabelMgr = 32
+
+	ipv6FlowLabelMask = 0xfffff
+)
+
+// in6FlowLabelReq is struct in6_flowlabel_req.
+type in6FlowLabelReq struct {
+	dst     [16]byte
+	label   [4]byte
+	action  uint8
+	share   uint8
+	flags   uint16
+	expires uint16
+	linger  uint16
+	_       uint32
+}
+
+func rawControl(conn net.PacketConn, fn func(fd int) error) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return syscall.EINVAL
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
+
+// enableFlowInfo makes conn receive the flow information of IPv6 packets.
+func enableFlowInfo(conn net.PacketConn) error {
+	return rawControl(conn, func(fd int) error {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6FlowInfo, 1)
+	})
+}
+
+// flowLabelControlMessage leases label towards dst, which Linux requires
+// before a socket may use a flow label, and returns the control message
+// applying it to sent packets.
+func flowLabelControlMessage(conn net.PacketConn, dst net.IP, label uint32) ([]byte, error) {
+	req := in6FlowLabelReq{
+		share: 255, // IPV6_FL_S_ANY
+		flags: 1,   // IPV6_FL_F_CREATE
+	}
+	copy(req.dst[:], dst.To16())
+	binary.BigEndian.PutUint32(req.label[:], label&ipv6FlowLabelMask)
+	err := rawControl(conn, func(fd int) error {
+		b := (*[unsafe.Sizeof(req)]byte)(unsafe.Pointer(&req))[:]
+		return syscall.SetsockoptString(fd, syscall.IPPROTO_IPV6, ipv6FlowLabelMgr, string(b))
+	})
+	if err != nil {
+		return nil, err
+	}
+	oob := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_IPV6
+	h.Type = ipv6FlowInfo
+	h.SetLen(syscall.CmsgLen(4))
+	copy(oob[syscall.CmsgLen(0):], req.label[:])
+	return oob, nil
+}
+
+// parseFlowLabel returns the flow label carried in control messages.
+func parseFlowLabel(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == ipv6FlowInfo && len(m.Data) >= 4 {
+			return int(binary.BigEndian.Uint32(m.Data) & ipv6FlowLabelMask)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package libprobe
+
+import (
+	"errors"
+	"net"
+)
+
+func enableFlowInfo(conn net.PacketConn) error {
+	return nil
+}
+
+func flowLabelControlMessage(conn net.PacketConn, dst net.IP, label uint32) ([]byte, error) {
+	return nil, errors.New("icmp: setting flow labels is only supported on Linux")
+}
+
+func parseFlowLabel(oob []byte) int {
+	return 0
+}
@@ -0,0 +1,139 @@
+package libprobe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPv4Option is an IPv4 header option set on echo requests. Replies carry
+// the option back, with the data recorded on both the forward and the return
+// path, which is occasionally the only way to see reverse paths. Many
+// routers ignore or drop packets with options.
+type IPv4Option int
+
+const (
+	IPv4OptionNone IPv4Option = iota
+	// IPv4OptionRecordRoute records up to nine addresses (RFC 791).
+	IPv4OptionRecordRoute
+	// IPv4OptionTimestamp records up to nine timestamps (RFC 791).
+	IPv4OptionTimestamp
+	// IPv4OptionTimestampAddr records up to four addresses together with
+	// timestamps.
+	IPv4OptionTimestampAddr
+)
+
+const (
+	ipOptEnd         = 0
+	ipOptNop         = 1
+	ipOptRecordRoute = 7
+	ipOptTimestamp   = 68
+
+	ipOptTSOnly    = 0
+	ipOptTSAndAddr = 1
+	ipOptTSPrespec = 3
+)
+
+// bytes returns the option as sent, padded to a multiple of four bytes.
+func (o IPv4Option) bytes() []byte {
+	var b []byte
+	switch o {
+	case IPv4OptionRecordRoute:
+		b = make([]byte, 40)
+		b[0], b[1], b[2] = ipOptRecordRoute, 39, 4
+		b[39] = ipOptEnd
+	case IPv4OptionTimestamp:
+		b = make([]byte, 40)
+		b[0], b[1], b[2], b[3] = ipOptTimestamp, 40, 5, ipOptTSOnly
+	case IPv4OptionTimestampAddr:
+		b = make([]byte, 36)
+		b[0], b[1], b[2], b[3] = ipOptTimestamp, 36, 5, ipOptTSAndAddr
+	}
+	return b
+}
+
+// ICMPRouteHop is an entry recorded by an IPv4 option. Timestamp is in
+// milliseconds since midnight UT as defined by RFC 791; routers set the
+// high bit for non-standard values.
+type ICMPRouteHop struct {
+	Address      string
+	Timestamp    uint32
+	HasTimestamp bool
+	// Info classifies Address when the prober has a Classifier.
+	Info *AddressInfo
+}
+
+func (h ICMPRouteHop) String() string {
+	switch {
+	case h.Address != "" && h.HasTimestamp:
+		return fmt.Sprintf("%s@%d", h.Address, h.Timestamp)
+	case h.HasTimestamp:
+		return fmt.Sprint(h.Timestamp)
+	}
+	return h.Address
+}
+
+func formatRoute(hops []ICMPRouteHop) string {
+	s := make([]string, len(hops))
+	for i, h := range hops {
+		s[i] = h.String()
+	}
+	return strings.Join(s, " ")
+}
+
+// parseIPv4Options returns the entries recorded in Record Route and
+// Timestamp options. Malformed options end parsing.
+func parseIPv4Options(b []byte) []ICMPRouteHop {
+	var hops []ICMPRouteHop
+	for len(b) > 0 {
+		switch b[0] {
+		case ipOptEnd:
+			return hops
+		case ipOptNop:
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || int(b[1]) < 2 || int(b[1]) > len(b) {
+			return hops
+		}
+		opt := b[:b[1]]
+		b = b[b[1]:]
+		if len(opt) < 3 {
+			continue
+		}
+		// The pointer is 1-based and points past the recorded data.
+		end := int(opt[2]) - 1
+		if end > len(opt) {
+			end = len(opt)
+		}
+		switch opt[0] {
+		case ipOptRecordRoute:
+			for i := 3; i+4 <= end; i += 4 {
+				hops = append(hops, ICMPRouteHop{Address: net.IP(opt[i : i+4]).String()})
+			}
+		case ipOptTimestamp:
+			if len(opt) < 4 {
+				continue
+			}
+			switch opt[3] & 0x0f {
+			case ipOptTSOnly:
+				for i := 4; i+4 <= end; i += 4 {
+					hops = append(hops, ICMPRouteHop{
+						Timestamp:    binary.BigEndian.Uint32(opt[i:]),
+						HasTimestamp: true,
+					})
+				}
+			case ipOptTSAndAddr, ipOptTSPrespec:
+				for i := 4; i+8 <= end; i += 8 {
+					hops = append(hops, ICMPRouteHop{
+						Address:      net.IP(opt[i : i+4]).String(),
+						Timestamp:    binary.BigEndian.Uint32(opt[i+4:]),
+						HasTimestamp: true,
+					})
+				}
+			}
+		}
+	}
+	return hops
+}
@@ -0,0 +1,373 @@
+package libprobe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+
+	// icmpHeaderLen is the length of the timestamp and tracker leading
+	// every echo payload.
+	icmpHeaderLen = 16
+	// icmpDefaultSize is the default echo payload size.
+	icmpDefaultSize = 24
+)
+
+// icmpSocket sends ICMP echo requests and reads what comes back. It uses a
+// raw socket when privileged and an unprivileged datagram ("ping") socket
+// otherwise, in which case the kernel assigns the echo identifier.
+type icmpSocket struct {
+	conn    net.PacketConn
+	p4      *ipv4.PacketConn
+	p6      *ipv6.PacketConn
+	ipv6    bool
+	raw     bool
+	id      int
+	tracker []byte
+	// oob is the control message sent with every echo request.
+	oob []byte
+}
+
+// icmpPacket is an ICMP message received by an icmpSocket.
+type icmpPacket struct {
+	From net.IP
+	Type int
+	Code int
+	ID   int
+	Seq  int
+	Data []byte
+	TTL  int
+	// Options are the IPv4 header options, read on raw IPv4 sockets only.
+	Options []byte
+	// TrafficClass and FlowLabel are read from IPv6 packets; flow labels
+	// on Linux only.
+	TrafficClass int
+	FlowLabel    int
+	Received     time.Time
+	// Sent is the send time carried in the payload of echo replies.
+	Sent time.Time
+
+	// IsError is set for ICMP error messages quoting an echo request. Dst
+	// is the destination of the quoted request and MTU the next-hop MTU
+	// of "fragmentation needed" and "packet too big" messages.
+	IsError bool
+	Dst     net.IP
+	MTU     int
+}
+
+func listenICMP(isIPv6, privileged bool) (*icmpSocket, error) {
+	var conn net.PacketConn
+	var err error
+	switch {
+	case privileged && !isIPv6:
+		conn, err = net.ListenPacket("ip4:icmp", "0.0.0.0")
+	case privileged:
+		conn, err = net.ListenPacket("ip6:ipv6-icmp", "::")
+	default:
+		conn, err = listenPingSocket(isIPv6)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &icmpSocket{
+		conn:    conn,
+		ipv6:    isIPv6,
+		raw:     privileged,
+		tracker: make([]byte, 8),
+	}
+	if _, err := rand.Read(s.tracker); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.id = int(binary.BigEndian.Uint16(s.tracker))
+	switch {
+	case isIPv6:
+		s.p6 = ipv6.NewPacketConn(conn)
+		if err = s.p6.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagTrafficClass, true); err == nil {
+			err = enableFlowInfo(conn)
+		}
+	case !privileged:
+		s.p4 = ipv4.NewPacketConn(conn)
+		err = s.p4.SetControlMessage(ipv4.FlagTTL, true)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *icmpSocket) Close() error {
+	return s.conn.Close()
+}
+
+// setFlowLabel makes echo requests to dst carry an IPv6 flow label.
+func (s *icmpSocket) setFlowLabel(dst net.IP, label int) error {
+	oob, err := flowLabelControlMessage(s.conn, dst, uint32(label))
+	if err != nil {
+		return err
+	}
+	s.oob = oob
+	return nil
+}
+
+func readMsg(conn net.PacketConn, b, oob []byte) (n, oobn int, src net.Addr, err error) {
+	switch c := conn.(type) {
+	case *net.IPConn:
+		var addr *net.IPAddr
+		n, oobn, _, addr, err = c.ReadMsgIP(b, oob)
+		if err == nil {
+			src = addr
+		}
+	case *net.UDPConn:
+		var addr *net.UDPAddr
+		n, oobn, _, addr, err = c.ReadMsgUDP(b, oob)
+		if err == nil {
+			src = addr
+		}
+	default:
+		n, src, err = conn.ReadFrom(b)
+	}
+	return n, oobn, src, err
+}
+
+func writeMsg(conn net.PacketConn, b, oob []byte, dst net.Addr) (err error) {
+	switch c := conn.(type) {
+	case *net.IPConn:
+		_, _, err = c.WriteMsgIP(b, oob, dst.(*net.IPAddr))
+	case *net.UDPConn:
+		_, _, err = c.WriteMsgUDP(b, oob, dst.(*net.UDPAddr))
+	default:
+		_, err = conn.WriteTo(b, dst)
+	}
+	return err
+}
+
+func (s *icmpSocket) addr(ip net.IP) net.Addr {
+	if s.raw {
+		return &net.IPAddr{IP: ip}
+	}
+	return &net.UDPAddr{IP: ip}
+}
+
+// payload returns an echo payload of size bytes (at least icmpHeaderLen)
+// carrying the send time and the socket's tracker, padded with fill.
+func (s *icmpSocket) payload(size int, fill []byte) []byte {
+	if size < icmpHeaderLen {
+		size = icmpHeaderLen
+	}
+	b := make([]byte, icmpHeaderLen, size)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	copy(b[8:], s.tracker)
+	for len(b) < size {
+		if len(fill) == 0 {
+			b = append(b, 0)
+			continue
+		}
+		n := size - len(b)
+		if n > len(fill) {
+			n = len(fill)
+		}
+		b = append(b, fill[:n]...)
+	}
+	return b
+}
+
+// sendEcho sends an echo request with the given payload to dst.
+func (s *icmpSocket) sendEcho(dst net.IP, seq int, payload []byte) error {
+	if err := checkGuard("ip", dst.String()); err != nil {
+		return err
+	}
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if s.ipv6 {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+	msg := icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{ID: s.id, Seq: seq, Data: payload},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	return writeMsg(s.conn, b, s.oob, s.addr(dst))
+}
+
+var errNotOurs = errors.New("icmp: message of another prober")
+
+// recv reads the next ICMP message until the read deadline. Echo replies not
+// carrying the socket's tracker are skipped with errNotOurs.
+func (s *icmpSocket) recv(buf []byte) (*icmpPacket, error) {
+	var n, ttl, tclass, flowLabel int
+	var src net.Addr
+	var options []byte
+	var err error
+	switch {
+	case s.ipv6:
+		// Read control messages directly to see flow labels, which
+		// ipv6.ControlMessage doesn't know.
+		oob := ipv6.NewControlMessage(ipv6.FlagHopLimit | ipv6.FlagTrafficClass)
+		oob = append(oob, make([]byte, 64)...)
+		var oobn int
+		if n, oobn, src, err = readMsg(s.conn, buf, oob); err != nil {
+			break
+		}
+		var cm ipv6.ControlMessage
+		if err = cm.Parse(oob[:oobn]); err != nil {
+			return nil, err
+		}
+		ttl, tclass = cm.HopLimit, cm.TrafficClass
+		flowLabel = parseFlowLabel(oob[:oobn])
+	case s.raw:
+		// Raw IPv4 sockets return the IP header, options included, from
+		// ReadMsgIP.
+		if n, _, src, err = readMsg(s.conn, buf, nil); err != nil {
+			break
+		}
+		var h *ipv4.Header
+		if h, err = ipv4.ParseHeader(buf[:n]); err != nil {
+			return nil, err
+		}
+		ttl = h.TTL
+		options = append(options, h.Options...)
+		buf = buf[h.Len:n]
+		n -= h.Len
+	default:
+		var cm *ipv4.ControlMessage
+		n, cm, src, err = s.p4.ReadFrom(buf)
+		if cm != nil {
+			ttl = cm.TTL
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := &icmpPacket{
+		TTL:          ttl,
+		Options:      options,
+		TrafficClass: tclass,
+		FlowLabel:    flowLabel,
+		Received:     time.Now(),
+	}
+	switch addr := src.(type) {
+	case *net.IPAddr:
+		p.From = addr.IP
+	case *net.UDPAddr:
+		p.From = addr.IP
+	}
+	if err := parseICMPPacket(p, buf[:n], s.ipv6, s.raw, s.id, s.tracker); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseICMPPacket fills p from the ICMP message b, read from a socket with
+// the given echo identifier and tracker. Echo replies and errors which don't
+// answer the socket's requests are rejected with errNotOurs. It reads b only,
+// so malformed messages from hostile networks can be fuzzed without sockets.
+func parseICMPPacket(p *icmpPacket, b []byte, isIPv6, raw bool, id int, tracker []byte) error {
+	proto := protocolICMP
+	if isIPv6 {
+		proto = protocolIPv6ICMP
+	}
+	msg, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		return err
+	}
+	p.Type = int(b[0])
+	p.Code = msg.Code
+	if echo, ok := msg.Body.(*icmp.Echo); ok {
+		if msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply {
+			return errNotOurs
+		}
+		if len(echo.Data) < icmpHeaderLen || !bytes.Equal(echo.Data[8:16], tracker) {
+			return errNotOurs
+		}
+		p.ID = echo.ID
+		p.Seq = echo.Seq
+		p.Data = echo.Data
+		p.Sent = time.Unix(0, int64(binary.BigEndian.Uint64(echo.Data)))
+		return nil
+	}
+	if !parseICMPError(p, b, isIPv6, raw, id, tracker) {
+		return errNotOurs
+	}
+	return nil
+}
+
+// parseICMPError fills p from an ICMP error message quoting one of the
+// socket's echo requests, and reports whether it did.
+func parseICMPError(p *icmpPacket, b []byte, isIPv6, raw bool, id int, tracker []byte) bool {
+	if len(b) < 8 {
+		return false
+	}
+	typ := int(b[0])
+	if isIPv6 {
+		switch typ {
+		case 1, 3, 4: // destination unreachable, time exceeded, parameter problem
+		case 2: // packet too big
+			p.MTU = int(binary.BigEndian.Uint32(b[4:8]))
+		default:
+			return false
+		}
+	} else {
+		switch typ {
+		case 3: // destination unreachable
+			if b[1] == 4 { // fragmentation needed
+				p.MTU = int(binary.BigEndian.Uint16(b[6:8]))
+			}
+		case 4, 5, 11, 12: // source quench, redirect, time exceeded, parameter problem
+		default:
+			return false
+		}
+	}
+	// The message quotes the IP header and the start of the echo request.
+	quoted := b[8:]
+	var echo []byte
+	if isIPv6 {
+		if len(quoted) < 40 || quoted[6] != protocolIPv6ICMP {
+			return false
+		}
+		p.Dst = net.IP(append([]byte(nil), quoted[24:40]...))
+		echo = quoted[40:]
+	} else {
+		if len(quoted) < 20 || quoted[9] != protocolICMP {
+			return false
+		}
+		hlen := int(quoted[0]&0x0f) << 2
+		if hlen < 20 || len(quoted) < hlen {
+			return false
+		}
+		p.Dst = net.IPv4(quoted[16], quoted[17], quoted[18], quoted[19])
+		echo = quoted[hlen:]
+	}
+	if len(echo) < 8 {
+		return false
+	}
+	if echo[0] != byte(ipv4.ICMPTypeEcho) && echo[0] != byte(ipv6.ICMPTypeEchoRequest) {
+		return false
+	}
+	p.ID = int(binary.BigEndian.Uint16(echo[4:6]))
+	p.Seq = int(binary.BigEndian.Uint16(echo[6:8]))
+	// Ping sockets only deliver errors of their own requests, raw sockets
+	// see all of them.
+	if raw && p.ID != id {
+		return false
+	}
+	if len(echo) >= 8+icmpHeaderLen && !bytes.Equal(echo[16:24], tracker) {
+		return false
+	}
+	p.IsError = true
+	return true
+}
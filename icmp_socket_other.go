@@ -0,0 +1,23 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package libprobe
+
+import (
+	"errors"
+	"net"
+)
+
+var errICMPUnsupported = errors.New("icmp: not supported on this platform")
+
+func listenPingSocket(isIPv6 bool) (net.PacketConn, error) {
+	return nil, errICMPUnsupported
+}
+
+func setBroadcast(conn net.PacketConn) error {
+	return errICMPUnsupported
+}
+
+func setIPOptions(conn net.PacketConn, options []byte) error {
+	return errICMPUnsupported
+}
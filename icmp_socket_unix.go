@@ -0,0 +1,83 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package libprobe
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// ipStripHdr is Darwin's IP_STRIPHDR socket option.
+const ipStripHdr = 0x17
+
+// listenPingSocket opens an unprivileged ICMP datagram socket.
+func listenPingSocket(isIPv6 bool) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, protocolICMP
+	var sa syscall.Sockaddr = &syscall.SockaddrInet4{}
+	if isIPv6 {
+		family, proto = syscall.AF_INET6, protocolIPv6ICMP
+		sa = &syscall.SockaddrInet6{}
+	}
+	s, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if runtime.GOOS == "darwin" && !isIPv6 {
+		if err := syscall.SetsockoptInt(s, syscall.IPPROTO_IP, ipStripHdr, 1); err != nil {
+			syscall.Close(s)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := syscall.Bind(s, sa); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	f := os.NewFile(uintptr(s), "icmp")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+// setSockoptInt sets an integer socket option on conn.
+func setSockoptInt(conn net.PacketConn, level, name, value int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return syscall.EINVAL
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, name, value)
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
+
+func setBroadcast(conn net.PacketConn) error {
+	return setSockoptInt(conn, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+}
+
+// setIPOptions sets the IPv4 options of packets sent on conn.
+func setIPOptions(conn net.PacketConn, options []byte) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return syscall.EINVAL
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_IP, syscall.IP_OPTIONS, string(options))
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
@@ -1,7 +1,10 @@
 package libprobe_test
 
 import (
+	"bytes"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/blho/libprobe"
 
@@ -17,3 +20,209 @@ func TestICMP(t *testing.T) {
 	require.NoError(t, err)
 	t.Logf("RTT: %s\n%s", r.RTT(), r.String())
 }
+
+func TestICMPProbeStream(t *testing.T) {
+	prober := libprobe.NewICMPProber(true)
+	var replies []libprobe.ICMPReply
+	r, err := prober.ProbeStream(libprobe.Target{
+		Address:  "127.0.0.1",
+		Count:    3,
+		Interval: 10 * time.Millisecond,
+		Timeout:  time.Second,
+	}, func(reply libprobe.ICMPReply) {
+		replies = append(replies, reply)
+	})
+	if err != nil {
+		t.Skipf("ICMP unavailable: %v", err)
+	}
+	require.Len(t, replies, 3)
+	for i, reply := range replies {
+		require.Equal(t, i, reply.Seq)
+		require.Equal(t, "127.0.0.1", reply.From)
+		require.Equal(t, 32, reply.Bytes)
+	}
+	res := r.(*libprobe.ICMPResult)
+	require.Equal(t, 3, res.Stats.PacketsRecv)
+	require.Equal(t, []int{0, 1, 2}, res.ReplySeqs)
+	require.Equal(t, "127.0.0.1", res.Destination)
+	require.Equal(t, "127.0.0.1", res.ReplySource)
+	require.False(t, res.SourceMismatch)
+}
+
+func TestICMPSweep(t *testing.T) {
+	prober := libprobe.NewICMPProberWithOptions(libprobe.ICMPProberOptions{
+		Privileged: true,
+		Sweep:      &libprobe.ICMPSweep{MinSize: 0, MaxSize: 1500, Step: 500},
+	})
+	r, err := prober.Probe(libprobe.Target{
+		Address:  "127.0.0.1",
+		Count:    2,
+		Interval: 10 * time.Millisecond,
+		Timeout:  time.Second,
+	})
+	if err != nil {
+		t.Skipf("ICMP unavailable: %v", err)
+	}
+	sweep := r.(*libprobe.ICMPSweepResult)
+	require.Len(t, sweep.Steps, 3)
+	for i, step := range sweep.Steps {
+		require.Equal(t, 16+i*500, step.Size)
+		require.Equal(t, 2, step.PacketsRecv)
+	}
+	rows := libprobe.Flatten(r)
+	require.Len(t, rows, 4)
+	require.Equal(t, "steps", rows[1][libprobe.ColumnRow])
+}
+
+func TestICMPBroadcast(t *testing.T) {
+	prober := libprobe.NewICMPProberWithOptions(libprobe.ICMPProberOptions{
+		Privileged: true,
+		Broadcast:  true,
+	})
+	r, err := prober.Probe(libprobe.Target{
+		Address:  "127.0.0.1",
+		Count:    3,
+		Interval: 10 * time.Millisecond,
+		Timeout:  200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Skipf("ICMP unavailable: %v", err)
+	}
+	broadcast := r.(*libprobe.ICMPBroadcastResult)
+	require.Equal(t, 3, broadcast.PacketsSent)
+	require.Len(t, broadcast.Responders, 1)
+	require.Equal(t, "127.0.0.1", broadcast.Responders[0].Address)
+	require.Equal(t, 3, broadcast.Responders[0].Replies)
+	require.True(t, broadcast.Responders[0].TTL > 0)
+}
+
+func TestICMPPayload(t *testing.T) {
+	sniffer, err := net.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("ICMP unavailable: %v", err)
+	}
+	defer sniffer.Close()
+
+	prober := libprobe.NewICMPProberWithOptions(libprobe.ICMPProberOptions{
+		Privileged: true,
+		Size:       64,
+		Payload:    libprobe.ICMPPayload{Tag: "agent-7 ", Pattern: []byte{0xde, 0xad}},
+	})
+	var replies []libprobe.ICMPReply
+	_, err = prober.ProbeStream(libprobe.Target{Address: "127.0.0.1", Timeout: time.Second}, func(r libprobe.ICMPReply) {
+		replies = append(replies, r)
+	})
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	require.Equal(t, 72, replies[0].Bytes)
+
+	require.NoError(t, sniffer.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 1500)
+	n, _, err := sniffer.ReadFrom(buf)
+	require.NoError(t, err)
+	// ICMP header, timestamp and tracker precede the fill.
+	payload := buf[8+16 : n]
+	require.Len(t, payload, 48)
+	require.Equal(t, "agent-7 ", string(payload[:8]))
+	require.Equal(t, bytes.Repeat([]byte{0xde, 0xad}, 20), payload[8:])
+}
+
+func TestICMPPayloadLongTag(t *testing.T) {
+	sniffer, err := net.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("ICMP unavailable: %v", err)
+	}
+	defer sniffer.Close()
+
+	tag := "agent-7 operated by noc@example.net"
+	for _, tc := range []struct {
+		name    string
+		size    int
+		payload libprobe.ICMPPayload
+		target  libprobe.Target
+		want    string
+	}{
+		{"zeros", 24, libprobe.ICMPPayload{Tag: tag}, libprobe.Target{}, tag[:8]},
+		{"pattern", 24, libprobe.ICMPPayload{Tag: tag, Pattern: []byte{0xde, 0xad}}, libprobe.Target{}, tag[:8]},
+		{"random", 24, libprobe.ICMPPayload{Tag: tag, Random: true}, libprobe.Target{}, tag[:8]},
+		{"exact", 16 + len(tag), libprobe.ICMPPayload{Tag: tag, Random: true}, libprobe.Target{}, tag},
+		{"probe id", 24, libprobe.ICMPPayload{Tag: "agent", Random: true}, libprobe.Target{ProbeID: "p-1"}, "agent pr"},
+		{"no room", 16, libprobe.ICMPPayload{Tag: tag, Random: true}, libprobe.Target{}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prober := libprobe.NewICMPProberWithOptions(libprobe.ICMPProberOptions{
+				Privileged: true,
+				Size:       tc.size,
+				Payload:    tc.payload,
+			})
+			target := tc.target
+			target.Address = "127.0.0.1"
+			target.Timeout = time.Second
+			r, err := prober.Probe(target)
+			require.NoError(t, err)
+			require.Equal(t, 1, r.(*libprobe.ICMPResult).Stats.PacketsRecv)
+
+			// The echo request and its reply both reach the sniffer.
+			require.NoError(t, sniffer.SetReadDeadline(time.Now().Add(time.Second)))
+			buf := make([]byte, 1500)
+			for i := 0; i < 2; i++ {
+				n, _, err := sniffer.ReadFrom(buf)
+				require.NoError(t, err)
+				require.Equal(t, tc.want, string(buf[8+16:n]))
+			}
+		})
+	}
+}
+
+func TestICMPRecordRoute(t *testing.T) {
+	prober := libprobe.NewICMPProberWithOptions(libprobe.ICMPProberOptions{
+		Privileged: true,
+		IPOption:   libprobe.IPv4OptionRecordRoute,
+	})
+	r, err := prober.Probe(libprobe.Target{Address: "127.0.0.1", Timeout: time.Second})
+	if err != nil {
+		t.Skipf("ICMP unavailable: %v", err)
+	}
+	route := r.(*libprobe.ICMPResult).Route
+	require.NotEmpty(t, route)
+	for _, hop := range route {
+		require.Equal(t, "127.0.0.1", hop.Address)
+	}
+
+	prober = libprobe.NewICMPProberWithOptions(libprobe.ICMPProberOptions{
+		Privileged: true,
+		IPOption:   libprobe.IPv4OptionTimestampAddr,
+	})
+	r, err = prober.Probe(libprobe.Target{Address: "127.0.0.1", Timeout: time.Second})
+	require.NoError(t, err)
+	route = r.(*libprobe.ICMPResult).Route
+	require.NotEmpty(t, route)
+	require.True(t, route[0].HasTimestamp)
+}
+
+func TestICMPTrafficClass(t *testing.T) {
+	prober := libprobe.NewICMPProberWithOptions(libprobe.ICMPProberOptions{
+		Privileged:   true,
+		TrafficClass: 0x28,
+		FlowLabel:    0x12345,
+	})
+	r, err := prober.Probe(libprobe.Target{Address: "::1", Timeout: time.Second})
+	if err != nil {
+		t.Skipf("ICMPv6 unavailable: %v", err)
+	}
+	res := r.(*libprobe.ICMPResult)
+	require.Equal(t, 1, res.Stats.PacketsRecv)
+	require.Equal(t, 0x28, res.ReplyTrafficClass)
+}
+
+func TestICMPError(t *testing.T) {
+	e := libprobe.ICMPError{From: "192.0.2.1", Type: 3, Code: 13}
+	require.True(t, e.Unreachable())
+	require.True(t, e.AdminProhibited())
+	require.Equal(t, "destination unreachable from 192.0.2.1: communication administratively prohibited", e.String())
+
+	e = libprobe.ICMPError{From: "2001:db8::1", IPv6: true, Type: 2, MTU: 1280}
+	require.False(t, e.Unreachable())
+	require.False(t, e.AdminProhibited())
+	require.Equal(t, "packet too big from 2001:db8::1: code 0 (mtu 1280)", e.String())
+}
@@ -0,0 +1,253 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const KindIRC = "IRC"
+
+// IRCProberOptions configures an IRCProber.
+type IRCProberOptions struct {
+	// TLS connects with TLS, configured by TLSConfig, whose ServerName
+	// defaults to the host dialed, on port 6697 by default instead of
+	// 6667.
+	TLS       bool
+	TLSConfig *tls.Config
+	// Nick is the nickname registered, followed by underscores while it's
+	// in use. Default: "probe" followed by random digits.
+	Nick string
+	// Password is sent with PASS, for servers requiring one.
+	Password string
+}
+
+// IRCResult describes the registration of a client with an IRC server.
+type IRCResult struct {
+	Target
+	Error error
+
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	// CapTime is the time of CAP LS, RegistrationTime the time from
+	// sending NICK and USER to the welcome.
+	CapTime          time.Duration
+	RegistrationTime time.Duration
+	TotalTime        time.Duration
+	// Capabilities are those listed in reply to CAP LS, without values;
+	// servers not implementing CAP list none.
+	Capabilities []string
+	// Nick is the nickname registered.
+	Nick string
+	// Server and Version are the name and version of the server, from
+	// RPL_MYINFO.
+	Server  string
+	Version string
+}
+
+func (r IRCResult) RTT() time.Duration {
+	return r.RegistrationTime
+}
+
+func (r IRCResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	return fmt.Sprintf("-> %s %s %s Connect: %s, CAP: %s, Registration: %s. Total: %s",
+		r.Target.Address, r.Server, r.Version, r.ConnectTime, r.CapTime, r.RegistrationTime, r.TotalTime)
+}
+
+// IRCProber registers a client with the IRC server in Target.Address, "host"
+// or "host:port", listing its capabilities on the way, waits for the
+// welcome and server version, then quits.
+type IRCProber struct {
+	opts IRCProberOptions
+}
+
+func NewIRCProber(opts IRCProberOptions) *IRCProber {
+	return &IRCProber{opts: opts}
+}
+
+func (p *IRCProber) Kind() string {
+	return KindIRC
+}
+
+// ircMessage is a message of RFC 1459, tags aside.
+type ircMessage struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// parseIRCMessage parses a line received from a server.
+func parseIRCMessage(line string) ircMessage {
+	var m ircMessage
+	if strings.HasPrefix(line, "@") {
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			line = line[i+1:]
+		} else {
+			line = ""
+		}
+	}
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			i = len(line)
+		}
+		m.Prefix, line = line[1:i], line[i:]
+	}
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if m.Command != "" && line[0] == ':' {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		word := line
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			word, line = line[:i], line[i:]
+		} else {
+			line = ""
+		}
+		if m.Command == "" {
+			m.Command = strings.ToUpper(word)
+		} else {
+			m.Params = append(m.Params, word)
+		}
+	}
+	return m
+}
+
+func (m ircMessage) param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+func (p *IRCProber) Probe(target Target) (Result, error) {
+	r := &IRCResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "6667"
+		if p.opts.TLS {
+			port = "6697"
+		}
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+	if p.opts.TLS {
+		handshakeAt := time.Now()
+		tlsConn := tls.Client(conn, mailTLSConfig(p.opts.TLSConfig, address))
+		if err := tlsConn.Handshake(); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.TLSHandshakeTime = time.Since(handshakeAt)
+		conn = tlsConn
+	}
+	r.Error = p.register(r, textproto.NewConn(conn))
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+// register lists the capabilities of the server, registers and quits.
+func (p *IRCProber) register(r *IRCResult, c *textproto.Conn) error {
+	r.Nick = p.opts.Nick
+	if r.Nick == "" {
+		r.Nick = fmt.Sprintf("probe%05d", rand.Intn(100000))
+	}
+	// CAP LS suspends the registration until CAP END, sent once the
+	// capabilities are listed. Servers without CAP ignore it or answer
+	// ERR_UNKNOWNCOMMAND.
+	capAt := time.Now()
+	if err := c.PrintfLine("CAP LS 302"); err != nil {
+		return err
+	}
+	if p.opts.Password != "" {
+		if err := c.PrintfLine("PASS %s", p.opts.Password); err != nil {
+			return err
+		}
+	}
+	registrationAt := time.Now()
+	if err := c.PrintfLine("NICK %s", r.Nick); err != nil {
+		return err
+	}
+	if err := c.PrintfLine("USER %s 0 * :libprobe", r.Nick); err != nil {
+		return err
+	}
+	capDone := false
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return err
+		}
+		m := parseIRCMessage(line)
+		switch m.Command {
+		case "PING":
+			if err := c.PrintfLine("PONG :%s", m.param(0)); err != nil {
+				return err
+			}
+		case "CAP":
+			if capDone || !strings.EqualFold(m.param(1), "LS") {
+				continue
+			}
+			for _, capability := range strings.Fields(m.Params[len(m.Params)-1]) {
+				name, _, _ := strings.Cut(capability, "=")
+				r.Capabilities = append(r.Capabilities, name)
+			}
+			// "CAP * LS * :..." announces more lines.
+			if m.param(2) == "*" && len(m.Params) > 3 {
+				continue
+			}
+			capDone = true
+			r.CapTime = time.Since(capAt)
+			if err := c.PrintfLine("CAP END"); err != nil {
+				return err
+			}
+		case "001":
+			r.RegistrationTime = time.Since(registrationAt)
+			r.Nick = m.param(0)
+		case "004":
+			r.Server, r.Version = m.param(1), m.param(2)
+			return c.PrintfLine("QUIT")
+		case "421":
+			// ERR_UNKNOWNCOMMAND, from servers without CAP.
+			if !strings.EqualFold(m.param(1), "CAP") {
+				return fmt.Errorf("irc: %s", line)
+			}
+		case "433":
+			// ERR_NICKNAMEINUSE
+			if r.RegistrationTime > 0 || len(r.Nick) >= 30 {
+				return fmt.Errorf("irc: %s", line)
+			}
+			r.Nick += "_"
+			if err := c.PrintfLine("NICK %s", r.Nick); err != nil {
+				return err
+			}
+		case "ERROR":
+			return fmt.Errorf("irc: %s", m.param(0))
+		default:
+			if len(m.Command) == 3 && (m.Command[0] == '4' || m.Command[0] == '5') && r.RegistrationTime == 0 {
+				return fmt.Errorf("irc: %s", line)
+			}
+		}
+	}
+}
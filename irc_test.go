@@ -0,0 +1,116 @@
+package libprobe_test
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveIRC serves an IRC server requiring the password secret, on which the
+// nickname taken is in use. Servers without CAP answer it with
+// ERR_UNKNOWNCOMMAND.
+func serveIRC(t *testing.T, capabilities bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := textproto.NewConn(conn)
+				var nick, password string
+				suspended := false
+				for {
+					line, err := c.ReadLine()
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					switch fields[0] {
+					case "CAP":
+						if !capabilities {
+							c.PrintfLine(":irc.example.com 421 * CAP :Unknown command")
+							continue
+						}
+						if fields[1] == "LS" {
+							suspended = true
+							c.PrintfLine(":irc.example.com CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL")
+							c.PrintfLine(":irc.example.com CAP * LS :server-time")
+						} else if fields[1] == "END" {
+							suspended = false
+						}
+					case "PASS":
+						password = fields[1]
+					case "NICK":
+						if fields[1] == "taken" {
+							c.PrintfLine(":irc.example.com 433 * taken :Nickname is already in use")
+							continue
+						}
+						nick = fields[1]
+						c.PrintfLine("PING :cookie")
+					case "PONG":
+						if fields[1] != ":cookie" {
+							return
+						}
+					case "QUIT":
+						c.PrintfLine("ERROR :Closing link")
+						return
+					}
+					if nick == "" || suspended {
+						continue
+					}
+					if password != "secret" {
+						c.PrintfLine(":irc.example.com 464 %s :Password incorrect", nick)
+						return
+					}
+					c.PrintfLine(":irc.example.com 001 %s :Welcome to the Example IRC Network %s", nick, nick)
+					c.PrintfLine(":irc.example.com 002 %s :Your host is irc.example.com, running version ircd-1.2", nick)
+					c.PrintfLine(":irc.example.com 003 %s :This server was created today", nick)
+					c.PrintfLine(":irc.example.com 004 %s irc.example.com ircd-1.2 iosw biklmnopstv", nick)
+					nick = ""
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestIRCProber(t *testing.T) {
+	p := libprobe.NewIRCProber(libprobe.IRCProberOptions{Nick: "taken", Password: "secret"})
+	require.Equal(t, libprobe.KindIRC, p.Kind())
+	r, err := p.Probe(libprobe.Target{Address: serveIRC(t, true), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.IRCResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "taken_", res.Nick)
+	require.Equal(t, []string{"multi-prefix", "sasl", "server-time"}, res.Capabilities)
+	require.Equal(t, "irc.example.com", res.Server)
+	require.Equal(t, "ircd-1.2", res.Version)
+	require.Positive(t, res.CapTime)
+	require.Positive(t, res.RegistrationTime)
+	require.Equal(t, res.RegistrationTime, res.RTT())
+
+	target := libprobe.Target{Address: serveIRC(t, false), Timeout: 5 * time.Second}
+	r, err = libprobe.NewIRCProber(libprobe.IRCProberOptions{Password: "secret"}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.IRCResult)
+	require.NoError(t, res.Error)
+	require.Empty(t, res.Capabilities)
+	require.True(t, strings.HasPrefix(res.Nick, "probe"))
+	require.Equal(t, "ircd-1.2", res.Version)
+
+	r, err = libprobe.NewIRCProber(libprobe.IRCProberOptions{Password: "wrong"}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.IRCResult)
+	require.ErrorContains(t, res.Error, "Password incorrect")
+}
@@ -0,0 +1,327 @@
+package libprobe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindISCSI = "ISCSI"
+
+// iSCSI opcodes (RFC 7143).
+const (
+	iscsiOpImmediate   = 0x40
+	iscsiOpTextReq     = 0x04
+	iscsiOpLoginReq    = 0x03
+	iscsiOpLogoutReq   = 0x06
+	iscsiOpTextResp    = 0x24
+	iscsiOpLoginResp   = 0x23
+	iscsiOpLogoutResp  = 0x26
+	iscsiOpReject      = 0x3f
+	iscsiBHSLen        = 48
+	iscsiFinal         = 0x80
+	iscsiContinue      = 0x40
+	iscsiTransit       = 0x80
+	iscsiStageSecurity = 0
+	iscsiStageOper     = 1
+	iscsiStageFull     = 3
+)
+
+const defaultISCSIInitiator = "iqn.2021-01.com.github.blho:libprobe"
+
+// ISCSIProberOptions configures an ISCSIProber.
+type ISCSIProberOptions struct {
+	// InitiatorName is the iSCSI name the prober logs in with.
+	// Default: "iqn.2021-01.com.github.blho:libprobe".
+	InitiatorName string
+}
+
+// ISCSITarget is a target reported by a portal.
+type ISCSITarget struct {
+	Name string
+	// Addresses are the portals of the target as "host:port,tpgt".
+	Addresses []string
+}
+
+type ISCSIResult struct {
+	Target
+	Error error
+
+	ConnectTime   time.Duration
+	LoginTime     time.Duration
+	DiscoveryTime time.Duration
+	TotalTime     time.Duration
+	Targets       []ISCSITarget
+}
+
+func (r ISCSIResult) RTT() time.Duration {
+	return r.TotalTime
+}
+
+func (r ISCSIResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("Error: %s", r.Error)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "-> %s Connect: %s, Login: %s, Discovery: %s. Total: %s\n",
+		r.Target.Address, r.ConnectTime, r.LoginTime, r.DiscoveryTime, r.TotalTime)
+	for _, t := range r.Targets {
+		fmt.Fprintf(&b, "%s %s\n", t.Name, strings.Join(t.Addresses, " "))
+	}
+	return b.String()
+}
+
+// ISCSIProber logs in to the iSCSI portal in Target.Address (port 3260 by
+// default) with a discovery session, lists its targets with SendTargets and
+// logs out. Portals requiring CHAP for discovery fail the login.
+type ISCSIProber struct {
+	opts ISCSIProberOptions
+}
+
+func NewISCSIProber(opts ISCSIProberOptions) *ISCSIProber {
+	if opts.InitiatorName == "" {
+		opts.InitiatorName = defaultISCSIInitiator
+	}
+	return &ISCSIProber{opts: opts}
+}
+
+func (p *ISCSIProber) Kind() string {
+	return KindISCSI
+}
+
+// iscsiPDU is a PDU without additional header segments or digests.
+type iscsiPDU struct {
+	BHS  [iscsiBHSLen]byte
+	Data []byte
+}
+
+func (pdu *iscsiPDU) opcode() byte {
+	return pdu.BHS[0] & 0x3f
+}
+
+func (pdu *iscsiPDU) writeTo(w io.Writer) error {
+	n := len(pdu.Data)
+	pdu.BHS[5], pdu.BHS[6], pdu.BHS[7] = byte(n>>16), byte(n>>8), byte(n)
+	b := append(pdu.BHS[:], pdu.Data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readISCSIPDU(r io.Reader) (*iscsiPDU, error) {
+	pdu := &iscsiPDU{}
+	if _, err := io.ReadFull(r, pdu.BHS[:]); err != nil {
+		return nil, err
+	}
+	ahs := int(pdu.BHS[4]) * 4
+	n := int(pdu.BHS[5])<<16 | int(pdu.BHS[6])<<8 | int(pdu.BHS[7])
+	padded := (n + 3) &^ 3
+	buf := make([]byte, ahs+padded)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	pdu.Data = buf[ahs : ahs+n]
+	return pdu, nil
+}
+
+// iscsiKeys encodes text keys as NUL terminated key=value pairs.
+func iscsiKeys(pairs ...string) []byte {
+	var b bytes.Buffer
+	for i := 0; i+1 < len(pairs); i += 2 {
+		b.WriteString(pairs[i] + "=" + pairs[i+1])
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// iscsiSession is the state of a discovery session.
+type iscsiSession struct {
+	conn      net.Conn
+	isid      [6]byte
+	tsih      uint16
+	itt       uint32
+	cmdSN     uint32
+	expStatSN uint32
+}
+
+// request sends a PDU with the session's task tag and sequence numbers and
+// reads the response.
+func (s *iscsiSession) request(pdu *iscsiPDU) (*iscsiPDU, error) {
+	s.itt++
+	binary.BigEndian.PutUint32(pdu.BHS[16:], s.itt)
+	binary.BigEndian.PutUint32(pdu.BHS[24:], s.cmdSN)
+	binary.BigEndian.PutUint32(pdu.BHS[28:], s.expStatSN)
+	if err := pdu.writeTo(s.conn); err != nil {
+		return nil, err
+	}
+	resp, err := readISCSIPDU(s.conn)
+	if err != nil {
+		return nil, err
+	}
+	if resp.opcode() == iscsiOpReject {
+		return nil, fmt.Errorf("iscsi: request rejected with reason 0x%02x", resp.BHS[2])
+	}
+	s.expStatSN = binary.BigEndian.Uint32(resp.BHS[24:]) + 1
+	return resp, nil
+}
+
+// login moves from stage csg to nsg.
+func (s *iscsiSession) login(csg, nsg byte, keys []byte) (*iscsiPDU, error) {
+	req := &iscsiPDU{Data: keys}
+	req.BHS[0] = iscsiOpImmediate | iscsiOpLoginReq
+	req.BHS[1] = iscsiTransit | csg<<2 | nsg
+	copy(req.BHS[8:14], s.isid[:])
+	binary.BigEndian.PutUint16(req.BHS[14:], s.tsih)
+	resp, err := s.request(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.opcode() != iscsiOpLoginResp {
+		return nil, fmt.Errorf("iscsi: unexpected opcode 0x%02x", resp.opcode())
+	}
+	if class, detail := resp.BHS[36], resp.BHS[37]; class != 0 {
+		return nil, iscsiLoginError(class, detail)
+	}
+	s.tsih = binary.BigEndian.Uint16(resp.BHS[14:])
+	s.cmdSN = binary.BigEndian.Uint32(resp.BHS[28:])
+	return resp, nil
+}
+
+func iscsiLoginError(class, detail byte) error {
+	switch {
+	case class == 1:
+		return errors.New("iscsi: login redirected")
+	case class == 2 && detail == 1:
+		return errors.New("iscsi: login authentication failed")
+	case class == 2 && detail == 2:
+		return errors.New("iscsi: login not authorized")
+	case class == 2:
+		return fmt.Errorf("iscsi: login initiator error 0x%02x", detail)
+	case class == 3:
+		return fmt.Errorf("iscsi: login target error 0x%02x", detail)
+	}
+	return fmt.Errorf("iscsi: login status 0x%02x%02x", class, detail)
+}
+
+// sendTargets lists the targets of the portal, following continuations.
+func (s *iscsiSession) sendTargets() ([]ISCSITarget, error) {
+	var data []byte
+	ttt := uint32(0xffffffff)
+	keys := iscsiKeys("SendTargets", "All")
+	for {
+		req := &iscsiPDU{Data: keys}
+		req.BHS[0] = iscsiOpImmediate | iscsiOpTextReq
+		req.BHS[1] = iscsiFinal
+		binary.BigEndian.PutUint32(req.BHS[20:], ttt)
+		resp, err := s.request(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.opcode() != iscsiOpTextResp {
+			return nil, fmt.Errorf("iscsi: unexpected opcode 0x%02x", resp.opcode())
+		}
+		data = append(data, resp.Data...)
+		if resp.BHS[1]&iscsiContinue == 0 {
+			break
+		}
+		ttt = binary.BigEndian.Uint32(resp.BHS[20:])
+		keys = nil
+	}
+	var targets []ISCSITarget
+	for _, kv := range strings.Split(string(data), "\x00") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		switch key, value := kv[:i], kv[i+1:]; key {
+		case "TargetName":
+			targets = append(targets, ISCSITarget{Name: value})
+		case "TargetAddress":
+			if len(targets) > 0 {
+				t := &targets[len(targets)-1]
+				t.Addresses = append(t.Addresses, value)
+			}
+		}
+	}
+	return targets, nil
+}
+
+func (s *iscsiSession) logout() error {
+	req := &iscsiPDU{}
+	req.BHS[0] = iscsiOpImmediate | iscsiOpLogoutReq
+	req.BHS[1] = iscsiFinal // close the session
+	resp, err := s.request(req)
+	if err != nil {
+		return err
+	}
+	if resp.opcode() != iscsiOpLogoutResp {
+		return fmt.Errorf("iscsi: unexpected opcode 0x%02x", resp.opcode())
+	}
+	return nil
+}
+
+func (p *ISCSIProber) Probe(target Target) (Result, error) {
+	r := &ISCSIResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "3260")
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	r.ConnectTime = time.Since(startAt)
+	if target.Timeout > 0 {
+		if err := conn.SetDeadline(startAt.Add(target.Timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &iscsiSession{conn: conn, cmdSN: 1}
+	// A random ISID qualifier, type 0x80.
+	if _, err := rand.Read(s.isid[1:]); err != nil {
+		return nil, err
+	}
+	s.isid[0] = 0x80
+
+	loginAt := time.Now()
+	resp, err := s.login(iscsiStageSecurity, iscsiStageOper, iscsiKeys(
+		"InitiatorName", p.opts.InitiatorName,
+		"SessionType", "Discovery",
+		"AuthMethod", "None",
+	))
+	// The target may go straight to the full feature phase.
+	if err == nil && resp.BHS[1]&0x03 != iscsiStageFull {
+		_, err = s.login(iscsiStageOper, iscsiStageFull, iscsiKeys(
+			"HeaderDigest", "None",
+			"DataDigest", "None",
+			"MaxRecvDataSegmentLength", "65536",
+		))
+	}
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.LoginTime = time.Since(loginAt)
+
+	discoveryAt := time.Now()
+	if r.Targets, err = s.sendTargets(); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.DiscoveryTime = time.Since(discoveryAt)
+	r.TotalTime = time.Since(startAt)
+	_ = s.logout()
+	return r, nil
+}
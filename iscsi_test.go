@@ -0,0 +1,87 @@
+package libprobe_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveISCSI runs a portal accepting discovery logins without
+// authentication and reporting two targets.
+func serveISCSI(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var statSN uint32
+				for {
+					bhs := make([]byte, 48)
+					if _, err := io.ReadFull(conn, bhs); err != nil {
+						return
+					}
+					n := int(bhs[5])<<16 | int(bhs[6])<<8 | int(bhs[7])
+					data := make([]byte, (n+3)&^3)
+					if _, err := io.ReadFull(conn, data); err != nil {
+						return
+					}
+					resp := make([]byte, 48)
+					copy(resp[16:20], bhs[16:20])
+					binary.BigEndian.PutUint32(resp[24:], statSN)
+					binary.BigEndian.PutUint32(resp[28:], 1)
+					statSN++
+					var payload []byte
+					switch bhs[0] & 0x3f {
+					case 0x03:
+						resp[0] = 0x23
+						// Transit straight to the full feature phase.
+						resp[1] = 0x80 | bhs[1]&0x0c | 0x03
+						copy(resp[8:14], bhs[8:14])
+						binary.BigEndian.PutUint16(resp[14:], 7)
+						if !strings.Contains(string(data), "SessionType=Discovery") {
+							resp[36], resp[37] = 2, 2
+						}
+					case 0x04:
+						resp[0], resp[1] = 0x24, 0x80
+						payload = []byte("TargetName=iqn.2024-01.example:disk1\x00TargetAddress=10.0.0.1:3260,1\x00" +
+							"TargetAddress=10.0.0.2:3260,2\x00TargetName=iqn.2024-01.example:disk2\x00TargetAddress=10.0.0.1:3260,1\x00")
+					case 0x06:
+						resp[0], resp[1] = 0x26, 0x80
+					}
+					resp[5], resp[6], resp[7] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+					for len(payload)%4 != 0 {
+						payload = append(payload, 0)
+					}
+					conn.Write(append(resp, payload...))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestISCSIProber(t *testing.T) {
+	prober := libprobe.NewISCSIProber(libprobe.ISCSIProberOptions{})
+	r, err := prober.Probe(libprobe.Target{Address: serveISCSI(t), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.ISCSIResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, []libprobe.ISCSITarget{
+		{Name: "iqn.2024-01.example:disk1", Addresses: []string{"10.0.0.1:3260,1", "10.0.0.2:3260,2"}},
+		{Name: "iqn.2024-01.example:disk2", Addresses: []string{"10.0.0.1:3260,1"}},
+	}, res.Targets)
+	require.NotZero(t, res.LoginTime)
+}
@@ -0,0 +1,419 @@
+package libprobe
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// JSONAssertion is a compiled assertion on JSON documents, such as
+//
+//	$.status == "ok" && $.replicas >= 3
+//
+// Operands are JSONPath expressions made of $, .name, ['name'] and [index]
+// selectors, or string, number, true, false and null literals. They combine
+// with the ==, !=, <, <=, >, >= comparisons, the &&, || and ! operators, and
+// parentheses. A path alone asserts the value exists and isn't false or null.
+// Paths selecting nothing compare unequal to everything.
+type JSONAssertion struct {
+	src  string
+	expr jsonExpr
+}
+
+// CompileJSONAssertion parses an assertion.
+func CompileJSONAssertion(s string) (*JSONAssertion, error) {
+	p := &jsonAssertionParser{src: s}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return &JSONAssertion{src: s, expr: expr}, nil
+}
+
+// MustCompileJSONAssertion is like CompileJSONAssertion but panics on
+// errors.
+func MustCompileJSONAssertion(s string) *JSONAssertion {
+	a, err := CompileJSONAssertion(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func (a *JSONAssertion) String() string {
+	return a.src
+}
+
+// Evaluate tells whether the JSON document doc satisfies the assertion.
+func (a *JSONAssertion) Evaluate(doc []byte) (bool, error) {
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return false, fmt.Errorf("assertion: %w", err)
+	}
+	return jsonTruthy(a.expr.eval(v)), nil
+}
+
+// evaluateJSONAssertions returns the assertions doc fails, and an error
+// summarizing them.
+func evaluateJSONAssertions(assertions []*JSONAssertion, doc []byte) ([]string, error) {
+	var failed []string
+	for _, a := range assertions {
+		ok, err := a.Evaluate(doc)
+		if err != nil {
+			return []string{a.src}, err
+		}
+		if !ok {
+			failed = append(failed, a.src)
+		}
+	}
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("assertion failed: %s", strings.Join(failed, "; "))
+	}
+	return nil, nil
+}
+
+// jsonUndefined is the value of paths selecting nothing.
+type jsonUndefined struct{}
+
+func jsonTruthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil, jsonUndefined:
+		return false
+	case bool:
+		return v
+	}
+	return true
+}
+
+type jsonExpr interface {
+	eval(doc interface{}) interface{}
+}
+
+type jsonLiteral struct{ v interface{} }
+
+func (e jsonLiteral) eval(interface{}) interface{} { return e.v }
+
+// jsonPath selects a value with keys (string) and indexes (int).
+type jsonPath []interface{}
+
+func (e jsonPath) eval(doc interface{}) interface{} {
+	v := doc
+	for _, sel := range e {
+		switch sel := sel.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return jsonUndefined{}
+			}
+			if v, ok = obj[sel]; !ok {
+				return jsonUndefined{}
+			}
+		case int:
+			arr, ok := v.([]interface{})
+			if sel < 0 {
+				sel += len(arr)
+			}
+			if !ok || sel < 0 || sel >= len(arr) {
+				return jsonUndefined{}
+			}
+			v = arr[sel]
+		}
+	}
+	return v
+}
+
+type jsonNot struct{ x jsonExpr }
+
+func (e jsonNot) eval(doc interface{}) interface{} { return !jsonTruthy(e.x.eval(doc)) }
+
+type jsonBinary struct {
+	op   string
+	x, y jsonExpr
+}
+
+func (e jsonBinary) eval(doc interface{}) interface{} {
+	switch e.op {
+	case "&&":
+		return jsonTruthy(e.x.eval(doc)) && jsonTruthy(e.y.eval(doc))
+	case "||":
+		return jsonTruthy(e.x.eval(doc)) || jsonTruthy(e.y.eval(doc))
+	}
+	x, y := e.x.eval(doc), e.y.eval(doc)
+	_, xu := x.(jsonUndefined)
+	_, yu := y.(jsonUndefined)
+	if xu || yu {
+		return e.op == "!="
+	}
+	switch e.op {
+	case "==":
+		return reflect.DeepEqual(x, y)
+	case "!=":
+		return !reflect.DeepEqual(x, y)
+	}
+	var c int
+	switch x := x.(type) {
+	case float64:
+		y, ok := y.(float64)
+		if !ok {
+			return false
+		}
+		c = compareFloat(x, y)
+	case string:
+		y, ok := y.(string)
+		if !ok {
+			return false
+		}
+		c = strings.Compare(x, y)
+	default:
+		return false
+	}
+	switch e.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func compareFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+type jsonToken struct {
+	kind byte // 'p'unct, 's'tring, 'n'umber, 'i'dentifier
+	text string
+	pos  int
+}
+
+type jsonAssertionParser struct {
+	src    string
+	tokens []jsonToken
+	pos    int
+}
+
+func (p *jsonAssertionParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("assertion %q: %s", p.src, fmt.Sprintf(format, args...))
+}
+
+func (p *jsonAssertionParser) tokenize() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") ||
+			strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">=") ||
+			strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||"):
+			p.tokens = append(p.tokens, jsonToken{'p', s[i : i+2], i})
+			i += 2
+		case strings.IndexByte("$.[]()<>!", c) >= 0:
+			p.tokens = append(p.tokens, jsonToken{'p', s[i : i+1], i})
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return p.errorf("unterminated string")
+			}
+			text := s[i : j+1]
+			if c == '\'' {
+				text = `"` + strings.Replace(strings.Replace(s[i+1:j], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+			}
+			unquoted, err := strconv.Unquote(text)
+			if err != nil {
+				return p.errorf("invalid string %s", s[i:j+1])
+			}
+			p.tokens = append(p.tokens, jsonToken{'s', unquoted, i})
+			i = j + 1
+		case c == '-' || ('0' <= c && c <= '9'):
+			j := i + 1
+			for j < len(s) && strings.IndexByte("0123456789.eE+-", s[j]) >= 0 {
+				j++
+			}
+			p.tokens = append(p.tokens, jsonToken{'n', s[i:j], i})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '-' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			p.tokens = append(p.tokens, jsonToken{'i', s[i:j], i})
+			i = j
+		default:
+			return p.errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return nil
+}
+
+func (p *jsonAssertionParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == 'p' && p.tokens[p.pos].text == text
+}
+
+func (p *jsonAssertionParser) next() (jsonToken, error) {
+	if p.pos >= len(p.tokens) {
+		return jsonToken{}, p.errorf("unexpected end")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *jsonAssertionParser) expect(text string) error {
+	if !p.peek(text) {
+		if p.pos >= len(p.tokens) {
+			return p.errorf("expected %q at the end", text)
+		}
+		return p.errorf("expected %q at %d", text, p.tokens[p.pos].pos)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *jsonAssertionParser) or() (jsonExpr, error) {
+	x, err := p.and()
+	for err == nil && p.peek("||") {
+		p.pos++
+		var y jsonExpr
+		if y, err = p.and(); err == nil {
+			x = jsonBinary{"||", x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *jsonAssertionParser) and() (jsonExpr, error) {
+	x, err := p.not()
+	for err == nil && p.peek("&&") {
+		p.pos++
+		var y jsonExpr
+		if y, err = p.not(); err == nil {
+			x = jsonBinary{"&&", x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *jsonAssertionParser) not() (jsonExpr, error) {
+	if p.peek("!") {
+		p.pos++
+		x, err := p.not()
+		return jsonNot{x}, err
+	}
+	x, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.peek(op) {
+			p.pos++
+			y, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			return jsonBinary{op, x, y}, nil
+		}
+	}
+	return x, nil
+}
+
+func (p *jsonAssertionParser) operand() (jsonExpr, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch tok.kind {
+	case 's':
+		return jsonLiteral{tok.text}, nil
+	case 'n':
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", tok.text)
+		}
+		return jsonLiteral{f}, nil
+	case 'i':
+		switch tok.text {
+		case "true":
+			return jsonLiteral{true}, nil
+		case "false":
+			return jsonLiteral{false}, nil
+		case "null":
+			return jsonLiteral{nil}, nil
+		}
+		return nil, p.errorf("unknown identifier %s, paths start with $", tok.text)
+	}
+	switch tok.text {
+	case "(":
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case "$":
+		return p.path()
+	}
+	return nil, p.errorf("unexpected %q at %d", tok.text, tok.pos)
+}
+
+func (p *jsonAssertionParser) path() (jsonExpr, error) {
+	path := jsonPath{}
+	for {
+		switch {
+		case p.peek("."):
+			p.pos++
+			tok, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			if tok.kind != 'i' {
+				return nil, p.errorf("expected a name at %d", tok.pos)
+			}
+			path = append(path, tok.text)
+		case p.peek("["):
+			p.pos++
+			tok, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			switch tok.kind {
+			case 's':
+				path = append(path, tok.text)
+			case 'n':
+				i, err := strconv.Atoi(tok.text)
+				if err != nil {
+					return nil, p.errorf("invalid index %s", tok.text)
+				}
+				path = append(path, i)
+			default:
+				return nil, p.errorf("expected a key or an index at %d", tok.pos)
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		default:
+			return path, nil
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package libprobe_test
+
+import (
+	"testing"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONAssertion(t *testing.T) {
+	doc := []byte(`{"status": "ok", "replicas": 3, "ready": true, "version": null,
+		"pods": [{"name": "a", "phase": "Running"}, {"name": "b", "phase": "Pending"}],
+		"labels": {"app.kubernetes.io/name": "api"}}`)
+	for expr, want := range map[string]bool{
+		`$.status == "ok" && $.replicas >= 3`:         true,
+		`$.status == 'ok' && $.replicas > 3`:          false,
+		`$.ready`:                                     true,
+		`!$.ready || $.replicas < 1`:                  false,
+		`$.version`:                                   false,
+		`$.version == null`:                           true,
+		`$.missing`:                                   false,
+		`$.missing != "x"`:                            true,
+		`$.missing == null`:                           false,
+		`$.pods[0].phase == "Running"`:                true,
+		`$.pods[-1]['name'] == "b"`:                   true,
+		`$.pods[2].name == "c"`:                       false,
+		`$.labels['app.kubernetes.io/name'] == "api"`: true,
+		`($.replicas == 1 || $.replicas == 3) && $.status != "down"`: true,
+		`$.status > 3`:      false,
+		`$.status < "p"`:    true,
+		`$.replicas == 3.0`: true,
+	} {
+		a, err := libprobe.CompileJSONAssertion(expr)
+		require.NoError(t, err, expr)
+		got, err := a.Evaluate(doc)
+		require.NoError(t, err, expr)
+		require.Equal(t, want, got, expr)
+	}
+
+	for _, expr := range []string{``, `$.`, `status == "ok"`, `$.a == `, `($.a`, `$.a = 1`, `$["a`, `$[x]`} {
+		_, err := libprobe.CompileJSONAssertion(expr)
+		require.Error(t, err, expr)
+	}
+
+	_, err := libprobe.MustCompileJSONAssertion(`$.a`).Evaluate([]byte(`not json`))
+	require.Error(t, err)
+}
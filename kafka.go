@@ -0,0 +1,454 @@
+package libprobe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Kafka API keys used by the sink and prober.
+const (
+	kafkaAPIProduce  = 0
+	kafkaAPIMetadata = 3
+	kafkaAPIVersions = 18
+)
+
+// kafkaEncoder builds Kafka protocol messages, big endian, with int16 length
+// prefixed strings and int32 length prefixed arrays.
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.b = append(e.b, byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.b = append(e.b, byte(v>>8), byte(v)) }
+func (e *kafkaEncoder) int32(v int32) {
+	e.b = append(e.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+func (e *kafkaEncoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+func (e *kafkaEncoder) nullableString(s string) {
+	if s == "" {
+		e.int16(-1)
+		return
+	}
+	e.string(s)
+}
+func (e *kafkaEncoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.b = append(e.b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+func (e *kafkaEncoder) varintBytes(p []byte) {
+	if p == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(p)))
+	e.b = append(e.b, p...)
+}
+
+var errKafkaShortRead = errors.New("kafka: short response")
+
+// kafkaDecoder reads a Kafka response, remembering the first error so
+// callers can check it once at the end.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = errKafkaShortRead
+		return nil
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if p := d.take(1); p != nil {
+		return int8(p[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if p := d.take(2); p != nil {
+		return int16(binary.BigEndian.Uint16(p))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if p := d.take(4); p != nil {
+		return int32(binary.BigEndian.Uint32(p))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if p := d.take(8); p != nil {
+		return int64(binary.BigEndian.Uint64(p))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// arrayLen reads an array length, guarding against absurd values from a
+// corrupt or hostile response.
+func (d *kafkaDecoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(d.b) {
+		d.err = errKafkaShortRead
+		return 0
+	}
+	return int(n)
+}
+
+// kafkaConn is a synchronous connection to a single broker.
+type kafkaConn struct {
+	conn          net.Conn
+	br            *bufio.Reader
+	clientID      string
+	correlationID int32
+	timeout       time.Duration
+}
+
+func dialKafka(address, clientID string, timeout time.Duration) (*kafkaConn, error) {
+	conn, err := dialTimeout(nil, "tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{
+		conn:     conn,
+		br:       bufio.NewReader(conn),
+		clientID: clientID,
+		timeout:  timeout,
+	}, nil
+}
+
+// roundTrip sends a request and waits for its response.
+func (c *kafkaConn) roundTrip(apiKey, apiVersion int16, body []byte) (*kafkaDecoder, error) {
+	if err := c.send(apiKey, apiVersion, body); err != nil {
+		return nil, err
+	}
+	return c.receive()
+}
+
+// send writes a request with a v1 request header.
+func (c *kafkaConn) send(apiKey, apiVersion int16, body []byte) error {
+	c.correlationID++
+	req := &kafkaEncoder{}
+	req.int32(0)
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(c.correlationID)
+	req.string(c.clientID)
+	req.b = append(req.b, body...)
+	binary.BigEndian.PutUint32(req.b, uint32(len(req.b)-4))
+	if c.timeout > 0 {
+		_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	_, err := c.conn.Write(req.b)
+	return err
+}
+
+// receive reads the response to the last request and returns its body
+// following the correlation ID.
+func (c *kafkaConn) receive() (*kafkaDecoder, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(c.br, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > 64<<20 {
+		return nil, fmt.Errorf("kafka: invalid response size %d", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.br, resp); err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{b: resp}
+	if id := d.int32(); id != c.correlationID {
+		return nil, fmt.Errorf("kafka: correlation ID mismatch, got %d want %d", id, c.correlationID)
+	}
+	return d, nil
+}
+
+func (c *kafkaConn) Close() error {
+	return c.conn.Close()
+}
+
+type kafkaBroker struct {
+	NodeID int32
+	Host   string
+	Port   int32
+	Rack   string
+}
+
+func (b kafkaBroker) Address() string {
+	return net.JoinHostPort(b.Host, strconv.Itoa(int(b.Port)))
+}
+
+type kafkaPartitionMetadata struct {
+	ErrorCode int16
+	ID        int32
+	Leader    int32
+	Replicas  []int32
+	ISR       []int32
+}
+
+type kafkaTopicMetadata struct {
+	ErrorCode  int16
+	Name       string
+	Internal   bool
+	Partitions []kafkaPartitionMetadata
+}
+
+type kafkaMetadata struct {
+	Brokers      []kafkaBroker
+	ClusterID    string
+	ControllerID int32
+	Topics       []kafkaTopicMetadata
+}
+
+func (m kafkaMetadata) broker(id int32) (kafkaBroker, bool) {
+	for _, b := range m.Brokers {
+		if b.NodeID == id {
+			return b, true
+		}
+	}
+	return kafkaBroker{}, false
+}
+
+// kafkaMaxMetadataVersion is the latest Metadata version metadata speaks.
+const kafkaMaxMetadataVersion = 4
+
+// metadata issues a Metadata request of version 1 to
+// kafkaMaxMetadataVersion, brokers returning the cluster ID from version 2
+// on. A nil topics slice requests all topics, an empty one the brokers
+// alone.
+func (c *kafkaConn) metadata(version int16, topics []string) (kafkaMetadata, error) {
+	req := &kafkaEncoder{}
+	if topics == nil {
+		req.int32(-1)
+	} else {
+		req.int32(int32(len(topics)))
+		for _, t := range topics {
+			req.string(t)
+		}
+	}
+	if version >= 4 {
+		req.int8(0) // allow_auto_topic_creation
+	}
+	d, err := c.roundTrip(kafkaAPIMetadata, version, req.b)
+	if err != nil {
+		return kafkaMetadata{}, err
+	}
+	if version >= 3 {
+		d.int32() // throttle_time_ms
+	}
+	var m kafkaMetadata
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		b := kafkaBroker{NodeID: d.int32(), Host: d.string(), Port: d.int32(), Rack: d.string()}
+		m.Brokers = append(m.Brokers, b)
+	}
+	if version >= 2 {
+		m.ClusterID = d.string()
+	}
+	m.ControllerID = d.int32()
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		t := kafkaTopicMetadata{ErrorCode: d.int16(), Name: d.string(), Internal: d.int8() != 0}
+		for j, np := 0, d.arrayLen(); j < np; j++ {
+			p := kafkaPartitionMetadata{ErrorCode: d.int16(), ID: d.int32(), Leader: d.int32()}
+			for k, nr := 0, d.arrayLen(); k < nr; k++ {
+				p.Replicas = append(p.Replicas, d.int32())
+			}
+			for k, ni := 0, d.arrayLen(); k < ni; k++ {
+				p.ISR = append(p.ISR, d.int32())
+			}
+			t.Partitions = append(t.Partitions, p)
+		}
+		m.Topics = append(m.Topics, t)
+	}
+	return m, d.err
+}
+
+// apiVersions issues an ApiVersions v0 request, which every broker
+// answers, and returns the minimum and maximum version of each API key.
+func (c *kafkaConn) apiVersions() (map[int16][2]int16, error) {
+	d, err := c.roundTrip(kafkaAPIVersions, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if code := d.int16(); code != 0 {
+		return nil, kafkaError(code)
+	}
+	versions := make(map[int16][2]int16)
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		key := d.int16()
+		versions[key] = [2]int16{d.int16(), d.int16()}
+	}
+	return versions, d.err
+}
+
+type kafkaRecord struct {
+	Key   []byte
+	Value []byte
+	Time  time.Time
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeRecordBatch encodes records as a magic v2 record batch.
+func encodeRecordBatch(records []kafkaRecord) []byte {
+	first, last := records[0].Time, records[0].Time
+	for _, r := range records {
+		if r.Time.Before(first) {
+			first = r.Time
+		}
+		if r.Time.After(last) {
+			last = r.Time
+		}
+	}
+	firstMs := first.UnixNano() / int64(time.Millisecond)
+	body := &kafkaEncoder{}
+	body.int16(0) // attributes
+	body.int32(int32(len(records) - 1))
+	body.int64(firstMs)
+	body.int64(last.UnixNano() / int64(time.Millisecond))
+	body.int64(-1) // producer ID
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(records)))
+	for i, r := range records {
+		rec := &kafkaEncoder{}
+		rec.int8(0)
+		rec.varint(r.Time.UnixNano()/int64(time.Millisecond) - firstMs)
+		rec.varint(int64(i))
+		rec.varintBytes(r.Key)
+		rec.varintBytes(r.Value)
+		rec.varint(0) // headers
+		body.varint(int64(len(rec.b)))
+		body.b = append(body.b, rec.b...)
+	}
+
+	batch := &kafkaEncoder{}
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + len(body.b)))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body.b, crc32c)))
+	batch.b = append(batch.b, body.b...)
+	return batch.b
+}
+
+// kafkaError is a non-zero error code returned by a broker.
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	return fmt.Sprintf("kafka: broker returned error code %d", int16(e))
+}
+
+// produce sends records to a single partition with a Produce v3 request and
+// returns the base offset assigned by the broker.
+func (c *kafkaConn) produce(topic string, partition int32, acks int16, timeout time.Duration, records []kafkaRecord) (int64, error) {
+	batch := encodeRecordBatch(records)
+	req := &kafkaEncoder{}
+	req.nullableString("")
+	req.int16(acks)
+	req.int32(int32(timeout / time.Millisecond))
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+	req.int32(int32(len(batch)))
+	req.b = append(req.b, batch...)
+	if acks == 0 {
+		// The broker doesn't respond to produce requests without acks.
+		return -1, c.send(kafkaAPIProduce, 3, req.b)
+	}
+	d, err := c.roundTrip(kafkaAPIProduce, 3, req.b)
+	if err != nil {
+		return -1, err
+	}
+	offset := int64(-1)
+	var code int16
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		d.string()
+		for j, np := 0, d.arrayLen(); j < np; j++ {
+			d.int32()
+			code = d.int16()
+			offset = d.int64()
+			d.int64() // log append time
+		}
+	}
+	if d.err != nil {
+		return -1, d.err
+	}
+	if code != 0 {
+		return -1, kafkaError(code)
+	}
+	return offset, nil
+}
+
+// kafkaMurmur2 is the murmur2 variant used by the Java client's default
+// partitioner, so keyed records land on the same partitions.
+func kafkaMurmur2(data []byte) int32 {
+	const (
+		seed = uint32(0x9747b28c)
+		m    = uint32(0x5bd1e995)
+		r    = 24
+	)
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := length &^ 3
+	switch length & 3 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
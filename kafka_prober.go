@@ -0,0 +1,148 @@
+package libprobe
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindKafka = "KAFKA"
+
+// KafkaProberOptions configures a KafkaProber.
+type KafkaProberOptions struct {
+	// TLS connects with TLS, configured by TLSConfig, whose ServerName
+	// defaults to the host dialed.
+	TLS       bool
+	TLSConfig *tls.Config
+	// ClientID is the client ID of the requests. Default: "libprobe".
+	ClientID string
+}
+
+// KafkaBroker is a broker of the cluster, as listed in the metadata.
+type KafkaBroker struct {
+	NodeID int32
+	Host   string
+	Port   int32
+	Rack   string
+}
+
+// KafkaResult describes the cluster metadata returned by a Kafka broker.
+type KafkaResult struct {
+	Target
+	Error error
+
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	// APIVersionsTime and MetadataTime are the round trip times of the
+	// ApiVersions and Metadata requests.
+	APIVersionsTime time.Duration
+	MetadataTime    time.Duration
+	TotalTime       time.Duration
+	// MetadataVersion is the version of the Metadata request, the latest
+	// supported by both sides.
+	MetadataVersion int16
+	ClusterID       string
+	// ControllerID is the node ID of the controller, -1 when unknown.
+	ControllerID int32
+	Brokers      []KafkaBroker
+}
+
+func (r KafkaResult) RTT() time.Duration {
+	return r.MetadataTime
+}
+
+func (r KafkaResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	return fmt.Sprintf("-> %s cluster=%s brokers=%d controller=%d time=%v", r.Target.Address, r.ClusterID, len(r.Brokers), r.ControllerID, r.MetadataTime)
+}
+
+// KafkaProber requests the API versions, then the brokers and controller of
+// the cluster from the Kafka broker in Target.Address, "host" or
+// "host:port" with port 9092 by default. A broker accepting connections but
+// wedged times out on those requests.
+type KafkaProber struct {
+	opts KafkaProberOptions
+}
+
+func NewKafkaProber(opts KafkaProberOptions) *KafkaProber {
+	if opts.ClientID == "" {
+		opts.ClientID = "libprobe"
+	}
+	return &KafkaProber{opts: opts}
+}
+
+func (p *KafkaProber) Kind() string {
+	return KindKafka
+}
+
+func (p *KafkaProber) Probe(target Target) (Result, error) {
+	r := &KafkaResult{Target: target, ControllerID: -1}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "9092")
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+	if p.opts.TLS {
+		handshakeAt := time.Now()
+		tlsConn := tls.Client(conn, mailTLSConfig(p.opts.TLSConfig, address))
+		if err := tlsConn.Handshake(); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.TLSHandshakeTime = time.Since(handshakeAt)
+		conn = tlsConn
+	}
+	// The connection keeps the deadline of the whole probe.
+	client := &kafkaConn{conn: conn, br: bufio.NewReader(conn), clientID: p.opts.ClientID}
+
+	requestAt := time.Now()
+	versions, err := client.apiVersions()
+	r.APIVersionsTime = time.Since(requestAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	supported, ok := versions[kafkaAPIMetadata]
+	if !ok {
+		r.Error = errors.New("kafka: the broker doesn't support Metadata")
+		return r, nil
+	}
+	r.MetadataVersion = supported[1]
+	if r.MetadataVersion > kafkaMaxMetadataVersion {
+		r.MetadataVersion = kafkaMaxMetadataVersion
+	}
+	if r.MetadataVersion < 1 || r.MetadataVersion < supported[0] {
+		r.Error = fmt.Errorf("kafka: Metadata versions %d to %d not supported", supported[0], supported[1])
+		return r, nil
+	}
+
+	requestAt = time.Now()
+	m, err := client.metadata(r.MetadataVersion, []string{})
+	r.MetadataTime = time.Since(requestAt)
+	r.TotalTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.ClusterID, r.ControllerID = m.ClusterID, m.ControllerID
+	for _, b := range m.Brokers {
+		r.Brokers = append(r.Brokers, KafkaBroker(b))
+	}
+	return r, nil
+}
@@ -0,0 +1,114 @@
+package libprobe_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveKafkaMetadata answers ApiVersions v0 with Metadata versions 0 to
+// maxMetadata, and Metadata with two brokers, the second one controller.
+func serveKafkaMetadata(t *testing.T, maxMetadata int16) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					apiKey, apiVersion := binary.BigEndian.Uint16(buf), int16(binary.BigEndian.Uint16(buf[2:]))
+					resp := appendInt32([]byte{0, 0, 0, 0}, int32(binary.BigEndian.Uint32(buf[4:])))
+					switch apiKey {
+					case 18:
+						resp = append(resp, 0, 0)
+						resp = appendInt32(resp, 2)
+						resp = append(resp, 0, 3, 0, 0, 0, byte(maxMetadata))
+						resp = append(resp, 0, 18, 0, 0, 0, 3)
+					case 3:
+						if apiVersion != maxMetadata {
+							return
+						}
+						resp = appendInt32(resp, 0)
+						resp = appendInt32(resp, 2)
+						for id := int32(1); id <= 2; id++ {
+							resp = appendInt32(resp, id)
+							resp = appendString(resp, "kafka.example.com")
+							resp = appendInt32(resp, 9090+id)
+							resp = appendString(resp, "rack-a")
+						}
+						resp = appendString(resp, "cluster-1")
+						resp = appendInt32(resp, 2)
+						resp = appendInt32(resp, 0)
+					default:
+						return
+					}
+					binary.BigEndian.PutUint32(resp, uint32(len(resp)-4))
+					if _, err := conn.Write(resp); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestKafkaProber(t *testing.T) {
+	p := libprobe.NewKafkaProber(libprobe.KafkaProberOptions{})
+	require.Equal(t, libprobe.KindKafka, p.Kind())
+	r, err := p.Probe(libprobe.Target{Address: serveKafkaMetadata(t, 4), Timeout: 2 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.KafkaResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, int16(4), res.MetadataVersion)
+	require.Equal(t, "cluster-1", res.ClusterID)
+	require.Equal(t, int32(2), res.ControllerID)
+	require.Equal(t, []libprobe.KafkaBroker{
+		{NodeID: 1, Host: "kafka.example.com", Port: 9091, Rack: "rack-a"},
+		{NodeID: 2, Host: "kafka.example.com", Port: 9092, Rack: "rack-a"},
+	}, res.Brokers)
+	require.Positive(t, res.APIVersionsTime)
+	require.Equal(t, res.MetadataTime, res.RTT())
+}
+
+func TestKafkaProberWedged(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		// The broker accepts connections and never answers.
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	r, err := libprobe.NewKafkaProber(libprobe.KafkaProberOptions{}).Probe(libprobe.Target{Address: l.Addr().String(), Timeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+	res := r.(*libprobe.KafkaResult)
+	var netErr net.Error
+	require.ErrorAs(t, res.Error, &netErr)
+	require.True(t, netErr.Timeout())
+	require.Equal(t, int32(-1), res.ControllerID)
+}
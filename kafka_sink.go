@@ -0,0 +1,265 @@
+package libprobe
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// KafkaSinkOptions configures a KafkaSink.
+type KafkaSinkOptions struct {
+	// Brokers are bootstrap broker addresses (host:port).
+	Brokers  []string
+	Topic    string
+	ClientID string
+	// RequiredAcks is the acks setting of produce requests, 1 (leader) or
+	// -1 (all in-sync replicas). Default: 1.
+	RequiredAcks int16
+	// Encode serializes a result into the record value: MarshalResultJSON,
+	// the default, MarshalResultProto or a custom encoder.
+	Encode func(Result) ([]byte, error)
+	// BatchSize is the number of records buffered before a flush.
+	// Default: 100.
+	BatchSize int
+	// Linger flushes buffered records periodically. Default: 1s; a negative
+	// value disables periodic flushing.
+	Linger time.Duration
+	// Retries is the number of additional attempts of a failed produce
+	// request, refreshing metadata before each attempt. Default: 3.
+	Retries int
+	Timeout time.Duration
+}
+
+// KafkaSink produces results to a Kafka topic, keyed by target address so all
+// results of a target land on the same partition. Records are batched per
+// partition and flushed once BatchSize is reached, every Linger, and on Close.
+type KafkaSink struct {
+	opts KafkaSinkOptions
+
+	mu       sync.Mutex
+	pending  []kafkaRecord
+	metadata *kafkaMetadata
+	conns    map[string]*kafkaConn
+	closed   bool
+	done     chan struct{}
+	lastErr  error
+}
+
+func NewKafkaSink(opts KafkaSinkOptions) *KafkaSink {
+	if opts.RequiredAcks == 0 {
+		opts.RequiredAcks = 1
+	}
+	if opts.Encode == nil {
+		opts.Encode = MarshalResultJSON
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.Linger == 0 {
+		opts.Linger = time.Second
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = "libprobe"
+	}
+	s := &KafkaSink{
+		opts:  opts,
+		conns: make(map[string]*kafkaConn),
+		done:  make(chan struct{}),
+	}
+	if opts.Linger > 0 {
+		go s.lingerLoop()
+	}
+	return s
+}
+
+func (s *KafkaSink) lingerLoop() {
+	ticker := time.NewTicker(s.opts.Linger)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			if len(s.pending) > 0 {
+				s.lastErr = s.flush()
+			}
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Write buffers a result. The returned error reports a failure of the last
+// flush, including periodic flushes that happened in the background.
+func (s *KafkaSink) Write(r Result) error {
+	value, err := s.opts.Encode(r)
+	if err != nil {
+		return err
+	}
+	var key string
+	if address, ok := Flatten(r)[0][ColumnAddress].(string); ok {
+		key = address
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSinkClosed
+	}
+	s.pending = append(s.pending, kafkaRecord{Key: []byte(key), Value: value, Time: time.Now()})
+	if len(s.pending) >= s.opts.BatchSize {
+		s.lastErr = s.flush()
+	}
+	err, s.lastErr = s.lastErr, nil
+	return err
+}
+
+// Flush produces all buffered records.
+func (s *KafkaSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+func (s *KafkaSink) flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	var err error
+	for attempt := 0; attempt <= s.opts.Retries; attempt++ {
+		if err = s.produce(); err == nil {
+			return nil
+		}
+		s.reset()
+	}
+	return err
+}
+
+// produce sends the pending records, removing them from the buffer once the
+// partition they belong to acknowledged them.
+func (s *KafkaSink) produce() error {
+	if s.metadata == nil {
+		if err := s.refreshMetadata(); err != nil {
+			return err
+		}
+	}
+	var topic *kafkaTopicMetadata
+	for i := range s.metadata.Topics {
+		if s.metadata.Topics[i].Name == s.opts.Topic {
+			topic = &s.metadata.Topics[i]
+		}
+	}
+	if topic == nil || len(topic.Partitions) == 0 {
+		return fmt.Errorf("kafka: no partitions for topic %q", s.opts.Topic)
+	}
+	if topic.ErrorCode != 0 {
+		return kafkaError(topic.ErrorCode)
+	}
+	// Brokers don't list partitions in ID order, so the hash picks an ID
+	// as the Java partitioner does rather than an index into the metadata.
+	partitions := make(map[int32]kafkaPartitionMetadata, len(topic.Partitions))
+	for _, p := range topic.Partitions {
+		partitions[p.ID] = p
+	}
+	batches := make(map[int32][]kafkaRecord)
+	for _, rec := range s.pending {
+		hash := kafkaMurmur2(rec.Key) & 0x7fffffff
+		id := hash % int32(len(topic.Partitions))
+		batches[id] = append(batches[id], rec)
+	}
+	var remaining []kafkaRecord
+	var firstErr error
+	for id, records := range batches {
+		partition, ok := partitions[id]
+		var err error
+		if !ok {
+			err = fmt.Errorf("kafka: no metadata for partition %d of topic %q", id, s.opts.Topic)
+		} else {
+			err = s.producePartition(partition, records)
+		}
+		if err != nil {
+			remaining = append(remaining, records...)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	s.pending = remaining
+	return firstErr
+}
+
+func (s *KafkaSink) producePartition(partition kafkaPartitionMetadata, records []kafkaRecord) error {
+	leader, ok := s.metadata.broker(partition.Leader)
+	if !ok {
+		return fmt.Errorf("kafka: no leader for partition %d", partition.ID)
+	}
+	conn, err := s.conn(leader.Address())
+	if err != nil {
+		return err
+	}
+	_, err = conn.produce(s.opts.Topic, partition.ID, s.opts.RequiredAcks, s.opts.Timeout, records)
+	return err
+}
+
+func (s *KafkaSink) conn(address string) (*kafkaConn, error) {
+	if conn, ok := s.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := dialKafka(address, s.opts.ClientID, s.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.conns[address] = conn
+	return conn, nil
+}
+
+func (s *KafkaSink) refreshMetadata() error {
+	if len(s.opts.Brokers) == 0 {
+		return errors.New("kafka: no bootstrap brokers")
+	}
+	var err error
+	for _, address := range s.opts.Brokers {
+		var conn *kafkaConn
+		if conn, err = s.conn(address); err != nil {
+			continue
+		}
+		var m kafkaMetadata
+		if m, err = conn.metadata(1, []string{s.opts.Topic}); err != nil {
+			conn.Close()
+			delete(s.conns, address)
+			continue
+		}
+		s.metadata = &m
+		return nil
+	}
+	return err
+}
+
+// reset drops cached metadata and connections after a failure.
+func (s *KafkaSink) reset() {
+	s.metadata = nil
+	for address, conn := range s.conns {
+		conn.Close()
+		delete(s.conns, address)
+	}
+}
+
+// Close flushes buffered records and closes all broker connections.
+func (s *KafkaSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	err := s.flush()
+	s.reset()
+	return err
+}
@@ -0,0 +1,239 @@
+package libprobe_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+	"github.com/go-ping/ping"
+
+	"github.com/stretchr/testify/require"
+)
+
+type kafkaTestRequest struct {
+	APIKey        int16
+	APIVersion    int16
+	CorrelationID int32
+	Body          []byte
+}
+
+// newKafkaTestBroker serves a topic with the given partitions, listed in
+// that order and defaulting to a single one, answering Metadata and Produce
+// requests and forwarding every request to the returned channel.
+func newKafkaTestBroker(t *testing.T, topic string, partitions ...int32) (string, <-chan kafkaTestRequest) {
+	if len(partitions) == 0 {
+		partitions = []int32{0}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	host, portStr, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	requests := make(chan kafkaTestRequest, 10)
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					req := kafkaTestRequest{
+						APIKey:        int16(binary.BigEndian.Uint16(buf)),
+						APIVersion:    int16(binary.BigEndian.Uint16(buf[2:])),
+						CorrelationID: int32(binary.BigEndian.Uint32(buf[4:])),
+					}
+					clientIDLen := int(binary.BigEndian.Uint16(buf[8:]))
+					req.Body = buf[10+clientIDLen:]
+					requests <- req
+
+					resp := []byte{0, 0, 0, 0}
+					resp = appendInt32(resp, req.CorrelationID)
+					switch req.APIKey {
+					case 3:
+						resp = appendInt32(resp, 1)
+						resp = appendInt32(resp, 1)
+						resp = appendString(resp, host)
+						resp = appendInt32(resp, int32(port))
+						resp = append(resp, 0xff, 0xff)
+						resp = appendInt32(resp, 1)
+						resp = appendInt32(resp, 1)
+						resp = append(resp, 0, 0)
+						resp = appendString(resp, topic)
+						resp = append(resp, 0)
+						resp = appendInt32(resp, int32(len(partitions)))
+						for _, id := range partitions {
+							resp = append(resp, 0, 0)
+							resp = appendInt32(resp, id)
+							resp = appendInt32(resp, 1)
+							resp = appendInt32(resp, 1)
+							resp = appendInt32(resp, 1)
+							resp = appendInt32(resp, 1)
+							resp = appendInt32(resp, 1)
+						}
+					case 0:
+						resp = appendInt32(resp, 1)
+						resp = appendString(resp, topic)
+						resp = appendInt32(resp, 1)
+						resp = appendInt32(resp, 0)
+						resp = append(resp, 0, 0)
+						resp = append(resp, 0, 0, 0, 0, 0, 0, 0, 42)
+						resp = append(resp, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+						resp = appendInt32(resp, 0)
+					default:
+						return
+					}
+					binary.BigEndian.PutUint32(resp, uint32(len(resp)-4))
+					if _, err := conn.Write(resp); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), requests
+}
+
+func appendInt32(b []byte, v int32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func TestKafkaSink(t *testing.T) {
+	addr, requests := newKafkaTestBroker(t, "probes")
+	sink := libprobe.NewKafkaSink(libprobe.KafkaSinkOptions{
+		Brokers: []string{addr},
+		Topic:   "probes",
+		Linger:  -1,
+	})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sink.Write(&libprobe.TCPResult{
+			Target:      libprobe.Target{Address: "1.1.1.1:80"},
+			ConnectTime: time.Millisecond,
+		}))
+	}
+	require.NoError(t, sink.Close())
+
+	metadata := <-requests
+	require.Equal(t, int16(3), metadata.APIKey)
+	produce := <-requests
+	require.Equal(t, int16(0), produce.APIKey)
+	require.Equal(t, int16(3), produce.APIVersion)
+
+	body := produce.Body
+	body = body[2+2+4:]                           // transactional ID, acks, timeout
+	body = body[4+2+len("probes")+4+4:]           // topic array, partition array, partition
+	batch := body[4:]                             // records size
+	require.Equal(t, byte(2), batch[16], "magic") // base offset, length, leader epoch
+	crc := binary.BigEndian.Uint32(batch[17:])
+	require.Equal(t, crc32.Checksum(batch[21:], crc32.MakeTable(crc32.Castagnoli)), crc)
+	require.Equal(t, uint32(3), binary.BigEndian.Uint32(batch[57:]), "record count")
+}
+
+func TestKafkaSinkPartitionOrder(t *testing.T) {
+	// The Java partitioner maps 1.1.1.1:80 to partition 1 and 8.8.8.8:53 to
+	// partition 0 of two, whichever order the broker lists them in.
+	addr, requests := newKafkaTestBroker(t, "probes", 1, 0)
+	sink := libprobe.NewKafkaSink(libprobe.KafkaSinkOptions{
+		Brokers: []string{addr},
+		Topic:   "probes",
+		Linger:  -1,
+	})
+	for _, address := range []string{"1.1.1.1:80", "8.8.8.8:53"} {
+		require.NoError(t, sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: address}}))
+	}
+	require.NoError(t, sink.Close())
+
+	require.Equal(t, int16(3), (<-requests).APIKey)
+	produced := make(map[int32][]byte)
+	for i := 0; i < 2; i++ {
+		produce := <-requests
+		require.Equal(t, int16(0), produce.APIKey)
+		partition := int32(binary.BigEndian.Uint32(produce.Body[2+2+4+4+2+len("probes")+4:]))
+		produced[partition] = produce.Body
+	}
+	require.Contains(t, string(produced[1]), "1.1.1.1:80")
+	require.NotContains(t, string(produced[1]), "8.8.8.8:53")
+	require.Contains(t, string(produced[0]), "8.8.8.8:53")
+	require.NotContains(t, string(produced[0]), "1.1.1.1:80")
+}
+
+func TestKafkaSinkProto(t *testing.T) {
+	addr, requests := newKafkaTestBroker(t, "probes")
+	sink := libprobe.NewKafkaSink(libprobe.KafkaSinkOptions{
+		Brokers: []string{addr},
+		Topic:   "probes",
+		Encode:  libprobe.MarshalResultProto,
+		Linger:  -1,
+	})
+	require.NoError(t, sink.Write(&libprobe.ICMPResult{
+		Target: libprobe.Target{Address: "1.1.1.1"},
+		Stats:  &ping.Statistics{PacketsSent: 4, PacketsRecv: 3, PacketLoss: 25, AvgRtt: time.Millisecond},
+		Route:  []libprobe.ICMPRouteHop{{Address: "10.0.0.1"}, {Address: "1.1.1.1", Timestamp: 7, HasTimestamp: true}},
+	}))
+	require.NoError(t, sink.Close())
+	<-requests
+	produce := <-requests
+
+	body := produce.Body[2+2+4+4+2+len("probes")+4+4+4:]
+	records := body[61:] // record batch header
+	_, n := binary.Varint(records)
+	rec := records[n+1:] // length, attributes
+	for i := 0; i < 2; i++ {
+		_, n = binary.Varint(rec) // timestamp and offset deltas
+		rec = rec[n:]
+	}
+	keyLen, n := binary.Varint(rec)
+	require.Equal(t, "1.1.1.1", string(rec[n:n+int(keyLen)]))
+	rec = rec[n+int(keyLen):]
+	valueLen, n := binary.Varint(rec)
+	value := rec[n : n+int(valueLen)]
+
+	msg := pbFields(t, value)
+	require.Equal(t, "ICMP", string(msg[1][0]))
+	require.Equal(t, "1.1.1.1", string(msg[2][0]))
+	rtt, _ := binary.Uvarint(msg[3][0])
+	require.Equal(t, uint64(time.Millisecond), rtt)
+	require.Empty(t, msg[4][0])
+	columns := make(map[string]map[int][][]byte)
+	for _, entry := range msg[5] {
+		e := pbFields(t, entry)
+		columns[string(e[1][0])] = pbFields(t, e[2][0])
+	}
+	recv, _ := binary.Uvarint(columns["stats_packets_recv"][2][0])
+	require.Equal(t, uint64(3), recv)
+	require.Equal(t, 25.0, math.Float64frombits(binary.LittleEndian.Uint64(columns["stats_packet_loss"][4][0])))
+	require.Equal(t, []byte{0}, columns["source_mismatch"][5][0])
+	require.NotContains(t, columns, "kind")
+
+	require.Len(t, msg[6], 2)
+	row := pbFields(t, msg[6][1])
+	require.Equal(t, "route", string(row[1][0]))
+	require.Equal(t, []byte{1}, row[2][0])
+	hop := make(map[string]map[int][][]byte)
+	for _, entry := range row[3] {
+		e := pbFields(t, entry)
+		hop[string(e[1][0])] = pbFields(t, e[2][0])
+	}
+	require.Equal(t, "1.1.1.1", string(hop["address"][1][0]))
+	require.Equal(t, []byte{1}, hop["has_timestamp"][5][0])
+}
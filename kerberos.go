@@ -0,0 +1,291 @@
+package libprobe
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindKerberos = "KERBEROS"
+
+// Kerberos message tags and error codes (RFC 4120).
+const (
+	krbASReq    = 0x6a
+	krbASRep    = 0x6b
+	krbErrorMsg = 0x7e
+
+	krbGeneralString   = 0x1b
+	krbGeneralizedTime = 0x18
+	krbBitString       = 0x03
+
+	krbErrPreauthRequired = 25
+)
+
+var krbErrorNames = map[int64]string{
+	6:  "KDC_ERR_C_PRINCIPAL_UNKNOWN",
+	7:  "KDC_ERR_S_PRINCIPAL_UNKNOWN",
+	12: "KDC_ERR_POLICY",
+	14: "KDC_ERR_ETYPE_NOSUPP",
+	18: "KDC_ERR_CLIENT_REVOKED",
+	23: "KDC_ERR_KEY_EXPIRED",
+	24: "KDC_ERR_PREAUTH_FAILED",
+	25: "KDC_ERR_PREAUTH_REQUIRED",
+	37: "KRB_AP_ERR_SKEW",
+	52: "KRB_ERR_RESPONSE_TOO_BIG",
+	60: "KRB_ERR_GENERIC",
+	68: "KDC_ERR_WRONG_REALM",
+}
+
+func krbErrorName(code int64) string {
+	if name, ok := krbErrorNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("KRB_ERROR_%d", code)
+}
+
+// KerberosProberOptions configures a KerberosProber.
+type KerberosProberOptions struct {
+	// Realm is the realm of the principal, e.g. "CORP.EXAMPLE.COM".
+	Realm string
+	// Principal is the client principal of the AS-REQ. It should require
+	// pre-authentication, as every Active Directory account does by
+	// default. Default: "krbprobe".
+	Principal string
+	// Networks are the transports to probe. Default: "udp" and "tcp".
+	Networks []string
+}
+
+// KerberosTransport is the outcome of an AS-REQ over one transport.
+type KerberosTransport struct {
+	Network string
+	RTT     time.Duration
+	// ErrorCode is the code of the KRB-ERROR answered, 25
+	// (KDC_ERR_PREAUTH_REQUIRED) for a healthy KDC.
+	ErrorCode  int
+	ErrorName  string
+	Realm      string
+	ServerTime time.Time
+	Error      string
+}
+
+type KerberosResult struct {
+	Target
+	Error error
+
+	Transports []KerberosTransport
+}
+
+// RTT returns the average RTT of the transports that got an answer.
+func (r KerberosResult) RTT() time.Duration {
+	var total time.Duration
+	var n int
+	for _, t := range r.Transports {
+		if t.RTT > 0 {
+			total += t.RTT
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / time.Duration(n)
+}
+
+func (r KerberosResult) String() string {
+	var b strings.Builder
+	for _, t := range r.Transports {
+		fmt.Fprintf(&b, "%s/%s %s %s", t.Network, r.Target.Address, t.RTT, t.ErrorName)
+		if t.Error != "" {
+			fmt.Fprintf(&b, " error=%s", t.Error)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// KerberosProber sends an AS-REQ without pre-authentication data to the KDC
+// in Target.Address, over UDP and TCP port 88 by default, and expects a
+// KDC_ERR_PREAUTH_REQUIRED error in return. This exercises the KDC without
+// credentials. Any other answer fails the transport.
+type KerberosProber struct {
+	opts KerberosProberOptions
+}
+
+func NewKerberosProber(opts KerberosProberOptions) *KerberosProber {
+	if opts.Principal == "" {
+		opts.Principal = "krbprobe"
+	}
+	if len(opts.Networks) == 0 {
+		opts.Networks = []string{"udp", "tcp"}
+	}
+	return &KerberosProber{opts: opts}
+}
+
+func (p *KerberosProber) Kind() string {
+	return KindKerberos
+}
+
+// krbTag wraps elements in an explicit context-specific tag.
+func krbTag(n byte, contents ...[]byte) []byte {
+	return berTLV(0xa0|n, contents...)
+}
+
+func krbPrincipalName(nameType int64, components ...string) []byte {
+	names := make([][]byte, len(components))
+	for i, c := range components {
+		names[i] = berString(krbGeneralString, c)
+	}
+	return berTLV(berSequence,
+		krbTag(0, berInt(berInteger, nameType)),
+		krbTag(1, berTLV(berSequence, names...)),
+	)
+}
+
+func (p *KerberosProber) asReq() ([]byte, error) {
+	var nonce [4]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	body := berTLV(berSequence,
+		krbTag(0, berTLV(krbBitString, []byte{0, 0x40, 0, 0, 0x10})), // forwardable, renewable-ok
+		krbTag(1, krbPrincipalName(1, strings.Split(p.opts.Principal, "/")...)),
+		krbTag(2, berString(krbGeneralString, p.opts.Realm)),
+		krbTag(3, krbPrincipalName(2, "krbtgt", p.opts.Realm)),
+		krbTag(5, berString(krbGeneralizedTime, "20370913024805Z")),
+		krbTag(7, berInt(berInteger, int64(binary.BigEndian.Uint32(nonce[:])>>1))),
+		// aes256-cts-hmac-sha1-96, aes128-cts-hmac-sha1-96, rc4-hmac
+		krbTag(8, berTLV(berSequence, berInt(berInteger, 18), berInt(berInteger, 17), berInt(berInteger, 23))),
+	)
+	return berTLV(krbASReq, berTLV(berSequence,
+		krbTag(1, berInt(berInteger, 5)),
+		krbTag(2, berInt(berInteger, 10)),
+		krbTag(4, body),
+	)), nil
+}
+
+// krbExchange sends req over network and returns the reply.
+func krbExchange(meter *trafficMeter, network, address string, req []byte, deadline time.Time) ([]byte, error) {
+	conn, err := dialTimeout(meter, network, address, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if network == "udp" {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+	// Messages over TCP are prefixed with their length.
+	msg := make([]byte, 4+len(req))
+	binary.BigEndian.PutUint32(msg, uint32(len(req)))
+	copy(msg[4:], req)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var l [4]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > berMaxLength {
+		return nil, errors.New("kerberos: reply too large")
+	}
+	resp := make([]byte, n)
+	_, err = io.ReadFull(conn, resp)
+	return resp, err
+}
+
+// parseReply fills t from a KDC reply.
+func (t *KerberosTransport) parseReply(b []byte) error {
+	msg, _, err := berDecode(b)
+	if err != nil {
+		return err
+	}
+	switch msg.Tag {
+	case krbASRep:
+		return errors.New("kerberos: principal does not require pre-authentication")
+	case krbErrorMsg:
+	default:
+		return fmt.Errorf("kerberos: unexpected message 0x%02x", msg.Tag)
+	}
+	seq, _, err := berDecode(msg.Content)
+	if err != nil {
+		return err
+	}
+	fields, err := berChildren(seq.Content)
+	if err != nil {
+		return err
+	}
+	code := int64(-1)
+	for _, f := range fields {
+		inner, _, err := berDecode(f.Content)
+		if err != nil {
+			return err
+		}
+		switch f.Tag {
+		case 0xa4: // stime
+			t.ServerTime, _ = time.Parse("20060102150405Z", string(inner.Content))
+		case 0xa6: // error-code
+			code = berParseInt(inner.Content)
+		case 0xa9: // realm
+			t.Realm = string(inner.Content)
+		}
+	}
+	if code < 0 {
+		return errors.New("kerberos: malformed KRB-ERROR")
+	}
+	t.ErrorCode = int(code)
+	t.ErrorName = krbErrorName(code)
+	if code != krbErrPreauthRequired {
+		return fmt.Errorf("kerberos: %s", t.ErrorName)
+	}
+	return nil
+}
+
+func (p *KerberosProber) Probe(target Target) (Result, error) {
+	if p.opts.Realm == "" {
+		return nil, errors.New("kerberos: no realm")
+	}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "88")
+	}
+	if target.Timeout <= 0 {
+		target.Timeout = 5 * time.Second
+	}
+	r := &KerberosResult{Target: target}
+	var failed int
+	for _, network := range p.opts.Networks {
+		t := KerberosTransport{Network: network}
+		req, err := p.asReq()
+		if err != nil {
+			return nil, err
+		}
+		startAt := time.Now()
+		resp, err := krbExchange(target.meter, network, address, req, startAt.Add(target.Timeout))
+		if err == nil {
+			t.RTT = time.Since(startAt)
+			err = t.parseReply(resp)
+		}
+		if err != nil {
+			t.Error = err.Error()
+			failed++
+		}
+		r.Transports = append(r.Transports, t)
+	}
+	if failed > 0 {
+		r.Error = fmt.Errorf("kerberos: %d of %d transports failed", failed, len(r.Transports))
+	}
+	return r, nil
+}
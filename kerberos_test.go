@@ -0,0 +1,96 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// krbError builds a KRB-ERROR message with the given error code.
+func krbError(code byte) []byte {
+	return tlv(0x7e, tlv(0x30,
+		tlv(0xa0, tlv(0x02, []byte{5})),
+		tlv(0xa1, tlv(0x02, []byte{30})),
+		tlv(0xa4, tlv(0x18, []byte("20240102030405Z"))),
+		tlv(0xa5, tlv(0x02, []byte{0})),
+		tlv(0xa6, tlv(0x02, []byte{code})),
+		tlv(0xa9, tlv(0x1b, []byte("CORP.EXAMPLE.COM"))),
+	))
+}
+
+// serveKDC answers AS-REQs over UDP and TCP on the same port with the
+// given error code.
+func serveKDC(t *testing.T, code byte) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n > 0 && buf[0] == 0x6a {
+				pc.WriteTo(krbError(code), from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var l [4]byte
+				if _, err := io.ReadFull(conn, l[:]); err != nil {
+					return
+				}
+				tag, _, err := readTLV(bufio.NewReader(io.LimitReader(conn, int64(binary.BigEndian.Uint32(l[:])))))
+				if err != nil || tag != 0x6a {
+					return
+				}
+				msg := krbError(code)
+				binary.BigEndian.PutUint32(l[:], uint32(len(msg)))
+				conn.Write(append(l[:], msg...))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestKerberosProber(t *testing.T) {
+	prober := libprobe.NewKerberosProber(libprobe.KerberosProberOptions{Realm: "CORP.EXAMPLE.COM"})
+	r, err := prober.Probe(libprobe.Target{Address: serveKDC(t, 25), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.KerberosResult)
+	require.NoError(t, res.Error)
+	require.Len(t, res.Transports, 2)
+	for i, network := range []string{"udp", "tcp"} {
+		tr := res.Transports[i]
+		require.Equal(t, network, tr.Network)
+		require.Equal(t, 25, tr.ErrorCode)
+		require.Equal(t, "KDC_ERR_PREAUTH_REQUIRED", tr.ErrorName)
+		require.Equal(t, "CORP.EXAMPLE.COM", tr.Realm)
+		require.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), tr.ServerTime)
+		require.NotZero(t, tr.RTT)
+	}
+
+	r, err = prober.Probe(libprobe.Target{Address: serveKDC(t, 6), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.KerberosResult)
+	require.Error(t, res.Error)
+	require.Equal(t, "kerberos: KDC_ERR_C_PRINCIPAL_UNKNOWN", res.Transports[0].Error)
+}
@@ -0,0 +1,185 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindKeyExchange = "KEY_EXCHANGE"
+
+// KeyExchangeProberOptions configures a KeyExchangeProber.
+type KeyExchangeProberOptions struct {
+	// ServerName is sent in the SNI extension. Default: the host of
+	// Target.Address.
+	ServerName string
+	// Groups are the key exchange groups tested. Default: the hybrid
+	// post-quantum X25519MLKEM768.
+	Groups []tls.CurveID
+	// Baseline is the group the others are compared to. Default: X25519.
+	Baseline tls.CurveID
+}
+
+// KeyExchangeHandshake is a handshake offering a single group, which
+// succeeds only when the server negotiates it.
+type KeyExchangeHandshake struct {
+	Group string
+	// Error is the error of the handshake, typically a handshake failure
+	// alert when the server doesn't support the group.
+	Error         error
+	Version       string
+	HandshakeTime time.Duration
+	// BytesSent and BytesReceived are the bytes of the handshake, the key
+	// shares of post-quantum groups being much larger than classical ones.
+	BytesSent     int64
+	BytesReceived int64
+	// SizeOverhead and LatencyOverhead are the bytes and time the handshake
+	// takes over the baseline, when both succeeded.
+	SizeOverhead    int64
+	LatencyOverhead time.Duration
+}
+
+// KeyExchangeResult reports the key exchange groups a TLS server negotiates
+// and their cost.
+type KeyExchangeResult struct {
+	Target
+	// Error is the error of the baseline handshake.
+	Error      error
+	Baseline   KeyExchangeHandshake
+	Handshakes []KeyExchangeHandshake
+	TotalTime  time.Duration
+}
+
+func (r KeyExchangeResult) RTT() time.Duration {
+	return r.TotalTime
+}
+
+func (r KeyExchangeResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "-> %s", r.Target.Address)
+	if r.Error != nil {
+		fmt.Fprintf(&b, ": %v", r.Error)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\n%s: %d bytes in %v (baseline)", r.Baseline.Group, r.Baseline.BytesSent+r.Baseline.BytesReceived, r.Baseline.HandshakeTime)
+	for _, h := range r.Handshakes {
+		if h.Error != nil {
+			fmt.Fprintf(&b, "\n%s: %v", h.Group, h.Error)
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s: %d bytes in %v (%+d bytes, %+v)", h.Group, h.BytesSent+h.BytesReceived, h.HandshakeTime, h.SizeOverhead, h.LatencyOverhead)
+	}
+	return b.String()
+}
+
+// Traffic returns the bytes of the handshakes.
+func (r KeyExchangeResult) Traffic() Traffic {
+	t := Traffic{BytesSent: r.Baseline.BytesSent, BytesReceived: r.Baseline.BytesReceived}
+	for _, h := range r.Handshakes {
+		t = t.Add(Traffic{BytesSent: h.BytesSent, BytesReceived: h.BytesReceived})
+	}
+	return t
+}
+
+// KeyExchangeProber performs TLS 1.3 handshakes with Target.Address, "host"
+// or "host:port" with port 443 by default, offering a single key exchange
+// group each, to track the rollout of hybrid post-quantum key exchange.
+// Offering one group at a time tells which the server supports without
+// relying on its preferences. Each handshake has Target.Timeout, and
+// certificates aren't verified, as TLSProber does.
+type KeyExchangeProber struct {
+	opts KeyExchangeProberOptions
+}
+
+func NewKeyExchangeProber(opts KeyExchangeProberOptions) *KeyExchangeProber {
+	if opts.Groups == nil {
+		opts.Groups = []tls.CurveID{tls.X25519MLKEM768}
+	}
+	if opts.Baseline == 0 {
+		opts.Baseline = tls.X25519
+	}
+	return &KeyExchangeProber{opts: opts}
+}
+
+func (p *KeyExchangeProber) Kind() string {
+	return KindKeyExchange
+}
+
+func (p *KeyExchangeProber) Probe(target Target) (Result, error) {
+	r := &KeyExchangeResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "443")
+	}
+	host, _, _ := net.SplitHostPort(address)
+	startAt := time.Now()
+	handshake := func(group tls.CurveID) KeyExchangeHandshake {
+		config := unverifiedTLSConfig(&tls.Config{
+			ServerName:       p.opts.ServerName,
+			MinVersion:       tls.VersionTLS13,
+			CurvePreferences: []tls.CurveID{group},
+		}, host)
+		return keyExchangeHandshake(target.meter, address, config, group, target.Timeout)
+	}
+	r.Baseline = handshake(p.opts.Baseline)
+	if r.Error = r.Baseline.Error; r.Error != nil {
+		r.TotalTime = time.Since(startAt)
+		return r, nil
+	}
+	baselineSize := r.Baseline.BytesSent + r.Baseline.BytesReceived
+	for _, group := range p.opts.Groups {
+		h := handshake(group)
+		if h.Error == nil {
+			h.SizeOverhead = h.BytesSent + h.BytesReceived - baselineSize
+			h.LatencyOverhead = h.HandshakeTime - r.Baseline.HandshakeTime
+		}
+		r.Handshakes = append(r.Handshakes, h)
+	}
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+// keyExchangeHandshake performs a handshake with config, counting its
+// bytes.
+func keyExchangeHandshake(meter *trafficMeter, address string, config *tls.Config, group tls.CurveID, timeout time.Duration) KeyExchangeHandshake {
+	h := KeyExchangeHandshake{Group: group.String()}
+	startAt := time.Now()
+	conn, err := dialTimeout(meter, "tcp", address, timeout)
+	if err != nil {
+		h.Error = err
+		return h
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(timeout))
+	}
+	counter := &countingConn{Conn: conn}
+	handshakeAt := time.Now()
+	tlsConn := tls.Client(counter, config)
+	if h.Error = tlsConn.Handshake(); h.Error == nil {
+		h.HandshakeTime = time.Since(handshakeAt)
+		h.Version = tlsVersionName(tlsConn.ConnectionState().Version)
+	}
+	h.BytesSent, h.BytesReceived = counter.sent, counter.received
+	return h
+}
+
+// countingConn counts the bytes written to and read from a connection.
+type countingConn struct {
+	net.Conn
+	sent, received int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received += int64(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sent += int64(n)
+	return n, err
+}
@@ -0,0 +1,51 @@
+package libprobe_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyExchangeProber(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	target := libprobe.Target{Address: srv.Listener.Addr().String(), Timeout: 5 * time.Second}
+
+	r, err := libprobe.NewKeyExchangeProber(libprobe.KeyExchangeProberOptions{}).Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.KeyExchangeResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "X25519", res.Baseline.Group)
+	require.Equal(t, "TLS 1.3", res.Baseline.Version)
+	require.Len(t, res.Handshakes, 1)
+	h := res.Handshakes[0]
+	require.Equal(t, "X25519MLKEM768", h.Group)
+	require.NoError(t, h.Error)
+	require.Positive(t, h.HandshakeTime)
+	// The ML-KEM encapsulation key and ciphertext add over 2KB.
+	require.Greater(t, h.SizeOverhead, int64(2000))
+	require.Equal(t, h.BytesSent+h.BytesReceived-res.Baseline.BytesSent-res.Baseline.BytesReceived, h.SizeOverhead)
+	require.Equal(t, res.Baseline.BytesSent+h.BytesSent, res.Traffic().BytesSent)
+
+	// A server without post-quantum key exchange refuses the handshake.
+	classical := httptest.NewUnstartedServer(http.NotFoundHandler())
+	classical.TLS = &tls.Config{CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256}}
+	classical.StartTLS()
+	defer classical.Close()
+	r, err = libprobe.NewKeyExchangeProber(libprobe.KeyExchangeProberOptions{
+		Groups: []tls.CurveID{tls.X25519MLKEM768, tls.CurveP256},
+	}).Probe(libprobe.Target{Address: classical.Listener.Addr().String(), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.KeyExchangeResult)
+	require.NoError(t, res.Error)
+	require.Error(t, res.Handshakes[0].Error)
+	require.Zero(t, res.Handshakes[0].SizeOverhead)
+	require.NoError(t, res.Handshakes[1].Error)
+	require.Equal(t, "CurveP256", res.Handshakes[1].Group)
+}
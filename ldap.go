@@ -0,0 +1,465 @@
+package libprobe
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindLDAP = "LDAP"
+
+// LDAPTLSMode selects how an LDAPProber secures its connection.
+type LDAPTLSMode int
+
+const (
+	// LDAPPlain doesn't use TLS.
+	LDAPPlain LDAPTLSMode = iota
+	// LDAPStartTLS upgrades a plain connection with the StartTLS operation.
+	LDAPStartTLS
+	// LDAPS connects with implicit TLS, as on port 636.
+	LDAPS
+)
+
+// LDAP protocol operations.
+const (
+	ldapBindRequest       = 0x60
+	ldapBindResponse      = 0x61
+	ldapSearchRequest     = 0x63
+	ldapSearchResultEntry = 0x64
+	ldapSearchResultDone  = 0x65
+	ldapSearchResultRef   = 0x73
+	ldapUnbindRequest     = 0x42
+	ldapExtendedRequest   = 0x77
+	ldapExtendedResponse  = 0x78
+)
+
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+var ldapResultCodes = map[int64]string{
+	1:  "operationsError",
+	2:  "protocolError",
+	7:  "authMethodNotSupported",
+	8:  "strongerAuthRequired",
+	32: "noSuchObject",
+	48: "inappropriateAuthentication",
+	49: "invalidCredentials",
+	50: "insufficientAccessRights",
+	51: "busy",
+	52: "unavailable",
+	53: "unwillingToPerform",
+	80: "other",
+}
+
+// ldapRootDSEAttributes are requested explicitly as some servers leave them
+// out of "*" and "+".
+var ldapRootDSEAttributes = []string{
+	"*", "+",
+	"namingContexts", "defaultNamingContext", "supportedControl", "supportedExtension",
+	"supportedSASLMechanisms", "supportedLDAPVersion", "vendorName", "vendorVersion", "dnsHostName",
+}
+
+// LDAPProberOptions configures an LDAPProber.
+type LDAPProberOptions struct {
+	TLS LDAPTLSMode
+	// TLSConfig configures TLS, e.g. RootCAs to verify certificates of an
+	// internal CA with. Its ServerName defaults to the host dialed.
+	TLSConfig *tls.Config
+	// ExpectedNames are the names the server certificate must be valid
+	// for, e.g. both the host name of a domain controller and the domain.
+	// Default: the server name.
+	ExpectedNames []string
+	// Bind binds before the search, with a simple bind of BindDN and
+	// Password, anonymously when both are empty.
+	Bind     bool
+	BindDN   string
+	Password string
+}
+
+// LDAPRootDSE holds the RootDSE of a directory server.
+type LDAPRootDSE struct {
+	NamingContexts          []string
+	DefaultNamingContext    string
+	SupportedControls       []string
+	SupportedExtensions     []string
+	SupportedSASLMechanisms []string
+	SupportedLDAPVersions   []string
+	VendorName              string
+	VendorVersion           string
+	DNSHostName             string
+	// Attributes holds every attribute returned, the above included.
+	Attributes map[string][]string
+}
+
+type LDAPResult struct {
+	Target
+	Error error
+
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	BindTime         time.Duration
+	SearchTime       time.Duration
+	TotalTime        time.Duration
+	TLSVersion       string
+	Certificate      *CertificateInfo
+	RootDSE          *LDAPRootDSE
+	// BindResultCode is the result code of the bind, e.g. 49 for
+	// invalidCredentials.
+	BindResultCode int64
+}
+
+func (r LDAPResult) RTT() time.Duration {
+	return r.TotalTime
+}
+
+func (r LDAPResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("Error: %s", r.Error)
+	}
+	s := fmt.Sprintf("-> %s Connect: %s, TLS Handshake: %s, Bind: %s, Search: %s. Total: %s",
+		r.Target.Address, r.ConnectTime, r.TLSHandshakeTime, r.BindTime, r.SearchTime, r.TotalTime)
+	if r.RootDSE != nil && len(r.RootDSE.NamingContexts) > 0 {
+		s += "\nNaming contexts: " + strings.Join(r.RootDSE.NamingContexts, ", ")
+	}
+	return s
+}
+
+// LDAPProber connects to the directory server in Target.Address, optionally
+// over TLS, optionally binds, and reads its RootDSE. Server certificates are
+// checked against LDAPProberOptions.ExpectedNames; Certificate is reported
+// even when the check fails.
+type LDAPProber struct {
+	opts LDAPProberOptions
+}
+
+func NewLDAPProber(opts LDAPProberOptions) *LDAPProber {
+	return &LDAPProber{opts: opts}
+}
+
+func (p *LDAPProber) Kind() string {
+	return KindLDAP
+}
+
+// ldapConn is an LDAP connection sending requests one at a time.
+type ldapConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	nextID int64
+}
+
+func newLDAPConn(conn net.Conn) *ldapConn {
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn), nextID: 1}
+}
+
+// send sends a request and returns its message ID.
+func (c *ldapConn) send(op []byte) (int64, error) {
+	id := c.nextID
+	c.nextID++
+	_, err := c.conn.Write(berTLV(berSequence, berInt(berInteger, id), op))
+	return id, err
+}
+
+// recv reads the next response to the request id.
+func (c *ldapConn) recv(id int64) (berElement, error) {
+	for {
+		msg, err := berReadFrom(c.r)
+		if err != nil {
+			return berElement{}, err
+		}
+		if msg.Tag != berSequence {
+			return berElement{}, errors.New("ldap: malformed message")
+		}
+		children, err := berChildren(msg.Content)
+		if err != nil {
+			return berElement{}, err
+		}
+		if len(children) < 2 || children[0].Tag != berInteger {
+			return berElement{}, errors.New("ldap: malformed message")
+		}
+		// Unsolicited notifications have ID 0, e.g. a notice of disconnection.
+		if msgID := berParseInt(children[0].Content); msgID == id {
+			return children[1], nil
+		} else if msgID == 0 {
+			if err := ldapResultError(children[1]); err != nil {
+				return berElement{}, err
+			}
+			return berElement{}, errors.New("ldap: unsolicited notification")
+		}
+	}
+}
+
+// ldapResultError returns the error of an LDAPResult, nil on success.
+func ldapResultError(op berElement) error {
+	_, err := ldapParseResult(op)
+	return err
+}
+
+// ldapParseResult returns the result code of an LDAPResult and its error,
+// nil on success.
+func ldapParseResult(op berElement) (int64, error) {
+	fields, err := berChildren(op.Content)
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) < 3 || fields[0].Tag != berEnumerated {
+		return 0, errors.New("ldap: malformed result")
+	}
+	code := berParseInt(fields[0].Content)
+	if code == 0 {
+		return 0, nil
+	}
+	name, ok := ldapResultCodes[code]
+	if !ok {
+		name = fmt.Sprintf("result code %d", code)
+	}
+	if msg := string(fields[2].Content); msg != "" {
+		return code, fmt.Errorf("ldap: %s: %s", name, msg)
+	}
+	return code, fmt.Errorf("ldap: %s", name)
+}
+
+func (c *ldapConn) startTLS() error {
+	id, err := c.send(berTLV(ldapExtendedRequest, berString(0x80, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	resp, err := c.recv(id)
+	if err != nil {
+		return err
+	}
+	if resp.Tag != ldapExtendedResponse {
+		return errors.New("ldap: unexpected response to StartTLS")
+	}
+	return ldapResultError(resp)
+}
+
+// bind performs an LDAPv3 simple bind and returns its result code.
+func (c *ldapConn) bind(dn, password string) (int64, error) {
+	id, err := c.send(berTLV(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(0x80, password), // simple
+	))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.recv(id)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Tag != ldapBindResponse {
+		return 0, errors.New("ldap: unexpected response to bind")
+	}
+	return ldapParseResult(resp)
+}
+
+// searchRootDSE reads the RootDSE: a base search of the empty DN for any
+// object class.
+func (c *ldapConn) searchRootDSE() (*LDAPRootDSE, error) {
+	attrs := make([][]byte, len(ldapRootDSEAttributes))
+	for i, a := range ldapRootDSEAttributes {
+		attrs[i] = berString(berOctetString, a)
+	}
+	id, err := c.send(berTLV(ldapSearchRequest,
+		berString(berOctetString, ""),
+		berInt(berEnumerated, 0), // baseObject
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 0),
+		berInt(berInteger, 0),
+		berBool(false),
+		berString(0x87, "objectClass"), // present filter
+		berTLV(berSequence, attrs...),
+	))
+	if err != nil {
+		return nil, err
+	}
+	dse := &LDAPRootDSE{Attributes: make(map[string][]string)}
+	for {
+		resp, err := c.recv(id)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Tag {
+		case ldapSearchResultEntry:
+			if err := dse.parse(resp.Content); err != nil {
+				return nil, err
+			}
+		case ldapSearchResultRef:
+		case ldapSearchResultDone:
+			if err := ldapResultError(resp); err != nil {
+				return nil, err
+			}
+			return dse, nil
+		default:
+			return nil, errors.New("ldap: unexpected response to search")
+		}
+	}
+}
+
+func (dse *LDAPRootDSE) parse(entry []byte) error {
+	fields, err := berChildren(entry)
+	if err != nil {
+		return err
+	}
+	if len(fields) < 2 {
+		return errors.New("ldap: malformed search entry")
+	}
+	attrs, err := berChildren(fields[1].Content)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		parts, err := berChildren(attr.Content)
+		if err != nil {
+			return err
+		}
+		if len(parts) < 2 {
+			return errors.New("ldap: malformed attribute")
+		}
+		vals, err := berChildren(parts[1].Content)
+		if err != nil {
+			return err
+		}
+		name := string(parts[0].Content)
+		for _, v := range vals {
+			dse.Attributes[name] = append(dse.Attributes[name], string(v.Content))
+		}
+	}
+	get := func(name string) []string {
+		for k, v := range dse.Attributes {
+			if strings.EqualFold(k, name) {
+				return v
+			}
+		}
+		return nil
+	}
+	first := func(name string) string {
+		if v := get(name); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	dse.NamingContexts = get("namingContexts")
+	dse.DefaultNamingContext = first("defaultNamingContext")
+	dse.SupportedControls = get("supportedControl")
+	dse.SupportedExtensions = get("supportedExtension")
+	dse.SupportedSASLMechanisms = get("supportedSASLMechanisms")
+	dse.SupportedLDAPVersions = get("supportedLDAPVersion")
+	dse.VendorName = first("vendorName")
+	dse.VendorVersion = first("vendorVersion")
+	dse.DNSHostName = first("dnsHostName")
+	return nil
+}
+
+func (c *ldapConn) unbind() error {
+	_, err := c.send([]byte{ldapUnbindRequest, 0})
+	return err
+}
+
+func (p *LDAPProber) Probe(target Target) (Result, error) {
+	// A bind with a DN and no password is an unauthenticated bind, which
+	// servers may accept without checking anything (RFC 4513 5.1.2).
+	if p.opts.Bind && p.opts.BindDN != "" && p.opts.Password == "" {
+		return nil, errors.New("ldap: a bind DN without a password is an unauthenticated bind")
+	}
+	r := &LDAPResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "389"
+		if p.opts.TLS == LDAPS {
+			port = "636"
+		}
+		address = net.JoinHostPort(address, port)
+	}
+	host, _, _ := net.SplitHostPort(address)
+
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	r.ConnectTime = time.Since(startAt)
+	if target.Timeout > 0 {
+		if err := conn.SetDeadline(startAt.Add(target.Timeout)); err != nil {
+			return nil, err
+		}
+	}
+	c := newLDAPConn(conn)
+
+	if p.opts.TLS != LDAPPlain {
+		tlsStartAt := time.Now()
+		if p.opts.TLS == LDAPStartTLS {
+			if err := c.startTLS(); err != nil {
+				r.Error = err
+				return r, nil
+			}
+		}
+		config := unverifiedTLSConfig(p.opts.TLSConfig, host)
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.TLSHandshakeTime = time.Since(tlsStartAt)
+		state := tlsConn.ConnectionState()
+		r.TLSVersion = tlsVersionName(state.Version)
+		if len(state.PeerCertificates) > 0 {
+			r.Certificate = newCertificateInfo(state.PeerCertificates[0])
+		}
+		if p.opts.TLSConfig == nil || !p.opts.TLSConfig.InsecureSkipVerify {
+			names := p.opts.ExpectedNames
+			if len(names) == 0 {
+				names = []string{config.ServerName}
+			}
+			var roots *x509.CertPool
+			if p.opts.TLSConfig != nil {
+				roots = p.opts.TLSConfig.RootCAs
+			}
+			if err := verifyCertificate(state, roots, names); err != nil {
+				r.Error = err
+				return r, nil
+			}
+		}
+		c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	if p.opts.Bind {
+		bindStartAt := time.Now()
+		r.BindResultCode, err = c.bind(p.opts.BindDN, p.opts.Password)
+		r.BindTime = time.Since(bindStartAt)
+		if err != nil {
+			r.Error = err
+			return r, nil
+		}
+	}
+
+	searchStartAt := time.Now()
+	if r.RootDSE, err = c.searchRootDSE(); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.SearchTime = time.Since(searchStartAt)
+	r.TotalTime = time.Since(startAt)
+	_ = c.unbind()
+	return r, nil
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
@@ -0,0 +1,195 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func tlv(tag byte, contents ...[]byte) []byte {
+	var content []byte
+	for _, c := range contents {
+		content = append(content, c...)
+	}
+	// Contents stay below 64KiB in tests.
+	if len(content) < 0x80 {
+		return append([]byte{tag, byte(len(content))}, content...)
+	}
+	return append([]byte{tag, 0x82, byte(len(content) >> 8), byte(len(content))}, content...)
+}
+
+// readTLV reads an element with a short or two-byte long form length.
+func readTLV(r *bufio.Reader) (byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, nil, err
+	}
+	n := int(head[1])
+	if n&0x80 != 0 {
+		l := make([]byte, n&0x7f)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return 0, nil, err
+		}
+		n = 0
+		for _, c := range l {
+			n = n<<8 | int(c)
+		}
+	}
+	content := make([]byte, n)
+	_, err := io.ReadFull(r, content)
+	return head[0], content, err
+}
+
+// serveLDAP runs a directory server answering StartTLS, binds, anonymous or
+// of cn=admin with the password "secret", and RootDSE searches, with
+// implicit TLS when ldaps is set.
+func serveLDAP(t *testing.T, config *tls.Config, ldaps bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	if ldaps {
+		ln = tls.NewListener(ln, config)
+	}
+	result := func(tag, code byte, msg string) []byte {
+		return tlv(tag, tlv(0x0a, []byte{code}), tlv(0x04), tlv(0x04, []byte(msg)))
+	}
+	success := func(tag byte) []byte {
+		return result(tag, 0, "")
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer func() { conn.Close() }()
+				r := bufio.NewReader(conn)
+				for {
+					_, msg, err := readTLV(r)
+					if err != nil {
+						return
+					}
+					id := msg[:3] // a one-byte INTEGER
+					op := msg[3]
+					reply := func(ops ...[]byte) {
+						for _, op := range ops {
+							conn.Write(tlv(0x30, id, op))
+						}
+					}
+					switch op {
+					case 0x77: // StartTLS
+						reply(success(0x78))
+						tlsConn := tls.Server(conn, config)
+						conn, r = tlsConn, bufio.NewReader(tlsConn)
+					case 0x60: // bind
+						switch string(msg[5:]) { // short form lengths
+						case string(tlv(0x02, []byte{3})) + string(tlv(0x04)) + string(tlv(0x80)),
+							string(tlv(0x02, []byte{3})) + string(tlv(0x04, []byte("cn=admin"))) + string(tlv(0x80, []byte("secret"))):
+							reply(success(0x61))
+						default:
+							reply(result(0x61, 49, "80090308: LdapErr: DSID-0C090447"))
+						}
+					case 0x63: // search
+						attr := func(name string, vals ...string) []byte {
+							var set [][]byte
+							for _, v := range vals {
+								set = append(set, tlv(0x04, []byte(v)))
+							}
+							return tlv(0x30, tlv(0x04, []byte(name)), tlv(0x31, set...))
+						}
+						reply(tlv(0x64, tlv(0x04), tlv(0x30,
+							attr("namingContexts", "DC=corp,DC=example", "CN=Configuration,DC=corp,DC=example"),
+							attr("supportedControl", "1.2.840.113556.1.4.319"),
+							attr("supportedLDAPVersion", "3", "2"),
+							attr("dnsHostName", "dc1.corp.example"),
+						)), success(0x65))
+					default:
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestLDAPProber(t *testing.T) {
+	// The test server's certificate is valid for example.com and 127.0.0.1.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	for _, mode := range []libprobe.LDAPTLSMode{libprobe.LDAPPlain, libprobe.LDAPStartTLS, libprobe.LDAPS} {
+		address := serveLDAP(t, srv.TLS, mode == libprobe.LDAPS)
+		prober := libprobe.NewLDAPProber(libprobe.LDAPProberOptions{
+			TLS:           mode,
+			TLSConfig:     &tls.Config{RootCAs: roots},
+			ExpectedNames: []string{"example.com", "127.0.0.1"},
+		})
+		r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		res := r.(*libprobe.LDAPResult)
+		require.NoError(t, res.Error)
+		require.Equal(t, []string{"DC=corp,DC=example", "CN=Configuration,DC=corp,DC=example"}, res.RootDSE.NamingContexts)
+		require.Equal(t, []string{"1.2.840.113556.1.4.319"}, res.RootDSE.SupportedControls)
+		require.Equal(t, "dc1.corp.example", res.RootDSE.DNSHostName)
+		if mode == libprobe.LDAPPlain {
+			require.Nil(t, res.Certificate)
+			continue
+		}
+		require.NotZero(t, res.TLSHandshakeTime)
+		require.Contains(t, res.Certificate.DNSNames, "example.com")
+	}
+
+	// The certificate isn't valid for the domain controller's name.
+	prober := libprobe.NewLDAPProber(libprobe.LDAPProberOptions{
+		TLS:           libprobe.LDAPStartTLS,
+		TLSConfig:     &tls.Config{RootCAs: roots},
+		ExpectedNames: []string{"dc1.corp.example"},
+	})
+	r, err := prober.Probe(libprobe.Target{Address: serveLDAP(t, srv.TLS, false), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.LDAPResult)
+	require.Error(t, res.Error)
+	require.NotNil(t, res.Certificate)
+}
+
+func TestLDAPProberBind(t *testing.T) {
+	address := serveLDAP(t, nil, false)
+	for _, tt := range []struct {
+		dn, password string
+		code         int64
+	}{
+		{"", "", 0},
+		{"cn=admin", "secret", 0},
+		{"cn=admin", "wrong", 49},
+	} {
+		prober := libprobe.NewLDAPProber(libprobe.LDAPProberOptions{Bind: true, BindDN: tt.dn, Password: tt.password})
+		r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		res := r.(*libprobe.LDAPResult)
+		require.Equal(t, tt.code, res.BindResultCode)
+		require.Positive(t, res.BindTime)
+		if tt.code != 0 {
+			require.EqualError(t, res.Error, "ldap: invalidCredentials: 80090308: LdapErr: DSID-0C090447")
+			require.Nil(t, res.RootDSE)
+			continue
+		}
+		require.NoError(t, res.Error)
+		require.Equal(t, "dc1.corp.example", res.RootDSE.DNSHostName)
+	}
+
+	// An unauthenticated bind is refused.
+	_, err := libprobe.NewLDAPProber(libprobe.LDAPProberOptions{Bind: true, BindDN: "cn=admin"}).Probe(libprobe.Target{Address: address})
+	require.Error(t, err)
+}
@@ -0,0 +1,232 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MailboxOptions locates a mailbox read over IMAP or POP3.
+type MailboxOptions struct {
+	// Protocol is "imap" or "pop3".
+	Protocol string
+	// Address is the server as host:port.
+	Address string
+	// TLS connects with implicit TLS, as on ports 993 and 995.
+	TLS      bool
+	Username string
+	Password string
+	// Mailbox is the IMAP folder to search. Default: "INBOX".
+	Mailbox string
+}
+
+// dialMail connects to a mail server, with implicit TLS when useTLS is set.
+// The connection's deadline is set to deadline.
+func dialMail(meter *trafficMeter, address string, useTLS bool, config *tls.Config, deadline time.Time) (net.Conn, error) {
+	conn, err := dialTimeout(meter, "tcp", address, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !useTLS {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, mailTLSConfig(config, address))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// mailTLSConfig returns config, or an empty one, with ServerName defaulting
+// to the host of address.
+func mailTLSConfig(config *tls.Config, address string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config.ServerName = host
+	}
+	return config
+}
+
+// findMail reports whether the mailbox holds a message whose header name
+// has the given value, deleting it when remove is set.
+func findMail(meter *trafficMeter, opts MailboxOptions, config *tls.Config, name, value string, remove bool, deadline time.Time) (bool, error) {
+	conn, err := dialMail(meter, opts.Address, opts.TLS, config, deadline)
+	if err != nil {
+		return false, err
+	}
+	c := textproto.NewConn(conn)
+	defer c.Close()
+	switch strings.ToLower(opts.Protocol) {
+	case "imap":
+		return imapFind(c, opts, name, value, remove)
+	case "pop3":
+		return pop3Find(c, opts, name, value, remove)
+	}
+	return false, fmt.Errorf("mail: unknown mailbox protocol %q", opts.Protocol)
+}
+
+// pop3Cmd sends a POP3 command, if any, and reads its status line.
+func pop3Cmd(c *textproto.Conn, format string, args ...interface{}) (string, error) {
+	if format != "" {
+		if err := c.PrintfLine(format, args...); err != nil {
+			return "", err
+		}
+	}
+	line, err := c.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return "", fmt.Errorf("pop3: %s", line)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+}
+
+func pop3Find(c *textproto.Conn, opts MailboxOptions, name, value string, remove bool) (bool, error) {
+	if _, err := pop3Cmd(c, ""); err != nil {
+		return false, err
+	}
+	if _, err := pop3Cmd(c, "USER %s", opts.Username); err != nil {
+		return false, err
+	}
+	if _, err := pop3Cmd(c, "PASS %s", opts.Password); err != nil {
+		return false, err
+	}
+	stat, err := pop3Cmd(c, "STAT")
+	if err != nil {
+		return false, err
+	}
+	count, err := strconv.Atoi(strings.Fields(stat + " 0")[0])
+	if err != nil {
+		return false, fmt.Errorf("pop3: bad STAT response %q", stat)
+	}
+	found := false
+	// The probe message is most likely among the newest ones.
+	for n := count; n >= 1 && !found; n-- {
+		if _, err := pop3Cmd(c, "TOP %d 0", n); err != nil {
+			return false, err
+		}
+		lines, err := c.ReadDotLines()
+		if err != nil {
+			return false, err
+		}
+		if !mailHeaderHas(lines, name, value) {
+			continue
+		}
+		found = true
+		if remove {
+			if _, err := pop3Cmd(c, "DELE %d", n); err != nil {
+				return false, err
+			}
+		}
+	}
+	// Deletions are only applied by QUIT.
+	_, err = pop3Cmd(c, "QUIT")
+	return found, err
+}
+
+// mailHeaderHas reports whether the header lines of a message hold the
+// header name with the given value.
+func mailHeaderHas(lines []string, name, value string) bool {
+	for _, line := range lines {
+		if line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i > 0 && strings.EqualFold(line[:i], name) && strings.TrimSpace(line[i+1:]) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// imapQuote returns s as an IMAP quoted string.
+func imapQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// imapCmd sends a tagged IMAP command and returns the untagged responses
+// read before its completion.
+func imapCmd(c *textproto.Conn, tag, format string, args ...interface{}) ([]string, error) {
+	if err := c.PrintfLine(tag+" "+format, args...); err != nil {
+		return nil, err
+	}
+	var untagged []string
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "* ") {
+			untagged = append(untagged, line[2:])
+			continue
+		}
+		if !strings.HasPrefix(line, tag+" ") {
+			continue
+		}
+		if status := line[len(tag)+1:]; !strings.HasPrefix(status, "OK") {
+			return nil, fmt.Errorf("imap: %s", status)
+		}
+		return untagged, nil
+	}
+}
+
+func imapFind(c *textproto.Conn, opts MailboxOptions, name, value string, remove bool) (bool, error) {
+	greeting, err := c.ReadLine()
+	if err != nil {
+		return false, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		return false, fmt.Errorf("imap: %s", greeting)
+	}
+	if _, err := imapCmd(c, "a1", "LOGIN %s %s", imapQuote(opts.Username), imapQuote(opts.Password)); err != nil {
+		return false, err
+	}
+	mailbox := opts.Mailbox
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	if _, err := imapCmd(c, "a2", "SELECT %s", imapQuote(mailbox)); err != nil {
+		return false, err
+	}
+	untagged, err := imapCmd(c, "a3", "UID SEARCH HEADER %s %s", imapQuote(name), imapQuote(value))
+	if err != nil {
+		return false, err
+	}
+	var uids []string
+	for _, line := range untagged {
+		if strings.HasPrefix(line, "SEARCH") {
+			uids = append(uids, strings.Fields(line)[1:]...)
+		}
+	}
+	if len(uids) > 0 && remove {
+		if _, err := imapCmd(c, "a4", `UID STORE %s +FLAGS.SILENT (\Deleted)`, strings.Join(uids, ",")); err != nil {
+			return false, err
+		}
+		if _, err := imapCmd(c, "a5", "EXPUNGE"); err != nil {
+			return false, err
+		}
+	}
+	if _, err := imapCmd(c, "a6", "LOGOUT"); err != nil {
+		return false, err
+	}
+	return len(uids) > 0, nil
+}
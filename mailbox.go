@@ -0,0 +1,284 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	KindIMAP = "IMAP"
+	KindPOP3 = "POP3"
+)
+
+// MailTLSMode selects how a MailboxProber secures its connection.
+type MailTLSMode int
+
+const (
+	// MailPlain doesn't use TLS.
+	MailPlain MailTLSMode = iota
+	// MailStartTLS upgrades a plain connection with STARTTLS (STLS for
+	// POP3).
+	MailStartTLS
+	// MailImplicitTLS connects with implicit TLS, as on ports 993 and 995.
+	MailImplicitTLS
+)
+
+// MailboxProberOptions configures a MailboxProber.
+type MailboxProberOptions struct {
+	TLS MailTLSMode
+	// TLSConfig configures TLS; its ServerName defaults to the host dialed.
+	TLSConfig *tls.Config
+	// Username and Password, when set, log in after the greeting, with
+	// LOGIN for IMAP and USER and PASS for POP3.
+	Username string
+	Password string
+}
+
+// MailboxResult describes a session with an IMAP or POP3 server, step by
+// step.
+type MailboxResult struct {
+	Target
+	Error error
+
+	ConnectTime time.Duration
+	// GreetingTime is the time from connecting, or from the implicit TLS
+	// handshake, to the server's greeting.
+	GreetingTime time.Duration
+	// StartTLSTime is the time of the STARTTLS command, TLSHandshakeTime
+	// that of the handshake following it or of the implicit one.
+	StartTLSTime     time.Duration
+	TLSHandshakeTime time.Duration
+	AuthTime         time.Duration
+	TotalTime        time.Duration
+	Greeting         string
+	// Capabilities are those announced by the server, after the TLS
+	// upgrade with MailStartTLS.
+	Capabilities []string
+	TLSVersion   string
+	Certificate  *CertificateInfo
+}
+
+func (r MailboxResult) RTT() time.Duration {
+	return r.TotalTime
+}
+
+func (r MailboxResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	return fmt.Sprintf("-> %s %q Connect: %s, Greeting: %s, STARTTLS: %s, TLS Handshake: %s, Auth: %s. Total: %s",
+		r.Target.Address, r.Greeting, r.ConnectTime, r.GreetingTime, r.StartTLSTime, r.TLSHandshakeTime, r.AuthTime, r.TotalTime)
+}
+
+// MailboxProber checks the IMAP or POP3 server in Target.Address: it reads
+// the greeting and the capabilities, optionally secures the connection and
+// logs in, then ends the session.
+type MailboxProber struct {
+	kind string
+	opts MailboxProberOptions
+}
+
+func NewIMAPProber(opts MailboxProberOptions) *MailboxProber {
+	return &MailboxProber{kind: KindIMAP, opts: opts}
+}
+
+func NewPOP3Prober(opts MailboxProberOptions) *MailboxProber {
+	return &MailboxProber{kind: KindPOP3, opts: opts}
+}
+
+func (p *MailboxProber) Kind() string {
+	return p.kind
+}
+
+// mailboxSession is a session of a MailboxProber.
+type mailboxSession struct {
+	conn net.Conn
+	c    *textproto.Conn
+	tag  int
+}
+
+// imapCmd sends an IMAP command with the next tag.
+func (s *mailboxSession) imapCmd(format string, args ...interface{}) ([]string, error) {
+	s.tag++
+	return imapCmd(s.c, fmt.Sprintf("a%d", s.tag), format, args...)
+}
+
+func (p *MailboxProber) Probe(target Target) (Result, error) {
+	r := &MailboxResult{Target: target}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", target.Address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+	s := &mailboxSession{conn: conn}
+	if p.opts.TLS == MailImplicitTLS {
+		if r.Error = p.handshake(r, s, target.Address); r.Error != nil {
+			return r, nil
+		}
+	}
+	s.c = textproto.NewConn(s.conn)
+	if p.kind == KindIMAP {
+		r.Error = p.imap(r, s, target.Address)
+	} else {
+		r.Error = p.pop3(r, s, target.Address)
+	}
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+// handshake secures the session with TLS.
+func (p *MailboxProber) handshake(r *MailboxResult, s *mailboxSession, address string) error {
+	handshakeAt := time.Now()
+	tlsConn := tls.Client(s.conn, mailTLSConfig(p.opts.TLSConfig, address))
+	err := tlsConn.Handshake()
+	r.TLSHandshakeTime = time.Since(handshakeAt)
+	if err != nil {
+		return err
+	}
+	state := tlsConn.ConnectionState()
+	r.TLSVersion = tlsVersionName(state.Version)
+	r.Certificate = newCertificateInfo(state.PeerCertificates[0])
+	s.conn = tlsConn
+	return nil
+}
+
+func (p *MailboxProber) imap(r *MailboxResult, s *mailboxSession, address string) error {
+	greetingAt := time.Now()
+	greeting, err := s.c.ReadLine()
+	if err != nil {
+		return err
+	}
+	r.GreetingTime = time.Since(greetingAt)
+	r.Greeting = greeting
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		return fmt.Errorf("imap: %s", greeting)
+	}
+	capabilities := func() error {
+		untagged, err := s.imapCmd("CAPABILITY")
+		if err != nil {
+			return err
+		}
+		r.Capabilities = nil
+		for _, line := range untagged {
+			if fields := strings.Fields(line); len(fields) > 0 && strings.EqualFold(fields[0], "CAPABILITY") {
+				r.Capabilities = append(r.Capabilities, fields[1:]...)
+			}
+		}
+		return nil
+	}
+	if err := capabilities(); err != nil {
+		return err
+	}
+	if p.opts.TLS == MailStartTLS {
+		if !mailHasCapability(r.Capabilities, "STARTTLS") {
+			return errors.New("imap: the server doesn't offer STARTTLS")
+		}
+		startTLSAt := time.Now()
+		if _, err := s.imapCmd("STARTTLS"); err != nil {
+			return err
+		}
+		r.StartTLSTime = time.Since(startTLSAt)
+		if err := p.handshake(r, s, address); err != nil {
+			return err
+		}
+		s.c = textproto.NewConn(s.conn)
+		if err := capabilities(); err != nil {
+			return err
+		}
+	}
+	if p.opts.Username != "" {
+		if mailHasCapability(r.Capabilities, "LOGINDISABLED") {
+			return errors.New("imap: the server disabled LOGIN")
+		}
+		authAt := time.Now()
+		if _, err := s.imapCmd("LOGIN %s %s", imapQuote(p.opts.Username), imapQuote(p.opts.Password)); err != nil {
+			return err
+		}
+		r.AuthTime = time.Since(authAt)
+	}
+	_, err = s.imapCmd("LOGOUT")
+	return err
+}
+
+func (p *MailboxProber) pop3(r *MailboxResult, s *mailboxSession, address string) error {
+	greetingAt := time.Now()
+	greeting, err := s.c.ReadLine()
+	if err != nil {
+		return err
+	}
+	r.GreetingTime = time.Since(greetingAt)
+	r.Greeting = greeting
+	if !strings.HasPrefix(greeting, "+OK") {
+		return fmt.Errorf("pop3: %s", greeting)
+	}
+	// CAPA is optional: servers without it answer -ERR.
+	capabilities := func() error {
+		r.Capabilities = nil
+		if _, err := pop3Cmd(s.c, "CAPA"); err != nil {
+			return nil
+		}
+		lines, err := s.c.ReadDotLines()
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if fields := strings.Fields(line); len(fields) > 0 {
+				r.Capabilities = append(r.Capabilities, fields[0])
+			}
+		}
+		return nil
+	}
+	if err := capabilities(); err != nil {
+		return err
+	}
+	if p.opts.TLS == MailStartTLS {
+		if r.Capabilities != nil && !mailHasCapability(r.Capabilities, "STLS") {
+			return errors.New("pop3: the server doesn't offer STLS")
+		}
+		startTLSAt := time.Now()
+		if _, err := pop3Cmd(s.c, "STLS"); err != nil {
+			return err
+		}
+		r.StartTLSTime = time.Since(startTLSAt)
+		if err := p.handshake(r, s, address); err != nil {
+			return err
+		}
+		s.c = textproto.NewConn(s.conn)
+		if err := capabilities(); err != nil {
+			return err
+		}
+	}
+	if p.opts.Username != "" {
+		authAt := time.Now()
+		if _, err := pop3Cmd(s.c, "USER %s", p.opts.Username); err != nil {
+			return err
+		}
+		if _, err := pop3Cmd(s.c, "PASS %s", p.opts.Password); err != nil {
+			return err
+		}
+		r.AuthTime = time.Since(authAt)
+	}
+	_, err = pop3Cmd(s.c, "QUIT")
+	return err
+}
+
+// mailHasCapability reports whether capabilities hold name.
+func mailHasCapability(capabilities []string, name string) bool {
+	for _, c := range capabilities {
+		if strings.EqualFold(c, name) {
+			return true
+		}
+	}
+	return false
+}
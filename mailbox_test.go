@@ -0,0 +1,160 @@
+package libprobe_test
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveMailbox serves a minimal IMAP or POP3 server offering STARTTLS and
+// accepting the credentials user and secret.
+func serveMailbox(t *testing.T, protocol string, config *tls.Config) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if protocol == "imap" {
+					fakeIMAP(conn, config)
+				} else {
+					fakePOP3(conn, config)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func fakeIMAP(conn net.Conn, config *tls.Config) {
+	c := textproto.NewConn(conn)
+	c.PrintfLine("* OK IMAP ready")
+	secure := false
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		tag, cmd := fields[0], fields[1]
+		switch cmd {
+		case "CAPABILITY":
+			if secure {
+				c.PrintfLine("* CAPABILITY IMAP4rev1 AUTH=PLAIN")
+			} else {
+				c.PrintfLine("* CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED")
+			}
+		case "STARTTLS":
+			c.PrintfLine("%s OK begin TLS", tag)
+			tlsConn := tls.Server(conn, config)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			c, secure = textproto.NewConn(tlsConn), true
+			continue
+		case "LOGIN":
+			if fields[2] != `"user"` || fields[3] != `"secret"` {
+				c.PrintfLine("%s NO invalid credentials", tag)
+				continue
+			}
+		case "LOGOUT":
+			c.PrintfLine("* BYE")
+		}
+		c.PrintfLine("%s OK done", tag)
+	}
+}
+
+func fakePOP3(conn net.Conn, config *tls.Config) {
+	c := textproto.NewConn(conn)
+	c.PrintfLine("+OK POP3 ready")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		switch fields := strings.Fields(line); fields[0] {
+		case "CAPA":
+			c.PrintfLine("+OK")
+			c.PrintfLine("USER")
+			c.PrintfLine("STLS")
+			c.PrintfLine(".")
+		case "STLS":
+			c.PrintfLine("+OK begin TLS")
+			tlsConn := tls.Server(conn, config)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			c = textproto.NewConn(tlsConn)
+		case "PASS":
+			if fields[1] != "secret" {
+				c.PrintfLine("-ERR invalid credentials")
+				continue
+			}
+			c.PrintfLine("+OK")
+		case "QUIT":
+			c.PrintfLine("+OK bye")
+			return
+		default:
+			c.PrintfLine("+OK")
+		}
+	}
+}
+
+func TestMailboxProber(t *testing.T) {
+	// The test server's certificate is valid for 127.0.0.1.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	clientConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	for _, protocol := range []string{"imap", "pop3"} {
+		address := serveMailbox(t, protocol, srv.TLS)
+		newProber := libprobe.NewIMAPProber
+		if protocol == "pop3" {
+			newProber = libprobe.NewPOP3Prober
+		}
+		target := libprobe.Target{Address: address, Timeout: 5 * time.Second}
+
+		r, err := newProber(libprobe.MailboxProberOptions{
+			TLS:       libprobe.MailStartTLS,
+			TLSConfig: clientConfig,
+			Username:  "user",
+			Password:  "secret",
+		}).Probe(target)
+		require.NoError(t, err)
+		res := r.(*libprobe.MailboxResult)
+		require.NoError(t, res.Error, protocol)
+		require.Contains(t, res.Greeting, "ready")
+		require.Equal(t, "TLS 1.3", res.TLSVersion)
+		require.NotNil(t, res.Certificate)
+		require.Positive(t, res.StartTLSTime)
+		require.Positive(t, res.AuthTime)
+		require.GreaterOrEqual(t, res.TotalTime, res.ConnectTime+res.StartTLSTime+res.TLSHandshakeTime+res.AuthTime)
+
+		r, err = newProber(libprobe.MailboxProberOptions{Username: "user", Password: "wrong"}).Probe(target)
+		require.NoError(t, err)
+		res = r.(*libprobe.MailboxResult)
+		require.Error(t, res.Error, protocol)
+		require.Empty(t, res.TLSVersion)
+	}
+
+	// Capabilities are those announced after the upgrade.
+	r, err := libprobe.NewIMAPProber(libprobe.MailboxProberOptions{TLS: libprobe.MailStartTLS, TLSConfig: clientConfig}).Probe(libprobe.Target{Address: serveMailbox(t, "imap", srv.TLS), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.MailboxResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, []string{"IMAP4rev1", "AUTH=PLAIN"}, res.Capabilities)
+}
@@ -0,0 +1,259 @@
+package libprobe
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target.Metadata keys set on the targets of mesh jobs.
+const (
+	MetadataMeshFrom = "mesh_from"
+	MetadataMeshTo   = "mesh_to"
+)
+
+// MeshAgent is an agent taking part in a mesh.
+type MeshAgent struct {
+	Name string
+	// Address is probed by the other agents, such as the address of the
+	// agent's Reflector.
+	Address string
+}
+
+// MeshOptions configures a Mesh.
+type MeshOptions struct {
+	Agents []MeshAgent
+	// Prober probes the other agents. Default: a ReflectorProber.
+	Prober Prober
+	// Target is the template of the probed targets; Address is set to the
+	// address of the probed agent.
+	Target Target
+	// Interval between probes of a pair of agents. Default: 1m.
+	Interval time.Duration
+}
+
+// MeshCell aggregates the probes from one agent to another.
+type MeshCell struct {
+	From string
+	To   string
+	// Probes and Failures count the results recorded.
+	Probes   int
+	Failures int
+	// Loss is the average packet loss in percent. Probers without packet
+	// statistics count failed probes as 100% loss.
+	Loss float64
+	// ForwardLoss and ReverseLoss are the average losses towards To and
+	// back, measured by ReflectorProber.
+	ForwardLoss float64
+	ReverseLoss float64
+	// RTT is the average RTT of the successful probes, LastRTT that of the
+	// latest one.
+	RTT     time.Duration
+	LastRTT time.Duration
+	LastAt  time.Time
+
+	succeeded  int
+	reflected  int
+	totalRTT   time.Duration
+	totalLoss  float64
+	forwardSum float64
+	reverseSum float64
+}
+
+// MeshMatrix is a snapshot of a mesh: Cells[i][j] aggregates the probes from
+// Agents[i] to Agents[j], and is nil when none were recorded.
+type MeshMatrix struct {
+	Agents []string
+	Cells  [][]*MeshCell
+}
+
+// String renders the matrix as a table of average RTTs and losses, with a
+// row per probing agent.
+func (m MeshMatrix) String() string {
+	var b strings.Builder
+	width := 8
+	for _, name := range m.Agents {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	fmt.Fprintf(&b, "%-*s", width+1, "from\\to")
+	for _, name := range m.Agents {
+		fmt.Fprintf(&b, " %*s", 2*width, name)
+	}
+	b.WriteByte('\n')
+	for i, from := range m.Agents {
+		fmt.Fprintf(&b, "%-*s", width+1, from)
+		for _, cell := range m.Cells[i] {
+			s := "-"
+			if cell != nil {
+				s = fmt.Sprintf("%v/%.1f%%", cell.RTT.Round(time.Microsecond), cell.Loss)
+			}
+			fmt.Fprintf(&b, " %*s", 2*width, s)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Mesh coordinates a full mesh of measurements between N agents: every
+// agent probes the N-1 others, with start times staggered evenly over the
+// interval so agents don't probe the same peer at once. Each agent runs the
+// jobs returned by Jobs on its engine and ships its results back to the
+// coordinator, which records them to aggregate the N×N matrix. Mesh is a
+// Sink, so the results of a single-process mesh can be written to it
+// directly.
+type Mesh struct {
+	opts  MeshOptions
+	index map[string]int
+
+	mu    sync.Mutex
+	cells map[[2]int]*MeshCell
+}
+
+func NewMesh(opts MeshOptions) (*Mesh, error) {
+	if opts.Prober == nil {
+		opts.Prober = NewReflectorProber(ReflectorProberOptions{})
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	m := &Mesh{opts: opts, index: make(map[string]int), cells: make(map[[2]int]*MeshCell)}
+	for i, agent := range opts.Agents {
+		if agent.Name == "" {
+			return nil, errors.New("mesh: agent without name")
+		}
+		if _, ok := m.index[agent.Name]; ok {
+			return nil, fmt.Errorf("mesh: duplicate agent %s", agent.Name)
+		}
+		m.index[agent.Name] = i
+	}
+	return m, nil
+}
+
+// Jobs returns the jobs the named agent runs to probe the other agents.
+func (m *Mesh) Jobs(agent string) ([]Job, error) {
+	i, ok := m.index[agent]
+	if !ok {
+		return nil, fmt.Errorf("mesh: unknown agent %s", agent)
+	}
+	n := len(m.opts.Agents)
+	var jobs []Job
+	for j, peer := range m.opts.Agents {
+		if j == i {
+			continue
+		}
+		target := m.opts.Target
+		target.Address = peer.Address
+		target.Metadata = make(map[string]string, len(m.opts.Target.Metadata)+2)
+		for k, v := range m.opts.Target.Metadata {
+			target.Metadata[k] = v
+		}
+		target.Metadata[MetadataMeshFrom] = agent
+		target.Metadata[MetadataMeshTo] = peer.Name
+		// Pairs are numbered row by row, skipping the diagonal.
+		slot := i*(n-1) + len(jobs)
+		jobs = append(jobs, Job{
+			ID:       "mesh/" + agent + "/" + peer.Name,
+			Prober:   m.opts.Prober,
+			Target:   target,
+			Interval: m.opts.Interval,
+			Offset:   m.opts.Interval * time.Duration(slot) / time.Duration(n*(n-1)),
+		})
+	}
+	return jobs, nil
+}
+
+func (m *Mesh) Write(r Result) error {
+	return m.Record(time.Now(), r)
+}
+
+func (m *Mesh) Close() error {
+	return nil
+}
+
+// Record aggregates the result of a mesh job observed at a given time.
+func (m *Mesh) Record(at time.Time, r Result) error {
+	row := Flatten(r)[0]
+	from, _ := row["metadata_"+MetadataMeshFrom].(string)
+	to, _ := row["metadata_"+MetadataMeshTo].(string)
+	i, ok := m.index[from]
+	j, ok2 := m.index[to]
+	if !ok || !ok2 {
+		return fmt.Errorf("mesh: result from %q to %q isn't part of the mesh", from, to)
+	}
+	ok = resultOK(r)
+	loss := 100.0
+	if ok {
+		loss = 0
+	}
+	inner := r
+	for w, isWrapper := inner.(ResultWrapper); isWrapper; w, isWrapper = inner.(ResultWrapper) {
+		inner = w.Unwrap()
+	}
+	reflected, _ := inner.(*ReflectorResult)
+	switch v := inner.(type) {
+	case *ICMPResult:
+		if v.Stats != nil {
+			loss = v.Stats.PacketLoss
+		}
+	case *ReflectorResult:
+		if v.PacketsSent > 0 {
+			loss = float64(v.PacketsSent-v.PacketsRecv) / float64(v.PacketsSent) * 100
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cell, exists := m.cells[[2]int{i, j}]
+	if !exists {
+		cell = &MeshCell{From: from, To: to}
+		m.cells[[2]int{i, j}] = cell
+	}
+	cell.Probes++
+	cell.LastAt = at
+	cell.totalLoss += loss
+	cell.Loss = cell.totalLoss / float64(cell.Probes)
+	if reflected != nil && reflected.PacketsSent > 0 {
+		cell.reflected++
+		cell.forwardSum += reflected.ForwardLoss
+		cell.reverseSum += reflected.ReverseLoss
+		cell.ForwardLoss = cell.forwardSum / float64(cell.reflected)
+		cell.ReverseLoss = cell.reverseSum / float64(cell.reflected)
+	}
+	if !ok {
+		cell.Failures++
+		return nil
+	}
+	cell.succeeded++
+	cell.LastRTT = r.RTT()
+	cell.totalRTT += cell.LastRTT
+	cell.RTT = cell.totalRTT / time.Duration(cell.succeeded)
+	return nil
+}
+
+// Matrix returns a snapshot of the aggregated measurements.
+func (m *Mesh) Matrix() MeshMatrix {
+	n := len(m.opts.Agents)
+	matrix := MeshMatrix{Agents: make([]string, n), Cells: make([][]*MeshCell, n)}
+	for i, agent := range m.opts.Agents {
+		matrix.Agents[i] = agent.Name
+		matrix.Cells[i] = make([]*MeshCell, n)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for pair, cell := range m.cells {
+		c := *cell
+		matrix.Cells[pair[0]][pair[1]] = &c
+	}
+	return matrix
+}
+
+// Reset discards the aggregated measurements, starting a new period.
+func (m *Mesh) Reset() {
+	m.mu.Lock()
+	m.cells = make(map[[2]int]*MeshCell)
+	m.mu.Unlock()
+}
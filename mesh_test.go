@@ -0,0 +1,72 @@
+package libprobe_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMesh(t *testing.T) {
+	var agents []libprobe.MeshAgent
+	for _, name := range []string{"a", "b", "c"} {
+		reflector, err := libprobe.ListenReflector(libprobe.ReflectorOptions{Address: "127.0.0.1:0"})
+		require.NoError(t, err)
+		defer reflector.Close()
+		agents = append(agents, libprobe.MeshAgent{Name: name, Address: reflector.Addr().String()})
+	}
+	mesh, err := libprobe.NewMesh(libprobe.MeshOptions{
+		Agents:   agents,
+		Target:   libprobe.Target{Count: 2, Interval: time.Millisecond, Timeout: time.Second, Metadata: map[string]string{"env": "test"}},
+		Interval: 60 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{mesh}})
+	for i, agent := range agents {
+		jobs, err := mesh.Jobs(agent.Name)
+		require.NoError(t, err)
+		require.Len(t, jobs, 2)
+		for k, job := range jobs {
+			require.Equal(t, time.Duration(i*2+k)*10*time.Millisecond, job.Offset)
+			require.Equal(t, agent.Name, job.Target.Metadata[libprobe.MetadataMeshFrom])
+			require.Equal(t, "test", job.Target.Metadata["env"])
+			require.NoError(t, engine.Add(job))
+		}
+	}
+	jobs, err := mesh.Jobs("b")
+	require.NoError(t, err)
+	require.Equal(t, "mesh/b/c", jobs[1].ID)
+	_, err = mesh.Jobs("d")
+	require.Error(t, err)
+
+	engine.Start()
+	defer engine.Stop()
+	require.Eventually(t, func() bool {
+		m := mesh.Matrix()
+		for i := range m.Agents {
+			for j, cell := range m.Cells[i] {
+				if (i == j) != (cell == nil) || (cell != nil && cell.Probes < 2) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	m := mesh.Matrix()
+	cell := m.Cells[0][2]
+	require.Equal(t, "a", cell.From)
+	require.Equal(t, "c", cell.To)
+	require.Zero(t, cell.Failures)
+	require.Zero(t, cell.Loss)
+	require.True(t, cell.RTT > 0)
+	require.True(t, strings.HasPrefix(m.String(), "from\\to"))
+
+	require.Error(t, mesh.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "x:1"}}))
+	mesh.Reset()
+	require.Nil(t, mesh.Matrix().Cells[0][1])
+}
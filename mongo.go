@@ -0,0 +1,368 @@
+package libprobe
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindMongo = "MONGO"
+
+// mongoOpMsg is the opcode of OP_MSG, supported since MongoDB 3.6.
+const mongoOpMsg = 2013
+
+// mongoMaxMessage bounds the replies read.
+const mongoMaxMessage = 48 << 20
+
+// Roles of a MongoDB server, as reported by MongoResult.Role.
+const (
+	MongoPrimary    = "primary"
+	MongoSecondary  = "secondary"
+	MongoArbiter    = "arbiter"
+	MongoRouter     = "mongos"
+	MongoStandalone = "standalone"
+	// MongoOther is a replica set member neither primary, secondary nor
+	// arbiter, e.g. recovering or starting up.
+	MongoOther = "other"
+)
+
+// MongoProberOptions configures a MongoProber.
+type MongoProberOptions struct {
+	// TLS connects with TLS, configured by TLSConfig, whose ServerName
+	// defaults to the host dialed.
+	TLS       bool
+	TLSConfig *tls.Config
+}
+
+// MongoResult describes the reply of a MongoDB server to the hello command.
+type MongoResult struct {
+	Target
+	Error error
+
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	// HelloTime is the time of the hello command.
+	HelloTime time.Duration
+	TotalTime time.Duration
+	// Role is MongoPrimary, MongoSecondary, MongoArbiter, MongoRouter,
+	// MongoStandalone or MongoOther.
+	Role string
+	// SetName, Primary, Me and Hosts describe the replica set, as seen by
+	// the server.
+	SetName        string
+	Primary        string
+	Me             string
+	Hosts          []string
+	Hidden         bool
+	ReadOnly       bool
+	MinWireVersion int32
+	MaxWireVersion int32
+}
+
+func (r MongoResult) RTT() time.Duration {
+	return r.HelloTime
+}
+
+func (r MongoResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	s := fmt.Sprintf("-> %s %s wire=%d-%d time=%v", r.Target.Address, r.Role, r.MinWireVersion, r.MaxWireVersion, r.HelloTime)
+	if r.SetName != "" {
+		s += fmt.Sprintf(" set=%s primary=%s", r.SetName, r.Primary)
+	}
+	return s
+}
+
+// MongoProber sends the hello command to the MongoDB server in
+// Target.Address, "host" or "host:port" with port 27017 by default, and
+// reports its role in the replica set. Servers older than 4.4.2, which
+// lack hello, are sent isMaster.
+type MongoProber struct {
+	opts MongoProberOptions
+}
+
+func NewMongoProber(opts MongoProberOptions) *MongoProber {
+	return &MongoProber{opts: opts}
+}
+
+func (p *MongoProber) Kind() string {
+	return KindMongo
+}
+
+func (p *MongoProber) Probe(target Target) (Result, error) {
+	r := &MongoResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "27017")
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+	if p.opts.TLS {
+		handshakeAt := time.Now()
+		tlsConn := tls.Client(conn, mailTLSConfig(p.opts.TLSConfig, address))
+		if err := tlsConn.Handshake(); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.TLSHandshakeTime = time.Since(handshakeAt)
+		conn = tlsConn
+	}
+	helloAt := time.Now()
+	reply, err := mongoCommand(conn, "hello")
+	if err == nil && mongoFloat(reply["ok"]) != 1 {
+		// Servers without hello answer CommandNotFound.
+		if code := mongoFloat(reply["code"]); code == 59 {
+			helloAt = time.Now()
+			reply, err = mongoCommand(conn, "isMaster")
+		}
+	}
+	r.HelloTime = time.Since(helloAt)
+	r.TotalTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	if mongoFloat(reply["ok"]) != 1 {
+		msg, _ := reply["errmsg"].(string)
+		r.Error = fmt.Errorf("mongo: %s", msg)
+		return r, nil
+	}
+	r.SetName, _ = reply["setName"].(string)
+	r.Primary, _ = reply["primary"].(string)
+	r.Me, _ = reply["me"].(string)
+	for _, host := range mongoArray(reply["hosts"]) {
+		if s, ok := host.(string); ok {
+			r.Hosts = append(r.Hosts, s)
+		}
+	}
+	r.Hidden, _ = reply["hidden"].(bool)
+	r.ReadOnly, _ = reply["readOnly"].(bool)
+	r.MinWireVersion = int32(mongoFloat(reply["minWireVersion"]))
+	r.MaxWireVersion = int32(mongoFloat(reply["maxWireVersion"]))
+	primary, _ := reply["isWritablePrimary"].(bool)
+	if !primary {
+		primary, _ = reply["ismaster"].(bool)
+	}
+	secondary, _ := reply["secondary"].(bool)
+	arbiter, _ := reply["arbiterOnly"].(bool)
+	msg, _ := reply["msg"].(string)
+	switch {
+	case msg == "isdbgrid":
+		r.Role = MongoRouter
+	case r.SetName == "" && primary:
+		r.Role = MongoStandalone
+	case primary:
+		r.Role = MongoPrimary
+	case secondary:
+		r.Role = MongoSecondary
+	case arbiter:
+		r.Role = MongoArbiter
+	default:
+		r.Role = MongoOther
+	}
+	return r, nil
+}
+
+// mongoCommand runs command against the admin database with OP_MSG and
+// returns the reply document.
+func mongoCommand(conn net.Conn, command string) (map[string]interface{}, error) {
+	body := bsonDocument(
+		bsonInt32(command, 1),
+		bsonString("$db", "admin"),
+	)
+	requestID := rand.Int31()
+	msg := make([]byte, 16, 16+5+len(body))
+	binary.LittleEndian.PutUint32(msg[4:], uint32(requestID))
+	binary.LittleEndian.PutUint32(msg[12:], mongoOpMsg)
+	msg = append(msg, 0, 0, 0, 0, 0)
+	msg = append(msg, body...)
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)))
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var header [16]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint32(header[:]))
+	if n < 16+5 || n > mongoMaxMessage {
+		return nil, errors.New("mongo: invalid message length")
+	}
+	if int32(binary.LittleEndian.Uint32(header[8:])) != requestID || binary.LittleEndian.Uint32(header[12:]) != mongoOpMsg {
+		return nil, errors.New("mongo: unexpected reply")
+	}
+	b := make([]byte, n-16)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	flags := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	if flags&1 != 0 && len(b) >= 4 {
+		// The checksum is ignored.
+		b = b[:len(b)-4]
+	}
+	if len(b) == 0 || b[0] != 0 {
+		return nil, errors.New("mongo: reply without a body")
+	}
+	doc, _, err := bsonParse(b[1:])
+	return doc, err
+}
+
+// mongoFloat returns the value of a numeric field, whatever its BSON type.
+func mongoFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case bool:
+		if v {
+			return 1
+		}
+	}
+	return 0
+}
+
+// mongoArray returns the elements of a BSON array, decoded as a document
+// keyed by index.
+func mongoArray(v interface{}) []interface{} {
+	doc, _ := v.(map[string]interface{})
+	var elements []interface{}
+	for i := 0; ; i++ {
+		e, ok := doc[fmt.Sprint(i)]
+		if !ok {
+			return elements
+		}
+		elements = append(elements, e)
+	}
+}
+
+// bsonDocument encodes a document made of the encoded elements.
+func bsonDocument(elements ...[]byte) []byte {
+	n := 4 + 1
+	for _, e := range elements {
+		n += len(e)
+	}
+	b := binary.LittleEndian.AppendUint32(make([]byte, 0, n), uint32(n))
+	for _, e := range elements {
+		b = append(b, e...)
+	}
+	return append(b, 0)
+}
+
+func bsonInt32(key string, v int32) []byte {
+	b := append(append([]byte{0x10}, key...), 0)
+	return binary.LittleEndian.AppendUint32(b, uint32(v))
+}
+
+func bsonString(key, v string) []byte {
+	b := append(append([]byte{0x02}, key...), 0)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(v)+1))
+	return append(append(b, v...), 0)
+}
+
+var errBSONMalformed = errors.New("bson: malformed document")
+
+// bsonParse decodes a document, returning the bytes after it. Doubles,
+// strings, documents, arrays (as documents keyed by index), booleans,
+// int32 and int64 are decoded, other types skipped.
+func bsonParse(b []byte) (map[string]interface{}, []byte, error) {
+	if len(b) < 5 {
+		return nil, nil, errBSONMalformed
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if n < 5 || n > len(b) || b[n-1] != 0 {
+		return nil, nil, errBSONMalformed
+	}
+	rest := b[n:]
+	b = b[4 : n-1]
+	doc := make(map[string]interface{})
+	for len(b) > 0 {
+		typ := b[0]
+		i := bytes.IndexByte(b[1:], 0)
+		if i < 0 {
+			return nil, nil, errBSONMalformed
+		}
+		key := string(b[1 : 1+i])
+		b = b[2+i:]
+		var size int
+		switch typ {
+		case 0x01, 0x09, 0x11, 0x12: // double, datetime, timestamp, int64
+			size = 8
+		case 0x02, 0x0d, 0x0e: // string, JavaScript, symbol
+			if len(b) < 4 {
+				return nil, nil, errBSONMalformed
+			}
+			size = 4 + int(binary.LittleEndian.Uint32(b))
+		case 0x03, 0x04, 0x0f: // document, array, JavaScript with scope
+			if len(b) < 4 {
+				return nil, nil, errBSONMalformed
+			}
+			size = int(binary.LittleEndian.Uint32(b))
+		case 0x05: // binary
+			if len(b) < 4 {
+				return nil, nil, errBSONMalformed
+			}
+			size = 5 + int(binary.LittleEndian.Uint32(b))
+		case 0x07: // ObjectId
+			size = 12
+		case 0x08: // boolean
+			size = 1
+		case 0x06, 0x0a, 0x7f, 0xff: // undefined, null, max and min keys
+		case 0x10: // int32
+			size = 4
+		case 0x13: // decimal128
+			size = 16
+		default:
+			return nil, nil, fmt.Errorf("bson: unsupported type 0x%02x", typ)
+		}
+		if size < 0 || size > len(b) {
+			return nil, nil, errBSONMalformed
+		}
+		value := b[:size]
+		b = b[size:]
+		switch typ {
+		case 0x01:
+			doc[key] = math.Float64frombits(binary.LittleEndian.Uint64(value))
+		case 0x02:
+			if size < 5 {
+				return nil, nil, errBSONMalformed
+			}
+			doc[key] = string(value[4 : size-1])
+		case 0x03, 0x04:
+			sub, _, err := bsonParse(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			doc[key] = sub
+		case 0x08:
+			doc[key] = value[0] != 0
+		case 0x10:
+			doc[key] = int32(binary.LittleEndian.Uint32(value))
+		case 0x12:
+			doc[key] = int64(binary.LittleEndian.Uint64(value))
+		}
+	}
+	return doc, rest, nil
+}
@@ -0,0 +1,132 @@
+package libprobe_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func bsonDoc(elements ...[]byte) []byte {
+	body := bytes.Join(elements, nil)
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(body)+5)), append(body, 0)...)
+}
+
+func bsonElement(typ byte, key string, value []byte) []byte {
+	return append(append(append([]byte{typ}, key...), 0), value...)
+}
+
+func bsonStr(key, v string) []byte {
+	return bsonElement(0x02, key, append(binary.LittleEndian.AppendUint32(nil, uint32(len(v)+1)), append([]byte(v), 0)...))
+}
+
+func bsonBool(key string, v bool) []byte {
+	if v {
+		return bsonElement(0x08, key, []byte{1})
+	}
+	return bsonElement(0x08, key, []byte{0})
+}
+
+func bsonNumber(key string, v float64) []byte {
+	return bsonElement(0x01, key, binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func bsonI32(key string, v int32) []byte {
+	return bsonElement(0x10, key, binary.LittleEndian.AppendUint32(nil, uint32(v)))
+}
+
+// serveMongo answers OP_MSG commands with reply, or with CommandNotFound
+// to hello when legacy is set.
+func serveMongo(t *testing.T, reply []byte, legacy bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var header [16]byte
+					if _, err := io.ReadFull(conn, header[:]); err != nil {
+						return
+					}
+					msg := make([]byte, binary.LittleEndian.Uint32(header[:])-16)
+					if _, err := io.ReadFull(conn, msg); err != nil {
+						return
+					}
+					// The command is the first key of the body, after the
+					// flags, the section kind, the length and the type.
+					command := string(msg[10 : bytes.IndexByte(msg[10:], 0)+10])
+					body := reply
+					if legacy && command == "hello" {
+						body = bsonDoc(bsonNumber("ok", 0), bsonStr("errmsg", "no such command: 'hello'"), bsonI32("code", 59))
+					}
+					resp := make([]byte, 16)
+					binary.LittleEndian.PutUint32(resp[8:], binary.LittleEndian.Uint32(header[4:]))
+					binary.LittleEndian.PutUint32(resp[12:], 2013)
+					resp = append(append(resp, 0, 0, 0, 0, 0), body...)
+					binary.LittleEndian.PutUint32(resp, uint32(len(resp)))
+					conn.Write(resp)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestMongoProber(t *testing.T) {
+	hosts := bsonElement(0x04, "hosts", bsonDoc(bsonStr("0", "db1:27017"), bsonStr("1", "db2:27017")))
+	secondary := bsonDoc(
+		bsonBool("isWritablePrimary", false),
+		bsonBool("secondary", true),
+		bsonStr("setName", "rs0"),
+		hosts,
+		bsonStr("primary", "db1:27017"),
+		bsonStr("me", "db2:27017"),
+		bsonElement(0x07, "electionId", make([]byte, 12)),
+		bsonElement(0x09, "localTime", make([]byte, 8)),
+		bsonI32("minWireVersion", 0),
+		bsonI32("maxWireVersion", 21),
+		bsonNumber("ok", 1),
+	)
+	r, err := libprobe.NewMongoProber(libprobe.MongoProberOptions{}).Probe(libprobe.Target{Address: serveMongo(t, secondary, false), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.MongoResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, libprobe.MongoSecondary, res.Role)
+	require.Equal(t, "rs0", res.SetName)
+	require.Equal(t, "db1:27017", res.Primary)
+	require.Equal(t, []string{"db1:27017", "db2:27017"}, res.Hosts)
+	require.EqualValues(t, 21, res.MaxWireVersion)
+	require.Positive(t, res.HelloTime)
+
+	// Servers without hello are sent isMaster.
+	standalone := bsonDoc(bsonBool("ismaster", true), bsonI32("maxWireVersion", 8), bsonNumber("ok", 1))
+	r, err = libprobe.NewMongoProber(libprobe.MongoProberOptions{}).Probe(libprobe.Target{Address: serveMongo(t, standalone, true), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.MongoResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, libprobe.MongoStandalone, res.Role)
+	require.EqualValues(t, 8, res.MaxWireVersion)
+
+	router := bsonDoc(bsonBool("isWritablePrimary", true), bsonStr("msg", "isdbgrid"), bsonNumber("ok", 1))
+	r, err = libprobe.NewMongoProber(libprobe.MongoProberOptions{}).Probe(libprobe.Target{Address: serveMongo(t, router, false), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.Equal(t, libprobe.MongoRouter, r.(*libprobe.MongoResult).Role)
+
+	failed := bsonDoc(bsonNumber("ok", 0), bsonStr("errmsg", "node is shutting down"))
+	r, err = libprobe.NewMongoProber(libprobe.MongoProberOptions{}).Probe(libprobe.Target{Address: serveMongo(t, failed, false), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.EqualError(t, r.(*libprobe.MongoResult).Error, "mongo: node is shutting down")
+}
@@ -0,0 +1,272 @@
+package libprobe
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect      = 1
+	mqttConnack      = 2
+	mqttPublish      = 3
+	mqttPuback       = 4
+	mqttPubrec       = 5
+	mqttPubrel       = 6
+	mqttPubcomp      = 7
+	mqttSubscribe    = 8
+	mqttSuback       = 9
+	mqttPingresp     = 13
+	mqttDisconnect   = 14
+	mqttMaxRemaining = 268435455
+)
+
+// mqttConnectOptions are the CONNECT fields used by the MQTT sink and prober.
+type mqttConnectOptions struct {
+	ClientID     string
+	Username     string
+	Password     string
+	KeepAlive    time.Duration
+	CleanSession bool
+}
+
+// mqttConn is a minimal, synchronous MQTT 3.1.1 client connection.
+type mqttConn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	nextID uint16
+	// onPublish, when set, is called with the messages received while
+	// waiting for acknowledgements.
+	onPublish func(topic string, payload []byte)
+}
+
+func dialMQTT(address string, tlsConfig *tls.Config, timeout time.Duration) (*mqttConn, error) {
+	dialer, err := guardDialer("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mqttConn{conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func (c *mqttConn) writePacket(packetType, flags byte, body []byte) error {
+	if len(body) > mqttMaxRemaining {
+		return fmt.Errorf("mqtt: packet too large (%d bytes)", len(body))
+	}
+	packet := []byte{packetType<<4 | flags}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := c.conn.Write(append(packet, body...))
+	return err
+}
+
+func (c *mqttConn) readPacket() (packetType byte, flags byte, body []byte, err error) {
+	head, err := c.br.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		digit, err := c.br.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body = make([]byte, length)
+	if _, err := io.ReadFull(c.br, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return head >> 4, head & 0x0f, body, nil
+}
+
+// connect sends CONNECT and returns the CONNACK return code and session
+// present flag. A non-zero return code is not reported as an error.
+func (c *mqttConn) connect(opts mqttConnectOptions) (returnCode byte, sessionPresent bool, err error) {
+	var flags byte
+	if opts.CleanSession {
+		flags |= 0x02
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags)
+	keepAlive := uint16(opts.KeepAlive / time.Second)
+	body = append(body, byte(keepAlive>>8), byte(keepAlive))
+	body = appendMQTTString(body, opts.ClientID)
+	if opts.Username != "" {
+		body = appendMQTTString(body, opts.Username)
+	}
+	if opts.Password != "" {
+		body = appendMQTTString(body, opts.Password)
+	}
+	if err := c.writePacket(mqttConnect, 0, body); err != nil {
+		return 0, false, err
+	}
+	packetType, _, resp, err := c.readPacket()
+	if err != nil {
+		return 0, false, err
+	}
+	if packetType != mqttConnack || len(resp) != 2 {
+		return 0, false, fmt.Errorf("mqtt: unexpected packet type %d waiting for CONNACK", packetType)
+	}
+	return resp[1], resp[0]&0x01 != 0, nil
+}
+
+func (c *mqttConn) packetID() uint16 {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	return c.nextID
+}
+
+// publish sends a PUBLISH and, for QoS 1 and 2, waits for the broker to
+// complete the acknowledgement flow.
+func (c *mqttConn) publish(topic string, payload []byte, qos byte, retain bool) error {
+	if qos > 2 {
+		return fmt.Errorf("mqtt: invalid QoS %d", qos)
+	}
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	body := appendMQTTString(nil, topic)
+	var id uint16
+	if qos > 0 {
+		id = c.packetID()
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = append(body, payload...)
+	if err := c.writePacket(mqttPublish, flags, body); err != nil {
+		return err
+	}
+	switch qos {
+	case 1:
+		return c.waitAck(mqttPuback, id)
+	case 2:
+		if err := c.waitAck(mqttPubrec, id); err != nil {
+			return err
+		}
+		if err := c.writePacket(mqttPubrel, 0x02, []byte{byte(id >> 8), byte(id)}); err != nil {
+			return err
+		}
+		return c.waitAck(mqttPubcomp, id)
+	}
+	return nil
+}
+
+func (c *mqttConn) waitAck(packetType byte, id uint16) error {
+	for {
+		t, _, body, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if t == packetType && len(body) >= 2 && binary.BigEndian.Uint16(body) == id {
+			return nil
+		}
+		if t == mqttPublish {
+			c.received(body)
+			continue
+		}
+		if t == mqttPingresp {
+			continue
+		}
+		return fmt.Errorf("mqtt: unexpected packet type %d waiting for %d", t, packetType)
+	}
+}
+
+// received passes a QoS 0 message to onPublish. Subscriptions are made
+// with QoS 0, so messages of other QoS aren't expected.
+func (c *mqttConn) received(body []byte) {
+	if c.onPublish == nil || len(body) < 2 || int(binary.BigEndian.Uint16(body)) > len(body)-2 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	c.onPublish(string(body[2:2+n]), body[2+n:])
+}
+
+// subscribe sends a SUBSCRIBE to topic with QoS 0 and waits for the SUBACK.
+func (c *mqttConn) subscribe(topic string) error {
+	id := c.packetID()
+	body := appendMQTTString([]byte{byte(id >> 8), byte(id)}, topic)
+	if err := c.writePacket(mqttSubscribe, 0x02, append(body, 0)); err != nil {
+		return err
+	}
+	for {
+		t, _, resp, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		switch {
+		case t == mqttSuback && len(resp) == 3 && binary.BigEndian.Uint16(resp) == id:
+			if resp[2] == 0x80 {
+				return fmt.Errorf("mqtt: subscription to %s refused", topic)
+			}
+			return nil
+		case t == mqttPublish:
+			c.received(resp)
+		case t != mqttPingresp:
+			return fmt.Errorf("mqtt: unexpected packet type %d waiting for %d", t, mqttSuback)
+		}
+	}
+}
+
+// receive reads packets until onPublish is done with them.
+func (c *mqttConn) receive(done func() bool) error {
+	for !done() {
+		t, _, body, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if t == mqttPublish {
+			c.received(body)
+		}
+	}
+	return nil
+}
+
+func (c *mqttConn) Close() error {
+	_ = c.writePacket(mqttDisconnect, 0, nil)
+	return c.conn.Close()
+}
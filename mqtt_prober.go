@@ -0,0 +1,183 @@
+package libprobe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindMQTT = "MQTT"
+
+// mqttReturnCodes describe the CONNACK return codes of MQTT 3.1.1.
+var mqttReturnCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// MQTTProberOptions configures an MQTTProber.
+type MQTTProberOptions struct {
+	// TLS connects with TLS, configured by TLSConfig, whose ServerName
+	// defaults to the host dialed, on port 8883 by default instead of
+	// 1883.
+	TLS       bool
+	TLSConfig *tls.Config
+	// ClientID defaults to "libprobe-" followed by the time.
+	ClientID string
+	Username string
+	Password string
+	// Topic, when set, is a test topic subscribed to and then published
+	// to with QoS, timing the message through the broker.
+	Topic string
+	QoS   byte
+}
+
+// MQTTResult describes a session with an MQTT broker.
+type MQTTResult struct {
+	Target
+	Error error
+
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	// ConnackTime is the time from CONNECT to CONNACK.
+	ConnackTime    time.Duration
+	ReturnCode     byte
+	SessionPresent bool
+	// SubscribeTime is the time from SUBSCRIBE to SUBACK, PublishTime the
+	// time of the publication up to its acknowledgement, 0 with QoS 0,
+	// and DeliveryTime the time from publishing to receiving the message.
+	SubscribeTime time.Duration
+	PublishTime   time.Duration
+	DeliveryTime  time.Duration
+	TotalTime     time.Duration
+}
+
+func (r MQTTResult) RTT() time.Duration {
+	return r.ConnackTime
+}
+
+func (r MQTTResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	s := fmt.Sprintf("-> %s Connect: %s, TLS Handshake: %s, CONNACK: %s", r.Target.Address, r.ConnectTime, r.TLSHandshakeTime, r.ConnackTime)
+	if r.DeliveryTime > 0 {
+		s += fmt.Sprintf(", Subscribe: %s, Publish: %s, Delivery: %s", r.SubscribeTime, r.PublishTime, r.DeliveryTime)
+	}
+	return s + fmt.Sprintf(". Total: %s", r.TotalTime)
+}
+
+// MQTTProber connects to the MQTT 3.1.1 broker in Target.Address, "host" or
+// "host:port", optionally sends a message through a test topic, then
+// disconnects. A CONNACK refusing the connection is reported as an error,
+// along with its return code.
+type MQTTProber struct {
+	opts MQTTProberOptions
+}
+
+func NewMQTTProber(opts MQTTProberOptions) *MQTTProber {
+	return &MQTTProber{opts: opts}
+}
+
+func (p *MQTTProber) Kind() string {
+	return KindMQTT
+}
+
+func (p *MQTTProber) Probe(target Target) (Result, error) {
+	if p.opts.QoS > 2 {
+		return nil, fmt.Errorf("mqtt: invalid QoS %d", p.opts.QoS)
+	}
+	r := &MQTTResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "1883"
+		if p.opts.TLS {
+			port = "8883"
+		}
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+	if p.opts.TLS {
+		handshakeAt := time.Now()
+		tlsConn := tls.Client(conn, mailTLSConfig(p.opts.TLSConfig, address))
+		if err := tlsConn.Handshake(); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.TLSHandshakeTime = time.Since(handshakeAt)
+		conn = tlsConn
+	}
+	c := &mqttConn{conn: conn, br: bufio.NewReader(conn)}
+	r.Error = p.session(r, c)
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+func (p *MQTTProber) session(r *MQTTResult, c *mqttConn) error {
+	clientID := p.opts.ClientID
+	if clientID == "" {
+		clientID = fmt.Sprintf("libprobe-%d", time.Now().UnixNano())
+	}
+	connectAt := time.Now()
+	code, sessionPresent, err := c.connect(mqttConnectOptions{
+		ClientID:     clientID,
+		Username:     p.opts.Username,
+		Password:     p.opts.Password,
+		CleanSession: true,
+	})
+	if err != nil {
+		return err
+	}
+	r.ConnackTime = time.Since(connectAt)
+	r.ReturnCode, r.SessionPresent = code, sessionPresent
+	if code != 0 {
+		if reason, ok := mqttReturnCodes[code]; ok {
+			return fmt.Errorf("mqtt: connection refused, %s", reason)
+		}
+		return fmt.Errorf("mqtt: connection refused, return code %d", code)
+	}
+
+	if p.opts.Topic != "" {
+		// The payload tells the message apart from others on the topic,
+		// such as a retained one.
+		payload := []byte(fmt.Sprintf("libprobe %s %d", clientID, time.Now().UnixNano()))
+		var publishAt time.Time
+		c.onPublish = func(topic string, message []byte) {
+			if r.DeliveryTime == 0 && topic == p.opts.Topic && bytes.Equal(message, payload) {
+				r.DeliveryTime = time.Since(publishAt)
+			}
+		}
+		subscribeAt := time.Now()
+		if err := c.subscribe(p.opts.Topic); err != nil {
+			return err
+		}
+		r.SubscribeTime = time.Since(subscribeAt)
+		publishAt = time.Now()
+		if err := c.publish(p.opts.Topic, payload, p.opts.QoS, false); err != nil {
+			return err
+		}
+		if p.opts.QoS > 0 {
+			r.PublishTime = time.Since(publishAt)
+		}
+		if err := c.receive(func() bool { return r.DeliveryTime > 0 }); err != nil {
+			return err
+		}
+	}
+	return c.writePacket(mqttDisconnect, 0, nil)
+}
@@ -0,0 +1,92 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveMQTTEcho serves a broker refusing the password "wrong", delivering
+// messages to the client that published them, ahead of their PUBACK.
+func serveMQTTEcho(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					p, err := readMQTTTestPacket(r)
+					if err != nil {
+						return
+					}
+					switch p.Type {
+					case 1:
+						code := byte(0)
+						if bytes.HasSuffix(p.Body, []byte("wrong")) {
+							code = 4
+						}
+						_, _ = conn.Write([]byte{0x20, 2, 0, code})
+					case 8:
+						_, _ = conn.Write([]byte{0x90, 3, p.Body[0], p.Body[1], 0})
+					case 3:
+						topicLen := int(p.Body[0])<<8 | int(p.Body[1])
+						payload := p.Body[2+topicLen:]
+						qos := (p.Flags >> 1) & 0x03
+						if qos > 0 {
+							payload = payload[2:]
+						}
+						echo := append(append([]byte{0x30, byte(2 + topicLen + len(payload))}, p.Body[:2+topicLen]...), payload...)
+						_, _ = conn.Write(echo)
+						if qos == 1 {
+							_, _ = conn.Write([]byte{0x40, 2, p.Body[2+topicLen], p.Body[3+topicLen]})
+						}
+					case 14:
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestMQTTProber(t *testing.T) {
+	target := libprobe.Target{Address: serveMQTTEcho(t), Timeout: 5 * time.Second}
+	p := libprobe.NewMQTTProber(libprobe.MQTTProberOptions{Username: "user", Password: "secret", Topic: "probes/test", QoS: 1})
+	require.Equal(t, libprobe.KindMQTT, p.Kind())
+	r, err := p.Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.MQTTResult)
+	require.NoError(t, res.Error)
+	require.Zero(t, res.ReturnCode)
+	require.Positive(t, res.ConnackTime)
+	require.Positive(t, res.SubscribeTime)
+	require.Positive(t, res.PublishTime)
+	require.Positive(t, res.DeliveryTime)
+	require.Equal(t, res.ConnackTime, res.RTT())
+
+	r, err = libprobe.NewMQTTProber(libprobe.MQTTProberOptions{}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.MQTTResult)
+	require.NoError(t, res.Error)
+	require.Zero(t, res.DeliveryTime)
+
+	r, err = libprobe.NewMQTTProber(libprobe.MQTTProberOptions{Username: "user", Password: "wrong"}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.MQTTResult)
+	require.EqualError(t, res.Error, "mqtt: connection refused, bad user name or password")
+	require.Equal(t, byte(4), res.ReturnCode)
+}
@@ -0,0 +1,132 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTTSinkOptions configures an MQTTSink.
+type MQTTSinkOptions struct {
+	// Broker is the broker address as host:port.
+	Broker    string
+	TLSConfig *tls.Config
+	ClientID  string
+	Username  string
+	Password  string
+	// Topic is the topic template results are published to, with the
+	// placeholders {kind} and {target}. Default: "probes/{kind}/{target}".
+	Topic string
+	// StateTopic, when set, is a topic template receiving a retained "up"
+	// or "down" message reflecting the last result of each target.
+	StateTopic string
+	QoS        byte
+	// Retain sets the retain flag on result messages so subscribers
+	// immediately receive the last result.
+	Retain bool
+	// Timeout bounds connecting and acknowledgements. Default: 5s.
+	Timeout time.Duration
+}
+
+// MQTTSink publishes results as JSON to an MQTT 3.1.1 broker. The connection
+// is established lazily and re-established on the next write after a failure.
+type MQTTSink struct {
+	opts MQTTSinkOptions
+
+	mu   sync.Mutex
+	conn *mqttConn
+}
+
+func NewMQTTSink(opts MQTTSinkOptions) *MQTTSink {
+	if opts.Topic == "" {
+		opts.Topic = "probes/{kind}/{target}"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = fmt.Sprintf("libprobe-%d", time.Now().UnixNano())
+	}
+	return &MQTTSink{opts: opts}
+}
+
+var mqttTopicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_", ":", "_")
+
+// MQTTTopic expands the {kind} and {target} placeholders of a topic template.
+// MQTT wildcard and level separator characters in the target are replaced.
+func MQTTTopic(template string, r Result) string {
+	var address string
+	if row := Flatten(r)[0]; row[ColumnAddress] != nil {
+		address, _ = row[ColumnAddress].(string)
+	}
+	address = strings.TrimPrefix(strings.TrimPrefix(address, "https://"), "http://")
+	return strings.NewReplacer(
+		"{kind}", strings.ToLower(resultKind(r)),
+		"{target}", mqttTopicEscaper.Replace(address),
+	).Replace(template)
+}
+
+func (s *MQTTSink) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := dialMQTT(s.opts.Broker, s.opts.TLSConfig, s.opts.Timeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	code, _, err := conn.connect(mqttConnectOptions{
+		ClientID:     s.opts.ClientID,
+		Username:     s.opts.Username,
+		Password:     s.opts.Password,
+		CleanSession: true,
+	})
+	if err == nil && code != 0 {
+		err = fmt.Errorf("mqtt: connection refused, return code %d", code)
+	}
+	if err != nil {
+		conn.conn.Close()
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *MQTTSink) Write(r Result) error {
+	payload, err := MarshalResultJSON(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.connect(); err != nil {
+		return err
+	}
+	_ = s.conn.conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	err = s.conn.publish(MQTTTopic(s.opts.Topic, r), payload, s.opts.QoS, s.opts.Retain)
+	if err == nil && s.opts.StateTopic != "" {
+		state := "down"
+		if resultOK(r) {
+			state = "up"
+		}
+		err = s.conn.publish(MQTTTopic(s.opts.StateTopic, r), []byte(state), s.opts.QoS, true)
+	}
+	if err != nil {
+		s.conn.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *MQTTSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,110 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mqttTestPacket struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+func readMQTTTestPacket(r *bufio.Reader) (mqttTestPacket, error) {
+	head, err := r.ReadByte()
+	if err != nil {
+		return mqttTestPacket{}, err
+	}
+	length, multiplier := 0, 1
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return mqttTestPacket{}, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return mqttTestPacket{Type: head >> 4, Flags: head & 0x0f, Body: body}, err
+}
+
+// newMQTTTestBroker accepts a single client, acknowledges its CONNECT with
+// returnCode and acknowledges QoS 1 publishes, forwarding them to the channel.
+func newMQTTTestBroker(t *testing.T, returnCode byte) (string, <-chan mqttTestPacket) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	packets := make(chan mqttTestPacket, 10)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			p, err := readMQTTTestPacket(r)
+			if err != nil {
+				return
+			}
+			switch p.Type {
+			case 1:
+				_, _ = conn.Write([]byte{0x20, 2, 0, returnCode})
+			case 3:
+				packets <- p
+				if qos := (p.Flags >> 1) & 0x03; qos == 1 {
+					topicLen := int(p.Body[0])<<8 | int(p.Body[1])
+					id := p.Body[2+topicLen : 4+topicLen]
+					_, _ = conn.Write([]byte{0x40, 2, id[0], id[1]})
+				}
+			case 14:
+				return
+			}
+		}
+	}()
+	return l.Addr().String(), packets
+}
+
+func TestMQTTSink(t *testing.T) {
+	addr, packets := newMQTTTestBroker(t, 0)
+	sink := libprobe.NewMQTTSink(libprobe.MQTTSinkOptions{
+		Broker:     addr,
+		QoS:        1,
+		StateTopic: "probes/{kind}/{target}/state",
+	})
+	require.NoError(t, sink.Write(&libprobe.TCPResult{
+		Target:      libprobe.Target{Address: "1.1.1.1:80"},
+		ConnectTime: time.Millisecond,
+	}))
+	require.NoError(t, sink.Close())
+
+	p := <-packets
+	topicLen := int(p.Body[0])<<8 | int(p.Body[1])
+	require.Equal(t, "probes/tcp/1.1.1.1_80", string(p.Body[2:2+topicLen]))
+	var payload map[string]interface{}
+	require.NoError(t, json.Unmarshal(p.Body[4+topicLen:], &payload))
+	require.Equal(t, "1.1.1.1:80", payload["address"])
+
+	state := <-packets
+	require.Equal(t, byte(1), state.Flags&0x01, "state message must be retained")
+	require.Equal(t, "up", string(state.Body[len(state.Body)-2:]))
+}
+
+func TestMQTTSinkRefused(t *testing.T) {
+	addr, _ := newMQTTTestBroker(t, 5)
+	sink := libprobe.NewMQTTSink(libprobe.MQTTSinkOptions{Broker: addr})
+	require.Error(t, sink.Write(&libprobe.TCPResult{}))
+}
@@ -0,0 +1,488 @@
+package libprobe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindMySQL = "MYSQL"
+
+// Capability flags of the MySQL protocol.
+const (
+	mysqlClientLongPassword     = 0x00000001
+	mysqlClientConnectWithDB    = 0x00000008
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSSL              = 0x00000800
+	mysqlClientTransactions     = 0x00002000
+	mysqlClientSecureConnection = 0x00008000
+	mysqlClientPluginAuth       = 0x00080000
+)
+
+// Commands and packet headers of the MySQL protocol.
+const (
+	mysqlComQuit = 0x01
+	mysqlComPing = 0x0e
+
+	mysqlOK         = 0x00
+	mysqlAuthMore   = 0x01
+	mysqlAuthSwitch = 0xfe
+	mysqlErr        = 0xff
+)
+
+// mysqlMaxPacket is the maximum packet size announced to servers.
+const mysqlMaxPacket = 1 << 24
+
+// MySQLProberOptions configures a MySQLProber.
+type MySQLProberOptions struct {
+	// TLS upgrades the connection after the greeting, failing the probe
+	// when the server doesn't support it.
+	TLS bool
+	// TLSConfig configures TLS; its ServerName defaults to the host dialed.
+	TLSConfig *tls.Config
+	// Username, when set, authenticates after the greeting, with Password
+	// and Database, then pings the server. The mysql_native_password,
+	// caching_sha2_password and, over TLS, mysql_clear_password plugins are
+	// supported.
+	Username string
+	Password string
+	Database string
+}
+
+// MySQLResult describes a session with a MySQL or MariaDB server, step by
+// step.
+type MySQLResult struct {
+	Target
+	Error error
+
+	ConnectTime time.Duration
+	// GreetingTime is the time from connecting to the server's greeting.
+	GreetingTime     time.Duration
+	TLSHandshakeTime time.Duration
+	AuthTime         time.Duration
+	PingTime         time.Duration
+	TotalTime        time.Duration
+	ServerVersion    string
+	ConnectionID     uint32
+	// TLSSupported is set when the server announces TLS support.
+	TLSSupported bool
+	TLSVersion   string
+	// AuthPlugin is the authentication plugin of the greeting.
+	AuthPlugin string
+	// ErrorCode and SQLState are those of the server's error, such as 1040
+	// for too many connections or 1129 for a blocked host.
+	ErrorCode uint16
+	SQLState  string
+}
+
+func (r MySQLResult) RTT() time.Duration {
+	return r.TotalTime
+}
+
+func (r MySQLResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	return fmt.Sprintf("-> %s %s Connect: %s, Greeting: %s, TLS Handshake: %s, Auth: %s, Ping: %s. Total: %s",
+		r.Target.Address, r.ServerVersion, r.ConnectTime, r.GreetingTime, r.TLSHandshakeTime, r.AuthTime, r.PingTime, r.TotalTime)
+}
+
+// MySQLError is an error packet sent by a MySQL server.
+type MySQLError struct {
+	Code     uint16
+	SQLState string
+	Message  string
+}
+
+func (e *MySQLError) Error() string {
+	if e.SQLState != "" {
+		return fmt.Sprintf("mysql: %d (%s): %s", e.Code, e.SQLState, e.Message)
+	}
+	return fmt.Sprintf("mysql: %d: %s", e.Code, e.Message)
+}
+
+// MySQLProber checks the MySQL server in Target.Address, "host" or
+// "host:port" with port 3306 by default: it reads the greeting, optionally
+// upgrades to TLS, authenticates and pings the server, then quits. A server
+// accepting connections but answering with an error, e.g. when it has too
+// many connections, fails the probe with a *MySQLError.
+type MySQLProber struct {
+	opts MySQLProberOptions
+}
+
+func NewMySQLProber(opts MySQLProberOptions) *MySQLProber {
+	return &MySQLProber{opts: opts}
+}
+
+func (p *MySQLProber) Kind() string {
+	return KindMySQL
+}
+
+// mysqlConn reads and writes the packets of a MySQL session.
+type mysqlConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	seq  byte
+}
+
+func (c *mysqlConn) readPacket() ([]byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return nil, err
+	}
+	n := int(head[0]) | int(head[1])<<8 | int(head[2])<<16
+	c.seq = head[3] + 1
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, err
+	}
+	if len(b) > 0 && b[0] == mysqlErr {
+		return b, mysqlParseError(b)
+	}
+	return b, nil
+}
+
+func (c *mysqlConn) writePacket(b []byte) error {
+	head := []byte{byte(len(b)), byte(len(b) >> 8), byte(len(b) >> 16), c.seq}
+	c.seq++
+	_, err := c.conn.Write(append(head, b...))
+	return err
+}
+
+// command sends a command, starting a new sequence, and reads its reply.
+func (c *mysqlConn) command(cmd byte) ([]byte, error) {
+	c.seq = 0
+	if err := c.writePacket([]byte{cmd}); err != nil {
+		return nil, err
+	}
+	return c.readPacket()
+}
+
+func mysqlParseError(b []byte) error {
+	e := &MySQLError{}
+	if len(b) < 3 {
+		return errors.New("mysql: malformed error packet")
+	}
+	e.Code = binary.LittleEndian.Uint16(b[1:])
+	b = b[3:]
+	if len(b) >= 6 && b[0] == '#' {
+		e.SQLState, b = string(b[1:6]), b[6:]
+	}
+	e.Message = string(b)
+	return e
+}
+
+// mysqlGreeting is the initial handshake packet of a server.
+type mysqlGreeting struct {
+	version      string
+	connectionID uint32
+	capabilities uint32
+	charset      byte
+	nonce        []byte
+	plugin       string
+}
+
+func mysqlParseGreeting(b []byte) (*mysqlGreeting, error) {
+	errMalformed := errors.New("mysql: malformed greeting")
+	if len(b) == 0 || b[0] != 10 {
+		return nil, errors.New("mysql: unsupported protocol version")
+	}
+	g := &mysqlGreeting{}
+	i := bytes.IndexByte(b[1:], 0)
+	if i < 0 {
+		return nil, errMalformed
+	}
+	g.version, b = string(b[1:1+i]), b[2+i:]
+	if len(b) < 4+8+1+2 {
+		return nil, errMalformed
+	}
+	g.connectionID = binary.LittleEndian.Uint32(b)
+	g.nonce = append([]byte(nil), b[4:12]...)
+	g.capabilities = uint32(binary.LittleEndian.Uint16(b[13:]))
+	b = b[15:]
+	if len(b) < 1+2+2+1+10 {
+		return g, nil
+	}
+	g.charset = b[0]
+	g.capabilities |= uint32(binary.LittleEndian.Uint16(b[3:])) << 16
+	nonceLength := int(b[5])
+	b = b[16:]
+	if g.capabilities&mysqlClientSecureConnection != 0 {
+		n := max(13, nonceLength-8)
+		if len(b) < n {
+			return nil, errMalformed
+		}
+		g.nonce = append(g.nonce, bytes.TrimRight(b[:n], "\x00")...)
+		b = b[n:]
+	}
+	if g.capabilities&mysqlClientPluginAuth != 0 {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		g.plugin = string(b)
+	}
+	return g, nil
+}
+
+func (p *MySQLProber) Probe(target Target) (Result, error) {
+	r := &MySQLResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "3306")
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+	r.Error = p.session(r, &mysqlConn{conn: conn, r: bufio.NewReader(conn)}, address)
+	var serverErr *MySQLError
+	if errors.As(r.Error, &serverErr) {
+		r.ErrorCode, r.SQLState = serverErr.Code, serverErr.SQLState
+	}
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+func (p *MySQLProber) session(r *MySQLResult, c *mysqlConn, address string) error {
+	greetingAt := time.Now()
+	b, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	r.GreetingTime = time.Since(greetingAt)
+	g, err := mysqlParseGreeting(b)
+	if err != nil {
+		return err
+	}
+	r.ServerVersion, r.ConnectionID, r.AuthPlugin = g.version, g.connectionID, g.plugin
+	r.TLSSupported = g.capabilities&mysqlClientSSL != 0
+
+	capabilities := uint32(mysqlClientLongPassword | mysqlClientProtocol41 | mysqlClientTransactions | mysqlClientSecureConnection | mysqlClientPluginAuth)
+	if p.opts.Database != "" {
+		capabilities |= mysqlClientConnectWithDB
+	}
+	capabilities &= g.capabilities | mysqlClientLongPassword
+	if capabilities&mysqlClientProtocol41 == 0 {
+		return errors.New("mysql: the server doesn't support protocol 4.1")
+	}
+	// The SSLRequest is the start of the handshake response.
+	header := func(capabilities uint32) []byte {
+		b := binary.LittleEndian.AppendUint32(nil, capabilities)
+		b = binary.LittleEndian.AppendUint32(b, mysqlMaxPacket)
+		return append(append(b, g.charset), make([]byte, 23)...)
+	}
+	secure := false
+	if p.opts.TLS {
+		if !r.TLSSupported {
+			return errors.New("mysql: the server doesn't support TLS")
+		}
+		capabilities |= mysqlClientSSL
+		if err := c.writePacket(header(capabilities)); err != nil {
+			return err
+		}
+		handshakeAt := time.Now()
+		tlsConn := tls.Client(c.conn, mailTLSConfig(p.opts.TLSConfig, address))
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		r.TLSHandshakeTime = time.Since(handshakeAt)
+		r.TLSVersion = tlsVersionName(tlsConn.ConnectionState().Version)
+		c.conn, c.r, secure = tlsConn, bufio.NewReader(tlsConn), true
+	}
+	if p.opts.Username == "" {
+		return nil
+	}
+
+	authAt := time.Now()
+	plugin := g.plugin
+	if plugin == "" {
+		plugin = "mysql_native_password"
+	}
+	auth, err := p.scramble(plugin, g.nonce, secure)
+	if err != nil {
+		return err
+	}
+	resp := append(header(capabilities), p.opts.Username...)
+	resp = append(append(resp, 0, byte(len(auth))), auth...)
+	if capabilities&mysqlClientConnectWithDB != 0 {
+		resp = append(append(resp, p.opts.Database...), 0)
+	}
+	if capabilities&mysqlClientPluginAuth != 0 {
+		resp = append(append(resp, plugin...), 0)
+	}
+	if err := c.writePacket(resp); err != nil {
+		return err
+	}
+	if err := p.authenticate(c, plugin, g.nonce, secure); err != nil {
+		return err
+	}
+	r.AuthTime = time.Since(authAt)
+
+	pingAt := time.Now()
+	if _, err := c.command(mysqlComPing); err != nil {
+		return err
+	}
+	r.PingTime = time.Since(pingAt)
+	c.seq = 0
+	return c.writePacket([]byte{mysqlComQuit})
+}
+
+// authenticate reads the server's replies to the handshake response until
+// it accepts or refuses the credentials, switching plugins as it requests.
+func (p *MySQLProber) authenticate(c *mysqlConn, plugin string, nonce []byte, secure bool) error {
+	for {
+		b, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if len(b) == 0 {
+			return errors.New("mysql: empty packet")
+		}
+		switch b[0] {
+		case mysqlOK:
+			return nil
+		case mysqlAuthSwitch:
+			b = b[1:]
+			i := bytes.IndexByte(b, 0)
+			if i < 0 {
+				return errors.New("mysql: malformed authentication switch")
+			}
+			plugin, nonce = string(b[:i]), bytes.TrimRight(b[i+1:], "\x00")
+			auth, err := p.scramble(plugin, nonce, secure)
+			if err != nil {
+				return err
+			}
+			if err := c.writePacket(auth); err != nil {
+				return err
+			}
+		case mysqlAuthMore:
+			if plugin != "caching_sha2_password" || len(b) < 2 {
+				return errors.New("mysql: unexpected authentication data")
+			}
+			switch b[1] {
+			case 3:
+				// Fast authentication succeeded: the OK packet follows.
+			case 4:
+				if err := p.fullAuthentication(c, nonce, secure); err != nil {
+					return err
+				}
+			default:
+				return errors.New("mysql: unexpected authentication data")
+			}
+		default:
+			return errors.New("mysql: unexpected authentication reply")
+		}
+	}
+}
+
+// fullAuthentication sends the password for caching_sha2_password when the
+// server's cache lacks it: in clear over TLS, encrypted with the server's
+// RSA key otherwise.
+func (p *MySQLProber) fullAuthentication(c *mysqlConn, nonce []byte, secure bool) error {
+	password := append([]byte(p.opts.Password), 0)
+	if secure {
+		return c.writePacket(password)
+	}
+	if err := c.writePacket([]byte{2}); err != nil {
+		return err
+	}
+	b, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 || b[0] != mysqlAuthMore {
+		return errors.New("mysql: no public key from the server")
+	}
+	block, _ := pem.Decode(b[1:])
+	if block == nil {
+		return errors.New("mysql: malformed public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok || len(nonce) == 0 {
+		return errors.New("mysql: unsupported public key")
+	}
+	for i := range password {
+		password[i] ^= nonce[i%len(nonce)]
+	}
+	encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaKey, password, nil)
+	if err != nil {
+		return err
+	}
+	return c.writePacket(encrypted)
+}
+
+// scramble returns the authentication data of plugin for the password.
+func (p *MySQLProber) scramble(plugin string, nonce []byte, secure bool) ([]byte, error) {
+	switch plugin {
+	case "mysql_native_password":
+		return mysqlNativeScramble(p.opts.Password, nonce), nil
+	case "caching_sha2_password":
+		return mysqlSHA2Scramble(p.opts.Password, nonce), nil
+	case "mysql_clear_password":
+		if !secure {
+			return nil, errors.New("mysql: refusing to send a clear password without TLS")
+		}
+		return append([]byte(p.opts.Password), 0), nil
+	}
+	return nil, fmt.Errorf("mysql: unsupported authentication plugin %q", plugin)
+}
+
+// mysqlNativeScramble returns SHA1(password) XOR SHA1(nonce +
+// SHA1(SHA1(password))).
+func mysqlNativeScramble(password string, nonce []byte) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write(stage2[:])
+	scramble := h.Sum(nil)
+	for i := range scramble {
+		scramble[i] ^= stage1[i]
+	}
+	return scramble
+}
+
+// mysqlSHA2Scramble returns SHA256(password) XOR
+// SHA256(SHA256(SHA256(password)) + nonce).
+func mysqlSHA2Scramble(password string, nonce []byte) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha256.Sum256([]byte(password))
+	stage2 := sha256.Sum256(stage1[:])
+	h := sha256.New()
+	h.Write(stage2[:])
+	h.Write(nonce)
+	scramble := h.Sum(nil)
+	for i := range scramble {
+		scramble[i] ^= stage1[i]
+	}
+	return scramble
+}
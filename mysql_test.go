@@ -0,0 +1,183 @@
+package libprobe_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveMySQL serves a minimal MySQL server, accepting the user "user" with
+// caching_sha2_password and the user "native", switched to
+// mysql_native_password, both with the password secret. A busy server
+// refuses every connection.
+func serveMySQL(t *testing.T, config *tls.Config, busy bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fakeMySQL(conn, config, busy)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func fakeMySQL(conn net.Conn, config *tls.Config, busy bool) {
+	var seq byte
+	write := func(b []byte) {
+		conn.Write(append([]byte{byte(len(b)), byte(len(b) >> 8), 0, seq}, b...))
+		seq++
+	}
+	read := func() []byte {
+		var head [4]byte
+		if _, err := io.ReadFull(conn, head[:]); err != nil {
+			return nil
+		}
+		b := make([]byte, int(head[0])|int(head[1])<<8)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil
+		}
+		seq = head[3] + 1
+		return b
+	}
+	ok := []byte{0, 0, 0, 2, 0, 0, 0}
+	if busy {
+		write(append([]byte{0xff, 0x10, 0x04}, "#08004Too many connections"...))
+		return
+	}
+	nonce := []byte("abcdefghijklmnopqrst")
+	greeting := append([]byte{10}, "8.0.36-fake\x00"...)
+	greeting = binary.LittleEndian.AppendUint32(greeting, 7)
+	greeting = append(append(greeting, nonce[:8]...), 0)
+	capabilities := uint32(0x1 | 0x8 | 0x200 | 0x800 | 0x8000 | 0x80000)
+	greeting = binary.LittleEndian.AppendUint16(greeting, uint16(capabilities))
+	greeting = append(greeting, 0xff, 2, 0)
+	greeting = binary.LittleEndian.AppendUint16(greeting, uint16(capabilities>>16))
+	greeting = append(append(greeting, 21), make([]byte, 10)...)
+	greeting = append(append(greeting, nonce[8:]...), 0)
+	greeting = append(greeting, "caching_sha2_password\x00"...)
+	write(greeting)
+
+	resp := read()
+	if len(resp) == 32 {
+		tlsConn := tls.Server(conn, config)
+		if tlsConn.Handshake() != nil {
+			return
+		}
+		conn = tlsConn
+		resp = read()
+	}
+	if len(resp) < 32 {
+		return
+	}
+	fields := bytes.SplitN(resp[32:], []byte{0}, 2)
+	user, rest := string(fields[0]), fields[1]
+	auth := rest[1 : 1+rest[0]]
+	switch {
+	case user == "user" && bytes.Equal(auth, sha2Scramble("secret", nonce)):
+		write([]byte{1, 3})
+		write(ok)
+	case user == "native":
+		switched := []byte("ABCDEFGHIJKLMNOPQRST")
+		write(append(append([]byte{0xfe}, "mysql_native_password\x00"...), append(switched, 0)...))
+		if !bytes.Equal(read(), nativeScramble("secret", switched)) {
+			write(append([]byte{0xff, 0x15, 0x04}, "#28000Access denied"...))
+			return
+		}
+		write(ok)
+	default:
+		write(append([]byte{0xff, 0x15, 0x04}, "#28000Access denied"...))
+		return
+	}
+	for {
+		cmd := read()
+		if len(cmd) == 0 || cmd[0] != 0x0e {
+			return
+		}
+		write(ok)
+	}
+}
+
+func sha2Scramble(password string, nonce []byte) []byte {
+	stage1 := sha256.Sum256([]byte(password))
+	stage2 := sha256.Sum256(stage1[:])
+	digest := sha256.Sum256(append(stage2[:], nonce...))
+	for i := range digest {
+		digest[i] ^= stage1[i]
+	}
+	return digest[:]
+}
+
+func nativeScramble(password string, nonce []byte) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	digest := sha1.Sum(append(append([]byte(nil), nonce...), stage2[:]...))
+	for i := range digest {
+		digest[i] ^= stage1[i]
+	}
+	return digest[:]
+}
+
+func TestMySQLProber(t *testing.T) {
+	// The test server's certificate is valid for 127.0.0.1.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	clientConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	target := libprobe.Target{Address: serveMySQL(t, srv.TLS, false), Timeout: 5 * time.Second}
+
+	r, err := libprobe.NewMySQLProber(libprobe.MySQLProberOptions{}).Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.MySQLResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "8.0.36-fake", res.ServerVersion)
+	require.EqualValues(t, 7, res.ConnectionID)
+	require.True(t, res.TLSSupported)
+	require.Equal(t, "caching_sha2_password", res.AuthPlugin)
+	require.Zero(t, res.AuthTime)
+
+	r, err = libprobe.NewMySQLProber(libprobe.MySQLProberOptions{TLS: true, TLSConfig: clientConfig, Username: "user", Password: "secret"}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.MySQLResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "TLS 1.3", res.TLSVersion)
+	require.Positive(t, res.AuthTime)
+	require.Positive(t, res.PingTime)
+
+	r, err = libprobe.NewMySQLProber(libprobe.MySQLProberOptions{Username: "native", Password: "secret", Database: "app"}).Probe(target)
+	require.NoError(t, err)
+	require.NoError(t, r.(*libprobe.MySQLResult).Error)
+
+	r, err = libprobe.NewMySQLProber(libprobe.MySQLProberOptions{Username: "user", Password: "wrong"}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.MySQLResult)
+	require.EqualError(t, res.Error, "mysql: 1045 (28000): Access denied")
+	require.EqualValues(t, 1045, res.ErrorCode)
+
+	// A server accepting connections but refusing sessions is down.
+	r, err = libprobe.NewMySQLProber(libprobe.MySQLProberOptions{}).Probe(libprobe.Target{Address: serveMySQL(t, nil, true), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.MySQLResult)
+	require.Error(t, res.Error)
+	require.EqualValues(t, 1040, res.ErrorCode)
+	require.Equal(t, "08004", res.SQLState)
+	require.Empty(t, res.ServerVersion)
+}
@@ -0,0 +1,349 @@
+package libprobe
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATSSinkOptions configures a NATSSink.
+type NATSSinkOptions struct {
+	// Server is the NATS server address. Default port is 4222.
+	Server string
+	// TLSConfig enables TLS, which is also used when the server requires it.
+	TLSConfig *tls.Config
+	Username  string
+	Password  string
+	Token     string
+	// Subject is the subject template results are published to, with the
+	// placeholders {kind} and {target}. It must be bound to a JetStream
+	// stream. Default: "probes.{kind}.{target}".
+	Subject string
+	// Encode serializes a result into the message payload. Default:
+	// MarshalResultJSON.
+	Encode func(Result) ([]byte, error)
+	// Retries is the number of additional attempts of a failed publish,
+	// reconnecting before each attempt. Retried messages keep their ID, so
+	// the stream's duplicate window discards them if the first attempt
+	// was stored after all. Default: 3.
+	Retries int
+	// Timeout bounds connecting and waiting for acknowledgements.
+	// Default: 5s.
+	Timeout time.Duration
+}
+
+// NATSSink publishes results to NATS JetStream. Every message carries a
+// unique Nats-Msg-Id header for deduplication, and Write waits for the
+// stream's acknowledgement. The connection is established lazily and
+// re-established after a failure.
+type NATSSink struct {
+	opts NATSSinkOptions
+
+	mu   sync.Mutex
+	conn *natsConn
+	seq  int
+}
+
+// NATSAck is the acknowledgement of a JetStream publish.
+type NATSAck struct {
+	Stream    string `json:"stream"`
+	Sequence  uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate"`
+	Error     *struct {
+		Code        int    `json:"code"`
+		ErrCode     int    `json:"err_code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+func NewNATSSink(opts NATSSinkOptions) *NATSSink {
+	if opts.Subject == "" {
+		opts.Subject = "probes.{kind}.{target}"
+	}
+	if opts.Encode == nil {
+		opts.Encode = MarshalResultJSON
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if _, _, err := net.SplitHostPort(opts.Server); err != nil {
+		opts.Server = net.JoinHostPort(opts.Server, "4222")
+	}
+	return &NATSSink{opts: opts}
+}
+
+var natsSubjectEscaper = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "\t", "_", "/", "_", ":", "_")
+
+// NATSSubject expands the {kind} and {target} placeholders of a subject
+// template. Token separators and wildcards in the target are replaced.
+func NATSSubject(template string, r Result) string {
+	address, _ := Flatten(r)[0][ColumnAddress].(string)
+	address = strings.TrimPrefix(strings.TrimPrefix(address, "https://"), "http://")
+	return strings.NewReplacer(
+		"{kind}", strings.ToLower(resultKind(r)),
+		"{target}", natsSubjectEscaper.Replace(address),
+	).Replace(template)
+}
+
+// Write publishes a result and waits for its acknowledgement.
+func (s *NATSSink) Write(r Result) error {
+	payload, err := s.opts.Encode(r)
+	if err != nil {
+		return err
+	}
+	subject := NATSSubject(s.opts.Subject, r)
+	id := randomID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for attempt := 0; attempt <= s.opts.Retries; attempt++ {
+		var ack *NATSAck
+		if ack, err = s.publish(subject, id, payload); err == nil {
+			if ack.Error != nil {
+				return fmt.Errorf("nats: %s (%d)", ack.Error.Description, ack.Error.ErrCode)
+			}
+			return nil
+		}
+		var status natsStatusError
+		if errors.As(err, &status) {
+			// The server answered, retrying won't help.
+			return err
+		}
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+	}
+	return err
+}
+
+func (s *NATSSink) publish(subject, id string, payload []byte) (*NATSAck, error) {
+	if s.conn == nil {
+		conn, err := dialNATS(s.opts)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	s.seq++
+	reply := s.conn.inbox + "." + strconv.Itoa(s.seq)
+	_ = s.conn.conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	header := "NATS/1.0\r\nNats-Msg-Id: " + id + "\r\n\r\n"
+	fmt.Fprintf(s.conn.w, "HPUB %s %s %d %d\r\n%s", subject, reply, len(header), len(header)+len(payload), header)
+	s.conn.w.Write(payload)
+	s.conn.w.WriteString("\r\n")
+	if err := s.conn.w.Flush(); err != nil {
+		return nil, err
+	}
+	for {
+		msg, err := s.conn.next()
+		if err != nil {
+			return nil, err
+		}
+		if msg.subject != reply {
+			continue
+		}
+		if msg.status != "" {
+			return nil, natsStatusError(msg.status)
+		}
+		var ack NATSAck
+		if err := json.Unmarshal(msg.payload, &ack); err != nil {
+			return nil, fmt.Errorf("nats: invalid acknowledgement: %v", err)
+		}
+		return &ack, nil
+	}
+}
+
+func (s *NATSSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// natsStatusError is a status reply, such as "503 No Responders" when no
+// stream is bound to the subject.
+type natsStatusError string
+
+func (e natsStatusError) Error() string {
+	return "nats: " + string(e)
+}
+
+type natsConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	w     *bufio.Writer
+	inbox string
+}
+
+type natsMsg struct {
+	subject string
+	status  string
+	payload []byte
+}
+
+func dialNATS(opts NATSSinkOptions) (*natsConn, error) {
+	conn, err := net.DialTimeout("tcp", opts.Server, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(opts.Timeout))
+	c := &natsConn{conn: conn, r: bufio.NewReader(conn), inbox: "_INBOX." + randomID()}
+	line, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+		Headers     bool `json:"headers"`
+	}
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		conn.Close()
+		return nil, fmt.Errorf("nats: unexpected greeting %q", line)
+	}
+	if !info.Headers {
+		conn.Close()
+		return nil, errors.New("nats: server doesn't support headers")
+	}
+	if info.TLSRequired || opts.TLSConfig != nil {
+		config := opts.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(opts.Server)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.conn = tlsConn
+		c.r = bufio.NewReader(tlsConn)
+	}
+	c.w = bufio.NewWriter(c.conn)
+	connect, _ := json.Marshal(map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"headers":       true,
+		"no_responders": true,
+		"name":          "libprobe",
+		"lang":          "go",
+		"version":       "1.0.0",
+		"protocol":      1,
+		"user":          opts.Username,
+		"pass":          opts.Password,
+		"auth_token":    opts.Token,
+	})
+	fmt.Fprintf(c.w, "CONNECT %s\r\nSUB %s.* 1\r\nPING\r\n", connect, c.inbox)
+	if err := c.w.Flush(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+		switch {
+		case line == "PONG":
+			return c, nil
+		case strings.HasPrefix(line, "-ERR"):
+			c.conn.Close()
+			return nil, fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (c *natsConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// next reads protocol messages until a message delivered to a subscription,
+// answering pings on the way.
+func (c *natsConn) next() (*natsMsg, error) {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			c.w.WriteString("PONG\r\n")
+			if err := c.w.Flush(); err != nil {
+				return nil, err
+			}
+		case "-ERR":
+			return nil, fmt.Errorf("nats: %s", strings.TrimSpace(line[4:]))
+		case "MSG", "HMSG":
+			return c.readMsg(fields)
+		}
+	}
+}
+
+// readMsg reads the payload of "MSG <subject> <sid> [reply] <size>" and
+// "HMSG <subject> <sid> [reply] <header size> <total size>".
+func (c *natsConn) readMsg(fields []string) (*natsMsg, error) {
+	headers := strings.ToUpper(fields[0]) == "HMSG"
+	min := 4
+	if headers {
+		min = 5
+	}
+	if len(fields) < min || len(fields) > min+1 {
+		return nil, fmt.Errorf("nats: invalid message %q", strings.Join(fields, " "))
+	}
+	total, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || total < 0 || total > 64<<20 {
+		return nil, fmt.Errorf("nats: invalid message size %q", fields[len(fields)-1])
+	}
+	headerSize := 0
+	if headers {
+		if headerSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil || headerSize > total {
+			return nil, fmt.Errorf("nats: invalid header size %q", fields[len(fields)-2])
+		}
+	}
+	buf := make([]byte, total+2)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return nil, err
+	}
+	msg := &natsMsg{subject: fields[1], payload: buf[headerSize:total]}
+	if headers {
+		// The first header line is "NATS/1.0" with an optional status.
+		tp := textproto.NewReader(bufio.NewReader(strings.NewReader(string(buf[:headerSize]))))
+		version, _ := tp.ReadLine()
+		if status := strings.TrimSpace(strings.TrimPrefix(version, "NATS/1.0")); status != "" {
+			msg.status = status
+		}
+	}
+	return msg, nil
+}
+
+func (c *natsConn) Close() error {
+	return c.conn.Close()
+}
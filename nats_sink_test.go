@@ -0,0 +1,104 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+type natsPublish struct {
+	subject string
+	header  string
+	payload string
+}
+
+// serveNATS runs a JetStream server storing messages published to subjects
+// starting with "probes.", deduplicating them by Nats-Msg-Id. The first
+// connection is dropped after reading its first publish when dropFirst is
+// set.
+func serveNATS(t *testing.T, dropFirst bool) (string, <-chan natsPublish) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	published := make(chan natsPublish, 10)
+	seen := make(map[string]bool)
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn, drop bool) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				io.WriteString(conn, `INFO {"server_id":"test","headers":true,"max_payload":1048576}`+"\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					switch fields[0] {
+					case "PING":
+						io.WriteString(conn, "PONG\r\n")
+					case "HPUB":
+						hdr, _ := strconv.Atoi(fields[3])
+						total, _ := strconv.Atoi(fields[4])
+						buf := make([]byte, total+2)
+						if _, err := io.ReadFull(r, buf); err != nil {
+							return
+						}
+						msg := natsPublish{subject: fields[1], header: string(buf[:hdr]), payload: string(buf[hdr:total])}
+						published <- msg
+						if drop {
+							return
+						}
+						if !strings.HasPrefix(fields[1], "probes.") {
+							status := "NATS/1.0 503\r\n\r\n"
+							fmt.Fprintf(conn, "HMSG %s 1 %d %d\r\n%s\r\n", fields[2], len(status), len(status), status)
+							continue
+						}
+						id := strings.TrimSpace(strings.SplitN(msg.header, "Nats-Msg-Id:", 2)[1])
+						ack := fmt.Sprintf(`{"stream":"PROBES","seq":1,"duplicate":%t}`, seen[id])
+						seen[id] = true
+						fmt.Fprintf(conn, "PING\r\nMSG %s 1 %d\r\n%s\r\n", fields[2], len(ack), ack)
+					}
+				}
+			}(conn, dropFirst && n == 0)
+		}
+	}()
+	return l.Addr().String(), published
+}
+
+func TestNATSSink(t *testing.T) {
+	addr, published := serveNATS(t, false)
+	sink := libprobe.NewNATSSink(libprobe.NATSSinkOptions{Server: addr})
+	defer sink.Close()
+	require.NoError(t, sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "1.1.1.1:80"}, ConnectTime: time.Millisecond}))
+	msg := <-published
+	require.Equal(t, "probes.tcp.1_1_1_1_80", msg.subject)
+	require.Contains(t, msg.header, "Nats-Msg-Id: ")
+	require.Contains(t, msg.payload, `"kind":"TCP"`)
+
+	sink = libprobe.NewNATSSink(libprobe.NATSSinkOptions{Server: addr, Subject: "other.{kind}"})
+	defer sink.Close()
+	require.EqualError(t, sink.Write(&libprobe.TCPResult{}), "nats: 503")
+}
+
+func TestNATSSinkRetry(t *testing.T) {
+	addr, published := serveNATS(t, true)
+	sink := libprobe.NewNATSSink(libprobe.NATSSinkOptions{Server: addr, Timeout: time.Second})
+	defer sink.Close()
+	require.NoError(t, sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "1.1.1.1:80"}}))
+	first, second := <-published, <-published
+	require.Equal(t, first.header, second.header)
+}
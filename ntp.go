@@ -0,0 +1,198 @@
+package libprobe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and
+// the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// ntpTime converts t into a 64-bit NTP timestamp.
+func ntpTime(t time.Time) uint64 {
+	sec := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// ntpToTime converts a 64-bit NTP timestamp into a time.
+func ntpToTime(v uint64) time.Time {
+	sec := int64(v>>32) - ntpEpochOffset
+	nsec := int64((v & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(sec, nsec)
+}
+
+// ntpShort converts a 32-bit NTP short format (16.16 seconds) duration.
+func ntpShort(v uint32) time.Duration {
+	return time.Duration(uint64(v) * uint64(time.Second) >> 16)
+}
+
+// ntpResponse is the outcome of an SNTP exchange (RFC 4330).
+type ntpResponse struct {
+	Stratum        int
+	ReferenceID    [4]byte
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+	// Offset is the offset of the server clock relative to the local
+	// clock: positive when the local clock is behind.
+	Offset time.Duration
+	// Delay is the round-trip delay of the exchange excluding the server's
+	// processing time.
+	Delay time.Duration
+	// TransmitTime is the server's transmit timestamp.
+	TransmitTime time.Time
+}
+
+// Uncertainty bounds the error of Offset relative to the reference clock
+// the server is synchronized to.
+func (r ntpResponse) Uncertainty() time.Duration {
+	return r.Delay/2 + r.RootDelay/2 + r.RootDispersion
+}
+
+// ntpQuery performs an SNTP exchange with the server at address.
+func ntpQuery(meter *trafficMeter, address string, timeout time.Duration) (ntpResponse, error) {
+	var resp ntpResponse
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "123")
+	}
+	conn, err := dialTimeout(meter, "udp", address, timeout)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	req := make([]byte, 48)
+	req[0] = 4<<3 | 3 // version 4, client mode
+	t1 := time.Now()
+	binary.BigEndian.PutUint64(req[40:], ntpTime(t1))
+	if _, err := conn.Write(req); err != nil {
+		return resp, err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return resp, err
+		}
+		// The local receive time, derived from the monotonic clock so a
+		// clock step during the exchange doesn't distort it.
+		t4 := t1.Add(time.Since(t1))
+		if n < 48 || buf[0]&7 != 4 || binary.BigEndian.Uint64(buf[24:]) != binary.BigEndian.Uint64(req[40:]) {
+			continue // not a server reply to our request
+		}
+		if buf[0]>>6 == 3 {
+			return resp, errors.New("ntp: server clock not synchronized")
+		}
+		resp.Stratum = int(buf[1])
+		copy(resp.ReferenceID[:], buf[12:16])
+		if resp.Stratum == 0 {
+			return resp, fmt.Errorf("ntp: kiss of death %q", resp.ReferenceID[:])
+		}
+		resp.RootDelay = ntpShort(binary.BigEndian.Uint32(buf[4:]))
+		resp.RootDispersion = ntpShort(binary.BigEndian.Uint32(buf[8:]))
+		t2 := ntpToTime(binary.BigEndian.Uint64(buf[32:]))
+		t3 := ntpToTime(binary.BigEndian.Uint64(buf[40:]))
+		resp.TransmitTime = t3
+		resp.Offset = (t2.Sub(t1) + t3.Sub(t4)) / 2
+		resp.Delay = t4.Sub(t1) - t3.Sub(t2)
+		if resp.Delay < 0 {
+			resp.Delay = 0
+		}
+		return resp, nil
+	}
+}
+
+const KindNTP = "NTP"
+
+// NTPProberOptions configures an NTPProber.
+type NTPProberOptions struct {
+	// MaxOffset, when set, fails probes whose clock offset exceeds it, in
+	// either direction.
+	MaxOffset time.Duration
+}
+
+// NTPResult is the outcome of an SNTP exchange with a time server.
+type NTPResult struct {
+	Target
+	Error error
+
+	Stratum int
+	// ReferenceID identifies the server's reference clock: a source such
+	// as "GPS" for stratum 1 servers, the address of the upstream server
+	// otherwise.
+	ReferenceID    string
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+	// Delay is the round-trip delay, excluding the server's processing.
+	Delay time.Duration
+	// Offset is the offset of the server's clock relative to the local
+	// one: positive when the local clock is behind. Uncertainty bounds its
+	// error relative to the server's reference clock.
+	Offset      time.Duration
+	Uncertainty time.Duration
+}
+
+func (r NTPResult) RTT() time.Duration {
+	return r.Delay
+}
+
+func (r NTPResult) String() string {
+	if r.Stratum == 0 {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	s := fmt.Sprintf("-> %s stratum %d ref %s delay=%v offset=%v ±%v", r.Target.Address, r.Stratum, r.ReferenceID, r.Delay, r.Offset, r.Uncertainty)
+	if r.Error != nil {
+		s += fmt.Sprintf(": %v", r.Error)
+	}
+	return s
+}
+
+// NTPProber queries the time server in Target.Address, "host" or
+// "host:port" with port 123 by default, with SNTP and reports its clock
+// against the local one. Target.Timeout defaults to five seconds.
+type NTPProber struct {
+	opts NTPProberOptions
+}
+
+func NewNTPProber(opts NTPProberOptions) *NTPProber {
+	return &NTPProber{opts: opts}
+}
+
+func (p *NTPProber) Kind() string {
+	return KindNTP
+}
+
+func (p *NTPProber) Probe(target Target) (Result, error) {
+	r := &NTPResult{Target: target}
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	resp, err := ntpQuery(target.meter, target.Address, timeout)
+	if err != nil {
+		if resp.Stratum == 0 && resp.ReferenceID != [4]byte{} {
+			// The kiss code of a kiss-of-death packet.
+			r.ReferenceID = strings.TrimRight(string(resp.ReferenceID[:]), "\x00")
+		}
+		r.Error = err
+		return r, nil
+	}
+	r.Stratum = resp.Stratum
+	if resp.Stratum == 1 {
+		r.ReferenceID = strings.TrimRight(string(resp.ReferenceID[:]), "\x00")
+	} else {
+		r.ReferenceID = net.IP(resp.ReferenceID[:]).String()
+	}
+	r.RootDelay, r.RootDispersion = resp.RootDelay, resp.RootDispersion
+	r.Delay, r.Offset, r.Uncertainty = resp.Delay, resp.Offset, resp.Uncertainty()
+	if p.opts.MaxOffset > 0 && (r.Offset > p.opts.MaxOffset || r.Offset < -p.opts.MaxOffset) {
+		r.Error = fmt.Errorf("ntp: clock offset %v exceeds %v", r.Offset, p.opts.MaxOffset)
+	}
+	return r, nil
+}
@@ -0,0 +1,29 @@
+package libprobe_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNTPProber(t *testing.T) {
+	target := libprobe.Target{Address: serveNTP(t, 2*time.Second), Timeout: time.Second}
+	r, err := libprobe.NewNTPProber(libprobe.NTPProberOptions{}).Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.NTPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, 2, res.Stratum)
+	require.Equal(t, "0.0.0.0", res.ReferenceID)
+	require.InDelta(t, float64(2*time.Second), float64(res.Offset), float64(50*time.Millisecond))
+	require.GreaterOrEqual(t, res.Uncertainty, time.Millisecond)
+	require.Equal(t, res.Delay, res.RTT())
+
+	r, err = libprobe.NewNTPProber(libprobe.NTPProberOptions{MaxOffset: time.Second}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.NTPResult)
+	require.Error(t, res.Error)
+	require.Equal(t, 2, res.Stratum)
+}
@@ -0,0 +1,426 @@
+package libprobe
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const KindOAuth = "OAUTH"
+
+// oauthMaxBody bounds the bodies read, discovery documents and key sets
+// included.
+const oauthMaxBody = 1 << 20
+
+// oauthClockSkew is tolerated on the validity of tokens.
+const oauthClockSkew = time.Minute
+
+// OAuthProberOptions configures an OAuthProber.
+type OAuthProberOptions struct {
+	// TokenURL and JWKSURL are the token endpoint and key set. Default:
+	// those of the OpenID Connect discovery document of the issuer in
+	// Target.Address, which is then fetched.
+	TokenURL string
+	JWKSURL  string
+	// ClientID and ClientSecret, when set, request a token with the client
+	// credentials grant, authenticated with HTTP Basic. Otherwise no token
+	// is requested.
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// Audience is sent as the audience parameter, which some servers
+	// require, e.g. Auth0.
+	Audience string
+	// RequireJWT fails the probe when the access token isn't a JWT signed
+	// by a key of the key set, rather than an opaque token.
+	RequireJWT bool
+	// TLSConfig configures TLS, e.g. RootCAs to verify the certificates of
+	// an internal identity provider.
+	TLSConfig *tls.Config
+}
+
+// OAuthToken describes a JWT access token.
+type OAuthToken struct {
+	Algorithm string
+	KeyID     string
+	Issuer    string
+	Subject   string
+	ExpiresAt time.Time
+}
+
+// OAuthResult describes the checks of an authorization server.
+type OAuthResult struct {
+	Target
+	Error error
+
+	// Step is the step failing, empty on success.
+	Step          string
+	DiscoveryTime time.Duration
+	JWKSTime      time.Duration
+	TokenTime     time.Duration
+	TotalTime     time.Duration
+	// Issuer is that of the discovery document.
+	Issuer        string
+	TokenEndpoint string
+	// Keys counts the keys of the key set.
+	Keys int
+	// TokenType and ExpiresIn are those of the token response.
+	TokenType string
+	ExpiresIn time.Duration
+	// Token is set when the access token is a JWT, verified.
+	Token *OAuthToken
+}
+
+func (r OAuthResult) RTT() time.Duration {
+	if r.TokenTime > 0 {
+		return r.TokenTime
+	}
+	return r.DiscoveryTime
+}
+
+func (r OAuthResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %s: %v", r.Target.Address, r.Step, r.Error)
+	}
+	return fmt.Sprintf("-> %s Discovery: %s, JWKS: %s (%d keys), Token: %s. Total: %s",
+		r.Target.Address, r.DiscoveryTime, r.JWKSTime, r.Keys, r.TokenTime, r.TotalTime)
+}
+
+// OAuthProber checks the OAuth 2.0 authorization server, or OpenID Connect
+// provider, whose issuer URL is Target.Address: it fetches the discovery
+// document and key set, then requests a token with the client credentials
+// grant. An access token in JWT form is verified against the key set, its
+// expiry and issuer included.
+type OAuthProber struct {
+	opts OAuthProberOptions
+}
+
+func NewOAuthProber(opts OAuthProberOptions) *OAuthProber {
+	return &OAuthProber{opts: opts}
+}
+
+func (p *OAuthProber) Kind() string {
+	return KindOAuth
+}
+
+func (p *OAuthProber) Probe(target Target) (Result, error) {
+	r := &OAuthResult{Target: target}
+	client := &http.Client{Timeout: target.Timeout, Transport: &http.Transport{DialContext: meteredDial(target.meter), TLSClientConfig: p.opts.TLSConfig}}
+	defer client.CloseIdleConnections()
+	startAt := time.Now()
+	r.Step, r.Error = p.run(r, client, strings.TrimSuffix(target.Address, "/"))
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+// run performs the steps, returning the last one started.
+func (p *OAuthProber) run(r *OAuthResult, client *http.Client, issuer string) (string, error) {
+	r.TokenEndpoint = p.opts.TokenURL
+	jwksURL := p.opts.JWKSURL
+	if r.TokenEndpoint == "" || jwksURL == "" {
+		stepAt := time.Now()
+		var discovery struct {
+			Issuer        string `json:"issuer"`
+			TokenEndpoint string `json:"token_endpoint"`
+			JWKSURI       string `json:"jwks_uri"`
+		}
+		if err := oauthGet(client, issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return "discovery", err
+		}
+		r.DiscoveryTime = time.Since(stepAt)
+		r.Issuer = discovery.Issuer
+		// The issuer must be that of the discovery URL (OpenID Connect
+		// Discovery 4.3), lest tokens of another be accepted.
+		if r.Issuer != issuer && r.Issuer != issuer+"/" {
+			return "discovery", fmt.Errorf("oauth: issuer %q instead of %q", r.Issuer, issuer)
+		}
+		if r.TokenEndpoint == "" {
+			r.TokenEndpoint = discovery.TokenEndpoint
+		}
+		if jwksURL == "" {
+			jwksURL = discovery.JWKSURI
+		}
+	}
+
+	var keys map[string]crypto.PublicKey
+	if jwksURL != "" {
+		stepAt := time.Now()
+		var set struct {
+			Keys []oauthJWK `json:"keys"`
+		}
+		if err := oauthGet(client, jwksURL, &set); err != nil {
+			return "jwks", err
+		}
+		r.JWKSTime = time.Since(stepAt)
+		keys = make(map[string]crypto.PublicKey)
+		for _, k := range set.Keys {
+			// Encryption keys and those of unknown types are left out.
+			if pub, err := k.publicKey(); err == nil && k.Use != "enc" {
+				keys[k.KeyID] = pub
+			}
+		}
+		r.Keys = len(keys)
+		if r.Keys == 0 {
+			return "jwks", errors.New("oauth: no signing key in the key set")
+		}
+	}
+
+	if p.opts.ClientID == "" {
+		return "", nil
+	}
+	if r.TokenEndpoint == "" {
+		return "token", errors.New("oauth: no token endpoint")
+	}
+	stepAt := time.Now()
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(p.opts.Scopes) > 0 {
+		form.Set("scope", strings.Join(p.opts.Scopes, " "))
+	}
+	if p.opts.Audience != "" {
+		form.Set("audience", p.opts.Audience)
+	}
+	req, err := http.NewRequest(http.MethodPost, r.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "token", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.opts.ClientID), url.QueryEscape(p.opts.ClientSecret))
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := oauthDo(client, req, &token); err != nil {
+		return "token", err
+	}
+	r.TokenTime = time.Since(stepAt)
+	r.TokenType = token.TokenType
+	r.ExpiresIn = time.Duration(token.ExpiresIn) * time.Second
+	if token.AccessToken == "" {
+		return "token", errors.New("oauth: no access token")
+	}
+	if strings.Count(token.AccessToken, ".") != 2 {
+		if p.opts.RequireJWT {
+			return "token", errors.New("oauth: the access token isn't a JWT")
+		}
+		return "", nil
+	}
+	if keys == nil {
+		return "token", errors.New("oauth: no key set to verify the access token with")
+	}
+	if r.Token, err = oauthVerifyJWT(token.AccessToken, keys, time.Now()); err != nil {
+		return "token", err
+	}
+	if r.Issuer != "" && r.Token.Issuer != r.Issuer {
+		return "token", fmt.Errorf("oauth: token issued by %q instead of %q", r.Token.Issuer, r.Issuer)
+	}
+	return "", nil
+}
+
+func oauthGet(client *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	return oauthDo(client, req, v)
+}
+
+// oauthDo sends req and decodes the JSON response into v. Error responses
+// of the token endpoint (RFC 6749 5.2) are returned with their description.
+func oauthDo(client *http.Client, req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	setDefaultUserAgent(req.Header)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, oauthMaxBody))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &oauthErr) == nil && oauthErr.Error != "" {
+			if oauthErr.Description != "" {
+				return fmt.Errorf("oauth: %s: %s", oauthErr.Error, oauthErr.Description)
+			}
+			return fmt.Errorf("oauth: %s", oauthErr.Error)
+		}
+		return fmt.Errorf("oauth: %s: %s", req.URL, resp.Status)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("oauth: %s: %w", req.URL, err)
+	}
+	return nil
+}
+
+// oauthJWK is a JSON Web Key (RFC 7517) of type RSA or EC.
+type oauthJWK struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func (k oauthJWK) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.KeyType {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("oauth: invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("oauth: unsupported curve %q", k.Curve)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("oauth: invalid EC key")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("oauth: unsupported key type %q", k.KeyType)
+}
+
+// oauthHashes are the hashes of the JWS algorithms verified, by their
+// size.
+var oauthHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// oauthVerifyJWT verifies the signature of token with keys and its validity
+// at now.
+func oauthVerifyJWT(token string, keys map[string]crypto.PublicKey, now time.Time) (*OAuthToken, error) {
+	b64 := base64.RawURLEncoding
+	parts := strings.Split(token, ".")
+	header, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("oauth: malformed JWT header")
+	}
+	var h struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return nil, errors.New("oauth: malformed JWT header")
+	}
+	t := &OAuthToken{Algorithm: h.Algorithm, KeyID: h.KeyID}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("oauth: malformed JWT signature")
+	}
+	key, ok := keys[h.KeyID]
+	if !ok && h.KeyID == "" && len(keys) == 1 {
+		for _, k := range keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("oauth: no key %q in the key set", h.KeyID)
+	}
+	if len(h.Algorithm) != 5 {
+		return nil, fmt.Errorf("oauth: unsupported algorithm %q", h.Algorithm)
+	}
+	hash, ok := oauthHashes[h.Algorithm[2:]]
+	if !ok {
+		return nil, fmt.Errorf("oauth: unsupported algorithm %q", h.Algorithm)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	digest := hasher.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch h.Algorithm[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		case "PS":
+			err = rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			err = fmt.Errorf("oauth: algorithm %q for an RSA key", h.Algorithm)
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		switch {
+		case h.Algorithm[:2] != "ES":
+			err = fmt.Errorf("oauth: algorithm %q for an EC key", h.Algorithm)
+		case len(sig) != 2*size || !ecdsa.Verify(pub, digest, new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])):
+			err = rsa.ErrVerification
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("oauth: invalid JWT signature: %w", err)
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("oauth: malformed JWT claims")
+	}
+	var claims struct {
+		Issuer    string `json:"iss"`
+		Subject   string `json:"sub"`
+		ExpiresAt *int64 `json:"exp"`
+		NotBefore *int64 `json:"nbf"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("oauth: malformed JWT claims")
+	}
+	t.Issuer, t.Subject = claims.Issuer, claims.Subject
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("oauth: the JWT has no expiry")
+	}
+	t.ExpiresAt = time.Unix(*claims.ExpiresAt, 0)
+	if now.After(t.ExpiresAt.Add(oauthClockSkew)) {
+		return nil, fmt.Errorf("oauth: the JWT expired at %s", t.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	if claims.NotBefore != nil && now.Add(oauthClockSkew).Before(time.Unix(*claims.NotBefore, 0)) {
+		return nil, errors.New("oauth: the JWT isn't valid yet")
+	}
+	return t, nil
+}
@@ -0,0 +1,134 @@
+package libprobe_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveOIDC runs an OpenID Connect provider issuing tokens to the clients
+// "ec", "rsa" and "expired", of secret "secret", the latter expired.
+func serveOIDC(t *testing.T) *httptest.Server {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	b64 := base64.RawURLEncoding
+
+	var srv *httptest.Server
+	sign := func(client string) string {
+		alg, kid, exp := "ES256", "ec-1", time.Now().Add(time.Hour)
+		switch client {
+		case "rsa":
+			alg, kid = "RS256", "rsa-1"
+		case "expired":
+			exp = time.Now().Add(-time.Hour)
+		}
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "at+jwt"})
+		claims, _ := json.Marshal(map[string]interface{}{"iss": srv.URL, "sub": client, "exp": exp.Unix()})
+		input := b64.EncodeToString(header) + "." + b64.EncodeToString(claims)
+		digest := sha256.Sum256([]byte(input))
+		var sig []byte
+		if alg == "RS256" {
+			sig, _ = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		} else {
+			r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+		return input + "." + b64.EncodeToString(sig)
+	}
+
+	mux := http.NewServeMux()
+	// The document of the tenant is that of the provider.
+	for _, path := range []string{"/.well-known/openid-configuration", "/tenant/.well-known/openid-configuration"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, `{"issuer": "%[1]s", "token_endpoint": "%[1]s/token", "jwks_uri": "%[1]s/jwks"}`, srv.URL)
+		})
+	}
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "EC", "kid": "ec-1", "use": "sig", "crv": "P-256", "x": b64.EncodeToString(ecKey.X.Bytes()), "y": b64.EncodeToString(ecKey.Y.Bytes())},
+			{"kty": "RSA", "kid": "rsa-1", "n": b64.EncodeToString(rsaKey.N.Bytes()), "e": "AQAB"},
+			{"kty": "RSA", "kid": "rsa-enc", "use": "enc", "n": b64.EncodeToString(rsaKey.N.Bytes()), "e": "AQAB"},
+			{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		client, secret, _ := req.BasicAuth()
+		if req.PostFormValue("grant_type") != "client_credentials" || secret != "secret" || req.PostFormValue("scope") != "probe:read" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": "invalid_client", "error_description": "Client authentication failed"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": %q, "token_type": "Bearer", "expires_in": 3600}`, sign(client))
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOAuthProber(t *testing.T) {
+	srv := serveOIDC(t)
+	target := libprobe.Target{Address: srv.URL, Timeout: 5 * time.Second}
+	for _, tt := range []struct {
+		client, secret, alg, err string
+	}{
+		{"ec", "secret", "ES256", ""},
+		{"rsa", "secret", "RS256", ""},
+		{"expired", "secret", "", "oauth: the JWT expired at "},
+		{"ec", "wrong", "", "oauth: invalid_client: Client authentication failed"},
+	} {
+		p := libprobe.NewOAuthProber(libprobe.OAuthProberOptions{ClientID: tt.client, ClientSecret: tt.secret, Scopes: []string{"probe:read"}})
+		require.Equal(t, libprobe.KindOAuth, p.Kind())
+		r, err := p.Probe(target)
+		require.NoError(t, err)
+		res := r.(*libprobe.OAuthResult)
+		require.Equal(t, srv.URL, res.Issuer)
+		require.Equal(t, 2, res.Keys)
+		if tt.err != "" {
+			require.Equal(t, "token", res.Step)
+			require.ErrorContains(t, res.Error, tt.err)
+			continue
+		}
+		require.NoError(t, res.Error, tt.client)
+		require.Equal(t, "Bearer", res.TokenType)
+		require.Equal(t, time.Hour, res.ExpiresIn)
+		require.Equal(t, tt.alg, res.Token.Algorithm)
+		require.Equal(t, tt.client, res.Token.Subject)
+		require.Positive(t, res.DiscoveryTime)
+		require.Positive(t, res.JWKSTime)
+		require.Equal(t, res.TokenTime, res.RTT())
+	}
+
+	// Without a client, only the discovery document and key set are
+	// fetched.
+	r, err := libprobe.NewOAuthProber(libprobe.OAuthProberOptions{}).Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.OAuthResult)
+	require.NoError(t, res.Error)
+	require.Zero(t, res.TokenTime)
+	require.Equal(t, srv.URL+"/token", res.TokenEndpoint)
+
+	// The discovery document of another issuer is refused.
+	r, err = libprobe.NewOAuthProber(libprobe.OAuthProberOptions{}).Probe(libprobe.Target{Address: srv.URL + "/tenant", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.OAuthResult)
+	require.Equal(t, "discovery", res.Step)
+	require.EqualError(t, res.Error, fmt.Sprintf("oauth: issuer %q instead of %q", srv.URL, srv.URL+"/tenant"))
+}
@@ -0,0 +1,578 @@
+package libprobe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindOPCUA = "OPCUA"
+
+// Binary encoding ids of the OPC UA services used (namespace 0).
+const (
+	opcuaOpenSecureChannelRequest  = 446
+	opcuaOpenSecureChannelResponse = 449
+	opcuaCloseSecureChannelRequest = 452
+	opcuaGetEndpointsRequest       = 428
+	opcuaGetEndpointsResponse      = 431
+)
+
+const opcuaSecurityPolicyNone = "http://opcfoundation.org/UA/SecurityPolicy#None"
+
+var opcuaSecurityModes = map[uint32]string{1: "None", 2: "Sign", 3: "SignAndEncrypt"}
+
+var opcuaUserTokenTypes = map[uint32]string{0: "Anonymous", 1: "UserName", 2: "Certificate", 3: "IssuedToken"}
+
+// OPCUAProberOptions configures an OPCUAProber.
+type OPCUAProberOptions struct {
+	// EndpointURL is sent in the Hello and GetEndpoints messages.
+	// Default: "opc.tcp://" followed by Target.Address.
+	EndpointURL string
+}
+
+// OPCUAEndpoint is an endpoint offered by an OPC UA server.
+type OPCUAEndpoint struct {
+	URL            string
+	SecurityMode   string
+	SecurityPolicy string
+	SecurityLevel  int
+	UserTokenTypes []string
+	ApplicationURI string
+}
+
+type OPCUAResult struct {
+	Target
+	Error error
+
+	ConnectTime      time.Duration
+	HelloTime        time.Duration
+	OpenChannelTime  time.Duration
+	GetEndpointsTime time.Duration
+	TotalTime        time.Duration
+	Endpoints        []OPCUAEndpoint
+}
+
+func (r OPCUAResult) RTT() time.Duration {
+	return r.TotalTime
+}
+
+func (r OPCUAResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("Error: %s", r.Error)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "-> %s Connect: %s, Hello: %s, Open: %s, GetEndpoints: %s. Total: %s\n",
+		r.Target.Address, r.ConnectTime, r.HelloTime, r.OpenChannelTime, r.GetEndpointsTime, r.TotalTime)
+	for _, e := range r.Endpoints {
+		fmt.Fprintf(&b, "%s %s/%s level=%d tokens=%s\n",
+			e.URL, e.SecurityPolicy, e.SecurityMode, e.SecurityLevel, strings.Join(e.UserTokenTypes, ","))
+	}
+	return b.String()
+}
+
+// OPCUAProber performs the Hello/Acknowledge handshake with the OPC UA
+// server in Target.Address (port 4840 by default), opens an unsecured
+// channel and lists the server's endpoints with GetEndpoints, which servers
+// allow without security for discovery.
+type OPCUAProber struct {
+	opts OPCUAProberOptions
+}
+
+func NewOPCUAProber(opts OPCUAProberOptions) *OPCUAProber {
+	return &OPCUAProber{opts: opts}
+}
+
+func (p *OPCUAProber) Kind() string {
+	return KindOPCUA
+}
+
+// opcuaWriter encodes OPC UA built-in types.
+type opcuaWriter struct {
+	bytes.Buffer
+}
+
+func (w *opcuaWriter) u8(v byte) {
+	w.WriteByte(v)
+}
+
+func (w *opcuaWriter) u16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *opcuaWriter) u32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *opcuaWriter) i64(v int64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	w.Write(b[:])
+}
+
+// str encodes a String or ByteString, nil as a null one.
+func (w *opcuaWriter) str(s []byte) {
+	if s == nil {
+		w.u32(0xffffffff)
+		return
+	}
+	w.u32(uint32(len(s)))
+	w.Write(s)
+}
+
+// nodeID encodes a numeric node id of namespace 0 in the four-byte form.
+func (w *opcuaWriter) nodeID(id uint16) {
+	w.u8(0x01)
+	w.u8(0)
+	w.u16(id)
+}
+
+// requestHeader encodes an anonymous RequestHeader.
+func (w *opcuaWriter) requestHeader(handle uint32, timeout time.Duration) {
+	w.u8(0x00) // null authentication token
+	w.u8(0x00)
+	w.i64(opcuaDateTime(time.Now()))
+	w.u32(handle)
+	w.u32(0) // no diagnostics
+	w.str(nil)
+	w.u32(uint32(timeout / time.Millisecond))
+	w.u8(0x00) // no additional header
+	w.u8(0x00)
+	w.u8(0x00)
+}
+
+// opcuaDateTime returns t in 100ns intervals since 1601-01-01.
+func opcuaDateTime(t time.Time) int64 {
+	return t.UnixNano()/100 + 116444736000000000
+}
+
+// opcuaReader decodes OPC UA built-in types. The first error sticks and
+// makes every later read return zero values.
+type opcuaReader struct {
+	b   []byte
+	err error
+}
+
+var errOPCUATruncated = errors.New("opcua: truncated message")
+
+func (r *opcuaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errOPCUATruncated
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *opcuaReader) u8() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *opcuaReader) u16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *opcuaReader) u32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *opcuaReader) str() string {
+	n := int32(r.u32())
+	if n <= 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+// array returns the length of an array, 0 for a null one.
+func (r *opcuaReader) array() int {
+	n := int32(r.u32())
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(r.b) {
+		r.err = errOPCUATruncated
+		return 0
+	}
+	return int(n)
+}
+
+// nodeID decodes a (possibly expanded) node id, returning its numeric
+// identifier or 0.
+func (r *opcuaReader) nodeID() uint32 {
+	enc := r.u8()
+	var id uint32
+	switch enc & 0x0f {
+	case 0:
+		id = uint32(r.u8())
+	case 1:
+		r.u8()
+		id = uint32(r.u16())
+	case 2:
+		r.u16()
+		id = r.u32()
+	case 3, 5:
+		r.u16()
+		r.str()
+	case 4:
+		r.u16()
+		r.next(16)
+	default:
+		r.err = errors.New("opcua: bad node id")
+	}
+	if enc&0x80 != 0 {
+		r.str()
+	}
+	if enc&0x40 != 0 {
+		r.u32()
+	}
+	return id
+}
+
+func (r *opcuaReader) extensionObject() {
+	r.nodeID()
+	if enc := r.u8(); enc == 1 || enc == 2 {
+		r.str()
+	}
+}
+
+func (r *opcuaReader) diagnosticInfo() {
+	mask := r.u8()
+	for bit := byte(0x01); bit <= 0x08; bit <<= 1 {
+		if mask&bit != 0 {
+			r.u32()
+		}
+	}
+	if mask&0x10 != 0 {
+		r.str()
+	}
+	if mask&0x20 != 0 {
+		r.u32()
+	}
+	if mask&0x40 != 0 && r.err == nil {
+		r.diagnosticInfo()
+	}
+}
+
+func (r *opcuaReader) localizedText() string {
+	mask := r.u8()
+	if mask&0x01 != 0 {
+		r.str()
+	}
+	if mask&0x02 != 0 {
+		return r.str()
+	}
+	return ""
+}
+
+// responseHeader decodes a ResponseHeader and returns its service result
+// as an error when bad.
+func (r *opcuaReader) responseHeader() error {
+	r.next(8) // timestamp
+	r.u32()   // request handle
+	status := r.u32()
+	r.diagnosticInfo()
+	for n := r.array(); n > 0 && r.err == nil; n-- {
+		r.str()
+	}
+	r.extensionObject()
+	if r.err != nil {
+		return r.err
+	}
+	if status&0x80000000 != 0 {
+		return fmt.Errorf("opcua: service result 0x%08x", status)
+	}
+	return nil
+}
+
+// opcuaConn exchanges messages of the OPC UA TCP binary protocol.
+type opcuaConn struct {
+	conn      net.Conn
+	channelID uint32
+	tokenID   uint32
+	seq       uint32
+	requestID uint32
+}
+
+func (c *opcuaConn) write(typ string, body []byte) error {
+	msg := make([]byte, 8, 8+len(body))
+	copy(msg, typ+"F")
+	binary.LittleEndian.PutUint32(msg[4:], uint32(8+len(body)))
+	_, err := c.conn.Write(append(msg, body...))
+	return err
+}
+
+// read reads a final message, concatenating the bodies of intermediate
+// chunks after their security and sequence headers, which are skip bytes
+// long.
+func (c *opcuaConn) read(skip func(body []byte) int) (string, []byte, error) {
+	var out []byte
+	for {
+		var head [8]byte
+		if _, err := io.ReadFull(c.conn, head[:]); err != nil {
+			return "", nil, err
+		}
+		size := binary.LittleEndian.Uint32(head[4:])
+		if size < 8 || size > berMaxLength {
+			return "", nil, errors.New("opcua: bad message size")
+		}
+		body := make([]byte, size-8)
+		if _, err := io.ReadFull(c.conn, body); err != nil {
+			return "", nil, err
+		}
+		typ := string(head[:3])
+		if typ == "ERR" {
+			r := &opcuaReader{b: body}
+			status := r.u32()
+			return "", nil, fmt.Errorf("opcua: error 0x%08x: %s", status, r.str())
+		}
+		if skip == nil {
+			return typ, body, nil
+		}
+		n := skip(body)
+		if n > len(body) {
+			return "", nil, errOPCUATruncated
+		}
+		switch head[3] {
+		case 'A':
+			return "", nil, errors.New("opcua: message aborted")
+		case 'C':
+			out = append(out, body[n:]...)
+		default:
+			return typ, append(out, body[n:]...), nil
+		}
+	}
+}
+
+func (c *opcuaConn) hello(endpointURL string) error {
+	var w opcuaWriter
+	w.u32(0)       // protocol version
+	w.u32(1 << 16) // receive buffer size
+	w.u32(1 << 16) // send buffer size
+	w.u32(0)       // max message size
+	w.u32(0)       // max chunk count
+	w.str([]byte(endpointURL))
+	if err := c.write("HEL", w.Bytes()); err != nil {
+		return err
+	}
+	typ, _, err := c.read(nil)
+	if err != nil {
+		return err
+	}
+	if typ != "ACK" {
+		return fmt.Errorf("opcua: unexpected %s message", typ)
+	}
+	return nil
+}
+
+func (c *opcuaConn) sequenceHeader(w *opcuaWriter) {
+	c.seq++
+	c.requestID++
+	w.u32(c.seq)
+	w.u32(c.requestID)
+}
+
+// skipAsymmetric returns the length of the headers of an OPN chunk.
+func skipAsymmetric(body []byte) int {
+	r := &opcuaReader{b: body}
+	r.u32() // secure channel id
+	r.str() // security policy
+	r.str() // sender certificate
+	r.str() // receiver thumbprint
+	r.next(8)
+	if r.err != nil {
+		return len(body) + 1
+	}
+	return len(body) - len(r.b)
+}
+
+// skipSymmetric returns the length of the headers of a MSG chunk.
+func skipSymmetric([]byte) int {
+	return 16
+}
+
+func (c *opcuaConn) openSecureChannel(timeout time.Duration) error {
+	var w opcuaWriter
+	w.u32(0)
+	w.str([]byte(opcuaSecurityPolicyNone))
+	w.str(nil)
+	w.str(nil)
+	c.sequenceHeader(&w)
+	w.nodeID(opcuaOpenSecureChannelRequest)
+	w.requestHeader(c.requestID, timeout)
+	w.u32(0)        // client protocol version
+	w.u32(0)        // issue
+	w.u32(1)        // security mode None
+	w.str([]byte{}) // client nonce
+	w.u32(uint32(time.Hour / time.Millisecond))
+	if err := c.write("OPN", w.Bytes()); err != nil {
+		return err
+	}
+	typ, body, err := c.read(skipAsymmetric)
+	if err != nil {
+		return err
+	}
+	if typ != "OPN" {
+		return fmt.Errorf("opcua: unexpected %s message", typ)
+	}
+	r := &opcuaReader{b: body}
+	id := r.nodeID()
+	if err := r.responseHeader(); err != nil {
+		return err
+	}
+	if id != opcuaOpenSecureChannelResponse {
+		return fmt.Errorf("opcua: unexpected response %d", id)
+	}
+	r.u32() // server protocol version
+	c.channelID = r.u32()
+	c.tokenID = r.u32()
+	return r.err
+}
+
+func (c *opcuaConn) getEndpoints(endpointURL string, timeout time.Duration) ([]OPCUAEndpoint, error) {
+	var w opcuaWriter
+	w.u32(c.channelID)
+	w.u32(c.tokenID)
+	c.sequenceHeader(&w)
+	w.nodeID(opcuaGetEndpointsRequest)
+	w.requestHeader(c.requestID, timeout)
+	w.str([]byte(endpointURL))
+	w.u32(0) // locale ids
+	w.u32(0) // profile uris
+	if err := c.write("MSG", w.Bytes()); err != nil {
+		return nil, err
+	}
+	typ, body, err := c.read(skipSymmetric)
+	if err != nil {
+		return nil, err
+	}
+	if typ != "MSG" {
+		return nil, fmt.Errorf("opcua: unexpected %s message", typ)
+	}
+	r := &opcuaReader{b: body}
+	id := r.nodeID()
+	if err := r.responseHeader(); err != nil {
+		return nil, err
+	}
+	if id != opcuaGetEndpointsResponse {
+		return nil, fmt.Errorf("opcua: unexpected response %d", id)
+	}
+	endpoints := make([]OPCUAEndpoint, r.array())
+	for i := range endpoints {
+		e := &endpoints[i]
+		e.URL = r.str()
+		e.ApplicationURI = r.str()
+		r.str() // product uri
+		r.localizedText()
+		r.u32() // application type
+		r.str() // gateway server uri
+		r.str() // discovery profile uri
+		for n := r.array(); n > 0 && r.err == nil; n-- {
+			r.str()
+		}
+		r.str() // server certificate
+		mode := r.u32()
+		e.SecurityMode = opcuaSecurityModes[mode]
+		if e.SecurityMode == "" {
+			e.SecurityMode = fmt.Sprint(mode)
+		}
+		policy := r.str()
+		e.SecurityPolicy = policy[strings.LastIndexByte(policy, '#')+1:]
+		for n := r.array(); n > 0 && r.err == nil; n-- {
+			r.str() // policy id
+			tokenType := r.u32()
+			name, ok := opcuaUserTokenTypes[tokenType]
+			if !ok {
+				name = fmt.Sprint(tokenType)
+			}
+			e.UserTokenTypes = append(e.UserTokenTypes, name)
+			r.str() // issued token type
+			r.str() // issuer endpoint url
+			r.str() // security policy uri
+		}
+		r.str() // transport profile uri
+		e.SecurityLevel = int(r.u8())
+	}
+	return endpoints, r.err
+}
+
+func (c *opcuaConn) closeSecureChannel() error {
+	var w opcuaWriter
+	w.u32(c.channelID)
+	w.u32(c.tokenID)
+	c.sequenceHeader(&w)
+	w.nodeID(opcuaCloseSecureChannelRequest)
+	w.requestHeader(c.requestID, 0)
+	return c.write("CLO", w.Bytes())
+}
+
+func (p *OPCUAProber) Probe(target Target) (Result, error) {
+	r := &OPCUAResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "4840")
+	}
+	endpointURL := p.opts.EndpointURL
+	if endpointURL == "" {
+		endpointURL = "opc.tcp://" + address
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	r.ConnectTime = time.Since(startAt)
+	if target.Timeout > 0 {
+		if err := conn.SetDeadline(startAt.Add(target.Timeout)); err != nil {
+			return nil, err
+		}
+	}
+	c := &opcuaConn{conn: conn}
+
+	at := time.Now()
+	if err := c.hello(endpointURL); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.HelloTime = time.Since(at)
+
+	at = time.Now()
+	if err := c.openSecureChannel(target.Timeout); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.OpenChannelTime = time.Since(at)
+
+	at = time.Now()
+	if r.Endpoints, err = c.getEndpoints(endpointURL, target.Timeout); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.GetEndpointsTime = time.Since(at)
+	r.TotalTime = time.Since(startAt)
+	_ = c.closeSecureChannel()
+	return r, nil
+}
@@ -0,0 +1,131 @@
+package libprobe_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// uaBuf encodes OPC UA built-in types for the fake server.
+type uaBuf struct {
+	bytes.Buffer
+}
+
+func (b *uaBuf) u32(v uint32) *uaBuf {
+	binary.Write(b, binary.LittleEndian, v)
+	return b
+}
+
+func (b *uaBuf) str(s string) *uaBuf {
+	b.u32(uint32(len(s)))
+	b.WriteString(s)
+	return b
+}
+
+func (b *uaBuf) responseHeader(typeID uint16) *uaBuf {
+	b.Write([]byte{0x01, 0})
+	binary.Write(b, binary.LittleEndian, typeID)
+	b.Write(make([]byte, 8)) // timestamp
+	b.u32(1)                 // request handle
+	b.u32(0)                 // good
+	b.WriteByte(0)           // no diagnostics
+	b.u32(0xffffffff)        // no string table
+	b.Write([]byte{0, 0, 0}) // no additional header
+	return b
+}
+
+func (b *uaBuf) endpoint(url string, mode uint32, policy string, level byte, tokens ...uint32) {
+	b.str(url)
+	b.str("urn:fake").str("urn:fake:product")
+	b.WriteByte(0x02)
+	b.str("Fake server")
+	b.u32(0)                          // server
+	b.u32(0xffffffff).u32(0xffffffff) // gateway, discovery profile
+	b.u32(1).str(url)                 // discovery urls
+	b.u32(0xffffffff)                 // no certificate
+	b.u32(mode).str(policy).u32(uint32(len(tokens)))
+	for _, t := range tokens {
+		b.str("policy").u32(t).u32(0xffffffff).u32(0xffffffff).u32(0xffffffff)
+	}
+	b.str("http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary")
+	b.WriteByte(level)
+}
+
+func serveOPCUA(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	send := func(conn net.Conn, typ string, body []byte) {
+		head := make([]byte, 8)
+		copy(head, typ+"F")
+		binary.LittleEndian.PutUint32(head[4:], uint32(8+len(body)))
+		conn.Write(append(head, body...))
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					head := make([]byte, 8)
+					if _, err := io.ReadFull(conn, head); err != nil {
+						return
+					}
+					body := make([]byte, binary.LittleEndian.Uint32(head[4:])-8)
+					if _, err := io.ReadFull(conn, body); err != nil {
+						return
+					}
+					var b uaBuf
+					switch string(head[:3]) {
+					case "HEL":
+						b.u32(0).u32(1 << 16).u32(1 << 16).u32(0).u32(0)
+						send(conn, "ACK", b.Bytes())
+					case "OPN":
+						b.u32(5).str("http://opcfoundation.org/UA/SecurityPolicy#None").u32(0xffffffff).u32(0xffffffff)
+						b.u32(1).u32(1)
+						b.responseHeader(449)
+						b.u32(0).u32(5).u32(9) // version, channel, token
+						b.Write(make([]byte, 8))
+						b.u32(3600000).u32(0)
+						send(conn, "OPN", b.Bytes())
+					case "MSG":
+						if binary.LittleEndian.Uint32(body) != 5 || binary.LittleEndian.Uint32(body[4:]) != 9 {
+							return
+						}
+						b.u32(5).u32(9).u32(2).u32(2)
+						b.responseHeader(431)
+						b.u32(2)
+						b.endpoint("opc.tcp://plc:4840", 1, "http://opcfoundation.org/UA/SecurityPolicy#None", 0, 0)
+						b.endpoint("opc.tcp://plc:4840", 3, "http://opcfoundation.org/UA/SecurityPolicy#Basic256Sha256", 100, 1, 2)
+						send(conn, "MSG", b.Bytes())
+					default:
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestOPCUAProber(t *testing.T) {
+	prober := libprobe.NewOPCUAProber(libprobe.OPCUAProberOptions{})
+	r, err := prober.Probe(libprobe.Target{Address: serveOPCUA(t), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.OPCUAResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, []libprobe.OPCUAEndpoint{
+		{URL: "opc.tcp://plc:4840", SecurityMode: "None", SecurityPolicy: "None", UserTokenTypes: []string{"Anonymous"}, ApplicationURI: "urn:fake"},
+		{URL: "opc.tcp://plc:4840", SecurityMode: "SignAndEncrypt", SecurityPolicy: "Basic256Sha256", SecurityLevel: 100, UserTokenTypes: []string{"UserName", "Certificate"}, ApplicationURI: "urn:fake"},
+	}, res.Endpoints)
+}
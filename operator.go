@@ -0,0 +1,49 @@
+package libprobe
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var operator struct {
+	mu      sync.RWMutex
+	contact string
+}
+
+// SetOperatorContact sets the contact of the operator running the probes,
+// such as "https://example.com/probing" or "mailto:noc@example.com", for all
+// probers of the process. Following measurement community practice, it is
+// embedded in ICMP echo payloads and in the default User-Agent of HTTP-based
+// probes, so recipients of unexpected traffic can identify its source and
+// reach the operator. An empty contact, the default, disables it.
+func SetOperatorContact(contact string) {
+	contact = strings.Join(strings.Fields(contact), " ")
+	operator.mu.Lock()
+	operator.contact = contact
+	operator.mu.Unlock()
+}
+
+// OperatorContact returns the contact set with SetOperatorContact.
+func OperatorContact() string {
+	operator.mu.RLock()
+	defer operator.mu.RUnlock()
+	return operator.contact
+}
+
+// UserAgent returns the User-Agent sent by probes: "libprobe", followed by
+// the operator contact as a comment, as in "libprobe (+https://example.com)".
+func UserAgent() string {
+	if contact := OperatorContact(); contact != "" {
+		return "libprobe (+" + contact + ")"
+	}
+	return "libprobe"
+}
+
+// setDefaultUserAgent sets the User-Agent of h when an operator contact is
+// set and h has none.
+func setDefaultUserAgent(h http.Header) {
+	if _, ok := h["User-Agent"]; !ok && OperatorContact() != "" {
+		h.Set("User-Agent", UserAgent())
+	}
+}
@@ -0,0 +1,64 @@
+package libprobe_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperatorContactHTTP(t *testing.T) {
+	agents := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.UserAgent()
+	}))
+	defer server.Close()
+	libprobe.SetOperatorContact("https://example.com/probing")
+	defer libprobe.SetOperatorContact("")
+
+	_, err := libprobe.NewHTTPProber().Probe(libprobe.Target{Address: server.URL, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.Equal(t, "libprobe (+https://example.com/probing)", <-agents)
+
+	target := libprobe.Target{Address: server.URL, Timeout: 5 * time.Second, Headers: http.Header{"User-Agent": {"custom"}}}
+	_, err = libprobe.NewHTTPProber().Probe(target)
+	require.NoError(t, err)
+	require.Equal(t, "custom", <-agents)
+
+	libprobe.SetOperatorContact("")
+	require.Equal(t, "libprobe", libprobe.UserAgent())
+	_, err = libprobe.NewHTTPProber().Probe(libprobe.Target{Address: server.URL, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.Equal(t, "Go-http-client/1.1", <-agents)
+}
+
+func TestOperatorContactICMP(t *testing.T) {
+	sniffer, err := net.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("ICMP unavailable: %v", err)
+	}
+	defer sniffer.Close()
+	libprobe.SetOperatorContact("mailto:noc@example.com")
+	defer libprobe.SetOperatorContact("")
+
+	prober := libprobe.NewICMPProberWithOptions(libprobe.ICMPProberOptions{
+		Privileged: true,
+		Size:       80,
+		Payload:    libprobe.ICMPPayload{Tag: "agent-7"},
+	})
+	_, err = prober.Probe(libprobe.Target{Address: "127.0.0.1", Timeout: time.Second, ProbeID: "p1"})
+	require.NoError(t, err)
+
+	require.NoError(t, sniffer.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 1500)
+	n, _, err := sniffer.ReadFrom(buf)
+	require.NoError(t, err)
+	payload := buf[8+16 : n]
+	want := "agent-7 mailto:noc@example.com probe-id=p1"
+	require.Equal(t, want, string(payload[:len(want)]))
+}
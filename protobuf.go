@@ -0,0 +1,769 @@
+package libprobe
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Protobuf wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// Protobuf field types and labels of FieldDescriptorProto.
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+
+	protoLabelRepeated = 3
+)
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// protoField is a field of an encoded protobuf message. Varint and fixed
+// values are in Value, length-delimited ones in Bytes.
+type protoField struct {
+	Num   int
+	Wire  int
+	Value uint64
+	Bytes []byte
+}
+
+func protoAppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func protoAppendTag(b []byte, num, wire int) []byte {
+	return protoAppendVarint(b, uint64(num)<<3|uint64(wire))
+}
+
+func protoAppendBytes(b []byte, num int, v []byte) []byte {
+	b = protoAppendTag(b, num, protoBytes)
+	b = protoAppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func protoAppendString(b []byte, num int, v string) []byte {
+	return protoAppendBytes(b, num, []byte(v))
+}
+
+func protoConsumeVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// protoParse splits an encoded message into its fields.
+func protoParse(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := protoConsumeVarint(b)
+		if n == 0 {
+			return nil, errProtoTruncated
+		}
+		b = b[n:]
+		f := protoField{Num: int(tag >> 3), Wire: int(tag & 7)}
+		if f.Num <= 0 {
+			return nil, errors.New("protobuf: invalid field number")
+		}
+		switch f.Wire {
+		case protoVarint:
+			if f.Value, n = protoConsumeVarint(b); n == 0 {
+				return nil, errProtoTruncated
+			}
+		case protoFixed64:
+			if n = 8; len(b) < n {
+				return nil, errProtoTruncated
+			}
+			f.Value = binary.LittleEndian.Uint64(b)
+		case protoFixed32:
+			if n = 4; len(b) < n {
+				return nil, errProtoTruncated
+			}
+			f.Value = uint64(binary.LittleEndian.Uint32(b))
+		case protoBytes:
+			size, m := protoConsumeVarint(b)
+			if m == 0 || uint64(len(b)-m) < size {
+				return nil, errProtoTruncated
+			}
+			f.Bytes, n = b[m:m+int(size)], m+int(size)
+		default:
+			return nil, fmt.Errorf("protobuf: unsupported wire type %d", f.Wire)
+		}
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// protoMessageDesc describes a message type, from a DescriptorProto.
+type protoMessageDesc struct {
+	Name     string
+	Fields   []*protoFieldDesc
+	MapEntry bool
+}
+
+func (m *protoMessageDesc) field(num int) *protoFieldDesc {
+	for _, f := range m.Fields {
+		if f.Number == num {
+			return f
+		}
+	}
+	return nil
+}
+
+// protoFieldDesc describes a field, from a FieldDescriptorProto. TypeName is
+// fully qualified, without the leading dot.
+type protoFieldDesc struct {
+	Name     string
+	JSONName string
+	Number   int
+	Label    int
+	Type     int
+	TypeName string
+}
+
+type protoEnumDesc struct {
+	Name    string
+	Names   map[int32]string
+	Numbers map[string]int32
+}
+
+type protoMethodDesc struct {
+	Name            string
+	Input           string
+	Output          string
+	ClientStreaming bool
+	ServerStreaming bool
+}
+
+// protoRegistry holds the types of a set of FileDescriptorProtos, enough to
+// convert messages from and to their JSON mapping.
+type protoRegistry struct {
+	files    map[string]bool
+	deps     []string
+	messages map[string]*protoMessageDesc
+	enums    map[string]*protoEnumDesc
+	services map[string][]protoMethodDesc
+}
+
+func newProtoRegistry() *protoRegistry {
+	return &protoRegistry{
+		files:    make(map[string]bool),
+		messages: make(map[string]*protoMessageDesc),
+		enums:    make(map[string]*protoEnumDesc),
+		services: make(map[string][]protoMethodDesc),
+	}
+}
+
+// missingDeps returns the dependencies of the files added that weren't.
+func (reg *protoRegistry) missingDeps() []string {
+	var missing []string
+	for _, dep := range reg.deps {
+		if !reg.files[dep] {
+			missing = append(missing, dep)
+		}
+	}
+	return missing
+}
+
+func protoJoin(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// addFile adds the types of an encoded FileDescriptorProto.
+func (reg *protoRegistry) addFile(b []byte) error {
+	fields, err := protoParse(b)
+	if err != nil {
+		return err
+	}
+	var name, pkg string
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			name = string(f.Bytes)
+		case 2:
+			pkg = string(f.Bytes)
+		}
+	}
+	if reg.files[name] {
+		return nil
+	}
+	reg.files[name] = true
+	for _, f := range fields {
+		switch f.Num {
+		case 3:
+			reg.deps = append(reg.deps, string(f.Bytes))
+		case 4:
+			err = reg.addMessage(pkg, f.Bytes)
+		case 5:
+			err = reg.addEnum(pkg, f.Bytes)
+		case 6:
+			err = reg.addService(pkg, f.Bytes)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (reg *protoRegistry) addMessage(scope string, b []byte) error {
+	fields, err := protoParse(b)
+	if err != nil {
+		return err
+	}
+	m := &protoMessageDesc{}
+	for _, f := range fields {
+		if f.Num == 1 {
+			m.Name = protoJoin(scope, string(f.Bytes))
+		}
+	}
+	for _, f := range fields {
+		switch f.Num {
+		case 2:
+			fd, err := parseProtoField(f.Bytes)
+			if err != nil {
+				return err
+			}
+			m.Fields = append(m.Fields, fd)
+		case 3:
+			err = reg.addMessage(m.Name, f.Bytes)
+		case 4:
+			err = reg.addEnum(m.Name, f.Bytes)
+		case 7:
+			// MessageOptions.map_entry
+			var options []protoField
+			if options, err = protoParse(f.Bytes); err == nil {
+				for _, o := range options {
+					if o.Num == 7 && o.Wire == protoVarint {
+						m.MapEntry = o.Value != 0
+					}
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	reg.messages[m.Name] = m
+	return nil
+}
+
+func parseProtoField(b []byte) (*protoFieldDesc, error) {
+	fields, err := protoParse(b)
+	if err != nil {
+		return nil, err
+	}
+	fd := &protoFieldDesc{}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			fd.Name = string(f.Bytes)
+		case 3:
+			fd.Number = int(f.Value)
+		case 4:
+			fd.Label = int(f.Value)
+		case 5:
+			fd.Type = int(f.Value)
+		case 6:
+			fd.TypeName = strings.TrimPrefix(string(f.Bytes), ".")
+		case 10:
+			fd.JSONName = string(f.Bytes)
+		}
+	}
+	if fd.JSONName == "" {
+		fd.JSONName = protoJSONName(fd.Name)
+	}
+	return fd, nil
+}
+
+// protoJSONName returns the lowerCamelCase JSON name of a field.
+func protoJSONName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, c := range name {
+		switch {
+		case c == '_':
+			upper = true
+		case upper && 'a' <= c && c <= 'z':
+			b.WriteRune(c - 'a' + 'A')
+			upper = false
+		default:
+			b.WriteRune(c)
+			upper = false
+		}
+	}
+	return b.String()
+}
+
+func (reg *protoRegistry) addEnum(scope string, b []byte) error {
+	fields, err := protoParse(b)
+	if err != nil {
+		return err
+	}
+	e := &protoEnumDesc{Names: make(map[int32]string), Numbers: make(map[string]int32)}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			e.Name = protoJoin(scope, string(f.Bytes))
+		case 2:
+			values, err := protoParse(f.Bytes)
+			if err != nil {
+				return err
+			}
+			var name string
+			var number int32
+			for _, v := range values {
+				switch v.Num {
+				case 1:
+					name = string(v.Bytes)
+				case 2:
+					number = int32(v.Value)
+				}
+			}
+			if _, ok := e.Names[number]; !ok {
+				e.Names[number] = name
+			}
+			e.Numbers[name] = number
+		}
+	}
+	reg.enums[e.Name] = e
+	return nil
+}
+
+func (reg *protoRegistry) addService(scope string, b []byte) error {
+	fields, err := protoParse(b)
+	if err != nil {
+		return err
+	}
+	var name string
+	var methods []protoMethodDesc
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			name = protoJoin(scope, string(f.Bytes))
+		case 2:
+			mfields, err := protoParse(f.Bytes)
+			if err != nil {
+				return err
+			}
+			var m protoMethodDesc
+			for _, mf := range mfields {
+				switch mf.Num {
+				case 1:
+					m.Name = string(mf.Bytes)
+				case 2:
+					m.Input = strings.TrimPrefix(string(mf.Bytes), ".")
+				case 3:
+					m.Output = strings.TrimPrefix(string(mf.Bytes), ".")
+				case 5:
+					m.ClientStreaming = mf.Value != 0
+				case 6:
+					m.ServerStreaming = mf.Value != 0
+				}
+			}
+			methods = append(methods, m)
+		}
+	}
+	reg.services[name] = methods
+	return nil
+}
+
+func (reg *protoRegistry) message(name string) (*protoMessageDesc, error) {
+	m, ok := reg.messages[name]
+	if !ok {
+		return nil, fmt.Errorf("protobuf: unknown message type %s", name)
+	}
+	return m, nil
+}
+
+// encodeJSON encodes the JSON mapping of a message of type name.
+func (reg *protoRegistry) encodeJSON(name string, data []byte) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("protobuf: JSON message isn't an object")
+	}
+	return reg.encodeMessage(name, obj)
+}
+
+func (reg *protoRegistry) encodeMessage(name string, obj map[string]interface{}) ([]byte, error) {
+	m, err := reg.message(name)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	for _, fd := range m.Fields {
+		v, ok := obj[fd.JSONName]
+		if !ok {
+			v, ok = obj[fd.Name]
+		}
+		if !ok || v == nil {
+			continue
+		}
+		if fd.Label != protoLabelRepeated {
+			if b, err = reg.encodeValue(b, fd, v); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if entry, ok := reg.messages[fd.TypeName]; ok && entry.MapEntry && fd.Type == protoTypeMessage {
+			entries, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("protobuf: %s isn't an object", fd.JSONName)
+			}
+			key, value := entry.field(1), entry.field(2)
+			if key == nil || value == nil {
+				return nil, fmt.Errorf("protobuf: malformed map entry %s", entry.Name)
+			}
+			for k, ev := range entries {
+				var eb []byte
+				var kv interface{} = k
+				if key.Type != protoTypeString {
+					kv = json.Number(k)
+				}
+				if eb, err = reg.encodeValue(eb, key, kv); err != nil {
+					return nil, err
+				}
+				if eb, err = reg.encodeValue(eb, value, ev); err != nil {
+					return nil, err
+				}
+				b = protoAppendBytes(b, fd.Number, eb)
+			}
+			continue
+		}
+		values, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("protobuf: %s isn't an array", fd.JSONName)
+		}
+		for _, v := range values {
+			if b, err = reg.encodeValue(b, fd, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+// jsonNumber returns the text of a JSON number, or of a string holding one.
+func jsonNumber(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		return string(v), true
+	case string:
+		return v, true
+	}
+	return "", false
+}
+
+func (reg *protoRegistry) encodeValue(b []byte, fd *protoFieldDesc, v interface{}) ([]byte, error) {
+	bad := func() ([]byte, error) {
+		return nil, fmt.Errorf("protobuf: invalid value %v for %s", v, fd.JSONName)
+	}
+	switch fd.Type {
+	case protoTypeString:
+		s, ok := v.(string)
+		if !ok {
+			return bad()
+		}
+		return protoAppendString(b, fd.Number, s), nil
+	case protoTypeBytes:
+		s, ok := v.(string)
+		if !ok {
+			return bad()
+		}
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			if data, err = base64.URLEncoding.DecodeString(s); err != nil {
+				return bad()
+			}
+		}
+		return protoAppendBytes(b, fd.Number, data), nil
+	case protoTypeBool:
+		t, ok := v.(bool)
+		if !ok {
+			return bad()
+		}
+		var x uint64
+		if t {
+			x = 1
+		}
+		return protoAppendVarint(protoAppendTag(b, fd.Number, protoVarint), x), nil
+	case protoTypeMessage:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return bad()
+		}
+		data, err := reg.encodeMessage(fd.TypeName, obj)
+		if err != nil {
+			return nil, err
+		}
+		return protoAppendBytes(b, fd.Number, data), nil
+	case protoTypeEnum:
+		if s, ok := v.(string); ok {
+			if e, ok := reg.enums[fd.TypeName]; ok {
+				if n, ok := e.Numbers[s]; ok {
+					return protoAppendVarint(protoAppendTag(b, fd.Number, protoVarint), uint64(int64(n))), nil
+				}
+			}
+		}
+		s, ok := jsonNumber(v)
+		n, err := strconv.ParseInt(s, 10, 32)
+		if !ok || err != nil {
+			return bad()
+		}
+		return protoAppendVarint(protoAppendTag(b, fd.Number, protoVarint), uint64(n)), nil
+	case protoTypeDouble, protoTypeFloat:
+		s, ok := jsonNumber(v)
+		if !ok {
+			return bad()
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		switch s {
+		case "NaN":
+			f, err = math.NaN(), nil
+		case "Infinity":
+			f, err = math.Inf(1), nil
+		case "-Infinity":
+			f, err = math.Inf(-1), nil
+		}
+		if err != nil {
+			return bad()
+		}
+		if fd.Type == protoTypeFloat {
+			var x [4]byte
+			binary.LittleEndian.PutUint32(x[:], math.Float32bits(float32(f)))
+			return append(protoAppendTag(b, fd.Number, protoFixed32), x[:]...), nil
+		}
+		b = protoAppendTag(b, fd.Number, protoFixed64)
+		var x [8]byte
+		binary.LittleEndian.PutUint64(x[:], math.Float64bits(f))
+		return append(b, x[:]...), nil
+	}
+
+	// Integers.
+	s, ok := jsonNumber(v)
+	if !ok {
+		return bad()
+	}
+	bits, signed := 64, true
+	switch fd.Type {
+	case protoTypeInt32, protoTypeSint32, protoTypeSfixed32:
+		bits = 32
+	case protoTypeUint32, protoTypeFixed32:
+		bits, signed = 32, false
+	case protoTypeUint64, protoTypeFixed64:
+		signed = false
+	case protoTypeInt64, protoTypeSint64, protoTypeSfixed64:
+	default:
+		return nil, fmt.Errorf("protobuf: unsupported type %d of %s", fd.Type, fd.JSONName)
+	}
+	var u uint64
+	var i int64
+	var err error
+	if signed {
+		i, err = strconv.ParseInt(s, 10, bits)
+		u = uint64(i)
+	} else {
+		u, err = strconv.ParseUint(s, 10, bits)
+	}
+	if err != nil {
+		return bad()
+	}
+	switch fd.Type {
+	case protoTypeSint32, protoTypeSint64:
+		u = uint64(i<<1) ^ uint64(i>>63)
+		fallthrough
+	case protoTypeInt32, protoTypeInt64, protoTypeUint32, protoTypeUint64:
+		return protoAppendVarint(protoAppendTag(b, fd.Number, protoVarint), u), nil
+	case protoTypeFixed32, protoTypeSfixed32:
+		var x [4]byte
+		binary.LittleEndian.PutUint32(x[:], uint32(u))
+		return append(protoAppendTag(b, fd.Number, protoFixed32), x[:]...), nil
+	}
+	var x [8]byte
+	binary.LittleEndian.PutUint64(x[:], u)
+	return append(protoAppendTag(b, fd.Number, protoFixed64), x[:]...), nil
+}
+
+// decodeJSON returns the JSON mapping of an encoded message of type name.
+func (reg *protoRegistry) decodeJSON(name string, b []byte) ([]byte, error) {
+	obj, err := reg.decodeMessage(name, b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
+
+func (reg *protoRegistry) decodeMessage(name string, b []byte) (map[string]interface{}, error) {
+	m, err := reg.message(name)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := protoParse(b)
+	if err != nil {
+		return nil, err
+	}
+	obj := make(map[string]interface{})
+	for _, f := range fields {
+		fd := m.field(f.Num)
+		if fd == nil {
+			continue
+		}
+		if fd.Label != protoLabelRepeated {
+			if obj[fd.JSONName], err = reg.decodeValue(fd, f); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if entry, ok := reg.messages[fd.TypeName]; ok && entry.MapEntry && fd.Type == protoTypeMessage {
+			kv, err := reg.decodeMessage(entry.Name, f.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			entries, _ := obj[fd.JSONName].(map[string]interface{})
+			if entries == nil {
+				entries = make(map[string]interface{})
+				obj[fd.JSONName] = entries
+			}
+			key, value := entry.field(1), entry.field(2)
+			if key == nil || value == nil {
+				return nil, fmt.Errorf("protobuf: malformed map entry %s", entry.Name)
+			}
+			entries[fmt.Sprint(kv[key.JSONName])] = kv[value.JSONName]
+			continue
+		}
+		values, _ := obj[fd.JSONName].([]interface{})
+		if f.Wire == protoBytes && fd.Type != protoTypeString && fd.Type != protoTypeBytes && fd.Type != protoTypeMessage {
+			// Packed scalars.
+			for packed := f.Bytes; len(packed) > 0; {
+				e := protoField{Num: f.Num}
+				switch fd.Type {
+				case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+					if len(packed) < 8 {
+						return nil, errProtoTruncated
+					}
+					e.Wire, e.Value, packed = protoFixed64, binary.LittleEndian.Uint64(packed), packed[8:]
+				case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+					if len(packed) < 4 {
+						return nil, errProtoTruncated
+					}
+					e.Wire, e.Value, packed = protoFixed32, uint64(binary.LittleEndian.Uint32(packed)), packed[4:]
+				default:
+					v, n := protoConsumeVarint(packed)
+					if n == 0 {
+						return nil, errProtoTruncated
+					}
+					e.Wire, e.Value, packed = protoVarint, v, packed[n:]
+				}
+				v, err := reg.decodeValue(fd, e)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, v)
+			}
+		} else {
+			v, err := reg.decodeValue(fd, f)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		obj[fd.JSONName] = values
+	}
+	return obj, nil
+}
+
+func (reg *protoRegistry) decodeValue(fd *protoFieldDesc, f protoField) (interface{}, error) {
+	switch fd.Type {
+	case protoTypeString:
+		return string(f.Bytes), nil
+	case protoTypeBytes:
+		return base64.StdEncoding.EncodeToString(f.Bytes), nil
+	case protoTypeMessage:
+		return reg.decodeMessage(fd.TypeName, f.Bytes)
+	case protoTypeBool:
+		return f.Value != 0, nil
+	case protoTypeEnum:
+		if e, ok := reg.enums[fd.TypeName]; ok {
+			if name, ok := e.Names[int32(f.Value)]; ok {
+				return name, nil
+			}
+		}
+		return int32(f.Value), nil
+	case protoTypeDouble:
+		return protoJSONFloat(math.Float64frombits(f.Value)), nil
+	case protoTypeFloat:
+		return protoJSONFloat(float64(math.Float32frombits(uint32(f.Value)))), nil
+	case protoTypeInt32, protoTypeSfixed32:
+		return int32(f.Value), nil
+	case protoTypeUint32, protoTypeFixed32:
+		return uint32(f.Value), nil
+	case protoTypeSint32:
+		return int32(uint32(f.Value)>>1) ^ -int32(f.Value&1), nil
+	// 64 bit integers are strings in JSON.
+	case protoTypeInt64, protoTypeSfixed64:
+		return strconv.FormatInt(int64(f.Value), 10), nil
+	case protoTypeUint64, protoTypeFixed64:
+		return strconv.FormatUint(f.Value, 10), nil
+	case protoTypeSint64:
+		return strconv.FormatInt(int64(f.Value>>1)^-int64(f.Value&1), 10), nil
+	}
+	return nil, fmt.Errorf("protobuf: unsupported type %d of %s", fd.Type, fd.JSONName)
+}
+
+// protoJSONFloat maps the floats JSON can't represent to their strings.
+func protoJSONFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return f
+}
@@ -0,0 +1,76 @@
+package libprobe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol makes TCP based probers send a PROXY protocol header right
+// after connecting, as load balancers such as HAProxy or AWS NLB do, so
+// backends requiring it can be probed directly.
+type ProxyProtocol struct {
+	// Version is 1 for the text header or 2 for the binary one. Default: 1.
+	Version int
+	// SourceAddress is the client "ip:port" presented to the backend.
+	// Default: the local address of the connection.
+	SourceAddress string
+}
+
+// header returns the PROXY header of a connection from local to remote.
+func (p *ProxyProtocol) header(local, remote net.Addr) ([]byte, error) {
+	src, ok := local.(*net.TCPAddr)
+	if p.SourceAddress != "" {
+		addr, err := net.ResolveTCPAddr("tcp", p.SourceAddress)
+		if err != nil {
+			return nil, fmt.Errorf("proxy protocol: %w", err)
+		}
+		src, ok = addr, true
+	}
+	dst, dstOK := remote.(*net.TCPAddr)
+	if !ok || !dstOK {
+		return nil, errors.New("proxy protocol: not a TCP connection")
+	}
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	v6 := srcIP == nil || dstIP == nil
+	if v6 {
+		// Both addresses must be of the same family, IPv4 ones are mapped.
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	switch p.Version {
+	case 0, 1:
+		proto := "TCP4"
+		if v6 {
+			proto = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port, dst.Port)), nil
+	case 2:
+		// Version 2, PROXY command, then TCP over IPv4 or IPv6.
+		b := append([]byte(nil), proxyV2Signature...)
+		family, n := byte(0x11), 12
+		if v6 {
+			family, n = 0x21, 36
+		}
+		b = append(b, 0x21, family, byte(n>>8), byte(n))
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+		var ports [4]byte
+		binary.BigEndian.PutUint16(ports[:], uint16(src.Port))
+		binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+		return append(b, ports[:]...), nil
+	}
+	return nil, fmt.Errorf("proxy protocol: unknown version %d", p.Version)
+}
+
+// send writes the PROXY header of conn to it.
+func (p *ProxyProtocol) send(conn net.Conn) error {
+	header, err := p.header(conn.LocalAddr(), conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(header)
+	return err
+}
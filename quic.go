@@ -0,0 +1,133 @@
+package libprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const KindQUIC = "QUIC"
+
+// QUICProberOptions configures a QUICProber.
+type QUICProberOptions struct {
+	// TLSConfig configures the handshake, e.g. RootCAs to verify
+	// certificates of a private server. ServerName defaults to the host of
+	// Target.Address.
+	TLSConfig *tls.Config
+	// NextProtos are the ALPN protocols offered, overriding those of
+	// TLSConfig. Default: "h3".
+	NextProtos []string
+}
+
+// QUICResult describes the QUIC handshake with a server.
+type QUICResult struct {
+	Target
+	Error error
+
+	// HandshakeTime is the time taken to complete the 1-RTT handshake,
+	// address resolution excluded.
+	HandshakeTime time.Duration
+	// Version is the QUIC version negotiated, such as "v1".
+	Version     string
+	ALPN        string
+	TLSVersion  string
+	CipherSuite string
+	Certificate *CertificateInfo
+}
+
+func (r QUICResult) RTT() time.Duration {
+	return r.HandshakeTime
+}
+
+func (r QUICResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	return fmt.Sprintf("-> %s QUIC %s alpn=%q %v", r.Target.Address, r.Version, r.ALPN, r.HandshakeTime)
+}
+
+// QUICProber measures the QUIC handshake with Target.Address, "host" or
+// "host:port" with port 443 by default, as the counterpart of TCPProber for
+// HTTP/3 infrastructure. Certificates are verified as configured by
+// TLSConfig.
+type QUICProber struct {
+	opts QUICProberOptions
+}
+
+func NewQUICProber(opts QUICProberOptions) *QUICProber {
+	if opts.NextProtos == nil {
+		opts.NextProtos = []string{"h3"}
+	}
+	return &QUICProber{opts: opts}
+}
+
+func (p *QUICProber) Kind() string {
+	return KindQUIC
+}
+
+func (p *QUICProber) Probe(target Target) (Result, error) {
+	return p.ProbeContext(context.Background(), target)
+}
+
+func (p *QUICProber) ProbeContext(ctx context.Context, target Target) (Result, error) {
+	r := &QUICResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "443")
+	}
+	if err := checkGuard("udp", address); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	if err := checkGuard("udp", addr.String()); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	config := mailTLSConfig(p.opts.TLSConfig, address)
+	config.NextProtos = p.opts.NextProtos
+	quicConfig := &quic.Config{}
+	if target.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, target.Timeout)
+		defer cancel()
+		quicConfig.HandshakeIdleTimeout = target.Timeout
+	}
+	conn, err := listenUDP(ctx, nil)
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, ErrFDPoolExhausted) {
+			r.Error = err
+			return r, nil
+		}
+		return nil, err
+	}
+	defer conn.Close()
+
+	startAt := time.Now()
+	c, err := quic.Dial(ctx, conn, addr, config, quicConfig)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.HandshakeTime = time.Since(startAt)
+	defer c.CloseWithError(0, "")
+	state := c.ConnectionState()
+	r.Version = state.Version.String()
+	r.ALPN = state.TLS.NegotiatedProtocol
+	r.TLSVersion = tlsVersionName(state.TLS.Version)
+	r.CipherSuite = tls.CipherSuiteName(state.TLS.CipherSuite)
+	if len(state.TLS.PeerCertificates) > 0 {
+		r.Certificate = newCertificateInfo(state.TLS.PeerCertificates[0])
+	}
+	return r, nil
+}
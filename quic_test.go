@@ -0,0 +1,60 @@
+package libprobe_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQUICProber(t *testing.T) {
+	// The test server's certificate is valid for example.com and 127.0.0.1.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	config := srv.TLS.Clone()
+	config.NextProtos = []string{"h3"}
+	ln, err := quic.ListenAddr("127.0.0.1:0", config, nil)
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				<-c.Context().Done()
+			}()
+		}
+	}()
+
+	prober := libprobe.NewQUICProber(libprobe.QUICProberOptions{TLSConfig: &tls.Config{RootCAs: roots}})
+	r, err := prober.Probe(libprobe.Target{Address: ln.Addr().String(), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.QUICResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "v1", res.Version)
+	require.Equal(t, "h3", res.ALPN)
+	require.Equal(t, "TLS 1.3", res.TLSVersion)
+	require.Contains(t, res.Certificate.DNSNames, "example.com")
+	require.True(t, res.HandshakeTime > 0)
+
+	// No common application protocol.
+	prober = libprobe.NewQUICProber(libprobe.QUICProberOptions{TLSConfig: &tls.Config{RootCAs: roots}, NextProtos: []string{"hq-29"}})
+	r, err = prober.Probe(libprobe.Target{Address: ln.Addr().String(), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.Error(t, r.(*libprobe.QUICResult).Error)
+
+	// Nothing listening.
+	r, err = prober.Probe(libprobe.Target{Address: "127.0.0.1:1", Timeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+	require.Error(t, r.(*libprobe.QUICResult).Error)
+}
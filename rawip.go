@@ -0,0 +1,293 @@
+package libprobe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const KindRawIP = "RAWIP"
+
+var errRawIPNoReply = errors.New("rawip: no reply before the timeout")
+
+// RawIPProberOptions configures a RawIPProber.
+type RawIPProberOptions struct {
+	// Protocol is the IP protocol number of the packet sent.
+	Protocol int
+	Payload  []byte
+	// TTL is the TTL or hop limit of the packet. Default: 64.
+	TTL int
+	// TOS is the IPv4 type of service or IPv6 traffic class.
+	TOS int
+	// ReplyProtocol is the IP protocol of the expected replies.
+	// Default: Protocol.
+	ReplyProtocol int
+	// Filter is a BPF program run by the kernel on every packet of
+	// ReplyProtocol received, starting at the IPv4 header or, for IPv6, at
+	// the payload. Packets it returns 0 for are dropped. By default IPv4
+	// replies are filtered by source address.
+	Filter []bpf.Instruction
+	// Match selects the replies among the packets passing Filter, given
+	// their payload. Default: every packet from the target.
+	Match func(payload []byte) bool
+	// MaxReplies ends the probe once that many replies were captured.
+	// Default: 1.
+	MaxReplies int
+}
+
+// RawIPReply is a packet captured by a RawIPProber.
+type RawIPReply struct {
+	From    string
+	RTT     time.Duration
+	TTL     int
+	TOS     int
+	Payload []byte
+}
+
+type RawIPResult struct {
+	Target
+	Error error
+
+	Replies []RawIPReply
+}
+
+// RTT returns the RTT of the first reply.
+func (r RawIPResult) RTT() time.Duration {
+	if len(r.Replies) == 0 {
+		return 0
+	}
+	return r.Replies[0].RTT
+}
+
+func (r RawIPResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("Error: %s", r.Error)
+	}
+	var b strings.Builder
+	for _, reply := range r.Replies {
+		fmt.Fprintf(&b, "%d bytes from %s: ttl=%d tos=0x%02x time=%s\n", len(reply.Payload), reply.From, reply.TTL, reply.TOS, reply.RTT)
+	}
+	return b.String()
+}
+
+// RawIPProber sends a crafted IP packet to Target.Address and captures the
+// replies matching its options until Target.Timeout, one second by default.
+// It is an escape hatch for protocols the library doesn't model and needs
+// raw socket privileges. Custom filters require Linux.
+type RawIPProber struct {
+	opts RawIPProberOptions
+}
+
+func NewRawIPProber(opts RawIPProberOptions) *RawIPProber {
+	if opts.TTL <= 0 {
+		opts.TTL = 64
+	}
+	if opts.ReplyProtocol == 0 {
+		opts.ReplyProtocol = opts.Protocol
+	}
+	if opts.MaxReplies <= 0 {
+		opts.MaxReplies = 1
+	}
+	return &RawIPProber{opts: opts}
+}
+
+func (p *RawIPProber) Kind() string {
+	return KindRawIP
+}
+
+// sourceFilter accepts the IPv4 packets from src.
+func sourceFilter(src net.IP) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 12, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: binary.BigEndian.Uint32(src.To4()), SkipFalse: 1},
+		bpf.RetConstant{Val: 0xffff},
+		bpf.RetConstant{Val: 0},
+	}
+}
+
+func (p *RawIPProber) Probe(target Target) (Result, error) {
+	if p.opts.Protocol <= 0 || p.opts.Protocol > 255 {
+		return nil, fmt.Errorf("rawip: bad protocol %d", p.opts.Protocol)
+	}
+	addr, err := resolveIPAddr("ip", target.Address)
+	if err != nil {
+		return nil, err
+	}
+	if target.Timeout <= 0 {
+		target.Timeout = time.Second
+	}
+	if addr.IP.To4() != nil {
+		return p.probe4(target, addr.IP.To4())
+	}
+	return p.probe6(target, addr.IP)
+}
+
+func (p *RawIPProber) compile(filter []bpf.Instruction) ([]bpf.RawInstruction, error) {
+	if p.opts.Filter != nil {
+		filter = p.opts.Filter
+	}
+	if filter == nil {
+		return nil, nil
+	}
+	return bpf.Assemble(filter)
+}
+
+func (p *RawIPProber) probe4(target Target, dst net.IP) (Result, error) {
+	send, err := net.ListenPacket("ip4:"+strconv.Itoa(p.opts.Protocol), "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	defer send.Close()
+	recv := send
+	if p.opts.ReplyProtocol != p.opts.Protocol {
+		if recv, err = net.ListenPacket("ip4:"+strconv.Itoa(p.opts.ReplyProtocol), "0.0.0.0"); err != nil {
+			return nil, err
+		}
+		defer recv.Close()
+	}
+	rc, err := ipv4.NewRawConn(recv)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := p.compile(sourceFilter(dst))
+	if err != nil {
+		return nil, err
+	}
+	// The default filter is only an optimization, sources are checked
+	// below too.
+	if err := rc.SetBPF(filter); err != nil && p.opts.Filter != nil {
+		return nil, err
+	}
+	out, err := ipv4.NewRawConn(send)
+	if err != nil {
+		return nil, err
+	}
+	h := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TOS:      p.opts.TOS,
+		TotalLen: ipv4.HeaderLen + len(p.opts.Payload),
+		TTL:      p.opts.TTL,
+		Protocol: p.opts.Protocol,
+		Dst:      dst,
+	}
+	r := &RawIPResult{Target: target}
+	sentAt := time.Now()
+	if err := out.WriteTo(h, p.opts.Payload, nil); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	if err := rc.SetReadDeadline(sentAt.Add(target.Timeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for len(r.Replies) < p.opts.MaxReplies {
+		rh, payload, _, err := rc.ReadFrom(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				break
+			}
+			r.Error = err
+			return r, nil
+		}
+		if p.opts.Filter == nil && !rh.Src.Equal(dst) {
+			continue
+		}
+		if p.opts.Match != nil && !p.opts.Match(payload) {
+			continue
+		}
+		r.Replies = append(r.Replies, RawIPReply{
+			From:    rh.Src.String(),
+			RTT:     time.Since(sentAt),
+			TTL:     rh.TTL,
+			TOS:     rh.TOS,
+			Payload: append([]byte(nil), payload...),
+		})
+	}
+	if len(r.Replies) == 0 {
+		r.Error = errRawIPNoReply
+	}
+	return r, nil
+}
+
+func (p *RawIPProber) probe6(target Target, dst net.IP) (Result, error) {
+	send, err := net.ListenPacket("ip6:"+strconv.Itoa(p.opts.Protocol), "::")
+	if err != nil {
+		return nil, err
+	}
+	defer send.Close()
+	recv := send
+	if p.opts.ReplyProtocol != p.opts.Protocol {
+		if recv, err = net.ListenPacket("ip6:"+strconv.Itoa(p.opts.ReplyProtocol), "::"); err != nil {
+			return nil, err
+		}
+		defer recv.Close()
+	}
+	out := ipv6.NewPacketConn(send)
+	if err := out.SetHopLimit(p.opts.TTL); err != nil {
+		return nil, err
+	}
+	if err := out.SetTrafficClass(p.opts.TOS); err != nil {
+		return nil, err
+	}
+	in := ipv6.NewPacketConn(recv)
+	if err := in.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagTrafficClass, true); err != nil {
+		return nil, err
+	}
+	// IPv6 raw sockets don't see the header, sources are checked below.
+	filter, err := p.compile(nil)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		if err := in.SetBPF(filter); err != nil {
+			return nil, err
+		}
+	}
+	r := &RawIPResult{Target: target}
+	sentAt := time.Now()
+	if _, err := out.WriteTo(p.opts.Payload, nil, &net.IPAddr{IP: dst}); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	if err := in.SetReadDeadline(sentAt.Add(target.Timeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for len(r.Replies) < p.opts.MaxReplies {
+		n, cm, src, err := in.ReadFrom(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				break
+			}
+			r.Error = err
+			return r, nil
+		}
+		from, _ := src.(*net.IPAddr)
+		if from == nil || (p.opts.Filter == nil && !from.IP.Equal(dst)) {
+			continue
+		}
+		if p.opts.Match != nil && !p.opts.Match(buf[:n]) {
+			continue
+		}
+		reply := RawIPReply{From: from.String(), RTT: time.Since(sentAt), Payload: append([]byte(nil), buf[:n]...)}
+		if cm != nil {
+			reply.TTL, reply.TOS = cm.HopLimit, cm.TrafficClass
+		}
+		r.Replies = append(r.Replies, reply)
+	}
+	if len(r.Replies) == 0 {
+		r.Error = errRawIPNoReply
+	}
+	return r, nil
+}
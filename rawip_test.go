@@ -0,0 +1,43 @@
+package libprobe_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawIPProber(t *testing.T) {
+	// Packets sent to the loopback address come back to the sending raw
+	// socket, standing in for a reply.
+	payload := []byte("libprobe raw ip")
+	prober := libprobe.NewRawIPProber(libprobe.RawIPProberOptions{
+		Protocol: 253, // experimentation and testing
+		Payload:  payload,
+		TTL:      9,
+		TOS:      0x28,
+		Match:    func(b []byte) bool { return bytes.Equal(b, payload) },
+	})
+	r, err := prober.Probe(libprobe.Target{Address: "127.0.0.1", Timeout: time.Second})
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	res := r.(*libprobe.RawIPResult)
+	require.NoError(t, res.Error)
+	require.Len(t, res.Replies, 1)
+	require.Equal(t, "127.0.0.1", res.Replies[0].From)
+	require.Equal(t, 9, res.Replies[0].TTL)
+	require.Equal(t, 0x28, res.Replies[0].TOS)
+
+	prober = libprobe.NewRawIPProber(libprobe.RawIPProberOptions{
+		Protocol: 253,
+		Payload:  payload,
+		Match:    func(b []byte) bool { return false },
+	})
+	r, err = prober.Probe(libprobe.Target{Address: "127.0.0.1", Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	require.EqualError(t, r.(*libprobe.RawIPResult).Error, "rawip: no reply before the timeout")
+}
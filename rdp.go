@@ -0,0 +1,235 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindRDP = "RDP"
+
+// RDPProtocol is a set of RDP security protocols (MS-RDPBCGR 2.2.1.1.1).
+type RDPProtocol uint32
+
+const (
+	// RDPStandard is the legacy RDP security, without TLS.
+	RDPStandard RDPProtocol = 0
+	RDPTLS      RDPProtocol = 1
+	// RDPCredSSP is TLS with Network Level Authentication.
+	RDPCredSSP RDPProtocol = 2
+	RDPRDSTLS  RDPProtocol = 4
+	// RDPCredSSPEarlyAuth is CredSSP with Early User Authorization.
+	RDPCredSSPEarlyAuth RDPProtocol = 8
+)
+
+func (p RDPProtocol) String() string {
+	switch p {
+	case RDPStandard:
+		return "RDP"
+	case RDPTLS:
+		return "TLS"
+	case RDPCredSSP:
+		return "CredSSP"
+	case RDPRDSTLS:
+		return "RDSTLS"
+	case RDPCredSSPEarlyAuth:
+		return "CredSSP with Early User Authorization"
+	}
+	return fmt.Sprintf("RDPProtocol(%d)", uint32(p))
+}
+
+// rdpFailures are the failure codes of RDP_NEG_FAILURE.
+var rdpFailures = map[uint32]string{
+	1: "TLS required by the server",
+	2: "TLS not allowed by the server",
+	3: "no certificate on the server",
+	4: "inconsistent flags",
+	5: "CredSSP required by the server",
+	6: "TLS with user authentication required by the server",
+}
+
+// RDPProberOptions configures an RDPProber.
+type RDPProberOptions struct {
+	// Protocols are the security protocols requested. Default: RDPTLS,
+	// RDPCredSSP and RDPCredSSPEarlyAuth, as by mstsc.
+	Protocols RDPProtocol
+	// Cookie is the user name sent as routing cookie, which load balancers
+	// and connection brokers may route on.
+	Cookie string
+	// TLS performs the TLS handshake of the protocol selected, unless
+	// RDPStandard, and reports the certificate. RDP hosts mostly present
+	// self-signed certificates, verified only when TLSConfig is set.
+	TLS       bool
+	TLSConfig *tls.Config
+}
+
+// RDPResult describes the negotiation of an RDP connection.
+type RDPResult struct {
+	Target
+	Error error
+
+	ConnectTime      time.Duration
+	NegotiationTime  time.Duration
+	TLSHandshakeTime time.Duration
+	TotalTime        time.Duration
+	// Selected is the protocol selected by the server, RDPStandard for
+	// servers not negotiating, such as Windows 2000.
+	Selected RDPProtocol
+	// Flags are the flags of the negotiation response, e.g. 0x01 when the
+	// server supports extended client data.
+	Flags       uint8
+	TLSVersion  string
+	Certificate *CertificateInfo
+}
+
+func (r RDPResult) RTT() time.Duration {
+	return r.NegotiationTime
+}
+
+func (r RDPResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	return fmt.Sprintf("-> %s %s Connect: %s, Negotiation: %s, TLS Handshake: %s. Total: %s",
+		r.Target.Address, r.Selected, r.ConnectTime, r.NegotiationTime, r.TLSHandshakeTime, r.TotalTime)
+}
+
+// RDPProber sends an X.224 Connection Request to the RDP server in
+// Target.Address, "host" or "host:port" with port 3389 by default, and
+// reports the security protocol selected in its Connection Confirm.
+type RDPProber struct {
+	opts RDPProberOptions
+}
+
+func NewRDPProber(opts RDPProberOptions) *RDPProber {
+	if opts.Protocols == 0 {
+		opts.Protocols = RDPTLS | RDPCredSSP | RDPCredSSPEarlyAuth
+	}
+	return &RDPProber{opts: opts}
+}
+
+func (p *RDPProber) Kind() string {
+	return KindRDP
+}
+
+func (p *RDPProber) Probe(target Target) (Result, error) {
+	if strings.ContainsAny(p.opts.Cookie, "\r\n") {
+		return nil, errors.New("rdp: invalid cookie")
+	}
+	r := &RDPResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "3389")
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+
+	negotiateAt := time.Now()
+	if _, err := conn.Write(p.connectionRequest()); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	if r.Error = p.readConfirm(r, conn); r.Error != nil {
+		return r, nil
+	}
+	r.NegotiationTime = time.Since(negotiateAt)
+
+	if p.opts.TLS && r.Selected != RDPStandard {
+		host, _, _ := net.SplitHostPort(address)
+		handshakeAt := time.Now()
+		tlsConn := tls.Client(conn, unverifiedTLSConfig(p.opts.TLSConfig, host))
+		if err := tlsConn.Handshake(); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.TLSHandshakeTime = time.Since(handshakeAt)
+		state := tlsConn.ConnectionState()
+		r.TLSVersion = tlsVersionName(state.Version)
+		if len(state.PeerCertificates) > 0 {
+			r.Certificate = newCertificateInfo(state.PeerCertificates[0])
+		}
+		if p.opts.TLSConfig != nil && !p.opts.TLSConfig.InsecureSkipVerify {
+			name := p.opts.TLSConfig.ServerName
+			if name == "" {
+				name = host
+			}
+			if err := verifyCertificate(state, p.opts.TLSConfig.RootCAs, []string{name}); err != nil {
+				r.Error = err
+				return r, nil
+			}
+		}
+	}
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+// connectionRequest returns the X.224 Connection Request, in a TPKT, with
+// the routing cookie and an RDP Negotiation Request.
+func (p *RDPProber) connectionRequest() []byte {
+	var body []byte
+	if p.opts.Cookie != "" {
+		body = append(body, "Cookie: mstshash="+p.opts.Cookie+"\r\n"...)
+	}
+	body = append(body, 1, 0, 8, 0) // TYPE_RDP_NEG_REQ, flags, length
+	body = binary.LittleEndian.AppendUint32(body, uint32(p.opts.Protocols))
+	// Length indicator, CR code, DST-REF, SRC-REF and class 0.
+	x224 := append([]byte{byte(6 + len(body)), 0xe0, 0, 0, 0, 0, 0}, body...)
+	tpkt := []byte{3, 0, 0, 0}
+	binary.BigEndian.PutUint16(tpkt[2:], uint16(4+len(x224)))
+	return append(tpkt, x224...)
+}
+
+// readConfirm reads the X.224 Connection Confirm and its negotiation
+// response.
+func (p *RDPProber) readConfirm(r *RDPResult, conn net.Conn) error {
+	var tpkt [4]byte
+	if _, err := io.ReadFull(conn, tpkt[:]); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(tpkt[2:]))
+	if tpkt[0] != 3 || n < 11 {
+		return errors.New("rdp: not an RDP server")
+	}
+	x224 := make([]byte, n-4)
+	if _, err := io.ReadFull(conn, x224); err != nil {
+		return err
+	}
+	if int(x224[0]) != len(x224)-1 || x224[1]&0xf0 != 0xd0 {
+		return errors.New("rdp: no connection confirm")
+	}
+	neg := x224[7:]
+	if len(neg) == 0 {
+		r.Selected = RDPStandard
+		return nil
+	}
+	if len(neg) < 8 {
+		return errors.New("rdp: malformed negotiation response")
+	}
+	code := binary.LittleEndian.Uint32(neg[4:])
+	switch neg[0] {
+	case 2: // TYPE_RDP_NEG_RSP
+		r.Flags = neg[1]
+		r.Selected = RDPProtocol(code)
+		return nil
+	case 3: // TYPE_RDP_NEG_FAILURE
+		if reason, ok := rdpFailures[code]; ok {
+			return fmt.Errorf("rdp: negotiation failure: %s", reason)
+		}
+		return fmt.Errorf("rdp: negotiation failure %d", code)
+	}
+	return fmt.Errorf("rdp: unexpected negotiation message type %d", neg[0])
+}
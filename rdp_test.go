@@ -0,0 +1,90 @@
+package libprobe_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveRDP serves a host requiring CredSSP, with the TLS configuration
+// config, or a legacy one not negotiating.
+func serveRDP(t *testing.T, config *tls.Config, legacy bool) string {
+	confirm := func(neg ...byte) []byte {
+		x224 := append([]byte{byte(6 + len(neg)), 0xd0, 0, 0, 0x12, 0x34, 0}, neg...)
+		return append([]byte{3, 0, 0, byte(4 + len(x224))}, x224...)
+	}
+	return serveLegacy(t, func(conn net.Conn) {
+		var tpkt [4]byte
+		if _, err := io.ReadFull(conn, tpkt[:]); err != nil {
+			return
+		}
+		x224 := make([]byte, binary.BigEndian.Uint16(tpkt[2:])-4)
+		if _, err := io.ReadFull(conn, x224); err != nil {
+			return
+		}
+		if legacy {
+			conn.Write(confirm())
+			return
+		}
+		body := x224[7:]
+		if !bytes.HasPrefix(body, []byte("Cookie: mstshash=alice\r\n")) {
+			return
+		}
+		requested := binary.LittleEndian.Uint32(body[len(body)-4:])
+		if requested&2 == 0 {
+			conn.Write(confirm(3, 0, 8, 0, 5, 0, 0, 0))
+			return
+		}
+		conn.Write(confirm(2, 0x1f, 8, 0, 2, 0, 0, 0))
+		tls.Server(conn, config).Handshake()
+	})
+}
+
+func TestRDPProber(t *testing.T) {
+	// The test server's certificate is valid for example.com and 127.0.0.1.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	address := serveRDP(t, srv.TLS, false)
+
+	p := libprobe.NewRDPProber(libprobe.RDPProberOptions{Cookie: "alice", TLS: true, TLSConfig: &tls.Config{RootCAs: roots}})
+	require.Equal(t, libprobe.KindRDP, p.Kind())
+	r, err := p.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.RDPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, libprobe.RDPCredSSP, res.Selected)
+	require.Equal(t, "CredSSP", res.Selected.String())
+	require.Equal(t, uint8(0x1f), res.Flags)
+	require.Positive(t, res.NegotiationTime)
+	require.Positive(t, res.TLSHandshakeTime)
+	require.Contains(t, res.Certificate.DNSNames, "example.com")
+
+	// The certificate is reported, unverified, without a TLS configuration.
+	r, err = libprobe.NewRDPProber(libprobe.RDPProberOptions{Cookie: "alice", TLS: true}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.RDPResult)
+	require.NoError(t, res.Error)
+	require.NotNil(t, res.Certificate)
+
+	r, err = libprobe.NewRDPProber(libprobe.RDPProberOptions{Cookie: "alice", Protocols: libprobe.RDPTLS}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.EqualError(t, r.(*libprobe.RDPResult).Error, "rdp: negotiation failure: CredSSP required by the server")
+
+	r, err = libprobe.NewRDPProber(libprobe.RDPProberOptions{TLS: true}).Probe(libprobe.Target{Address: serveRDP(t, nil, true), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.RDPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, libprobe.RDPStandard, res.Selected)
+	require.Nil(t, res.Certificate)
+}
@@ -0,0 +1,472 @@
+package libprobe
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const KindReflector = "REFLECTOR"
+
+// DefaultReflectorPort is the UDP port reflectors listen on by default.
+const DefaultReflectorPort = "8620"
+
+// Reflector packets, requests and replies alike, are made of
+//
+//	magic "LPRF" | version | type | 2 reserved bytes | session (8) |
+//	sequence (4) | reflected count (4) | sent (8) | received (8) |
+//	reflected (8) | padding
+//
+// in network byte order. Timestamps are Unix nanoseconds: sent is set by the
+// sender, received and reflected by the reflector, which also reports the
+// number of requests of the session it received so far.
+const (
+	reflectorHeaderLen = 48
+	reflectorVersion   = 1
+	reflectorRequest   = 0
+	reflectorReply     = 1
+)
+
+var reflectorMagic = []byte("LPRF")
+
+var errReflectorPacket = errors.New("reflector: invalid packet")
+
+type reflectorPacket struct {
+	typ       byte
+	session   uint64
+	seq       uint32
+	count     uint32
+	sent      int64
+	received  int64
+	reflected int64
+}
+
+func (p *reflectorPacket) marshal(b []byte) {
+	copy(b, reflectorMagic)
+	b[4], b[5], b[6], b[7] = reflectorVersion, p.typ, 0, 0
+	binary.BigEndian.PutUint64(b[8:], p.session)
+	binary.BigEndian.PutUint32(b[16:], p.seq)
+	binary.BigEndian.PutUint32(b[20:], p.count)
+	binary.BigEndian.PutUint64(b[24:], uint64(p.sent))
+	binary.BigEndian.PutUint64(b[32:], uint64(p.received))
+	binary.BigEndian.PutUint64(b[40:], uint64(p.reflected))
+}
+
+func parseReflectorPacket(b []byte) (*reflectorPacket, error) {
+	if len(b) < reflectorHeaderLen || string(b[:4]) != string(reflectorMagic) || b[4] != reflectorVersion {
+		return nil, errReflectorPacket
+	}
+	return &reflectorPacket{
+		typ:       b[5],
+		session:   binary.BigEndian.Uint64(b[8:]),
+		seq:       binary.BigEndian.Uint32(b[16:]),
+		count:     binary.BigEndian.Uint32(b[20:]),
+		sent:      int64(binary.BigEndian.Uint64(b[24:])),
+		received:  int64(binary.BigEndian.Uint64(b[32:])),
+		reflected: int64(binary.BigEndian.Uint64(b[40:])),
+	}, nil
+}
+
+// ReflectorOptions configures a Reflector.
+type ReflectorOptions struct {
+	// Address is the UDP address listened on. Default: ":8620".
+	Address string
+	// MaxSessions bounds the sessions tracked at the same time; requests
+	// of further sessions are dropped. Default: 1024.
+	MaxSessions int
+	// SessionTimeout is the idle time after which a session is forgotten.
+	// Default: 1m.
+	SessionTimeout time.Duration
+}
+
+// ReflectorStats are the counters of a Reflector.
+type ReflectorStats struct {
+	Requests int64
+	Dropped  int64
+	Sessions int
+}
+
+// Reflector is a UDP echo server for ReflectorProber, run by libprobe agents
+// so they can measure the forward and reverse paths between each other. It
+// timestamps every request and returns it with the same size, so it can't
+// be used to amplify traffic.
+type Reflector struct {
+	opts ReflectorOptions
+	conn net.PacketConn
+	done chan struct{}
+
+	mu       sync.Mutex
+	sessions map[reflectorSessionKey]*reflectorSession
+	stats    ReflectorStats
+}
+
+type reflectorSessionKey struct {
+	addr    string
+	session uint64
+}
+
+type reflectorSession struct {
+	count    uint32
+	lastSeen time.Time
+}
+
+// ListenReflector starts a reflector listening on opts.Address. It serves
+// until closed.
+func ListenReflector(opts ReflectorOptions) (*Reflector, error) {
+	if opts.Address == "" {
+		opts.Address = ":" + DefaultReflectorPort
+	}
+	if opts.MaxSessions <= 0 {
+		opts.MaxSessions = 1024
+	}
+	if opts.SessionTimeout <= 0 {
+		opts.SessionTimeout = time.Minute
+	}
+	conn, err := net.ListenPacket("udp", opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reflector{
+		opts:     opts,
+		conn:     conn,
+		done:     make(chan struct{}),
+		sessions: make(map[reflectorSessionKey]*reflectorSession),
+	}
+	go r.serve()
+	return r, nil
+}
+
+// Addr returns the address the reflector listens on.
+func (r *Reflector) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+func (r *Reflector) Stats() ReflectorStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Sessions = len(r.sessions)
+	return stats
+}
+
+func (r *Reflector) Close() error {
+	err := r.conn.Close()
+	<-r.done
+	return err
+}
+
+func (r *Reflector) serve() {
+	defer close(r.done)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		receivedAt := time.Now()
+		p, err := parseReflectorPacket(buf[:n])
+		if err != nil || p.typ != reflectorRequest {
+			r.count(false)
+			continue
+		}
+		count, ok := r.track(reflectorSessionKey{addr.String(), p.session}, receivedAt)
+		if !ok {
+			r.count(false)
+			continue
+		}
+		r.count(true)
+		p.typ, p.count, p.received = reflectorReply, count, receivedAt.UnixNano()
+		p.reflected = time.Now().UnixNano()
+		p.marshal(buf)
+		r.conn.WriteTo(buf[:n], addr)
+	}
+}
+
+func (r *Reflector) count(ok bool) {
+	r.mu.Lock()
+	if ok {
+		r.stats.Requests++
+	} else {
+		r.stats.Dropped++
+	}
+	r.mu.Unlock()
+}
+
+// track counts a request of a session and returns the number of requests
+// received in it so far.
+func (r *Reflector) track(key reflectorSessionKey, now time.Time) (uint32, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[key]
+	if !ok {
+		if len(r.sessions) >= r.opts.MaxSessions {
+			for k, s := range r.sessions {
+				if now.Sub(s.lastSeen) > r.opts.SessionTimeout {
+					delete(r.sessions, k)
+				}
+			}
+			if len(r.sessions) >= r.opts.MaxSessions {
+				return 0, false
+			}
+		}
+		s = &reflectorSession{}
+		r.sessions[key] = s
+	}
+	s.count++
+	s.lastSeen = now
+	return s.count, true
+}
+
+// ReflectorProberOptions configures a ReflectorProber.
+type ReflectorProberOptions struct {
+	// Size is the UDP payload size of the packets in bytes. Default and
+	// minimum: 48.
+	Size int
+	// Clock, when set, qualifies the one-way delays with the confidence
+	// in the local clock. The reflector's clock should be synchronized
+	// too.
+	Clock *ClockChecker
+}
+
+// ReflectorResult holds the round-trip and one-way metrics between a
+// ReflectorProber and a Reflector.
+type ReflectorResult struct {
+	Target
+	Error error
+
+	PacketsSent int
+	// ForwardReceived is the number of requests the reflector received, as
+	// reported by the latest reply, and PacketsRecv the number of replies.
+	ForwardReceived int
+	PacketsRecv     int
+	// ForwardLoss and ReverseLoss are the percentages of packets lost on
+	// the way to the reflector and back. Replies lost after the latest
+	// received one count as forward losses.
+	ForwardLoss float64
+	ReverseLoss float64
+
+	MinRTT time.Duration
+	AvgRTT time.Duration
+	MaxRTT time.Duration
+	// ForwardDelay and ReverseDelay are the average one-way delays. They
+	// include the offset between the clocks of both agents, which should
+	// be synchronized for them to be meaningful; their sum, the RTT
+	// without ReflectorTime, doesn't.
+	ForwardDelay time.Duration
+	ReverseDelay time.Duration
+	// ForwardJitter and ReverseJitter are the mean absolute differences
+	// between consecutive one-way delays (RFC 3393), which don't depend on
+	// the clock offset.
+	ForwardJitter time.Duration
+	ReverseJitter time.Duration
+	// ReflectorTime is the average time requests spent in the reflector.
+	ReflectorTime time.Duration
+	// ClockConfidence is the confidence in the local clock when the
+	// prober has a Clock.
+	ClockConfidence string
+
+	destination string
+	size        int
+}
+
+func (r ReflectorResult) RTT() time.Duration {
+	return r.AvgRTT
+}
+
+func (r ReflectorResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("reflector %s: %v", r.Address, r.Error)
+	}
+	return fmt.Sprintf("%d packets transmitted, %d reflected, %d received, %v%% forward loss, %v%% reverse loss\n"+
+		"round-trip min/avg/max = %v/%v/%v, one-way forward/reverse = %v/%v, jitter forward/reverse = %v/%v",
+		r.PacketsSent, r.ForwardReceived, r.PacketsRecv, r.ForwardLoss, r.ReverseLoss,
+		r.MinRTT, r.AvgRTT, r.MaxRTT, r.ForwardDelay, r.ReverseDelay, r.ForwardJitter, r.ReverseJitter)
+}
+
+// Traffic returns the traffic of the probe. UDP headers are as large as ICMP
+// ones.
+func (r ReflectorResult) Traffic() Traffic {
+	return icmpTraffic(r.destination, r.size, r.PacketsSent, r.PacketsRecv)
+}
+
+// ReflectorProber measures the path to a Reflector run by another agent:
+// it sends Target.Count requests every Target.Interval (default 1s), and
+// derives round-trip and one-way metrics from the reflector's timestamps.
+// Target.Address is "host:port"; the port defaults to DefaultReflectorPort.
+// Replies are awaited until Target.Timeout or, by default, a second after
+// the last request.
+type ReflectorProber struct {
+	opts ReflectorProberOptions
+}
+
+func NewReflectorProber(opts ReflectorProberOptions) *ReflectorProber {
+	if opts.Size < reflectorHeaderLen {
+		opts.Size = reflectorHeaderLen
+	}
+	return &ReflectorProber{opts: opts}
+}
+
+func (p *ReflectorProber) Kind() string {
+	return KindReflector
+}
+
+func (p *ReflectorProber) Probe(target Target) (Result, error) {
+	r := &ReflectorResult{Target: target, size: p.opts.Size}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DefaultReflectorPort)
+	}
+	conn, err := dialTimeout(target.meter, "udp", address, target.Timeout)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	r.destination, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	if p.opts.Clock != nil {
+		r.ClockConfidence = p.opts.Clock.Confidence()
+	}
+
+	count := target.GetCount()
+	interval := target.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	start := time.Now()
+	deadline := start.Add(time.Duration(count-1)*interval + time.Second)
+	if target.Timeout > 0 {
+		deadline = start.Add(target.Timeout)
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		r.Error = err
+		return r, nil
+	}
+
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	session := binary.BigEndian.Uint64(id[:])
+	var sentMu sync.Mutex
+	sent := 0
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		b := make([]byte, p.opts.Size)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for seq := 0; seq < count; seq++ {
+			if seq > 0 {
+				select {
+				case <-ticker.C:
+				case <-stop:
+					return
+				}
+			}
+			req := reflectorPacket{typ: reflectorRequest, session: session, seq: uint32(seq), sent: time.Now().UnixNano()}
+			req.marshal(b)
+			if _, err := conn.Write(b); err == nil {
+				sentMu.Lock()
+				sent++
+				sentMu.Unlock()
+			}
+		}
+	}()
+
+	var (
+		received                 = make(map[uint32]bool)
+		rtts, forward, reverse   []time.Duration
+		reflectorTime            time.Duration
+		forwardJitter, revJitter time.Duration
+		forwardReceived          uint32
+	)
+	buf := make([]byte, 65535)
+	for len(received) < count {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				break
+			}
+			r.Error = err
+			break
+		}
+		receivedAt := time.Now().UnixNano()
+		reply, err := parseReflectorPacket(buf[:n])
+		if err != nil || reply.typ != reflectorReply || reply.session != session ||
+			int(reply.seq) >= count || received[reply.seq] {
+			continue
+		}
+		received[reply.seq] = true
+		if reply.count > forwardReceived {
+			forwardReceived = reply.count
+		}
+		held := time.Duration(reply.reflected - reply.received)
+		rtt := time.Duration(receivedAt-reply.sent) - held
+		fwd := time.Duration(reply.received - reply.sent)
+		rev := time.Duration(receivedAt - reply.reflected)
+		if n := len(rtts); n > 0 {
+			forwardJitter += absDuration(fwd - forward[n-1])
+			revJitter += absDuration(rev - reverse[n-1])
+		}
+		rtts, forward, reverse = append(rtts, rtt), append(forward, fwd), append(reverse, rev)
+		reflectorTime += held
+	}
+
+	sentMu.Lock()
+	r.PacketsSent = sent
+	sentMu.Unlock()
+	r.ForwardReceived = int(forwardReceived)
+	r.PacketsRecv = len(rtts)
+	if r.ForwardReceived < r.PacketsRecv {
+		r.ForwardReceived = r.PacketsRecv
+	}
+	if r.PacketsSent > 0 {
+		r.ForwardLoss = float64(r.PacketsSent-r.ForwardReceived) / float64(r.PacketsSent) * 100
+	}
+	if r.ForwardReceived > 0 {
+		r.ReverseLoss = float64(r.ForwardReceived-r.PacketsRecv) / float64(r.ForwardReceived) * 100
+	}
+	if len(rtts) == 0 {
+		if r.Error == nil {
+			r.Error = fmt.Errorf("reflector: no reply from %s", address)
+		}
+		return r, nil
+	}
+	r.MinRTT, r.MaxRTT = rtts[0], rtts[0]
+	for _, rtt := range rtts {
+		if rtt < r.MinRTT {
+			r.MinRTT = rtt
+		}
+		if rtt > r.MaxRTT {
+			r.MaxRTT = rtt
+		}
+	}
+	n := time.Duration(len(rtts))
+	r.AvgRTT = sumDurations(rtts) / n
+	r.ForwardDelay = sumDurations(forward) / n
+	r.ReverseDelay = sumDurations(reverse) / n
+	r.ReflectorTime = reflectorTime / n
+	if n > 1 {
+		r.ForwardJitter = forwardJitter / (n - 1)
+		r.ReverseJitter = revJitter / (n - 1)
+	}
+	return r, nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func sumDurations(ds []time.Duration) time.Duration {
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	return sum
+}
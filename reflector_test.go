@@ -0,0 +1,76 @@
+package libprobe_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReflectorProber(t *testing.T) {
+	reflector, err := libprobe.ListenReflector(libprobe.ReflectorOptions{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	defer reflector.Close()
+
+	prober := libprobe.NewReflectorProber(libprobe.ReflectorProberOptions{Size: 100})
+	r, err := prober.Probe(libprobe.Target{Address: reflector.Addr().String(), Count: 5, Interval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	res := r.(*libprobe.ReflectorResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, 5, res.PacketsSent)
+	require.Equal(t, 5, res.ForwardReceived)
+	require.Equal(t, 5, res.PacketsRecv)
+	require.Zero(t, res.ForwardLoss)
+	require.Zero(t, res.ReverseLoss)
+	require.True(t, res.MinRTT > 0 && res.MinRTT <= res.AvgRTT && res.AvgRTT <= res.MaxRTT)
+	require.True(t, res.ForwardDelay > 0 && res.ReverseDelay > 0)
+	require.Equal(t, libprobe.Traffic{BytesSent: 5 * 128, BytesReceived: 5 * 128, PacketsSent: 5, PacketsReceived: 5}, res.Traffic())
+
+	stats := reflector.Stats()
+	require.Equal(t, int64(5), stats.Requests)
+	require.Equal(t, 1, stats.Sessions)
+}
+
+func TestReflectorProberLoss(t *testing.T) {
+	reflector, err := libprobe.ListenReflector(libprobe.ReflectorOptions{Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	defer reflector.Close()
+	upstream, err := net.Dial("udp", reflector.Addr().String())
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	// The relay drops the first request and the reply to the third.
+	var requests int
+	address := serveUDP(t, func(q []byte) [][]byte {
+		requests++
+		if requests == 1 {
+			return nil
+		}
+		upstream.Write(q)
+		buf := make([]byte, 1500)
+		upstream.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := upstream.Read(buf)
+		if err != nil || requests == 3 {
+			return nil
+		}
+		return [][]byte{buf[:n]}
+	})
+
+	prober := libprobe.NewReflectorProber(libprobe.ReflectorProberOptions{})
+	r, err := prober.Probe(libprobe.Target{Address: address, Count: 5, Interval: 10 * time.Millisecond, Timeout: 500 * time.Millisecond})
+	require.NoError(t, err)
+	res := r.(*libprobe.ReflectorResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, 5, res.PacketsSent)
+	require.Equal(t, 4, res.ForwardReceived)
+	require.Equal(t, 3, res.PacketsRecv)
+	require.Equal(t, 20.0, res.ForwardLoss)
+	require.Equal(t, 25.0, res.ReverseLoss)
+
+	r, err = prober.Probe(libprobe.Target{Address: "127.0.0.1:1", Count: 1, Timeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+	require.Error(t, r.(*libprobe.ReflectorResult).Error)
+}
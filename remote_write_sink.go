@@ -0,0 +1,292 @@
+package libprobe
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteWriteSinkOptions configures a RemoteWriteSink.
+type RemoteWriteSinkOptions struct {
+	// URL is the remote-write endpoint, e.g.
+	// "https://mimir.example.com/api/v1/push".
+	URL string
+	// Header is sent with every request, e.g. an Authorization or a
+	// X-Scope-OrgID header.
+	Header    http.Header
+	TLSConfig *tls.Config
+	// Labels are added to every series, e.g. {"agent": "edge-1"}.
+	Labels map[string]string
+	// MetricPrefix prefixes metric names. Default: "probe".
+	MetricPrefix string
+	// Columns are additional numeric flattened result columns sent as
+	// metrics. Duration columns such as "ttfb_ns" are converted to seconds
+	// and become "probe_ttfb_seconds".
+	Columns []string
+	// BatchSize is the number of results buffered before a flush.
+	// Default: 100.
+	BatchSize int
+	// Linger flushes buffered results periodically. Default: 10s; a negative
+	// value disables periodic flushing.
+	Linger time.Duration
+	// Backlog is the number of samples kept while the receiver is
+	// unreachable, the oldest samples are dropped first. Default: 10000.
+	Backlog int
+	Timeout time.Duration
+}
+
+// RemoteWriteSink pushes results to Prometheus remote-write receivers such as
+// Mimir, VictoriaMetrics or Thanos, for agents without a scrapeable endpoint.
+// Every result produces the samples "<prefix>_rtt_seconds" and
+// "<prefix>_success" labelled with kind and target, plus one sample per
+// configured column. Samples are flushed once BatchSize results are buffered,
+// every Linger, and on Close; samples the receiver failed to accept with a
+// retryable status are kept for the next flush.
+type RemoteWriteSink struct {
+	opts   RemoteWriteSinkOptions
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []remoteWriteSample
+	results int
+	dropped int
+	closed  bool
+	done    chan struct{}
+	lastErr error
+}
+
+type remoteWriteLabel struct {
+	Name, Value string
+}
+
+type remoteWriteSample struct {
+	Labels []remoteWriteLabel // sorted by name
+	Value  float64
+	Time   time.Time
+}
+
+func NewRemoteWriteSink(opts RemoteWriteSinkOptions) *RemoteWriteSink {
+	if opts.MetricPrefix == "" {
+		opts.MetricPrefix = "probe"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.Linger == 0 {
+		opts.Linger = 10 * time.Second
+	}
+	if opts.Backlog <= 0 {
+		opts.Backlog = 10000
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	s := &RemoteWriteSink{
+		opts: opts,
+		client: &http.Client{
+			Timeout:   opts.Timeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: opts.TLSConfig},
+		},
+		done: make(chan struct{}),
+	}
+	if opts.Linger > 0 {
+		go s.lingerLoop()
+	}
+	return s
+}
+
+func (s *RemoteWriteSink) lingerLoop() {
+	ticker := time.NewTicker(s.opts.Linger)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			if len(s.pending) > 0 {
+				s.lastErr = s.flush()
+			}
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// samples maps a result onto samples.
+func (s *RemoteWriteSink) samples(at time.Time, r Result) []remoteWriteSample {
+	row := Flatten(r)[0]
+	address, _ := row[ColumnAddress].(string)
+	labels := []remoteWriteLabel{{"kind", resultKind(r)}, {"target", address}}
+	for name, value := range s.opts.Labels {
+		labels = append(labels, remoteWriteLabel{name, value})
+	}
+	sample := func(name string, v float64) remoteWriteSample {
+		l := append([]remoteWriteLabel{{"__name__", s.opts.MetricPrefix + "_" + name}}, labels...)
+		sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+		return remoteWriteSample{Labels: l, Value: v, Time: at}
+	}
+	up := 0.0
+	if resultOK(r) {
+		up = 1
+	}
+	samples := []remoteWriteSample{
+		sample("rtt_seconds", r.RTT().Seconds()),
+		sample("success", up),
+	}
+	for _, c := range s.opts.Columns {
+		name := c
+		var v float64
+		switch cell := row[c].(type) {
+		case int64:
+			v = float64(cell)
+			if strings.HasSuffix(c, "_ns") {
+				name, v = strings.TrimSuffix(c, "_ns")+"_seconds", v/float64(time.Second)
+			}
+		case uint64:
+			v = float64(cell)
+		case float64:
+			v = cell
+		case bool:
+			if cell {
+				v = 1
+			}
+		default:
+			continue
+		}
+		samples = append(samples, sample(name, v))
+	}
+	return samples
+}
+
+// Write buffers a result. The returned error reports a failure of the last
+// flush, including periodic flushes that happened in the background.
+func (s *RemoteWriteSink) Write(r Result) error {
+	samples := s.samples(time.Now(), r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSinkClosed
+	}
+	s.pending = append(s.pending, samples...)
+	if over := len(s.pending) - s.opts.Backlog; over > 0 {
+		s.pending = s.pending[over:]
+		s.dropped += over
+	}
+	s.results++
+	if s.results >= s.opts.BatchSize {
+		s.lastErr = s.flush()
+	}
+	err := s.lastErr
+	s.lastErr = nil
+	return err
+}
+
+// Flush sends all buffered samples.
+func (s *RemoteWriteSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// Dropped returns the number of samples dropped because the backlog was full
+// or the receiver rejected them.
+func (s *RemoteWriteSink) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+func (s *RemoteWriteSink) flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	s.results = 0
+	retry, err := s.send(encodeRemoteWrite(s.pending))
+	if err == nil || !retry {
+		if err != nil {
+			s.dropped += len(s.pending)
+		}
+		s.pending = nil
+	}
+	return err
+}
+
+// send posts a write request. Only network errors, 429 and 5xx responses are
+// retryable, receivers reject the same samples again on other errors.
+func (s *RemoteWriteSink) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.opts.URL, bytes.NewReader(snappyEncode(body)))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range s.opts.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "libprobe")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote write: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5, err
+}
+
+// encodeRemoteWrite encodes samples as a prometheus.WriteRequest, grouping
+// the samples of a series into one TimeSeries.
+func encodeRemoteWrite(samples []remoteWriteSample) []byte {
+	var keys []string
+	series := make(map[string][]byte)
+	for _, sample := range samples {
+		var key strings.Builder
+		for _, l := range sample.Labels {
+			key.WriteString(l.Name + "\x00" + l.Value + "\x00")
+		}
+		b, ok := series[key.String()]
+		if !ok {
+			keys = append(keys, key.String())
+			for _, l := range sample.Labels {
+				b = protoAppendBytes(b, 1, protoAppendString(protoAppendString(nil, 1, l.Name), 2, l.Value))
+			}
+		}
+		var value [8]byte
+		binary.LittleEndian.PutUint64(value[:], math.Float64bits(sample.Value))
+		encoded := append(protoAppendTag(nil, 1, protoFixed64), value[:]...)
+		encoded = protoAppendTag(encoded, 2, protoVarint)
+		encoded = protoAppendVarint(encoded, uint64(sample.Time.UnixNano()/int64(time.Millisecond)))
+		series[key.String()] = protoAppendBytes(b, 2, encoded)
+	}
+	var req []byte
+	for _, key := range keys {
+		req = protoAppendBytes(req, 1, series[key])
+	}
+	return req
+}
+
+// Close flushes buffered samples.
+func (s *RemoteWriteSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	return s.flush()
+}
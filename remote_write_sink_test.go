@@ -0,0 +1,173 @@
+package libprobe_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func snappyDecode(src []byte) ([]byte, error) {
+	n, i := binary.Uvarint(src)
+	if i <= 0 {
+		return nil, errors.New("snappy: bad length")
+	}
+	dst := make([]byte, 0, n)
+	for i < len(src) {
+		tag := src[i]
+		switch tag & 3 {
+		case 0:
+			length := int(tag>>2) + 1
+			i++
+			switch tag >> 2 {
+			case 60:
+				length = int(src[i]) + 1
+				i++
+			case 61:
+				length = int(binary.LittleEndian.Uint16(src[i:])) + 1
+				i += 2
+			}
+			if i+length > len(src) {
+				return nil, errors.New("snappy: truncated literal")
+			}
+			dst = append(dst, src[i:i+length]...)
+			i += length
+		case 2:
+			length := int(tag>>2) + 1
+			offset := int(binary.LittleEndian.Uint16(src[i+1:]))
+			i += 3
+			if offset == 0 || offset > len(dst) {
+				return nil, errors.New("snappy: bad offset")
+			}
+			for j := 0; j < length; j++ {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		default:
+			return nil, errors.New("snappy: unexpected tag")
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errors.New("snappy: length mismatch")
+	}
+	return dst, nil
+}
+
+// pbFields splits a protobuf message into its fields, mapping each field
+// number to its raw values.
+func pbFields(t *testing.T, b []byte) map[int][][]byte {
+	fields := make(map[int][][]byte)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		require.True(t, n > 0)
+		b = b[n:]
+		num := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(b)
+			fields[num] = append(fields[num], b[:n])
+			b = b[n:]
+		case 1:
+			fields[num] = append(fields[num], b[:8])
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			fields[num] = append(fields[num], b[n:n+int(size)])
+			b = b[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+type remoteWriteSeries struct {
+	labels map[string]string
+	values []float64
+}
+
+func decodeRemoteWrite(t *testing.T, body []byte) map[string]remoteWriteSeries {
+	data, err := snappyDecode(body)
+	require.NoError(t, err)
+	series := make(map[string]remoteWriteSeries)
+	for _, ts := range pbFields(t, data)[1] {
+		fields := pbFields(t, ts)
+		s := remoteWriteSeries{labels: make(map[string]string)}
+		for _, l := range fields[1] {
+			lf := pbFields(t, l)
+			s.labels[string(lf[1][0])] = string(lf[2][0])
+		}
+		for _, sample := range fields[2] {
+			sf := pbFields(t, sample)
+			s.values = append(s.values, math.Float64frombits(binary.LittleEndian.Uint64(sf[1][0])))
+			require.Len(t, sf[2], 1)
+		}
+		series[s.labels["__name__"]] = s
+	}
+	return series
+}
+
+func TestRemoteWriteSink(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		require.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		require.Equal(t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+		require.Equal(t, "tenant-1", r.Header.Get("X-Scope-OrgID"))
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink := libprobe.NewRemoteWriteSink(libprobe.RemoteWriteSinkOptions{
+		URL:       server.URL,
+		Header:    http.Header{"X-Scope-OrgID": {"tenant-1"}},
+		Labels:    map[string]string{"agent": "edge-1"},
+		Columns:   []string{"connect_time_ns"},
+		BatchSize: 2,
+		Linger:    -1,
+	})
+	target := libprobe.Target{Address: "1.1.1.1:80"}
+	require.NoError(t, sink.Write(&libprobe.TCPResult{Target: target, ConnectTime: 1500 * time.Microsecond}))
+	require.NoError(t, sink.Write(&libprobe.TCPResult{Target: target, Error: errors.New("refused")}))
+
+	series := decodeRemoteWrite(t, <-bodies)
+	require.Len(t, series, 3)
+	require.Equal(t, map[string]string{"__name__": "probe_success", "agent": "edge-1", "kind": "TCP", "target": "1.1.1.1:80"}, series["probe_success"].labels)
+	require.Equal(t, []float64{1, 0}, series["probe_success"].values)
+	require.Equal(t, []float64{0.0015, 0}, series["probe_rtt_seconds"].values)
+	require.Equal(t, []float64{0.0015, 0}, series["probe_connect_time_seconds"].values)
+	require.NoError(t, sink.Close())
+}
+
+func TestRemoteWriteSinkRetry(t *testing.T) {
+	statuses := make(chan int, 3)
+	statuses <- http.StatusServiceUnavailable
+	statuses <- http.StatusNoContent
+	statuses <- http.StatusBadRequest
+	bodies := make(chan []byte, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+		w.WriteHeader(<-statuses)
+	}))
+	defer server.Close()
+
+	sink := libprobe.NewRemoteWriteSink(libprobe.RemoteWriteSinkOptions{URL: server.URL, BatchSize: 1, Linger: -1})
+	require.Error(t, sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "a:1"}}))
+	<-bodies
+	require.NoError(t, sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "a:1"}}))
+	require.Equal(t, []float64{1, 1}, decodeRemoteWrite(t, <-bodies)["probe_success"].values)
+	require.Error(t, sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "a:1"}}))
+	<-bodies
+	require.Equal(t, 2, sink.Dropped())
+	require.NoError(t, sink.Close())
+}
@@ -0,0 +1,546 @@
+package libprobe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordedProbe is a probe of a recorded session.
+type RecordedProbe struct {
+	// Time is when the probe started, or when the result was written for
+	// results recorded as a Sink.
+	Time     time.Time
+	Kind     string
+	Duration time.Duration
+	Result   Result
+	// Err is the error returned by Probe, as opposed to the Error of the
+	// result.
+	Err error
+}
+
+// sessionRecord is the JSON line of a recorded probe.
+type sessionRecord struct {
+	Time     time.Time       `json:"time"`
+	Kind     string          `json:"kind,omitempty"`
+	Duration time.Duration   `json:"duration,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// replayValue is a result encoded along with the name of its type, so it can
+// be decoded back into the same type.
+type replayValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+var (
+	resultType          = reflect.TypeOf((*Result)(nil)).Elem()
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+	replayMu    sync.RWMutex
+	replayTypes = make(map[string]reflect.Type)
+)
+
+func init() {
+	for _, r := range []Result{
+		&ACMEResult{},
+		&ALPNResult{},
+		&AMQPResult{},
+		&ClassifiedResult{},
+		&CompareResult{},
+		&DiameterResult{},
+		&DNSResult{},
+		&DNSConsistencyResult{},
+		&ECHResult{},
+		&ExpectResult{},
+		&FailoverResult{},
+		&GameQueryResult{},
+		&GRPCResult{},
+		&GTPResult{},
+		&HTTP2Result{},
+		&HTTPResult{},
+		&ICMPResult{},
+		&ICMPSweepResult{},
+		&ICMPBroadcastResult{},
+		&IRCResult{},
+		&ISCSIResult{},
+		&KafkaResult{},
+		&KerberosResult{},
+		&KeyExchangeResult{},
+		&LDAPResult{},
+		&MailboxResult{},
+		&MongoResult{},
+		&MQTTResult{},
+		&MySQLResult{},
+		&NTPResult{},
+		&OAuthResult{},
+		&OPCUAResult{},
+		&PanicResult{},
+		&QUICResult{},
+		&RawIPResult{},
+		&RDPResult{},
+		&ReflectorResult{},
+		&RTSPResult{},
+		&ScheduledResult{},
+		&SIPResult{},
+		&SMTPRoundTripResult{},
+		&SNMPResult{},
+		&SRVResult{},
+		&SSHResult{},
+		&SuppressedResult{},
+		&SweepResult{},
+		&TACACSResult{},
+		&TCPResult{},
+		&TLSResult{},
+		&TimestampedResult{},
+		&WSResult{},
+		&WatchdogResult{},
+		&WaterfallResult{},
+		&WellKnownResult{},
+		&WHOISResult{},
+		&XMPPResult{},
+	} {
+		RegisterReplayType(r)
+	}
+}
+
+// RegisterReplayType registers the type of r, so recorded results of that
+// type can be replayed. Result types of this package are registered already;
+// custom probers register theirs before reading sessions.
+func RegisterReplayType(r Result) {
+	t := reflect.TypeOf(r)
+	replayMu.Lock()
+	replayTypes[replayTypeName(t)] = t
+	replayMu.Unlock()
+}
+
+func replayTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// SessionRecorder records probe sessions as JSON lines: the timing of every
+// probe along with its complete result, so real incidents can be captured and
+// later replayed against alerting logic with Replay. Errors are recorded as
+// their message, and fields which can't be serialized, such as request
+// bodies and unexported state, are left out.
+//
+// Probers wrapped by Prober are recorded as they probe, and SessionRecorder
+// is a Sink recording the results written to it.
+type SessionRecorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewSessionRecorder creates a recorder writing to w. Close closes w when it
+// is an io.Closer.
+func NewSessionRecorder(w io.Writer) *SessionRecorder {
+	return &SessionRecorder{w: w}
+}
+
+// Record records a probe.
+func (s *SessionRecorder) Record(p RecordedProbe) error {
+	rec := sessionRecord{Time: p.Time, Kind: p.Kind, Duration: p.Duration}
+	if p.Err != nil {
+		rec.Error = p.Err.Error()
+	}
+	if p.Result != nil {
+		v, err := encodeReplayResult(p.Result)
+		if err != nil {
+			return err
+		}
+		if rec.Result, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *SessionRecorder) Write(r Result) error {
+	return s.Record(RecordedProbe{Time: time.Now(), Kind: resultKind(r), Result: r})
+}
+
+func (s *SessionRecorder) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Prober wraps p so its probes are recorded.
+func (s *SessionRecorder) Prober(p Prober) Prober {
+	return &recordingProber{Prober: p, recorder: s}
+}
+
+type recordingProber struct {
+	Prober
+	recorder *SessionRecorder
+}
+
+func (p *recordingProber) Probe(target Target) (Result, error) {
+	return p.ProbeContext(context.Background(), target)
+}
+
+func (p *recordingProber) ProbeContext(ctx context.Context, target Target) (Result, error) {
+	start := time.Now()
+	var r Result
+	var err error
+	if cp, ok := p.Prober.(ContextProber); ok {
+		r, err = cp.ProbeContext(ctx, target)
+	} else {
+		r, err = p.Prober.Probe(target)
+	}
+	rec := RecordedProbe{Time: start, Kind: p.Prober.Kind(), Duration: time.Since(start), Result: r, Err: err}
+	if recErr := p.recorder.Record(rec); recErr != nil && err == nil {
+		err = fmt.Errorf("record probe: %w", recErr)
+	}
+	return r, err
+}
+
+// ReadSession reads a session recorded by SessionRecorder.
+func ReadSession(r io.Reader) ([]RecordedProbe, error) {
+	var probes []RecordedProbe
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec sessionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("session line %d: %w", line, err)
+		}
+		p := RecordedProbe{Time: rec.Time, Kind: rec.Kind, Duration: rec.Duration}
+		if rec.Error != "" {
+			p.Err = errors.New(rec.Error)
+		}
+		if len(rec.Result) > 0 {
+			var v replayValue
+			err := json.Unmarshal(rec.Result, &v)
+			if err == nil {
+				p.Result, err = decodeReplayResult(v)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("session line %d: %w", line, err)
+			}
+		}
+		probes = append(probes, p)
+	}
+	return probes, scanner.Err()
+}
+
+// LoadSession reads the session recorded in a file.
+func LoadSession(path string) ([]RecordedProbe, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSession(f)
+}
+
+// ReplayOptions configures Replay.
+type ReplayOptions struct {
+	// Sinks receive the recorded results.
+	Sinks []Sink
+	// Speed scales the pace of the replay: 1 replays the session at the
+	// recorded pace, 2 twice as fast. Default: 0, replaying as fast as
+	// possible.
+	Speed float64
+}
+
+// Replay writes the results of a recorded session to sinks in order, such as
+// the Suppressor and alerting sinks under test. Probes which failed without
+// a result are skipped. It stops at the first sink error.
+func Replay(probes []RecordedProbe, opts ReplayOptions) error {
+	var start time.Time
+	began := time.Now()
+	for i, p := range probes {
+		if i == 0 {
+			start = p.Time
+		}
+		if opts.Speed > 0 {
+			at := time.Duration(float64(p.Time.Sub(start)) / opts.Speed)
+			if d := at - time.Since(began); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		if p.Result == nil {
+			continue
+		}
+		for _, sink := range opts.Sinks {
+			if err := sink.Write(p.Result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GoldenOptions configures CompareGolden.
+type GoldenOptions struct {
+	// Update rewrites the golden file instead of comparing against it. It
+	// is also enabled by setting LIBPROBE_UPDATE_GOLDEN=1.
+	Update bool
+	// Ignore lists columns left out of the comparison, such as timestamps.
+	Ignore []string
+}
+
+// CompareGolden compares results with a golden file holding their CSV export,
+// returning an error describing the first difference.
+func CompareGolden(path string, results []Result, opts GoldenOptions) error {
+	var all []Row
+	for _, r := range results {
+		all = append(all, Flatten(r)...)
+	}
+	ignored := make(map[string]bool, len(opts.Ignore))
+	for _, c := range opts.Ignore {
+		ignored[c] = true
+	}
+	var columns []string
+	for _, c := range Columns(all...) {
+		if !ignored[c] {
+			columns = append(columns, c)
+		}
+	}
+	var buf bytes.Buffer
+	enc := NewCSVEncoder(&buf, columns...)
+	for _, r := range results {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+
+	if opts.Update || os.Getenv("LIBPROBE_UPDATE_GOLDEN") == "1" {
+		return ioutil.WriteFile(path, buf.Bytes(), 0644)
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(want, buf.Bytes()) {
+		return nil
+	}
+	got := strings.Split(buf.String(), "\n")
+	lines := strings.Split(string(want), "\n")
+	for i := 0; ; i++ {
+		var g, w string
+		if i < len(got) {
+			g = got[i]
+		}
+		if i < len(lines) {
+			w = lines[i]
+		}
+		if g != w {
+			return fmt.Errorf("golden %s: line %d: got %q, want %q", path, i+1, g, w)
+		}
+	}
+}
+
+func encodeReplayResult(r Result) (replayValue, error) {
+	v, err := json.Marshal(encodeReplayValue(reflect.ValueOf(r)))
+	if err != nil {
+		return replayValue{}, err
+	}
+	return replayValue{Type: replayTypeName(reflect.TypeOf(r)), Value: v}, nil
+}
+
+func decodeReplayResult(v replayValue) (Result, error) {
+	replayMu.RLock()
+	t, ok := replayTypes[v.Type]
+	replayMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unregistered result type %q", v.Type)
+	}
+	var ptr reflect.Value
+	if t.Kind() == reflect.Ptr {
+		ptr = reflect.New(t.Elem())
+	} else {
+		ptr = reflect.New(t)
+	}
+	if err := decodeReplayValue(v.Value, ptr.Elem()); err != nil {
+		return nil, fmt.Errorf("%s: %w", v.Type, err)
+	}
+	if t.Kind() == reflect.Ptr {
+		return ptr.Interface().(Result), nil
+	}
+	return ptr.Elem().Interface().(Result), nil
+}
+
+// encodeReplayValue converts v into a value encoding/json marshals
+// losslessly: errors become their message, nested results are tagged with
+// their type, and values which can't be serialized are dropped.
+func encodeReplayValue(v reflect.Value) interface{} {
+	switch {
+	case !v.IsValid():
+		return nil
+	case v.Type() == errorType:
+		if v.IsNil() {
+			return nil
+		}
+		return v.Interface().(error).Error()
+	case v.Type() == resultType:
+		if v.IsNil() {
+			return nil
+		}
+		r, err := encodeReplayResult(v.Interface().(Result))
+		if err != nil {
+			return nil
+		}
+		return r
+	case v.Kind() == reflect.Ptr && v.IsNil():
+		return nil
+	case v.Type().Implements(jsonMarshalerType), v.Type().Implements(textMarshalerType):
+		return v.Interface()
+	case v.CanAddr() && (v.Addr().Type().Implements(jsonMarshalerType) || v.Addr().Type().Implements(textMarshalerType)):
+		return v.Addr().Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		return encodeReplayValue(v.Elem())
+	case reflect.Interface, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return nil
+	case reflect.Struct:
+		obj := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.PkgPath == "" {
+				obj[f.Name] = encodeReplayValue(v.Field(i))
+			}
+		}
+		return obj
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 || (v.Kind() == reflect.Slice && v.IsNil()) {
+			return v.Interface()
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = encodeReplayValue(v.Index(i))
+		}
+		return list
+	case reflect.Map:
+		if v.IsNil() || v.Type().Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		obj := make(map[string]interface{}, v.Len())
+		for _, k := range v.MapKeys() {
+			obj[k.String()] = encodeReplayValue(v.MapIndex(k))
+		}
+		return obj
+	}
+	return v.Interface()
+}
+
+// decodeReplayValue decodes data encoded by encodeReplayValue into v.
+func decodeReplayValue(data json.RawMessage, v reflect.Value) error {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	switch {
+	case v.Type() == errorType:
+		var msg string
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(errors.New(msg)))
+		return nil
+	case v.Type() == resultType:
+		var rv replayValue
+		if err := json.Unmarshal(data, &rv); err != nil {
+			return err
+		}
+		r, err := decodeReplayResult(rv)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(r))
+		return nil
+	case v.Kind() != reflect.Ptr && (v.Addr().Type().Implements(jsonUnmarshalerType) || v.Addr().Type().Implements(textUnmarshalerType)):
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if err := decodeReplayValue(data, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Interface, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if err := decodeReplayValue(fields[f.Name], v.Field(i)); err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return json.Unmarshal(data, v.Addr().Interface())
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), len(items), len(items)))
+		}
+		for i := 0; i < len(items) && i < v.Len(); i++ {
+			if err := decodeReplayValue(items[i], v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return json.Unmarshal(data, v.Addr().Interface())
+		}
+		var entries map[string]json.RawMessage
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return err
+		}
+		v.Set(reflect.MakeMapWithSize(v.Type(), len(entries)))
+		for k, raw := range entries {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeReplayValue(raw, elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), elem)
+		}
+	default:
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package libprobe_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/go-ping/ping"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionReplay(t *testing.T) {
+	var session bytes.Buffer
+	recorder := libprobe.NewSessionRecorder(&session)
+
+	prober := recorder.Prober(funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		if target.Address == "down:1" {
+			return nil, errors.New("no route")
+		}
+		return &libprobe.TCPResult{Target: target, Error: errors.New("refused"), ConnectTime: time.Millisecond}, nil
+	}})
+	require.Equal(t, "FAKE", prober.Kind())
+	_, err := prober.Probe(libprobe.Target{Address: "a:1", Metadata: map[string]string{"env": "test"}})
+	require.NoError(t, err)
+	_, err = prober.Probe(libprobe.Target{Address: "down:1"})
+	require.EqualError(t, err, "no route")
+
+	icmp := &libprobe.ICMPResult{
+		Target: libprobe.Target{Address: "192.0.2.1"},
+		Stats: &ping.Statistics{
+			PacketsSent: 2, PacketsRecv: 1, PacketLoss: 50,
+			IPAddr: &net.IPAddr{IP: net.ParseIP("192.0.2.1")},
+			Rtts:   []time.Duration{3 * time.Millisecond},
+			AvgRtt: 3 * time.Millisecond,
+		},
+	}
+	require.NoError(t, recorder.Write(&libprobe.ScheduledResult{Result: icmp, ScheduleMode: "adaptive", ScheduleInterval: time.Second}))
+
+	probes, err := libprobe.ReadSession(&session)
+	require.NoError(t, err)
+	require.Len(t, probes, 3)
+	require.Equal(t, "FAKE", probes[0].Kind)
+	tcp := probes[0].Result.(*libprobe.TCPResult)
+	require.EqualError(t, tcp.Error, "refused")
+	require.Equal(t, time.Millisecond, tcp.ConnectTime)
+	require.Equal(t, "test", tcp.Metadata["env"])
+	require.Nil(t, probes[1].Result)
+	require.EqualError(t, probes[1].Err, "no route")
+	require.Equal(t, "ICMP", probes[2].Kind)
+	scheduled := probes[2].Result.(*libprobe.ScheduledResult)
+	require.Equal(t, "adaptive", scheduled.ScheduleMode)
+	require.Equal(t, icmp, scheduled.Result)
+
+	sink := &memorySink{results: make(chan libprobe.Result, 10)}
+	require.NoError(t, libprobe.Replay(probes, libprobe.ReplayOptions{Sinks: []libprobe.Sink{sink}}))
+	require.Len(t, sink.results, 2)
+	require.Equal(t, probes[0].Result, <-sink.results)
+
+	dir, err := ioutil.TempDir("", "golden")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	golden := filepath.Join(dir, "session.csv")
+	results := []libprobe.Result{probes[0].Result, probes[2].Result}
+	require.Error(t, libprobe.CompareGolden(golden, results, libprobe.GoldenOptions{}))
+	require.NoError(t, libprobe.CompareGolden(golden, results, libprobe.GoldenOptions{Update: true}))
+	require.NoError(t, libprobe.CompareGolden(golden, results, libprobe.GoldenOptions{}))
+	tcp.ConnectTime = 2 * time.Millisecond
+	require.Error(t, libprobe.CompareGolden(golden, results, libprobe.GoldenOptions{}))
+
+	ignore := []string{libprobe.ColumnRTT, "connect_time_ns"}
+	require.NoError(t, libprobe.CompareGolden(golden, results, libprobe.GoldenOptions{Update: true, Ignore: ignore}))
+	tcp.ConnectTime = 3 * time.Millisecond
+	require.NoError(t, libprobe.CompareGolden(golden, results, libprobe.GoldenOptions{Ignore: ignore}))
+
+	_, err = libprobe.ReadSession(bytes.NewBufferString(`{"result":{"type":"NopeResult","value":{}}}`))
+	require.Error(t, err)
+}
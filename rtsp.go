@@ -0,0 +1,388 @@
+package libprobe
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const KindRTSP = "RTSP"
+
+// rtspMaxBody bounds the bodies read, session descriptions being small.
+const rtspMaxBody = 64 << 10
+
+// RTSPProberOptions configures an RTSPProber.
+type RTSPProberOptions struct {
+	// Describe requests the session description of the stream after
+	// OPTIONS.
+	Describe bool
+	// Username and Password answer authentication challenges, with Digest
+	// or, over TLS only, Basic authentication.
+	Username string
+	Password string
+	// TLSConfig configures TLS, used by rtsps URLs. Its ServerName defaults
+	// to the host dialed.
+	TLSConfig *tls.Config
+}
+
+// RTSPResult describes the responses of an RTSP server.
+type RTSPResult struct {
+	Target
+	Error error
+
+	URL              string
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	// OptionsTime and DescribeTime are the times of the requests, their
+	// authentication challenge included.
+	OptionsTime  time.Duration
+	DescribeTime time.Duration
+	TotalTime    time.Duration
+	// StatusCode and Reason are those of the last response.
+	StatusCode int
+	Reason     string
+	Server     string
+	// Methods are the methods supported, from the Public header.
+	Methods []string
+	// Media are the streams of the session description, as media type and
+	// encoding, e.g. "video/H264" and "audio/PCMA".
+	Media []string
+}
+
+func (r RTSPResult) RTT() time.Duration {
+	return r.OptionsTime
+}
+
+func (r RTSPResult) String() string {
+	if r.Error != nil && r.StatusCode == 0 {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	s := fmt.Sprintf("-> %s %d %s Options: %s, Describe: %s. Total: %s", r.URL, r.StatusCode, r.Reason, r.OptionsTime, r.DescribeTime, r.TotalTime)
+	if len(r.Media) > 0 {
+		s += "\nMedia: " + strings.Join(r.Media, ", ")
+	}
+	return s
+}
+
+// RTSPProber sends OPTIONS, and optionally DESCRIBE, to the stream in
+// Target.Address, an rtsp or rtsps URL such as "rtsp://camera/stream1" or
+// "host[:port]", as for cameras and streaming servers. The probe fails
+// unless the responses are 200 OK.
+type RTSPProber struct {
+	opts RTSPProberOptions
+}
+
+func NewRTSPProber(opts RTSPProberOptions) *RTSPProber {
+	return &RTSPProber{opts: opts}
+}
+
+func (p *RTSPProber) Kind() string {
+	return KindRTSP
+}
+
+func (p *RTSPProber) Probe(target Target) (Result, error) {
+	raw := target.Address
+	if !strings.Contains(raw, "://") {
+		raw = "rtsp://" + raw + "/"
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtsp" && u.Scheme != "rtsps" {
+		return nil, fmt.Errorf("rtsp: unsupported scheme %q", u.Scheme)
+	}
+	// Credentials in the URL, common with cameras, are sent as options.
+	username, password := p.opts.Username, p.opts.Password
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+		u.User = nil
+	}
+	address := u.Host
+	if u.Port() == "" {
+		port := "554"
+		if u.Scheme == "rtsps" {
+			port = "322"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+	r := &RTSPResult{Target: target, URL: u.String()}
+
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+	if u.Scheme == "rtsps" {
+		handshakeAt := time.Now()
+		tlsConn := tls.Client(conn, mailTLSConfig(p.opts.TLSConfig, address))
+		if err := tlsConn.Handshake(); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.TLSHandshakeTime = time.Since(handshakeAt)
+		conn = tlsConn
+	}
+	c := &rtspConn{
+		conn:     conn,
+		br:       bufio.NewReader(conn),
+		username: username,
+		password: password,
+		secure:   u.Scheme == "rtsps",
+	}
+
+	requestAt := time.Now()
+	resp, err := c.do("OPTIONS", r.URL, nil)
+	r.OptionsTime = time.Since(requestAt)
+	if r.Error = p.check(r, resp, err); r.Error != nil {
+		return r, nil
+	}
+	r.Server = resp.header.Get("Server")
+	r.Methods = sipList(resp.header["Public"])
+
+	if p.opts.Describe {
+		requestAt = time.Now()
+		resp, err = c.do("DESCRIBE", r.URL, textproto.MIMEHeader{"Accept": {"application/sdp"}})
+		r.DescribeTime = time.Since(requestAt)
+		if r.Error = p.check(r, resp, err); r.Error != nil {
+			return r, nil
+		}
+		r.Media = parseSDPMedia(resp.body)
+	}
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+// check records the status of resp, returning the error of the request.
+func (p *RTSPProber) check(r *RTSPResult, resp *rtspResponse, err error) error {
+	if err != nil {
+		return err
+	}
+	r.StatusCode, r.Reason = resp.code, resp.reason
+	if resp.code != 200 {
+		return fmt.Errorf("rtsp: %d %s", resp.code, resp.reason)
+	}
+	return nil
+}
+
+// rtspConn sends requests one at a time, authenticating them once
+// challenged.
+type rtspConn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	cseq     int
+	username string
+	password string
+	secure   bool
+	// challenge is the Digest challenge answered, nil before any.
+	challenge map[string]string
+	nc        int
+	basic     bool
+}
+
+type rtspResponse struct {
+	code   int
+	reason string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// do sends a request, answering an authentication challenge once.
+func (c *rtspConn) do(method, uri string, header textproto.MIMEHeader) (*rtspResponse, error) {
+	resp, err := c.roundTrip(method, uri, header)
+	if err != nil || resp.code != 401 || c.username == "" || c.challenge != nil || c.basic {
+		return resp, err
+	}
+	basic := false
+	for _, v := range resp.header["Www-Authenticate"] {
+		scheme, params := parseRTSPChallenge(v)
+		switch {
+		case strings.EqualFold(scheme, "Digest") && params["nonce"] != "":
+			c.challenge = params
+		case strings.EqualFold(scheme, "Basic"):
+			basic = true
+		}
+	}
+	// Basic authentication sends the password in the clear, so only over
+	// TLS, and Digest is preferred.
+	c.basic = c.challenge == nil && basic && c.secure
+	if c.challenge == nil && !c.basic {
+		return resp, nil
+	}
+	return c.roundTrip(method, uri, header)
+}
+
+func (c *rtspConn) roundTrip(method, uri string, header textproto.MIMEHeader) (*rtspResponse, error) {
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: %s\r\n", method, uri, c.cseq, UserAgent())
+	for name, values := range header {
+		for _, v := range values {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, v)
+		}
+	}
+	if auth := c.authorization(method, uri); auth != "" {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", auth)
+	}
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		// Responses to earlier requests, e.g. answered late, are skipped.
+		if resp.header.Get("CSeq") == strconv.Itoa(c.cseq) {
+			return resp, nil
+		}
+	}
+}
+
+func (c *rtspConn) readResponse() (*rtspResponse, error) {
+	tp := textproto.NewReader(c.br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	version, status, ok := strings.Cut(line, " ")
+	if !ok || !strings.HasPrefix(version, "RTSP/") {
+		return nil, errors.New("rtsp: malformed status line")
+	}
+	codeText, reason, _ := strings.Cut(status, " ")
+	code, err := strconv.Atoi(codeText)
+	if err != nil {
+		return nil, errors.New("rtsp: malformed status line")
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	resp := &rtspResponse{code: code, reason: reason, header: header}
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		if n > rtspMaxBody {
+			return nil, errors.New("rtsp: body too large")
+		}
+		resp.body = make([]byte, n)
+		if _, err := io.ReadFull(c.br, resp.body); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// authorization returns the Authorization header of a request, empty
+// before any challenge.
+func (c *rtspConn) authorization(method, uri string) string {
+	if c.basic {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+	}
+	if c.challenge == nil {
+		return ""
+	}
+	md5hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	realm, nonce := c.challenge["realm"], c.challenge["nonce"]
+	ha1 := md5hex(c.username + ":" + realm + ":" + c.password)
+	ha2 := md5hex(method + ":" + uri)
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, c.username, realm, nonce, uri)
+	// Cameras rarely ask for qop, as RFC 2069 digests predate it.
+	qopAuth := false
+	for _, qop := range strings.Split(c.challenge["qop"], ",") {
+		qopAuth = qopAuth || strings.TrimSpace(qop) == "auth"
+	}
+	if qopAuth {
+		c.nc++
+		cnonce := randomID()[:16]
+		nc := fmt.Sprintf("%08x", c.nc)
+		response := md5hex(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+		auth += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, response)
+	} else {
+		auth += fmt.Sprintf(`, response="%s"`, md5hex(ha1+":"+nonce+":"+ha2))
+	}
+	if opaque, ok := c.challenge["opaque"]; ok {
+		auth += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return auth
+}
+
+// parseRTSPChallenge parses a WWW-Authenticate header into its scheme and
+// parameters.
+func parseRTSPChallenge(v string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(v), " ")
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(rest, ", ") {
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.IndexByte(value[1:], '"')
+			if end < 0 {
+				break
+			}
+			params[name], rest = value[1:1+end], value[2+end:]
+			continue
+		}
+		value, rest, _ = strings.Cut(value, ",")
+		params[name] = strings.TrimSpace(value)
+	}
+	return scheme, params
+}
+
+// parseSDPMedia returns the media of a session description (RFC 8866) as
+// media type and encoding of their first format.
+func parseSDPMedia(sdp []byte) []string {
+	var media []string
+	var format string
+	encodings := make(map[string]string)
+	flush := func() {
+		if len(media) == 0 {
+			return
+		}
+		if enc, ok := encodings[format]; ok {
+			media[len(media)-1] += "/" + enc
+		}
+	}
+	for _, line := range strings.Split(string(sdp), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			flush()
+			format, encodings = "", make(map[string]string)
+			if fields := strings.Fields(line[2:]); len(fields) >= 4 {
+				media = append(media, fields[0])
+				format = fields[3]
+			}
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			pt, enc, _ := strings.Cut(line[len("a=rtpmap:"):], " ")
+			enc, _, _ = strings.Cut(enc, "/")
+			encodings[pt] = enc
+		}
+	}
+	flush()
+	return media
+}
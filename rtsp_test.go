@@ -0,0 +1,97 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"crypto/md5"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveRTSP serves a camera answering OPTIONS freely and DESCRIBE with
+// Digest authentication of admin, password "secret".
+func serveRTSP(t *testing.T) string {
+	const sdp = "v=0\r\n" +
+		"o=- 1 1 IN IP4 0.0.0.0\r\n" +
+		"s=Session\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=control:track1\r\n" +
+		"m=audio 0 RTP/AVP 8\r\n" +
+		"a=rtpmap:8 PCMA/8000\r\n" +
+		"m=application 0 RTP/AVP 107\r\n"
+	return serveLegacy(t, func(conn net.Conn) {
+		tp := textproto.NewReader(bufio.NewReader(conn))
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			header, err := tp.ReadMIMEHeader()
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			method, uri := fields[0], fields[1]
+			reply := "RTSP/1.0 200 OK\r\nCSeq: " + header.Get("CSeq") + "\r\nServer: Hikvision-Webs\r\n"
+			switch method {
+			case "OPTIONS":
+				reply += "Public: OPTIONS, DESCRIBE, SETUP, TEARDOWN, PLAY\r\n\r\n"
+			case "DESCRIBE":
+				ha1 := fmt.Sprintf("%x", md5.Sum([]byte("admin:IP Camera:secret")))
+				ha2 := fmt.Sprintf("%x", md5.Sum([]byte(method+":"+uri)))
+				want := fmt.Sprintf(`response="%x"`, md5.Sum([]byte(ha1+":4a6f7e2b:"+ha2)))
+				if !strings.Contains(header.Get("Authorization"), want) {
+					reply = "RTSP/1.0 401 Unauthorized\r\nCSeq: " + header.Get("CSeq") + "\r\n" +
+						"WWW-Authenticate: Basic realm=\"IP Camera\"\r\n" +
+						"WWW-Authenticate: Digest realm=\"IP Camera\", nonce=\"4a6f7e2b\", stale=\"FALSE\"\r\n\r\n"
+					break
+				}
+				reply += fmt.Sprintf("Content-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s", len(sdp), sdp)
+			}
+			conn.Write([]byte(reply))
+		}
+	})
+}
+
+func TestRTSPProber(t *testing.T) {
+	address := serveRTSP(t)
+	p := libprobe.NewRTSPProber(libprobe.RTSPProberOptions{Describe: true, Username: "admin", Password: "secret"})
+	require.Equal(t, libprobe.KindRTSP, p.Kind())
+	r, err := p.Probe(libprobe.Target{Address: "rtsp://" + address + "/Streaming/Channels/101", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.RTSPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "Hikvision-Webs", res.Server)
+	require.Equal(t, []string{"OPTIONS", "DESCRIBE", "SETUP", "TEARDOWN", "PLAY"}, res.Methods)
+	require.Equal(t, []string{"video/H264", "audio/PCMA", "application"}, res.Media)
+	require.Positive(t, res.OptionsTime)
+	require.Positive(t, res.DescribeTime)
+
+	// Credentials may be in the URL.
+	r, err = libprobe.NewRTSPProber(libprobe.RTSPProberOptions{Describe: true}).Probe(libprobe.Target{Address: "rtsp://admin:secret@" + address + "/", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.NoError(t, r.(*libprobe.RTSPResult).Error)
+
+	r, err = libprobe.NewRTSPProber(libprobe.RTSPProberOptions{Describe: true, Username: "admin", Password: "wrong"}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.RTSPResult)
+	require.EqualError(t, res.Error, "rtsp: 401 Unauthorized")
+	require.Equal(t, 401, res.StatusCode)
+
+	// Without DESCRIBE, OPTIONS needs no credentials.
+	r, err = libprobe.NewRTSPProber(libprobe.RTSPProberOptions{}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.RTSPResult)
+	require.NoError(t, res.Error)
+	require.Nil(t, res.Media)
+}
@@ -0,0 +1,204 @@
+package libprobe
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Schedule modes of a job, recorded in ScheduledResult.
+const (
+	// ScheduleNormal probes every Job.Interval.
+	ScheduleNormal = "normal"
+	// ScheduleBurst probes a degraded target every MinInterval.
+	ScheduleBurst = "burst"
+	// ScheduleRelaxed probes a healthy target less often than Interval.
+	ScheduleRelaxed = "relaxed"
+	// ScheduleBackoff probes a persistently failing target less and less
+	// often.
+	ScheduleBackoff = "backoff"
+)
+
+// AdaptiveInterval adapts the probe frequency of a job to the health of its
+// target: a degraded result switches to burst mode, probing every
+// MinInterval; RecoverAfter healthy results in a row return to Interval, and
+// every further RelaxAfter healthy results in a row double the interval up
+// to MaxInterval.
+type AdaptiveInterval struct {
+	// MinInterval is the interval in burst mode. Default: Interval/5.
+	MinInterval time.Duration
+	// MaxInterval bounds the interval of healthy targets. Default:
+	// 4*Interval.
+	MaxInterval time.Duration
+	// RecoverAfter is the number of healthy results ending burst mode.
+	// Default: 3.
+	RecoverAfter int
+	// RelaxAfter is the number of healthy results after which the interval
+	// is doubled. Default: 10.
+	RelaxAfter int
+	// LatencyThreshold also considers successful results degraded when
+	// their RTT exceeds it. Default: 0, only failures are degraded.
+	LatencyThreshold time.Duration
+}
+
+// FailureBackoff backs off from persistently failing targets, so dead hosts
+// aren't probed at full rate forever: from the After-th failure in a row on,
+// the interval starts at Floor and is multiplied by Factor after every
+// further failure, up to Ceiling. The first success resets the interval.
+// Backoff takes precedence over the burst mode of AdaptiveInterval.
+type FailureBackoff struct {
+	// After is the number of failures in a row starting the backoff.
+	// Default: 3.
+	After int
+	// Floor is the first backed off interval. Default: 2*Interval.
+	Floor time.Duration
+	// Ceiling bounds the backed off interval. Default: 64*Interval.
+	Ceiling time.Duration
+	// Factor is the growth of the interval per failure. Default: 2.
+	Factor float64
+}
+
+// ScheduledResult decorates a result with the schedule its job was in when
+// the probe started.
+type ScheduledResult struct {
+	Result
+	ScheduleMode     string
+	ScheduleInterval time.Duration
+}
+
+func (r *ScheduledResult) Unwrap() Result {
+	return r.Result
+}
+
+// jobSchedule tracks the interval of a job as its results come in.
+type jobSchedule struct {
+	job      Job
+	adaptive AdaptiveInterval
+	backoff  FailureBackoff
+	// changed is signalled when the interval changes.
+	changed chan struct{}
+
+	mu       sync.Mutex
+	mode     string
+	interval time.Duration
+	healthy  int
+	failures int
+}
+
+func newJobSchedule(job Job) *jobSchedule {
+	s := &jobSchedule{job: job, mode: ScheduleNormal, interval: job.Interval, changed: make(chan struct{}, 1)}
+	if job.Adaptive != nil {
+		a := *job.Adaptive
+		if a.MinInterval <= 0 {
+			a.MinInterval = job.Interval / 5
+		}
+		if a.MaxInterval <= 0 {
+			a.MaxInterval = 4 * job.Interval
+		}
+		if a.RecoverAfter <= 0 {
+			a.RecoverAfter = 3
+		}
+		if a.RelaxAfter <= 0 {
+			a.RelaxAfter = 10
+		}
+		s.adaptive = a
+	}
+	if job.Backoff != nil {
+		b := *job.Backoff
+		if b.After <= 0 {
+			b.After = 3
+		}
+		if b.Floor <= 0 {
+			b.Floor = 2 * job.Interval
+		}
+		if b.Ceiling < b.Floor {
+			b.Ceiling = 64 * job.Interval
+			if b.Ceiling < b.Floor {
+				b.Ceiling = b.Floor
+			}
+		}
+		if b.Factor < 1 {
+			b.Factor = 2
+		}
+		s.backoff = b
+	}
+	return s
+}
+
+// scheduled reports whether results of the job are wrapped in
+// ScheduledResult.
+func (s *jobSchedule) scheduled() bool {
+	return s.job.Adaptive != nil || s.job.Backoff != nil
+}
+
+// nextDelay returns the delay until the next probe, spaced like the job.
+func (s *jobSchedule) nextDelay() time.Duration {
+	s.mu.Lock()
+	job := s.job
+	job.Interval = s.interval
+	s.mu.Unlock()
+	return job.NextDelay()
+}
+
+func (s *jobSchedule) state() (string, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mode, s.interval
+}
+
+// observe updates the schedule with the outcome of a probe.
+func (s *jobSchedule) observe(r Result, err error) {
+	if !s.scheduled() {
+		return
+	}
+	failed := err != nil || !resultOK(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func(interval time.Duration) {
+		if s.interval != interval {
+			select {
+			case s.changed <- struct{}{}:
+			default:
+			}
+		}
+	}(s.interval)
+
+	if failed {
+		s.failures++
+	} else {
+		s.failures = 0
+	}
+	if b := s.backoff; s.job.Backoff != nil {
+		if n := s.failures - b.After; n >= 0 {
+			interval := float64(b.Floor) * math.Pow(b.Factor, float64(n))
+			s.mode, s.interval, s.healthy = ScheduleBackoff, time.Duration(math.Min(interval, float64(b.Ceiling))), 0
+			return
+		}
+		if s.mode == ScheduleBackoff {
+			s.mode, s.interval = ScheduleNormal, s.job.Interval
+		}
+	}
+	if s.job.Adaptive == nil {
+		return
+	}
+	a := s.adaptive
+	if failed || (a.LatencyThreshold > 0 && r.RTT() > a.LatencyThreshold) {
+		s.mode, s.interval, s.healthy = ScheduleBurst, a.MinInterval, 0
+		return
+	}
+	s.healthy++
+	switch {
+	case s.mode == ScheduleBurst:
+		if s.healthy >= a.RecoverAfter {
+			s.mode, s.interval, s.healthy = ScheduleNormal, s.job.Interval, 0
+		}
+	case s.healthy >= a.RelaxAfter:
+		s.healthy = 0
+		if s.interval *= 2; s.interval > a.MaxInterval {
+			s.interval = a.MaxInterval
+		}
+		if s.interval > s.job.Interval {
+			s.mode = ScheduleRelaxed
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package libprobe_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func collectResults(t *testing.T, sink *memorySink, n int) []libprobe.Result {
+	var results []libprobe.Result
+	for i := 0; i < n; i++ {
+		select {
+		case r := <-sink.results:
+			results = append(results, r)
+		case <-time.After(3 * time.Second):
+			t.Fatal("no result delivered")
+		}
+	}
+	return results
+}
+
+func TestEngineAdaptiveInterval(t *testing.T) {
+	var calls int32
+	prober := funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		if atomic.AddInt32(&calls, 1) <= 3 {
+			return &libprobe.TCPResult{Target: target, Error: errors.New("refused")}, nil
+		}
+		return &libprobe.TCPResult{Target: target, ConnectTime: time.Millisecond}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 100)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}})
+	require.NoError(t, engine.Add(libprobe.Job{
+		Prober:   prober,
+		Target:   libprobe.Target{Address: "a:1"},
+		Interval: time.Hour,
+		Adaptive: &libprobe.AdaptiveInterval{MinInterval: 10 * time.Millisecond, RecoverAfter: 2},
+	}))
+	engine.Start()
+	defer engine.Stop()
+
+	var modes []string
+	for _, r := range collectResults(t, sink, 5) {
+		modes = append(modes, r.(*libprobe.ScheduledResult).ScheduleMode)
+	}
+	require.Equal(t, []string{"normal", "burst", "burst", "burst", "burst"}, modes)
+	select {
+	case <-sink.results:
+		t.Fatal("probed in burst mode after recovering")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Equal(t, "normal", libprobe.Flatten(libprobe.Result(&libprobe.ScheduledResult{
+		Result:       &libprobe.TCPResult{},
+		ScheduleMode: "normal",
+	}))[0]["schedule_mode"])
+}
+
+func TestEngineAdaptiveIntervalRelax(t *testing.T) {
+	prober := funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		return &libprobe.TCPResult{Target: target}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 100)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}})
+	require.NoError(t, engine.Add(libprobe.Job{
+		Prober:   prober,
+		Target:   libprobe.Target{Address: "a:1"},
+		Interval: 10 * time.Millisecond,
+		Adaptive: &libprobe.AdaptiveInterval{MaxInterval: 30 * time.Millisecond, RelaxAfter: 2},
+	}))
+	engine.Start()
+	defer engine.Stop()
+
+	var intervals []time.Duration
+	for _, r := range collectResults(t, sink, 6) {
+		intervals = append(intervals, r.(*libprobe.ScheduledResult).ScheduleInterval)
+	}
+	ms := time.Millisecond
+	require.Equal(t, []time.Duration{10 * ms, 10 * ms, 20 * ms, 20 * ms, 30 * ms, 30 * ms}, intervals)
+}
+
+func TestEngineFailureBackoff(t *testing.T) {
+	var calls int32
+	prober := funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		if atomic.AddInt32(&calls, 1) <= 5 {
+			return nil, errors.New("no route to host")
+		}
+		return &libprobe.TCPResult{Target: target}, nil
+	}}
+	var results []libprobe.Result
+	done := make(chan struct{})
+	engine := libprobe.NewEngine(libprobe.EngineOptions{OnResult: func(job libprobe.Job, r libprobe.Result, err error) {
+		if len(results) < 7 {
+			results = append(results, r)
+			if len(results) == 7 {
+				close(done)
+			}
+		}
+	}})
+	require.NoError(t, engine.Add(libprobe.Job{
+		Prober:   prober,
+		Target:   libprobe.Target{Address: "a:1"},
+		Interval: 5 * time.Millisecond,
+		Backoff:  &libprobe.FailureBackoff{After: 2, Floor: 10 * time.Millisecond, Ceiling: 40 * time.Millisecond},
+	}))
+	engine.Start()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no result delivered")
+	}
+	engine.Stop()
+
+	// Failed probes without a result are not recorded, the schedule of the
+	// first successful probe is.
+	require.Nil(t, results[0])
+	sr := results[5].(*libprobe.ScheduledResult)
+	require.Equal(t, libprobe.ScheduleBackoff, sr.ScheduleMode)
+	require.Equal(t, 40*time.Millisecond, sr.ScheduleInterval)
+	sr = results[6].(*libprobe.ScheduledResult)
+	require.Equal(t, libprobe.ScheduleNormal, sr.ScheduleMode)
+	require.Equal(t, 5*time.Millisecond, sr.ScheduleInterval)
+}
@@ -0,0 +1,55 @@
+package libprobe
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const ipprotoSCTP = 132
+
+// dialSCTP opens a one-to-one SCTP association, used like a TCP stream.
+func dialSCTP(address string, timeout time.Duration) (net.Conn, error) {
+	if err := checkGuard("sctp", address); err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkGuard("sctp", addr.String()); err != nil {
+		return nil, err
+	}
+	family := syscall.AF_INET
+	var sa syscall.Sockaddr
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+	}
+	s, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, ipprotoSCTP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	// The send timeout bounds the blocking connect.
+	if timeout > 0 {
+		tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(s, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv); err != nil {
+			syscall.Close(s)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := syscall.Connect(s, sa); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("connect", err)
+	}
+	f := os.NewFile(uintptr(s), "sctp")
+	defer f.Close()
+	return net.FileConn(f)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package libprobe
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+func dialSCTP(address string, timeout time.Duration) (net.Conn, error) {
+	return nil, errors.New("sctp: not supported on this platform")
+}
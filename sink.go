@@ -0,0 +1,170 @@
+package libprobe
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Sink receives probe results and forwards them to an external system.
+type Sink interface {
+	Write(r Result) error
+	Close() error
+}
+
+// MarshalResultJSON encodes a result as a JSON object holding the columns of
+// its summary row. Rows expanded from slices (such as hops) are nested as
+// arrays under their row name.
+func MarshalResultJSON(r Result) ([]byte, error) {
+	rows := Flatten(r)
+	obj := make(map[string]interface{}, len(rows[0]))
+	for k, v := range rows[0] {
+		if k == ColumnRow || k == ColumnIndex {
+			continue
+		}
+		obj[k] = v
+	}
+	for _, row := range rows[1:] {
+		name, _ := row[ColumnRow].(string)
+		child := make(map[string]interface{})
+		for k, v := range row {
+			if strings.HasPrefix(k, name+"_") {
+				child[strings.TrimPrefix(k, name+"_")] = v
+			}
+		}
+		list, _ := obj[name].([]interface{})
+		obj[name] = append(list, child)
+	}
+	return json.Marshal(obj)
+}
+
+// MarshalResultProto encodes a result as a protobuf message, the binary
+// counterpart of MarshalResultJSON:
+//
+//	message Result {
+//	  string kind = 1;
+//	  string address = 2;
+//	  int64 rtt_ns = 3;
+//	  string error = 4;
+//	  map<string, Value> columns = 5; // the other columns of the summary row
+//	  repeated Row rows = 6;
+//	}
+//	message Row {
+//	  string name = 1;
+//	  int64 index = 2;
+//	  map<string, Value> columns = 3; // without the "<name>_" prefix
+//	}
+//	message Value {
+//	  oneof value {
+//	    string string_value = 1;
+//	    int64 int_value = 2;
+//	    uint64 uint_value = 3;
+//	    double double_value = 4;
+//	    bool bool_value = 5;
+//	  }
+//	}
+func MarshalResultProto(r Result) ([]byte, error) {
+	rows := Flatten(r)
+	summary := rows[0]
+	kind, _ := summary[ColumnKind].(string)
+	address, _ := summary[ColumnAddress].(string)
+	rtt, _ := summary[ColumnRTT].(int64)
+	errText, _ := summary[ColumnError].(string)
+	b := protoAppendString(nil, 1, kind)
+	b = protoAppendString(b, 2, address)
+	b = protoAppendTag(b, 3, protoVarint)
+	b = protoAppendVarint(b, uint64(rtt))
+	b = protoAppendString(b, 4, errText)
+	columns := make(Row, len(summary))
+	for k, v := range summary {
+		switch k {
+		case ColumnKind, ColumnAddress, ColumnRTT, ColumnError, ColumnRow, ColumnIndex:
+			continue
+		}
+		columns[k] = v
+	}
+	b = protoAppendColumns(b, 5, columns)
+	for _, row := range rows[1:] {
+		name, _ := row[ColumnRow].(string)
+		index, _ := row[ColumnIndex].(int64)
+		child := make(Row)
+		for k, v := range row {
+			if strings.HasPrefix(k, name+"_") {
+				child[strings.TrimPrefix(k, name+"_")] = v
+			}
+		}
+		msg := protoAppendString(nil, 1, name)
+		msg = protoAppendTag(msg, 2, protoVarint)
+		msg = protoAppendVarint(msg, uint64(index))
+		b = protoAppendBytes(b, 6, protoAppendColumns(msg, 3, child))
+	}
+	return b, nil
+}
+
+// protoAppendColumns appends the columns of a row as the map<string, Value>
+// field num of MarshalResultProto, sorted by name.
+func protoAppendColumns(b []byte, num int, row Row) []byte {
+	names := make([]string, 0, len(row))
+	for k := range row {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		var value []byte
+		switch v := row[k].(type) {
+		case string:
+			value = protoAppendString(nil, 1, v)
+		case int64:
+			value = protoAppendVarint(protoAppendTag(nil, 2, protoVarint), uint64(v))
+		case uint64:
+			value = protoAppendVarint(protoAppendTag(nil, 3, protoVarint), v)
+		case float64:
+			value = binary.LittleEndian.AppendUint64(protoAppendTag(nil, 4, protoFixed64), math.Float64bits(v))
+		case bool:
+			var bit uint64
+			if v {
+				bit = 1
+			}
+			value = protoAppendVarint(protoAppendTag(nil, 5, protoVarint), bit)
+		default:
+			continue
+		}
+		b = protoAppendBytes(b, num, protoAppendBytes(protoAppendString(nil, 1, k), 2, value))
+	}
+	return b
+}
+
+// resultOK reports whether a result represents a successful probe: it carries
+// no error and, for ICMP, at least one echo reply was received (for every
+// size in sweep mode, from any host in broadcast mode).
+func resultOK(r Result) bool {
+	if r == nil {
+		return false
+	}
+	if w, ok := r.(ResultWrapper); ok {
+		return resultOK(w.Unwrap())
+	}
+	if icmp, ok := r.(*ICMPResult); ok {
+		return icmp.Stats != nil && icmp.Stats.PacketsRecv > 0
+	}
+	if sweep, ok := r.(*ICMPSweepResult); ok {
+		for _, s := range sweep.Steps {
+			if s.PacketsRecv == 0 {
+				return false
+			}
+		}
+		return len(sweep.Steps) > 0
+	}
+	if broadcast, ok := r.(*ICMPBroadcastResult); ok {
+		return len(broadcast.Responders) > 0
+	}
+	v := reflect.Indirect(reflect.ValueOf(r))
+	if v.Kind() != reflect.Struct {
+		return true
+	}
+	f := v.FieldByName("Error")
+	return !f.IsValid() || f.Type() != errorType || f.IsNil()
+}
@@ -0,0 +1,328 @@
+package libprobe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const KindSIP = "SIP"
+
+// SIPTransport is the transport of a SIPProber.
+type SIPTransport int
+
+const (
+	SIPUDP SIPTransport = iota
+	SIPTCP
+	// SIPTLS connects with TLS, on port 5061 by default.
+	SIPTLS
+)
+
+func (t SIPTransport) String() string {
+	switch t {
+	case SIPUDP:
+		return "UDP"
+	case SIPTCP:
+		return "TCP"
+	case SIPTLS:
+		return "TLS"
+	}
+	return fmt.Sprintf("SIPTransport(%d)", int(t))
+}
+
+// sipT1 is the initial retransmission interval of requests over UDP, doubled
+// at every retransmission (RFC 3261 17.1.2.1).
+const sipT1 = 500 * time.Millisecond
+
+// sipMaxMessage bounds the messages read, OPTIONS responses describing
+// capabilities in a few headers.
+const sipMaxMessage = 64 << 10
+
+// SIPProberOptions configures a SIPProber.
+type SIPProberOptions struct {
+	Transport SIPTransport
+	// TLSConfig configures SIPTLS. Its ServerName defaults to the host
+	// dialed.
+	TLSConfig *tls.Config
+	// URI is the Request-URI. Default: "sip:" and the host dialed, or
+	// "sips:" over TLS.
+	URI string
+}
+
+// SIPResult describes the response of a SIP server to OPTIONS.
+type SIPResult struct {
+	Target
+	Error error
+
+	Transport        string
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	// ResponseTime is the time from the request to its final response, of
+	// the first transmission over UDP.
+	ResponseTime time.Duration
+	TotalTime    time.Duration
+	// Retransmissions counts the requests retransmitted over UDP.
+	Retransmissions int
+	StatusCode      int
+	Reason          string
+	// Server is the Server or User-Agent header.
+	Server string
+	// Allow are the methods supported, Supported the option tags.
+	Allow     []string
+	Supported []string
+}
+
+func (r SIPResult) RTT() time.Duration {
+	return r.ResponseTime
+}
+
+func (r SIPResult) String() string {
+	if r.Error != nil && r.StatusCode == 0 {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	return fmt.Sprintf("-> %s %s %d %s in %s, Server: %q", r.Target.Address, r.Transport, r.StatusCode, r.Reason, r.ResponseTime, r.Server)
+}
+
+// SIPProber sends an OPTIONS request to the SIP server in Target.Address,
+// "host" or "host:port" with port 5060 by default, and reports its final
+// response. Any final response shows the server is up, authentication
+// challenges included; the probe fails on server errors (5xx) and global
+// failures (6xx). Target.Timeout bounds the exchange and defaults to 32
+// seconds, the timeout of transactions over UDP.
+type SIPProber struct {
+	opts SIPProberOptions
+}
+
+func NewSIPProber(opts SIPProberOptions) *SIPProber {
+	return &SIPProber{opts: opts}
+}
+
+func (p *SIPProber) Kind() string {
+	return KindSIP
+}
+
+func (p *SIPProber) Probe(target Target) (Result, error) {
+	r := &SIPResult{Target: target, Transport: p.opts.Transport.String()}
+	network := "tcp"
+	if p.opts.Transport == SIPUDP {
+		network = "udp"
+	}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "5060"
+		if p.opts.Transport == SIPTLS {
+			port = "5061"
+		}
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	host, _, _ := net.SplitHostPort(address)
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = 64 * sipT1
+	}
+
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, network, address, timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(startAt.Add(timeout))
+	if p.opts.Transport == SIPTLS {
+		handshakeAt := time.Now()
+		tlsConn := tls.Client(conn, mailTLSConfig(p.opts.TLSConfig, address))
+		if err := tlsConn.Handshake(); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.TLSHandshakeTime = time.Since(handshakeAt)
+		conn = tlsConn
+	}
+
+	uri := p.opts.URI
+	if uri == "" {
+		scheme := "sip:"
+		if p.opts.Transport == SIPTLS {
+			scheme = "sips:"
+		}
+		uri = scheme + host
+		if strings.Contains(host, ":") {
+			uri = scheme + "[" + host + "]"
+		}
+	}
+	callID := randomID()
+	request := sipOptionsRequest(uri, conn.LocalAddr().String(), p.opts.Transport.String(), callID)
+
+	requestAt := time.Now()
+	var resp *sipResponse
+	if p.opts.Transport == SIPUDP {
+		resp, err = p.exchangeUDP(r, conn, request, callID, startAt.Add(timeout))
+	} else {
+		resp, err = p.exchangeStream(conn, request, callID)
+	}
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.ResponseTime = time.Since(requestAt)
+	r.TotalTime = time.Since(startAt)
+	r.StatusCode, r.Reason = resp.code, resp.reason
+	r.Server = resp.header.Get("Server")
+	if r.Server == "" {
+		r.Server = resp.header.Get("User-Agent")
+	}
+	r.Allow = sipList(resp.header["Allow"])
+	r.Supported = sipList(append(resp.header["Supported"], resp.header["K"]...))
+	if r.StatusCode >= 500 {
+		r.Error = fmt.Errorf("sip: %d %s", r.StatusCode, r.Reason)
+	}
+	return r, nil
+}
+
+// sipOptionsRequest returns an OPTIONS request to uri from local, the local
+// address of the transport.
+func sipOptionsRequest(uri, local, transport, callID string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "OPTIONS %s SIP/2.0\r\n", uri)
+	// rport has servers answer to the source address and port, past NATs.
+	fmt.Fprintf(&b, "Via: SIP/2.0/%s %s;branch=z9hG4bK%s;rport\r\n", transport, local, callID[:16])
+	fmt.Fprintf(&b, "Max-Forwards: 70\r\n")
+	fmt.Fprintf(&b, "To: <%s>\r\n", uri)
+	fmt.Fprintf(&b, "From: <sip:libprobe@%s>;tag=%s\r\n", local, callID[16:24])
+	fmt.Fprintf(&b, "Call-ID: %s\r\n", callID)
+	fmt.Fprintf(&b, "CSeq: 1 OPTIONS\r\n")
+	fmt.Fprintf(&b, "Accept: application/sdp\r\n")
+	fmt.Fprintf(&b, "User-Agent: %s\r\n", UserAgent())
+	fmt.Fprintf(&b, "Content-Length: 0\r\n\r\n")
+	return b.Bytes()
+}
+
+// exchangeUDP sends request, retransmitting it until a final response
+// arrives or deadline passes.
+func (p *SIPProber) exchangeUDP(r *SIPResult, conn net.Conn, request []byte, callID string, deadline time.Time) (*sipResponse, error) {
+	buf := make([]byte, sipMaxMessage)
+	interval := sipT1
+	for {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		readDeadline := time.Now().Add(interval)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		_ = conn.SetReadDeadline(readDeadline)
+		for {
+			n, err := conn.Read(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && readDeadline.Before(deadline) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			resp, err := readSIPResponse(bufio.NewReader(bytes.NewReader(buf[:n])))
+			if err != nil || resp.header.Get("Call-ID") != callID {
+				continue
+			}
+			if resp.code >= 200 {
+				return resp, nil
+			}
+			// A provisional response stops retransmissions (RFC 3261
+			// 17.1.2.2), though OPTIONS rarely gets one.
+			readDeadline = deadline
+			_ = conn.SetReadDeadline(readDeadline)
+		}
+		r.Retransmissions++
+		interval *= 2
+	}
+}
+
+// exchangeStream sends request over a stream and reads its final response.
+func (p *SIPProber) exchangeStream(conn net.Conn, request []byte, callID string) (*sipResponse, error) {
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(io.LimitReader(conn, sipMaxMessage))
+	for {
+		resp, err := readSIPResponse(br)
+		if err != nil {
+			return nil, err
+		}
+		if resp.header.Get("Call-ID") == callID && resp.code >= 200 {
+			return resp, nil
+		}
+	}
+}
+
+type sipResponse struct {
+	code   int
+	reason string
+	header textproto.MIMEHeader
+}
+
+// sipCompactHeaders maps the compact forms of the headers read to their
+// names (RFC 3261 7.3.3).
+var sipCompactHeaders = map[string]string{
+	"I": "Call-Id",
+	"L": "Content-Length",
+}
+
+// readSIPResponse reads a response, skipping its body.
+func readSIPResponse(br *bufio.Reader) (*sipResponse, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	// Keep-alives are empty lines between messages over streams.
+	for err == nil && line == "" {
+		line, err = tp.ReadLine()
+	}
+	if err != nil {
+		return nil, err
+	}
+	version, status, ok := strings.Cut(line, " ")
+	if !ok || version != "SIP/2.0" {
+		return nil, errors.New("sip: malformed status line")
+	}
+	codeText, reason, _ := strings.Cut(status, " ")
+	code, err := strconv.Atoi(codeText)
+	if err != nil || code < 100 || code > 699 {
+		return nil, errors.New("sip: malformed status line")
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil, err
+	}
+	for compact, name := range sipCompactHeaders {
+		if v, ok := header[compact]; ok {
+			header[name] = append(header[name], v...)
+		}
+	}
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		if _, err := io.CopyN(ioutil.Discard, br, int64(n)); err != nil {
+			return nil, err
+		}
+	}
+	return &sipResponse{code: code, reason: reason, header: header}, nil
+}
+
+// sipList splits comma-separated header values.
+func sipList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
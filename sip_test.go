@@ -0,0 +1,98 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sipReply answers the SIP request in request with status, copying its
+// transaction headers, the Call-ID in compact form.
+func sipReply(request []byte, status string, extra ...string) []byte {
+	tp := textproto.NewReader(bufio.NewReader(strings.NewReader(string(request))))
+	requestLine, _ := tp.ReadLine()
+	header, _ := tp.ReadMIMEHeader()
+	if !strings.HasPrefix(requestLine, "OPTIONS sip") {
+		status = "400 Bad Request"
+	}
+	lines := []string{
+		"SIP/2.0 " + status,
+		"Via: " + header.Get("Via"),
+		"From: " + header.Get("From"),
+		"To: " + header.Get("To") + ";tag=1928301774",
+		"i: " + header.Get("Call-ID"),
+		"CSeq: " + header.Get("CSeq"),
+	}
+	lines = append(lines, extra...)
+	return []byte(strings.Join(append(lines, "Content-Length: 0", "", ""), "\r\n"))
+}
+
+func TestSIPProberUDP(t *testing.T) {
+	// The first request is lost, and answered with a provisional response
+	// once retransmitted.
+	var requests int32
+	address := serveUDP(t, func(request []byte) [][]byte {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			return nil
+		}
+		return [][]byte{
+			sipReply(request, "100 Trying"),
+			sipReply(request, "200 OK", "Allow: INVITE, ACK, CANCEL, OPTIONS, BYE", "k: replaces, timer", "Server: Asterisk PBX 20.5.0"),
+		}
+	})
+	p := libprobe.NewSIPProber(libprobe.SIPProberOptions{})
+	require.Equal(t, libprobe.KindSIP, p.Kind())
+	r, err := p.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.SIPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "UDP", res.Transport)
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "OK", res.Reason)
+	require.Equal(t, 1, res.Retransmissions)
+	require.Equal(t, "Asterisk PBX 20.5.0", res.Server)
+	require.Equal(t, []string{"INVITE", "ACK", "CANCEL", "OPTIONS", "BYE"}, res.Allow)
+	require.Equal(t, []string{"replaces", "timer"}, res.Supported)
+	require.GreaterOrEqual(t, res.RTT(), 500*time.Millisecond)
+}
+
+func TestSIPProberTCP(t *testing.T) {
+	for status, failed := range map[string]bool{"404 Not Found": false, "503 Service Unavailable": true} {
+		address := serveLegacy(t, func(conn net.Conn) {
+			tp := textproto.NewReader(bufio.NewReader(conn))
+			var request []string
+			for {
+				line, err := tp.ReadLine()
+				if err != nil {
+					return
+				}
+				request = append(request, line)
+				if line == "" {
+					break
+				}
+			}
+			conn.Write([]byte("\r\n\r\n"))
+			conn.Write(sipReply([]byte(strings.Join(request, "\r\n")+"\r\n"), status, "User-Agent: FPBX-16.0"))
+			conn.Read(make([]byte, 1))
+		})
+		r, err := libprobe.NewSIPProber(libprobe.SIPProberOptions{Transport: libprobe.SIPTCP}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		res := r.(*libprobe.SIPResult)
+		require.Contains(t, res.String(), status)
+		require.Equal(t, "FPBX-16.0", res.Server)
+		require.Zero(t, res.Retransmissions)
+		if failed {
+			require.EqualError(t, res.Error, "sip: "+status)
+		} else {
+			require.NoError(t, res.Error)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package libprobe
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FormatFPing formats a result the way `fping -C <count> -q` reports a host:
+// "<address> : <rtt> <rtt> -", with round-trip times in milliseconds and a
+// "-" in place of every lost probe. This is the format parsed by Smokeping's
+// FPing probe.
+func FormatFPing(r Result) string {
+	var (
+		address string
+		samples []string
+	)
+	if row := Flatten(r)[0]; row[ColumnAddress] != nil {
+		address, _ = row[ColumnAddress].(string)
+	}
+	if icmp, ok := innermostResult(r).(*ICMPResult); ok {
+		count := icmp.GetCount()
+		if icmp.Stats != nil && icmp.Stats.PacketsSent > count {
+			count = icmp.Stats.PacketsSent
+		}
+		samples = make([]string, count)
+		for i := range samples {
+			samples[i] = "-"
+		}
+		if icmp.Stats != nil {
+			// Without sequence numbers, the replies are assumed to be the
+			// first probes.
+			sequenced := len(icmp.ReplySeqs) == len(icmp.Stats.Rtts)
+			for i, rtt := range icmp.Stats.Rtts {
+				seq := i
+				if sequenced {
+					seq = icmp.ReplySeqs[i]
+				}
+				if seq < len(samples) {
+					samples[seq] = fpingRTT(rtt)
+				}
+			}
+		}
+	} else if resultOK(r) {
+		samples = append(samples, fpingRTT(r.RTT()))
+	} else {
+		samples = append(samples, "-")
+	}
+	return fmt.Sprintf("%s : %s", address, strings.Join(samples, " "))
+}
+
+func fpingRTT(rtt time.Duration) string {
+	return fmt.Sprintf("%.2f", float64(rtt)/float64(time.Millisecond))
+}
+
+// SmokepingSink writes results in the fping format understood by Smokeping,
+// one line per result, so libprobe agents can stand in for fping.
+type SmokepingSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewSmokepingSink(w io.Writer) *SmokepingSink {
+	return &SmokepingSink{w: w}
+}
+
+func (s *SmokepingSink) Write(r Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := io.WriteString(s.w, FormatFPing(r)+"\n")
+	return err
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (s *SmokepingSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
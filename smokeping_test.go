@@ -0,0 +1,40 @@
+package libprobe_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+	"github.com/go-ping/ping"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatFPing(t *testing.T) {
+	icmp := &libprobe.ICMPResult{
+		Target: libprobe.Target{Address: "1.1.1.1", Count: 3},
+		Stats: &ping.Statistics{
+			PacketsSent: 3,
+			PacketsRecv: 2,
+			Rtts:        []time.Duration{10120 * time.Microsecond, 9870 * time.Microsecond},
+		},
+	}
+	require.Equal(t, "1.1.1.1 : 10.12 9.87 -", libprobe.FormatFPing(icmp))
+
+	// Lost probes keep their position in the sequence, also in results
+	// wrapped by the engine.
+	icmp.ReplySeqs = []int{2, 0}
+	require.Equal(t, "1.1.1.1 : 9.87 - 10.12", libprobe.FormatFPing(icmp))
+	wrapped := &libprobe.ScheduledResult{Result: &libprobe.TimestampedResult{Result: icmp}}
+	require.Equal(t, "1.1.1.1 : 9.87 - 10.12", libprobe.FormatFPing(wrapped))
+
+	tcp := &libprobe.TCPResult{Target: libprobe.Target{Address: "1.1.1.1:80"}, Error: errors.New("timeout")}
+	require.Equal(t, "1.1.1.1:80 : -", libprobe.FormatFPing(tcp))
+
+	buf := &bytes.Buffer{}
+	sink := libprobe.NewSmokepingSink(buf)
+	require.NoError(t, sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "a:1"}, ConnectTime: time.Millisecond}))
+	require.Equal(t, "a:1 : 1.00\n", buf.String())
+}
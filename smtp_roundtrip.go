@@ -0,0 +1,174 @@
+package libprobe
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+const KindSMTPRoundTrip = "SMTP_ROUNDTRIP"
+
+// smtpProbeHeader carries the token identifying a probe message.
+const smtpProbeHeader = "X-Libprobe-Probe"
+
+var errMailNotDelivered = errors.New("mail: message not delivered before the timeout")
+
+// SMTPRoundTripProberOptions configures an SMTPRoundTripProber.
+type SMTPRoundTripProberOptions struct {
+	// TLS submits with implicit TLS, as on port 465. Otherwise STARTTLS is
+	// used whenever the server offers it.
+	TLS bool
+	// Username and Password authenticate the submission with AUTH PLAIN
+	// when set.
+	Username string
+	Password string
+	From     string
+	To       string
+	// Mailbox is where the message to To is expected to arrive.
+	Mailbox MailboxOptions
+	// PollInterval is the time between two checks of the mailbox.
+	// Default: 5 seconds.
+	PollInterval time.Duration
+	// KeepMessages leaves delivered probe messages in the mailbox instead
+	// of deleting them.
+	KeepMessages bool
+	// TLSConfig is used for both the SMTP and the mailbox servers; its
+	// ServerName defaults to the host dialed.
+	TLSConfig *tls.Config
+}
+
+// SMTPRoundTripResult is the outcome of sending a message and waiting for
+// its delivery.
+type SMTPRoundTripResult struct {
+	Target
+	Error error
+
+	Token string
+	// SubmitTime is the time the SMTP submission took.
+	SubmitTime time.Duration
+	// DeliveryTime is the time from the end of the submission until the
+	// message was found, within PollInterval.
+	DeliveryTime time.Duration
+	Polls        int
+}
+
+func (r SMTPRoundTripResult) RTT() time.Duration {
+	return r.SubmitTime + r.DeliveryTime
+}
+
+func (r SMTPRoundTripResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("Error: %s", r.Error)
+	}
+	return fmt.Sprintf("-> %s submit: %s, delivery: %s (%d polls)", r.Target.Address, r.SubmitTime, r.DeliveryTime, r.Polls)
+}
+
+// SMTPRoundTripProber submits a message to the SMTP server in Target.Address
+// and polls a mailbox until it arrives, measuring end-to-end delivery.
+// Target.Timeout bounds the whole probe and defaults to two minutes.
+type SMTPRoundTripProber struct {
+	opts SMTPRoundTripProberOptions
+}
+
+func NewSMTPRoundTripProber(opts SMTPRoundTripProberOptions) *SMTPRoundTripProber {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 5 * time.Second
+	}
+	return &SMTPRoundTripProber{opts: opts}
+}
+
+func (p *SMTPRoundTripProber) Kind() string {
+	return KindSMTPRoundTrip
+}
+
+func (p *SMTPRoundTripProber) Probe(target Target) (Result, error) {
+	if target.Timeout <= 0 {
+		target.Timeout = 2 * time.Minute
+	}
+	token := make([]byte, 12)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	r := &SMTPRoundTripResult{Target: target, Token: hex.EncodeToString(token)}
+	deadline := time.Now().Add(target.Timeout)
+
+	startAt := time.Now()
+	if err := p.submit(target, r.Token, deadline); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	sentAt := time.Now()
+	r.SubmitTime = sentAt.Sub(startAt)
+
+	for {
+		r.Polls++
+		found, err := findMail(target.meter, p.opts.Mailbox, p.opts.TLSConfig, smtpProbeHeader, r.Token, !p.opts.KeepMessages, deadline)
+		if err != nil {
+			r.Error = err
+			return r, nil
+		}
+		if found {
+			r.DeliveryTime = time.Since(sentAt)
+			return r, nil
+		}
+		if time.Now().Add(p.opts.PollInterval).After(deadline) {
+			r.Error = errMailNotDelivered
+			return r, nil
+		}
+		time.Sleep(p.opts.PollInterval)
+	}
+}
+
+func (p *SMTPRoundTripProber) submit(target Target, token string, deadline time.Time) error {
+	address := target.Address
+	conn, err := dialMail(target.meter, address, p.opts.TLS, p.opts.TLSConfig, deadline)
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if !p.opts.TLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(mailTLSConfig(p.opts.TLSConfig, address)); err != nil {
+				return err
+			}
+		}
+	}
+	if p.opts.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", p.opts.Username, p.opts.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(p.opts.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(p.opts.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "From: <%s>\r\nTo: <%s>\r\nSubject: libprobe delivery probe %s\r\nDate: %s\r\nMessage-ID: <%s@libprobe>\r\n%s: %s\r\n\r\nThis message measures mail delivery and can be deleted.\r\n",
+		p.opts.From, p.opts.To, token, time.Now().Format(time.RFC1123Z), token, smtpProbeHeader, token)
+	if err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,187 @@
+package libprobe_test
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMail is a mail server accepting messages over SMTP and serving them
+// over POP3 and IMAP, just enough for the round-trip probe.
+type fakeMail struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (m *fakeMail) listen(t *testing.T, serve func(c *textproto.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c := textproto.NewConn(conn)
+				defer c.Close()
+				serve(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (m *fakeMail) smtp(c *textproto.Conn) {
+	c.PrintfLine("220 fake")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			body, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			// Deliver later, as a real server would.
+			time.AfterFunc(50*time.Millisecond, func() {
+				m.mu.Lock()
+				m.messages = append(m.messages, string(body))
+				m.mu.Unlock()
+			})
+			c.PrintfLine("250 queued")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (m *fakeMail) pop3(c *textproto.Conn) {
+	c.PrintfLine("+OK fake")
+	m.mu.Lock()
+	messages := append([]string(nil), m.messages...)
+	m.mu.Unlock()
+	deleted := make(map[int]bool)
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		var n int
+		switch fields := strings.Fields(line); fields[0] {
+		case "STAT":
+			c.PrintfLine("+OK %d 0", len(messages))
+		case "TOP":
+			fmt.Sscan(fields[1], &n)
+			c.PrintfLine("+OK")
+			w := c.DotWriter()
+			w.Write([]byte(strings.SplitN(messages[n-1], "\n\n", 2)[0] + "\n\n"))
+			w.Close()
+		case "DELE":
+			fmt.Sscan(fields[1], &n)
+			deleted[n] = true
+			c.PrintfLine("+OK")
+		case "QUIT":
+			m.mu.Lock()
+			for n := range deleted {
+				m.messages[n-1] = ""
+			}
+			m.mu.Unlock()
+			c.PrintfLine("+OK bye")
+			return
+		default:
+			c.PrintfLine("+OK")
+		}
+	}
+}
+
+func (m *fakeMail) imap(c *textproto.Conn) {
+	c.PrintfLine("* OK fake")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		tag, cmd := fields[0], fields[1]
+		switch {
+		case cmd == "UID" && fields[2] == "SEARCH":
+			value := strings.Trim(fields[len(fields)-1], `"`)
+			var uids []string
+			m.mu.Lock()
+			for i, msg := range m.messages {
+				if strings.Contains(msg, "X-Libprobe-Probe: "+value) {
+					uids = append(uids, fmt.Sprint(i+1))
+				}
+			}
+			m.mu.Unlock()
+			c.PrintfLine("* SEARCH %s", strings.Join(uids, " "))
+		case cmd == "LOGOUT":
+			c.PrintfLine("* BYE")
+			c.PrintfLine("%s OK", tag)
+			return
+		}
+		c.PrintfLine("%s OK done", tag)
+	}
+}
+
+func TestSMTPRoundTripProber(t *testing.T) {
+	m := &fakeMail{}
+	smtpAddress := m.listen(t, m.smtp)
+	for _, protocol := range []string{"pop3", "imap"} {
+		serve := m.pop3
+		if protocol == "imap" {
+			serve = m.imap
+		}
+		prober := libprobe.NewSMTPRoundTripProber(libprobe.SMTPRoundTripProberOptions{
+			From: "probe@example.com",
+			To:   "probe@example.com",
+			Mailbox: libprobe.MailboxOptions{
+				Protocol: protocol,
+				Address:  m.listen(t, serve),
+				Username: "probe",
+				Password: "secret",
+			},
+			PollInterval: 20 * time.Millisecond,
+			KeepMessages: protocol == "imap",
+		})
+		r, err := prober.Probe(libprobe.Target{Address: smtpAddress, Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		res := r.(*libprobe.SMTPRoundTripResult)
+		require.NoError(t, res.Error, protocol)
+		require.Greater(t, res.Polls, 1, protocol)
+		require.GreaterOrEqual(t, int64(res.DeliveryTime), int64(50*time.Millisecond), protocol)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.Len(t, m.messages, 2)
+	require.Empty(t, m.messages[0], "pop3 probe message not deleted")
+	require.NotEmpty(t, m.messages[1])
+}
+
+func TestSMTPRoundTripProberTimeout(t *testing.T) {
+	m := &fakeMail{}
+	prober := libprobe.NewSMTPRoundTripProber(libprobe.SMTPRoundTripProberOptions{
+		Mailbox:      libprobe.MailboxOptions{Protocol: "pop3", Address: m.listen(t, m.pop3)},
+		PollInterval: 20 * time.Millisecond,
+	})
+	// The fake server delivers messages after the timeout.
+	r, err := prober.Probe(libprobe.Target{Address: m.listen(t, m.smtp), Timeout: 30 * time.Millisecond})
+	require.NoError(t, err)
+	require.EqualError(t, r.(*libprobe.SMTPRoundTripResult).Error, "mail: message not delivered before the timeout")
+}
@@ -0,0 +1,69 @@
+package libprobe
+
+import "encoding/binary"
+
+// snappyEncode compresses src in the snappy block format, as used by the
+// Prometheus remote-write protocol. It favours simplicity over ratio: matches
+// are found with a single hash probe and emitted as 2-byte offset copies.
+func snappyEncode(src []byte) []byte {
+	dst := protoAppendVarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		block := src
+		if len(block) > 1<<16 {
+			block = block[:1<<16]
+		}
+		src = src[len(block):]
+		dst = snappyEncodeBlock(dst, block)
+	}
+	return dst
+}
+
+func snappyEncodeBlock(dst, src []byte) []byte {
+	var table [1 << 12]int // position+1 of the last 4 bytes with a hash
+	lit := 0
+	for i := 0; i+4 <= len(src); {
+		word := binary.LittleEndian.Uint32(src[i:])
+		h := word * 0x1e35a7bd >> 20
+		candidate := table[h] - 1
+		table[h] = i + 1
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != word {
+			i++
+			continue
+		}
+		n := 4
+		for i+n < len(src) && src[candidate+n] == src[i+n] {
+			n++
+		}
+		dst = snappyAppendLiteral(dst, src[lit:i])
+		dst = snappyAppendCopy(dst, i-candidate, n)
+		i += n
+		lit = i
+	}
+	return snappyAppendLiteral(dst, src[lit:])
+}
+
+func snappyAppendLiteral(dst, lit []byte) []byte {
+	switch n := len(lit) - 1; {
+	case n < 0:
+		return dst
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	default:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	}
+	return append(dst, lit...)
+}
+
+func snappyAppendCopy(dst []byte, offset, n int) []byte {
+	for n > 0 {
+		chunk := n
+		if chunk > 64 {
+			chunk = 64
+		}
+		dst = append(dst, byte(chunk-1)<<2|2, byte(offset), byte(offset>>8))
+		n -= chunk
+	}
+	return dst
+}
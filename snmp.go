@@ -0,0 +1,681 @@
+package libprobe
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	mrand "math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const KindSNMP = "SNMP"
+
+// SNMP PDU types.
+const (
+	snmpGetRequest = 0xa0
+	snmpResponse   = 0xa2
+	snmpReport     = 0xa8
+)
+
+// msgFlags of SNMPv3 messages.
+const (
+	snmpFlagAuth       = 0x01
+	snmpFlagPriv       = 0x02
+	snmpFlagReportable = 0x04
+)
+
+// snmpMaxMessage is the msgMaxSize announced, the largest UDP payload.
+const snmpMaxMessage = 65507
+
+var snmpErrorStatuses = []string{
+	"noError", "tooBig", "noSuchName", "badValue", "readOnly", "genErr",
+	"noAccess", "wrongType", "wrongLength", "wrongEncoding", "wrongValue",
+	"noCreation", "inconsistentValue", "resourceUnavailable", "commitFailed",
+	"undoFailed", "authorizationError", "notWritable", "inconsistentName",
+}
+
+// snmpUSMReports are the counters reported by agents refusing a message.
+var snmpUSMReports = map[string]string{
+	"1.3.6.1.6.3.15.1.1.1.0": "unsupported security level",
+	"1.3.6.1.6.3.15.1.1.2.0": "not in time window",
+	"1.3.6.1.6.3.15.1.1.3.0": "unknown user name",
+	"1.3.6.1.6.3.15.1.1.4.0": "unknown engine ID",
+	"1.3.6.1.6.3.15.1.1.5.0": "wrong digest",
+	"1.3.6.1.6.3.15.1.1.6.0": "decryption error",
+}
+
+const snmpNotInTimeWindow = "1.3.6.1.6.3.15.1.1.2.0"
+
+// SNMPVersion is the version of the requests of an SNMPProber.
+type SNMPVersion int
+
+const (
+	SNMPv2c SNMPVersion = iota
+	SNMPv3
+)
+
+// SNMPAuthProtocol is the authentication protocol of SNMPv3 requests.
+type SNMPAuthProtocol string
+
+const (
+	SNMPAuthNone   SNMPAuthProtocol = ""
+	SNMPAuthMD5    SNMPAuthProtocol = "MD5"
+	SNMPAuthSHA    SNMPAuthProtocol = "SHA"
+	SNMPAuthSHA256 SNMPAuthProtocol = "SHA-256"
+)
+
+// SNMPPrivProtocol is the privacy protocol of SNMPv3 requests.
+type SNMPPrivProtocol string
+
+const (
+	SNMPPrivNone SNMPPrivProtocol = ""
+	// SNMPPrivAES is AES-128 in CFB mode, as specified by RFC 3826.
+	SNMPPrivAES SNMPPrivProtocol = "AES"
+)
+
+// SNMPProberOptions configures an SNMPProber.
+type SNMPProberOptions struct {
+	Version SNMPVersion
+	// Community is the community of v2c requests. Default: "public".
+	Community string
+	// OIDs are fetched with a single GetRequest. Default: sysDescr.0 and
+	// sysUpTime.0.
+	OIDs []string
+	// User is the USM user of v3 requests, authenticated with
+	// AuthProtocol and AuthPassphrase and encrypted with PrivProtocol and
+	// PrivPassphrase when set.
+	User           string
+	AuthProtocol   SNMPAuthProtocol
+	AuthPassphrase string
+	PrivProtocol   SNMPPrivProtocol
+	PrivPassphrase string
+	// ContextName is the context of v3 requests.
+	ContextName string
+}
+
+// SNMPVarBind is a value fetched by an SNMPProber.
+type SNMPVarBind struct {
+	OID string
+	// Type is the type of the value, e.g. "OctetString", "Counter32" or
+	// "TimeTicks", or the exception replacing it: "noSuchObject",
+	// "noSuchInstance" or "endOfMibView".
+	Type string
+	// Value is the value as text: numbers in decimal, object identifiers
+	// and IP addresses dotted, and octet strings as is when printable, in
+	// hex otherwise.
+	Value string
+}
+
+type SNMPResult struct {
+	Target
+	Error error
+
+	// DiscoveryTime is the time of the SNMPv3 engine discovery,
+	// ResponseTime that of the GetRequest.
+	DiscoveryTime time.Duration
+	ResponseTime  time.Duration
+	// EngineID is the SNMPv3 engine ID of the agent, in hex.
+	EngineID string
+	VarBinds []SNMPVarBind
+}
+
+func (r SNMPResult) RTT() time.Duration {
+	return r.ResponseTime
+}
+
+func (r SNMPResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	s := fmt.Sprintf("-> %s time=%v", r.Target.Address, r.ResponseTime)
+	for _, v := range r.VarBinds {
+		s += fmt.Sprintf("\n%s = %s: %s", v.OID, v.Type, v.Value)
+	}
+	return s
+}
+
+// SNMPProber fetches OIDs from the SNMP agent in Target.Address, "host" or
+// "host:port" with port 161 by default, with a GetRequest. Missing OIDs
+// fail the probe. Target.Timeout defaults to five seconds.
+type SNMPProber struct {
+	opts SNMPProberOptions
+
+	mu sync.Mutex
+	// keys are the localized v3 keys, by engine ID.
+	keys map[string]snmpKeys
+}
+
+type snmpKeys struct {
+	auth, priv []byte
+}
+
+func NewSNMPProber(opts SNMPProberOptions) *SNMPProber {
+	if opts.Community == "" {
+		opts.Community = "public"
+	}
+	if opts.OIDs == nil {
+		opts.OIDs = []string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.3.0"}
+	}
+	return &SNMPProber{opts: opts, keys: make(map[string]snmpKeys)}
+}
+
+func (p *SNMPProber) Kind() string {
+	return KindSNMP
+}
+
+func (p *SNMPProber) Probe(target Target) (Result, error) {
+	r := &SNMPResult{Target: target}
+	var oids [][]byte
+	for _, oid := range p.opts.OIDs {
+		b, err := berObjectIdentifier(oid)
+		if err != nil {
+			return nil, fmt.Errorf("snmp: invalid OID %q", oid)
+		}
+		oids = append(oids, b)
+	}
+	s := &snmpSession{opts: &p.opts}
+	if p.opts.Version == SNMPv3 {
+		if err := s.setProtocols(); err != nil {
+			return nil, err
+		}
+	}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "161")
+	}
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	conn, err := dialTimeout(target.meter, "udp", address, timeout)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	s.conn = conn
+
+	var pdu berElement
+	if p.opts.Version == SNMPv3 {
+		discoveryAt := time.Now()
+		if err := s.discover(); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.DiscoveryTime = time.Since(discoveryAt)
+		r.EngineID = hex.EncodeToString(s.engineID)
+		if s.keys, err = p.localizedKeys(s); err != nil {
+			return nil, err
+		}
+		startAt := time.Now()
+		pdu, err = s.getV3(oids)
+		r.ResponseTime = time.Since(startAt)
+	} else {
+		startAt := time.Now()
+		pdu, err = s.getV2c(oids)
+		r.ResponseTime = time.Since(startAt)
+	}
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.VarBinds, r.Error = snmpVarBinds(pdu)
+	return r, nil
+}
+
+// localizedKeys returns the keys of the v3 credentials localized to the
+// engine of s, computing them once per engine as that takes hashing a
+// megabyte per key.
+func (p *SNMPProber) localizedKeys(s *snmpSession) (snmpKeys, error) {
+	if s.hash == nil {
+		return snmpKeys{}, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if keys, ok := p.keys[string(s.engineID)]; ok {
+		return keys, nil
+	}
+	if len(p.opts.AuthPassphrase) < 8 {
+		return snmpKeys{}, errors.New("snmp: the authentication passphrase must have at least 8 characters")
+	}
+	keys := snmpKeys{auth: snmpLocalizedKey(s.hash, p.opts.AuthPassphrase, s.engineID)}
+	if p.opts.PrivProtocol != SNMPPrivNone {
+		if len(p.opts.PrivPassphrase) < 8 {
+			return snmpKeys{}, errors.New("snmp: the privacy passphrase must have at least 8 characters")
+		}
+		keys.priv = snmpLocalizedKey(s.hash, p.opts.PrivPassphrase, s.engineID)[:16]
+	}
+	p.keys[string(s.engineID)] = keys
+	return keys, nil
+}
+
+// snmpLocalizedKey derives the key of passphrase localized to engineID, as
+// specified by RFC 3414 section A.2.
+func snmpLocalizedKey(h func() hash.Hash, passphrase string, engineID []byte) []byte {
+	d := h()
+	buf := make([]byte, 64)
+	for i := 0; i < 1<<20; i += len(buf) {
+		for j := range buf {
+			buf[j] = passphrase[(i+j)%len(passphrase)]
+		}
+		d.Write(buf)
+	}
+	key := d.Sum(nil)
+	d.Reset()
+	d.Write(key)
+	d.Write(engineID)
+	d.Write(key)
+	return d.Sum(nil)
+}
+
+// snmpSession is an exchange of an SNMPProber with an agent.
+type snmpSession struct {
+	conn net.Conn
+	opts *SNMPProberOptions
+
+	// The v3 security parameters.
+	hash      func() hash.Hash
+	macLength int
+	keys      snmpKeys
+	engineID  []byte
+	boots     int64
+	time      int64
+}
+
+func (s *snmpSession) setProtocols() error {
+	switch s.opts.AuthProtocol {
+	case SNMPAuthNone:
+		if s.opts.PrivProtocol != SNMPPrivNone {
+			return errors.New("snmp: privacy requires authentication")
+		}
+	case SNMPAuthMD5:
+		s.hash, s.macLength = md5.New, 12
+	case SNMPAuthSHA:
+		s.hash, s.macLength = sha1.New, 12
+	case SNMPAuthSHA256:
+		s.hash, s.macLength = sha256.New, 24
+	default:
+		return fmt.Errorf("snmp: unsupported authentication protocol %q", s.opts.AuthProtocol)
+	}
+	if s.opts.PrivProtocol != SNMPPrivNone && s.opts.PrivProtocol != SNMPPrivAES {
+		return fmt.Errorf("snmp: unsupported privacy protocol %q", s.opts.PrivProtocol)
+	}
+	return nil
+}
+
+// snmpPDU encodes a PDU requesting oids.
+func snmpPDU(tag byte, id int32, oids [][]byte) []byte {
+	var binds [][]byte
+	for _, oid := range oids {
+		binds = append(binds, berTLV(berSequence, oid, berTLV(berNull)))
+	}
+	return berTLV(tag, berInt(berInteger, int64(id)), berInt(berInteger, 0), berInt(berInteger, 0), berTLV(berSequence, binds...))
+}
+
+// snmpPDUID returns the request ID of a PDU.
+func snmpPDUID(pdu berElement) (int64, error) {
+	e, _, err := berDecode(pdu.Content)
+	if err != nil || e.Tag != berInteger {
+		return 0, errors.New("snmp: malformed PDU")
+	}
+	return berParseInt(e.Content), nil
+}
+
+// exchange sends msg and returns the first reply for which parse succeeds,
+// skipping the others.
+func (s *snmpSession) exchange(msg []byte, parse func([]byte) (berElement, error)) (berElement, error) {
+	if _, err := s.conn.Write(msg); err != nil {
+		return berElement{}, err
+	}
+	buf := make([]byte, snmpMaxMessage)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return berElement{}, err
+		}
+		if pdu, err := parse(buf[:n]); err == nil {
+			return pdu, nil
+		}
+	}
+}
+
+func (s *snmpSession) getV2c(oids [][]byte) (berElement, error) {
+	id := mrand.Int31()
+	msg := berTLV(berSequence,
+		berInt(berInteger, 1),
+		berString(berOctetString, s.opts.Community),
+		snmpPDU(snmpGetRequest, id, oids))
+	return s.exchange(msg, func(b []byte) (berElement, error) {
+		msg, _, err := berDecode(b)
+		if err != nil || msg.Tag != berSequence {
+			return berElement{}, errors.New("snmp: malformed message")
+		}
+		fields, err := berChildren(msg.Content)
+		if err != nil || len(fields) != 3 || fields[2].Tag != snmpResponse {
+			return berElement{}, errors.New("snmp: malformed message")
+		}
+		if respID, err := snmpPDUID(fields[2]); err != nil || respID != int64(id) {
+			return berElement{}, errors.New("snmp: unexpected response")
+		}
+		return fields[2], nil
+	})
+}
+
+// discover learns the engine ID, boots and time of the agent, which
+// answers an empty request with a report.
+func (s *snmpSession) discover() error {
+	msgID := mrand.Int31()
+	msg, err := s.v3Message(msgID, snmpFlagReportable, snmpPDU(snmpGetRequest, mrand.Int31(), nil))
+	if err != nil {
+		return err
+	}
+	_, err = s.exchange(msg, func(b []byte) (berElement, error) {
+		m, err := s.parseV3(b, msgID)
+		if err != nil {
+			return berElement{}, err
+		}
+		if len(m.engineID) == 0 {
+			return berElement{}, errors.New("snmp: no engine ID")
+		}
+		s.engineID, s.boots, s.time = m.engineID, m.boots, m.time
+		return m.pdu, nil
+	})
+	return err
+}
+
+func (s *snmpSession) getV3(oids [][]byte) (berElement, error) {
+	flags := byte(snmpFlagReportable)
+	if s.hash != nil {
+		flags |= snmpFlagAuth
+	}
+	if s.keys.priv != nil {
+		flags |= snmpFlagPriv
+	}
+	// An agent rebooted or with a clock jump since the discovery reports
+	// its new boots and time, with which the request is retried once.
+	for attempt := 0; ; attempt++ {
+		msgID, id := mrand.Int31(), mrand.Int31()
+		msg, err := s.v3Message(msgID, flags, snmpPDU(snmpGetRequest, id, oids))
+		if err != nil {
+			return berElement{}, err
+		}
+		var m snmpV3Message
+		_, err = s.exchange(msg, func(b []byte) (berElement, error) {
+			m, err = s.parseV3(b, msgID)
+			return m.pdu, err
+		})
+		if err != nil {
+			return berElement{}, err
+		}
+		if m.pdu.Tag == snmpReport {
+			binds, _ := snmpVarBinds(m.pdu)
+			if len(binds) == 1 && binds[0].OID == snmpNotInTimeWindow && m.flags&snmpFlagAuth != 0 && attempt == 0 {
+				s.boots, s.time = m.boots, m.time
+				continue
+			}
+			if len(binds) == 1 {
+				if reason, ok := snmpUSMReports[binds[0].OID]; ok {
+					return berElement{}, fmt.Errorf("snmp: %s", reason)
+				}
+				return berElement{}, fmt.Errorf("snmp: report %s", binds[0].OID)
+			}
+			return berElement{}, errors.New("snmp: request refused")
+		}
+		if m.pdu.Tag != snmpResponse {
+			return berElement{}, errors.New("snmp: unexpected PDU")
+		}
+		if flags&snmpFlagAuth != 0 && m.flags&snmpFlagAuth == 0 {
+			return berElement{}, errors.New("snmp: unauthenticated response")
+		}
+		if respID, err := snmpPDUID(m.pdu); err != nil || respID != int64(id) {
+			return berElement{}, errors.New("snmp: unexpected response")
+		}
+		return m.pdu, nil
+	}
+}
+
+// v3Message encodes an SNMPv3 message carrying pdu, authenticated and
+// encrypted as flags says.
+func (s *snmpSession) v3Message(msgID int32, flags byte, pdu []byte) ([]byte, error) {
+	data := berTLV(berSequence, berTLV(berOctetString, s.engineID), berString(berOctetString, s.opts.ContextName), pdu)
+	var authParams, privParams []byte
+	if flags&snmpFlagPriv != 0 {
+		privParams = make([]byte, 8)
+		if _, err := rand.Read(privParams); err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(s.keys.priv)
+		if err != nil {
+			return nil, err
+		}
+		encrypted := make([]byte, len(data))
+		cipher.NewCFBEncrypter(block, snmpAESIV(s.boots, s.time, privParams)).XORKeyStream(encrypted, data)
+		data = berTLV(berOctetString, encrypted)
+	}
+	if flags&snmpFlagAuth != 0 {
+		authParams = make([]byte, s.macLength)
+	}
+	user := berString(berOctetString, "")
+	if flags&snmpFlagAuth != 0 || len(s.engineID) > 0 {
+		user = berString(berOctetString, s.opts.User)
+	}
+	auth := berTLV(berOctetString, authParams)
+	security := berTLV(berSequence,
+		berTLV(berOctetString, s.engineID),
+		berInt(berInteger, s.boots),
+		berInt(berInteger, s.time),
+		user, auth,
+		berTLV(berOctetString, privParams))
+	msg := berTLV(berSequence,
+		berInt(berInteger, 3),
+		berTLV(berSequence,
+			berInt(berInteger, int64(msgID)),
+			berInt(berInteger, snmpMaxMessage),
+			berTLV(berOctetString, []byte{flags}),
+			berInt(berInteger, 3)),
+		berTLV(berOctetString, security),
+		data)
+	if flags&snmpFlagAuth != 0 {
+		// The MAC is computed with its own placeholder zeroed.
+		i := bytes.Index(msg, append(user, auth...)) + len(user) + len(auth) - len(authParams)
+		copy(msg[i:], s.mac(msg))
+	}
+	return msg, nil
+}
+
+func (s *snmpSession) mac(msg []byte) []byte {
+	h := hmac.New(s.hash, s.keys.auth)
+	h.Write(msg)
+	return h.Sum(nil)[:s.macLength]
+}
+
+// snmpAESIV returns the IV of AES encryption from the engine boots and
+// time and the salt, as specified by RFC 3826 section 3.1.2.1.
+func snmpAESIV(boots, time int64, salt []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv, uint32(boots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(time))
+	copy(iv[8:], salt)
+	return iv
+}
+
+// snmpV3Message is a decoded SNMPv3 message.
+type snmpV3Message struct {
+	flags    byte
+	engineID []byte
+	boots    int64
+	time     int64
+	pdu      berElement
+}
+
+// parseV3 decodes the reply to the message msgID, verifying and decrypting
+// it as its flags say.
+func (s *snmpSession) parseV3(b []byte, msgID int32) (snmpV3Message, error) {
+	var m snmpV3Message
+	errMalformed := errors.New("snmp: malformed message")
+	msg, _, err := berDecode(b)
+	if err != nil || msg.Tag != berSequence {
+		return m, errMalformed
+	}
+	fields, err := berChildren(msg.Content)
+	if err != nil || len(fields) != 4 || berParseInt(fields[0].Content) != 3 {
+		return m, errMalformed
+	}
+	global, err := berChildren(fields[1].Content)
+	if err != nil || len(global) != 4 || len(global[2].Content) != 1 {
+		return m, errMalformed
+	}
+	if berParseInt(global[0].Content) != int64(msgID) {
+		return m, errors.New("snmp: unexpected message")
+	}
+	m.flags = global[2].Content[0]
+	security, _, err := berDecode(fields[2].Content)
+	if err != nil {
+		return m, errMalformed
+	}
+	params, err := berChildren(security.Content)
+	if err != nil || len(params) != 6 {
+		return m, errMalformed
+	}
+	m.engineID = params[0].Content
+	m.boots, m.time = berParseInt(params[1].Content), berParseInt(params[2].Content)
+
+	if m.flags&snmpFlagAuth != 0 {
+		authParams := params[4].Content
+		if s.hash == nil || len(authParams) != s.macLength {
+			return m, errors.New("snmp: unexpected authentication")
+		}
+		// authParams is a slice of b: their capacities, which run to the
+		// end of the buffer, give its offset.
+		i := cap(b) - cap(authParams)
+		zeroed := append([]byte(nil), b...)
+		for j := range authParams {
+			zeroed[i+j] = 0
+		}
+		if !hmac.Equal(s.mac(zeroed), authParams) {
+			return m, errors.New("snmp: wrong digest in response")
+		}
+	}
+	data := fields[3]
+	if m.flags&snmpFlagPriv != 0 {
+		if s.keys.priv == nil || data.Tag != berOctetString || len(params[5].Content) != 8 {
+			return m, errors.New("snmp: unexpected encryption")
+		}
+		block, err := aes.NewCipher(s.keys.priv)
+		if err != nil {
+			return m, err
+		}
+		decrypted := make([]byte, len(data.Content))
+		cipher.NewCFBDecrypter(block, snmpAESIV(m.boots, m.time, params[5].Content)).XORKeyStream(decrypted, data.Content)
+		if data, _, err = berDecode(decrypted); err != nil {
+			return m, errors.New("snmp: decryption failed")
+		}
+	}
+	scoped, err := berChildren(data.Content)
+	if err != nil || data.Tag != berSequence || len(scoped) != 3 {
+		return m, errMalformed
+	}
+	m.pdu = scoped[2]
+	return m, nil
+}
+
+// snmpVarBinds decodes the variable bindings of a response PDU, failing
+// with its error status or the first exception.
+func snmpVarBinds(pdu berElement) ([]SNMPVarBind, error) {
+	fields, err := berChildren(pdu.Content)
+	if err != nil || len(fields) != 4 || fields[3].Tag != berSequence {
+		return nil, errors.New("snmp: malformed PDU")
+	}
+	list, err := berChildren(fields[3].Content)
+	if err != nil {
+		return nil, errors.New("snmp: malformed PDU")
+	}
+	var binds []SNMPVarBind
+	for _, e := range list {
+		pair, err := berChildren(e.Content)
+		if err != nil || len(pair) != 2 || pair[0].Tag != berOID {
+			return nil, errors.New("snmp: malformed variable binding")
+		}
+		v := SNMPVarBind{OID: berParseObjectIdentifier(pair[0].Content)}
+		v.Type, v.Value = snmpValue(pair[1])
+		binds = append(binds, v)
+	}
+	if status := berParseInt(fields[1].Content); status != 0 {
+		name := fmt.Sprintf("error %d", status)
+		if status > 0 && status < int64(len(snmpErrorStatuses)) {
+			name = snmpErrorStatuses[status]
+		}
+		return binds, fmt.Errorf("snmp: %s at index %d", name, berParseInt(fields[2].Content))
+	}
+	for _, v := range binds {
+		if v.Type == "noSuchObject" || v.Type == "noSuchInstance" || v.Type == "endOfMibView" {
+			return binds, fmt.Errorf("snmp: %s: %s", v.OID, v.Type)
+		}
+	}
+	return binds, nil
+}
+
+// snmpValue returns the type and the text of a value.
+func snmpValue(e berElement) (string, string) {
+	switch e.Tag {
+	case berInteger:
+		return "Integer", strconv.FormatInt(berParseInt(e.Content), 10)
+	case berOctetString:
+		if snmpPrintable(e.Content) {
+			return "OctetString", string(e.Content)
+		}
+		return "OctetString", hex.EncodeToString(e.Content)
+	case berNull:
+		return "Null", ""
+	case berOID:
+		return "ObjectIdentifier", berParseObjectIdentifier(e.Content)
+	case 0x40:
+		return "IpAddress", net.IP(e.Content).String()
+	case 0x41:
+		return "Counter32", strconv.FormatUint(berParseUint(e.Content), 10)
+	case 0x42:
+		return "Gauge32", strconv.FormatUint(berParseUint(e.Content), 10)
+	case 0x43:
+		return "TimeTicks", strconv.FormatUint(berParseUint(e.Content), 10)
+	case 0x44:
+		return "Opaque", hex.EncodeToString(e.Content)
+	case 0x46:
+		return "Counter64", strconv.FormatUint(berParseUint(e.Content), 10)
+	case 0x80:
+		return "noSuchObject", ""
+	case 0x81:
+		return "noSuchInstance", ""
+	case 0x82:
+		return "endOfMibView", ""
+	}
+	return fmt.Sprintf("0x%02x", e.Tag), hex.EncodeToString(e.Content)
+}
+
+func snmpPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,225 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// snmpChildren splits the content of a constructed element.
+func snmpChildren(b []byte) (tags []byte, contents [][]byte) {
+	r := bufio.NewReader(bytes.NewReader(b))
+	for {
+		tag, content, err := readTLV(r)
+		if err != nil {
+			return tags, contents
+		}
+		tags, contents = append(tags, tag), append(contents, content)
+	}
+}
+
+func snmpInt(n uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, n)
+	for len(b) > 1 && b[0] == 0 && b[1]&0x80 == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+// snmpUint32 pads the content of an integer to four bytes.
+func snmpUint32(b []byte) []byte {
+	return append(make([]byte, 4-len(b)), b...)
+}
+
+// snmpKey localizes a SHA key, as specified by RFC 3414 section A.2.
+func snmpKey(passphrase string, engineID []byte) []byte {
+	h := sha1.New()
+	for i := 0; i < 1<<20; i++ {
+		h.Write([]byte{passphrase[i%len(passphrase)]})
+	}
+	key := h.Sum(nil)
+	h.Reset()
+	h.Write(key)
+	h.Write(engineID)
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// fakeSNMPAgent answers GetRequests for sysDescr.0 and sysUpTime.0 over
+// v2c with the community public, and over v3 for the user admin with SHA
+// and AES.
+type fakeSNMPAgent struct {
+	engineID []byte
+	authKey  []byte
+	privKey  []byte
+	// boots is reported after the first v3 request, to force a resync.
+	boots    uint32
+	requests atomic.Int32
+}
+
+// response answers the varbinds of a GetRequest.
+func (a *fakeSNMPAgent) response(pduType byte, pdu []byte) []byte {
+	_, fields := snmpChildren(pdu)
+	var binds [][]byte
+	_, list := snmpChildren(fields[3])
+	for _, bind := range list {
+		_, pair := snmpChildren(bind)
+		oid := tlv(0x06, pair[0])
+		switch hex.EncodeToString(pair[0]) {
+		case "2b06010201010100":
+			binds = append(binds, tlv(0x30, oid, tlv(0x04, []byte("Fake agent"))))
+		case "2b06010201010300":
+			binds = append(binds, tlv(0x30, oid, tlv(0x43, snmpInt(4242))))
+		default:
+			binds = append(binds, tlv(0x30, oid, tlv(0x80)))
+		}
+	}
+	return tlv(pduType, tlv(0x02, fields[0]), tlv(0x02, []byte{0}), tlv(0x02, []byte{0}), tlv(0x30, binds...))
+}
+
+func (a *fakeSNMPAgent) handle(q []byte) [][]byte {
+	_, fields := snmpChildren(q)
+	_, msg := snmpChildren(fields[0])
+	if msg[0][0] == 1 {
+		if string(msg[1]) != "public" {
+			return nil
+		}
+		return [][]byte{tlv(0x30, tlv(0x02, []byte{1}), tlv(0x04, []byte("public")), a.response(0xa2, msg[2]))}
+	}
+
+	_, global := snmpChildren(msg[1])
+	_, security := snmpChildren(msg[2])
+	_, params := snmpChildren(security[0])
+	requests := a.requests.Add(1)
+	if len(params[0]) == 0 {
+		report := tlv(0xa8, tlv(0x02, []byte{1}), tlv(0x02, []byte{0}), tlv(0x02, []byte{0}),
+			tlv(0x30, tlv(0x30, tlv(0x06, []byte{0x2b, 6, 1, 6, 3, 15, 1, 1, 4, 0}), tlv(0x41, []byte{1}))))
+		return [][]byte{a.message(global[0], 0x00, tlv(0x30, tlv(0x04, a.engineID), tlv(0x04), report))}
+	}
+
+	// Check the digest, over the message with it zeroed.
+	zeroed := bytes.Replace(q, params[4], make([]byte, 12), 1)
+	mac := hmac.New(sha1.New, a.authKey)
+	mac.Write(zeroed)
+	if !hmac.Equal(mac.Sum(nil)[:12], params[4]) {
+		return nil
+	}
+	if requests == 2 {
+		// The first authenticated request predates a reboot.
+		report := tlv(0xa8, tlv(0x02, []byte{1}), tlv(0x02, []byte{0}), tlv(0x02, []byte{0}),
+			tlv(0x30, tlv(0x30, tlv(0x06, []byte{0x2b, 6, 1, 6, 3, 15, 1, 1, 2, 0}), tlv(0x41, []byte{1}))))
+		a.boots++
+		return [][]byte{a.message(global[0], 0x01, tlv(0x30, tlv(0x04, a.engineID), tlv(0x04), report))}
+	}
+	iv := append(append(snmpUint32(params[1]), snmpUint32(params[2])...), params[5]...)
+	block, _ := aes.NewCipher(a.privKey)
+	scoped := make([]byte, len(msg[3]))
+	cipher.NewCFBDecrypter(block, iv).XORKeyStream(scoped, msg[3])
+	_, outer := snmpChildren(scoped)
+	_, pdu := snmpChildren(outer[0])
+	return [][]byte{a.message(global[0], 0x03, tlv(0x30, tlv(0x04, a.engineID), tlv(0x04), a.response(0xa2, pdu[2])))}
+}
+
+// message encodes a v3 message, encrypting and authenticating it as flags
+// say.
+func (a *fakeSNMPAgent) message(msgID []byte, flags byte, scoped []byte) []byte {
+	boots, engineTime := snmpInt(a.boots), snmpInt(100)
+	var authParams, privParams []byte
+	data := scoped
+	if flags&0x02 != 0 {
+		privParams = []byte("saltsalt")
+		iv := append(append(binary.BigEndian.AppendUint32(nil, a.boots), 0, 0, 0, 100), privParams...)
+		block, _ := aes.NewCipher(a.privKey)
+		encrypted := make([]byte, len(scoped))
+		cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted, scoped)
+		data = tlv(0x04, encrypted)
+	}
+	if flags&0x01 != 0 {
+		authParams = bytes.Repeat([]byte{0xee}, 12)
+	}
+	msg := tlv(0x30,
+		tlv(0x02, []byte{3}),
+		tlv(0x30, tlv(0x02, msgID), tlv(0x02, snmpInt(65507)), tlv(0x04, []byte{flags}), tlv(0x02, []byte{3})),
+		tlv(0x04, tlv(0x30, tlv(0x04, a.engineID), tlv(0x02, boots), tlv(0x02, engineTime), tlv(0x04, []byte("admin")), tlv(0x04, authParams), tlv(0x04, privParams))),
+		data)
+	if flags&0x01 != 0 {
+		i := bytes.Index(msg, authParams)
+		copy(msg[i:], make([]byte, 12))
+		mac := hmac.New(sha1.New, a.authKey)
+		mac.Write(msg)
+		copy(msg[i:], mac.Sum(nil)[:12])
+	}
+	return msg
+}
+
+func TestSNMPProber(t *testing.T) {
+	// The key localization of RFC 3414 section A.3.2.
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	require.Equal(t, "6695febc9288e36282235fc7151f128497b38f3f", hex.EncodeToString(snmpKey("maplesyrup", engineID)))
+
+	agent := &fakeSNMPAgent{
+		engineID: []byte("\x80\x00\x1f\x88\x04fake"),
+		boots:    1,
+	}
+	agent.authKey = snmpKey("authpass", agent.engineID)
+	agent.privKey = snmpKey("privpass", agent.engineID)[:16]
+	address := serveUDP(t, agent.handle)
+	target := libprobe.Target{Address: address, Timeout: 2 * time.Second}
+
+	r, err := libprobe.NewSNMPProber(libprobe.SNMPProberOptions{}).Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.SNMPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, []libprobe.SNMPVarBind{
+		{OID: "1.3.6.1.2.1.1.1.0", Type: "OctetString", Value: "Fake agent"},
+		{OID: "1.3.6.1.2.1.1.3.0", Type: "TimeTicks", Value: "4242"},
+	}, res.VarBinds)
+	require.Positive(t, res.RTT())
+	require.Empty(t, res.EngineID)
+
+	// Missing OIDs fail the probe, with the values fetched.
+	r, err = libprobe.NewSNMPProber(libprobe.SNMPProberOptions{OIDs: []string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.9.0"}}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.SNMPResult)
+	require.EqualError(t, res.Error, "snmp: 1.3.6.1.2.1.1.9.0: noSuchObject")
+	require.Len(t, res.VarBinds, 2)
+
+	// A wrong community goes unanswered.
+	r, err = libprobe.NewSNMPProber(libprobe.SNMPProberOptions{Community: "private"}).Probe(libprobe.Target{Address: address, Timeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+	require.Error(t, r.(*libprobe.SNMPResult).Error)
+
+	// v3 with authentication and privacy, resynchronizing once.
+	r, err = libprobe.NewSNMPProber(libprobe.SNMPProberOptions{
+		Version:        libprobe.SNMPv3,
+		User:           "admin",
+		AuthProtocol:   libprobe.SNMPAuthSHA,
+		AuthPassphrase: "authpass",
+		PrivProtocol:   libprobe.SNMPPrivAES,
+		PrivPassphrase: "privpass",
+	}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.SNMPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, hex.EncodeToString(agent.engineID), res.EngineID)
+	require.Positive(t, res.DiscoveryTime)
+	require.Equal(t, "Fake agent", res.VarBinds[0].Value)
+	require.EqualValues(t, 3, agent.requests.Load())
+
+	_, err = libprobe.NewSNMPProber(libprobe.SNMPProberOptions{Version: libprobe.SNMPv3, PrivProtocol: libprobe.SNMPPrivAES}).Probe(target)
+	require.Error(t, err)
+	_, err = libprobe.NewSNMPProber(libprobe.SNMPProberOptions{OIDs: []string{"sysDescr"}}).Probe(target)
+	require.Error(t, err)
+}
@@ -0,0 +1,247 @@
+package libprobe
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const KindSRV = "SRV"
+
+// SRVProberOptions configures an SRVProber.
+type SRVProberOptions struct {
+	// Prober probes every instance, with Target.Address set to its
+	// "host:port".
+	Prober Prober
+	// Resolver is the name server queried for the SRV records, as "host"
+	// or "host:port", or SystemResolver. Default: SystemResolver.
+	Resolver string
+}
+
+// SRVInstance is the probe of an instance of the service.
+type SRVInstance struct {
+	// Address is the "host:port" of the SRV record.
+	Address  string
+	Priority uint16
+	Weight   uint16
+	Result   Result
+	// Error is the error returned by Prober.Probe, as opposed to the Error
+	// of the result.
+	Error   error
+	Healthy bool
+}
+
+// SRVResult describes the instances of a service addressed by SRV records.
+type SRVResult struct {
+	Target
+	// Error is set when the lookup failed or no instance is healthy.
+	Error error
+
+	LookupTime time.Duration
+	// Instances are in the order a client tries them (RFC 2782): by
+	// priority, in weighted random order within a priority.
+	Instances []SRVInstance
+	Healthy   int
+	// Degraded is set when instances of the lowest priority, those clients
+	// prefer, are down, so that clients fall back on others.
+	Degraded  bool
+	TotalTime time.Duration
+}
+
+// RTT returns the RTT of the first healthy instance, the one a client
+// connects to.
+func (r SRVResult) RTT() time.Duration {
+	for _, in := range r.Instances {
+		if in.Healthy {
+			return in.Result.RTT()
+		}
+	}
+	return 0
+}
+
+func (r SRVResult) String() string {
+	if r.Error != nil && r.Instances == nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "-> %s %d/%d healthy lookup=%v", r.Target.Address, r.Healthy, len(r.Instances), r.LookupTime)
+	if r.Degraded {
+		b.WriteString(" degraded")
+	}
+	for _, in := range r.Instances {
+		state := "up"
+		if !in.Healthy {
+			state = "down"
+		}
+		fmt.Fprintf(&b, "\n  %d %d %s %s", in.Priority, in.Weight, in.Address, state)
+		if in.Error != nil {
+			fmt.Fprintf(&b, " error=%v", in.Error)
+		} else if in.Result != nil {
+			fmt.Fprintf(&b, " %v", in.Result)
+		}
+	}
+	return b.String()
+}
+
+// SRVProber resolves the SRV records of Target.Address, such as
+// "_ldap._tcp.example.com", and probes every instance concurrently with
+// Prober, reporting each and the health of the service. Target.Timeout
+// bounds the lookup, five seconds by default, and every probe.
+type SRVProber struct {
+	opts SRVProberOptions
+}
+
+func NewSRVProber(opts SRVProberOptions) *SRVProber {
+	if opts.Resolver == "" {
+		opts.Resolver = SystemResolver
+	}
+	return &SRVProber{opts: opts}
+}
+
+func (p *SRVProber) Kind() string {
+	return KindSRV
+}
+
+func (p *SRVProber) Probe(target Target) (Result, error) {
+	if p.opts.Prober == nil {
+		return nil, fmt.Errorf("srv: no prober")
+	}
+	r := &SRVResult{Target: target}
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	startAt := time.Now()
+	records, err := lookupSRV(target.meter, p.opts.Resolver, target.Address, startAt.Add(timeout))
+	r.LookupTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	if len(records) == 0 {
+		r.Error = fmt.Errorf("srv: no instance of %s", target.Address)
+		return r, nil
+	}
+
+	r.Instances = make([]SRVInstance, len(records))
+	var wg sync.WaitGroup
+	for i, record := range records {
+		r.Instances[i] = SRVInstance{
+			Address:  net.JoinHostPort(record.Target, strconv.Itoa(int(record.Port))),
+			Priority: record.Priority,
+			Weight:   record.Weight,
+		}
+		wg.Add(1)
+		go func(in *SRVInstance) {
+			defer wg.Done()
+			t := target
+			t.Address = in.Address
+			in.Result, in.Error = safeProbe(p.opts.Prober, t)
+			in.Healthy = in.Error == nil && resultOK(in.Result)
+		}(&r.Instances[i])
+	}
+	wg.Wait()
+	r.TotalTime = time.Since(startAt)
+
+	for _, in := range r.Instances {
+		if in.Healthy {
+			r.Healthy++
+		} else if in.Priority == r.Instances[0].Priority {
+			r.Degraded = true
+		}
+	}
+	if r.Healthy == 0 {
+		r.Error = fmt.Errorf("srv: no healthy instance of %s", target.Address)
+	}
+	return r, nil
+}
+
+// srvRecord is the data of an SRV record.
+type srvRecord struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// lookupSRV queries resolver, "host", "host:port" or SystemResolver, for
+// the SRV records of name, returned in the order of RFC 2782. A single
+// record of target "." says the service isn't available: none is returned.
+func lookupSRV(meter *trafficMeter, resolver, name string, deadline time.Time) ([]srvRecord, error) {
+	server := dnsServerAddress(resolver)
+	if resolver == SystemResolver {
+		var err error
+		if server, err = systemDNSServer(); err != nil {
+			return nil, err
+		}
+	}
+	id, query, err := dnsQueryWith(name, dnsmessage.TypeSRV, true, 1232)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dnsExchange(meter, "udp", server, id, query, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.RCode != dnsmessage.RCodeSuccess && resp.Header.RCode != dnsmessage.RCodeNameError {
+		return nil, fmt.Errorf("dns: %s", dnsRcodeName(resp.Header.RCode))
+	}
+	var records []srvRecord
+	for _, a := range resp.Answers {
+		if a.Type != dnsmessage.TypeSRV {
+			continue
+		}
+		var r srvRecord
+		if _, err := fmt.Sscanf(a.Data, "%d %d %d %s", &r.Priority, &r.Weight, &r.Port, &r.Target); err != nil {
+			return nil, fmt.Errorf("dns: malformed SRV record %q", a.Data)
+		}
+		if r.Target == "." {
+			continue
+		}
+		r.Target = strings.TrimSuffix(r.Target, ".")
+		records = append(records, r)
+	}
+	return srvOrder(records), nil
+}
+
+// srvOrder sorts records by priority, and within a priority picks them at
+// random with a probability proportional to their weight, records of
+// weight 0 having a small chance to be picked first (RFC 2782).
+func srvOrder(records []srvRecord) []srvRecord {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+	ordered := make([]srvRecord, 0, len(records))
+	for start := 0; start < len(records); {
+		end := start
+		for end < len(records) && records[end].Priority == records[start].Priority {
+			end++
+		}
+		group := append([]srvRecord(nil), records[start:end]...)
+		// Records of weight 0 go first, so that they are picked only when
+		// the running sum draws 0.
+		sort.SliceStable(group, func(i, j int) bool { return group[i].Weight == 0 && group[j].Weight != 0 })
+		for len(group) > 0 {
+			total := 0
+			for _, r := range group {
+				total += int(r.Weight)
+			}
+			n := rand.Intn(total + 1)
+			i, sum := 0, 0
+			for ; i < len(group)-1; i++ {
+				if sum += int(group[i].Weight); sum >= n {
+					break
+				}
+			}
+			ordered = append(ordered, group[i])
+			group = append(group[:i], group[i+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
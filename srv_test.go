@@ -0,0 +1,96 @@
+package libprobe_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveSRVRecords answers SRV queries with records.
+func serveSRVRecords(t *testing.T, records ...dnsmessage.SRVResource) string {
+	return serveUDP(t, func(b []byte) [][]byte {
+		var q dnsmessage.Message
+		if q.Unpack(b) != nil {
+			return nil
+		}
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, RecursionAvailable: true},
+			Questions: q.Questions,
+		}
+		for i := range records {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &records[i],
+			})
+		}
+		out, _ := resp.Pack()
+		return [][]byte{out}
+	})
+}
+
+func TestSRVProber(t *testing.T) {
+	resolver := serveSRVRecords(t,
+		dnsmessage.SRVResource{Priority: 20, Weight: 0, Port: 389, Target: dnsmessage.MustNewName("backup.example.com.")},
+		dnsmessage.SRVResource{Priority: 10, Weight: 60, Port: 389, Target: dnsmessage.MustNewName("dc1.example.com.")},
+		dnsmessage.SRVResource{Priority: 10, Weight: 40, Port: 3268, Target: dnsmessage.MustNewName("dc2.example.com.")},
+	)
+	var down string
+	prober := funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		if target.Address == down {
+			return &libprobe.TCPResult{Target: target, Error: errors.New("refused")}, nil
+		}
+		return &libprobe.TCPResult{Target: target, ConnectTime: time.Millisecond}, nil
+	}}
+	p := libprobe.NewSRVProber(libprobe.SRVProberOptions{Prober: prober, Resolver: resolver})
+	require.Equal(t, libprobe.KindSRV, p.Kind())
+
+	target := libprobe.Target{Address: "_ldap._tcp.example.com", Timeout: 2 * time.Second}
+	r, err := p.Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.SRVResult)
+	require.NoError(t, res.Error)
+	require.Len(t, res.Instances, 3)
+	require.ElementsMatch(t, []string{"dc1.example.com:389", "dc2.example.com:3268"}, []string{res.Instances[0].Address, res.Instances[1].Address})
+	require.Equal(t, "backup.example.com:389", res.Instances[2].Address)
+	require.Equal(t, uint16(20), res.Instances[2].Priority)
+	require.Equal(t, 3, res.Healthy)
+	require.False(t, res.Degraded)
+	require.Equal(t, time.Millisecond, res.RTT())
+	require.Positive(t, res.LookupTime)
+
+	down = "dc1.example.com:389"
+	r, err = p.Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.SRVResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, 2, res.Healthy)
+	require.True(t, res.Degraded)
+	require.Contains(t, res.String(), "dc1.example.com:389 down")
+}
+
+func TestSRVProberUnavailable(t *testing.T) {
+	prober := funcProber{kind: "FAKE", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		return &libprobe.TCPResult{Target: target, Error: errors.New("refused")}, nil
+	}}
+	target := libprobe.Target{Address: "_xmpp-server._tcp.example.com", Timeout: 2 * time.Second}
+
+	resolver := serveSRVRecords(t, dnsmessage.SRVResource{Target: dnsmessage.MustNewName(".")})
+	r, err := libprobe.NewSRVProber(libprobe.SRVProberOptions{Prober: prober, Resolver: resolver}).Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.SRVResult)
+	require.Error(t, res.Error)
+	require.Empty(t, res.Instances)
+
+	resolver = serveSRVRecords(t, dnsmessage.SRVResource{Priority: 10, Port: 5269, Target: dnsmessage.MustNewName("xmpp.example.com.")})
+	r, err = libprobe.NewSRVProber(libprobe.SRVProberOptions{Prober: prober, Resolver: resolver}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.SRVResult)
+	require.ErrorContains(t, res.Error, "no healthy instance")
+	require.Len(t, res.Instances, 1)
+	require.False(t, res.Instances[0].Healthy)
+}
@@ -0,0 +1,313 @@
+package libprobe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const KindSSH = "SSH"
+
+// sshClientVersion is the identification string sent by SSH probes.
+const sshClientVersion = "SSH-2.0-libprobe"
+
+const sshMsgKexInit = 20
+
+// errSSHKeyExchangeDone stops the handshake of an SSH probe once the host
+// key was received, before authentication.
+var errSSHKeyExchangeDone = errors.New("ssh: key exchange done")
+
+// SSHProberOptions configures an SSHProber.
+type SSHProberOptions struct {
+	// KeyExchange completes the key exchange after reading the server's
+	// banner and algorithms, stopping before authentication.
+	KeyExchange bool
+	// KeyExchanges and HostKeyAlgorithms are the algorithms offered in the
+	// key exchange, in order of preference. Default: those of
+	// golang.org/x/crypto/ssh.
+	KeyExchanges      []string
+	HostKeyAlgorithms []string
+}
+
+type SSHResult struct {
+	Target
+	Error error
+
+	ConnectTime time.Duration
+	// BannerTime is the time from connecting to receiving the server's
+	// banner, KeyExchangeTime from the banner to the end of the key
+	// exchange.
+	BannerTime      time.Duration
+	KeyExchangeTime time.Duration
+	TotalTime       time.Duration
+	// Banner is the server's identification string, e.g.
+	// "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13".
+	Banner string
+	// ServerKeyExchanges and ServerHostKeyAlgorithms are the algorithms
+	// offered by the server, in its order of preference.
+	ServerKeyExchanges      []string
+	ServerHostKeyAlgorithms []string
+	// KeyExchange and HostKeyAlgorithm are the algorithms negotiated, and
+	// HostKeyFingerprint the SHA256 fingerprint of the host key, as printed
+	// by ssh-keygen -l. They are set with SSHProberOptions.KeyExchange.
+	KeyExchange        string
+	HostKeyAlgorithm   string
+	HostKeyFingerprint string
+}
+
+func (r SSHResult) RTT() time.Duration {
+	return r.TotalTime
+}
+
+func (r SSHResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	s := fmt.Sprintf("-> %s %s Connect: %s, Banner: %s, Key Exchange: %s. Total: %s",
+		r.Target.Address, r.Banner, r.ConnectTime, r.BannerTime, r.KeyExchangeTime, r.TotalTime)
+	if r.KeyExchange != "" {
+		s += fmt.Sprintf("\n%s, %s %s", r.KeyExchange, r.HostKeyAlgorithm, r.HostKeyFingerprint)
+	}
+	return s
+}
+
+// SSHProber connects to the SSH server in Target.Address, reads its banner
+// and the algorithms it offers, and optionally completes the key exchange.
+// It never authenticates.
+type SSHProber struct {
+	opts SSHProberOptions
+}
+
+func NewSSHProber(opts SSHProberOptions) *SSHProber {
+	return &SSHProber{opts: opts}
+}
+
+func (p *SSHProber) Kind() string {
+	return KindSSH
+}
+
+func (p *SSHProber) Probe(target Target) (Result, error) {
+	r := &SSHResult{Target: target}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", target.Address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+	if p.opts.KeyExchange {
+		r.Error = p.keyExchange(r, conn, target.Address)
+	} else {
+		r.Error = p.readAlgorithms(r, conn)
+	}
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+// readAlgorithms reads the banner and the KEXINIT of the server.
+func (p *SSHProber) readAlgorithms(r *SSHResult, conn net.Conn) error {
+	connectedAt := time.Now()
+	br := bufio.NewReader(conn)
+	banner, err := readSSHBanner(br)
+	if err != nil {
+		return err
+	}
+	r.Banner, r.BannerTime = banner, time.Since(connectedAt)
+	if err := checkSSHVersion(banner); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, sshClientVersion+"\r\n"); err != nil {
+		return err
+	}
+	kexInit, err := readSSHKexInit(br)
+	if err != nil {
+		return err
+	}
+	r.ServerKeyExchanges, r.ServerHostKeyAlgorithms = kexInit.kexAlgos, kexInit.hostKeyAlgos
+	return nil
+}
+
+// keyExchange runs the handshake of golang.org/x/crypto/ssh until the host
+// key is verified, recording the traffic to report the banner and the
+// algorithms offered by both sides.
+func (p *SSHProber) keyExchange(r *SSHResult, conn net.Conn, address string) error {
+	rec := &sshRecorder{Conn: conn, connectedAt: time.Now()}
+	var doneAt time.Time
+	config := &ssh.ClientConfig{
+		Config:            ssh.Config{KeyExchanges: p.opts.KeyExchanges},
+		ClientVersion:     sshClientVersion,
+		HostKeyAlgorithms: p.opts.HostKeyAlgorithms,
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			doneAt = time.Now()
+			r.HostKeyFingerprint = ssh.FingerprintSHA256(key)
+			return errSSHKeyExchangeDone
+		},
+	}
+	_, _, _, err := ssh.NewClientConn(rec, address, config)
+	read, written, bannerAt := rec.recorded()
+
+	br := bufio.NewReader(bytes.NewReader(read))
+	banner, berr := readSSHBanner(br)
+	if berr != nil {
+		if err == nil {
+			err = berr
+		}
+		return err
+	}
+	r.Banner, r.BannerTime = banner, bannerAt.Sub(rec.connectedAt)
+	if server, serr := readSSHKexInit(br); serr == nil {
+		r.ServerKeyExchanges, r.ServerHostKeyAlgorithms = server.kexAlgos, server.hostKeyAlgos
+		// The client's KEXINIT follows its identification string.
+		wr := bufio.NewReader(bytes.NewReader(written))
+		if _, cerr := wr.ReadString('\n'); cerr == nil {
+			if client, cerr := readSSHKexInit(wr); cerr == nil {
+				r.KeyExchange = sshNegotiate(client.kexAlgos, server.kexAlgos)
+				r.HostKeyAlgorithm = sshNegotiate(client.hostKeyAlgos, server.hostKeyAlgos)
+			}
+		}
+	}
+	if !errors.Is(err, errSSHKeyExchangeDone) {
+		if err == nil {
+			err = errors.New("ssh: server accepted an unauthenticated session")
+		}
+		return err
+	}
+	r.KeyExchangeTime = doneAt.Sub(bannerAt)
+	return nil
+}
+
+// sshRecorder records the traffic of a connection, and when the server's
+// banner was received.
+type sshRecorder struct {
+	net.Conn
+	connectedAt time.Time
+
+	mu       sync.Mutex
+	read     bytes.Buffer
+	written  bytes.Buffer
+	bannerAt time.Time
+}
+
+func (c *sshRecorder) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.read.Write(b[:n])
+	if c.bannerAt.IsZero() {
+		if _, err := readSSHBanner(bufio.NewReader(bytes.NewReader(c.read.Bytes()))); err == nil {
+			c.bannerAt = time.Now()
+		}
+	}
+	return n, err
+}
+
+func (c *sshRecorder) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *sshRecorder) recorded() (read, written []byte, bannerAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.read.Bytes()), bytes.Clone(c.written.Bytes()), c.bannerAt
+}
+
+// readSSHBanner returns the identification string of an SSH server,
+// skipping the lines it may send before.
+func readSSHBanner(r *bufio.Reader) (string, error) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(line, "SSH-") {
+			return strings.TrimRight(line, "\r\n"), nil
+		}
+	}
+}
+
+// checkSSHVersion fails for servers not speaking SSH 2.
+func checkSSHVersion(banner string) error {
+	if strings.HasPrefix(banner, "SSH-2.0-") || strings.HasPrefix(banner, "SSH-1.99-") {
+		return nil
+	}
+	return fmt.Errorf("ssh: unsupported protocol version in %q", banner)
+}
+
+// sshKexInit holds the algorithms of a KEXINIT message.
+type sshKexInit struct {
+	kexAlgos     []string
+	hostKeyAlgos []string
+}
+
+// readSSHKexInit reads an unencrypted packet, which must hold a KEXINIT
+// message.
+func readSSHKexInit(r io.Reader) (sshKexInit, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return sshKexInit{}, err
+	}
+	length, padding := binary.BigEndian.Uint32(header[:4]), int(header[4])
+	if length < 2 || length > 35000 {
+		return sshKexInit{}, errors.New("ssh: malformed packet")
+	}
+	body := make([]byte, length-1)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return sshKexInit{}, err
+	}
+	if padding >= len(body) {
+		return sshKexInit{}, errors.New("ssh: malformed packet")
+	}
+	payload := body[:len(body)-padding]
+	if payload[0] != sshMsgKexInit {
+		return sshKexInit{}, fmt.Errorf("ssh: expected KEXINIT, got message %d", payload[0])
+	}
+	if len(payload) < 17 {
+		return sshKexInit{}, errors.New("ssh: malformed KEXINIT")
+	}
+	// The type is followed by a 16-byte cookie, then the name-lists.
+	payload = payload[17:]
+	var lists [2][]string
+	for i := range lists {
+		if len(payload) < 4 {
+			return sshKexInit{}, errors.New("ssh: malformed KEXINIT")
+		}
+		n := binary.BigEndian.Uint32(payload)
+		if uint32(len(payload)-4) < n {
+			return sshKexInit{}, errors.New("ssh: malformed KEXINIT")
+		}
+		if n > 0 {
+			lists[i] = strings.Split(string(payload[4:4+n]), ",")
+		}
+		payload = payload[4+n:]
+	}
+	return sshKexInit{kexAlgos: lists[0], hostKeyAlgos: lists[1]}, nil
+}
+
+// sshNegotiate returns the first algorithm of the client supported by the
+// server, as specified by RFC 4253 section 7.1.
+func sshNegotiate(client, server []string) string {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c
+			}
+		}
+	}
+	return ""
+}
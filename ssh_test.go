@@ -0,0 +1,86 @@
+package libprobe_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHProber(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	config := &ssh.ServerConfig{
+		ServerVersion: "SSH-2.0-TestSSH_1.0",
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _, _, _ = ssh.NewServerConn(conn, config)
+			}()
+		}
+	}()
+	target := libprobe.Target{Address: ln.Addr().String(), Timeout: 5 * time.Second}
+
+	r, err := libprobe.NewSSHProber(libprobe.SSHProberOptions{}).Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.SSHResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "SSH-2.0-TestSSH_1.0", res.Banner)
+	require.Contains(t, res.ServerKeyExchanges, ssh.KeyExchangeCurve25519)
+	require.Equal(t, []string{ssh.KeyAlgoED25519}, res.ServerHostKeyAlgorithms)
+	require.Empty(t, res.KeyExchange)
+
+	r, err = libprobe.NewSSHProber(libprobe.SSHProberOptions{
+		KeyExchange:  true,
+		KeyExchanges: []string{ssh.KeyExchangeECDHP256, ssh.KeyExchangeCurve25519},
+	}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.SSHResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "SSH-2.0-TestSSH_1.0", res.Banner)
+	require.Equal(t, ssh.KeyExchangeECDHP256, res.KeyExchange)
+	require.Equal(t, ssh.KeyAlgoED25519, res.HostKeyAlgorithm)
+	require.Equal(t, ssh.FingerprintSHA256(signer.PublicKey()), res.HostKeyFingerprint)
+	require.Positive(t, res.KeyExchangeTime)
+	require.GreaterOrEqual(t, res.TotalTime, res.ConnectTime+res.BannerTime+res.KeyExchangeTime)
+
+	// Servers not speaking SSH 2 are reported with their banner.
+	legacy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer legacy.Close()
+	go func() {
+		conn, err := legacy.Accept()
+		if err == nil {
+			conn.Write([]byte("SSH-1.5-Legacy\r\n"))
+			conn.Close()
+		}
+	}()
+	r, err = libprobe.NewSSHProber(libprobe.SSHProberOptions{}).Probe(libprobe.Target{Address: legacy.Addr().String(), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.SSHResult)
+	require.Error(t, res.Error)
+	require.Equal(t, "SSH-1.5-Legacy", res.Banner)
+}
@@ -0,0 +1,239 @@
+package libprobe
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsDSinkOptions configures a StatsDSink.
+type StatsDSinkOptions struct {
+	// Network is "udp" or "unixgram" for a DogStatsD Unix domain socket.
+	// Default: "udp".
+	Network string
+	// Address is the daemon address. Default: "127.0.0.1:8125".
+	Address string
+	// Prefix prefixes metric names. Default: "probe".
+	Prefix string
+	// DogStatsD sends kind, target and Tags as DogStatsD tags. Plain StatsD
+	// has no tags, kind and target are then part of the metric name, as in
+	// "probe.tcp.1_1_1_1_80.rtt".
+	DogStatsD bool
+	// Tags are added to every metric in DogStatsD mode, e.g.
+	// {"agent": "edge-1"}.
+	Tags map[string]string
+	// Columns are additional numeric flattened result columns sent as
+	// gauges, or as timers in milliseconds for duration columns such as
+	// "ttfb_ns" (sent as "ttfb").
+	Columns []string
+	// MaxPacketSize is the size up to which metrics are batched into one
+	// datagram. Default: 1432 for UDP, 8192 for Unix domain sockets.
+	MaxPacketSize int
+	// Linger flushes batched metrics periodically. Default: 1s; a negative
+	// value disables periodic flushing, metrics are then sent as soon as a
+	// datagram is full and on Flush.
+	Linger time.Duration
+}
+
+// StatsDSink emits results as StatsD metrics: the timer "<prefix>.rtt" in
+// milliseconds, the gauge "<prefix>.success" (1 or 0), the gauge
+// "<prefix>.loss" with the packet loss percentage of ICMP results, and one
+// metric per configured column. Metrics are batched into datagrams of up to
+// MaxPacketSize bytes.
+type StatsDSink struct {
+	opts StatsDSinkOptions
+
+	mu      sync.Mutex
+	conn    net.Conn
+	buf     []byte
+	closed  bool
+	done    chan struct{}
+	lastErr error
+}
+
+func NewStatsDSink(opts StatsDSinkOptions) *StatsDSink {
+	if opts.Network == "" {
+		opts.Network = "udp"
+	}
+	if opts.Address == "" {
+		opts.Address = "127.0.0.1:8125"
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "probe"
+	}
+	if opts.MaxPacketSize <= 0 {
+		opts.MaxPacketSize = 1432
+		if opts.Network == "unixgram" {
+			opts.MaxPacketSize = 8192
+		}
+	}
+	if opts.Linger == 0 {
+		opts.Linger = time.Second
+	}
+	s := &StatsDSink{opts: opts, done: make(chan struct{})}
+	if opts.Linger > 0 {
+		go s.lingerLoop()
+	}
+	return s
+}
+
+func (s *StatsDSink) lingerLoop() {
+	ticker := time.NewTicker(s.opts.Linger)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			if len(s.buf) > 0 {
+				s.lastErr = s.flush()
+			}
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// statsdName replaces characters with a meaning in the StatsD line protocol
+// (and dots, which separate Graphite path components).
+var statsdName = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "/", "_")
+
+// statsdTag replaces characters with a meaning in DogStatsD tag lists.
+var statsdTag = strings.NewReplacer("|", "_", ",", "_", "#", "_", " ", "_", "\n", "_")
+
+// FormatStatsD formats a result as StatsD lines.
+func (s *StatsDSink) FormatStatsD(r Result) []string {
+	row := Flatten(r)[0]
+	address, _ := row[ColumnAddress].(string)
+	prefix, suffix := s.opts.Prefix+".", ""
+	if s.opts.DogStatsD {
+		tags := []string{"kind:" + statsdTag.Replace(resultKind(r)), "target:" + statsdTag.Replace(address)}
+		var extra []string
+		for k, v := range s.opts.Tags {
+			extra = append(extra, statsdTag.Replace(k)+":"+statsdTag.Replace(v))
+		}
+		sort.Strings(extra)
+		suffix = "|#" + strings.Join(append(tags, extra...), ",")
+	} else {
+		prefix += strings.ToLower(statsdName.Replace(resultKind(r))) + "." + statsdName.Replace(address) + "."
+	}
+	metric := func(name string, v float64, typ string) string {
+		return prefix + name + ":" + strconv.FormatFloat(v, 'f', -1, 64) + "|" + typ + suffix
+	}
+	up := 0.0
+	if resultOK(r) {
+		up = 1
+	}
+	lines := []string{
+		metric("rtt", float64(r.RTT())/float64(time.Millisecond), "ms"),
+		metric("success", up, "g"),
+	}
+	if icmp, ok := innermostResult(r).(*ICMPResult); ok && icmp.Stats != nil {
+		lines = append(lines, metric("loss", icmp.Stats.PacketLoss, "g"))
+	}
+	for _, c := range s.opts.Columns {
+		switch v := row[c].(type) {
+		case int64:
+			if strings.HasSuffix(c, "_ns") {
+				lines = append(lines, metric(strings.TrimSuffix(c, "_ns"), float64(v)/float64(time.Millisecond), "ms"))
+			} else {
+				lines = append(lines, metric(c, float64(v), "g"))
+			}
+		case uint64:
+			lines = append(lines, metric(c, float64(v), "g"))
+		case float64:
+			lines = append(lines, metric(c, v, "g"))
+		case bool:
+			b := 0.0
+			if v {
+				b = 1
+			}
+			lines = append(lines, metric(c, b, "g"))
+		}
+	}
+	return lines
+}
+
+// Write batches the metrics of a result. The returned error reports a
+// failure of the last datagram sent, including periodic flushes that
+// happened in the background.
+func (s *StatsDSink) Write(r Result) error {
+	lines := s.FormatStatsD(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSinkClosed
+	}
+	for _, line := range lines {
+		if len(s.buf) > 0 && len(s.buf)+1+len(line) > s.opts.MaxPacketSize {
+			if err := s.flush(); err != nil {
+				s.lastErr = err
+			}
+		}
+		if len(s.buf) > 0 {
+			s.buf = append(s.buf, '\n')
+		}
+		s.buf = append(s.buf, line...)
+	}
+	err := s.lastErr
+	s.lastErr = nil
+	return err
+}
+
+// Flush sends batched metrics.
+func (s *StatsDSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// flush sends the batch as one datagram. Metrics are dropped when the
+// datagram cannot be sent, as is usual for StatsD clients.
+func (s *StatsDSink) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	buf := s.buf
+	s.buf = s.buf[:0]
+	if s.conn == nil {
+		switch s.opts.Network {
+		case "udp", "udp4", "udp6", "unixgram":
+		default:
+			return fmt.Errorf("statsd: unsupported network %q", s.opts.Network)
+		}
+		conn, err := net.Dial(s.opts.Network, s.opts.Address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close flushes batched metrics and closes the socket.
+func (s *StatsDSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	err := s.flush()
+	if s.conn != nil {
+		if cerr := s.conn.Close(); err == nil {
+			err = cerr
+		}
+		s.conn = nil
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package libprobe_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+	"github.com/go-ping/ping"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readDatagram(t *testing.T, pc net.PacketConn) string {
+	buf := make([]byte, 65536)
+	_ = pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestStatsDSink(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	sink := libprobe.NewStatsDSink(libprobe.StatsDSinkOptions{
+		Address: pc.LocalAddr().String(),
+		Columns: []string{"connect_time_ns"},
+		Linger:  -1,
+	})
+	defer sink.Close()
+	require.NoError(t, sink.Write(&libprobe.TCPResult{
+		Target:      libprobe.Target{Address: "1.1.1.1:80"},
+		ConnectTime: 1500 * time.Microsecond,
+	}))
+	require.NoError(t, sink.Flush())
+	require.Equal(t, strings.Join([]string{
+		"probe.tcp.1_1_1_1_80.rtt:1.5|ms",
+		"probe.tcp.1_1_1_1_80.success:1|g",
+		"probe.tcp.1_1_1_1_80.connect_time:1.5|ms",
+	}, "\n"), readDatagram(t, pc))
+}
+
+func TestStatsDSinkDogStatsD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dsd.socket")
+	pc, err := net.ListenPacket("unixgram", path)
+	require.NoError(t, err)
+	defer pc.Close()
+
+	sink := libprobe.NewStatsDSink(libprobe.StatsDSinkOptions{
+		Network:       "unixgram",
+		Address:       path,
+		DogStatsD:     true,
+		Tags:          map[string]string{"agent": "edge-1"},
+		MaxPacketSize: 100,
+	})
+	require.NoError(t, sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "1.1.1.1:80"}, ConnectTime: time.Millisecond}))
+	// The second line didn't fit into the first datagram.
+	require.Equal(t, "probe.rtt:1|ms|#kind:TCP,target:1.1.1.1:80,agent:edge-1", readDatagram(t, pc))
+	require.NoError(t, sink.Close())
+	require.Equal(t, "probe.success:1|g|#kind:TCP,target:1.1.1.1:80,agent:edge-1", readDatagram(t, pc))
+}
+
+func TestStatsDSinkWrappedICMP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	sink := libprobe.NewStatsDSink(libprobe.StatsDSinkOptions{Address: pc.LocalAddr().String(), Linger: 10 * time.Millisecond})
+	defer sink.Close()
+	prober := funcProber{kind: "ICMP", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		return &libprobe.ICMPResult{Target: target, Stats: &ping.Statistics{PacketsSent: 4, PacketsRecv: 3, PacketLoss: 25}}, nil
+	}}
+	// Adaptive jobs deliver their results wrapped in a ScheduledResult.
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}})
+	require.NoError(t, engine.Add(libprobe.Job{
+		Prober:   prober,
+		Target:   libprobe.Target{Address: "1.1.1.1"},
+		Interval: time.Hour,
+		Adaptive: &libprobe.AdaptiveInterval{},
+	}))
+	engine.Start()
+	defer engine.Stop()
+	require.Contains(t, strings.Split(readDatagram(t, pc), "\n"), "probe.icmp.1_1_1_1.loss:25|g")
+}
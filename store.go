@@ -0,0 +1,185 @@
+package libprobe
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ResultStoreOptions configures a ResultStore.
+type ResultStoreOptions struct {
+	// Capacity is the number of results kept per target; older results are
+	// overwritten. Default: 1000.
+	Capacity int
+}
+
+// StoredResult is a result with the time it was recorded.
+type StoredResult struct {
+	Time   time.Time
+	Result Result
+}
+
+// ResultStore keeps the latest results of every target in bounded ring
+// buffers, for agents that want to answer simple queries without a database.
+// Targets are identified by "<kind>/<address>" with the kind of the result's
+// type, e.g. "DNSConsistency/example.com" rather than the prober's
+// "DNS_CONSISTENCY", since results don't carry their job. Use the store
+// either as a Sink or with RecordJob as EngineOptions.OnResult, not both.
+type ResultStore struct {
+	opts ResultStoreOptions
+
+	mu      sync.RWMutex
+	targets map[string]*resultRing
+}
+
+// resultRing holds up to len(buf) results, next is the slot written next.
+type resultRing struct {
+	buf  []StoredResult
+	next int
+	full bool
+}
+
+func (r *resultRing) add(sr StoredResult) {
+	r.buf[r.next] = sr
+	r.next++
+	if r.next == len(r.buf) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// since returns the results recorded at or after t, oldest first.
+func (r *resultRing) since(t time.Time) []StoredResult {
+	var all []StoredResult
+	if r.full {
+		all = append(all, r.buf[r.next:]...)
+	}
+	all = append(all, r.buf[:r.next]...)
+	i := sort.Search(len(all), func(i int) bool { return !all[i].Time.Before(t) })
+	return all[i:]
+}
+
+func NewResultStore(opts ResultStoreOptions) *ResultStore {
+	if opts.Capacity <= 0 {
+		opts.Capacity = 1000
+	}
+	return &ResultStore{opts: opts, targets: make(map[string]*resultRing)}
+}
+
+func (s *ResultStore) Write(r Result) error {
+	s.Record(time.Now(), r)
+	return nil
+}
+
+// RecordJob stores the result of a probe of job like Write. Its signature
+// matches EngineOptions.OnResult; probes that could not be run aren't
+// recorded.
+func (s *ResultStore) RecordJob(job Job, r Result, err error) {
+	if r == nil {
+		return
+	}
+	s.Record(time.Now(), r)
+}
+
+// Record stores a result observed at a given time. Results of a target must
+// be recorded in chronological order.
+func (s *ResultStore) Record(at time.Time, r Result) {
+	key := resultKind(r) + "/" + resultTarget(r).Address
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ring, ok := s.targets[key]
+	if !ok {
+		ring = &resultRing{buf: make([]StoredResult, s.opts.Capacity)}
+		s.targets[key] = ring
+	}
+	ring.add(StoredResult{Time: at, Result: r})
+}
+
+// Targets returns the keys of all targets with results, sorted.
+func (s *ResultStore) Targets() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.targets))
+	for key := range s.targets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *ResultStore) window(key string, window time.Duration) []StoredResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ring, ok := s.targets[key]
+	if !ok {
+		return nil
+	}
+	since := time.Time{}
+	if window > 0 {
+		since = time.Now().Add(-window)
+	}
+	return ring.since(since)
+}
+
+// Last returns up to n of the latest results of a target, oldest first, and
+// nil when n isn't positive.
+func (s *ResultStore) Last(key string, n int) []StoredResult {
+	if n <= 0 {
+		return nil
+	}
+	results := s.window(key, 0)
+	if len(results) > n {
+		results = results[len(results)-n:]
+	}
+	return results
+}
+
+// SuccessRate returns the fraction of successful results of a target within
+// the window preceding now, and the number of results it's based on. A
+// window of 0 covers all stored results.
+func (s *ResultStore) SuccessRate(key string, window time.Duration) (float64, int) {
+	results := s.window(key, window)
+	if len(results) == 0 {
+		return 0, 0
+	}
+	ok := 0
+	for _, sr := range results {
+		if resultOK(sr.Result) {
+			ok++
+		}
+	}
+	return float64(ok) / float64(len(results)), len(results)
+}
+
+// LatencyQuantiles returns the given quantiles (between 0 and 1) of the RTT of
+// successful results of a target within the window preceding now, using the
+// nearest-rank method. It returns nil when there are no such results.
+func (s *ResultStore) LatencyQuantiles(key string, window time.Duration, quantiles ...float64) []time.Duration {
+	var rtts []time.Duration
+	for _, sr := range s.window(key, window) {
+		if resultOK(sr.Result) {
+			rtts = append(rtts, sr.Result.RTT())
+		}
+	}
+	if len(rtts) == 0 {
+		return nil
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	values := make([]time.Duration, len(quantiles))
+	for i, q := range quantiles {
+		rank := int(math.Ceil(q*float64(len(rtts)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(rtts) {
+			rank = len(rtts) - 1
+		}
+		values[i] = rtts[rank]
+	}
+	return values
+}
+
+func (s *ResultStore) Close() error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package libprobe_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultStore(t *testing.T) {
+	store := libprobe.NewResultStore(libprobe.ResultStoreOptions{Capacity: 5})
+	now := time.Now()
+	target := libprobe.Target{Address: "1.1.1.1:80"}
+	for i := 1; i <= 7; i++ {
+		r := &libprobe.TCPResult{Target: target, ConnectTime: time.Duration(i) * time.Millisecond}
+		if i == 6 {
+			r.Error = errors.New("refused")
+		}
+		store.Record(now.Add(time.Duration(i-7)*time.Minute), r)
+	}
+	require.NoError(t, store.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "8.8.8.8:53"}}))
+	require.Equal(t, []string{"TCP/1.1.1.1:80", "TCP/8.8.8.8:53"}, store.Targets())
+
+	last := store.Last("TCP/1.1.1.1:80", 2)
+	require.Len(t, last, 2)
+	require.Equal(t, 6*time.Millisecond, last[0].Result.RTT())
+	require.Equal(t, 7*time.Millisecond, last[1].Result.RTT())
+	require.Len(t, store.Last("TCP/1.1.1.1:80", 10), 5)
+	require.Empty(t, store.Last("TCP/missing", 10))
+	require.Nil(t, store.Last("TCP/1.1.1.1:80", 0))
+	require.Nil(t, store.Last("TCP/1.1.1.1:80", -1))
+
+	rate, n := store.SuccessRate("TCP/1.1.1.1:80", 0)
+	require.Equal(t, 5, n)
+	require.Equal(t, 0.8, rate)
+	rate, n = store.SuccessRate("TCP/1.1.1.1:80", 90*time.Second)
+	require.Equal(t, 2, n)
+	require.Equal(t, 0.5, rate)
+
+	require.Equal(t, []time.Duration{3 * time.Millisecond, 4 * time.Millisecond, 7 * time.Millisecond},
+		store.LatencyQuantiles("TCP/1.1.1.1:80", 0, 0, 0.5, 0.99))
+	require.Nil(t, store.LatencyQuantiles("TCP/missing", 0, 0.5))
+}
+
+func TestResultStoreRecordJob(t *testing.T) {
+	prober := funcProber{kind: libprobe.KindDNSConsistency, probe: func(target libprobe.Target) (libprobe.Result, error) {
+		return &libprobe.DNSConsistencyResult{Target: target}, nil
+	}}
+	job := libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "example.com"}, Interval: time.Hour}
+
+	// Results reaching the store as a sink or through RecordJob are kept
+	// under the same key.
+	sink := libprobe.NewResultStore(libprobe.ResultStoreOptions{})
+	onResult := libprobe.NewResultStore(libprobe.ResultStoreOptions{})
+	engine := libprobe.NewEngine(libprobe.EngineOptions{Sinks: []libprobe.Sink{sink}, OnResult: onResult.RecordJob})
+	require.NoError(t, engine.Add(job))
+	engine.Start()
+	require.Eventually(t, func() bool {
+		return len(sink.Targets()) == 1 && len(onResult.Targets()) == 1
+	}, 3*time.Second, time.Millisecond)
+	engine.Stop()
+
+	require.Equal(t, []string{"DNSConsistency/example.com"}, sink.Targets())
+	require.Equal(t, sink.Targets(), onResult.Targets())
+	require.Len(t, onResult.Last("DNSConsistency/example.com", 10), 1)
+}
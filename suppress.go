@@ -0,0 +1,221 @@
+package libprobe
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SuppressOptions configures a Suppressor.
+type SuppressOptions struct {
+	// Window is the period repeated identical failures are suppressed for.
+	// Once it elapses a summary of the suppressed results is emitted.
+	// Default: 5m.
+	Window time.Duration
+	// FlapThreshold is the number of up/down transitions within Window
+	// after which a target is considered flapping. While flapping, results
+	// are suppressed until the target was stable for a whole Window.
+	// Default: 4; a negative value disables flap detection.
+	FlapThreshold int
+}
+
+// SuppressedResult summarizes results that were held back by a Suppressor.
+// It wraps the latest of them.
+type SuppressedResult struct {
+	Result
+	// Occurrences is the number of results summarized, including the
+	// wrapped one.
+	Occurrences int
+	Since       time.Time
+	// Flapping is set when results were suppressed because the target
+	// was flapping rather than repeatedly failing.
+	Flapping bool
+}
+
+func (r SuppressedResult) Unwrap() Result {
+	return r.Result
+}
+
+func (r SuppressedResult) String() string {
+	state := "still down"
+	if r.Flapping {
+		state = "flapping"
+	}
+	return fmt.Sprintf("%s, %d occurrences since %s: %s",
+		state, r.Occurrences, r.Since.Format(time.RFC3339), r.Result.String())
+}
+
+type suppressState struct {
+	up          bool
+	seen        bool
+	signature   string
+	emittedAt   time.Time
+	suppressed  int
+	since       time.Time
+	last        Result
+	transitions []time.Time
+	flapping    bool
+}
+
+// Suppressor is a Sink decorator that keeps alert pipelines from being
+// flooded. The first failure of a target is forwarded, identical failures
+// following it are suppressed and summarized once per window, and targets
+// going up and down rapidly are reported once as flapping instead of on
+// every transition.
+type Suppressor struct {
+	next Sink
+	opts SuppressOptions
+
+	mu     sync.Mutex
+	states map[string]*suppressState
+}
+
+func NewSuppressor(next Sink, opts SuppressOptions) *Suppressor {
+	if opts.Window <= 0 {
+		opts.Window = 5 * time.Minute
+	}
+	if opts.FlapThreshold == 0 {
+		opts.FlapThreshold = 4
+	}
+	return &Suppressor{
+		next:   next,
+		opts:   opts,
+		states: make(map[string]*suppressState),
+	}
+}
+
+func failureSignature(r Result) string {
+	row := Flatten(r)[0]
+	if msg, _ := row[ColumnError].(string); msg != "" {
+		return msg
+	}
+	return r.String()
+}
+
+func (s *Suppressor) Write(r Result) error {
+	row := Flatten(r)[0]
+	address, _ := row[ColumnAddress].(string)
+	key := resultKind(r) + "/" + address
+	up := resultOK(r)
+	now := time.Now()
+
+	s.mu.Lock()
+	st, ok := s.states[key]
+	if !ok {
+		st = &suppressState{}
+		s.states[key] = st
+	}
+	forward := s.observe(st, now, r, up)
+	s.mu.Unlock()
+
+	if forward == nil {
+		return nil
+	}
+	return s.next.Write(forward)
+}
+
+// observe updates the state of a target and returns the result to forward,
+// if any. It must be called with s.mu held.
+func (s *Suppressor) observe(st *suppressState, now time.Time, r Result, up bool) Result {
+	transition := st.seen && st.up != up
+	st.seen = true
+	st.up = up
+
+	if s.opts.FlapThreshold > 0 {
+		if transition {
+			st.transitions = append(st.transitions, now)
+		}
+		cutoff := now.Add(-s.opts.Window)
+		for len(st.transitions) > 0 && st.transitions[0].Before(cutoff) {
+			st.transitions = st.transitions[1:]
+		}
+		switch {
+		case !st.flapping && len(st.transitions) >= s.opts.FlapThreshold:
+			st.flapping = true
+			st.suppressed = 0
+			st.since = st.transitions[0]
+			st.emittedAt = now
+			return SuppressedResult{Result: r, Occurrences: len(st.transitions), Since: st.since, Flapping: true}
+		case st.flapping && len(st.transitions) == 0:
+			// Stable for a whole window: report the settled state.
+			st.flapping = false
+			st.suppressed = 0
+			st.signature = ""
+			if !up {
+				st.signature = failureSignature(r)
+			}
+			st.emittedAt = now
+			return r
+		case st.flapping:
+			st.suppressed++
+			st.last = r
+			return nil
+		}
+	}
+
+	if up {
+		st.signature = ""
+		if st.suppressed > 0 {
+			// The recovery is forwarded, the pending summary is dropped
+			// since the target is no longer down.
+			st.suppressed = 0
+		}
+		return r
+	}
+	signature := failureSignature(r)
+	if signature != st.signature {
+		st.signature = signature
+		st.suppressed = 0
+		st.since = now
+		st.emittedAt = now
+		return r
+	}
+	st.suppressed++
+	st.last = r
+	if now.Sub(st.emittedAt) < s.opts.Window {
+		return nil
+	}
+	summary := SuppressedResult{Result: r, Occurrences: st.suppressed, Since: st.since}
+	st.suppressed = 0
+	st.emittedAt = now
+	return summary
+}
+
+// Flush forwards summaries of all results suppressed so far.
+func (s *Suppressor) Flush() error {
+	s.mu.Lock()
+	var pending []Result
+	for _, st := range s.states {
+		if st.suppressed == 0 || st.last == nil {
+			continue
+		}
+		pending = append(pending, SuppressedResult{
+			Result:      st.last,
+			Occurrences: st.suppressed,
+			Since:       st.since,
+			Flapping:    st.flapping,
+		})
+		st.suppressed = 0
+		st.emittedAt = time.Now()
+	}
+	s.mu.Unlock()
+
+	for _, r := range pending {
+		if err := s.next.Write(r); err != nil {
+			return err
+		}
+	}
+	if f, ok := s.next.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close flushes pending summaries and closes the wrapped sink.
+func (s *Suppressor) Close() error {
+	err := s.Flush()
+	if cerr := s.next.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
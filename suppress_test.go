@@ -0,0 +1,47 @@
+package libprobe_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuppressorRepeatedFailures(t *testing.T) {
+	sink := &memorySink{results: make(chan libprobe.Result, 10)}
+	s := libprobe.NewSuppressor(sink, libprobe.SuppressOptions{Window: time.Hour})
+	failed := &libprobe.TCPResult{Target: libprobe.Target{Address: "a:1"}, Error: errors.New("refused")}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Write(failed))
+	}
+	require.Len(t, sink.results, 1)
+	require.Equal(t, failed, <-sink.results)
+
+	require.NoError(t, s.Flush())
+	summary := (<-sink.results).(libprobe.SuppressedResult)
+	require.Equal(t, 2, summary.Occurrences)
+	require.False(t, summary.Flapping)
+	require.Equal(t, "TCP", libprobe.Flatten(summary)[0][libprobe.ColumnKind])
+	require.Equal(t, "a:1", libprobe.Flatten(summary)[0][libprobe.ColumnAddress])
+
+	require.NoError(t, s.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "a:1"}}))
+	require.Len(t, sink.results, 1, "recovery is forwarded")
+}
+
+func TestSuppressorFlapping(t *testing.T) {
+	sink := &memorySink{results: make(chan libprobe.Result, 10)}
+	s := libprobe.NewSuppressor(sink, libprobe.SuppressOptions{Window: time.Hour, FlapThreshold: 2})
+	ok := &libprobe.TCPResult{Target: libprobe.Target{Address: "a:1"}}
+	failed := &libprobe.TCPResult{Target: libprobe.Target{Address: "a:1"}, Error: errors.New("refused")}
+	for _, r := range []libprobe.Result{ok, failed, ok, failed, ok} {
+		require.NoError(t, s.Write(r))
+	}
+	require.Len(t, sink.results, 3)
+	<-sink.results
+	<-sink.results
+	flap := (<-sink.results).(libprobe.SuppressedResult)
+	require.True(t, flap.Flapping)
+}
@@ -0,0 +1,218 @@
+package libprobe
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Record types of RFC 9460, which dnsmessage doesn't know.
+const (
+	dnsTypeSVCB  dnsmessage.Type = 64
+	dnsTypeHTTPS dnsmessage.Type = 65
+)
+
+// SvcParamKeys of RFC 9460 and of the ECH draft.
+const (
+	svcbKeyMandatory     = 0
+	svcbKeyALPN          = 1
+	svcbKeyNoDefaultALPN = 2
+	svcbKeyPort          = 3
+	svcbKeyIPv4Hint      = 4
+	svcbKeyECH           = 5
+	svcbKeyIPv6Hint      = 6
+)
+
+// svcbMaxAliases bounds the AliasMode records followed.
+const svcbMaxAliases = 4
+
+// svcbRecord is the data of an SVCB or HTTPS record.
+type svcbRecord struct {
+	// Priority is 0 for AliasMode records.
+	Priority uint16
+	// Target is the name of the service, "." for the owner name.
+	Target        string
+	ALPN          []string
+	NoDefaultALPN bool
+	Port          uint16
+	IPv4Hint      []net.IP
+	IPv6Hint      []net.IP
+	// ECH is the ECHConfigList of the service.
+	ECH []byte
+}
+
+// String returns r in presentation format.
+func (r svcbRecord) String() string {
+	s := fmt.Sprintf("%d %s", r.Priority, r.Target)
+	if r.ALPN != nil {
+		s += fmt.Sprintf(" alpn=%q", strings.Join(r.ALPN, ","))
+	}
+	if r.NoDefaultALPN {
+		s += " no-default-alpn"
+	}
+	if r.Port != 0 {
+		s += fmt.Sprintf(" port=%d", r.Port)
+	}
+	for _, hint := range []struct {
+		key string
+		ips []net.IP
+	}{{"ipv4hint", r.IPv4Hint}, {"ipv6hint", r.IPv6Hint}} {
+		if hint.ips != nil {
+			ips := make([]string, len(hint.ips))
+			for i, ip := range hint.ips {
+				ips[i] = ip.String()
+			}
+			s += fmt.Sprintf(" %s=%s", hint.key, strings.Join(ips, ","))
+		}
+	}
+	if r.ECH != nil {
+		s += " ech=" + base64.StdEncoding.EncodeToString(r.ECH)
+	}
+	return s
+}
+
+var errSVCBMalformed = errors.New("dns: malformed SVCB record")
+
+// parseSVCB decodes the data of an SVCB or HTTPS record, whose target name
+// is never compressed. Unknown parameters are skipped.
+func parseSVCB(b []byte) (svcbRecord, error) {
+	var r svcbRecord
+	if len(b) < 3 {
+		return r, errSVCBMalformed
+	}
+	r.Priority = binary.BigEndian.Uint16(b)
+	b = b[2:]
+	var labels []string
+	for {
+		if len(b) == 0 || int(b[0]) >= len(b) || b[0]&0xc0 != 0 {
+			return r, errSVCBMalformed
+		}
+		n := int(b[0])
+		labels = append(labels, string(b[1:1+n]))
+		b = b[1+n:]
+		if n == 0 {
+			break
+		}
+	}
+	r.Target = strings.Join(labels, ".")
+	if r.Target == "" {
+		r.Target = "."
+	}
+	for len(b) > 0 {
+		if len(b) < 4 || int(binary.BigEndian.Uint16(b[2:])) > len(b)-4 {
+			return r, errSVCBMalformed
+		}
+		key, value := binary.BigEndian.Uint16(b), b[4:4+int(binary.BigEndian.Uint16(b[2:]))]
+		b = b[4+len(value):]
+		switch key {
+		case svcbKeyALPN:
+			r.ALPN = []string{}
+			for len(value) > 0 {
+				n := int(value[0])
+				if n == 0 || n >= len(value) {
+					return r, errSVCBMalformed
+				}
+				r.ALPN = append(r.ALPN, string(value[1:1+n]))
+				value = value[1+n:]
+			}
+		case svcbKeyNoDefaultALPN:
+			r.NoDefaultALPN = true
+		case svcbKeyPort:
+			if len(value) != 2 {
+				return r, errSVCBMalformed
+			}
+			r.Port = binary.BigEndian.Uint16(value)
+		case svcbKeyIPv4Hint, svcbKeyIPv6Hint:
+			size := net.IPv4len
+			if key == svcbKeyIPv6Hint {
+				size = net.IPv6len
+			}
+			if len(value) == 0 || len(value)%size != 0 {
+				return r, errSVCBMalformed
+			}
+			ips := []net.IP{}
+			for ; len(value) > 0; value = value[size:] {
+				ips = append(ips, net.IP(append([]byte(nil), value[:size]...)))
+			}
+			if key == svcbKeyIPv4Hint {
+				r.IPv4Hint = ips
+			} else {
+				r.IPv6Hint = ips
+			}
+		case svcbKeyECH:
+			r.ECH = append([]byte(nil), value...)
+		}
+	}
+	return r, nil
+}
+
+// httpsRecordName returns the name of the HTTPS records of host for an
+// origin on port, prefixed for ports other than 443 (RFC 9460 section 9.1).
+func httpsRecordName(host, port string) string {
+	if port == "" || port == "443" {
+		return host
+	}
+	return "_" + port + "._https." + host
+}
+
+// lookupHTTPSRecords queries resolver, "host", "host:port" or
+// SystemResolver, for the HTTPS records of name, following AliasMode
+// records. It returns the ServiceMode records by priority, with their
+// target resolved to the owner name.
+func lookupHTTPSRecords(meter *trafficMeter, resolver, name string, deadline time.Time) ([]svcbRecord, error) {
+	server := dnsServerAddress(resolver)
+	if resolver == SystemResolver {
+		var err error
+		if server, err = systemDNSServer(); err != nil {
+			return nil, err
+		}
+	}
+	for aliases := 0; ; aliases++ {
+		id, query, err := dnsQueryWith(name, dnsTypeHTTPS, true, 1232)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := dnsExchange(meter, "udp", server, id, query, deadline)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Header.RCode != dnsmessage.RCodeSuccess && resp.Header.RCode != dnsmessage.RCodeNameError {
+			return nil, fmt.Errorf("dns: %s", dnsRcodeName(resp.Header.RCode))
+		}
+		var records []svcbRecord
+		var alias string
+		for _, a := range resp.Answers {
+			if a.SVCB == nil {
+				continue
+			}
+			r := *a.SVCB
+			if r.Priority == 0 {
+				// An alias to "." says the service doesn't exist.
+				if r.Target != "." {
+					alias = r.Target
+				}
+				continue
+			}
+			if r.Target == "." {
+				r.Target = a.Name
+			}
+			r.Target = strings.TrimSuffix(r.Target, ".")
+			records = append(records, r)
+		}
+		if records != nil || alias == "" {
+			sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+			return records, nil
+		}
+		if aliases == svcbMaxAliases {
+			return nil, errors.New("dns: too many HTTPS aliases")
+		}
+		name = alias
+	}
+}
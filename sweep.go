@@ -0,0 +1,200 @@
+package libprobe
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const KindSweep = "SWEEP"
+
+// SweepProberOptions configures a SweepProber.
+type SweepProberOptions struct {
+	// Prober probes every host of the swept network. Default: an
+	// unprivileged ICMPProber.
+	Prober Prober
+	// Port is joined to every host address when set, for probers dialing
+	// host:port such as TCPProber.
+	Port string
+	// Concurrency limits the hosts probed at the same time. Default: 64.
+	Concurrency int
+	// ReverseDNS looks up the names of alive hosts. With SkipBogonPTR,
+	// bogons, such as private addresses public resolvers have no names
+	// for, aren't looked up.
+	ReverseDNS   bool
+	SkipBogonPTR bool
+	// Classifier, when set, classifies the alive hosts. SkipBogonPTR
+	// defaults to classifying with the IANA registries.
+	Classifier AddressClassifier
+	// MaxHosts is the largest number of hosts a sweep may expand to.
+	// Default: 65536.
+	MaxHosts int
+}
+
+// SweepHost is an alive host found by a SweepProber.
+type SweepHost struct {
+	Address string
+	RTT     time.Duration
+	// Name is the first reverse DNS name of the host, if requested.
+	Name string
+	// Info classifies Address when the prober has a Classifier.
+	Info *AddressInfo
+}
+
+// SweepResult lists the alive hosts of a swept network ordered by address.
+type SweepResult struct {
+	Target
+
+	Scanned int
+	Alive   []SweepHost
+}
+
+// RTT returns the average RTT of the alive hosts.
+func (r SweepResult) RTT() time.Duration {
+	if len(r.Alive) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, h := range r.Alive {
+		total += h.RTT
+	}
+	return total / time.Duration(len(r.Alive))
+}
+
+func (r SweepResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d of %d hosts alive\n", r.Target.Address, len(r.Alive), r.Scanned)
+	for _, h := range r.Alive {
+		if h.Name != "" {
+			fmt.Fprintf(&b, "%s (%s) %s\n", h.Address, h.Name, h.RTT)
+		} else {
+			fmt.Fprintf(&b, "%s %s\n", h.Address, h.RTT)
+		}
+	}
+	return b.String()
+}
+
+// SweepProber probes every host of a network given in CIDR notation and
+// reports those that answered. Target.Timeout, Count and Interval apply to
+// each host; the timeout defaults to one second.
+type SweepProber struct {
+	opts SweepProberOptions
+}
+
+func NewSweepProber(opts SweepProberOptions) *SweepProber {
+	if opts.Prober == nil {
+		opts.Prober = NewICMPProber(false)
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 64
+	}
+	if opts.MaxHosts <= 0 {
+		opts.MaxHosts = 65536
+	}
+	return &SweepProber{opts: opts}
+}
+
+func (p *SweepProber) Kind() string {
+	return KindSweep
+}
+
+// SweepHosts expands a CIDR network into its host addresses. The network and
+// broadcast addresses of IPv4 networks larger than /31 are left out. A plain
+// IP address expands to itself.
+func SweepHosts(cidr string, max int) ([]net.IP, error) {
+	if ip := net.ParseIP(cidr); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones >= 31 || (max > 0 && 1<<uint(bits-ones) > max+2) {
+		return nil, fmt.Errorf("sweep: %s has more than %d hosts", cidr, max)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	var hosts []net.IP
+	for cur := ip.Mask(ipnet.Mask); ipnet.Contains(cur); cur = nextIP(cur) {
+		hosts = append(hosts, cur)
+	}
+	if bits == 32 && ones < 31 {
+		hosts = hosts[1 : len(hosts)-1]
+	}
+	return hosts, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	// Wrapped around past the last address.
+	return nil
+}
+
+func (p *SweepProber) Probe(target Target) (Result, error) {
+	hosts, err := SweepHosts(target.Address, p.opts.MaxHosts)
+	if err != nil {
+		return nil, err
+	}
+	if target.Timeout <= 0 {
+		target.Timeout = time.Second
+	}
+	r := &SweepResult{Target: target, Scanned: len(hosts)}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slot := make(chan struct{}, p.opts.Concurrency)
+	for _, ip := range hosts {
+		host := Target{
+			Address:  ip.String(),
+			Timeout:  target.Timeout,
+			Interval: target.Interval,
+			Count:    target.Count,
+		}
+		if p.opts.Port != "" {
+			host.Address = net.JoinHostPort(host.Address, p.opts.Port)
+		}
+		wg.Add(1)
+		slot <- struct{}{}
+		go func(ip net.IP, host Target) {
+			defer wg.Done()
+			defer func() { <-slot }()
+			res, err := safeProbe(p.opts.Prober, host)
+			if err != nil || !resultOK(res) {
+				return
+			}
+			alive := SweepHost{Address: ip.String(), RTT: res.RTT()}
+			var info AddressInfo
+			if p.opts.Classifier != nil {
+				info = p.opts.Classifier.Classify(ip)
+				alive.Info = &info
+			} else if p.opts.SkipBogonPTR {
+				info = RegistryClassifier{}.Classify(ip)
+			}
+			if p.opts.ReverseDNS && !(p.opts.SkipBogonPTR && info.Bogon) {
+				if names, err := net.LookupAddr(alive.Address); err == nil && len(names) > 0 {
+					alive.Name = strings.TrimSuffix(names[0], ".")
+				}
+			}
+			mu.Lock()
+			r.Alive = append(r.Alive, alive)
+			mu.Unlock()
+		}(ip, host)
+	}
+	wg.Wait()
+	sort.Slice(r.Alive, func(i, j int) bool {
+		return string(net.ParseIP(r.Alive[i].Address)) < string(net.ParseIP(r.Alive[j].Address))
+	})
+	return r, nil
+}
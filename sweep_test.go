@@ -0,0 +1,58 @@
+package libprobe_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweepHosts(t *testing.T) {
+	hosts, err := libprobe.SweepHosts("192.0.2.0/29", 0)
+	require.NoError(t, err)
+	require.Len(t, hosts, 6)
+	require.Equal(t, "192.0.2.1", hosts[0].String())
+	require.Equal(t, "192.0.2.6", hosts[5].String())
+
+	hosts, err = libprobe.SweepHosts("192.0.2.0/31", 0)
+	require.NoError(t, err)
+	require.Len(t, hosts, 2)
+
+	hosts, err = libprobe.SweepHosts("2001:db8::/126", 0)
+	require.NoError(t, err)
+	require.Len(t, hosts, 4)
+	require.Equal(t, "2001:db8::3", hosts[3].String())
+
+	_, err = libprobe.SweepHosts("10.0.0.0/8", 1024)
+	require.Error(t, err)
+}
+
+func TestSweepProber(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	prober := libprobe.NewSweepProber(libprobe.SweepProberOptions{
+		Prober: libprobe.NewTCPProber(),
+		Port:   port,
+	})
+	r, err := prober.Probe(libprobe.Target{Address: "127.0.0.0/29", Timeout: time.Second})
+	require.NoError(t, err)
+	sweep := r.(*libprobe.SweepResult)
+	require.Equal(t, 6, sweep.Scanned)
+	require.Len(t, sweep.Alive, 1)
+	require.Equal(t, "127.0.0.1", sweep.Alive[0].Address)
+}
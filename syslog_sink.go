@@ -0,0 +1,196 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog facilities and severities, RFC 5424 section 6.2.1.
+const (
+	SyslogFacilityUser   = 1
+	SyslogFacilityDaemon = 3
+	SyslogFacilityLocal0 = 16
+
+	syslogSeverityWarning = 4
+	syslogSeverityInfo    = 6
+)
+
+// SyslogSinkOptions configures a SyslogSink.
+type SyslogSinkOptions struct {
+	// Network is one of "udp", "tcp" or "tls".
+	Network   string
+	Address   string
+	TLSConfig *tls.Config
+	// Facility defaults to SyslogFacilityDaemon.
+	Facility int
+	// Hostname defaults to os.Hostname().
+	Hostname string
+	// AppName defaults to "libprobe".
+	AppName string
+	// SDID is the structured data element ID holding the result columns.
+	// Default: "probe@32473".
+	SDID    string
+	Timeout time.Duration
+}
+
+// SyslogSink emits results as RFC 5424 messages. Every summary column is sent
+// as a parameter of one structured data element. Messages for failed probes
+// are sent with warning severity, successful ones as informational. Stream
+// transports use octet-counting framing (RFC 6587, RFC 5425).
+type SyslogSink struct {
+	opts SyslogSinkOptions
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func NewSyslogSink(opts SyslogSinkOptions) *SyslogSink {
+	if opts.Network == "" {
+		opts.Network = "udp"
+	}
+	if opts.Facility == 0 {
+		opts.Facility = SyslogFacilityDaemon
+	}
+	if opts.Hostname == "" {
+		opts.Hostname, _ = os.Hostname()
+	}
+	if opts.AppName == "" {
+		opts.AppName = "libprobe"
+	}
+	if opts.SDID == "" {
+		opts.SDID = "probe@32473"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	return &SyslogSink{opts: opts}
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogTimestamp is the TIMESTAMP format of RFC 5424, which allows at most
+// six fractional digits.
+const syslogTimestamp = "2006-01-02T15:04:05.000000Z07:00"
+
+// syslogField returns s as a header field of at most max printable ASCII
+// characters, "-" when s is empty.
+func syslogField(s string, max int) string {
+	if s == "" {
+		return "-"
+	}
+	s = strings.Map(func(r rune) rune {
+		if r <= 32 || r >= 127 {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > max {
+		s = s[:max]
+	}
+	return s
+}
+
+// syslogName returns s as an SD-NAME: at most 32 printable ASCII
+// characters other than '=', ']' and '"'.
+func syslogName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= 32 || r >= 127 || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > 32 {
+		s = s[:32]
+	}
+	return s
+}
+
+// FormatSyslog formats a result as an RFC 5424 message without transport
+// framing.
+func (s *SyslogSink) FormatSyslog(at time.Time, r Result) []byte {
+	severity := syslogSeverityInfo
+	if !resultOK(r) {
+		severity = syslogSeverityWarning
+	}
+	row := Flatten(r)[0]
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s [%s",
+		s.opts.Facility*8+severity,
+		at.UTC().Format(syslogTimestamp),
+		syslogField(s.opts.Hostname, 255),
+		syslogField(s.opts.AppName, 48),
+		os.Getpid(),
+		syslogField(resultKind(r), 32),
+		syslogName(s.opts.SDID),
+	)
+	for _, name := range Columns(row) {
+		v, ok := row[name]
+		if !ok || name == ColumnRow || name == ColumnIndex {
+			continue
+		}
+		fmt.Fprintf(&b, ` %s="%s"`, syslogName(name), syslogParamEscaper.Replace(formatCell(v)))
+	}
+	b.WriteString("] ")
+	b.WriteString(strings.Join(strings.Fields(r.String()), " "))
+	return []byte(b.String())
+}
+
+func (s *SyslogSink) dial() error {
+	if s.conn != nil {
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: s.opts.Timeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch s.opts.Network {
+	case "udp", "tcp":
+		conn, err = dialer.Dial(s.opts.Network, s.opts.Address)
+	case "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.opts.Address, s.opts.TLSConfig)
+	default:
+		err = fmt.Errorf("syslog: unsupported network %q", s.opts.Network)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *SyslogSink) Write(r Result) error {
+	msg := s.FormatSyslog(time.Now(), r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.dial(); err != nil {
+		return err
+	}
+	if s.opts.Network != "udp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.opts.Timeout))
+	if _, err := s.conn.Write(msg); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,148 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogSinkUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	sink := libprobe.NewSyslogSink(libprobe.SyslogSinkOptions{
+		Address:  pc.LocalAddr().String(),
+		Hostname: "agent-1",
+	})
+	defer sink.Close()
+	require.NoError(t, sink.Write(&libprobe.TCPResult{
+		Target: libprobe.Target{Address: "1.1.1.1:80"},
+		Error:  errors.New(`dial "x" refused]`),
+	}))
+
+	buf := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	msg := string(buf[:n])
+	require.True(t, strings.HasPrefix(msg, "<28>1 "), msg)
+	require.Contains(t, msg, " agent-1 libprobe ")
+	require.Contains(t, msg, ` TCP [probe@32473 kind="TCP"`)
+	require.Contains(t, msg, `error="dial \"x\" refused\]"`)
+}
+
+func TestSyslogSinkTCPFraming(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(length))
+		msg := make([]byte, n)
+		_, _ = r.Read(msg)
+		received <- string(msg)
+	}()
+
+	sink := libprobe.NewSyslogSink(libprobe.SyslogSinkOptions{
+		Network: "tcp",
+		Address: l.Addr().String(),
+	})
+	defer sink.Close()
+	require.NoError(t, sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "1.1.1.1:80"}}))
+	select {
+	case msg := <-received:
+		require.True(t, strings.HasPrefix(msg, "<30>1 "), msg)
+	case <-time.After(3 * time.Second):
+		t.Fatal("no message received")
+	}
+}
+
+// syslogGrammar matches RFC 5424 messages with a single SD-ELEMENT.
+var syslogGrammar = regexp.MustCompile(`^<(\d{1,3})>1 ` +
+	`(\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(?:\.\d{1,6})?(?:Z|[+-]\d\d:\d\d)) ` +
+	`([!-~]{1,255}) ([!-~]{1,48}) ([!-~]{1,128}) ([!-~]{1,32}) ` +
+	`\[([!#-<>-\\^-~]{1,32})((?: [!#-<>-\\^-~]{1,32}="(?:[^"\\\]]|\\.)*")*)\]` +
+	`(?: (.*))?$`)
+
+// syslogParam matches the SD-PARAMs of an SD-ELEMENT.
+var syslogParam = regexp.MustCompile(` ([^=]+)="((?:[^"\\\]]|\\.)*)"`)
+
+type exceptionallyLongCustomProbeKindNameResult struct {
+	libprobe.Target
+}
+
+func (exceptionallyLongCustomProbeKindNameResult) RTT() time.Duration { return 0 }
+func (exceptionallyLongCustomProbeKindNameResult) String() string     { return "custom" }
+
+func TestFormatSyslog(t *testing.T) {
+	sink := libprobe.NewSyslogSink(libprobe.SyslogSinkOptions{
+		Hostname: "agent 1",
+		AppName:  strings.Repeat("a", 60),
+	})
+	at := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	for _, tc := range []struct {
+		result libprobe.Result
+		msgID  string
+		params map[string]string
+	}{
+		{
+			result: &libprobe.TCPResult{
+				Target: libprobe.Target{Address: "1.1.1.1:80", Metadata: map[string]string{
+					`a b=c]"d`:              "v",
+					"é":                     "w",
+					strings.Repeat("k", 40): "x",
+				}},
+				Error: errors.New(`dial "x" refused]`),
+			},
+			msgID: "TCP",
+			params: map[string]string{
+				"address":                             "1.1.1.1:80",
+				"error":                               `dial \"x\" refused\]`,
+				"metadata_a_b_c__d":                   "v",
+				"metadata__":                          "w",
+				"metadata_" + strings.Repeat("k", 23): "x",
+			},
+		},
+		{
+			result: exceptionallyLongCustomProbeKindNameResult{Target: libprobe.Target{Address: "host"}},
+			msgID:  "exceptionallyLongCustomProbeKind",
+			params: map[string]string{"address": "host"},
+		},
+	} {
+		msg := string(sink.FormatSyslog(at, tc.result))
+		m := syslogGrammar.FindStringSubmatch(msg)
+		require.NotNil(t, m, msg)
+		require.Equal(t, "2024-05-06T07:08:09.123456Z", m[2])
+		require.Equal(t, "agent_1", m[3])
+		require.Equal(t, strings.Repeat("a", 48), m[4])
+		require.Equal(t, tc.msgID, m[6])
+		require.Equal(t, "probe@32473", m[7])
+		params := map[string]string{}
+		for _, p := range syslogParam.FindAllStringSubmatch(m[8], -1) {
+			params[p[1]] = p[2]
+		}
+		for name, value := range tc.params {
+			require.Equal(t, value, params[name], name)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package libprobe
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const KindTACACS = "TACACS"
+
+// TACACS+ packet constants (RFC 8907).
+const (
+	tacacsMajorVersion = 0xc0
+	tacacsAuthen       = 1
+
+	tacacsUnencrypted = 0x01
+
+	tacacsLogin        = 1
+	tacacsAuthenASCII  = 1
+	tacacsAuthenPAP    = 2
+	tacacsServiceLogin = 1
+
+	tacacsContinueAbort = 0x01
+
+	tacacsStatusPass    = 0x01
+	tacacsStatusGetData = 0x03
+	tacacsStatusGetUser = 0x04
+	tacacsStatusError   = 0x07
+)
+
+var tacacsStatusNames = map[byte]string{
+	0x01: "PASS",
+	0x02: "FAIL",
+	0x03: "GETDATA",
+	0x04: "GETUSER",
+	0x05: "GETPASS",
+	0x06: "RESTART",
+	0x07: "ERROR",
+	0x21: "FOLLOW",
+}
+
+func tacacsStatusName(status byte) string {
+	if name, ok := tacacsStatusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("STATUS_%d", status)
+}
+
+// TACACSProberOptions configures a TACACSProber.
+type TACACSProberOptions struct {
+	// Key is the shared secret obfuscating the packet bodies. Packets are
+	// sent in the clear when empty.
+	Key string
+	// Username and Password are the credentials of a PAP login. Without
+	// credentials an ASCII login is started and aborted once the server
+	// asks for the user name.
+	Username string
+	Password string
+	// Port is the user port reported to the server. Default: "libprobe".
+	Port string
+}
+
+type TACACSResult struct {
+	Target
+	Error error
+
+	ConnectTime time.Duration
+	AuthTime    time.Duration
+	TotalTime   time.Duration
+	// Status is the status of the authentication REPLY, e.g. "PASS" or
+	// "GETUSER".
+	Status        string
+	ServerMessage string
+}
+
+func (r TACACSResult) RTT() time.Duration {
+	return r.TotalTime
+}
+
+func (r TACACSResult) String() string {
+	if r.Error != nil && r.Status == "" {
+		return fmt.Sprintf("Error: %s", r.Error)
+	}
+	s := fmt.Sprintf("-> %s %s Connect: %s, Authentication: %s", r.Target.Address, r.Status, r.ConnectTime, r.AuthTime)
+	if r.ServerMessage != "" {
+		s += fmt.Sprintf(" %q", r.ServerMessage)
+	}
+	return s
+}
+
+// TACACSProber performs a TACACS+ authentication START/REPLY exchange with
+// the server in Target.Address, TCP port 49 by default. With credentials the
+// probe fails unless the login passes. Without, any answer asking for the
+// user name shows a responsive server sharing the key.
+type TACACSProber struct {
+	opts TACACSProberOptions
+}
+
+func NewTACACSProber(opts TACACSProberOptions) *TACACSProber {
+	if opts.Port == "" {
+		opts.Port = "libprobe"
+	}
+	return &TACACSProber{opts: opts}
+}
+
+func (p *TACACSProber) Kind() string {
+	return KindTACACS
+}
+
+// tacacsPacket is a TACACS+ packet with a deobfuscated body.
+type tacacsPacket struct {
+	Version byte
+	Type    byte
+	Seq     byte
+	Flags   byte
+	Session uint32
+	Body    []byte
+}
+
+// obfuscate XORs body with the MD5 pseudo pad derived from the key, which
+// both obfuscates and restores it.
+func (p *TACACSProber) obfuscate(pkt *tacacsPacket) {
+	if p.opts.Key == "" {
+		return
+	}
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], pkt.Session)
+	var pad []byte
+	for i := 0; i < len(pkt.Body); i++ {
+		if i%md5.Size == 0 {
+			h := md5.New()
+			h.Write(prefix[:])
+			h.Write([]byte(p.opts.Key))
+			h.Write([]byte{pkt.Version, pkt.Seq})
+			h.Write(pad)
+			pad = h.Sum(nil)
+		}
+		pkt.Body[i] ^= pad[i%md5.Size]
+	}
+}
+
+func (p *TACACSProber) write(w io.Writer, pkt *tacacsPacket) error {
+	if p.opts.Key == "" {
+		pkt.Flags |= tacacsUnencrypted
+	}
+	body := append([]byte(nil), pkt.Body...)
+	p.obfuscate(pkt)
+	b := make([]byte, 12, 12+len(pkt.Body))
+	b[0], b[1], b[2], b[3] = pkt.Version, pkt.Type, pkt.Seq, pkt.Flags
+	binary.BigEndian.PutUint32(b[4:], pkt.Session)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(pkt.Body)))
+	_, err := w.Write(append(b, pkt.Body...))
+	pkt.Body = body
+	return err
+}
+
+func (p *TACACSProber) read(r io.Reader) (*tacacsPacket, error) {
+	var head [12]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0]&0xf0 != tacacsMajorVersion {
+		return nil, fmt.Errorf("tacacs: unsupported version 0x%02x", head[0])
+	}
+	n := binary.BigEndian.Uint32(head[8:])
+	if n > 1<<16 {
+		return nil, errors.New("tacacs: packet too large")
+	}
+	pkt := &tacacsPacket{
+		Version: head[0],
+		Type:    head[1],
+		Seq:     head[2],
+		Flags:   head[3],
+		Session: binary.BigEndian.Uint32(head[4:]),
+		Body:    make([]byte, n),
+	}
+	if _, err := io.ReadFull(r, pkt.Body); err != nil {
+		return nil, err
+	}
+	if pkt.Flags&tacacsUnencrypted == 0 {
+		p.obfuscate(pkt)
+	}
+	return pkt, nil
+}
+
+// start returns an authentication START body.
+func (p *TACACSProber) start(authenType byte, remote string) []byte {
+	user, data := p.opts.Username, ""
+	if authenType == tacacsAuthenPAP {
+		data = p.opts.Password
+	}
+	b := []byte{tacacsLogin, 1, authenType, tacacsServiceLogin,
+		byte(len(user)), byte(len(p.opts.Port)), byte(len(remote)), byte(len(data))}
+	b = append(b, user...)
+	b = append(b, p.opts.Port...)
+	b = append(b, remote...)
+	return append(b, data...)
+}
+
+// parseTACACSReply returns the status and server message of an authentication
+// REPLY body.
+func parseTACACSReply(b []byte) (byte, string, error) {
+	if len(b) < 6 {
+		return 0, "", errors.New("tacacs: truncated reply, wrong key?")
+	}
+	msgLen := int(binary.BigEndian.Uint16(b[2:]))
+	dataLen := int(binary.BigEndian.Uint16(b[4:]))
+	if 6+msgLen+dataLen != len(b) {
+		return 0, "", errors.New("tacacs: malformed reply, wrong key?")
+	}
+	return b[0], string(b[6 : 6+msgLen]), nil
+}
+
+func (p *TACACSProber) Probe(target Target) (Result, error) {
+	if len(p.opts.Username) > 255 || len(p.opts.Password) > 255 || len(p.opts.Port) > 255 {
+		return nil, errors.New("tacacs: fields are limited to 255 bytes")
+	}
+	r := &TACACSResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "49")
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	r.ConnectTime = time.Since(startAt)
+	if target.Timeout > 0 {
+		if err := conn.SetDeadline(startAt.Add(target.Timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	var session [4]byte
+	if _, err := rand.Read(session[:]); err != nil {
+		return nil, err
+	}
+	pkt := &tacacsPacket{
+		Version: tacacsMajorVersion,
+		Type:    tacacsAuthen,
+		Seq:     1,
+		Session: binary.BigEndian.Uint32(session[:]),
+	}
+	remote, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	pap := p.opts.Username != "" || p.opts.Password != ""
+	if pap {
+		// PAP is defined for minor version 1.
+		pkt.Version |= 1
+		pkt.Body = p.start(tacacsAuthenPAP, remote)
+	} else {
+		pkt.Body = p.start(tacacsAuthenASCII, remote)
+	}
+	authAt := time.Now()
+	if err := p.write(conn, pkt); err != nil {
+		r.Error = err
+		return r, nil
+	}
+	reply, err := p.read(conn)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.AuthTime = time.Since(authAt)
+	r.TotalTime = time.Since(startAt)
+	if reply.Session != pkt.Session || reply.Seq != pkt.Seq+1 || reply.Type != tacacsAuthen {
+		r.Error = errors.New("tacacs: unexpected reply")
+		return r, nil
+	}
+	status, msg, err := parseTACACSReply(reply.Body)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.Status, r.ServerMessage = tacacsStatusName(status), msg
+
+	switch {
+	case status == tacacsStatusError:
+		r.Error = fmt.Errorf("tacacs: server error %q", msg)
+	case pap && status != tacacsStatusPass:
+		r.Error = fmt.Errorf("tacacs: authentication %s", r.Status)
+	case !pap && status != tacacsStatusGetUser && status != tacacsStatusGetData:
+		r.Error = fmt.Errorf("tacacs: unexpected status %s", r.Status)
+	case !pap:
+		// Abort the login, the server closes the session.
+		abort := &tacacsPacket{
+			Version: pkt.Version,
+			Type:    tacacsAuthen,
+			Seq:     reply.Seq + 1,
+			Session: pkt.Session,
+			Body:    []byte{0, 0, 0, 0, tacacsContinueAbort},
+		}
+		_ = p.write(conn, abort)
+	}
+	return r, nil
+}
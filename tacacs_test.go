@@ -0,0 +1,108 @@
+package libprobe_test
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func tacacsCrypt(key string, head []byte, body []byte) {
+	var pad []byte
+	for i := range body {
+		if i%md5.Size == 0 {
+			h := md5.New()
+			h.Write(head[4:8])
+			h.Write([]byte(key))
+			h.Write([]byte{head[0], head[2]})
+			h.Write(pad)
+			pad = h.Sum(nil)
+		}
+		body[i] ^= pad[i%md5.Size]
+	}
+}
+
+// serveTACACS accepts the PAP login alice/secret and asks for the user name
+// of ASCII logins.
+func serveTACACS(t *testing.T, key string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				head := make([]byte, 12)
+				if _, err := io.ReadFull(conn, head); err != nil {
+					return
+				}
+				body := make([]byte, binary.BigEndian.Uint32(head[8:]))
+				if _, err := io.ReadFull(conn, body); err != nil {
+					return
+				}
+				tacacsCrypt(key, head, body)
+				status, msg := byte(0x02), "bad credentials"
+				if len(body) < 8 || len(body) != 8+int(body[4])+int(body[5])+int(body[6])+int(body[7]) {
+					return
+				}
+				off := 8
+				user := string(body[off : off+int(body[4])])
+				off += int(body[4]) + int(body[5]) + int(body[6])
+				data := string(body[off : off+int(body[7])])
+				switch {
+				case body[2] == 1 && user == "":
+					status, msg = 0x04, "Username: "
+				case body[2] == 2 && user == "alice" && data == "secret":
+					status, msg = 0x01, ""
+				}
+				reply := []byte{status, 0, 0, byte(len(msg)), 0, 0}
+				reply = append(reply, msg...)
+				head[2]++
+				binary.BigEndian.PutUint32(head[8:], uint32(len(reply)))
+				tacacsCrypt(key, head, reply)
+				conn.Write(append(head, reply...))
+				ioutil.ReadAll(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTACACSProber(t *testing.T) {
+	address := serveTACACS(t, "s3cr3t")
+	target := libprobe.Target{Address: address, Timeout: 5 * time.Second}
+
+	r, err := libprobe.NewTACACSProber(libprobe.TACACSProberOptions{Key: "s3cr3t"}).Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.TACACSResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "GETUSER", res.Status)
+	require.Equal(t, "Username: ", res.ServerMessage)
+
+	r, err = libprobe.NewTACACSProber(libprobe.TACACSProberOptions{Key: "s3cr3t", Username: "alice", Password: "secret"}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.TACACSResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "PASS", res.Status)
+
+	r, err = libprobe.NewTACACSProber(libprobe.TACACSProberOptions{Key: "s3cr3t", Username: "alice", Password: "wrong"}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.TACACSResult)
+	require.Error(t, res.Error)
+	require.Equal(t, "FAIL", res.Status)
+
+	r, err = libprobe.NewTACACSProber(libprobe.TACACSProberOptions{Key: "other"}).Probe(target)
+	require.NoError(t, err)
+	require.Error(t, r.(*libprobe.TACACSResult).Error)
+}
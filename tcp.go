@@ -1,16 +1,30 @@
 package libprobe
 
 import (
+	"context"
 	"fmt"
-	"net"
 	"time"
 )
 
+// TCPProberOptions configures a TCPProber.
+type TCPProberOptions struct {
+	// ProxyProtocol, when set, sends a PROXY protocol header once
+	// connected.
+	ProxyProtocol *ProxyProtocol
+	// DNSCache, when set, resolves host names through the cache.
+	DNSCache *DNSCache
+}
+
 type TCPProber struct {
+	opts TCPProberOptions
 }
 
 func NewTCPProber() *TCPProber {
-	return &TCPProber{}
+	return NewTCPProberWithOptions(TCPProberOptions{})
+}
+
+func NewTCPProberWithOptions(opts TCPProberOptions) *TCPProber {
+	return &TCPProber{opts: opts}
 }
 
 func (p *TCPProber) Kind() string {
@@ -21,6 +35,11 @@ type TCPResult struct {
 	Target
 	Error       error
 	ConnectTime time.Duration
+	// DNSResolveTime and DNSCacheStatus report the resolution of host names
+	// through TCPProberOptions.DNSCache. ConnectTime then excludes it;
+	// without a cache it includes the resolution.
+	DNSResolveTime time.Duration
+	DNSCacheStatus string
 }
 
 func (r TCPResult) RTT() time.Duration {
@@ -35,14 +54,23 @@ func (p *TCPProber) Probe(target Target) (Result, error) {
 	r := &TCPResult{
 		Target: target,
 	}
-	// TODO: Add resolve
+	ctx := withTrafficMeter(context.Background(), target.meter)
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
 	startAt := time.Now()
-	conn, err := net.DialTimeout("tcp", r.Address, r.Timeout)
+	conn, status, resolveTime, err := dialCached(ctx, p.opts.DNSCache, target.BypassDNSCache, "tcp", r.Address, dialContext)
+	r.DNSCacheStatus, r.DNSResolveTime = status, resolveTime
 	if err != nil {
 		r.Error = err
 		return r, nil
 	}
+	r.ConnectTime = time.Since(startAt) - resolveTime
+	if p.opts.ProxyProtocol != nil {
+		r.Error = p.opts.ProxyProtocol.send(conn)
+	}
 	_ = conn.Close()
-	r.ConnectTime = time.Since(startAt)
 	return r, nil
 }
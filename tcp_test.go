@@ -1,7 +1,11 @@
 package libprobe_test
 
 import (
+	"io/ioutil"
+	"net"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/blho/libprobe"
 
@@ -16,3 +20,30 @@ func TestTCPPing(t *testing.T) {
 	require.NoError(t, err)
 	t.Logf("RTT: %s", r.RTT())
 }
+
+func TestTCPProberProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	headers := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		headers <- b
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	p := libprobe.NewTCPProberWithOptions(libprobe.TCPProberOptions{
+		ProxyProtocol: &libprobe.ProxyProtocol{Version: 2, SourceAddress: "192.0.2.1:4242"},
+	})
+	r, err := p.Probe(libprobe.Target{Address: ln.Addr().String(), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.NoError(t, r.(*libprobe.TCPResult).Error)
+	header := append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"), 192, 0, 2, 1, 127, 0, 0, 1, 0x10, 0x92)
+	n, _ := strconv.Atoi(port)
+	header = append(header, byte(n>>8), byte(n))
+	require.Equal(t, header, <-headers)
+}
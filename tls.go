@@ -0,0 +1,380 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindTLS = "TLS"
+
+// TLSExtention configures the handshakes of a TLSProber.
+type TLSExtention struct {
+	// ServerName is sent in the SNI extension and verified against the
+	// certificate. Default: the host of Target.Address.
+	ServerName string
+	// MinVersion is the lowest TLS version accepted, e.g.
+	// tls.VersionTLS12. Default: that of crypto/tls.
+	MinVersion uint16
+	// InsecureSkipVerify reports the certificate chain without verifying
+	// it.
+	InsecureSkipVerify bool
+	// RootCAs verifies the chain. Default: the system pool.
+	RootCAs *x509.CertPool
+	// ClientCert is presented to servers requesting client authentication.
+	ClientCert *tls.Certificate
+	// NextProtos are the ALPN protocols offered.
+	// Default: "h2" and "http/1.1".
+	NextProtos []string
+	// DetectClientAuth reports whether the server requests a client
+	// certificate, and requires it, in TLSResult.ClientAuth. Without
+	// ClientCert, a server refusing the handshake for want of a
+	// certificate then doesn't fail the probe.
+	DetectClientAuth bool
+	// Resumption performs a second handshake resuming the session of the
+	// first, with a session ticket, and reports it in TLSResult.Resumption.
+	// TLS 1.3 servers send tickets after the handshake: the connection is
+	// read until one arrives, for up to a second, discarding any data the
+	// server sends meanwhile.
+	Resumption bool
+	// EarlyData, with Resumption, offers 0-RTT data with a ticket of the
+	// resumed TLS 1.3 session on a third connection, reported in
+	// TLSResumption.EarlyData. crypto/tls can't send early data, so the
+	// prober sends its own ClientHello and closes the connection once the
+	// server answered the offer, without sending data. crypto/tls doesn't
+	// tell which tickets allow early data either, so the offer is made with
+	// any ticket; servers not allowing it reject it or abort the handshake.
+	EarlyData bool
+}
+
+// tlsClientAuthWait bounds the wait for a TLS 1.3 server to refuse the
+// client's empty certificate, which it does after the handshake.
+const tlsClientAuthWait = time.Second
+
+// tlsTicketWait bounds the wait for the session ticket of a TLS 1.3 server,
+// which it sends after the handshake.
+const tlsTicketWait = time.Second
+
+// TLSClientAuth describes the client authentication asked by a server.
+type TLSClientAuth struct {
+	// Requested is set when the server sent a CertificateRequest, Required
+	// when it refused the handshake without a certificate.
+	Requested bool
+	Required  bool
+	// AcceptableCAs are the distinguished names of the CAs advertised by
+	// the server, empty when it accepts any.
+	AcceptableCAs []string
+}
+
+// TLSResumption describes the resumption of a session.
+type TLSResumption struct {
+	// Error is the error of the second handshake.
+	Error error
+	// TicketIssued is set when the server issued a session ticket, Resumed
+	// when it accepted it.
+	TicketIssued bool
+	Resumed      bool
+	// HandshakeTime is the time of the second handshake, Savings the time
+	// saved compared to the first.
+	HandshakeTime time.Duration
+	Savings       time.Duration
+	// EarlyData is set with TLSExtention.EarlyData when the session was
+	// resumed with TLS 1.3.
+	EarlyData *TLSEarlyData
+}
+
+// TLSResult describes the handshake with a TLS server. The chain is reported
+// even when it fails verification, in which case Error is set.
+type TLSResult struct {
+	Target
+	Error error
+
+	ConnectTime   time.Duration
+	HandshakeTime time.Duration
+	ServerName    string
+	Version       string
+	CipherSuite   string
+	// ALPN is the negotiated application protocol, empty when the server
+	// didn't select any.
+	ALPN     string
+	Verified bool
+	// Chain holds the certificates presented by the server, leaf first.
+	Chain []CertificateInfo
+	// ExpiresAt is the earliest expiry in the chain, DaysUntilExpiry the
+	// whole days left until then, negative once expired.
+	ExpiresAt       time.Time
+	DaysUntilExpiry int
+	// ClientAuth is set with TLSExtention.DetectClientAuth.
+	ClientAuth *TLSClientAuth
+	// Resumption is set with TLSExtention.Resumption.
+	Resumption *TLSResumption
+}
+
+func (r TLSResult) RTT() time.Duration {
+	return r.HandshakeTime
+}
+
+func (r TLSResult) String() string {
+	if r.Version == "" {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	s := fmt.Sprintf("-> %s %s %s alpn=%q in %v, expires in %d days", r.Target.Address, r.Version, r.CipherSuite, r.ALPN, r.HandshakeTime, r.DaysUntilExpiry)
+	if r.ClientAuth != nil {
+		s += fmt.Sprintf(", client certificate requested=%v required=%v", r.ClientAuth.Requested, r.ClientAuth.Required)
+	}
+	if r.Resumption != nil && r.Resumption.Resumed {
+		s += fmt.Sprintf(", resumed in %v (saved %v)", r.Resumption.HandshakeTime, r.Resumption.Savings)
+	} else if r.Resumption != nil {
+		s += ", not resumed"
+	}
+	if r.Resumption != nil && r.Resumption.EarlyData != nil {
+		if r.Resumption.EarlyData.Accepted {
+			s += ", 0-RTT accepted"
+		} else {
+			s += ", 0-RTT rejected"
+		}
+	}
+	if r.Error != nil {
+		s += fmt.Sprintf(": %v", r.Error)
+	}
+	return s
+}
+
+// TLSProber performs a TLS handshake with Target.Address, "host" or
+// "host:port" with port 443 by default, and reports the negotiated
+// parameters along with the certificate chain, for certificate expiry
+// monitoring.
+type TLSProber struct {
+	ext TLSExtention
+}
+
+func NewTLSProber(ext TLSExtention) *TLSProber {
+	if ext.NextProtos == nil {
+		ext.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return &TLSProber{ext: ext}
+}
+
+func (p *TLSProber) Kind() string {
+	return KindTLS
+}
+
+func (p *TLSProber) Probe(target Target) (Result, error) {
+	r := &TLSResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "443")
+	}
+	host, _, _ := net.SplitHostPort(address)
+	config := unverifiedTLSConfig(&tls.Config{
+		ServerName: p.ext.ServerName,
+		MinVersion: p.ext.MinVersion,
+		NextProtos: p.ext.NextProtos,
+	}, host)
+	if p.ext.ClientCert != nil {
+		config.Certificates = []tls.Certificate{*p.ext.ClientCert}
+	}
+	if p.ext.DetectClientAuth {
+		r.ClientAuth = &TLSClientAuth{}
+		config.GetClientCertificate = func(req *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			r.ClientAuth.Requested = true
+			for _, der := range req.AcceptableCAs {
+				var name pkix.RDNSequence
+				if _, err := asn1.Unmarshal(der, &name); err == nil {
+					var dn pkix.Name
+					dn.FillFromRDNSequence(&name)
+					r.ClientAuth.AcceptableCAs = append(r.ClientAuth.AcceptableCAs, dn.String())
+				}
+			}
+			if p.ext.ClientCert != nil {
+				return p.ext.ClientCert, nil
+			}
+			return &tls.Certificate{}, nil
+		}
+	}
+	var tickets *tlsTicketCache
+	if p.ext.Resumption {
+		tickets = &tlsTicketCache{ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+		config.ClientSessionCache = tickets
+	}
+	r.ServerName = config.ServerName
+
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	r.ConnectTime = time.Since(startAt)
+	if target.Timeout > 0 {
+		if err := conn.SetDeadline(startAt.Add(target.Timeout)); err != nil {
+			return nil, err
+		}
+	}
+	handshakeAt := time.Now()
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.Handshake()
+	r.HandshakeTime = time.Since(handshakeAt)
+	if err == nil && r.ClientAuth != nil && r.ClientAuth.Requested && tlsConn.ConnectionState().Version == tls.VersionTLS13 {
+		err = p.awaitRefusal(tlsConn, startAt.Add(target.Timeout), target.Timeout > 0)
+	}
+	if err != nil {
+		if !p.refusedClientAuth(r, err) {
+			r.HandshakeTime = 0
+			r.Error = err
+			return r, nil
+		}
+		r.ClientAuth.Required = true
+	}
+	state := tlsConn.ConnectionState()
+	r.Version = tlsVersionName(state.Version)
+	r.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	r.ALPN = state.NegotiatedProtocol
+	for _, cert := range state.PeerCertificates {
+		r.Chain = append(r.Chain, *newCertificateInfo(cert))
+		if r.ExpiresAt.IsZero() || cert.NotAfter.Before(r.ExpiresAt) {
+			r.ExpiresAt = cert.NotAfter
+		}
+	}
+	if !r.ExpiresAt.IsZero() {
+		r.DaysUntilExpiry = int(math.Floor(time.Until(r.ExpiresAt).Hours() / 24))
+	}
+	if !p.ext.InsecureSkipVerify {
+		if err := verifyCertificate(state, p.ext.RootCAs, []string{config.ServerName}); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.Verified = true
+	}
+	if tickets != nil {
+		r.Resumption = p.resume(target.meter, tlsConn, tickets, address, config, startAt.Add(target.Timeout), target.Timeout, r.HandshakeTime)
+	}
+	return r, nil
+}
+
+// tlsTicketCache stores the sessions of a TLSProber. TLS 1.3 servers send
+// their tickets after the handshake, which await reads: Put interrupts the
+// read by moving the read deadline of conn once a ticket is stored, and the
+// data read meanwhile is discarded.
+type tlsTicketCache struct {
+	tls.ClientSessionCache
+	conn     *tls.Conn
+	awaiting bool
+	// last is the last session stored.
+	last *tls.ClientSessionState
+}
+
+func (c *tlsTicketCache) Put(key string, cs *tls.ClientSessionState) {
+	if cs != nil {
+		c.last = cs
+		if c.awaiting {
+			_ = c.conn.SetReadDeadline(time.Now())
+		}
+	}
+	c.ClientSessionCache.Put(key, cs)
+}
+
+// await reads from conn until a ticket is stored, for up to tlsTicketWait
+// and until deadline when timeout is set. It returns at once for versions
+// sending tickets within the handshake.
+func (c *tlsTicketCache) await(conn *tls.Conn, deadline time.Time, timeout time.Duration) {
+	if c.last != nil || conn.ConnectionState().Version != tls.VersionTLS13 {
+		return
+	}
+	wait := time.Now().Add(tlsTicketWait)
+	if timeout > 0 && deadline.Before(wait) {
+		wait = deadline
+	}
+	c.conn = conn
+	c.awaiting = true
+	_ = conn.SetReadDeadline(wait)
+	_, _ = conn.Read(make([]byte, 1))
+	c.awaiting = false
+}
+
+// resume performs a second handshake resuming the session of conn, and
+// offers early data with a ticket of the resumed session with EarlyData.
+func (p *TLSProber) resume(meter *trafficMeter, conn *tls.Conn, tickets *tlsTicketCache, address string, config *tls.Config, deadline time.Time, timeout, handshakeTime time.Duration) *TLSResumption {
+	res := &TLSResumption{}
+	tickets.await(conn, deadline, timeout)
+	res.TicketIssued = tickets.last != nil
+	if !res.TicketIssued {
+		return res
+	}
+	// Every handshake has the server to itself, which some servers need
+	// to answer the next one without delay.
+	_ = conn.Close()
+	startAt := time.Now()
+	c, err := dialTimeout(meter, "tcp", address, timeout)
+	if err != nil {
+		res.Error = err
+		return res
+	}
+	defer c.Close()
+	if timeout > 0 {
+		_ = c.SetDeadline(startAt.Add(timeout))
+	}
+	handshakeAt := time.Now()
+	tlsConn := tls.Client(c, config)
+	if err := tlsConn.Handshake(); err != nil {
+		res.Error = err
+		return res
+	}
+	res.HandshakeTime = time.Since(handshakeAt)
+	res.Resumed = tlsConn.ConnectionState().DidResume
+	if res.Resumed {
+		res.Savings = handshakeTime - res.HandshakeTime
+	}
+	if p.ext.EarlyData && res.Resumed && tlsConn.ConnectionState().Version == tls.VersionTLS13 {
+		// Servers may only accept early data once per ticket, the offer is
+		// made with a fresh one.
+		tickets.last = nil
+		tickets.await(tlsConn, startAt.Add(timeout), timeout)
+		if tickets.last == nil {
+			res.EarlyData = &TLSEarlyData{Error: errors.New("tls: no ticket issued for the resumed session")}
+			return res
+		}
+		_ = tlsConn.Close()
+		res.EarlyData = p.earlyData(meter, tickets.last, address, config, timeout)
+	}
+	return res
+}
+
+// awaitRefusal waits for a TLS 1.3 server to refuse the client's
+// certificate, returning the alert received if it does.
+func (p *TLSProber) awaitRefusal(conn *tls.Conn, deadline time.Time, hasDeadline bool) error {
+	wait := time.Now().Add(tlsClientAuthWait)
+	if hasDeadline && deadline.Before(wait) {
+		wait = deadline
+	}
+	if err := conn.SetReadDeadline(wait); err != nil {
+		return err
+	}
+	// Servers may send session tickets, or even data, before refusing.
+	_, err := io.Copy(ioutil.Discard, conn)
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// refusedClientAuth reports whether err is the refusal of a handshake by a
+// server requesting a client certificate that the prober doesn't have.
+func (p *TLSProber) refusedClientAuth(r *TLSResult, err error) bool {
+	if r.ClientAuth == nil || !r.ClientAuth.Requested || p.ext.ClientCert != nil {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
@@ -0,0 +1,542 @@
+package libprobe
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// TLSEarlyData describes an offer of 0-RTT data made with a ticket of a
+// resumed TLS 1.3 session.
+type TLSEarlyData struct {
+	// Error is the error of the attempt, e.g. the alert of a server aborting
+	// handshakes that offer early data, as Go servers do.
+	Error error
+	// Resumed is set when the server accepted the ticket, Accepted when it
+	// also accepted early data.
+	Resumed  bool
+	Accepted bool
+	// Time is the time from sending the ClientHello to receiving the
+	// server's answer to the offer.
+	Time time.Duration
+}
+
+// TLS record content types, handshake message types and extensions, RFC
+// 8446 section 4 and appendix B.
+const (
+	tlsRecordChangeCipherSpec = 20
+	tlsRecordAlert            = 21
+	tlsRecordHandshake        = 22
+	tlsRecordApplicationData  = 23
+
+	tlsMessageClientHello         = 1
+	tlsMessageServerHello         = 2
+	tlsMessageEncryptedExtensions = 8
+
+	tlsExtServerName          = 0
+	tlsExtSupportedGroups     = 10
+	tlsExtSignatureAlgorithms = 13
+	tlsExtALPN                = 16
+	tlsExtPreSharedKey        = 41
+	tlsExtEarlyData           = 42
+	tlsExtSupportedVersions   = 43
+	tlsExtPSKKeyExchangeModes = 45
+	tlsExtKeyShare            = 51
+
+	tlsGroupX25519 = 29
+	tlsPSKDHEKE    = 1
+)
+
+// tlsHelloRetryRequest is the random of a ServerHello asking for another
+// ClientHello.
+var tlsHelloRetryRequest = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// tlsSignatureAlgorithms are offered with early data; the server doesn't
+// sign anything when it resumes a session, but may require the extension.
+var tlsSignatureAlgorithms = []uint16{0x0403, 0x0503, 0x0603, 0x0804, 0x0805, 0x0806, 0x0807, 0x0401, 0x0501, 0x0601}
+
+// tls13Suite is a TLS 1.3 cipher suite.
+type tls13Suite struct {
+	hash   func() hash.Hash
+	keyLen int
+	aead   func(key []byte) (cipher.AEAD, error)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var tls13Suites = map[uint16]*tls13Suite{
+	tls.TLS_AES_128_GCM_SHA256:       {sha256.New, 16, newAESGCM},
+	tls.TLS_AES_256_GCM_SHA384:       {sha512.New384, 32, newAESGCM},
+	tls.TLS_CHACHA20_POLY1305_SHA256: {sha256.New, 32, chacha20poly1305.New},
+}
+
+// extract is HKDF-Extract, with a secret of zeros when secret is nil.
+func (s *tls13Suite) extract(secret, salt []byte) []byte {
+	if secret == nil {
+		secret = make([]byte, s.hash().Size())
+	}
+	prk, err := hkdf.Extract(s.hash, secret, salt)
+	if err != nil {
+		panic(err)
+	}
+	return prk
+}
+
+// expandLabel is HKDF-Expand-Label of RFC 8446 section 7.1.
+func (s *tls13Suite) expandLabel(secret []byte, label string, context []byte, length int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(context)
+	})
+	out, err := hkdf.Expand(s.hash, secret, string(b.BytesOrPanic()), length)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// deriveSecret is Derive-Secret of RFC 8446 section 7.1, over an empty
+// transcript when transcript is nil.
+func (s *tls13Suite) deriveSecret(secret []byte, label string, transcript hash.Hash) []byte {
+	if transcript == nil {
+		transcript = s.hash()
+	}
+	return s.expandLabel(secret, label, transcript.Sum(nil), s.hash().Size())
+}
+
+// tls13Session is what it takes to resume a TLS 1.3 client session.
+type tls13Session struct {
+	ticket    []byte
+	suite     uint16
+	createdAt time.Time
+	psk       []byte
+	ageAdd    uint32
+}
+
+// parseTLS13Session reads the PSK of a session, which crypto/tls only
+// exposes in the encoding of tls.SessionState.Bytes, described in its
+// source.
+func parseTLS13Session(cs *tls.ClientSessionState) (*tls13Session, error) {
+	ticket, state, err := cs.ResumptionState()
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, errors.New("tls: no session to resume")
+	}
+	encoded, err := state.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	session := &tls13Session{ticket: ticket}
+	var (
+		version         uint16
+		typ             uint8
+		extMasterSecret uint8
+		earlyData       uint8
+		createdAt       uint64
+		useBy           uint64
+		psk             []byte
+		skip            cryptobyte.String
+	)
+	s := cryptobyte.String(encoded)
+	if !s.ReadUint16(&version) ||
+		!s.ReadUint8(&typ) ||
+		!s.ReadUint16(&session.suite) ||
+		!s.ReadUint64(&createdAt) ||
+		!s.ReadUint8LengthPrefixed((*cryptobyte.String)(&psk)) ||
+		!s.ReadUint24LengthPrefixed(&skip) || // extra
+		!s.ReadUint8(&extMasterSecret) ||
+		!s.ReadUint8(&earlyData) ||
+		!s.ReadUint24LengthPrefixed(&skip) || // certificate_list
+		!s.ReadUint24LengthPrefixed(&skip) || // verified_chains
+		(earlyData == 1 && !s.ReadUint8LengthPrefixed(&skip)) || // alpn
+		!s.ReadUint64(&useBy) ||
+		!s.ReadUint32(&session.ageAdd) {
+		return nil, errors.New("tls: unsupported session encoding")
+	}
+	if version != tls.VersionTLS13 || typ != 2 {
+		return nil, errors.New("tls: not a TLS 1.3 client session")
+	}
+	session.createdAt = time.Unix(int64(createdAt), 0)
+	session.psk = psk
+	return session, nil
+}
+
+// clientHello returns a ClientHello resuming the session and offering early
+// data.
+func (s *tls13Session) clientHello(suite *tls13Suite, serverName string, alpn []string, key *ecdh.PrivateKey) ([]byte, error) {
+	var random, sessionID [32]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(sessionID[:]); err != nil {
+		return nil, err
+	}
+	age := uint32(time.Since(s.createdAt)/time.Millisecond) + s.ageAdd
+	binderLen := suite.hash().Size()
+
+	var b cryptobyte.Builder
+	b.AddUint8(tlsMessageClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(tls.VersionTLS12)
+		b.AddBytes(random[:])
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(sessionID[:])
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(s.suite)
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8(0) // null compression
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			if serverName != "" {
+				b.AddUint16(tlsExtServerName)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddUint8(0) // host_name
+						b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+							b.AddBytes([]byte(serverName))
+						})
+					})
+				})
+			}
+			b.AddUint16(tlsExtSupportedVersions)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(tls.VersionTLS13)
+				})
+			})
+			b.AddUint16(tlsExtSupportedGroups)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(tlsGroupX25519)
+				})
+			})
+			b.AddUint16(tlsExtSignatureAlgorithms)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					for _, alg := range tlsSignatureAlgorithms {
+						b.AddUint16(alg)
+					}
+				})
+			})
+			b.AddUint16(tlsExtKeyShare)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(tlsGroupX25519)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(key.PublicKey().Bytes())
+					})
+				})
+			})
+			b.AddUint16(tlsExtPSKKeyExchangeModes)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(tlsPSKDHEKE)
+				})
+			})
+			if len(alpn) > 0 {
+				b.AddUint16(tlsExtALPN)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						for _, proto := range alpn {
+							b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+								b.AddBytes([]byte(proto))
+							})
+						}
+					})
+				})
+			}
+			b.AddUint16(tlsExtEarlyData)
+			b.AddUint16(0)
+			// pre_shared_key must come last, its binder is filled in below.
+			b.AddUint16(tlsExtPreSharedKey)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(s.ticket)
+					})
+					b.AddUint32(age)
+				})
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(make([]byte, binderLen))
+					})
+				})
+			})
+		})
+	})
+	hello, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	// The binder is a MAC of the ClientHello up to the binders list, which
+	// makes up its last bytes.
+	binderKey := suite.deriveSecret(suite.extract(s.psk, nil), "res binder", nil)
+	transcript := suite.hash()
+	transcript.Write(hello[:len(hello)-2-1-binderLen])
+	mac := hmac.New(suite.hash, suite.expandLabel(binderKey, "finished", nil, binderLen))
+	mac.Write(transcript.Sum(nil))
+	copy(hello[len(hello)-binderLen:], mac.Sum(nil))
+	return hello, nil
+}
+
+// tls13Reader reads the handshake messages of a server, decrypting records
+// once aead is set.
+type tls13Reader struct {
+	r    io.Reader
+	aead cipher.AEAD
+	iv   []byte
+	seq  uint64
+	buf  []byte
+}
+
+func (t *tls13Reader) setKey(suite *tls13Suite, secret []byte) error {
+	aead, err := suite.aead(suite.expandLabel(secret, "key", nil, suite.keyLen))
+	if err != nil {
+		return err
+	}
+	t.aead = aead
+	t.iv = suite.expandLabel(secret, "iv", nil, aead.NonceSize())
+	t.seq = 0
+	return nil
+}
+
+func (t *tls13Reader) readRecord() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(t.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(header[3:]))
+	if n > 1<<14+256 {
+		return 0, nil, errors.New("tls: record overflow")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(t.r, data); err != nil {
+		return 0, nil, err
+	}
+	if t.aead == nil || header[0] != tlsRecordApplicationData {
+		return header[0], data, nil
+	}
+	nonce := make([]byte, len(t.iv))
+	copy(nonce, t.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(t.seq >> (8 * i))
+	}
+	t.seq++
+	plain, err := t.aead.Open(data[:0], nonce, data, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	// The content type follows the content and precedes the padding.
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil, errors.New("tls: record without content type")
+	}
+	return plain[i], plain[:i], nil
+}
+
+// readMessage returns the next handshake message, with its header.
+func (t *tls13Reader) readMessage() ([]byte, error) {
+	for {
+		if len(t.buf) >= 4 {
+			n := 4 + (int(t.buf[1])<<16 | int(t.buf[2])<<8 | int(t.buf[3]))
+			if len(t.buf) >= n {
+				msg := t.buf[:n]
+				t.buf = t.buf[n:]
+				return msg, nil
+			}
+		}
+		typ, data, err := t.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case tlsRecordHandshake:
+			t.buf = append(t.buf, data...)
+		case tlsRecordAlert:
+			if len(data) != 2 {
+				return nil, errors.New("tls: malformed alert")
+			}
+			return nil, tls.AlertError(data[1])
+		case tlsRecordChangeCipherSpec:
+		default:
+			return nil, fmt.Errorf("tls: unexpected record type %d", typ)
+		}
+	}
+}
+
+// earlyData offers early data with session on a new connection. No data is
+// sent: the offer is answered in the server's EncryptedExtensions, after
+// which the connection is closed.
+func (p *TLSProber) earlyData(meter *trafficMeter, cs *tls.ClientSessionState, address string, config *tls.Config, timeout time.Duration) *TLSEarlyData {
+	res := &TLSEarlyData{}
+	session, err := parseTLS13Session(cs)
+	if err != nil {
+		res.Error = err
+		return res
+	}
+	suite := tls13Suites[session.suite]
+	if suite == nil {
+		res.Error = fmt.Errorf("tls: unsupported cipher suite %s", tls.CipherSuiteName(session.suite))
+		return res
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		res.Error = err
+		return res
+	}
+	serverName := config.ServerName
+	if net.ParseIP(serverName) != nil {
+		serverName = ""
+	}
+	hello, err := session.clientHello(suite, serverName, config.NextProtos, key)
+	if err != nil {
+		res.Error = err
+		return res
+	}
+
+	startAt := time.Now()
+	c, err := dialTimeout(meter, "tcp", address, timeout)
+	if err != nil {
+		res.Error = err
+		return res
+	}
+	defer c.Close()
+	if timeout > 0 {
+		_ = c.SetDeadline(startAt.Add(timeout))
+	}
+	sentAt := time.Now()
+	record := []byte{tlsRecordHandshake, 3, 1, byte(len(hello) >> 8), byte(len(hello))}
+	if _, err := c.Write(append(record, hello...)); err != nil {
+		res.Error = err
+		return res
+	}
+	res.Resumed, res.Accepted, res.Error = session.answer(&tls13Reader{r: c}, suite, hello, key)
+	if res.Error == nil {
+		res.Time = time.Since(sentAt)
+	}
+	return res
+}
+
+// answer reads the server's answer to hello up to its EncryptedExtensions.
+func (s *tls13Session) answer(r *tls13Reader, suite *tls13Suite, hello []byte, key *ecdh.PrivateKey) (resumed, accepted bool, err error) {
+	msg, err := r.readMessage()
+	if err != nil {
+		return false, false, err
+	}
+	var (
+		random, serverKey, exts cryptobyte.String
+		version, cipherSuite    uint16
+		group, selected         uint16
+		hasPSK                  bool
+	)
+	m := cryptobyte.String(msg[4:])
+	if msg[0] != tlsMessageServerHello ||
+		!m.Skip(2) || // legacy_version
+		!m.ReadBytes((*[]byte)(&random), 32) ||
+		!m.ReadUint8LengthPrefixed(new(cryptobyte.String)) ||
+		!m.ReadUint16(&cipherSuite) ||
+		!m.Skip(1) || // legacy_compression_method
+		!m.ReadUint16LengthPrefixed(&exts) {
+		return false, false, errors.New("tls: malformed ServerHello")
+	}
+	if bytes.Equal(random, tlsHelloRetryRequest) {
+		// A server asking for another key share has rejected early data.
+		return false, false, nil
+	}
+	for !exts.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+			return false, false, errors.New("tls: malformed ServerHello")
+		}
+		switch typ {
+		case tlsExtSupportedVersions:
+			data.ReadUint16(&version)
+		case tlsExtKeyShare:
+			data.ReadUint16(&group)
+			data.ReadUint16LengthPrefixed(&serverKey)
+		case tlsExtPreSharedKey:
+			hasPSK = data.ReadUint16(&selected)
+		}
+	}
+	if version != tls.VersionTLS13 || cipherSuite != s.suite || group != tlsGroupX25519 {
+		return false, false, errors.New("tls: unexpected ServerHello parameters")
+	}
+	peer, err := ecdh.X25519().NewPublicKey(serverKey)
+	if err != nil {
+		return false, false, err
+	}
+	shared, err := key.ECDH(peer)
+	if err != nil {
+		return false, false, err
+	}
+	var psk []byte
+	if hasPSK && selected == 0 {
+		psk = s.psk
+		resumed = true
+	}
+	transcript := suite.hash()
+	transcript.Write(hello)
+	transcript.Write(msg)
+	handshakeSecret := suite.extract(shared, suite.deriveSecret(suite.extract(psk, nil), "derived", nil))
+	if err := r.setKey(suite, suite.deriveSecret(handshakeSecret, "s hs traffic", transcript)); err != nil {
+		return resumed, false, err
+	}
+
+	msg, err = r.readMessage()
+	if err != nil {
+		return resumed, false, err
+	}
+	m = cryptobyte.String(msg[4:])
+	if msg[0] != tlsMessageEncryptedExtensions || !m.ReadUint16LengthPrefixed(&exts) {
+		return resumed, false, errors.New("tls: malformed EncryptedExtensions")
+	}
+	for !exts.Empty() {
+		var typ uint16
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(new(cryptobyte.String)) {
+			return resumed, false, errors.New("tls: malformed EncryptedExtensions")
+		}
+		if typ == tlsExtEarlyData {
+			accepted = true
+		}
+	}
+	return resumed, accepted, nil
+}
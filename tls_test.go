@@ -0,0 +1,214 @@
+package libprobe_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSProber(t *testing.T) {
+	// The test server's certificate is valid for example.com and 127.0.0.1.
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	address := srv.Listener.Addr().String()
+
+	prober := libprobe.NewTLSProber(libprobe.TLSExtention{ServerName: "example.com", RootCAs: roots})
+	r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.TLSResult)
+	require.NoError(t, res.Error)
+	require.True(t, res.Verified)
+	require.Equal(t, "example.com", res.ServerName)
+	require.Equal(t, "TLS 1.3", res.Version)
+	require.NotEmpty(t, res.CipherSuite)
+	require.Equal(t, "h2", res.ALPN)
+	require.Len(t, res.Chain, 1)
+	require.Contains(t, res.Chain[0].DNSNames, "example.com")
+	require.Equal(t, res.Chain[0].NotAfter, res.ExpiresAt)
+	require.True(t, res.DaysUntilExpiry > 365)
+	require.True(t, res.HandshakeTime > 0)
+
+	// The chain is reported even when it can't be verified.
+	r, err = libprobe.NewTLSProber(libprobe.TLSExtention{ServerName: "other.example", RootCAs: roots}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.TLSResult)
+	require.Error(t, res.Error)
+	require.False(t, res.Verified)
+	require.Len(t, res.Chain, 1)
+
+	r, err = libprobe.NewTLSProber(libprobe.TLSExtention{InsecureSkipVerify: true, NextProtos: []string{}}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.TLSResult)
+	require.NoError(t, res.Error)
+	require.False(t, res.Verified)
+	require.Empty(t, res.ALPN)
+
+	r, err = libprobe.NewTLSProber(libprobe.TLSExtention{InsecureSkipVerify: true, MinVersion: 0x0305}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.Error(t, r.(*libprobe.TLSResult).Error)
+}
+
+func TestTLSProberClientCert(t *testing.T) {
+	presented := make(chan int, 2)
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequestClientCert,
+		VerifyPeerCertificate: func(certs [][]byte, _ [][]*x509.Certificate) error {
+			presented <- len(certs)
+			return nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	address := srv.Listener.Addr().String()
+
+	r, err := libprobe.NewTLSProber(libprobe.TLSExtention{InsecureSkipVerify: true}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.NoError(t, r.(*libprobe.TLSResult).Error)
+	require.Equal(t, 0, <-presented)
+
+	cert := srv.TLS.Certificates[0]
+	r, err = libprobe.NewTLSProber(libprobe.TLSExtention{InsecureSkipVerify: true, ClientCert: &cert}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.NoError(t, r.(*libprobe.TLSResult).Error)
+	require.Equal(t, 1, <-presented)
+}
+
+func TestTLSProberDetectClientAuth(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		for _, clientAuth := range []tls.ClientAuthType{tls.NoClientCert, tls.VerifyClientCertIfGiven, tls.RequireAndVerifyClientCert} {
+			srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+			srv.TLS = &tls.Config{ClientAuth: clientAuth, MaxVersion: version}
+			srv.StartTLS()
+			pool := x509.NewCertPool()
+			pool.AddCert(srv.Certificate())
+			srv.TLS.ClientCAs = pool
+
+			prober := libprobe.NewTLSProber(libprobe.TLSExtention{InsecureSkipVerify: true, DetectClientAuth: true})
+			r, err := prober.Probe(libprobe.Target{Address: srv.Listener.Addr().String(), Timeout: 5 * time.Second})
+			srv.Close()
+			require.NoError(t, err)
+			res := r.(*libprobe.TLSResult)
+			require.NoError(t, res.Error)
+			require.NotEmpty(t, res.Version)
+			require.Len(t, res.Chain, 1)
+			want := &libprobe.TLSClientAuth{}
+			if clientAuth != tls.NoClientCert {
+				want.Requested = true
+				want.Required = clientAuth == tls.RequireAndVerifyClientCert
+				want.AcceptableCAs = []string{"O=Acme Co"}
+			}
+			require.Equal(t, want, res.ClientAuth, "version %x, client auth %v", version, clientAuth)
+		}
+	}
+}
+
+func TestTLSProberResumption(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+		srv.TLS = &tls.Config{MaxVersion: version}
+		srv.StartTLS()
+		defer srv.Close()
+		roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+		r, err := libprobe.NewTLSProber(libprobe.TLSExtention{RootCAs: roots, Resumption: true}).Probe(libprobe.Target{Address: srv.Listener.Addr().String(), Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		res := r.(*libprobe.TLSResult)
+		require.NoError(t, res.Error)
+		require.NotNil(t, res.Resumption)
+		require.NoError(t, res.Resumption.Error)
+		require.True(t, res.Resumption.TicketIssued)
+		require.True(t, res.Resumption.Resumed, "version %x", version)
+		require.Positive(t, res.Resumption.HandshakeTime)
+		require.Equal(t, res.HandshakeTime-res.Resumption.HandshakeTime, res.Resumption.Savings)
+		require.Contains(t, res.String(), "resumed in")
+	}
+
+	// Without tickets, the session isn't resumed.
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &tls.Config{SessionTicketsDisabled: true}
+	srv.StartTLS()
+	defer srv.Close()
+	r, err := libprobe.NewTLSProber(libprobe.TLSExtention{InsecureSkipVerify: true, Resumption: true}).Probe(libprobe.Target{Address: srv.Listener.Addr().String(), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.TLSResult)
+	require.NoError(t, res.Error)
+	require.False(t, res.Resumption.TicketIssued)
+	require.False(t, res.Resumption.Resumed)
+	require.Contains(t, res.String(), "not resumed")
+}
+
+func TestTLSProberEarlyData(t *testing.T) {
+	// Go servers abort handshakes offering early data.
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.StartTLS()
+	defer srv.Close()
+	prober := libprobe.NewTLSProber(libprobe.TLSExtention{InsecureSkipVerify: true, Resumption: true, EarlyData: true})
+	r, err := prober.Probe(libprobe.Target{Address: srv.Listener.Addr().String(), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.TLSResult)
+	require.True(t, res.Resumption.Resumed)
+	early := res.Resumption.EarlyData
+	require.NotNil(t, early)
+	var alert tls.AlertError
+	require.True(t, errors.As(early.Error, &alert), "%v", early.Error)
+	require.False(t, early.Accepted)
+	require.Contains(t, res.String(), "0-RTT rejected")
+
+	// OpenSSL accepts early data when started with -early_data.
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl not found")
+	}
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	out, err := exec.Command(openssl, "req", "-x509", "-newkey", "ec", "-pkeyopt", "ec_paramgen_curve:prime256v1",
+		"-nodes", "-subj", "/CN=localhost", "-days", "1", "-keyout", key, "-out", cert).CombinedOutput()
+	require.NoError(t, err, "%s", out)
+	for _, earlyData := range []bool{true, false} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		address := l.Addr().String()
+		l.Close()
+		args := []string{"s_server", "-accept", address, "-cert", cert, "-key", key, "-tls1_3", "-quiet"}
+		if earlyData {
+			args = append(args, "-early_data")
+		}
+		server := exec.Command(openssl, args...)
+		require.NoError(t, server.Start())
+		defer server.Process.Kill()
+		require.Eventually(t, func() bool {
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				conn.Close()
+			}
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+
+		r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		res := r.(*libprobe.TLSResult)
+		require.NoError(t, res.Error)
+		require.True(t, res.Resumption.Resumed)
+		early := res.Resumption.EarlyData
+		require.NotNil(t, early)
+		require.NoError(t, early.Error)
+		require.True(t, early.Resumed)
+		require.Equal(t, earlyData, early.Accepted)
+		require.Positive(t, early.Time)
+	}
+}
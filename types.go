@@ -1,6 +1,7 @@
 package libprobe
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"time"
@@ -17,6 +18,24 @@ type Target struct {
 	RequestMethod string
 	Headers       http.Header
 	Body          io.Reader
+
+	// ProbeID and TraceID correlate a probe across sinks, logs and remote
+	// reflectors. Results carry them along with the rest of the target, and
+	// probers propagate them on the wire where the protocol allows: HTTP
+	// and gRPC requests carry an X-Probe-ID header and, when TraceID is a
+	// W3C trace ID, a traceparent header; ICMP echo payloads carry the
+	// probe ID after the payload tag.
+	ProbeID string
+	TraceID string
+	// Metadata are labels carried into results, flattened into
+	// "metadata_<key>" columns.
+	Metadata map[string]string
+	// BypassDNSCache resolves the host name afresh, refreshing the DNS
+	// cache of probers that have one.
+	BypassDNSCache bool
+
+	// meter counts the traffic of the sockets of a probe run by an Engine.
+	meter *trafficMeter
 }
 
 func (t Target) GetCount() int {
@@ -36,6 +55,13 @@ type Prober interface {
 	Probe(target Target) (Result, error)
 }
 
+// ContextProber is implemented by probers whose probes can be interrupted by
+// cancelling ctx.
+type ContextProber interface {
+	Prober
+	ProbeContext(ctx context.Context, target Target) (Result, error)
+}
+
 const (
 	KindTCP  = "TCP"
 	KindHTTP = "HTTP"
@@ -0,0 +1,151 @@
+package libprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
+
+// WatchdogOptions configures the watchdog of an Engine, which keeps
+// long-lived agents from accumulating probes that hang or leak.
+type WatchdogOptions struct {
+	// MaxProbeDuration is a hard cap on the wall-clock time of a probe,
+	// whatever its target's timeout. Probes running past it are cancelled
+	// and abandoned, and a WatchdogResult is delivered in place of their
+	// result. Default: 0, no cap.
+	MaxProbeDuration time.Duration
+	// TrackResources counts goroutines and open file descriptors before
+	// and after every probe, accounting their change to the job in
+	// JobStats. Probes running at the same time blur the accounting, and
+	// connections may shut down shortly after a probe: a count growing
+	// steadily is the sign of a leak, which Concurrency 1 pins down to a
+	// job. File descriptors are counted on Linux only.
+	TrackResources bool
+}
+
+// ErrProbeHung is the error of probes killed by the watchdog.
+var ErrProbeHung = errors.New("watchdog: probe hung")
+
+// WatchdogResult is delivered in place of the result of a probe killed by
+// the watchdog.
+type WatchdogResult struct {
+	Target
+	Kind  string
+	Error error
+	// Duration is how long the probe ran before it was killed.
+	Duration time.Duration
+}
+
+func (r WatchdogResult) RTT() time.Duration {
+	return 0
+}
+
+func (r WatchdogResult) String() string {
+	return fmt.Sprintf("%s %s: %v", r.Kind, r.Target.Address, r.Error)
+}
+
+// resourceUsage counts the goroutines and open file descriptors of the
+// process, FDs being -1 where they can't be counted.
+type resourceUsage struct {
+	Goroutines int
+	FDs        int
+}
+
+func sampleResources() resourceUsage {
+	u := resourceUsage{Goroutines: runtime.NumGoroutine(), FDs: -1}
+	if dir, err := os.Open("/proc/self/fd"); err == nil {
+		names, err := dir.Readdirnames(-1)
+		dir.Close()
+		if err == nil {
+			// Not counting the descriptor of dir itself.
+			u.FDs = len(names) - 1
+		}
+	}
+	return u
+}
+
+// watchProbe probes target under the watchdog. Probes killed for running
+// past the cap are reported by a WatchdogResult, and counted as hung until
+// they return, if ever.
+func (e *Engine) watchProbe(ctx context.Context, job Job, target Target, stats *JobStats) (Result, error) {
+	wd := e.opts.Watchdog
+	var before resourceUsage
+	if wd.TrackResources {
+		before = sampleResources()
+	}
+	if wd.MaxProbeDuration <= 0 {
+		r, err := probeContext(ctx, job.Prober, target)
+		e.accountResources(stats, before)
+		return r, err
+	}
+
+	type outcome struct {
+		r   Result
+		err error
+	}
+	startedAt := time.Now()
+	wctx, cancel := context.WithTimeout(ctx, wd.MaxProbeDuration)
+	defer cancel()
+	done := make(chan outcome, 1)
+	// Unlike probeContext, the goroutine runs for as long as the probe
+	// does, so hung probes can be told from cancelled ones.
+	go func() {
+		var o outcome
+		defer func() { done <- o }()
+		defer recoverProbe(&o.err)
+		if cp, ok := job.Prober.(ContextProber); ok {
+			o.r, o.err = cp.ProbeContext(wctx, target)
+		} else {
+			o.r, o.err = job.Prober.Probe(target)
+		}
+	}()
+	select {
+	case o := <-done:
+		if o.err == nil || ctx.Err() != nil || wctx.Err() == nil {
+			e.accountResources(stats, before)
+			return o.r, o.err
+		}
+	case <-wctx.Done():
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		e.statsMu.Lock()
+		e.hung++
+		e.statsMu.Unlock()
+		go func() {
+			<-done
+			e.statsMu.Lock()
+			e.hung--
+			e.statsMu.Unlock()
+		}()
+	}
+	e.statsMu.Lock()
+	stats.Killed++
+	e.statsMu.Unlock()
+	return &WatchdogResult{
+		Target:   target,
+		Kind:     job.Prober.Kind(),
+		Error:    fmt.Errorf("%w after %v", ErrProbeHung, wd.MaxProbeDuration),
+		Duration: time.Since(startedAt),
+	}, nil
+}
+
+// accountResources accounts the change of resources since before to the job
+// when TrackResources is set. Decreases are accounted too, so that
+// resources released by a probe other than the one acquiring them cancel
+// out rather than add up.
+func (e *Engine) accountResources(stats *JobStats, before resourceUsage) {
+	if !e.opts.Watchdog.TrackResources {
+		return
+	}
+	after := sampleResources()
+	e.statsMu.Lock()
+	defer e.statsMu.Unlock()
+	stats.LeakedGoroutines += int64(after.Goroutines - before.Goroutines)
+	if before.FDs >= 0 && after.FDs >= 0 {
+		stats.LeakedFDs += int64(after.FDs - before.FDs)
+	}
+}
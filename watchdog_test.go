@@ -0,0 +1,115 @@
+package libprobe_test
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchdogKillsHungProbes(t *testing.T) {
+	release := make(chan struct{})
+	prober := funcProber{kind: "STUCK", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		<-release
+		return &libprobe.TCPResult{Target: target}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 10)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{
+		Sinks:    []libprobe.Sink{sink},
+		Watchdog: libprobe.WatchdogOptions{MaxProbeDuration: 20 * time.Millisecond},
+	})
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "a:1"}, Interval: time.Hour}))
+	engine.Start()
+	defer engine.Stop()
+
+	res := (<-sink.results).(*libprobe.WatchdogResult)
+	require.Equal(t, "STUCK", res.Kind)
+	require.True(t, errors.Is(res.Error, libprobe.ErrProbeHung))
+	require.True(t, res.Duration >= 20*time.Millisecond)
+	stats, _ := engine.JobStats("STUCK/a:1")
+	require.Equal(t, int64(1), stats.Killed)
+	require.Equal(t, int64(1), stats.Failures)
+	require.Equal(t, 1, engine.Stats().HungProbes)
+	require.Zero(t, engine.Stats().InFlight)
+
+	close(release)
+	require.Eventually(t, func() bool { return engine.Stats().HungProbes == 0 }, time.Second, time.Millisecond)
+}
+
+func TestWatchdogTracksResources(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var leaked []*os.File
+	defer func() {
+		for _, f := range leaked {
+			f.Close()
+		}
+	}()
+	prober := funcProber{kind: "LEAKY", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		go func() { <-release }()
+		f, err := os.Open(os.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		leaked = append(leaked, f)
+		return &libprobe.TCPResult{Target: target}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 10)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{
+		Sinks:       []libprobe.Sink{sink},
+		Concurrency: 1,
+		Watchdog:    libprobe.WatchdogOptions{MaxProbeDuration: time.Second, TrackResources: true},
+	})
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "a:1"}, Interval: time.Hour}))
+	engine.Start()
+	defer engine.Stop()
+
+	<-sink.results
+	stats, _ := engine.JobStats("LEAKY/a:1")
+	require.True(t, stats.LeakedGoroutines >= 1)
+	if runtime.GOOS == "linux" {
+		require.True(t, stats.LeakedFDs >= 1)
+	}
+	require.Zero(t, stats.Killed)
+}
+
+func TestWatchdogResourcesChurn(t *testing.T) {
+	// Every other probe starts a goroutine the next probe stops, as a pool
+	// of connections would, which doesn't leak.
+	var stop chan struct{}
+	prober := funcProber{kind: "CHURN", probe: func(target libprobe.Target) (libprobe.Result, error) {
+		if stop == nil {
+			stop = make(chan struct{})
+			done := stop
+			go func() { <-done }()
+		} else {
+			close(stop)
+			stop = nil
+			time.Sleep(5 * time.Millisecond)
+		}
+		return &libprobe.TCPResult{Target: target}, nil
+	}}
+	sink := &memorySink{results: make(chan libprobe.Result, 100)}
+	engine := libprobe.NewEngine(libprobe.EngineOptions{
+		Sinks:       []libprobe.Sink{sink},
+		Concurrency: 1,
+		Watchdog:    libprobe.WatchdogOptions{TrackResources: true},
+	})
+	require.NoError(t, engine.Add(libprobe.Job{Prober: prober, Target: libprobe.Target{Address: "a:1"}, Interval: time.Millisecond, Overlap: libprobe.OverlapQueue}))
+	engine.Start()
+	for i := 0; i < 10; i++ {
+		<-sink.results
+	}
+	engine.Stop()
+	if stop != nil {
+		close(stop)
+	}
+
+	stats, _ := engine.JobStats("CHURN/a:1")
+	require.True(t, stats.LeakedGoroutines <= 2, stats.LeakedGoroutines)
+}
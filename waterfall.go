@@ -0,0 +1,307 @@
+package libprobe
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const KindWaterfall = "WATERFALL"
+
+// WaterfallProberOptions configures a WaterfallProber.
+type WaterfallProberOptions struct {
+	// HTTP configures the requests. KeepBody and ReuseConnections are
+	// always set.
+	HTTP HTTPProberOptions
+	// Resources are the URLs of the sub-resources fetched, relative to the
+	// page. Default: the scripts, style sheets, images, frames and media
+	// referenced by the page, in document order.
+	Resources []string
+	// MaxResources bounds the sub-resources fetched. Default: 100.
+	MaxResources int
+	// Parallelism is the number of sub-resources fetched at the same time,
+	// and MaxPerHost the number fetched from a single host, as browsers
+	// limit their connections per host. Default: 6 and 6.
+	Parallelism int
+	MaxPerHost  int
+}
+
+// WaterfallEntry is the fetch of one object of a page.
+type WaterfallEntry struct {
+	URL        string
+	Error      error
+	StatusCode int
+	Size       int
+	// Start is the time from the start of the probe to the request, and
+	// Duration the time until its last byte. The phases of the request
+	// are those of HTTPResult.
+	Start            time.Duration
+	Duration         time.Duration
+	DNSResolveTime   time.Duration
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	TTFB             time.Duration
+	TransferTime     time.Duration
+	ConnectionReused bool
+}
+
+// WaterfallResult is the waterfall of a page load, primary URL first.
+type WaterfallResult struct {
+	Target
+	// Error is set when the page itself failed. Failed sub-resources are
+	// counted in Failed instead.
+	Error   error
+	Entries []WaterfallEntry
+	Failed  int
+	// Size is the total size of the objects.
+	Size int
+	// PageComplete is the time until the last byte of the last object.
+	PageComplete time.Duration
+}
+
+func (r WaterfallResult) RTT() time.Duration {
+	return r.PageComplete
+}
+
+func (r WaterfallResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "-> %s: %d objects, %d bytes, %d failed, complete in %v", r.Target.Address, len(r.Entries), r.Size, r.Failed, r.PageComplete)
+	if r.Error != nil {
+		fmt.Fprintf(&b, ": %v", r.Error)
+	}
+	for _, e := range r.Entries {
+		status := fmt.Sprint(e.StatusCode)
+		if e.Error != nil {
+			status = "ERR"
+		}
+		fmt.Fprintf(&b, "\n%10v %10v %3s %s", e.Start.Round(time.Microsecond), e.Duration.Round(time.Microsecond), status, e.URL)
+	}
+	return b.String()
+}
+
+// WaterfallProber approximates a page load without a browser: it fetches
+// the page at Target.Address, then its sub-resources in parallel, and
+// reports when each object was requested and received. Connections are
+// reused across the objects of a probe, as browsers do, but every probe
+// starts with cold connections. Sub-resources referenced by style sheets or
+// scripts are not discovered.
+type WaterfallProber struct {
+	opts WaterfallProberOptions
+}
+
+func NewWaterfallProber(opts WaterfallProberOptions) *WaterfallProber {
+	opts.HTTP.KeepBody = true
+	opts.HTTP.ReuseConnections = true
+	if opts.MaxResources <= 0 {
+		opts.MaxResources = 100
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = 6
+	}
+	if opts.MaxPerHost <= 0 {
+		opts.MaxPerHost = 6
+	}
+	return &WaterfallProber{opts: opts}
+}
+
+func (p *WaterfallProber) Kind() string {
+	return KindWaterfall
+}
+
+func (p *WaterfallProber) Probe(target Target) (Result, error) {
+	r := &WaterfallResult{Target: target}
+	page, err := url.Parse(target.Address)
+	if err != nil {
+		return nil, err
+	}
+	prober := NewHTTPProberWithOptions(p.opts.HTTP)
+	defer prober.closeIdleConnections()
+	startAt := time.Now()
+	fetch := func(u string) (WaterfallEntry, []byte, error) {
+		t := target
+		t.Address = u
+		t.Body = nil
+		t.RequestMethod = ""
+		requestAt := time.Now()
+		res, err := prober.Probe(t)
+		if err != nil {
+			return WaterfallEntry{}, nil, err
+		}
+		h := res.(*HTTPResult)
+		e := WaterfallEntry{
+			URL:              u,
+			Error:            h.Error,
+			StatusCode:       h.ResponseStatusCode,
+			Size:             h.ResponseSize,
+			Start:            requestAt.Sub(startAt),
+			Duration:         time.Since(requestAt),
+			DNSResolveTime:   h.DNSResolveTime,
+			ConnectTime:      h.ConnectTime,
+			TLSHandshakeTime: h.TLSHandshakeTime,
+			TTFB:             h.TTFB,
+			TransferTime:     h.TransferTime,
+			ConnectionReused: h.ConnectionReused,
+		}
+		if e.Error == nil && e.StatusCode >= 400 {
+			e.Error = fmt.Errorf("HTTP status %d", e.StatusCode)
+		}
+		return e, h.ResponseBody, nil
+	}
+
+	primary, body, err := fetch(target.Address)
+	if err != nil {
+		return r, err
+	}
+	r.Entries = append(r.Entries, primary)
+	if primary.Error != nil {
+		r.Error = primary.Error
+		r.finish()
+		return r, nil
+	}
+
+	var resources []*url.URL
+	if p.opts.Resources != nil {
+		for _, ref := range p.opts.Resources {
+			u, err := page.Parse(ref)
+			if err != nil {
+				return nil, err
+			}
+			resources = append(resources, u)
+		}
+	} else {
+		resources = htmlResources(page, body)
+	}
+	if len(resources) > p.opts.MaxResources {
+		resources = resources[:p.opts.MaxResources]
+	}
+
+	entries := make([]WaterfallEntry, len(resources))
+	errs := make([]error, len(resources))
+	slots := make(chan struct{}, p.opts.Parallelism)
+	var (
+		mu    sync.Mutex
+		hosts = make(map[string]chan struct{})
+		wg    sync.WaitGroup
+	)
+	for i, u := range resources {
+		mu.Lock()
+		host, ok := hosts[u.Host]
+		if !ok {
+			host = make(chan struct{}, p.opts.MaxPerHost)
+			hosts[u.Host] = host
+		}
+		mu.Unlock()
+		// Objects are requested in document order as slots free up.
+		host <- struct{}{}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, u *url.URL) {
+			defer func() {
+				<-slots
+				<-host
+				wg.Done()
+			}()
+			entries[i], _, errs[i] = fetch(u.String())
+		}(i, u)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			entries[i] = WaterfallEntry{URL: resources[i].String(), Error: err}
+		}
+	}
+	r.Entries = append(r.Entries, entries...)
+	r.finish()
+	return r, nil
+}
+
+// finish sums up the entries.
+func (r *WaterfallResult) finish() {
+	for _, e := range r.Entries {
+		if e.Error != nil {
+			r.Failed++
+		}
+		r.Size += e.Size
+		if end := e.Start + e.Duration; end > r.PageComplete {
+			r.PageComplete = end
+		}
+	}
+}
+
+// htmlResourceAttrs are the attributes of elements referencing the
+// sub-resources of a page.
+var htmlResourceAttrs = map[string][]string{
+	"script": {"src"},
+	"img":    {"src"},
+	"iframe": {"src"},
+	"embed":  {"src"},
+	"source": {"src"},
+	"video":  {"src", "poster"},
+	"audio":  {"src"},
+	"link":   {"href"},
+}
+
+// htmlLinkRels are the relations of link elements to load.
+var htmlLinkRels = map[string]bool{
+	"stylesheet":    true,
+	"icon":          true,
+	"preload":       true,
+	"modulepreload": true,
+}
+
+// htmlResources returns the distinct HTTP(S) sub-resources referenced by
+// the page at base, in document order.
+func htmlResources(base *url.URL, body []byte) []*url.URL {
+	var resources []*url.URL
+	seen := map[string]bool{base.String(): true}
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return resources
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		tag := z.Token()
+		attrs := make(map[string]string, len(tag.Attr))
+		for _, a := range tag.Attr {
+			attrs[a.Key] = a.Val
+		}
+		if tag.Data == "base" {
+			if u, err := base.Parse(attrs["href"]); err == nil && attrs["href"] != "" {
+				base = u
+			}
+			continue
+		}
+		if tag.Data == "link" {
+			load := false
+			for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+				load = load || htmlLinkRels[rel]
+			}
+			if !load {
+				continue
+			}
+		}
+		for _, key := range htmlResourceAttrs[tag.Data] {
+			ref := strings.TrimSpace(attrs[key])
+			if ref == "" {
+				continue
+			}
+			u, err := base.Parse(ref)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				continue
+			}
+			u.Fragment = ""
+			if !seen[u.String()] {
+				seen[u.String()] = true
+				resources = append(resources, u)
+			}
+		}
+	}
+}
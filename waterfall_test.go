@@ -0,0 +1,81 @@
+package libprobe_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaterfallProber(t *testing.T) {
+	var inFlight, maxInFlight int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><head>
+<link rel="stylesheet" href="/style.css">
+<link rel="canonical" href="/elsewhere">
+<script src="app.js"></script>
+</head><body>
+<img src="/a.png"><img src="/b.png"><img src="/a.png#again">
+<img src="data:image/png;base64,AAAA">
+<img src="/missing.png">
+</body></html>`)
+		case "/missing.png":
+			http.NotFound(w, r)
+		default:
+			n := atomic.AddInt64(&inFlight, 1)
+			defer atomic.AddInt64(&inFlight, -1)
+			for {
+				max := atomic.LoadInt64(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			fmt.Fprint(w, "0123456789")
+		}
+	}))
+	defer srv.Close()
+
+	r, err := libprobe.NewWaterfallProber(libprobe.WaterfallProberOptions{MaxPerHost: 2}).Probe(libprobe.Target{Address: srv.URL + "/", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.WaterfallResult)
+	require.NoError(t, res.Error)
+	var urls []string
+	for _, e := range res.Entries {
+		urls = append(urls, e.URL)
+	}
+	require.Equal(t, []string{
+		srv.URL + "/",
+		srv.URL + "/style.css",
+		srv.URL + "/app.js",
+		srv.URL + "/a.png",
+		srv.URL + "/b.png",
+		srv.URL + "/missing.png",
+	}, urls)
+	require.Equal(t, 1, res.Failed)
+	require.Equal(t, http.StatusNotFound, res.Entries[5].StatusCode)
+	require.LessOrEqual(t, atomic.LoadInt64(&maxInFlight), int64(2))
+	last := res.Entries[len(res.Entries)-1]
+	require.GreaterOrEqual(t, res.PageComplete, last.Start+last.Duration)
+	for _, e := range res.Entries[1:] {
+		require.GreaterOrEqual(t, e.Start, res.Entries[0].Duration)
+	}
+	require.Equal(t, res.PageComplete, res.RTT())
+
+	// An explicit list replaces the resources of the page.
+	r, err = libprobe.NewWaterfallProber(libprobe.WaterfallProberOptions{Resources: []string{"/b.png"}}).Probe(libprobe.Target{Address: srv.URL + "/", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.WaterfallResult)
+	require.Len(t, res.Entries, 2)
+	require.Equal(t, srv.URL+"/b.png", res.Entries[1].URL)
+	require.Equal(t, 10, res.Entries[1].Size)
+	require.True(t, res.Entries[1].ConnectionReused)
+}
@@ -0,0 +1,278 @@
+package libprobe
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WebSocket opcodes, RFC 6455 section 5.2.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errWebSocketClosed = errors.New("websocket: connection closed by peer")
+
+// wsConn is a minimal client side WebSocket connection.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// writeTimeout, when set, bounds the write of every frame.
+	writeTimeout time.Duration
+}
+
+// wsDialTrace records the timings of the opening handshake.
+type wsDialTrace struct {
+	// meter counts the traffic of the connection, if not nil.
+	meter       *trafficMeter
+	connectTime time.Duration
+	tlsTime     time.Duration
+	upgradeTime time.Duration
+}
+
+// dialWebSocket connects to a ws:// or wss:// URL and performs the opening
+// handshake, recording its timings in trace unless it's nil. The handshake
+// response is returned even if the upgrade was refused, so callers can
+// report the status code.
+func dialWebSocket(rawURL string, header http.Header, tlsConfig *tls.Config, timeout time.Duration, trace *wsDialTrace) (*wsConn, *http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	var secure bool
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		secure = true
+	default:
+		return nil, nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if secure {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	if trace == nil {
+		trace = &wsDialTrace{}
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(trace.meter, "tcp", host, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	connectedAt := time.Now()
+	trace.connectTime = connectedAt.Sub(startAt)
+	if timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(timeout))
+	}
+	if secure {
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+		trace.tlsTime = time.Since(connectedAt)
+	}
+	upgradeAt := time.Now()
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	u.Scheme = "http"
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	setDefaultUserAgent(req.Header)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	trace.upgradeTime = time.Since(upgradeAt)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, resp, fmt.Errorf("websocket: bad handshake status %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		conn.Close()
+		return nil, resp, errors.New("websocket: mismatched Sec-WebSocket-Accept")
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, br: br}, resp, nil
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// WriteMessage sends a single, masked, unfragmented frame.
+func (c *wsConn) WriteMessage(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = 0x80 | byte(n)
+	case n <= 0xffff:
+		header[1] = 0x80 | 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 0x80 | 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, mask); err != nil {
+		return err
+	}
+	header = append(header, mask...)
+	frame := make([]byte, len(header)+len(payload))
+	copy(frame, header)
+	for i, b := range payload {
+		frame[len(header)+i] = b ^ mask[i%4]
+	}
+	if c.writeTimeout > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// ReadMessage returns the next data message, reassembling fragments and
+// answering pings on the way. A close frame yields errWebSocketClosed.
+func (c *wsConn) ReadMessage() (byte, []byte, error) {
+	var (
+		opcode  byte
+		message []byte
+	)
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.WriteMessage(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			_ = c.WriteMessage(wsOpClose, payload)
+			return 0, nil, errWebSocketClosed
+		case wsOpContinuation:
+		default:
+			opcode = op
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	if length > 1<<26 {
+		return false, 0, nil, fmt.Errorf("websocket: frame too large (%d bytes)", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// Close sends a normal closure frame and closes the underlying connection.
+func (c *wsConn) Close() error {
+	_ = c.WriteMessage(wsOpClose, []byte{0x03, 0xe8})
+	return c.conn.Close()
+}
@@ -0,0 +1,161 @@
+package libprobe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const KindWS = "WS"
+
+// WSProberOptions configures a WSProber.
+type WSProberOptions struct {
+	// TLSConfig configures the handshake with wss:// targets.
+	TLSConfig *tls.Config
+	// Header is sent with the upgrade request, e.g. Origin or
+	// Sec-WebSocket-Protocol.
+	Header http.Header
+	// Ping sends a ping once connected and waits for its pong.
+	Ping bool
+	// Message, when set, is sent as a text message once connected, and
+	// the next message received must echo it.
+	Message string
+}
+
+// WSResult describes the opening handshake with a WebSocket server, and the
+// round trip of the ping or message sent.
+type WSResult struct {
+	Target
+	Error error
+
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	// HandshakeTime is the time from sending the upgrade request to its
+	// response, StatusCode the status of the response, 101 when the server
+	// switched protocols.
+	HandshakeTime time.Duration
+	StatusCode    int
+	// Subprotocol is the subprotocol selected by the server.
+	Subprotocol string
+	// PingRTT is the round trip of the ping, MessageRTT that of the
+	// message and its echo.
+	PingRTT    time.Duration
+	MessageRTT time.Duration
+}
+
+func (r WSResult) RTT() time.Duration {
+	if r.MessageRTT > 0 {
+		return r.MessageRTT
+	}
+	if r.PingRTT > 0 {
+		return r.PingRTT
+	}
+	return r.HandshakeTime
+}
+
+func (r WSResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	return fmt.Sprintf("-> %s %d handshake=%v ping=%v message=%v", r.Target.Address, r.StatusCode, r.HandshakeTime, r.PingRTT, r.MessageRTT)
+}
+
+// WSProber opens a WebSocket connection to Target.Address, a ws:// or
+// wss:// URL, and optionally measures the round trip of a ping or of a
+// message echoed by the server.
+type WSProber struct {
+	opts WSProberOptions
+}
+
+func NewWSProber(opts WSProberOptions) *WSProber {
+	return &WSProber{opts: opts}
+}
+
+func (p *WSProber) Kind() string {
+	return KindWS
+}
+
+func (p *WSProber) Probe(target Target) (Result, error) {
+	r := &WSResult{Target: target}
+	header := p.opts.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	setCorrelationHeaders(header, target)
+	trace := &wsDialTrace{meter: target.meter}
+	conn, resp, err := dialWebSocket(target.Address, header, p.opts.TLSConfig, target.Timeout, trace)
+	r.ConnectTime, r.TLSHandshakeTime, r.HandshakeTime = trace.connectTime, trace.tlsTime, trace.upgradeTime
+	if resp != nil {
+		r.StatusCode = resp.StatusCode
+		r.Subprotocol = resp.Header.Get("Sec-WebSocket-Protocol")
+	}
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(target.Timeout))
+	}
+
+	if p.opts.Ping {
+		if r.PingRTT, err = conn.ping(); err != nil {
+			r.Error = err
+			return r, nil
+		}
+	}
+	if p.opts.Message != "" {
+		startAt := time.Now()
+		if err := conn.WriteMessage(wsOpText, []byte(p.opts.Message)); err != nil {
+			r.Error = err
+			return r, nil
+		}
+		_, echo, err := conn.ReadMessage()
+		if err != nil {
+			r.Error = err
+			return r, nil
+		}
+		r.MessageRTT = time.Since(startAt)
+		if string(echo) != p.opts.Message {
+			r.Error = errors.New("websocket: the reply doesn't echo the message")
+		}
+	}
+	return r, nil
+}
+
+// ping sends a ping with a random payload and waits for its pong, ignoring
+// the data messages received meanwhile.
+func (c *wsConn) ping() (time.Duration, error) {
+	payload := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, payload); err != nil {
+		return 0, err
+	}
+	startAt := time.Now()
+	if err := c.WriteMessage(wsOpPing, payload); err != nil {
+		return 0, err
+	}
+	for {
+		_, op, b, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case wsOpPong:
+			if bytes.Equal(b, payload) {
+				return time.Since(startAt), nil
+			}
+		case wsOpPing:
+			if err := c.WriteMessage(wsOpPong, b); err != nil {
+				return 0, err
+			}
+		case wsOpClose:
+			_ = c.WriteMessage(wsOpClose, b)
+			return 0, errWebSocketClosed
+		}
+	}
+}
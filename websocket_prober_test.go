@@ -0,0 +1,49 @@
+package libprobe_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWSProber(t *testing.T) {
+	srv := newWebSocketServer(t, func(msg []byte) []byte {
+		if string(msg) == "garble" {
+			return []byte("garbled")
+		}
+		return msg
+	})
+	defer srv.Close()
+	address := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	prober := libprobe.NewWSProber(libprobe.WSProberOptions{Ping: true, Message: "hello"})
+	r, err := prober.Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.WSResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	require.True(t, res.ConnectTime > 0 && res.HandshakeTime > 0)
+	require.Zero(t, res.TLSHandshakeTime)
+	require.True(t, res.PingRTT > 0)
+	require.True(t, res.MessageRTT > 0)
+	require.Equal(t, res.MessageRTT, res.RTT())
+
+	r, err = libprobe.NewWSProber(libprobe.WSProberOptions{Message: "garble"}).Probe(libprobe.Target{Address: address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.EqualError(t, r.(*libprobe.WSResult).Error, "websocket: the reply doesn't echo the message")
+
+	// A plain HTTP server refuses the upgrade.
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	r, err = prober.Probe(libprobe.Target{Address: "ws" + strings.TrimPrefix(plain.URL, "http"), Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res = r.(*libprobe.WSResult)
+	require.Error(t, res.Error)
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
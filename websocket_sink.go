@@ -0,0 +1,340 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocketSinkOptions configures a WebSocketSink.
+type WebSocketSinkOptions struct {
+	// URL is the ws:// or wss:// endpoint, e.g. the Grafana Live push
+	// endpoint "ws://grafana:3000/api/live/push/probes".
+	URL string
+	// Header is sent with the opening handshake, e.g. an Authorization header.
+	Header    http.Header
+	TLSConfig *tls.Config
+	// Encode serializes a result into a text frame:
+	// MarshalResultLineProtocol, the default, MarshalDataFrame or a custom
+	// encoder.
+	Encode func(Result) ([]byte, error)
+	// DialTimeout bounds the handshake and the write of every frame. A
+	// frame timing out drops the connection, it's re-established by the
+	// next Write with the frame still in the backlog. Default: 5s.
+	DialTimeout time.Duration
+	// Backlog is the number of frames kept while disconnected, the oldest
+	// frames are dropped first. Default: 1024.
+	Backlog int
+	// ReconnectBackoff is the minimum delay between reconnect attempts,
+	// doubled on every failure up to one minute. Default: 1s.
+	ReconnectBackoff time.Duration
+}
+
+// WebSocketSink streams results over a WebSocket, by default as InfluxDB
+// line protocol, which Grafana Live's push endpoint takes. MarshalDataFrame
+// encodes Grafana data frames instead, for consumers of that format such as
+// a streaming data source plugin. Frames written while the connection is
+// down are kept in a bounded backlog and sent, oldest first, once it has
+// been re-established. Messages from the server are discarded; pings are
+// answered and a close frame drops the connection.
+type WebSocketSink struct {
+	opts WebSocketSinkOptions
+
+	mu        sync.Mutex
+	conn      *wsConn
+	backlog   [][]byte
+	dropped   int
+	backoff   time.Duration
+	nextDial  time.Time
+	closed    bool
+	lastError error
+	// flushing is set while a goroutine dials or writes, without holding
+	// mu; flushed is signalled when it's done.
+	flushing bool
+	flushed  *sync.Cond
+}
+
+var errSinkClosed = errors.New("sink closed")
+
+func NewWebSocketSink(opts WebSocketSinkOptions) *WebSocketSink {
+	if opts.Encode == nil {
+		opts.Encode = MarshalResultLineProtocol
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.Backlog <= 0 {
+		opts.Backlog = 1024
+	}
+	if opts.ReconnectBackoff <= 0 {
+		opts.ReconnectBackoff = time.Second
+	}
+	s := &WebSocketSink{
+		opts:    opts,
+		backoff: opts.ReconnectBackoff,
+	}
+	s.flushed = sync.NewCond(&s.mu)
+	return s
+}
+
+// Write queues the result and flushes the backlog. A non-nil error means the
+// frame is retained for a later attempt, not that it was lost. While another
+// Write is flushing, the frame is left for it to send and Write returns the
+// last error without waiting.
+func (s *WebSocketSink) Write(r Result) error {
+	frame, err := s.opts.Encode(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errSinkClosed
+	}
+	s.queue(frame)
+	if s.flushing {
+		err := s.lastError
+		s.mu.Unlock()
+		return err
+	}
+	s.flushing = true
+	s.mu.Unlock()
+	return s.flush()
+}
+
+// queue appends frames to the backlog, dropping the oldest frames beyond
+// its size.
+func (s *WebSocketSink) queue(frames ...[]byte) {
+	s.backlog = append(s.backlog, frames...)
+	if over := len(s.backlog) - s.opts.Backlog; over > 0 {
+		s.backlog = s.backlog[over:]
+		s.dropped += over
+	}
+}
+
+// flush sends the backlog until it's empty, dialing first if needed. The
+// caller sets flushing; mu is released while dialing and writing, so frames
+// queued in the meantime are sent by the same flush.
+func (s *WebSocketSink) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.flushed.Broadcast()
+	defer func() { s.flushing = false }()
+	for len(s.backlog) > 0 {
+		conn := s.conn
+		if conn == nil {
+			if time.Now().Before(s.nextDial) {
+				return s.lastError
+			}
+			s.mu.Unlock()
+			c, _, err := dialWebSocket(s.opts.URL, s.opts.Header, s.opts.TLSConfig, s.opts.DialTimeout, nil)
+			s.mu.Lock()
+			if err != nil {
+				s.nextDial = time.Now().Add(s.backoff)
+				if s.backoff *= 2; s.backoff > time.Minute {
+					s.backoff = time.Minute
+				}
+				s.lastError = err
+				return err
+			}
+			c.writeTimeout = s.opts.DialTimeout
+			conn = c
+			s.conn = conn
+			s.backoff = s.opts.ReconnectBackoff
+			s.lastError = nil
+			go s.drain(conn)
+		}
+		batch := s.backlog
+		s.backlog = nil
+		s.mu.Unlock()
+		sent := 0
+		var err error
+		for ; sent < len(batch); sent++ {
+			if err = conn.WriteMessage(wsOpText, batch[sent]); err != nil {
+				break
+			}
+		}
+		s.mu.Lock()
+		if err != nil {
+			conn.conn.Close()
+			if s.conn == conn {
+				s.conn = nil
+			}
+			s.lastError = err
+			// The unsent frames go back in front of those queued since.
+			queued := s.backlog
+			s.backlog = batch[sent:]
+			s.queue(queued...)
+			return err
+		}
+	}
+	return nil
+}
+
+// drain reads from conn until it fails, answering pings, and then drops conn
+// unless it was replaced or closed in the meantime.
+func (s *WebSocketSink) drain(conn *wsConn) {
+	var err error
+	for err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == conn {
+		conn.conn.Close()
+		s.conn = nil
+		s.lastError = err
+	}
+}
+
+// Pending returns the number of frames waiting to be sent and the number of
+// frames dropped because the backlog overflowed.
+func (s *WebSocketSink) Pending() (pending int, dropped int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.backlog), s.dropped
+}
+
+// Close waits for a running flush, tries to send the remaining backlog and
+// closes the connection.
+func (s *WebSocketSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for s.flushing {
+		s.flushed.Wait()
+	}
+	var err error
+	if len(s.backlog) > 0 {
+		s.nextDial = time.Time{}
+		s.flushing = true
+		s.mu.Unlock()
+		err = s.flush()
+		s.mu.Lock()
+	}
+	conn := s.conn
+	s.conn = nil
+	s.mu.Unlock()
+	if conn != nil {
+		if cerr := conn.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// DataFrame is the JSON representation of a Grafana data frame holding a
+// single flattened result.
+type DataFrame struct {
+	Schema DataFrameSchema `json:"schema"`
+	Data   DataFrameData   `json:"data"`
+}
+
+type DataFrameSchema struct {
+	Name   string           `json:"name"`
+	Fields []DataFrameField `json:"fields"`
+}
+
+type DataFrameField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type DataFrameData struct {
+	Values [][]interface{} `json:"values"`
+}
+
+// MarshalDataFrame encodes a result as the JSON of the data frame
+// NewDataFrame builds, at the current time.
+func MarshalDataFrame(r Result) ([]byte, error) {
+	return json.Marshal(NewDataFrame(time.Now(), r))
+}
+
+// NewDataFrame builds a single row data frame from the summary row of r, with
+// a leading "time" field in milliseconds since epoch.
+func NewDataFrame(at time.Time, r Result) DataFrame {
+	row := Flatten(r)[0]
+	frame := DataFrame{
+		Schema: DataFrameSchema{
+			Name:   resultKind(r),
+			Fields: []DataFrameField{{Name: "time", Type: "time"}},
+		},
+		Data: DataFrameData{
+			Values: [][]interface{}{{at.UnixNano() / int64(time.Millisecond)}},
+		},
+	}
+	for _, name := range Columns(row) {
+		v, ok := row[name]
+		if !ok {
+			continue
+		}
+		fieldType := "string"
+		switch v.(type) {
+		case bool:
+			fieldType = "boolean"
+		case int64, uint64, float64:
+			fieldType = "number"
+		}
+		frame.Schema.Fields = append(frame.Schema.Fields, DataFrameField{Name: name, Type: fieldType})
+		frame.Data.Values = append(frame.Data.Values, []interface{}{v})
+	}
+	return frame
+}
+
+// lineProtocolKey escapes measurements, tag keys and values and field keys
+// of the line protocol; lineProtocolString escapes string field values.
+var (
+	lineProtocolKey    = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	lineProtocolString = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// MarshalResultLineProtocol encodes the summary row of a result as a line of
+// the InfluxDB line protocol, as taken by Grafana Live's push endpoint: the
+// kind is the measurement, the address a tag, the other columns are fields
+// and the timestamp is the current time in nanoseconds.
+func MarshalResultLineProtocol(r Result) ([]byte, error) {
+	row := Flatten(r)[0]
+	kind, _ := row[ColumnKind].(string)
+	b := []byte(lineProtocolKey.Replace(kind))
+	if address, _ := row[ColumnAddress].(string); address != "" {
+		b = append(b, ",address="...)
+		b = append(b, lineProtocolKey.Replace(address)...)
+	}
+	sep := byte(' ')
+	for _, name := range Columns(row) {
+		switch name {
+		case ColumnKind, ColumnRow, ColumnIndex, ColumnAddress:
+			continue
+		}
+		var value string
+		switch v := row[name].(type) {
+		case string:
+			value = `"` + lineProtocolString.Replace(v) + `"`
+		case int64:
+			value = strconv.FormatInt(v, 10) + "i"
+		case uint64:
+			value = strconv.FormatUint(v, 10) + "u"
+		case float64:
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		case bool:
+			value = strconv.FormatBool(v)
+		default:
+			continue
+		}
+		b = append(b, sep)
+		b = append(b, lineProtocolKey.Replace(name)...)
+		b = append(b, '=')
+		b = append(b, value...)
+		sep = ','
+	}
+	b = append(b, ' ')
+	return strconv.AppendInt(b, time.Now().UnixNano(), 10), nil
+}
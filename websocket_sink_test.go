@@ -0,0 +1,304 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newWebSocketServer starts a server accepting WebSocket upgrades, answering
+// pings and calling handle for every text or binary message, writing back
+// whatever it returns.
+func newWebSocketServer(t *testing.T, handle func(msg []byte) []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := sha1.New()
+		h.Write([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h.Sum(nil)) + "\r\n\r\n")
+		_ = rw.Flush()
+		for {
+			op, msg, err := readTestFrame(rw.Reader)
+			if err != nil || op == 0x8 {
+				return
+			}
+			if op == 0x9 {
+				_, _ = conn.Write(append([]byte{0x8a, byte(len(msg))}, msg...))
+				continue
+			}
+			if reply := handle(msg); reply != nil {
+				frame := []byte{0x80 | op, byte(len(reply))}
+				_, _ = conn.Write(append(frame, reply...))
+			}
+		}
+	}))
+}
+
+func readTestFrame(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return head[0] & 0x0f, payload, nil
+}
+
+func TestWebSocketSink(t *testing.T) {
+	frames := make(chan []byte, 10)
+	server := newWebSocketServer(t, func(msg []byte) []byte {
+		frames <- msg
+		return nil
+	})
+	defer server.Close()
+
+	sink := libprobe.NewWebSocketSink(libprobe.WebSocketSinkOptions{
+		URL:    "ws" + strings.TrimPrefix(server.URL, "http") + "/probes",
+		Encode: libprobe.MarshalDataFrame,
+	})
+	require.NoError(t, sink.Write(&libprobe.TCPResult{
+		Target:      libprobe.Target{Address: "1.1.1.1:80"},
+		ConnectTime: time.Millisecond,
+	}))
+	select {
+	case msg := <-frames:
+		var frame libprobe.DataFrame
+		require.NoError(t, json.Unmarshal(msg, &frame))
+		require.Equal(t, "TCP", frame.Schema.Name)
+		require.Equal(t, "time", frame.Schema.Fields[0].Name)
+		require.Equal(t, len(frame.Schema.Fields), len(frame.Data.Values))
+	case <-time.After(3 * time.Second):
+		t.Fatal("no frame received")
+	}
+	require.NoError(t, sink.Close())
+}
+
+func TestWebSocketSinkLineProtocol(t *testing.T) {
+	frames := make(chan []byte, 10)
+	server := newWebSocketServer(t, func(msg []byte) []byte {
+		frames <- msg
+		return nil
+	})
+	defer server.Close()
+
+	// Line protocol is the default encoding.
+	sink := libprobe.NewWebSocketSink(libprobe.WebSocketSinkOptions{
+		URL: "ws" + strings.TrimPrefix(server.URL, "http") + "/api/live/push/probes",
+	})
+	require.NoError(t, sink.Write(&libprobe.TCPResult{
+		Target:      libprobe.Target{Address: "1.1.1.1:80", Metadata: map[string]string{"site": "a b"}},
+		ConnectTime: time.Millisecond,
+		Error:       errors.New(`say "no"`),
+	}))
+	select {
+	case msg := <-frames:
+		line := string(msg)
+		require.True(t, strings.HasPrefix(line, "TCP,address=1.1.1.1:80 rtt_ns=1000000i,error=\"say \\\"no\\\"\","), line)
+		require.Contains(t, line, ",connect_time_ns=1000000i,")
+		require.Contains(t, line, `,metadata_site="a b",`)
+		require.NotContains(t, line, "kind=")
+		require.Regexp(t, ` \d+$`, line)
+	case <-time.After(3 * time.Second):
+		t.Fatal("no frame received")
+	}
+	require.NoError(t, sink.Close())
+}
+
+func TestWebSocketSinkBacklog(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	sink := libprobe.NewWebSocketSink(libprobe.WebSocketSinkOptions{
+		URL:              "ws://" + addr,
+		Backlog:          2,
+		ReconnectBackoff: time.Hour,
+	})
+	for i := 0; i < 3; i++ {
+		require.Error(t, sink.Write(&libprobe.TCPResult{}))
+	}
+	pending, dropped := sink.Pending()
+	require.Equal(t, 2, pending)
+	require.Equal(t, 1, dropped)
+}
+
+func TestWebSocketSinkSlowDial(t *testing.T) {
+	// The listener accepts connections but never answers the handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	sink := libprobe.NewWebSocketSink(libprobe.WebSocketSinkOptions{
+		URL:         "ws://" + l.Addr().String(),
+		DialTimeout: 2 * time.Second,
+	})
+
+	dialing := make(chan error, 1)
+	go func() { dialing <- sink.Write(&libprobe.TCPResult{}) }()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Writes during the dial queue their frame without waiting for it.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sink.Write(&libprobe.TCPResult{}))
+	}
+	require.True(t, time.Since(start) < time.Second)
+	pending, _ := sink.Pending()
+	require.Equal(t, 4, pending)
+
+	require.Error(t, <-dialing)
+	pending, dropped := sink.Pending()
+	require.Equal(t, 4, pending)
+	require.Zero(t, dropped)
+}
+
+// acceptWebSocket accepts a connection on l and completes the opening
+// handshake, leaving the rest of the conversation to the test.
+func acceptWebSocket(t *testing.T, l net.Listener) (net.Conn, *bufio.Reader) {
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	require.NoError(t, err)
+	h := sha1.New()
+	h.Write([]byte(req.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h.Sum(nil)) + "\r\n\r\n"))
+	require.NoError(t, err)
+	return conn, br
+}
+
+func TestWebSocketSinkStalled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	sink := libprobe.NewWebSocketSink(libprobe.WebSocketSinkOptions{
+		URL:         "ws://" + l.Addr().String(),
+		DialTimeout: 100 * time.Millisecond,
+	})
+	defer sink.Close()
+
+	// The server never reads, the frames pile up until the socket buffers
+	// are full and a write times out.
+	errs := make(chan error, 1)
+	go func() {
+		big := libprobe.Target{Address: "1.1.1.1:80", Metadata: map[string]string{"pad": strings.Repeat("x", 1<<20)}}
+		var err error
+		for i := 0; i < 64 && err == nil; i++ {
+			err = sink.Write(&libprobe.TCPResult{Target: big})
+		}
+		errs <- err
+	}()
+	stalled, _ := acceptWebSocket(t, l)
+	defer stalled.Close()
+	var werr error
+	select {
+	case werr = <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked on a stalled receiver")
+	}
+	var nerr net.Error
+	require.ErrorAs(t, werr, &nerr)
+	require.True(t, nerr.Timeout())
+	pending, dropped := sink.Pending()
+	require.Equal(t, 1, pending)
+	require.Zero(t, dropped)
+
+	// The next write reconnects and sends the backlog.
+	go func() { _ = sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "1.1.1.1:80"}}) }()
+	conn, br := acceptWebSocket(t, l)
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for i := 0; i < 2; i++ {
+		op, _, err := readTestFrame(br)
+		require.NoError(t, err)
+		require.Equal(t, byte(0x1), op)
+	}
+}
+
+func TestWebSocketSinkPing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	sink := libprobe.NewWebSocketSink(libprobe.WebSocketSinkOptions{URL: "ws://" + l.Addr().String()})
+	defer sink.Close()
+	go func() { _ = sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "1.1.1.1:80"}}) }()
+	conn, br := acceptWebSocket(t, l)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	op, _, err := readTestFrame(br)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x1), op)
+
+	_, err = conn.Write([]byte{0x89, 2, 'h', 'i'})
+	require.NoError(t, err)
+	op, msg, err := readTestFrame(br)
+	require.NoError(t, err)
+	require.Equal(t, byte(0xa), op)
+	require.Equal(t, "hi", string(msg))
+
+	// A close frame is echoed and drops the connection, writes reconnect.
+	_, err = conn.Write([]byte{0x88, 2, 0x03, 0xe8})
+	require.NoError(t, err)
+	op, _, err = readTestFrame(br)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x8), op)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				_ = sink.Write(&libprobe.TCPResult{Target: libprobe.Target{Address: "1.1.1.1:80"}})
+			}
+		}
+	}()
+	again, _ := acceptWebSocket(t, l)
+	again.Close()
+}
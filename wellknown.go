@@ -0,0 +1,339 @@
+package libprobe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const KindWellKnown = "WELL_KNOWN"
+
+// WellKnownEndpoint is a standardized endpoint checked by a WellKnownProber.
+type WellKnownEndpoint int
+
+const (
+	// WellKnownSecurityTxt checks /.well-known/security.txt against RFC
+	// 9116: served over HTTPS as text/plain, with at least one Contact and
+	// a single Expires in the future.
+	WellKnownSecurityTxt WellKnownEndpoint = iota
+	// WellKnownRobotsTxt checks that /robots.txt parses.
+	WellKnownRobotsTxt
+	// WellKnownACMEChallenge checks that the HTTP-01 challenge of
+	// ACMEToken answers ACMEKeyAuthorization, as before asking a CA for a
+	// certificate.
+	WellKnownACMEChallenge
+	// WellKnownHealthz checks that HealthPath answers 200 and, when the
+	// body is a JSON object with a status, that it is healthy.
+	WellKnownHealthz
+)
+
+func (e WellKnownEndpoint) String() string {
+	switch e {
+	case WellKnownSecurityTxt:
+		return "security.txt"
+	case WellKnownRobotsTxt:
+		return "robots.txt"
+	case WellKnownACMEChallenge:
+		return "acme-challenge"
+	case WellKnownHealthz:
+		return "healthz"
+	}
+	return fmt.Sprintf("WellKnownEndpoint(%d)", int(e))
+}
+
+// wellKnownMaxBody bounds the bodies read, every endpoint is small.
+const wellKnownMaxBody = 512 << 10
+
+// WellKnownProberOptions configures a WellKnownProber.
+type WellKnownProberOptions struct {
+	Endpoint WellKnownEndpoint
+	// ACMEToken and ACMEKeyAuthorization are the token and expected key
+	// authorization of WellKnownACMEChallenge.
+	ACMEToken            string
+	ACMEKeyAuthorization string
+	// HealthPath is the path of WellKnownHealthz. Default: "/healthz".
+	HealthPath string
+}
+
+// SecurityTxt is the content of a security.txt file.
+type SecurityTxt struct {
+	Contacts           []string
+	Expires            time.Time
+	Encryption         []string
+	Acknowledgments    []string
+	Policy             []string
+	Hiring             []string
+	Canonical          []string
+	PreferredLanguages string
+	Signed             bool
+}
+
+// RobotsTxt summarizes a robots.txt file.
+type RobotsTxt struct {
+	Groups   int
+	Sitemaps []string
+	// DisallowAll is set when every crawler is disallowed from the whole
+	// site.
+	DisallowAll bool
+}
+
+type WellKnownResult struct {
+	Target
+	Error error
+
+	Endpoint   string
+	URL        string
+	StatusCode int
+	TotalTime  time.Duration
+	// Problems are the validation failures of the content.
+	Problems    []string
+	SecurityTxt *SecurityTxt
+	RobotsTxt   *RobotsTxt
+	// HealthStatus is the status reported by a JSON health endpoint.
+	HealthStatus string
+}
+
+func (r WellKnownResult) RTT() time.Duration {
+	return r.TotalTime
+}
+
+func (r WellKnownResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("%s %s: Error: %s", r.Endpoint, r.URL, r.Error)
+	}
+	return fmt.Sprintf("%s %s: %d OK, time=%s", r.Endpoint, r.URL, r.StatusCode, r.TotalTime)
+}
+
+// WellKnownProber fetches a standardized endpoint of the site whose base URL
+// is Target.Address, e.g. "https://example.com", and validates its content.
+// The probe fails on validation problems.
+type WellKnownProber struct {
+	opts WellKnownProberOptions
+}
+
+func NewWellKnownProber(opts WellKnownProberOptions) *WellKnownProber {
+	if opts.HealthPath == "" {
+		opts.HealthPath = "/healthz"
+	}
+	return &WellKnownProber{opts: opts}
+}
+
+func (p *WellKnownProber) Kind() string {
+	return KindWellKnown
+}
+
+func (p *WellKnownProber) path() (string, error) {
+	switch p.opts.Endpoint {
+	case WellKnownSecurityTxt:
+		return "/.well-known/security.txt", nil
+	case WellKnownRobotsTxt:
+		return "/robots.txt", nil
+	case WellKnownACMEChallenge:
+		if p.opts.ACMEToken == "" || strings.ContainsAny(p.opts.ACMEToken, "/?#") {
+			return "", errors.New("wellknown: invalid ACME token")
+		}
+		return "/.well-known/acme-challenge/" + p.opts.ACMEToken, nil
+	case WellKnownHealthz:
+		return p.opts.HealthPath, nil
+	}
+	return "", fmt.Errorf("wellknown: unknown endpoint %d", int(p.opts.Endpoint))
+}
+
+func (p *WellKnownProber) Probe(target Target) (Result, error) {
+	path, err := p.path()
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(target.Address)
+	if err != nil {
+		return nil, err
+	}
+	u := base.ResolveReference(&url.URL{Path: path})
+	r := &WellKnownResult{Target: target, Endpoint: p.opts.Endpoint.String(), URL: u.String()}
+
+	client := &http.Client{Timeout: target.Timeout, Transport: &http.Transport{DialContext: meteredDial(target.meter)}}
+	defer client.CloseIdleConnections()
+	startAt := time.Now()
+	resp, err := client.Get(r.URL)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, wellKnownMaxBody))
+	resp.Body.Close()
+	r.TotalTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	r.StatusCode = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		r.Error = fmt.Errorf("wellknown: %s", resp.Status)
+		return r, nil
+	}
+
+	switch p.opts.Endpoint {
+	case WellKnownSecurityTxt:
+		r.SecurityTxt, r.Problems = parseSecurityTxt(body, time.Now())
+		if resp.Request.URL.Scheme != "https" {
+			r.Problems = append(r.Problems, "not served over HTTPS")
+		}
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/plain" {
+			r.Problems = append(r.Problems, fmt.Sprintf("content type %q instead of text/plain", mediaType))
+		}
+	case WellKnownRobotsTxt:
+		r.RobotsTxt, r.Problems = parseRobotsTxt(body)
+	case WellKnownACMEChallenge:
+		if got := strings.TrimSpace(string(body)); got != p.opts.ACMEKeyAuthorization {
+			r.Problems = append(r.Problems, fmt.Sprintf("key authorization %q instead of %q", got, p.opts.ACMEKeyAuthorization))
+		}
+	case WellKnownHealthz:
+		var health struct {
+			Status *string `json:"status"`
+		}
+		if json.Unmarshal(body, &health) == nil && health.Status != nil {
+			r.HealthStatus = *health.Status
+			switch strings.ToLower(r.HealthStatus) {
+			case "ok", "pass", "up", "healthy":
+			default:
+				r.Problems = append(r.Problems, fmt.Sprintf("status %q", r.HealthStatus))
+			}
+		}
+	}
+	if len(r.Problems) > 0 {
+		r.Error = fmt.Errorf("wellknown: %s", strings.Join(r.Problems, "; "))
+	}
+	return r, nil
+}
+
+// parseSecurityTxt parses a security.txt file and returns its validation
+// problems at now.
+func parseSecurityTxt(b []byte, now time.Time) (*SecurityTxt, []string) {
+	txt := &SecurityTxt{}
+	var problems []string
+	if bytes.HasPrefix(b, []byte("-----BEGIN PGP SIGNED MESSAGE-----")) {
+		txt.Signed = true
+	}
+	var expires int
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "-----BEGIN PGP SIGNATURE-----" {
+			break
+		}
+		if line == "" || line[0] == '#' || line[0] == '-' || (txt.Signed && strings.HasPrefix(line, "Hash:")) {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			problems = append(problems, fmt.Sprintf("line %d: not a field", n))
+			continue
+		}
+		name, value := strings.ToLower(line[:i]), strings.TrimSpace(line[i+1:])
+		switch name {
+		case "contact", "encryption", "acknowledgments", "policy", "hiring", "canonical":
+			if u, err := url.Parse(value); err != nil || u.Scheme == "" {
+				problems = append(problems, fmt.Sprintf("line %d: %s is not a URI", n, line[:i]))
+				continue
+			} else if u.Scheme == "http" {
+				problems = append(problems, fmt.Sprintf("line %d: %s must not use http", n, line[:i]))
+			}
+		}
+		switch name {
+		case "contact":
+			txt.Contacts = append(txt.Contacts, value)
+		case "encryption":
+			txt.Encryption = append(txt.Encryption, value)
+		case "acknowledgments":
+			txt.Acknowledgments = append(txt.Acknowledgments, value)
+		case "policy":
+			txt.Policy = append(txt.Policy, value)
+		case "hiring":
+			txt.Hiring = append(txt.Hiring, value)
+		case "canonical":
+			txt.Canonical = append(txt.Canonical, value)
+		case "preferred-languages":
+			txt.PreferredLanguages = value
+		case "expires":
+			expires++
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("line %d: invalid Expires", n))
+				continue
+			}
+			txt.Expires = t
+		}
+	}
+	if len(txt.Contacts) == 0 {
+		problems = append(problems, "no Contact")
+	}
+	switch {
+	case expires == 0:
+		problems = append(problems, "no Expires")
+	case expires > 1:
+		problems = append(problems, "several Expires")
+	case !txt.Expires.IsZero() && txt.Expires.Before(now):
+		problems = append(problems, "expired on "+txt.Expires.Format(time.RFC3339))
+	}
+	return txt, problems
+}
+
+// parseRobotsTxt parses a robots.txt file.
+func parseRobotsTxt(b []byte) (*RobotsTxt, []string) {
+	txt := &RobotsTxt{}
+	var problems []string
+	var agents []string
+	inRules := false
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			problems = append(problems, fmt.Sprintf("line %d: not a rule", n))
+			continue
+		}
+		name, value := strings.ToLower(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:])
+		switch name {
+		case "user-agent":
+			// Consecutive user agents share a group.
+			if inRules || len(agents) == 0 {
+				agents = nil
+				txt.Groups++
+			}
+			inRules = false
+			agents = append(agents, value)
+		case "allow", "disallow":
+			if len(agents) == 0 {
+				problems = append(problems, fmt.Sprintf("line %d: %s outside of a group", n, line[:i]))
+				continue
+			}
+			inRules = true
+			if name == "disallow" && value == "/" {
+				for _, agent := range agents {
+					if agent == "*" {
+						txt.DisallowAll = true
+					}
+				}
+			}
+		case "sitemap":
+			txt.Sitemaps = append(txt.Sitemaps, value)
+		}
+	}
+	return txt, problems
+}
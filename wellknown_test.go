@@ -0,0 +1,83 @@
+package libprobe_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWellKnownProber(t *testing.T) {
+	expires := time.Now().Add(30 * 24 * time.Hour).UTC().Format(time.RFC3339)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/security.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "# Our policy\nContact: mailto:security@example.com\nContact: https://example.com/report\nExpires: "+expires+"\nPreferred-Languages: en, fr\n")
+	})
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "User-agent: BadBot\nUser-agent: *\nDisallow: /\n\nUser-agent: Googlebot\nAllow: /\n\nSitemap: https://example.com/sitemap.xml\n")
+	})
+	mux.HandleFunc("/.well-known/acme-challenge/tok3n", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tok3n.thumbprint\n")
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"status": "degraded"}`)
+	})
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	probe := func(opts libprobe.WellKnownProberOptions) *libprobe.WellKnownResult {
+		r, err := libprobe.NewWellKnownProber(opts).Probe(libprobe.Target{Address: server.URL, Timeout: 5 * time.Second})
+		require.NoError(t, err)
+		return r.(*libprobe.WellKnownResult)
+	}
+
+	res := probe(libprobe.WellKnownProberOptions{Endpoint: libprobe.WellKnownSecurityTxt})
+	require.Equal(t, []string{"not served over HTTPS"}, res.Problems)
+	require.Equal(t, []string{"mailto:security@example.com", "https://example.com/report"}, res.SecurityTxt.Contacts)
+	require.Equal(t, expires, res.SecurityTxt.Expires.Format(time.RFC3339))
+	require.Equal(t, "en, fr", res.SecurityTxt.PreferredLanguages)
+
+	res = probe(libprobe.WellKnownProberOptions{Endpoint: libprobe.WellKnownRobotsTxt})
+	require.NoError(t, res.Error)
+	require.Equal(t, &libprobe.RobotsTxt{Groups: 2, Sitemaps: []string{"https://example.com/sitemap.xml"}, DisallowAll: true}, res.RobotsTxt)
+
+	res = probe(libprobe.WellKnownProberOptions{Endpoint: libprobe.WellKnownACMEChallenge, ACMEToken: "tok3n", ACMEKeyAuthorization: "tok3n.thumbprint"})
+	require.NoError(t, res.Error)
+	res = probe(libprobe.WellKnownProberOptions{Endpoint: libprobe.WellKnownACMEChallenge, ACMEToken: "tok3n", ACMEKeyAuthorization: "tok3n.other"})
+	require.Error(t, res.Error)
+	res = probe(libprobe.WellKnownProberOptions{Endpoint: libprobe.WellKnownACMEChallenge, ACMEToken: "missing", ACMEKeyAuthorization: "x"})
+	require.Equal(t, 404, res.StatusCode)
+	require.Error(t, res.Error)
+
+	res = probe(libprobe.WellKnownProberOptions{Endpoint: libprobe.WellKnownHealthz})
+	require.Error(t, res.Error)
+	require.Equal(t, "degraded", res.HealthStatus)
+	res = probe(libprobe.WellKnownProberOptions{Endpoint: libprobe.WellKnownHealthz, HealthPath: "/livez"})
+	require.NoError(t, res.Error)
+}
+
+func TestWellKnownSecurityTxtProblems(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "Contact: security@example.com\nExpires: 2001-01-01T00:00:00Z\nPolicy: http://example.com/policy\n")
+	}))
+	defer server.Close()
+	r, err := libprobe.NewWellKnownProber(libprobe.WellKnownProberOptions{}).Probe(libprobe.Target{Address: server.URL, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"line 1: Contact is not a URI",
+		"line 3: Policy must not use http",
+		"no Contact",
+		"expired on 2001-01-01T00:00:00Z",
+		"not served over HTTPS",
+		`content type "text/html" instead of text/plain`,
+	}, r.(*libprobe.WellKnownResult).Problems)
+}
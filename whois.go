@@ -0,0 +1,356 @@
+package libprobe
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const KindWHOIS = "WHOIS"
+
+// whoisIANA is the WHOIS server referring to those of every TLD and address
+// registry.
+const whoisIANA = "whois.iana.org:43"
+
+// whoisMaxResponse bounds the responses read, WHOIS records and RDAP
+// objects being a few kilobytes.
+const whoisMaxResponse = 1 << 20
+
+// whoisDateLayouts are the date formats of WHOIS servers, most of them
+// following the RDAP-like layout mandated by ICANN.
+var whoisDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02",
+	"2006.01.02",
+	"2006/01/02",
+	"02-Jan-2006",
+	"02.01.2006",
+}
+
+// WHOISProberOptions configures a WHOISProber.
+type WHOISProberOptions struct {
+	// RDAP queries over RDAP (RFC 9082) rather than WHOIS on port 43.
+	RDAP bool
+	// Server is the WHOIS server, "host" or "host:port", or the base URL
+	// of the RDAP service, e.g. "https://rdap.verisign.com/com/v1/".
+	// Default: the server whois.iana.org refers to, or the RDAP bootstrap
+	// service of rdap.org.
+	Server string
+	// MinDaysUntilExpiry fails the probe when the registration expires
+	// within that many days, or has no expiry date.
+	MinDaysUntilExpiry int
+}
+
+// WHOISResult describes the registration of a domain or an address.
+type WHOISResult struct {
+	Target
+	Error error
+
+	// Server is the server answering, after referrals.
+	Server string
+	// QueryTime is the time of the query to Server, TotalTime that of the
+	// referrals included.
+	QueryTime time.Duration
+	TotalTime time.Duration
+	Registrar string
+	Status    []string
+	// CreatedAt, UpdatedAt and ExpiresAt are zero when not reported.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	ExpiresAt time.Time
+	// DaysUntilExpiry is the whole days left until ExpiresAt, negative
+	// once expired.
+	DaysUntilExpiry int
+}
+
+func (r WHOISResult) RTT() time.Duration {
+	return r.QueryTime
+}
+
+func (r WHOISResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	s := fmt.Sprintf("-> %s %s in %s", r.Target.Address, r.Server, r.QueryTime)
+	if !r.ExpiresAt.IsZero() {
+		s += fmt.Sprintf(", expires in %d days", r.DaysUntilExpiry)
+	}
+	return s
+}
+
+// WHOISProber looks up the registration of the domain or IP address in
+// Target.Address, over WHOIS or RDAP, for domain expiry monitoring.
+// Target.Timeout bounds the lookup, referrals included, and defaults to ten
+// seconds.
+type WHOISProber struct {
+	opts WHOISProberOptions
+}
+
+func NewWHOISProber(opts WHOISProberOptions) *WHOISProber {
+	return &WHOISProber{opts: opts}
+}
+
+func (p *WHOISProber) Kind() string {
+	return KindWHOIS
+}
+
+func (p *WHOISProber) Probe(target Target) (Result, error) {
+	query := strings.ToLower(strings.TrimSuffix(strings.Trim(target.Address, "[]"), "."))
+	if query == "" {
+		return nil, errors.New("whois: empty query")
+	}
+	r := &WHOISResult{Target: target}
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	startAt := time.Now()
+	if p.opts.RDAP {
+		r.Error = p.rdap(r, query, timeout)
+	} else {
+		r.Error = p.whois(r, query, startAt.Add(timeout))
+	}
+	r.TotalTime = time.Since(startAt)
+	if r.Error != nil {
+		return r, nil
+	}
+	if !r.ExpiresAt.IsZero() {
+		r.DaysUntilExpiry = int(math.Floor(time.Until(r.ExpiresAt).Hours() / 24))
+	}
+	if p.opts.MinDaysUntilExpiry > 0 {
+		switch {
+		case r.ExpiresAt.IsZero():
+			r.Error = fmt.Errorf("whois: no expiry date for %s", query)
+		case r.DaysUntilExpiry < p.opts.MinDaysUntilExpiry:
+			r.Error = fmt.Errorf("whois: %s expires in %d days, on %s", query, r.DaysUntilExpiry, r.ExpiresAt.Format("2006-01-02"))
+		}
+	}
+	return r, nil
+}
+
+// whois queries the WHOIS server, by default the one IANA refers to.
+func (p *WHOISProber) whois(r *WHOISResult, query string, deadline time.Time) error {
+	server := p.opts.Server
+	if server == "" {
+		response, _, err := whoisQuery(r.meter, whoisIANA, query, deadline)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(response, "\n") {
+			if key, value, ok := whoisField(line); ok && (key == "refer" || key == "whois") {
+				server = value
+				break
+			}
+		}
+		if server == "" {
+			return fmt.Errorf("whois: no WHOIS server for %s", query)
+		}
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "43")
+	}
+	r.Server = server
+	response, rtt, err := whoisQuery(r.meter, server, query, deadline)
+	if err != nil {
+		return err
+	}
+	r.QueryTime = rtt
+	return parseWHOIS(r, query, response)
+}
+
+// whoisQuery sends query to server and reads the response, until the server
+// closes the connection.
+func whoisQuery(meter *trafficMeter, server, query string, deadline time.Time) (string, time.Duration, error) {
+	startAt := time.Now()
+	conn, err := dialTimeout(meter, "tcp", server, time.Until(deadline))
+	if err != nil {
+		return "", 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(deadline)
+	if _, err := conn.Write([]byte(query + "\r\n")); err != nil {
+		return "", 0, err
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(conn, whoisMaxResponse))
+	if err != nil {
+		return "", 0, err
+	}
+	return string(b), time.Since(startAt), nil
+}
+
+// whoisField splits a "key: value" line, lowercasing key.
+func whoisField(line string) (string, string, bool) {
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return "", "", false
+	}
+	key := strings.ToLower(strings.TrimSpace(line[:i]))
+	value := strings.TrimSpace(line[i+1:])
+	return key, value, value != ""
+}
+
+// parseWHOIS parses the fields of a WHOIS record. The formats vary between
+// registries: the first of the known names of each field is used.
+func parseWHOIS(r *WHOISResult, query, response string) error {
+	s := bufio.NewScanner(strings.NewReader(response))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		// Notices follow the record, e.g. ">>> Last update of WHOIS database".
+		if strings.HasPrefix(line, ">>>") {
+			break
+		}
+		lower := strings.ToLower(line)
+		if strings.HasPrefix(lower, "no match") || strings.HasPrefix(lower, "not found") || strings.HasPrefix(lower, "no data found") || strings.HasPrefix(lower, "no entries found") {
+			return fmt.Errorf("whois: %s not found", query)
+		}
+		key, value, ok := whoisField(line)
+		if !ok {
+			continue
+		}
+		switch key {
+		case "registrar", "sponsoring registrar":
+			if r.Registrar == "" {
+				r.Registrar = value
+			}
+		case "domain status", "status":
+			r.Status = append(r.Status, strings.Fields(value)[0])
+		case "creation date", "created", "created on", "registered", "registered on", "registration time":
+			whoisDate(&r.CreatedAt, value)
+		case "updated date", "last updated", "last updated on", "last-update", "last modified", "changed":
+			whoisDate(&r.UpdatedAt, value)
+		case "registry expiry date", "registrar registration expiration date", "expiration date",
+			"expiry date", "expires", "expires on", "expire date", "paid-till", "expiration time":
+			whoisDate(&r.ExpiresAt, value)
+		}
+	}
+	return s.Err()
+}
+
+// whoisDate sets t to the date in value, unless already set.
+func whoisDate(t *time.Time, value string) {
+	if !t.IsZero() {
+		return
+	}
+	for _, layout := range whoisDateLayouts {
+		if d, err := time.Parse(layout, value); err == nil {
+			*t = d
+			return
+		}
+	}
+}
+
+// rdapObject holds the fields of RDAP domain and IP network objects read.
+type rdapObject struct {
+	Status []string `json:"status"`
+	Events []struct {
+		Action string `json:"eventAction"`
+		Date   string `json:"eventDate"`
+	} `json:"events"`
+	Entities []struct {
+		Roles      []string          `json:"roles"`
+		VCardArray []json.RawMessage `json:"vcardArray"`
+	} `json:"entities"`
+}
+
+// rdap looks up query with RDAP, as a domain or an IP network.
+func (p *WHOISProber) rdap(r *WHOISResult, query string, timeout time.Duration) error {
+	server := p.opts.Server
+	if server == "" {
+		server = "https://rdap.org/"
+	}
+	if !strings.HasSuffix(server, "/") {
+		server += "/"
+	}
+	base, err := url.Parse(server)
+	if err != nil {
+		return err
+	}
+	path := "domain/" + query
+	if ip := net.ParseIP(query); ip != nil {
+		path = "ip/" + ip.String()
+	}
+	u := base.ResolveReference(&url.URL{Path: path})
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+
+	client := &http.Client{Timeout: timeout, Transport: &http.Transport{DialContext: meteredDial(r.meter)}}
+	defer client.CloseIdleConnections()
+	startAt := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, whoisMaxResponse))
+	resp.Body.Close()
+	r.QueryTime = time.Since(startAt)
+	r.Server = resp.Request.URL.String()
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return fmt.Errorf("rdap: %s not found", query)
+	default:
+		return fmt.Errorf("rdap: %s", resp.Status)
+	}
+	var object rdapObject
+	if err := json.Unmarshal(body, &object); err != nil {
+		return fmt.Errorf("rdap: %w", err)
+	}
+	r.Status = object.Status
+	for _, e := range object.Events {
+		t, err := time.Parse(time.RFC3339, e.Date)
+		if err != nil {
+			continue
+		}
+		switch e.Action {
+		case "registration":
+			r.CreatedAt = t
+		case "last changed":
+			r.UpdatedAt = t
+		case "expiration":
+			r.ExpiresAt = t
+		}
+	}
+	for _, entity := range object.Entities {
+		if stringsContain(entity.Roles, "registrar") {
+			r.Registrar = rdapFullName(entity.VCardArray)
+		}
+	}
+	return nil
+}
+
+// rdapFullName returns the "fn" property of a jCard (RFC 7095).
+func rdapFullName(vcard []json.RawMessage) string {
+	if len(vcard) < 2 {
+		return ""
+	}
+	var properties [][]interface{}
+	if json.Unmarshal(vcard[1], &properties) != nil {
+		return ""
+	}
+	for _, property := range properties {
+		if len(property) >= 4 && property[0] == "fn" {
+			if name, ok := property[3].(string); ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
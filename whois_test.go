@@ -0,0 +1,102 @@
+package libprobe_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWHOISProber(t *testing.T) {
+	expiresAt := time.Now().UTC().AddDate(0, 0, 10).Truncate(time.Second)
+	server := serveLegacy(t, func(conn net.Conn) {
+		query, _ := bufio.NewReader(conn).ReadString('\n')
+		if strings.TrimSpace(query) != "example.com" {
+			fmt.Fprintf(conn, "No match for %q.\r\n>>> Last update of whois database: 2026-10-16T14:17:34Z <<<\r\n", strings.TrimSpace(query))
+			return
+		}
+		fmt.Fprintf(conn, "   Domain Name: EXAMPLE.COM\r\n"+
+			"   Registrar: RESERVED-Internet Assigned Numbers Authority\r\n"+
+			"   Updated Date: 2026-08-14T07:01:34Z\r\n"+
+			"   Creation Date: 1995-08-14T04:00:00Z\r\n"+
+			"   Registry Expiry Date: %s\r\n"+
+			"   Domain Status: clientDeleteProhibited https://icann.org/epp#clientDeleteProhibited\r\n"+
+			"   Domain Status: clientTransferProhibited https://icann.org/epp#clientTransferProhibited\r\n"+
+			">>> Last update of whois database: 2026-10-16T14:17:34Z <<<\r\n"+
+			"Registry Expiry Date: 1970-01-01\r\n", expiresAt.Format(time.RFC3339))
+	})
+
+	p := libprobe.NewWHOISProber(libprobe.WHOISProberOptions{Server: server})
+	require.Equal(t, libprobe.KindWHOIS, p.Kind())
+	r, err := p.Probe(libprobe.Target{Address: "Example.com.", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.WHOISResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, server, res.Server)
+	require.Equal(t, "RESERVED-Internet Assigned Numbers Authority", res.Registrar)
+	require.Equal(t, []string{"clientDeleteProhibited", "clientTransferProhibited"}, res.Status)
+	require.Equal(t, time.Date(1995, 8, 14, 4, 0, 0, 0, time.UTC), res.CreatedAt)
+	require.Equal(t, time.Date(2026, 8, 14, 7, 1, 34, 0, time.UTC), res.UpdatedAt)
+	require.True(t, expiresAt.Equal(res.ExpiresAt))
+	require.Equal(t, 9, res.DaysUntilExpiry)
+	require.Positive(t, res.RTT())
+
+	p = libprobe.NewWHOISProber(libprobe.WHOISProberOptions{Server: server, MinDaysUntilExpiry: 30})
+	r, err = p.Probe(libprobe.Target{Address: "example.com", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.ErrorContains(t, r.(*libprobe.WHOISResult).Error, "example.com expires in 9 days")
+
+	r, err = p.Probe(libprobe.Target{Address: "example.org", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.EqualError(t, r.(*libprobe.WHOISResult).Error, "whois: example.org not found")
+}
+
+func TestWHOISProberRDAP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/com/v1/domain/example.com" || req.Header.Get("Accept") != "application/rdap+json" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rdap+json")
+		fmt.Fprint(w, `{
+			"objectClassName": "domain",
+			"ldhName": "EXAMPLE.COM",
+			"status": ["client delete prohibited", "client transfer prohibited"],
+			"events": [
+				{"eventAction": "registration", "eventDate": "1995-08-14T04:00:00Z"},
+				{"eventAction": "expiration", "eventDate": "2099-08-13T04:00:00Z"},
+				{"eventAction": "last changed", "eventDate": "2026-08-14T07:01:34Z"}
+			],
+			"entities": [{
+				"objectClassName": "entity",
+				"roles": ["registrar"],
+				"vcardArray": ["vcard", [["version", {}, "text", "4.0"], ["fn", {}, "text", "RESERVED-Internet Assigned Numbers Authority"]]]
+			}]
+		}`)
+	}))
+	defer srv.Close()
+
+	p := libprobe.NewWHOISProber(libprobe.WHOISProberOptions{RDAP: true, Server: srv.URL + "/com/v1", MinDaysUntilExpiry: 30})
+	r, err := p.Probe(libprobe.Target{Address: "example.com", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	res := r.(*libprobe.WHOISResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, srv.URL+"/com/v1/domain/example.com", res.Server)
+	require.Equal(t, "RESERVED-Internet Assigned Numbers Authority", res.Registrar)
+	require.Equal(t, []string{"client delete prohibited", "client transfer prohibited"}, res.Status)
+	require.Equal(t, time.Date(1995, 8, 14, 4, 0, 0, 0, time.UTC), res.CreatedAt)
+	require.Equal(t, time.Date(2099, 8, 13, 4, 0, 0, 0, time.UTC), res.ExpiresAt)
+	require.Positive(t, res.DaysUntilExpiry)
+
+	r, err = p.Probe(libprobe.Target{Address: "example.net", Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.EqualError(t, r.(*libprobe.WHOISResult).Error, "rdap: example.net not found")
+}
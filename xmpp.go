@@ -0,0 +1,340 @@
+package libprobe
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const KindXMPP = "XMPP"
+
+// XMPPTLSMode selects how an XMPPProber secures its connection.
+type XMPPTLSMode int
+
+const (
+	// XMPPPlain doesn't use TLS.
+	XMPPPlain XMPPTLSMode = iota
+	// XMPPStartTLS upgrades the stream with STARTTLS.
+	XMPPStartTLS
+	// XMPPDirectTLS connects with implicit TLS (XEP-0368), as on ports 5223
+	// and 5270.
+	XMPPDirectTLS
+)
+
+// XML namespaces of RFC 6120.
+const (
+	xmppNSStream  = "http://etherx.jabber.org/streams"
+	xmppNSStreams = "urn:ietf:params:xml:ns:xmpp-streams"
+	xmppNSTLS     = "urn:ietf:params:xml:ns:xmpp-tls"
+	xmppNSSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
+)
+
+// XMPPProberOptions configures an XMPPProber.
+type XMPPProberOptions struct {
+	TLS XMPPTLSMode
+	// TLSConfig configures TLS; its ServerName defaults to Domain.
+	TLSConfig *tls.Config
+	// Server opens a server-to-server stream, as federating servers do,
+	// on port 5269 by default instead of 5222.
+	Server bool
+	// Domain is the XMPP domain the stream is opened to. Default: the host
+	// of Target.Address.
+	Domain string
+	// Username and Password, when set, authenticate a client stream with
+	// SASL PLAIN, which requires TLS.
+	Username string
+	Password string
+}
+
+// XMPPResult describes a stream opened with an XMPP server, stage by stage.
+type XMPPResult struct {
+	Target
+	Error error
+
+	ConnectTime time.Duration
+	// StreamTime is the time from opening the stream to receiving its
+	// features, that of the first stream with XMPPStartTLS.
+	StreamTime time.Duration
+	// StartTLSTime is the time of the STARTTLS negotiation,
+	// TLSHandshakeTime that of the handshake following it or of the
+	// implicit one.
+	StartTLSTime     time.Duration
+	TLSHandshakeTime time.Duration
+	AuthTime         time.Duration
+	TotalTime        time.Duration
+	StreamID         string
+	// Features are the names of the stream features, and Mechanisms the
+	// SASL mechanisms offered, after the TLS upgrade with XMPPStartTLS.
+	Features   []string
+	Mechanisms []string
+	// StartTLSRequired is set when the server requires STARTTLS.
+	StartTLSRequired bool
+	TLSVersion       string
+	Certificate      *CertificateInfo
+}
+
+func (r XMPPResult) RTT() time.Duration {
+	return r.StreamTime
+}
+
+func (r XMPPResult) String() string {
+	if r.Error != nil {
+		return fmt.Sprintf("-> %s: %v", r.Target.Address, r.Error)
+	}
+	return fmt.Sprintf("-> %s features=%s Connect: %s, Stream: %s, STARTTLS: %s, TLS Handshake: %s, Auth: %s. Total: %s",
+		r.Target.Address, strings.Join(r.Features, ","), r.ConnectTime, r.StreamTime, r.StartTLSTime, r.TLSHandshakeTime, r.AuthTime, r.TotalTime)
+}
+
+// XMPPProber opens a client or server stream with the XMPP server in
+// Target.Address, reads its features, optionally secures the stream and
+// authenticates, then closes it.
+type XMPPProber struct {
+	opts XMPPProberOptions
+}
+
+func NewXMPPProber(opts XMPPProberOptions) *XMPPProber {
+	return &XMPPProber{opts: opts}
+}
+
+func (p *XMPPProber) Kind() string {
+	return KindXMPP
+}
+
+// xmppFeatures are the stream features of RFC 6120 section 4.3.2.
+type xmppFeatures struct {
+	StartTLS *struct {
+		Required *struct{} `xml:"required"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Mechanisms *struct {
+		Mechanism []string `xml:"mechanism"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms"`
+	Others []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// xmppSession is a stream of an XMPPProber.
+type xmppSession struct {
+	conn net.Conn
+	d    *xml.Decoder
+}
+
+func (p *XMPPProber) Probe(target Target) (Result, error) {
+	if p.opts.Server && p.opts.Username != "" {
+		return nil, errors.New("xmpp: authentication applies to client streams")
+	}
+	r := &XMPPResult{Target: target}
+	address := target.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "5222"
+		switch {
+		case p.opts.Server && p.opts.TLS == XMPPDirectTLS:
+			port = "5270"
+		case p.opts.Server:
+			port = "5269"
+		case p.opts.TLS == XMPPDirectTLS:
+			port = "5223"
+		}
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	domain := p.opts.Domain
+	if domain == "" {
+		domain, _, _ = net.SplitHostPort(address)
+	}
+	startAt := time.Now()
+	conn, err := dialTimeout(target.meter, "tcp", address, target.Timeout)
+	r.ConnectTime = time.Since(startAt)
+	if err != nil {
+		r.Error = err
+		return r, nil
+	}
+	defer conn.Close()
+	if target.Timeout > 0 {
+		_ = conn.SetDeadline(startAt.Add(target.Timeout))
+	}
+	s := &xmppSession{conn: conn}
+	if p.opts.TLS == XMPPDirectTLS {
+		if r.Error = p.handshake(r, s, domain); r.Error != nil {
+			return r, nil
+		}
+	}
+	r.Error = p.stream(r, s, domain)
+	r.TotalTime = time.Since(startAt)
+	return r, nil
+}
+
+// handshake secures the session with TLS.
+func (p *XMPPProber) handshake(r *XMPPResult, s *xmppSession, domain string) error {
+	handshakeAt := time.Now()
+	tlsConn := tls.Client(s.conn, mailTLSConfig(p.opts.TLSConfig, domain))
+	err := tlsConn.Handshake()
+	r.TLSHandshakeTime = time.Since(handshakeAt)
+	if err != nil {
+		return err
+	}
+	state := tlsConn.ConnectionState()
+	r.TLSVersion = tlsVersionName(state.Version)
+	r.Certificate = newCertificateInfo(state.PeerCertificates[0])
+	s.conn = tlsConn
+	return nil
+}
+
+func (p *XMPPProber) stream(r *XMPPResult, s *xmppSession, domain string) error {
+	streamAt := time.Now()
+	features, err := p.open(r, s, domain)
+	if err != nil {
+		return err
+	}
+	r.StreamTime = time.Since(streamAt)
+	if p.opts.TLS == XMPPStartTLS {
+		if features.StartTLS == nil {
+			return errors.New("xmpp: the server doesn't offer STARTTLS")
+		}
+		startTLSAt := time.Now()
+		if _, err := fmt.Fprintf(s.conn, "<starttls xmlns='%s'/>", xmppNSTLS); err != nil {
+			return err
+		}
+		e, err := s.next()
+		if err != nil {
+			return err
+		}
+		if e.Name.Local != "proceed" {
+			return fmt.Errorf("xmpp: STARTTLS %s", e.Name.Local)
+		}
+		r.StartTLSTime = time.Since(startTLSAt)
+		if err := p.handshake(r, s, domain); err != nil {
+			return err
+		}
+		if features, err = p.open(r, s, domain); err != nil {
+			return err
+		}
+	}
+	if p.opts.Username != "" {
+		if r.TLSVersion == "" {
+			return errors.New("xmpp: refusing to authenticate without TLS")
+		}
+		if features.Mechanisms == nil || !stringsContain(features.Mechanisms.Mechanism, "PLAIN") {
+			return errors.New("xmpp: the server doesn't offer SASL PLAIN")
+		}
+		authAt := time.Now()
+		credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + p.opts.Username + "\x00" + p.opts.Password))
+		if _, err := fmt.Fprintf(s.conn, "<auth xmlns='%s' mechanism='PLAIN'>%s</auth>", xmppNSSASL, credentials); err != nil {
+			return err
+		}
+		e, err := s.next()
+		if err != nil {
+			return err
+		}
+		switch e.Name.Local {
+		case "success":
+			if err := s.d.Skip(); err != nil {
+				return err
+			}
+		case "failure":
+			var failure struct {
+				Condition []struct {
+					XMLName xml.Name
+				} `xml:",any"`
+			}
+			if err := s.d.DecodeElement(&failure, &e); err != nil {
+				return err
+			}
+			if len(failure.Condition) > 0 {
+				return fmt.Errorf("xmpp: authentication failed: %s", failure.Condition[0].XMLName.Local)
+			}
+			return errors.New("xmpp: authentication failed")
+		default:
+			return fmt.Errorf("xmpp: unexpected %s", e.Name.Local)
+		}
+		r.AuthTime = time.Since(authAt)
+	}
+	_, err = fmt.Fprint(s.conn, "</stream:stream>")
+	return err
+}
+
+// open opens a stream on the connection of s and returns its features.
+func (p *XMPPProber) open(r *XMPPResult, s *xmppSession, domain string) (*xmppFeatures, error) {
+	ns := "jabber:client"
+	if p.opts.Server {
+		ns = "jabber:server"
+	}
+	var to strings.Builder
+	_ = xml.EscapeText(&to, []byte(domain))
+	if _, err := fmt.Fprintf(s.conn, "<?xml version='1.0'?><stream:stream to='%s' version='1.0' xmlns='%s' xmlns:stream='%s'>", to.String(), ns, xmppNSStream); err != nil {
+		return nil, err
+	}
+	s.d = xml.NewDecoder(s.conn)
+	e, err := s.next()
+	if err != nil {
+		return nil, err
+	}
+	if e.Name.Space != xmppNSStream || e.Name.Local != "stream" {
+		return nil, fmt.Errorf("xmpp: unexpected %s", e.Name.Local)
+	}
+	for _, a := range e.Attr {
+		if a.Name.Local == "id" {
+			r.StreamID = a.Value
+		}
+	}
+	if e, err = s.next(); err != nil {
+		return nil, err
+	}
+	if e.Name.Space != xmppNSStream || e.Name.Local != "features" {
+		return nil, fmt.Errorf("xmpp: unexpected %s", e.Name.Local)
+	}
+	var features xmppFeatures
+	if err := s.d.DecodeElement(&features, &e); err != nil {
+		return nil, err
+	}
+	r.Features, r.Mechanisms, r.StartTLSRequired = nil, nil, false
+	if features.StartTLS != nil {
+		r.Features = append(r.Features, "starttls")
+		r.StartTLSRequired = features.StartTLS.Required != nil
+	}
+	if features.Mechanisms != nil {
+		r.Features = append(r.Features, "mechanisms")
+		r.Mechanisms = features.Mechanisms.Mechanism
+	}
+	for _, f := range features.Others {
+		r.Features = append(r.Features, f.XMLName.Local)
+	}
+	return &features, nil
+}
+
+// next returns the next element opened by the server, turning stream
+// errors into errors.
+func (s *xmppSession) next() (xml.StartElement, error) {
+	for {
+		t, err := s.d.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if t.Name.Space != xmppNSStream || t.Name.Local != "error" {
+				return t, nil
+			}
+			var streamErr struct {
+				Conditions []struct {
+					XMLName xml.Name
+				} `xml:",any"`
+			}
+			if err := s.d.DecodeElement(&streamErr, &t); err != nil {
+				return xml.StartElement{}, err
+			}
+			for _, c := range streamErr.Conditions {
+				if c.XMLName.Space == xmppNSStreams && c.XMLName.Local != "text" {
+					return xml.StartElement{}, fmt.Errorf("xmpp: stream error %s", c.XMLName.Local)
+				}
+			}
+			return xml.StartElement{}, errors.New("xmpp: stream error")
+		case xml.EndElement:
+			return xml.StartElement{}, errors.New("xmpp: stream closed by the server")
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package libprobe_test
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveXMPP serves client streams offering required STARTTLS, then SASL
+// PLAIN accepting user and secret.
+func serveXMPP(t *testing.T, config *tls.Config) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fakeXMPP(conn, config)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func fakeXMPP(conn net.Conn, config *tls.Config) {
+	d := xml.NewDecoder(conn)
+	secure := false
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return
+		}
+		e, ok := t.(xml.StartElement)
+		if !ok {
+			if _, end := t.(xml.EndElement); end {
+				fmt.Fprint(conn, "</stream:stream>")
+				return
+			}
+			continue
+		}
+		switch e.Name.Local {
+		case "stream":
+			fmt.Fprint(conn, "<?xml version='1.0'?><stream:stream from='example.com' id='s1' version='1.0' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'><stream:features>")
+			if secure {
+				fmt.Fprint(conn, "<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>SCRAM-SHA-1</mechanism><mechanism>PLAIN</mechanism></mechanisms>")
+			} else {
+				fmt.Fprint(conn, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls>")
+			}
+			fmt.Fprint(conn, "<sm xmlns='urn:xmpp:sm:3'/></stream:features>")
+		case "starttls":
+			fmt.Fprint(conn, "<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+			tlsConn := tls.Server(conn, config)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn, d, secure = tlsConn, xml.NewDecoder(tlsConn), true
+		case "auth":
+			var credentials string
+			if d.DecodeElement(&credentials, &e) != nil {
+				return
+			}
+			if credentials != base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")) {
+				fmt.Fprint(conn, "<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><not-authorized/></failure>")
+				continue
+			}
+			fmt.Fprint(conn, "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+		}
+	}
+}
+
+func TestXMPPProber(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	clientConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	target := libprobe.Target{Address: serveXMPP(t, srv.TLS), Timeout: 5 * time.Second}
+
+	p := libprobe.NewXMPPProber(libprobe.XMPPProberOptions{
+		TLS:       libprobe.XMPPStartTLS,
+		TLSConfig: clientConfig,
+		Domain:    "example.com",
+		Username:  "user",
+		Password:  "secret",
+	})
+	require.Equal(t, libprobe.KindXMPP, p.Kind())
+	r, err := p.Probe(target)
+	require.NoError(t, err)
+	res := r.(*libprobe.XMPPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, "s1", res.StreamID)
+	require.Equal(t, []string{"mechanisms", "sm"}, res.Features)
+	require.Equal(t, []string{"SCRAM-SHA-1", "PLAIN"}, res.Mechanisms)
+	require.Equal(t, "TLS 1.3", res.TLSVersion)
+	require.NotNil(t, res.Certificate)
+	require.Positive(t, res.StreamTime)
+	require.Positive(t, res.StartTLSTime)
+	require.Positive(t, res.AuthTime)
+	require.GreaterOrEqual(t, res.TotalTime, res.ConnectTime+res.StreamTime+res.StartTLSTime+res.TLSHandshakeTime+res.AuthTime)
+
+	// Without STARTTLS, the features of the plain stream are reported.
+	r, err = libprobe.NewXMPPProber(libprobe.XMPPProberOptions{Domain: "example.com"}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.XMPPResult)
+	require.NoError(t, res.Error)
+	require.Equal(t, []string{"starttls", "sm"}, res.Features)
+	require.True(t, res.StartTLSRequired)
+	require.Empty(t, res.TLSVersion)
+
+	r, err = libprobe.NewXMPPProber(libprobe.XMPPProberOptions{
+		TLS:       libprobe.XMPPStartTLS,
+		TLSConfig: clientConfig,
+		Domain:    "example.com",
+		Username:  "user",
+		Password:  "wrong",
+	}).Probe(target)
+	require.NoError(t, err)
+	res = r.(*libprobe.XMPPResult)
+	require.EqualError(t, res.Error, "xmpp: authentication failed: not-authorized")
+
+	_, err = libprobe.NewXMPPProber(libprobe.XMPPProberOptions{Server: true, Username: "user"}).Probe(target)
+	require.Error(t, err)
+}
@@ -0,0 +1,191 @@
+package libprobe
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ZabbixSinkOptions configures a ZabbixSink.
+type ZabbixSinkOptions struct {
+	// Server is the Zabbix server or proxy trapper address. Default port
+	// is 10051.
+	Server string
+	// Host is the host name results are reported for in Zabbix.
+	Host string
+	// KeyPrefix is prepended to item keys. Default: "libprobe".
+	KeyPrefix string
+	// Columns are additional flattened result columns sent as items, e.g.
+	// "ttfb_ns" becomes "libprobe.ttfb_ns[HTTP,https://example.com]".
+	Columns []string
+	// HostMetadata is sent by Register for active agent auto-registration.
+	HostMetadata string
+	Timeout      time.Duration
+}
+
+// ZabbixSink sends results to Zabbix trapper items using the sender protocol.
+// Every result produces the items "<prefix>.rtt[<kind>,<target>]" (RTT in
+// milliseconds) and "<prefix>.up[<kind>,<target>]" (1 or 0), plus one item
+// per configured column.
+type ZabbixSink struct {
+	opts ZabbixSinkOptions
+}
+
+func NewZabbixSink(opts ZabbixSinkOptions) *ZabbixSink {
+	if opts.KeyPrefix == "" {
+		opts.KeyPrefix = "libprobe"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if _, _, err := net.SplitHostPort(opts.Server); err != nil {
+		opts.Server = net.JoinHostPort(opts.Server, "10051")
+	}
+	return &ZabbixSink{opts: opts}
+}
+
+// ZabbixValue is a single item value in a sender data request.
+type ZabbixValue struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+	NS    int64  `json:"ns"`
+}
+
+type zabbixRequest struct {
+	Request      string        `json:"request"`
+	Data         []ZabbixValue `json:"data,omitempty"`
+	Host         string        `json:"host,omitempty"`
+	HostMetadata string        `json:"host_metadata,omitempty"`
+	Clock        int64         `json:"clock,omitempty"`
+	NS           int64         `json:"ns,omitempty"`
+}
+
+type zabbixResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+func zabbixKeyParam(s string) string {
+	if !strings.ContainsAny(s, ",]\" ") {
+		return s
+	}
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// ZabbixValues maps a result onto item values.
+func (s *ZabbixSink) ZabbixValues(at time.Time, r Result) []ZabbixValue {
+	row := Flatten(r)[0]
+	address, _ := row[ColumnAddress].(string)
+	params := "[" + zabbixKeyParam(resultKind(r)) + "," + zabbixKeyParam(address) + "]"
+	up := "0"
+	if resultOK(r) {
+		up = "1"
+	}
+	value := func(name, v string) ZabbixValue {
+		return ZabbixValue{
+			Host:  s.opts.Host,
+			Key:   s.opts.KeyPrefix + "." + name + params,
+			Value: v,
+			Clock: at.Unix(),
+			NS:    int64(at.Nanosecond()),
+		}
+	}
+	values := []ZabbixValue{
+		value("rtt", fmt.Sprintf("%.3f", float64(r.RTT())/float64(time.Millisecond))),
+		value("up", up),
+	}
+	for _, c := range s.opts.Columns {
+		if v, ok := row[c]; ok {
+			values = append(values, value(c, formatCell(v)))
+		}
+	}
+	return values
+}
+
+func (s *ZabbixSink) send(req zabbixRequest) (zabbixResponse, error) {
+	var resp zabbixResponse
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	conn, err := net.DialTimeout("tcp", s.opts.Server, s.opts.Timeout)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+
+	packet := make([]byte, 13, 13+len(payload))
+	copy(packet, "ZBXD\x01")
+	binary.LittleEndian.PutUint64(packet[5:], uint64(len(payload)))
+	if _, err := conn.Write(append(packet, payload...)); err != nil {
+		return resp, err
+	}
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return resp, err
+	}
+	if string(header[:4]) != "ZBXD" {
+		return resp, errors.New("zabbix: invalid response header")
+	}
+	size := binary.LittleEndian.Uint32(header[5:])
+	if size > 16<<20 {
+		return resp, fmt.Errorf("zabbix: response too large (%d bytes)", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return resp, err
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+func (s *ZabbixSink) Write(r Result) error {
+	now := time.Now()
+	resp, err := s.send(zabbixRequest{
+		Request: "sender data",
+		Data:    s.ZabbixValues(now, r),
+		Clock:   now.Unix(),
+		NS:      int64(now.Nanosecond()),
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Response != "success" {
+		return fmt.Errorf("zabbix: %s: %s", resp.Response, resp.Info)
+	}
+	if strings.Contains(resp.Info, "failed: ") && !strings.Contains(resp.Info, "failed: 0;") {
+		return fmt.Errorf("zabbix: some values were rejected: %s", resp.Info)
+	}
+	return nil
+}
+
+// Register sends an active checks request carrying HostMetadata, which
+// triggers active agent auto-registration of Host on the Zabbix server.
+func (s *ZabbixSink) Register() error {
+	resp, err := s.send(zabbixRequest{
+		Request:      "active checks",
+		Host:         s.opts.Host,
+		HostMetadata: s.opts.HostMetadata,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Response != "success" {
+		return fmt.Errorf("zabbix: %s: %s", resp.Response, resp.Info)
+	}
+	return nil
+}
+
+func (s *ZabbixSink) Close() error {
+	return nil
+}
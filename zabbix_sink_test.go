@@ -0,0 +1,68 @@
+package libprobe_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blho/libprobe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newZabbixTestServer(t *testing.T, response string) (string, <-chan map[string]interface{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	requests := make(chan map[string]interface{}, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := make([]byte, 13)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.LittleEndian.Uint64(header[5:]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		var req map[string]interface{}
+		_ = json.Unmarshal(body, &req)
+		requests <- req
+		resp := make([]byte, 13)
+		copy(resp, "ZBXD\x01")
+		binary.LittleEndian.PutUint64(resp[5:], uint64(len(response)))
+		_, _ = conn.Write(append(resp, response...))
+	}()
+	return l.Addr().String(), requests
+}
+
+func TestZabbixSink(t *testing.T) {
+	addr, requests := newZabbixTestServer(t, `{"response":"success","info":"processed: 2; failed: 0; total: 2; seconds spent: 0.0001"}`)
+	sink := libprobe.NewZabbixSink(libprobe.ZabbixSinkOptions{Server: addr, Host: "agent-1"})
+	require.NoError(t, sink.Write(&libprobe.TCPResult{
+		Target:      libprobe.Target{Address: "1.1.1.1:80"},
+		ConnectTime: 1500 * time.Microsecond,
+	}))
+	req := <-requests
+	require.Equal(t, "sender data", req["request"])
+	data := req["data"].([]interface{})
+	require.Len(t, data, 2)
+	rtt := data[0].(map[string]interface{})
+	require.Equal(t, "agent-1", rtt["host"])
+	require.Equal(t, "libprobe.rtt[TCP,1.1.1.1:80]", rtt["key"])
+	require.Equal(t, "1.500", rtt["value"])
+	require.Equal(t, "1", data[1].(map[string]interface{})["value"])
+}
+
+func TestZabbixSinkRejected(t *testing.T) {
+	addr, _ := newZabbixTestServer(t, `{"response":"success","info":"processed: 0; failed: 2; total: 2; seconds spent: 0.0001"}`)
+	sink := libprobe.NewZabbixSink(libprobe.ZabbixSinkOptions{Server: addr, Host: "agent-1"})
+	require.Error(t, sink.Write(&libprobe.TCPResult{}))
+}